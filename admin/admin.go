@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ortuman/jackal/log"
+)
+
+var (
+	srv   *http.Server
+	srvMu sync.Mutex
+)
+
+// Initialize starts serving the admin HTTP API if a listening port has been configured.
+func Initialize(cfg *Config) {
+	if cfg.Port == 0 {
+		return
+	}
+	srvMu.Lock()
+	defer srvMu.Unlock()
+	if srv != nil {
+		return
+	}
+	srv = &http.Server{Addr: fmt.Sprintf("%s:%d", cfg.BindAddress, cfg.Port), Handler: NewHandler(cfg)}
+
+	go func(srv *http.Server) {
+		log.Infof("admin api listening at %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error(err)
+		}
+	}(srv)
+}
+
+// Shutdown stops serving the admin HTTP API.
+func Shutdown() {
+	srvMu.Lock()
+	defer srvMu.Unlock()
+	if srv != nil {
+		srv.Close()
+		srv = nil
+	}
+}
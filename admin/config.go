@@ -0,0 +1,39 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package admin
+
+import "errors"
+
+// Config represents an admin HTTP API configuration.
+type Config struct {
+	BindAddress string
+	Port        int
+	Token       string
+}
+
+type configProxyType struct {
+	BindAddress string `yaml:"bind_addr"`
+	Port        int    `yaml:"port"`
+	Token       string `yaml:"token"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := configProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.Port < 0 {
+		return errors.New("admin.Config: invalid listening port")
+	}
+	if p.Port > 0 && len(p.Token) == 0 {
+		return errors.New("admin.Config: token must be specified")
+	}
+	c.BindAddress = p.BindAddress
+	c.Port = p.Port
+	c.Token = p.Token
+	return nil
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package admin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestAdminConfig(t *testing.T) {
+	cfg := Config{}
+	err := yaml.Unmarshal([]byte("{bind_addr: 127.0.0.1, port: 9091, token: s3cr3t}"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1", cfg.BindAddress)
+	require.Equal(t, 9091, cfg.Port)
+	require.Equal(t, "s3cr3t", cfg.Token)
+
+	// disabled
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("bind_addr: 127.0.0.1"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, 0, cfg.Port)
+
+	err = yaml.Unmarshal([]byte("port: 9091"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{port: -1, token: s3cr3t}"), &cfg)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,349 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	defaultSessionsLimit = 100
+	maxSessionsLimit     = 1000
+)
+
+type userRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type rosterItemResponse struct {
+	JID          string   `json:"jid"`
+	Name         string   `json:"name,omitempty"`
+	Subscription string   `json:"subscription"`
+	Ask          bool     `json:"ask"`
+	Groups       []string `json:"groups"`
+}
+
+type blockListItemResponse struct {
+	JID    string `json:"jid"`
+	Domain bool   `json:"domain"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type sessionResponse struct {
+	ID         string `json:"id"`
+	JID        string `json:"jid"`
+	Secured    bool   `json:"secured"`
+	Compressed bool   `json:"compressed"`
+	Available  bool   `json:"available"`
+	Priority   int8   `json:"priority"`
+	Show       string `json:"show,omitempty"`
+	Status     string `json:"status,omitempty"`
+}
+
+type sessionsResponse struct {
+	Total    int               `json:"total"`
+	Offset   int               `json:"offset"`
+	Sessions []sessionResponse `json:"sessions"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler represents the admin HTTP API handler.
+// Every request must carry the configured token as a bearer token.
+//
+// Supported endpoints:
+//
+//	POST   /users                      creates a user
+//	DELETE /users/{username}           deletes a user, ending all of its sessions
+//	GET    /users/{username}/roster    returns user's roster items
+//	GET    /users/{username}/blocklist returns user's block list items
+//	GET    /sessions?offset=&limit=    returns a page of authenticated sessions
+//	DELETE /sessions/{jid}             ends a session (or every user session given a bare JID)
+type Handler struct {
+	cfg *Config
+}
+
+// NewHandler returns an admin HTTP API handler.
+func NewHandler(config *Config) *Handler {
+	return &Handler{cfg: config}
+}
+
+// ServeHTTP satisfies http.Handler interface.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.isAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="jackal"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "users":
+		h.serveUsers(w, r)
+	case strings.HasPrefix(path, "users/"):
+		h.serveUser(w, r, strings.Split(path[len("users/"):], "/"))
+	case path == "sessions":
+		h.serveSessions(w, r)
+	case strings.HasPrefix(path, "sessions/"):
+		h.serveSession(w, r, path[len("sessions/"):])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) isAuthorized(r *http.Request) bool {
+	hdr := r.Header.Get("Authorization")
+	if len(hdr) < 7 || !strings.EqualFold(hdr[:7], "bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hdr[7:]), []byte(h.cfg.Token)) == 1
+}
+
+func (h *Handler) serveUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if auth.IsExternal() {
+		writeError(w, http.StatusForbidden, "users are managed by an external authentication provider")
+		return
+	}
+	var req userRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed request body")
+		return
+	}
+	username, ok := nodeprep(req.Username)
+	if !ok || len(req.Password) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid username or password")
+		return
+	}
+	user := model.User{Username: username}
+	if err := auth.SetPassword(&user, req.Password); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid username or password")
+		return
+	}
+	switch err := storage.Instance().InsertUser(&user); err {
+	case nil:
+		writeJSON(w, http.StatusCreated, map[string]string{"username": username})
+	case storage.ErrUserExists:
+		writeError(w, http.StatusConflict, "user already exists")
+	default:
+		writeInternalError(w, err)
+	}
+}
+
+func (h *Handler) serveUser(w http.ResponseWriter, r *http.Request, path []string) {
+	username, ok := nodeprep(path[0])
+	if !ok || len(path) > 2 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	exists, err := storage.Instance().UserExists(username)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	var resource string
+	if len(path) == 2 {
+		resource = path[1]
+	}
+	switch {
+	case resource == "" && r.Method == http.MethodDelete:
+		h.deleteUser(w, username)
+	case resource == "roster" && r.Method == http.MethodGet:
+		h.getRoster(w, username)
+	case resource == "blocklist" && r.Method == http.MethodGet:
+		h.getBlockList(w, username)
+	case resource == "" || resource == "roster" || resource == "blocklist":
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) deleteUser(w http.ResponseWriter, username string) {
+	if err := storage.Instance().DeleteUser(username); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	c2s.Instance().ReloadBlockList(username)
+
+	for _, stm := range userStreams(username) {
+		stm.Disconnect(streamerror.ErrNotAuthorized)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getRoster(w http.ResponseWriter, username string) {
+	items, _, err := storage.Instance().FetchRosterItems(username)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	resp := make([]rosterItemResponse, 0, len(items))
+	for _, item := range items {
+		groups := item.Groups
+		if groups == nil {
+			groups = []string{}
+		}
+		resp = append(resp, rosterItemResponse{
+			JID:          item.JID,
+			Name:         item.Name,
+			Subscription: item.Subscription,
+			Ask:          item.Ask,
+			Groups:       groups,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) getBlockList(w http.ResponseWriter, username string) {
+	items, err := storage.Instance().FetchBlockListItems(username)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	resp := make([]blockListItemResponse, 0, len(items))
+	for _, item := range items {
+		resp = append(resp, blockListItemResponse{JID: item.JID, Domain: item.Domain, Reason: item.Reason})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) serveSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	offset, ok := queryInt(r, "offset", 0)
+	if !ok || offset < 0 {
+		writeError(w, http.StatusBadRequest, "invalid offset")
+		return
+	}
+	limit, ok := queryInt(r, "limit", defaultSessionsLimit)
+	if !ok || limit <= 0 || limit > maxSessionsLimit {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	stms := c2s.Instance().AuthenticatedStreams()
+
+	resp := sessionsResponse{Total: len(stms), Offset: offset, Sessions: []sessionResponse{}}
+	if offset < len(stms) {
+		stms = stms[offset:]
+		if len(stms) > limit {
+			stms = stms[:limit]
+		}
+		for _, stm := range stms {
+			resp.Sessions = append(resp.Sessions, newSessionResponse(stm))
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) serveSession(w http.ResponseWriter, r *http.Request, jidStr string) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	jid, err := xml.NewJIDString(jidStr, false)
+	if err != nil || len(jid.Node()) == 0 || !c2s.Instance().IsLocalDomain(jid.Domain()) {
+		writeError(w, http.StatusBadRequest, "invalid session jid")
+		return
+	}
+	// a full JID ends a single session, while a bare one ends all of them
+	stms := c2s.Instance().StreamsMatchingJID(jid)
+	if len(stms) == 0 {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	for _, stm := range stms {
+		stm.Disconnect(streamerror.ErrPolicyViolation)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newSessionResponse(stm c2s.Stream) sessionResponse {
+	resp := sessionResponse{
+		ID:         stm.ID(),
+		JID:        stm.JID().String(),
+		Secured:    stm.IsSecured(),
+		Compressed: stm.IsCompressed(),
+	}
+	if p := stm.Presence(); p != nil && p.IsAvailable() {
+		resp.Available = true
+		resp.Priority = p.Priority()
+		resp.Status = p.Status()
+		if show := p.Elements().Child("show"); show != nil {
+			resp.Show = show.Text()
+		}
+	}
+	return resp
+}
+
+// userStreams returns every authenticated stream of a user within any local domain.
+func userStreams(username string) []c2s.Stream {
+	var ret []c2s.Stream
+	for _, stm := range c2s.Instance().AuthenticatedStreams() {
+		if stm.Username() == username {
+			ret = append(ret, stm)
+		}
+	}
+	return ret
+}
+
+func nodeprep(username string) (string, bool) {
+	if len(username) == 0 {
+		return "", false
+	}
+	j, err := xml.NewJID(username, c2s.Instance().DefaultLocalDomain(), "", false)
+	if err != nil {
+		return "", false
+	}
+	return j.Node(), true
+}
+
+func queryInt(r *http.Request, name string, defaultValue int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if len(v) == 0 {
+		return defaultValue, true
+	}
+	i, err := strconv.Atoi(v)
+	return i, err == nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	writeJSON(w, status, &errorResponse{Error: reason})
+}
+
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Error(err)
+	writeError(w, http.StatusInternalServerError, "internal server error")
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin_Authorization(t *testing.T) {
+	h := NewHandler(&Config{Port: 9091, Token: "s3cr3t"})
+
+	req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.NotEqual(t, "", rec.Header().Get("WWW-Authenticate"))
+
+	req.Header.Set("Authorization", "Bearer wr0ng")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAdmin_Users(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	h := NewHandler(&Config{Port: 9091, Token: "s3cr3t"})
+
+	rec := tUtilAdminRequest(h, http.MethodPost, "/users", `{"username": "Ortuman", "password": "1234"}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	user, _ := storage.Instance().FetchUser("ortuman")
+	require.NotNil(t, user)
+	require.Equal(t, "1234", user.Password)
+	require.NotEqual(t, "", user.ScramSHA256)
+
+	rec = tUtilAdminRequest(h, http.MethodPost, "/users", `{"username": "ortuman", "password": "5678"}`)
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = tUtilAdminRequest(h, http.MethodPost, "/users", `{"username": "noelia"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = tUtilAdminRequest(h, http.MethodPost, "/users", `{"username": "`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// roster and block list
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{Username: "ortuman", JID: "noelia@jackal.im", Subscription: "both", Groups: []string{"friends"}})
+	storage.Instance().InsertOrUpdateBlockListItems([]model.BlockListItem{{Username: "ortuman", JID: "romeo@jackal.im"}})
+
+	rec = tUtilAdminRequest(h, http.MethodGet, "/users/ortuman/roster", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var items []rosterItemResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&items))
+	require.Equal(t, []rosterItemResponse{{JID: "noelia@jackal.im", Subscription: "both", Groups: []string{"friends"}}}, items)
+
+	rec = tUtilAdminRequest(h, http.MethodGet, "/users/ortuman/blocklist", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var blItems []blockListItemResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&blItems))
+	require.Equal(t, []blockListItemResponse{{JID: "romeo@jackal.im"}}, blItems)
+
+	rec = tUtilAdminRequest(h, http.MethodGet, "/users/noelia/roster", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = tUtilAdminRequest(h, http.MethodPost, "/users/ortuman/roster", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	storage.ActivateMockedError()
+	rec = tUtilAdminRequest(h, http.MethodGet, "/users/ortuman/roster", "")
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	storage.DeactivateMockedError()
+
+	// deleting a user ends its sessions
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().AuthenticateStream(stm)
+
+	rec = tUtilAdminRequest(h, http.MethodDelete, "/users/ortuman", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, streamerror.ErrNotAuthorized, stm.WaitDisconnection())
+
+	exists, _ := storage.Instance().UserExists("ortuman")
+	require.False(t, exists)
+
+	rec = tUtilAdminRequest(h, http.MethodDelete, "/users/ortuman", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAdmin_Sessions(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	h := NewHandler(&Config{Port: 9091, Token: "s3cr3t"})
+
+	var stms []*c2s.MockStream
+	for _, resource := range []string{"yard", "balcony", "garden"} {
+		j, _ := xml.NewJID("ortuman", "jackal.im", resource, true)
+		stm := c2s.NewMockStream(uuid.New(), j)
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+		stms = append(stms, stm)
+	}
+	p := xml.NewElementName("presence")
+	show := xml.NewElementName("show")
+	show.SetText("away")
+	p.AppendElement(show)
+	presence, _ := xml.NewPresenceFromElement(p, stms[1].JID(), stms[1].JID())
+	stms[1].SetPresence(presence)
+
+	rec := tUtilAdminRequest(h, http.MethodGet, "/sessions?offset=0&limit=2", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp sessionsResponse
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Equal(t, 3, resp.Total)
+	require.Equal(t, 2, len(resp.Sessions))
+	require.Equal(t, "ortuman@jackal.im/balcony", resp.Sessions[0].JID)
+	require.True(t, resp.Sessions[0].Available)
+	require.Equal(t, "away", resp.Sessions[0].Show)
+	require.Equal(t, "ortuman@jackal.im/garden", resp.Sessions[1].JID)
+	require.False(t, resp.Sessions[1].Available)
+
+	rec = tUtilAdminRequest(h, http.MethodGet, "/sessions?offset=2", "")
+	resp = sessionsResponse{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Equal(t, 1, len(resp.Sessions))
+	require.Equal(t, "ortuman@jackal.im/yard", resp.Sessions[0].JID)
+
+	rec = tUtilAdminRequest(h, http.MethodGet, "/sessions?offset=5", "")
+	resp = sessionsResponse{}
+	require.Nil(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Equal(t, 3, resp.Total)
+	require.Equal(t, 0, len(resp.Sessions))
+
+	rec = tUtilAdminRequest(h, http.MethodGet, "/sessions?limit=0", "")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = tUtilAdminRequest(h, http.MethodGet, "/sessions?offset=abc", "")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// force disconnection
+	rec = tUtilAdminRequest(h, http.MethodDelete, "/sessions/ortuman@jackal.im/garden", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, streamerror.ErrPolicyViolation, stms[2].WaitDisconnection())
+	require.False(t, stms[0].IsDisconnected())
+
+	rec = tUtilAdminRequest(h, http.MethodDelete, "/sessions/ortuman@jackal.im/office", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = tUtilAdminRequest(h, http.MethodDelete, "/sessions/ortuman@example.org/garden", "")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func tUtilAdminRequest(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if len(body) > 0 {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
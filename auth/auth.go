@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// Provider represents a user authentication provider.
+type Provider interface {
+	// Authenticate returns whether or not password is valid for a given user.
+	Authenticate(username, password string) (bool, error)
+
+	// UserExists returns whether or not a user is known by the provider.
+	UserExists(username string) (bool, error)
+}
+
+// CredentialsProvider represents an authentication provider exposing
+// stored user credentials, as required by challenge-response SASL
+// mechanisms (DIGEST-MD5 and SCRAM), which never see plaintext passwords.
+type CredentialsProvider interface {
+	Provider
+
+	// FetchCredentials returns the stored credentials of a user,
+	// or nil if the user doesn't exist.
+	FetchCredentials(username string) (*model.User, error)
+}
+
+// SharedGroup represents a group whose members are
+// automatically added to each other's roster.
+type SharedGroup struct {
+	Name    string
+	Members []string
+}
+
+// GroupsProvider represents an authentication provider
+// sourcing shared roster groups.
+type GroupsProvider interface {
+	// SharedGroups returns the shared groups a user is member of.
+	SharedGroups(username string) ([]SharedGroup, error)
+}
+
+// singleton interface
+var (
+	inst        Provider
+	passwordCfg *PasswordConfig
+	instMu      sync.RWMutex
+	initialized uint32
+)
+
+// Initialize initializes authentication sub system.
+func Initialize(cfg *Config) {
+	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		pcfg := cfg.Password
+		pcfg.setDefaults()
+		passwordCfg = &pcfg
+
+		switch cfg.Type {
+		case HTTP:
+			inst = newHTTPProvider(cfg.HTTP)
+		case LDAP:
+			inst = newLDAPProvider(cfg.LDAP)
+		default:
+			inst = &storageProvider{}
+		}
+	}
+}
+
+// Instance returns the configured authentication provider.
+// Users are authenticated against storage in case
+// the sub system has not been initialized.
+func Instance() Provider {
+	instMu.RLock()
+	defer instMu.RUnlock()
+
+	if inst == nil {
+		return &storageProvider{}
+	}
+	return inst
+}
+
+// IsExternal reports whether users are authenticated against an external
+// source of truth, in which case their accounts can't be registered
+// nor their passwords changed in-band.
+func IsExternal() bool {
+	_, ok := Instance().(*storageProvider)
+	return !ok
+}
+
+// HashesPasswords reports whether or not passwords are stored hashed,
+// thus preventing every challenge-response mechanism but
+// SCRAM-SHA-256 from verifying them.
+func HashesPasswords() bool {
+	return passwordConfig().Scheme != model.PlainPasswordScheme
+}
+
+func passwordConfig() *PasswordConfig {
+	instMu.RLock()
+	defer instMu.RUnlock()
+
+	if passwordCfg == nil || len(passwordCfg.Scheme) == 0 {
+		return &PasswordConfig{Scheme: model.PlainPasswordScheme}
+	}
+	return passwordCfg
+}
+
+// Shutdown shuts down authentication sub system.
+// This method should be used only for testing purposes.
+func Shutdown() {
+	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
+		instMu.Lock()
+		defer instMu.Unlock()
+		inst = nil
+		passwordCfg = nil
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuth_Instance(t *testing.T) {
+	// not initialized... falls back to storage
+	_, ok := Instance().(CredentialsProvider)
+	require.True(t, ok)
+
+	Initialize(&Config{Type: HTTP, HTTP: &HTTPConfig{URL: "http://localhost", Timeout: 1}})
+	_, ok = Instance().(CredentialsProvider)
+	require.False(t, ok)
+	Shutdown()
+
+	Initialize(&Config{})
+	defer Shutdown()
+	_, ok = Instance().(CredentialsProvider)
+	require.True(t, ok)
+}
+
+func TestAuth_StorageProvider(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "noelia"})
+
+	p := &storageProvider{}
+
+	ok, err := p.Authenticate("ortuman", "1234")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	ok, _ = p.Authenticate("ortuman", "12345")
+	require.False(t, ok)
+
+	// users without password can't authenticate
+	ok, _ = p.Authenticate("noelia", "")
+	require.False(t, ok)
+
+	ok, _ = p.Authenticate("romeo", "1234")
+	require.False(t, ok)
+
+	exists, _ := p.UserExists("noelia")
+	require.True(t, exists)
+
+	user, _ := p.FetchCredentials("ortuman")
+	require.NotNil(t, user)
+	require.Equal(t, "1234", user.Password)
+
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+	_, err = p.Authenticate("ortuman", "1234")
+	require.Equal(t, storage.ErrMockedError, err)
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ortuman/jackal/storage/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultHTTPTimeout = 5
+
+const (
+	defaultBcryptCost    = 10
+	defaultArgon2Time    = 1
+	defaultArgon2Memory  = 64 * 1024
+	defaultArgon2Threads = 4
+)
+
+const (
+	defaultLDAPTimeout              = 5
+	defaultLDAPUserFilter           = "(objectClass=*)"
+	defaultLDAPUsernameAttribute    = "uid"
+	defaultLDAPGroupFilter          = "(objectClass=groupOfNames)"
+	defaultLDAPGroupNameAttribute   = "cn"
+	defaultLDAPGroupMemberAttribute = "member"
+	defaultLDAPGroupCacheTTL        = 300
+)
+
+// ProviderType represents an authentication provider type.
+type ProviderType int
+
+const (
+	// Storage represents a storage backed authentication provider type.
+	Storage ProviderType = iota
+
+	// HTTP represents an HTTP callback authentication provider type.
+	HTTP
+
+	// LDAP represents an LDAP authentication provider type.
+	LDAP
+)
+
+// Config represents an authentication provider configuration.
+type Config struct {
+	Type     ProviderType
+	HTTP     *HTTPConfig
+	LDAP     *LDAPConfig
+	Password PasswordConfig
+}
+
+// PasswordConfig represents stored passwords hashing configuration.
+type PasswordConfig struct {
+	// Scheme is the hashing scheme passwords are stored with: plain, bcrypt or argon2id.
+	// Passwords stored with a weaker scheme are rehashed on next login.
+	Scheme string `yaml:"scheme"`
+
+	// BcryptCost is the bcrypt hashing cost.
+	BcryptCost int `yaml:"bcrypt_cost"`
+
+	// Argon2Time is the number of argon2id passes over memory.
+	Argon2Time uint32 `yaml:"argon2_time"`
+
+	// Argon2Memory is the argon2id memory size in KiB.
+	Argon2Memory uint32 `yaml:"argon2_memory"`
+
+	// Argon2Threads is the argon2id degree of parallelism.
+	Argon2Threads uint8 `yaml:"argon2_threads"`
+}
+
+// HTTPConfig represents HTTP callback authentication provider configuration.
+type HTTPConfig struct {
+	// URL is the callback endpoints base URL.
+	URL string `yaml:"url"`
+
+	// Secret, if set, is sent along with every request as a bearer token.
+	Secret string `yaml:"secret"`
+
+	// Timeout is the maximum time (in seconds) a request is allowed to take.
+	Timeout int `yaml:"timeout"`
+}
+
+// LDAPConfig represents LDAP authentication provider configuration.
+type LDAPConfig struct {
+	// Address is the LDAP server address (host:port).
+	Address string `yaml:"address"`
+
+	// TLS enables LDAP over TLS (ldaps) connections.
+	TLS bool `yaml:"tls"`
+
+	// BindDN and BindPassword are the credentials used to look up users and groups.
+	// Searches are performed anonymously if not set.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+
+	// BaseDN is the users search base.
+	BaseDN string `yaml:"base_dn"`
+
+	// UserDNTemplate is the DN users bind with, '%s' standing for the username
+	// (e.g. uid=%s,ou=people,dc=example,dc=org).
+	UserDNTemplate string `yaml:"user_dn_template"`
+
+	// UserFilter restricts the entries considered users.
+	UserFilter string `yaml:"user_filter"`
+
+	// UsernameAttribute is the attribute holding the username.
+	UsernameAttribute string `yaml:"username_attr"`
+
+	// SharedRoster populates users roster with their LDAP groups members.
+	SharedRoster bool `yaml:"shared_roster"`
+
+	// GroupBaseDN is the groups search base (defaults to BaseDN).
+	GroupBaseDN string `yaml:"group_base_dn"`
+
+	// GroupFilter restricts the entries considered groups.
+	GroupFilter string `yaml:"group_filter"`
+
+	// GroupNameAttribute is the attribute holding the group name.
+	GroupNameAttribute string `yaml:"group_name_attr"`
+
+	// GroupMemberAttribute is the attribute holding group members,
+	// either as usernames or as user DNs.
+	GroupMemberAttribute string `yaml:"group_member_attr"`
+
+	// GroupCacheTTL is the time (in seconds) group membership is cached.
+	GroupCacheTTL int `yaml:"group_cache_ttl"`
+
+	// Timeout is the maximum time (in seconds) a request is allowed to take.
+	Timeout int `yaml:"timeout"`
+}
+
+type configProxyType struct {
+	Type     string          `yaml:"type"`
+	HTTP     *HTTPConfig     `yaml:"http"`
+	LDAP     *LDAPConfig     `yaml:"ldap"`
+	Password *PasswordConfig `yaml:"password"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := configProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	switch p.Type {
+	case "storage", "":
+		c.Type = Storage
+
+	case "http":
+		if p.HTTP == nil || len(p.HTTP.URL) == 0 {
+			return errors.New("auth.Config: http provider requires url")
+		}
+		c.Type = HTTP
+
+		c.HTTP = p.HTTP
+		if c.HTTP.Timeout == 0 {
+			c.HTTP.Timeout = defaultHTTPTimeout
+		}
+
+	case "ldap":
+		if p.LDAP == nil {
+			return errors.New("auth.Config: couldn't read LDAP configuration")
+		}
+		if err := p.LDAP.setDefaults(); err != nil {
+			return err
+		}
+		c.Type = LDAP
+		c.LDAP = p.LDAP
+
+	default:
+		return fmt.Errorf("auth.Config: unrecognized provider type: %s", p.Type)
+	}
+	if p.Password != nil {
+		c.Password = *p.Password
+	}
+	return c.Password.setDefaults()
+}
+
+func (c *PasswordConfig) setDefaults() error {
+	switch c.Scheme {
+	case "plain", "":
+		c.Scheme = model.PlainPasswordScheme
+	case model.BcryptPasswordScheme, model.Argon2idPasswordScheme:
+		break
+	default:
+		return fmt.Errorf("auth.PasswordConfig: unrecognized password scheme: %s", c.Scheme)
+	}
+	if c.BcryptCost == 0 {
+		c.BcryptCost = defaultBcryptCost
+	}
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("auth.PasswordConfig: bcrypt_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if c.Argon2Time == 0 {
+		c.Argon2Time = defaultArgon2Time
+	}
+	if c.Argon2Memory == 0 {
+		c.Argon2Memory = defaultArgon2Memory
+	}
+	if c.Argon2Threads == 0 {
+		c.Argon2Threads = defaultArgon2Threads
+	}
+	return nil
+}
+
+func (c *LDAPConfig) setDefaults() error {
+	if len(c.Address) == 0 {
+		return errors.New("auth.LDAPConfig: ldap provider requires address")
+	}
+	if len(c.BaseDN) == 0 {
+		return errors.New("auth.LDAPConfig: ldap provider requires base_dn")
+	}
+	if strings.Count(c.UserDNTemplate, "%s") != 1 {
+		return errors.New("auth.LDAPConfig: user_dn_template must contain a single '%s' username placeholder")
+	}
+	if len(c.UserFilter) == 0 {
+		c.UserFilter = defaultLDAPUserFilter
+	}
+	if len(c.UsernameAttribute) == 0 {
+		c.UsernameAttribute = defaultLDAPUsernameAttribute
+	}
+	if len(c.GroupBaseDN) == 0 {
+		c.GroupBaseDN = c.BaseDN
+	}
+	if len(c.GroupFilter) == 0 {
+		c.GroupFilter = defaultLDAPGroupFilter
+	}
+	if len(c.GroupNameAttribute) == 0 {
+		c.GroupNameAttribute = defaultLDAPGroupNameAttribute
+	}
+	if len(c.GroupMemberAttribute) == 0 {
+		c.GroupMemberAttribute = defaultLDAPGroupMemberAttribute
+	}
+	if c.GroupCacheTTL == 0 {
+		c.GroupCacheTTL = defaultLDAPGroupCacheTTL
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultLDAPTimeout
+	}
+	return nil
+}
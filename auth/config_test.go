@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfig(t *testing.T) {
+	cfg := Config{}
+	err := yaml.Unmarshal([]byte("type: storage\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, Storage, cfg.Type)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("type: http\nhttp:\n  url: https://auth.jackal.im\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, HTTP, cfg.Type)
+	require.Equal(t, "https://auth.jackal.im", cfg.HTTP.URL)
+	require.Equal(t, defaultHTTPTimeout, cfg.HTTP.Timeout)
+
+	err = yaml.Unmarshal([]byte("type: http\n"), &cfg)
+	require.NotNil(t, err)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("type: ldap\nldap:\n  address: localhost:389\n  base_dn: dc=jackal,dc=im\n  user_dn_template: uid=%s,ou=people,dc=jackal,dc=im\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, LDAP, cfg.Type)
+	require.Equal(t, "dc=jackal,dc=im", cfg.LDAP.GroupBaseDN)
+	require.Equal(t, defaultLDAPUsernameAttribute, cfg.LDAP.UsernameAttribute)
+	require.Equal(t, defaultLDAPGroupCacheTTL, cfg.LDAP.GroupCacheTTL)
+
+	err = yaml.Unmarshal([]byte("type: ldap\nldap:\n  address: localhost:389\n  base_dn: dc=jackal,dc=im\n  user_dn_template: uid=ortuman,dc=jackal,dc=im\n"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("type: kerberos\n"), &cfg)
+	require.NotNil(t, err)
+
+	// password hashing
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("type: storage\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, model.PlainPasswordScheme, cfg.Password.Scheme)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("type: storage\npassword:\n  scheme: bcrypt\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, model.BcryptPasswordScheme, cfg.Password.Scheme)
+	require.Equal(t, defaultBcryptCost, cfg.Password.BcryptCost)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("type: storage\npassword:\n  scheme: argon2id\n  argon2_memory: 32768\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, model.Argon2idPasswordScheme, cfg.Password.Scheme)
+	require.Equal(t, uint32(32768), cfg.Password.Argon2Memory)
+	require.Equal(t, uint32(defaultArgon2Time), cfg.Password.Argon2Time)
+	require.Equal(t, uint8(defaultArgon2Threads), cfg.Password.Argon2Threads)
+
+	err = yaml.Unmarshal([]byte("type: storage\npassword:\n  scheme: md5\n"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("type: storage\npassword:\n  scheme: bcrypt\n  bcrypt_cost: 50\n"), &cfg)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpProvider delegates user authentication to an external service.
+//
+// Credentials are POSTed form encoded to <url>/authenticate, while user
+// existence is checked against <url>/user_exists. A 200 status
+// stands for an affirmative answer, whereas 401, 403 and 404
+// statuses stand for a negative one.
+type httpProvider struct {
+	cfg    *HTTPConfig
+	client *http.Client
+}
+
+func newHTTPProvider(cfg *HTTPConfig) *httpProvider {
+	return &httpProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Second * time.Duration(cfg.Timeout)},
+	}
+}
+
+func (p *httpProvider) Authenticate(username, password string) (bool, error) {
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("password", password)
+	return p.request("authenticate", form)
+}
+
+func (p *httpProvider) UserExists(username string) (bool, error) {
+	form := url.Values{}
+	form.Set("username", username)
+	return p.request("user_exists", form)
+}
+
+func (p *httpProvider) request(endpoint string, form url.Values) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(p.cfg.URL, "/")+"/"+endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if len(p.cfg.Secret) > 0 {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.Secret)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body) // allow connection reuse
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("auth: http provider %s response status: %d", endpoint, resp.StatusCode)
+	}
+}
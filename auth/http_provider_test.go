@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuth_HTTPProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.PostFormValue("username") == "romeo" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/auth/authenticate":
+			if r.PostFormValue("username") != "ortuman" || r.PostFormValue("password") != "1234" {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		case "/auth/user_exists":
+			if r.PostFormValue("username") != "ortuman" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p := newHTTPProvider(&HTTPConfig{URL: srv.URL + "/auth/", Secret: "s3cr3t", Timeout: 1})
+
+	ok, err := p.Authenticate("ortuman", "1234")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	ok, err = p.Authenticate("ortuman", "12345")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	exists, err := p.UserExists("ortuman")
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	exists, err = p.UserExists("noelia")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// unexpected statuses are reported as errors
+	_, err = p.Authenticate("romeo", "1234")
+	require.NotNil(t, err)
+
+	p = newHTTPProvider(&HTTPConfig{URL: srv.URL + "/auth", Timeout: 1})
+	_, err = p.UserExists("ortuman")
+	require.NotNil(t, err)
+}
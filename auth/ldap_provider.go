@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+// ldapConn represents the LDAP client operations used by the provider.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// ldapProvider authenticates users binding with their own DN,
+// optionally sourcing shared roster groups from LDAP groups.
+type ldapProvider struct {
+	cfg  *LDAPConfig
+	dial func() (ldapConn, error)
+
+	mu        sync.Mutex
+	groups    []SharedGroup
+	fetchedAt time.Time
+}
+
+func newLDAPProvider(cfg *LDAPConfig) *ldapProvider {
+	p := &ldapProvider{cfg: cfg}
+	p.dial = p.dialServer
+	return p
+}
+
+func (p *ldapProvider) Authenticate(username, password string) (bool, error) {
+	if len(username) == 0 || len(password) == 0 {
+		return false, nil // unauthenticated binds always succeed
+	}
+	conn, err := p.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	err = conn.Bind(fmt.Sprintf(p.cfg.UserDNTemplate, escapeDN(username)), password)
+	switch {
+	case err == nil:
+		return true, nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (p *ldapProvider) UserExists(username string) (bool, error) {
+	conn, err := p.serviceConn()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf("(&%s(%s=%s))", p.cfg.UserFilter, p.cfg.UsernameAttribute, ldap.EscapeFilter(username))
+	res, err := conn.Search(p.searchRequest(p.cfg.BaseDN, filter, []string{"dn"}, 1))
+	if err != nil {
+		return false, err
+	}
+	return len(res.Entries) > 0, nil
+}
+
+func (p *ldapProvider) SharedGroups(username string) ([]SharedGroup, error) {
+	if !p.cfg.SharedRoster {
+		return nil, nil
+	}
+	groups, err := p.fetchGroups()
+	if err != nil {
+		return nil, err
+	}
+	var ret []SharedGroup
+	for _, g := range groups {
+		for _, member := range g.Members {
+			if member == username {
+				ret = append(ret, g)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// fetchGroups returns every LDAP group along with its members,
+// which are only looked up again once cached ones expire.
+func (p *ldapProvider) fetchGroups() ([]SharedGroup, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.groups != nil && time.Since(p.fetchedAt) < time.Second*time.Duration(p.cfg.GroupCacheTTL) {
+		return p.groups, nil
+	}
+	conn, err := p.serviceConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	attrs := []string{p.cfg.GroupNameAttribute, p.cfg.GroupMemberAttribute}
+	res, err := conn.Search(p.searchRequest(p.cfg.GroupBaseDN, p.cfg.GroupFilter, attrs, 0))
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]SharedGroup, 0, len(res.Entries))
+	for _, entry := range res.Entries {
+		g := SharedGroup{Name: entry.GetAttributeValue(p.cfg.GroupNameAttribute)}
+		if len(g.Name) == 0 {
+			continue
+		}
+		for _, v := range entry.GetAttributeValues(p.cfg.GroupMemberAttribute) {
+			if username := p.memberUsername(v); len(username) > 0 {
+				g.Members = append(g.Members, username)
+			}
+		}
+		groups = append(groups, g)
+	}
+	p.groups = groups
+	p.fetchedAt = time.Now()
+	return groups, nil
+}
+
+// memberUsername maps a group member attribute value to a username.
+// Values are either plain usernames (e.g. memberUid) or user DNs
+// whose first RDN holds the username attribute.
+func (p *ldapProvider) memberUsername(v string) string {
+	if !strings.Contains(v, "=") {
+		return v
+	}
+	dn, err := ldap.ParseDN(v)
+	if err != nil || len(dn.RDNs) == 0 {
+		return ""
+	}
+	for _, attr := range dn.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, p.cfg.UsernameAttribute) {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func (p *ldapProvider) searchRequest(baseDN, filter string, attrs []string, sizeLimit int) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, sizeLimit, p.cfg.Timeout, false, filter, attrs, nil)
+}
+
+// serviceConn returns a connection bound with the configured lookup credentials.
+func (p *ldapProvider) serviceConn() (ldapConn, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.cfg.BindDN) > 0 {
+		if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (p *ldapProvider) dialServer() (ldapConn, error) {
+	var conn *ldap.Conn
+	var err error
+	if p.cfg.TLS {
+		host, _, _ := net.SplitHostPort(p.cfg.Address)
+		conn, err = ldap.DialTLS("tcp", p.cfg.Address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = ldap.Dial("tcp", p.cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(time.Second * time.Duration(p.cfg.Timeout))
+	return conn, nil
+}
+
+// escapeDN escapes an attribute value to be used within a DN (RFC 4514).
+func escapeDN(s string) string {
+	var b bytes.Buffer
+	for i, r := range s {
+		switch {
+		case r == 0:
+			b.WriteString(`\00`)
+		case strings.ContainsRune(`,+"\<>;=`, r), i == 0 && (r == ' ' || r == '#'), i == len(s)-1 && r == ' ':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ldap.v2"
+)
+
+type fakeLDAPConn struct {
+	passwords map[string]string // keyed by DN
+	users     []*ldap.Entry
+	groups    []*ldap.Entry
+	searches  int
+}
+
+func (c *fakeLDAPConn) Bind(dn, password string) error {
+	if pw, ok := c.passwords[dn]; ok && pw == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.searches++
+	res := &ldap.SearchResult{}
+	if req.Filter == "(objectClass=groupOfNames)" {
+		res.Entries = c.groups
+		return res, nil
+	}
+	for _, e := range c.users {
+		if strings.Contains(req.Filter, "(uid="+e.GetAttributeValue("uid")+")") {
+			res.Entries = append(res.Entries, e)
+		}
+	}
+	return res, nil
+}
+
+func (c *fakeLDAPConn) Close() {}
+
+func TestAuth_LDAPProvider(t *testing.T) {
+	conn := &fakeLDAPConn{
+		passwords: map[string]string{
+			"cn=jackal,dc=jackal,dc=im":             "s3cr3t",
+			"uid=ortuman,ou=people,dc=jackal,dc=im": "1234",
+		},
+		users: []*ldap.Entry{
+			tUtilLDAPEntry("uid=ortuman,ou=people,dc=jackal,dc=im", "uid", "ortuman"),
+			tUtilLDAPEntry("uid=noelia,ou=people,dc=jackal,dc=im", "uid", "noelia"),
+		},
+		groups: []*ldap.Entry{
+			tUtilLDAPEntry("cn=devs,ou=groups,dc=jackal,dc=im", "cn", "devs",
+				"member", "uid=ortuman,ou=people,dc=jackal,dc=im",
+				"member", "uid=noelia,ou=people,dc=jackal,dc=im"),
+			tUtilLDAPEntry("cn=ops,ou=groups,dc=jackal,dc=im", "cn", "ops",
+				"member", "romeo",
+				"member", "cn=Juliet,ou=people,dc=jackal,dc=im"),
+		},
+	}
+	cfg := &LDAPConfig{
+		Address:        "localhost:389",
+		BindDN:         "cn=jackal,dc=jackal,dc=im",
+		BindPassword:   "s3cr3t",
+		BaseDN:         "dc=jackal,dc=im",
+		UserDNTemplate: "uid=%s,ou=people,dc=jackal,dc=im",
+		SharedRoster:   true,
+	}
+	require.Nil(t, cfg.setDefaults())
+
+	p := newLDAPProvider(cfg)
+	p.dial = func() (ldapConn, error) { return conn, nil }
+
+	ok, err := p.Authenticate("ortuman", "1234")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	ok, err = p.Authenticate("ortuman", "12345")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// unauthenticated binds are not allowed
+	ok, _ = p.Authenticate("ortuman", "")
+	require.False(t, ok)
+
+	exists, err := p.UserExists("noelia")
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	exists, _ = p.UserExists("romeo")
+	require.False(t, exists)
+
+	// group membership...
+	groups, err := p.SharedGroups("noelia")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(groups))
+	require.Equal(t, "devs", groups[0].Name)
+	require.Equal(t, []string{"ortuman", "noelia"}, groups[0].Members)
+
+	// plain usernames are taken as they are, while member DNs
+	// not keyed by the username attribute are skipped
+	groups, _ = p.SharedGroups("romeo")
+	require.Equal(t, 1, len(groups))
+	require.Equal(t, "ops", groups[0].Name)
+	require.Equal(t, []string{"romeo"}, groups[0].Members)
+
+	groups, _ = p.SharedGroups("Juliet")
+	require.Equal(t, 0, len(groups))
+
+	// ...is cached
+	require.Equal(t, 3, conn.searches)
+
+	p.cfg.SharedRoster = false
+	groups, _ = p.SharedGroups("noelia")
+	require.Nil(t, groups)
+}
+
+func TestAuth_LDAPEscapeDN(t *testing.T) {
+	require.Equal(t, "ortuman", escapeDN("ortuman"))
+	require.Equal(t, `ortuman\,ou\=admins`, escapeDN("ortuman,ou=admins"))
+	require.Equal(t, `\#ortuman\ `, escapeDN("#ortuman "))
+	require.Equal(t, `a\+b\<c\>\;\"\\`, escapeDN(`a+b<c>;"\`))
+}
+
+func tUtilLDAPEntry(dn string, attrs ...string) *ldap.Entry {
+	e := &ldap.Entry{DN: dn}
+	for i := 0; i < len(attrs); i += 2 {
+		var attr *ldap.EntryAttribute
+		for _, a := range e.Attributes {
+			if a.Name == attrs[i] {
+				attr = a
+			}
+		}
+		if attr == nil {
+			attr = &ldap.EntryAttribute{Name: attrs[i]}
+			e.Attributes = append(e.Attributes, attr)
+		}
+		attr.Values = append(attr.Values, attrs[i+1])
+	}
+	return e
+}
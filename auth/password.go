@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/util"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// relative strength of every password hashing scheme
+var passwordSchemeStrength = map[string]int{
+	model.PlainPasswordScheme:    0,
+	model.BcryptPasswordScheme:   1,
+	model.Argon2idPasswordScheme: 2,
+}
+
+var errMalformedPasswordHash = errors.New("auth: malformed password hash")
+
+// SetPassword stores password into user entity hashed using the
+// configured scheme, along with its derived SCRAM-SHA-256 credentials.
+func SetPassword(user *model.User, password string) error {
+	cfg := passwordConfig()
+
+	var hash string
+	switch cfg.Scheme {
+	case model.BcryptPasswordScheme:
+		b, err := bcrypt.GenerateFromPassword([]byte(password), cfg.BcryptCost)
+		if err != nil {
+			return err
+		}
+		hash = string(b)
+
+	case model.Argon2idPasswordScheme:
+		salt := util.RandomBytes(argon2SaltLen)
+		key := argon2.IDKey([]byte(password), salt, cfg.Argon2Time, cfg.Argon2Memory, cfg.Argon2Threads, argon2KeyLen)
+		hash = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			cfg.Argon2Memory, cfg.Argon2Time, cfg.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key))
+
+	default:
+		hash = password
+	}
+	user.Password = hash
+	user.PasswordScheme = cfg.Scheme
+	user.ScramSHA256 = util.NewScramSHA256Credentials(password).String()
+	return nil
+}
+
+// VerifyPassword returns whether or not password matches
+// the one stored into user entity.
+func VerifyPassword(user *model.User, password string) bool {
+	if len(user.Password) == 0 {
+		return false
+	}
+	switch user.PasswordScheme {
+	case model.PlainPasswordScheme:
+		return subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) == 1
+
+	case model.BcryptPasswordScheme:
+		return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
+
+	case model.Argon2idPasswordScheme:
+		params, salt, key, err := parseArgon2idHash(user.Password)
+		if err != nil {
+			return false
+		}
+		k := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(k, key) == 1
+	}
+	return false
+}
+
+// NeedsRehash returns whether or not user password is stored using a
+// weaker scheme, or weaker scheme parameters, than the configured ones.
+// Stored passwords are never downgraded to a weaker scheme.
+func NeedsRehash(user *model.User) bool {
+	cfg := passwordConfig()
+
+	if passwordSchemeStrength[user.PasswordScheme] != passwordSchemeStrength[cfg.Scheme] {
+		return passwordSchemeStrength[user.PasswordScheme] < passwordSchemeStrength[cfg.Scheme]
+	}
+	switch user.PasswordScheme {
+	case model.BcryptPasswordScheme:
+		cost, err := bcrypt.Cost([]byte(user.Password))
+		return err == nil && cost < cfg.BcryptCost
+
+	case model.Argon2idPasswordScheme:
+		params, _, _, err := parseArgon2idHash(user.Password)
+		if err != nil {
+			return false
+		}
+		return params.Argon2Time < cfg.Argon2Time || params.Argon2Memory < cfg.Argon2Memory || params.Argon2Threads < cfg.Argon2Threads
+	}
+	return false
+}
+
+// parseArgon2idHash parses an argon2id hash encoded as
+// '$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>'.
+func parseArgon2idHash(hash string) (params *PasswordConfig, salt, key []byte, err error) {
+	sp := strings.Split(hash, "$")
+	if len(sp) != 6 || sp[1] != "argon2id" {
+		return nil, nil, nil, errMalformedPasswordHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(sp[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errMalformedPasswordHash
+	}
+	params = &PasswordConfig{Scheme: model.Argon2idPasswordScheme}
+	if _, err := fmt.Sscanf(sp[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return nil, nil, nil, errMalformedPasswordHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(sp[4]); err != nil {
+		return nil, nil, nil, errMalformedPasswordHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(sp[5]); err != nil || len(key) == 0 {
+		return nil, nil, nil, errMalformedPasswordHash
+	}
+	return params, salt, key, nil
+}
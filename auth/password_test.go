@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassword_Verify(t *testing.T) {
+	defer Shutdown()
+
+	for _, scheme := range []string{model.PlainPasswordScheme, model.BcryptPasswordScheme, model.Argon2idPasswordScheme} {
+		tUtilPasswordInit(scheme, 4, 1)
+
+		var user model.User
+		require.Nil(t, SetPassword(&user, "1234"))
+		require.Equal(t, scheme, user.PasswordScheme)
+		require.Equal(t, scheme == model.PlainPasswordScheme, user.HasPlainPassword())
+
+		require.True(t, VerifyPassword(&user, "1234"))
+		require.False(t, VerifyPassword(&user, "12345"))
+		require.False(t, VerifyPassword(&user, ""))
+		require.False(t, NeedsRehash(&user))
+
+		// SCRAM credentials are derived from plain password
+		creds, err := util.ParseScramCredentials(user.ScramSHA256)
+		require.Nil(t, err)
+		require.Equal(t, util.ScramIterationsCount, creds.Iterations)
+		Shutdown()
+	}
+	// malformed hashes never match
+	user := &model.User{Password: "$argon2id$v=19$m=1024$c2FsdA$a2V5", PasswordScheme: model.Argon2idPasswordScheme}
+	require.False(t, VerifyPassword(user, "1234"))
+
+	user = &model.User{Password: "1234", PasswordScheme: "md5"}
+	require.False(t, VerifyPassword(user, "1234"))
+}
+
+func TestPassword_NeedsRehash(t *testing.T) {
+	defer Shutdown()
+
+	plain := &model.User{Password: "1234"}
+
+	tUtilPasswordInit(model.BcryptPasswordScheme, 4, 1)
+	bcryptUser := &model.User{}
+	SetPassword(bcryptUser, "1234")
+	require.True(t, NeedsRehash(plain))
+	Shutdown()
+
+	// stronger cost
+	tUtilPasswordInit(model.BcryptPasswordScheme, 5, 1)
+	require.True(t, NeedsRehash(bcryptUser))
+	Shutdown()
+
+	tUtilPasswordInit(model.Argon2idPasswordScheme, 4, 1)
+	argon2User := &model.User{}
+	SetPassword(argon2User, "1234")
+	require.True(t, NeedsRehash(plain))
+	require.True(t, NeedsRehash(bcryptUser))
+	Shutdown()
+
+	// stronger parameters
+	tUtilPasswordInit(model.Argon2idPasswordScheme, 4, 2)
+	require.True(t, NeedsRehash(argon2User))
+	Shutdown()
+
+	// never downgrade
+	tUtilPasswordInit(model.PlainPasswordScheme, 4, 1)
+	require.False(t, NeedsRehash(bcryptUser))
+	require.False(t, NeedsRehash(argon2User))
+	Shutdown()
+}
+
+func TestPassword_TransparentUpgrade(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	tUtilPasswordInit(model.Argon2idPasswordScheme, 4, 1)
+	defer Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+
+	p := &storageProvider{}
+
+	// failed logins leave stored password untouched
+	ok, err := p.Authenticate("ortuman", "4321")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	user, _ := storage.Instance().FetchUser("ortuman")
+	require.Equal(t, "1234", user.Password)
+	require.True(t, user.HasPlainPassword())
+
+	ok, err = p.Authenticate("ortuman", "1234")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	user, _ = storage.Instance().FetchUser("ortuman")
+	require.Equal(t, model.Argon2idPasswordScheme, user.PasswordScheme)
+	require.True(t, strings.HasPrefix(user.Password, "$argon2id$"))
+	require.False(t, user.HasPlainPassword())
+	require.True(t, len(user.ScramSHA256) > 0)
+
+	// rehashed password keeps working
+	ok, err = p.Authenticate("ortuman", "1234")
+	require.Nil(t, err)
+	require.True(t, ok)
+}
+
+func tUtilPasswordInit(scheme string, bcryptCost int, argon2Time uint32) {
+	Initialize(&Config{Password: PasswordConfig{
+		Scheme:        scheme,
+		BcryptCost:    bcryptCost,
+		Argon2Time:    argon2Time,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+	}})
+}
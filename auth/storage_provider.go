@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package auth
+
+import (
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// storageProvider authenticates users against their stored credentials.
+type storageProvider struct{}
+
+func (p *storageProvider) Authenticate(username, password string) (bool, error) {
+	user, err := storage.Instance().FetchUser(username)
+	if err != nil {
+		return false, err
+	}
+	if user == nil || !VerifyPassword(user, password) {
+		return false, nil
+	}
+	// transparently upgrade weaker stored passwords
+	if NeedsRehash(user) {
+		if err := SetPassword(user, password); err != nil {
+			log.Warnf("auth: couldn't rehash %s password: %v", username, err)
+			return true, nil
+		}
+		if err := storage.Instance().InsertOrUpdateUser(user); err != nil {
+			log.Warnf("auth: couldn't store %s rehashed password: %v", username, err)
+		}
+	}
+	return true, nil
+}
+
+func (p *storageProvider) UserExists(username string) (bool, error) {
+	return storage.Instance().UserExists(username)
+}
+
+func (p *storageProvider) FetchCredentials(username string) (*model.User, error) {
+	return storage.Instance().FetchUser(username)
+}
@@ -0,0 +1,480 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/metrics"
+	"github.com/ortuman/jackal/xml"
+)
+
+// ErrSessionNotFound will be returned by Route method if
+// no other cluster node holds a session matching the stanza destination.
+var ErrSessionNotFound = errors.New("cluster: session not found")
+
+const (
+	redisIdleTimeout = time.Minute * 4
+
+	// inbox polling timeout, bounding the time needed to notice a shutdown
+	inboxPollTimeout = 1
+)
+
+// registry keys
+const (
+	membersKey           = "cluster:members"
+	nodeKeyPrefix        = "cluster:node:"
+	nodeSessionsPrefix   = "cluster:nodeSessions:"
+	nodeInboxPrefix      = "cluster:inbox:"
+	userSessionsPrefix   = "cluster:sessions:"
+	nodeSessionSeparator = "/"
+)
+
+// removes a user session only if still owned by the given node.
+var unregisterSessionScript = redis.NewScript(2, `
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+end
+redis.call("SREM", KEYS[2], ARGV[3])
+return 0
+`)
+
+// purges every session owned by a node, along with its pending
+// inbox, and removes it from the cluster members set.
+var evictNodeScript = redis.NewScript(4, `
+for _, s in ipairs(redis.call("SMEMBERS", KEYS[3])) do
+	local username, resource = string.match(s, "^(.-)/(.*)$")
+	local key = ARGV[2] .. username
+	if redis.call("HGET", key, resource) == ARGV[1] then
+		redis.call("HDEL", key, resource)
+	end
+end
+redis.call("DEL", KEYS[2], KEYS[3], KEYS[4])
+redis.call("SREM", KEYS[1], ARGV[1])
+return 0
+`)
+
+// DeliverFunc delivers a stanza forwarded by another node
+// to the matching local sessions.
+type DeliverFunc func(stanza xml.Stanza)
+
+// Cluster shares the local session registry with the rest of
+// cluster nodes and forwards stanzas addressed to remote sessions.
+//
+// Every node periodically refreshes its own heartbeat key, which expires
+// after the configured node timeout, and evicts those members whose key has
+// already expired. Forwarded stanzas are pushed into a per-node Redis list,
+// so that they are not lost while the receiving node is reconnecting.
+type Cluster struct {
+	name              string
+	pool              *redis.Pool
+	deliver           DeliverFunc
+	heartbeatInterval time.Duration
+	nodeTimeout       time.Duration
+	mu                sync.RWMutex
+	members           map[string]struct{}
+	doneCh            chan struct{}
+	wg                sync.WaitGroup
+}
+
+// singleton interface
+var (
+	inst        *Cluster
+	instMu      sync.RWMutex
+	initialized uint32
+)
+
+// Initialize joins the local node to the cluster.
+func Initialize(cfg *Config, deliver DeliverFunc) {
+	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		dialTimeout := time.Second * time.Duration(cfg.Redis.DialTimeout)
+		p := &redis.Pool{
+			// inbox polling holds a connection of its own
+			MaxIdle:     cfg.Redis.PoolSize + 1,
+			MaxActive:   cfg.Redis.PoolSize + 1,
+			IdleTimeout: redisIdleTimeout,
+			Wait:        true,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", cfg.Redis.Address,
+					redis.DialPassword(cfg.Redis.Password),
+					redis.DialDatabase(cfg.Redis.Database),
+					redis.DialConnectTimeout(dialTimeout),
+				)
+			},
+		}
+		inst = newCluster(cfg.Name, p, deliver,
+			time.Second*time.Duration(cfg.HeartbeatInterval),
+			time.Second*time.Duration(cfg.NodeTimeout),
+		)
+		inst.start()
+	}
+}
+
+// Instance returns the cluster instance.
+func Instance() *Cluster {
+	instMu.RLock()
+	defer instMu.RUnlock()
+
+	if inst == nil {
+		log.Fatalf("cluster not initialized")
+	}
+	return inst
+}
+
+// Enabled returns whether or not the cluster mode has been enabled.
+func Enabled() bool {
+	instMu.RLock()
+	defer instMu.RUnlock()
+	return inst != nil
+}
+
+// Shutdown leaves the cluster, dropping every session
+// registered by the local node.
+func Shutdown() {
+	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
+		instMu.Lock()
+		defer instMu.Unlock()
+		inst.stop()
+		inst = nil
+	}
+}
+
+func newCluster(name string, p *redis.Pool, deliver DeliverFunc, heartbeatInterval, nodeTimeout time.Duration) *Cluster {
+	return &Cluster{
+		name:              name,
+		pool:              p,
+		deliver:           deliver,
+		heartbeatInterval: heartbeatInterval,
+		nodeTimeout:       nodeTimeout,
+		members:           make(map[string]struct{}),
+		doneCh:            make(chan struct{}),
+	}
+}
+
+// Name returns the local node name.
+func (c *Cluster) Name() string {
+	return c.name
+}
+
+// Members returns the names of the currently alive cluster nodes,
+// local node excluded.
+func (c *Cluster) Members() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var ret []string
+	for member := range c.members {
+		ret = append(ret, member)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// RegisterSession publishes a local authenticated session to the rest of cluster nodes.
+func (c *Cluster) RegisterSession(username, resource string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HSET", userSessionsPrefix+username, resource, c.name)
+	conn.Send("SADD", nodeSessionsPrefix+c.name, username+nodeSessionSeparator+resource)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// UnregisterSession removes a local session from the cluster registry.
+// The session is kept in case it has already been taken over by another node.
+func (c *Cluster) UnregisterSession(username, resource string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := unregisterSessionScript.Do(conn,
+		userSessionsPrefix+username,
+		nodeSessionsPrefix+c.name,
+		resource,
+		c.name,
+		username+nodeSessionSeparator+resource,
+	)
+	return err
+}
+
+// Route forwards a stanza to those cluster nodes holding a session
+// that matches its destination.
+// Messages addressed to a bare JID are forwarded to a single node, which
+// passes them on through RouteNext if none of its resources is eligible,
+// while any other stanza is forwarded to every matching one.
+func (c *Cluster) Route(stanza xml.Stanza) error {
+	toJID := stanza.ToJID()
+	if len(toJID.Node()) == 0 {
+		return ErrSessionNotFound
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	nodes, err := c.sessionNodes(conn, toJID)
+	if err != nil {
+		return err
+	}
+	if _, ok := stanza.(*xml.Message); ok && !toJID.IsFullWithUser() && len(nodes) > 1 {
+		nodes = nodes[:1]
+	}
+	return c.forward(conn, stanza, nodes)
+}
+
+// RouteNext forwards a bare JID message the local node couldn't deliver
+// to the next node, in name order, holding a session of its recipient.
+// ErrSessionNotFound is returned once every one of them has been tried,
+// leaving it up to the local node to store the message offline.
+func (c *Cluster) RouteNext(message *xml.Message) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	nodes, err := c.sessionNodes(conn, message.ToJID().ToBareJID())
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if node > c.name {
+			return c.forward(conn, message, []string{node})
+		}
+	}
+	return ErrSessionNotFound
+}
+
+// sessionNodes returns the sorted names of those cluster members
+// holding a session that matches a given JID.
+func (c *Cluster) sessionNodes(conn redis.Conn, jid *xml.JID) ([]string, error) {
+	sessions, err := redis.StringMap(conn.Do("HGETALL", userSessionsPrefix+jid.Node()))
+	if err != nil {
+		return nil, err
+	}
+	var nodes []string
+	if jid.IsFullWithUser() {
+		if node, ok := sessions[jid.Resource()]; ok && c.isMember(node) {
+			nodes = append(nodes, node)
+		}
+		return nodes, nil
+	}
+	added := make(map[string]struct{})
+	for _, node := range sessions {
+		if _, ok := added[node]; ok || !c.isMember(node) {
+			continue
+		}
+		added[node] = struct{}{}
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+func (c *Cluster) forward(conn redis.Conn, stanza xml.Stanza, nodes []string) error {
+	if len(nodes) == 0 {
+		return ErrSessionNotFound
+	}
+	payload := stanza.String()
+	for _, node := range nodes {
+		if err := conn.Send("RPUSH", nodeInboxPrefix+node, payload); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for range nodes {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	metrics.ClusterStanzasForwarded.Add(float64(len(nodes)))
+	return nil
+}
+
+func (c *Cluster) start() {
+	// sessions left behind by a previous run of this node are no longer valid
+	if err := c.evict(c.name); err != nil {
+		log.Error(err)
+	}
+	if err := c.heartbeat(); err != nil {
+		log.Error(err)
+	}
+	c.wg.Add(2)
+	go c.heartbeatLoop()
+	go c.inboxLoop()
+	log.Infof("joined cluster... (node: %s)", c.name)
+}
+
+func (c *Cluster) stop() {
+	close(c.doneCh)
+	c.wg.Wait()
+	if err := c.evict(c.name); err != nil {
+		log.Error(err)
+	}
+	c.pool.Close()
+	log.Infof("left cluster... (node: %s)", c.name)
+}
+
+func (c *Cluster) heartbeatLoop() {
+	defer c.wg.Done()
+	tc := time.NewTicker(c.heartbeatInterval)
+	defer tc.Stop()
+	for {
+		select {
+		case <-tc.C:
+			if err := c.heartbeat(); err != nil {
+				log.Error(err)
+			}
+		case <-c.doneCh:
+			return
+		}
+	}
+}
+
+// heartbeat refreshes local node liveness and evicts those
+// members that didn't refresh their own in time.
+func (c *Cluster) heartbeat() error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	conn.Send("SET", nodeKeyPrefix+c.name, time.Now().Unix(), "EX", int(c.nodeTimeout/time.Second))
+	conn.Send("SADD", membersKey, c.name)
+	conn.Send("SMEMBERS", membersKey)
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	names, err := redis.Strings(conn.Receive())
+	if err != nil {
+		return err
+	}
+	members := make(map[string]struct{})
+	for _, name := range names {
+		if name == c.name {
+			continue
+		}
+		alive, err := redis.Bool(conn.Do("EXISTS", nodeKeyPrefix+name))
+		if err != nil {
+			return err
+		}
+		if !alive {
+			if err := c.evict(name); err != nil {
+				return err
+			}
+			log.Infof("evicted cluster node... (node: %s)", name)
+			continue
+		}
+		members[name] = struct{}{}
+	}
+	c.mu.Lock()
+	c.members = members
+	c.mu.Unlock()
+	metrics.ClusterNodes.Set(float64(len(members) + 1))
+	return nil
+}
+
+func (c *Cluster) evict(name string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := evictNodeScript.Do(conn,
+		membersKey,
+		nodeKeyPrefix+name,
+		nodeSessionsPrefix+name,
+		nodeInboxPrefix+name,
+		name,
+		userSessionsPrefix,
+	)
+	return err
+}
+
+func (c *Cluster) inboxLoop() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.doneCh:
+			return
+		default:
+		}
+		payload, err := c.pollInbox()
+		switch err {
+		case nil:
+			c.deliverPayload(payload)
+		case redis.ErrNil:
+			break // poll timeout expired...
+		default:
+			log.Error(err)
+			select {
+			case <-time.After(c.heartbeatInterval):
+			case <-c.doneCh:
+				return
+			}
+		}
+	}
+}
+
+func (c *Cluster) pollInbox() (string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	vals, err := redis.Strings(conn.Do("BLPOP", nodeInboxPrefix+c.name, inboxPollTimeout))
+	if err != nil {
+		return "", err
+	}
+	return vals[1], nil
+}
+
+func (c *Cluster) deliverPayload(payload string) {
+	stanza, err := c.decodeStanza(payload)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	c.deliver(stanza)
+}
+
+func (c *Cluster) decodeStanza(payload string) (xml.Stanza, error) {
+	elem, err := xml.NewParser(strings.NewReader(payload)).ParseElement()
+	if err != nil {
+		return nil, err
+	}
+	if elem == nil {
+		return nil, errors.New("cluster: empty forwarded payload")
+	}
+	fromJID, err := xml.NewJIDString(elem.From(), true)
+	if err != nil {
+		return nil, err
+	}
+	toJID, err := xml.NewJIDString(elem.To(), true)
+	if err != nil {
+		return nil, err
+	}
+	switch elem.Name() {
+	case "message":
+		return xml.NewMessageFromElement(elem, fromJID, toJID)
+	case "presence":
+		return xml.NewPresenceFromElement(elem, fromJID, toJID)
+	case "iq":
+		return xml.NewIQFromElement(elem, fromJID, toJID)
+	}
+	return nil, fmt.Errorf("cluster: unexpected forwarded element: %s", elem.Name())
+}
+
+func (c *Cluster) isMember(name string) bool {
+	c.mu.RLock()
+	_, ok := c.members[name]
+	c.mu.RUnlock()
+	return ok
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCluster_Route(t *testing.T) {
+	s, err := miniredis.Run()
+	require.Nil(t, err)
+	defer s.Close()
+
+	n1, ch1 := tUtilClusterNode(s, "node1")
+	n2, ch2 := tUtilClusterNode(s, "node2")
+	n3, ch3 := tUtilClusterNode(s, "node3")
+	for _, n := range []*Cluster{n1, n2, n3} {
+		// second heartbeat discovers every other member
+		n.start()
+		defer n.stop()
+	}
+	require.Nil(t, n1.heartbeat())
+	require.Nil(t, n2.heartbeat())
+	require.Equal(t, []string{"node2", "node3"}, n1.Members())
+
+	require.Nil(t, n2.RegisterSession("ortuman", "balcony"))
+	require.Nil(t, n3.RegisterSession("ortuman", "garden"))
+
+	j1, _ := xml.NewJIDString("romeo@jackal.im/orchard", true)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/garden", true)
+	j3, _ := xml.NewJIDString("ortuman@jackal.im", true)
+	j4, _ := xml.NewJIDString("ortuman@jackal.im/hall", true)
+
+	// full JID
+	require.Nil(t, n1.Route(tUtilClusterMessage("m1", j1, j2)))
+	elem := tUtilClusterFetch(t, ch3)
+	require.Equal(t, "m1", elem.ID())
+	require.Equal(t, j2.String(), elem.ToJID().String())
+	require.Equal(t, j1.String(), elem.FromJID().String())
+
+	require.Equal(t, ErrSessionNotFound, n1.Route(tUtilClusterMessage("m2", j1, j4)))
+
+	// bare JID messages are forwarded to a single node
+	require.Nil(t, n1.Route(tUtilClusterMessage("m3", j1, j3)))
+	require.Equal(t, "m3", tUtilClusterFetch(t, ch2).ID())
+	select {
+	case <-ch3:
+		require.Fail(t, "message forwarded twice")
+	case <-time.After(time.Millisecond * 100):
+		break
+	}
+
+	// ...which passes them on to the next one if it couldn't deliver them
+	m3 := tUtilClusterMessage("m3", j1, j3)
+	require.Nil(t, n2.RouteNext(m3))
+	require.Equal(t, "m3", tUtilClusterFetch(t, ch3).ID())
+	require.Equal(t, ErrSessionNotFound, n3.RouteNext(m3))
+
+	// ...while any other stanza is broadcasted
+	p := xml.NewPresence(j1, j3, xml.AvailableType)
+	require.Nil(t, n1.Route(p))
+	require.Equal(t, "presence", tUtilClusterFetch(t, ch2).Name())
+	require.Equal(t, "presence", tUtilClusterFetch(t, ch3).Name())
+
+	// local sessions are never forwarded
+	require.Equal(t, ErrSessionNotFound, n3.Route(tUtilClusterMessage("m4", j1, j2)))
+
+	require.Nil(t, n3.UnregisterSession("ortuman", "garden"))
+	require.Equal(t, ErrSessionNotFound, n1.Route(tUtilClusterMessage("m5", j1, j2)))
+
+	select {
+	case <-ch1:
+		require.Fail(t, "unexpected delivered stanza")
+	default:
+		break
+	}
+}
+
+func TestCluster_TakenOverSession(t *testing.T) {
+	s, err := miniredis.Run()
+	require.Nil(t, err)
+	defer s.Close()
+
+	n1, _ := tUtilClusterNode(s, "node1")
+	n2, _ := tUtilClusterNode(s, "node2")
+
+	require.Nil(t, n1.RegisterSession("ortuman", "balcony"))
+	require.Nil(t, n2.RegisterSession("ortuman", "balcony"))
+
+	// stale session removal must not affect the new one
+	require.Nil(t, n1.UnregisterSession("ortuman", "balcony"))
+	require.Equal(t, "node2", s.HGet(userSessionsPrefix+"ortuman", "balcony"))
+}
+
+func TestCluster_Eviction(t *testing.T) {
+	s, err := miniredis.Run()
+	require.Nil(t, err)
+	defer s.Close()
+
+	n1, _ := tUtilClusterNode(s, "node1")
+	n2, _ := tUtilClusterNode(s, "node2")
+	require.Nil(t, n1.heartbeat())
+	require.Nil(t, n2.heartbeat())
+	require.Nil(t, n1.heartbeat())
+	require.Equal(t, []string{"node2"}, n1.Members())
+
+	require.Nil(t, n2.RegisterSession("ortuman", "balcony"))
+	require.Nil(t, n2.RegisterSession("romeo", "orchard"))
+
+	// node2 stops refreshing its heartbeat...
+	s.FastForward(time.Second * 3)
+	require.Nil(t, n1.heartbeat())
+	require.Nil(t, n1.Members())
+
+	require.False(t, s.Exists(userSessionsPrefix+"ortuman"))
+	require.False(t, s.Exists(userSessionsPrefix+"romeo"))
+	require.False(t, s.Exists(nodeSessionsPrefix+"node2"))
+	members, _ := s.Members(membersKey)
+	require.Equal(t, []string{"node1"}, members)
+}
+
+func tUtilClusterNode(s *miniredis.Miniredis, name string) (*Cluster, chan xml.Stanza) {
+	addr := s.Addr()
+	ch := make(chan xml.Stanza, 8)
+	c := newCluster(name, &redis.Pool{
+		MaxIdle: 2,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}, func(stanza xml.Stanza) { ch <- stanza }, time.Second, time.Second*2)
+	return c, ch
+}
+
+func tUtilClusterFetch(t *testing.T, ch chan xml.Stanza) xml.Stanza {
+	select {
+	case stanza := <-ch:
+		return stanza
+	case <-time.After(time.Second * 3):
+		require.Fail(t, "stanza not delivered")
+		return nil
+	}
+}
+
+func tUtilClusterMessage(id string, from, to *xml.JID) *xml.Message {
+	elem := xml.NewElementName("message")
+	elem.SetID(id)
+	elem.SetType(xml.ChatType)
+	msg, _ := xml.NewMessageFromElement(elem, from, to)
+	return msg
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package cluster
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+const (
+	defaultHeartbeatInterval = 5
+	defaultNodeTimeout       = 15
+)
+
+const (
+	defaultRedisAddress     = "localhost:6379"
+	defaultRedisPoolSize    = 8
+	defaultRedisDialTimeout = 5
+)
+
+// Config represents a cluster configuration.
+type Config struct {
+	Name              string
+	Redis             RedisConfig
+	HeartbeatInterval int
+	NodeTimeout       int
+}
+
+// RedisConfig represents the Redis cluster registry configuration.
+type RedisConfig struct {
+	Address     string `yaml:"address"`
+	Password    string `yaml:"password"`
+	Database    int    `yaml:"database"`
+	PoolSize    int    `yaml:"pool_size"`
+	DialTimeout int    `yaml:"dial_timeout"`
+}
+
+type configProxyType struct {
+	Name              string      `yaml:"name"`
+	Redis             RedisConfig `yaml:"redis"`
+	HeartbeatInterval int         `yaml:"heartbeat_interval"`
+	NodeTimeout       int         `yaml:"node_timeout"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := configProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	c.Name = p.Name
+	if len(c.Name) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		c.Name = hostname
+	}
+	if strings.Contains(c.Name, ":") {
+		return errors.New("cluster.Config: node name must not contain ':'")
+	}
+	c.Redis = p.Redis
+	if len(c.Redis.Address) == 0 {
+		c.Redis.Address = defaultRedisAddress
+	}
+	if c.Redis.PoolSize == 0 {
+		c.Redis.PoolSize = defaultRedisPoolSize
+	}
+	if c.Redis.DialTimeout == 0 {
+		c.Redis.DialTimeout = defaultRedisDialTimeout
+	}
+	c.HeartbeatInterval = p.HeartbeatInterval
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	c.NodeTimeout = p.NodeTimeout
+	if c.NodeTimeout == 0 {
+		c.NodeTimeout = defaultNodeTimeout
+	}
+	if c.HeartbeatInterval < 0 || c.NodeTimeout <= c.HeartbeatInterval {
+		return errors.New("cluster.Config: node_timeout must exceed heartbeat_interval")
+	}
+	return nil
+}
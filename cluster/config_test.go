@@ -0,0 +1,39 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package cluster
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfig(t *testing.T) {
+	cfg := Config{}
+	err := yaml.Unmarshal([]byte("name: node1\nredis:\n  address: redis:6379\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "node1", cfg.Name)
+	require.Equal(t, "redis:6379", cfg.Redis.Address)
+	require.Equal(t, defaultRedisPoolSize, cfg.Redis.PoolSize)
+	require.Equal(t, defaultHeartbeatInterval, cfg.HeartbeatInterval)
+	require.Equal(t, defaultNodeTimeout, cfg.NodeTimeout)
+
+	// defaults to hostname
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("heartbeat_interval: 2\n"), &cfg)
+	require.Nil(t, err)
+	hostname, _ := os.Hostname()
+	require.Equal(t, hostname, cfg.Name)
+	require.Equal(t, defaultRedisAddress, cfg.Redis.Address)
+
+	err = yaml.Unmarshal([]byte("heartbeat_interval: 10\nnode_timeout: 10\n"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("name: node:1\n"), &cfg)
+	require.NotNil(t, err)
+}
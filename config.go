@@ -9,7 +9,12 @@ import (
 	"bytes"
 	"io/ioutil"
 
+	"github.com/ortuman/jackal/admin"
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/cluster"
+	"github.com/ortuman/jackal/host"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/metrics"
 	"github.com/ortuman/jackal/server"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -22,10 +27,16 @@ type Config struct {
 	Debug   struct {
 		Port int `yaml:"port"`
 	} `yaml:"debug"`
-	Logger  log.Config      `yaml:"logger"`
-	Storage storage.Config  `yaml:"storage"`
-	C2S     c2s.Config      `yaml:"c2s"`
-	Servers []server.Config `yaml:"servers"`
+	Logger   log.Config            `yaml:"logger"`
+	Metrics  metrics.Config        `yaml:"metrics"`
+	Admin    admin.Config          `yaml:"admin"`
+	Storage  storage.Config        `yaml:"storage"`
+	Auth     auth.Config           `yaml:"auth"`
+	C2S      c2s.Config            `yaml:"c2s"`
+	Hosts    []host.Config         `yaml:"hosts"`
+	Cluster  *cluster.Config       `yaml:"cluster"`
+	Servers  []server.Config       `yaml:"servers"`
+	Shutdown server.ShutdownConfig `yaml:"shutdown"`
 }
 
 // FromFile loads default global configuration from
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package host
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ortuman/jackal/module/roster"
+	"github.com/ortuman/jackal/module/xep0077"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/s2s"
+)
+
+// Config represents a virtual host configuration.
+type Config struct {
+	Name string
+	// Aliases contains additional domain names the host is reachable at.
+	Aliases []string
+	TLS     TLSConfig
+
+	// Modules contains the set of modules enabled for the host.
+	// A nil value means server configured modules apply.
+	Modules map[string]struct{}
+
+	// Registration overrides server in-band registration policy.
+	Registration *xep0077.Config
+
+	// Roster overrides server roster configuration.
+	Roster *roster.Config
+
+	// S2S overrides server remote domains filter, if not empty.
+	S2S s2s.DomainFilter
+
+	// LoginMessage overrides server login message.
+	LoginMessage *c2s.Announcement
+}
+
+// TLSConfig represents a virtual host TLS configuration.
+type TLSConfig struct {
+	CertFile    string `yaml:"cert_path"`
+	PrivKeyFile string `yaml:"privkey_path"`
+}
+
+type configProxyType struct {
+	Name         string            `yaml:"name"`
+	Aliases      []string          `yaml:"aliases"`
+	TLS          TLSConfig         `yaml:"tls"`
+	Modules      []string          `yaml:"modules"`
+	Registration *xep0077.Config   `yaml:"mod_registration"`
+	Roster       *roster.Config    `yaml:"mod_roster"`
+	S2S          s2s.DomainFilter  `yaml:"s2s"`
+	LoginMessage *c2s.Announcement `yaml:"login_message"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := configProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if len(p.Name) == 0 {
+		return errors.New("host.Config: no host name specified")
+	}
+	if (len(p.TLS.CertFile) == 0) != (len(p.TLS.PrivKeyFile) == 0) {
+		return errors.New("host.Config: tls requires both cert_path and privkey_path")
+	}
+	if err := p.S2S.Validate(); err != nil {
+		return err
+	}
+	if p.LoginMessage != nil {
+		if err := p.LoginMessage.Validate(); err != nil {
+			return fmt.Errorf("host.Config: invalid login_message for host %s: %v", p.Name, err)
+		}
+	}
+	for _, alias := range p.Aliases {
+		if len(alias) == 0 || alias == p.Name {
+			return fmt.Errorf("host.Config: invalid alias for host %s: %s", p.Name, alias)
+		}
+	}
+	c.Name = p.Name
+	c.Aliases = p.Aliases
+	c.TLS = p.TLS
+	c.Modules = nil
+	if p.Modules != nil {
+		c.Modules = map[string]struct{}{}
+		for _, module := range p.Modules {
+			c.Modules[module] = struct{}{}
+		}
+	}
+	c.Registration = p.Registration
+	c.Roster = p.Roster
+	c.S2S = p.S2S
+	c.LoginMessage = p.LoginMessage
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package host
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// singleton interface
+var (
+	hosts       map[string]*Config
+	instMu      sync.RWMutex
+	initialized uint32
+)
+
+// Initialize initializes the virtual hosts registry.
+func Initialize(configs []Config) {
+	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		hosts = make(map[string]*Config, len(configs))
+		for i := range configs {
+			hosts[configs[i].Name] = &configs[i]
+		}
+	}
+}
+
+// Instance returns the configuration associated to a virtual host domain.
+// A nil value will be returned if the domain is not a virtual host.
+func Instance(domain string) *Config {
+	instMu.RLock()
+	defer instMu.RUnlock()
+	return hosts[domain]
+}
+
+// All returns every registered virtual host configuration.
+func All() []*Config {
+	instMu.RLock()
+	defer instMu.RUnlock()
+
+	ret := make([]*Config, 0, len(hosts))
+	for _, h := range hosts {
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+// Shutdown shuts down virtual hosts registry.
+// This method should be used only for testing purposes.
+func Shutdown() {
+	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
+		instMu.Lock()
+		defer instMu.Unlock()
+		hosts = nil
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package host
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/module/roster"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfig(t *testing.T) {
+	cfg := Config{}
+	err := yaml.Unmarshal([]byte("tls:\n  cert_path: a.crt\n"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("name: jackal.im\ntls:\n  cert_path: a.crt\n"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("name: jackal.im\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "jackal.im", cfg.Name)
+	require.Nil(t, cfg.Modules)
+	require.Nil(t, cfg.Registration)
+	require.Nil(t, cfg.Roster)
+
+	b := []byte(`
+name: jackal.im
+tls:
+  cert_path: a.crt
+  privkey_path: a.key
+modules: [roster, vcard]
+mod_registration:
+  allow_registration: true
+mod_roster:
+  subscription_policy: accept_same_domain
+`)
+	err = yaml.Unmarshal(b, &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "a.crt", cfg.TLS.CertFile)
+	require.Equal(t, "a.key", cfg.TLS.PrivKeyFile)
+	require.Equal(t, map[string]struct{}{"roster": {}, "vcard": {}}, cfg.Modules)
+	require.NotNil(t, cfg.Registration)
+	require.True(t, cfg.Registration.AllowRegistration)
+	require.NotNil(t, cfg.Roster)
+	require.Equal(t, roster.AcceptSameDomainSubscriptions, cfg.Roster.SubscriptionPolicy)
+
+	// aliases
+	err = yaml.Unmarshal([]byte("name: jackal.im\naliases: [jackal.net, jackal.org]\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, []string{"jackal.net", "jackal.org"}, cfg.Aliases)
+
+	err = yaml.Unmarshal([]byte("name: jackal.im\naliases: [jackal.im]\n"), &cfg)
+	require.NotNil(t, err)
+
+	// remote domains filter
+	err = yaml.Unmarshal([]byte("name: jackal.im\ns2s:\n  allow: [example.org]\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, []string{"example.org"}, cfg.S2S.Allow)
+
+	err = yaml.Unmarshal([]byte("name: jackal.im\ns2s:\n  deny: [\"*.*.org\"]\n"), &cfg)
+	require.NotNil(t, err)
+
+	// login message
+	err = yaml.Unmarshal([]byte("name: jackal.im\nlogin_message:\n  body: Welcome!\n"), &cfg)
+	require.Nil(t, err)
+	require.NotNil(t, cfg.LoginMessage)
+	require.Equal(t, "Welcome!", cfg.LoginMessage.Body)
+
+	err = yaml.Unmarshal([]byte("name: jackal.im\nlogin_message:\n  subject: Welcome\n"), &cfg)
+	require.NotNil(t, err)
+
+	// no modules enabled
+	err = yaml.Unmarshal([]byte("name: jackal.im\nmodules: []\n"), &cfg)
+	require.Nil(t, err)
+	require.NotNil(t, cfg.Modules)
+	require.Equal(t, 0, len(cfg.Modules))
+}
+
+func TestInstance(t *testing.T) {
+	Initialize([]Config{{Name: "jackal.im"}, {Name: "example.org"}})
+	defer Shutdown()
+
+	require.Equal(t, "jackal.im", Instance("jackal.im").Name)
+	require.Equal(t, "example.org", Instance("example.org").Name)
+	require.Nil(t, Instance("localhost"))
+	require.Equal(t, 2, len(All()))
+
+	Shutdown()
+	require.Nil(t, Instance("jackal.im"))
+	require.Equal(t, 0, len(All()))
+}
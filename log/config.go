@@ -30,14 +30,28 @@ const (
 	FatalLevel
 )
 
+// LogFormat represents log output format type.
+type LogFormat int
+
+const (
+	// TextFormat represents human readable log output format.
+	TextFormat LogFormat = iota
+
+	// JSONFormat represents JSON log output format,
+	// one object per line.
+	JSONFormat
+)
+
 // Config represents a logger manager configuration.
 type Config struct {
 	Level   LogLevel
+	Format  LogFormat
 	LogPath string
 }
 
 type configProxyType struct {
 	Level   string `yaml:"level"`
+	Format  string `yaml:"format"`
 	LogPath string `yaml:"log_path"`
 }
 
@@ -61,6 +75,14 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	default:
 		return fmt.Errorf("log.Config: unrecognized log level: %s", lp.Level)
 	}
+	switch strings.ToLower(lp.Format) {
+	case "", "text":
+		c.Format = TextFormat
+	case "json":
+		c.Format = JSONFormat
+	default:
+		return fmt.Errorf("log.Config: unrecognized log format: %s", lp.Format)
+	}
 	c.LogPath = lp.LogPath
 	return nil
 }
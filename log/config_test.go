@@ -37,6 +37,17 @@ func TestLoggerConfig(t *testing.T) {
 	err = yaml.Unmarshal([]byte("{level: invalid}"), &c)
 	require.NotNil(t, err)
 
+	err = yaml.Unmarshal([]byte("{format: json}"), &c)
+	require.Nil(t, err)
+	require.Equal(t, JSONFormat, c.Format)
+
+	err = yaml.Unmarshal([]byte("{format: text}"), &c)
+	require.Nil(t, err)
+	require.Equal(t, TextFormat, c.Format)
+
+	err = yaml.Unmarshal([]byte("{format: xml}"), &c)
+	require.NotNil(t, err)
+
 	err = yaml.Unmarshal([]byte("{log_path: jackal.log}"), &c)
 	require.Nil(t, err)
 	require.Equal(t, "jackal.log", c.LogPath)
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package log
+
+import "sort"
+
+// Fields represents a set of contextual log fields.
+type Fields map[string]interface{}
+
+func (f Fields) sortedKeys() []string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Entry represents a log entry carrying contextual fields
+// that will be attached to every message logged through it.
+type Entry struct {
+	fields Fields
+}
+
+// WithFields returns a log entry carrying the given fields.
+func WithFields(fields Fields) *Entry {
+	return (&Entry{}).WithFields(fields)
+}
+
+// WithField returns a log entry carrying a single field.
+func WithField(key string, value interface{}) *Entry {
+	return WithFields(Fields{key: value})
+}
+
+// WithFields returns a new log entry carrying both
+// entry fields and the given ones.
+func (e *Entry) WithFields(fields Fields) *Entry {
+	f := make(Fields, len(e.fields)+len(fields))
+	for k, v := range e.fields {
+		f[k] = v
+	}
+	for k, v := range fields {
+		f[k] = v
+	}
+	return &Entry{fields: f}
+}
+
+// WithField returns a new log entry carrying both
+// entry fields and the given one.
+func (e *Entry) WithField(key string, value interface{}) *Entry {
+	return e.WithFields(Fields{key: value})
+}
+
+// Debugf logs a 'debug' message along with entry fields.
+func (e *Entry) Debugf(format string, args ...interface{}) {
+	if inst := instance(); inst != nil && inst.level <= DebugLevel {
+		ci := getCallerInfo()
+		inst.writeLog(ci.filename, ci.line, e.fields, format, DebugLevel, true, args...)
+	}
+}
+
+// Infof logs an 'info' message along with entry fields.
+func (e *Entry) Infof(format string, args ...interface{}) {
+	if inst := instance(); inst != nil && inst.level <= InfoLevel {
+		ci := getCallerInfo()
+		inst.writeLog(ci.filename, ci.line, e.fields, format, InfoLevel, true, args...)
+	}
+}
+
+// Warnf logs a 'warning' message along with entry fields.
+func (e *Entry) Warnf(format string, args ...interface{}) {
+	if inst := instance(); inst != nil && inst.level <= WarningLevel {
+		ci := getCallerInfo()
+		inst.writeLog(ci.filename, ci.line, e.fields, format, WarningLevel, true, args...)
+	}
+}
+
+// Errorf logs an 'error' message along with entry fields.
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	if inst := instance(); inst != nil && inst.level <= ErrorLevel {
+		ci := getCallerInfo()
+		inst.writeLog(ci.filename, ci.line, e.fields, format, ErrorLevel, true, args...)
+	}
+}
+
+// Error logs an 'error' value along with entry fields.
+func (e *Entry) Error(err error) {
+	if inst := instance(); inst != nil && inst.level <= ErrorLevel {
+		ci := getCallerInfo()
+		inst.writeLog(ci.filename, ci.line, e.fields, "%v", ErrorLevel, true, err)
+	}
+}
@@ -6,12 +6,15 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -32,6 +35,7 @@ var (
 // Logger object is used to log messages for a specific system or application component.
 type Logger struct {
 	level     LogLevel
+	format    LogFormat
 	outWriter io.Writer
 	errWriter io.Writer
 	f         *os.File
@@ -42,6 +46,7 @@ type Logger struct {
 func newLogger(cfg *Config, outWriter io.Writer, errWriter io.Writer) (*Logger, error) {
 	l := &Logger{
 		level:     cfg.Level,
+		format:    cfg.Format,
 		outWriter: outWriter,
 		errWriter: errWriter,
 	}
@@ -99,7 +104,7 @@ func Shutdown() {
 func Debugf(format string, args ...interface{}) {
 	if inst := instance(); inst != nil && inst.level <= DebugLevel {
 		ci := getCallerInfo()
-		inst.writeLog(ci.filename, ci.line, format, DebugLevel, true, args...)
+		inst.writeLog(ci.filename, ci.line, nil, format, DebugLevel, true, args...)
 	}
 }
 
@@ -108,7 +113,7 @@ func Debugf(format string, args ...interface{}) {
 func Infof(format string, args ...interface{}) {
 	if inst := instance(); inst != nil && inst.level <= InfoLevel {
 		ci := getCallerInfo()
-		inst.writeLog(ci.filename, ci.line, format, InfoLevel, true, args...)
+		inst.writeLog(ci.filename, ci.line, nil, format, InfoLevel, true, args...)
 	}
 }
 
@@ -117,7 +122,7 @@ func Infof(format string, args ...interface{}) {
 func Warnf(format string, args ...interface{}) {
 	if inst := instance(); inst != nil && inst.level <= WarningLevel {
 		ci := getCallerInfo()
-		inst.writeLog(ci.filename, ci.line, format, WarningLevel, true, args...)
+		inst.writeLog(ci.filename, ci.line, nil, format, WarningLevel, true, args...)
 	}
 }
 
@@ -126,7 +131,7 @@ func Warnf(format string, args ...interface{}) {
 func Errorf(format string, args ...interface{}) {
 	if inst := instance(); inst != nil && inst.level <= ErrorLevel {
 		ci := getCallerInfo()
-		inst.writeLog(ci.filename, ci.line, format, ErrorLevel, true, args...)
+		inst.writeLog(ci.filename, ci.line, nil, format, ErrorLevel, true, args...)
 	}
 }
 
@@ -135,7 +140,7 @@ func Errorf(format string, args ...interface{}) {
 func Error(err error) {
 	if inst := instance(); inst != nil && inst.level <= ErrorLevel {
 		ci := getCallerInfo()
-		inst.writeLog(ci.filename, ci.line, "%v", ErrorLevel, true, err)
+		inst.writeLog(ci.filename, ci.line, nil, "%v", ErrorLevel, true, err)
 	}
 }
 
@@ -145,7 +150,7 @@ func Error(err error) {
 func Fatalf(format string, args ...interface{}) {
 	if inst := instance(); inst != nil {
 		ci := getCallerInfo()
-		inst.writeLog(ci.filename, ci.line, format, FatalLevel, false, args...)
+		inst.writeLog(ci.filename, ci.line, nil, format, FatalLevel, false, args...)
 	}
 }
 
@@ -159,15 +164,17 @@ type record struct {
 	file       string
 	line       int
 	log        string
+	fields     Fields
 	continueCh chan struct{}
 }
 
-func (l *Logger) writeLog(file string, line int, format string, level LogLevel, async bool, args ...interface{}) {
+func (l *Logger) writeLog(file string, line int, fields Fields, format string, level LogLevel, async bool, args ...interface{}) {
 	entry := record{
 		level:      level,
 		file:       file,
 		line:       line,
 		log:        fmt.Sprintf(format, args...),
+		fields:     fields,
 		continueCh: make(chan struct{}),
 	}
 	select {
@@ -184,12 +191,13 @@ func (l *Logger) loop() {
 	for {
 		select {
 		case rec := <-l.recCh:
-			t := time.Now()
-			tm := t.Format("2006-01-02 15:04:05")
-
-			glyph := logLevelGlyph(rec.level)
-			abbr := logLevelAbbreviation(rec.level)
-			line := fmt.Sprintf("%s %s [%s] %s:%d - %s\n", tm, glyph, abbr, rec.file, rec.line, rec.log)
+			var line string
+			switch l.format {
+			case JSONFormat:
+				line = formatJSONRecord(time.Now(), &rec)
+			default:
+				line = formatTextRecord(time.Now(), &rec)
+			}
 
 			if l.f != nil {
 				l.f.WriteString(line)
@@ -214,6 +222,54 @@ func (l *Logger) loop() {
 	}
 }
 
+func formatTextRecord(t time.Time, rec *record) string {
+	tm := t.Format("2006-01-02 15:04:05")
+	glyph := logLevelGlyph(rec.level)
+	abbr := logLevelAbbreviation(rec.level)
+
+	buf := bytes.NewBufferString(fmt.Sprintf("%s %s [%s] %s:%d - %s", tm, glyph, abbr, rec.file, rec.line, rec.log))
+	for _, k := range rec.fields.sortedKeys() {
+		v := fmt.Sprintf("%v", rec.fields[k])
+		if strings.ContainsAny(v, " =\"") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(fmt.Sprintf(" %s=%s", k, v))
+	}
+	buf.WriteString("\n")
+	return buf.String()
+}
+
+func formatJSONRecord(t time.Time, rec *record) string {
+	obj := make(map[string]interface{}, len(rec.fields)+5)
+	for k, v := range rec.fields {
+		switch v := v.(type) {
+		case error:
+			obj[k] = v.Error()
+		case fmt.Stringer:
+			obj[k] = v.String()
+		default:
+			obj[k] = v
+		}
+	}
+	obj["time"] = t.UTC().Format(time.RFC3339Nano)
+	obj["level"] = logLevelName(rec.level)
+	obj["file"] = rec.file
+	obj["line"] = rec.line
+	obj["msg"] = rec.log
+
+	b, err := json.Marshal(obj)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":  obj["time"],
+			"level": obj["level"],
+			"file":  rec.file,
+			"line":  rec.line,
+			"msg":   rec.log,
+		})
+	}
+	return string(b) + "\n"
+}
+
 func getCallerInfo() callerInfo {
 	_, file, ln, ok := runtime.Caller(2)
 	if !ok {
@@ -244,6 +300,24 @@ func logLevelAbbreviation(level LogLevel) string {
 	}
 }
 
+func logLevelName(level LogLevel) string {
+	switch level {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarningLevel:
+		return "warning"
+	case ErrorLevel:
+		return "error"
+	case FatalLevel:
+		return "fatal"
+	default:
+		// should not be reached
+		return ""
+	}
+}
+
 func logLevelGlyph(level LogLevel) string {
 	switch level {
 	case DebugLevel:
@@ -6,6 +6,7 @@
 package log
 
 import (
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"os"
@@ -170,6 +171,58 @@ func TestFatalLog(t *testing.T) {
 	<-continueCh
 }
 
+func TestFieldsLog(t *testing.T) {
+	Initialize(&Config{Level: InfoLevel})
+	defer Shutdown()
+
+	lw := newTestLogWriter()
+	instance().outWriter = lw
+
+	continueCh := make(chan struct{})
+
+	WithFields(Fields{"id": "abcd1234", "jid": "ortuman@jackal.im/balcony"}).WithField("type", "chat").Infof("test fields log!")
+	go func() {
+		select {
+		case l := <-lw.C:
+			require.True(t, strings.Contains(l, "[INF]"))
+			require.True(t, strings.HasSuffix(l, "test fields log! id=abcd1234 jid=ortuman@jackal.im/balcony type=chat\n"))
+
+		case <-time.After(time.Millisecond * 200):
+			require.Fail(t, "log fetch timeout")
+		}
+		close(continueCh)
+	}()
+	<-continueCh
+}
+
+func TestJSONLog(t *testing.T) {
+	Initialize(&Config{Level: DebugLevel, Format: JSONFormat})
+	defer Shutdown()
+
+	lw := newTestLogWriter()
+	instance().errWriter = lw
+
+	continueCh := make(chan struct{})
+
+	WithField("id", "abcd1234").Error(errors.New("some error string"))
+	go func() {
+		select {
+		case l := <-lw.C:
+			var obj map[string]interface{}
+			require.Nil(t, json.Unmarshal([]byte(l), &obj))
+			require.Equal(t, "error", obj["level"])
+			require.Equal(t, "log_test", obj["file"])
+			require.Equal(t, "some error string", obj["msg"])
+			require.Equal(t, "abcd1234", obj["id"])
+
+		case <-time.After(time.Millisecond * 200):
+			require.Fail(t, "log fetch timeout")
+		}
+		close(continueCh)
+	}()
+	<-continueCh
+}
+
 func TestLogFile(t *testing.T) {
 	logPath := "../testdata/log_file.log"
 
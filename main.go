@@ -9,10 +9,17 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
 
+	"github.com/ortuman/jackal/admin"
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/cluster"
+	"github.com/ortuman/jackal/host"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/metrics"
 	"github.com/ortuman/jackal/server"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -30,6 +37,7 @@ var logoStr = []string{
 
 const usageStr = `
 Usage: jackal [options]
+       jackal migrate [options] <command>
 
 Server Options:
     -c, --config <file>    Configuration file path
@@ -39,6 +47,15 @@ Common Options:
 `
 
 func main() {
+	// schema migrations subcommand
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "jackal: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var configFile string
 	var showVersion bool
 	var showUsage bool
@@ -79,14 +96,42 @@ func main() {
 		fmt.Fprint(os.Stderr, "jackal: couldn't find a server configuration\n")
 		return
 	}
+	if err := server.ValidateListeners(cfg.Servers); err != nil {
+		fmt.Fprintf(os.Stderr, "jackal: %v\n", err)
+		return
+	}
 
 	// initialize subsystems
 	log.Initialize(&cfg.Logger)
 
 	storage.Initialize(&cfg.Storage)
 
+	auth.Initialize(&cfg.Auth)
+
+	// virtual hosts are local domains as well
+	for _, h := range cfg.Hosts {
+		if !contains(cfg.C2S.Domains, h.Name) {
+			cfg.C2S.Domains = append(cfg.C2S.Domains, h.Name)
+		}
+		for _, alias := range h.Aliases {
+			if cfg.C2S.Aliases == nil {
+				cfg.C2S.Aliases = make(map[string]string)
+			}
+			cfg.C2S.Aliases[alias] = h.Name
+		}
+	}
+	host.Initialize(cfg.Hosts)
+
 	c2s.Initialize(&cfg.C2S)
 
+	if cfg.Cluster != nil {
+		cluster.Initialize(cfg.Cluster, server.ClusterDeliverFunc(cfg.Servers))
+	}
+
+	metrics.Initialize(&cfg.Metrics, func() bool { return storage.Instance().Healthy() })
+
+	admin.Initialize(&cfg.Admin)
+
 	// create PID file
 	if err := createPIDFile(cfg.PIDFile); err != nil {
 		log.Warnf("%v", err)
@@ -98,7 +143,22 @@ func main() {
 	log.Infof("")
 	log.Infof("jackal %v\n", version.ApplicationVersion)
 
-	server.Initialize(cfg.Servers, cfg.Debug.Port)
+	// shut down gracefully on termination signals
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Infof("received %v signal... shutting down", sig)
+		server.Shutdown()
+	}()
+
+	server.Initialize(cfg.Servers, &cfg.Shutdown, cfg.Debug.Port)
+
+	cluster.Shutdown()
+	admin.Shutdown()
+	metrics.Shutdown()
+	storage.Shutdown()
+	log.Infof("jackal stopped")
 }
 
 func createPIDFile(pidFile string) error {
@@ -118,3 +178,12 @@ func createPIDFile(pidFile string) error {
 	}
 	return nil
 }
+
+func contains(domains []string, domain string) bool {
+	for _, d := range domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	defaultMetricsPath   = "/metrics"
+	defaultReadinessPath = "/ready"
+)
+
+// Config represents a metrics exporter configuration.
+type Config struct {
+	Port          int
+	Path          string
+	ReadinessPath string
+}
+
+type configProxyType struct {
+	Port          int    `yaml:"port"`
+	Path          string `yaml:"path"`
+	ReadinessPath string `yaml:"readiness_path"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := configProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.Port < 0 {
+		return errors.New("metrics.Config: invalid listening port")
+	}
+	c.Port = p.Port
+	c.Path = p.Path
+	if len(c.Path) == 0 {
+		c.Path = defaultMetricsPath
+	} else if !strings.HasPrefix(c.Path, "/") {
+		return errors.New("metrics.Config: path must start with '/'")
+	}
+	c.ReadinessPath = p.ReadinessPath
+	if len(c.ReadinessPath) == 0 {
+		c.ReadinessPath = defaultReadinessPath
+	} else if !strings.HasPrefix(c.ReadinessPath, "/") {
+		return errors.New("metrics.Config: readiness_path must start with '/'")
+	}
+	if c.ReadinessPath == c.Path {
+		return errors.New("metrics.Config: readiness_path must differ from path")
+	}
+	return nil
+}
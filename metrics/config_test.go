@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMetricsConfig(t *testing.T) {
+	cfg := Config{}
+	err := yaml.Unmarshal([]byte("port: 9100"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, 9100, cfg.Port)
+	require.Equal(t, defaultMetricsPath, cfg.Path)
+	require.Equal(t, defaultReadinessPath, cfg.ReadinessPath)
+
+	err = yaml.Unmarshal([]byte("{port: 9100, path: /stats}"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "/stats", cfg.Path)
+
+	err = yaml.Unmarshal([]byte("{port: 9100, path: stats}"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{port: 9100, readiness_path: /healthz}"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, "/healthz", cfg.ReadinessPath)
+
+	err = yaml.Unmarshal([]byte("{port: 9100, readiness_path: healthz}"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{port: 9100, readiness_path: /metrics}"), &cfg)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("port: -1"), &cfg)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "jackal"
+
+var (
+	// StanzasRouted counts stanzas successfully routed by the c2s manager, labeled by stanza type.
+	StanzasRouted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stanzas_routed_total",
+		Help:      "Number of routed stanzas.",
+	}, []string{"type"})
+
+	// C2SStreams tracks currently registered client-to-server streams.
+	C2SStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "c2s_streams",
+		Help:      "Number of active c2s streams.",
+	})
+
+	// S2SStreams tracks currently registered server-to-server streams,
+	// both incoming and outgoing.
+	S2SStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "s2s_streams",
+		Help:      "Number of active s2s streams.",
+	})
+
+	// StorageOperationDuration observes storage operation latency, labeled by operation name.
+	StorageOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Storage operation latency in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	// Authentications counts SASL authentication attempts, labeled by mechanism and result.
+	Authentications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentications_total",
+		Help:      "Number of SASL authentication attempts.",
+	}, []string{"mechanism", "result"})
+
+	// BlockListReloads counts in-memory block list reloads.
+	BlockListReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocklist_reloads_total",
+		Help:      "Number of block list reloads.",
+	})
+
+	// ClusterNodes tracks currently alive cluster nodes, local node included.
+	ClusterNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cluster_nodes",
+		Help:      "Number of alive cluster nodes.",
+	})
+
+	// C2SSendQueueHighWater tracks the highest outbound queue length reached by any c2s stream.
+	C2SSendQueueHighWater = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "c2s_send_queue_high_water",
+		Help:      "Highest c2s stream outbound queue length.",
+	})
+
+	// C2SSendQueueOverflows counts c2s streams dropped due to a full outbound queue.
+	C2SSendQueueOverflows = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "c2s_send_queue_overflows_total",
+		Help:      "Number of c2s streams dropped due to a full outbound queue.",
+	})
+
+	// ClusterStanzasForwarded counts stanzas forwarded to other cluster nodes.
+	ClusterStanzasForwarded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cluster_stanzas_forwarded_total",
+		Help:      "Number of stanzas forwarded to other cluster nodes.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(StanzasRouted)
+	prometheus.MustRegister(C2SStreams)
+	prometheus.MustRegister(S2SStreams)
+	prometheus.MustRegister(StorageOperationDuration)
+	prometheus.MustRegister(Authentications)
+	prometheus.MustRegister(BlockListReloads)
+	prometheus.MustRegister(ClusterNodes)
+	prometheus.MustRegister(ClusterStanzasForwarded)
+	prometheus.MustRegister(C2SSendQueueHighWater)
+	prometheus.MustRegister(C2SSendQueueOverflows)
+}
+
+// ObserveAuthentication accounts for a finished authentication attempt.
+func ObserveAuthentication(mechanism string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	Authentications.WithLabelValues(mechanism, result).Inc()
+}
+
+var sendQueueHighWater int64
+
+// ObserveC2SSendQueueLength accounts for a c2s stream outbound queue length,
+// raising the high-water mark whenever exceeded.
+func ObserveC2SSendQueueLength(length int) {
+	for {
+		hw := atomic.LoadInt64(&sendQueueHighWater)
+		if int64(length) <= hw {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&sendQueueHighWater, hw, int64(length)) {
+			C2SSendQueueHighWater.Set(float64(length))
+			return
+		}
+	}
+}
+
+var (
+	srv   *http.Server
+	srvMu sync.Mutex
+)
+
+// Initialize starts serving metrics over HTTP if a listening port has been configured.
+// Readiness is reported on the same listener by querying isReady.
+func Initialize(cfg *Config, isReady func() bool) {
+	if cfg.Port == 0 {
+		return
+	}
+	srvMu.Lock()
+	defer srvMu.Unlock()
+	if srv != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, promhttp.Handler())
+	mux.Handle(cfg.ReadinessPath, readinessHandler(isReady))
+	srv = &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: mux}
+
+	go func(srv *http.Server) {
+		log.Infof("metrics listening at %s%s", srv.Addr, cfg.Path)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error(err)
+		}
+	}(srv)
+}
+
+func readinessHandler(isReady func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isReady != nil && !isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// Shutdown stops serving metrics.
+func Shutdown() {
+	srvMu.Lock()
+	defer srvMu.Unlock()
+	if srv != nil {
+		srv.Close()
+		srv = nil
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsExport(t *testing.T) {
+	StanzasRouted.WithLabelValues("message").Inc()
+	C2SStreams.Inc()
+	S2SStreams.Set(0)
+	ObserveAuthentication("PLAIN", true)
+	ObserveAuthentication("PLAIN", false)
+	BlockListReloads.Inc()
+	StorageOperationDuration.WithLabelValues("FetchUser").Observe(0.01)
+	ObserveC2SSendQueueLength(12)
+	ObserveC2SSendQueueLength(3)
+	C2SSendQueueOverflows.Inc()
+
+	srv := httptest.NewServer(promhttp.Handler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+
+	out := string(b)
+	require.Contains(t, out, `jackal_stanzas_routed_total{type="message"}`)
+	require.Contains(t, out, `jackal_c2s_streams`)
+	require.Contains(t, out, `jackal_s2s_streams 0`)
+	require.Contains(t, out, `jackal_authentications_total{mechanism="PLAIN",result="success"}`)
+	require.Contains(t, out, `jackal_authentications_total{mechanism="PLAIN",result="failure"}`)
+	require.Contains(t, out, `jackal_blocklist_reloads_total`)
+	require.Contains(t, out, `jackal_storage_operation_duration_seconds_bucket{operation="FetchUser"`)
+	require.Contains(t, out, `jackal_c2s_send_queue_high_water 12`)
+	require.Contains(t, out, `jackal_c2s_send_queue_overflows_total 1`)
+}
+
+func TestMetricsReadiness(t *testing.T) {
+	ready := true
+	srv := httptest.NewServer(readinessHandler(func() bool { return ready }))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	ready = false
+	resp, err = srv.Client().Get(srv.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ortuman/jackal/storage"
+)
+
+const migrateUsageStr = `
+Usage: jackal migrate [options] <command>
+
+Commands:
+    status                 Show applied and pending schema migrations
+    up                     Apply pending schema migrations
+    baseline <version>     Record migrations up to version as applied without running them
+
+Options:
+    -c, --config <file>    Configuration file path
+    --dry-run              List pending migrations without applying them
+`
+
+// runMigrate executes a schema migration subcommand.
+func runMigrate(args []string, w io.Writer) error {
+	var configFile string
+	var dryRun bool
+
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.StringVar(&configFile, "config", "/etc/jackal/jackal.yml", "Configuration file path.")
+	fs.StringVar(&configFile, "c", "/etc/jackal/jackal.yml", "Configuration file path.")
+	fs.BoolVar(&dryRun, "dry-run", false, "List pending migrations without applying them.")
+	fs.Usage = func() { fmt.Fprintf(w, "%s\n", migrateUsageStr) }
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing migrate command")
+	}
+
+	var cfg Config
+	if err := cfg.FromFile(configFile); err != nil {
+		return err
+	}
+	switch cmd := fs.Arg(0); cmd {
+	case "status":
+		states, err := storage.MigrationStatus(&cfg.Storage)
+		if err != nil {
+			return err
+		}
+		for _, st := range states {
+			if st.Applied {
+				fmt.Fprintf(w, "applied  %v (%s)\n", st.Migration, st.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Fprintf(w, "pending  %v\n", st.Migration)
+			}
+		}
+		return nil
+
+	case "up":
+		migrations, err := storage.Migrate(&cfg.Storage, dryRun)
+		for _, m := range migrations {
+			if dryRun {
+				fmt.Fprintf(w, "pending  %v\n", m)
+			} else {
+				fmt.Fprintf(w, "applied  %v\n", m)
+			}
+		}
+		if err == nil && len(migrations) == 0 {
+			fmt.Fprintf(w, "schema is up to date\n")
+		}
+		return err
+
+	case "baseline":
+		if fs.NArg() < 2 {
+			return errors.New("missing baseline version")
+		}
+		version, err := strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			return fmt.Errorf("invalid baseline version: %s", fs.Arg(1))
+		}
+		migrations, err := storage.BaselineMigrations(&cfg.Storage, version)
+		for _, m := range migrations {
+			fmt.Fprintf(w, "recorded %v\n", m)
+		}
+		return err
+
+	default:
+		fs.Usage()
+		return fmt.Errorf("unrecognized migrate command: %s", cmd)
+	}
+}
@@ -0,0 +1,27 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate_Command(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	require.Nil(t, runMigrate([]string{"-h"}, buf))
+	require.Contains(t, buf.String(), "Usage: jackal migrate")
+
+	require.NotNil(t, runMigrate([]string{"-c", "./testdata/config_basic.yml"}, bytes.NewBuffer(nil)))
+	require.NotNil(t, runMigrate([]string{"-c", "./testdata/not_a_config.yml", "status"}, bytes.NewBuffer(nil)))
+
+	// mock storage has no schema to migrate
+	err := runMigrate([]string{"-c", "./testdata/config_basic.yml", "status"}, bytes.NewBuffer(nil))
+	require.Equal(t, storage.ErrMigrationsNotSupported, err)
+}
@@ -28,3 +28,12 @@ type IQHandler interface {
 	// over the associated stream.
 	ProcessIQ(iq *xml.IQ)
 }
+
+// Disposable represents a module that must be signaled
+// once its associated stream terminates.
+type Disposable interface {
+	Module
+
+	// Done signals stream termination.
+	Done()
+}
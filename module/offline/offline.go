@@ -6,7 +6,8 @@
 package offline
 
 import (
-	"github.com/ortuman/jackal/log"
+	"errors"
+
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
@@ -14,16 +15,30 @@ import (
 
 const offlineNamespace = "msgoffline"
 
+const defaultQueueSize = 100
+
+// ErrQueueFull will be returned when storing a message
+// for a user whose offline queue is already full.
+var ErrQueueFull = errors.New("offline: queue full")
+
 // Config represents Offline Storage module configuration.
 type Config struct {
 	QueueSize int `yaml:"queue_size"`
 }
 
+func (c *Config) queueSize() int {
+	if c.QueueSize > 0 {
+		return c.QueueSize
+	}
+	return defaultQueueSize
+}
+
 // ModOffline represents an offline server stream module.
 type ModOffline struct {
-	cfg     *Config
-	stm     c2s.Stream
-	actorCh chan func()
+	cfg       *Config
+	stm       c2s.Stream
+	actorCh   chan func()
+	archiveFn func(*xml.Message)
 }
 
 // New returns an offline server stream module.
@@ -45,13 +60,42 @@ func (o *ModOffline) AssociatedNamespaces() []string {
 	return []string{offlineNamespace}
 }
 
+// OnArchive sets the handler to be invoked every time
+// a message is successfully stored offline.
+func (o *ModOffline) OnArchive(fn func(*xml.Message)) {
+	o.archiveFn = fn
+}
+
 // ArchiveMessage archives a new offline messages into the storage.
+// Only 'normal' and 'chat' messages containing a body are stored,
+// any other message is silently discarded.
 func (o *ModOffline) ArchiveMessage(message *xml.Message) {
 	o.actorCh <- func() {
 		o.archiveMessage(message)
 	}
 }
 
+// ArchiveMessageAndWait archives a new offline message into the storage
+// in a synchronous manner.
+func (o *ModOffline) ArchiveMessageAndWait(message *xml.Message) {
+	continueCh := make(chan struct{})
+	o.actorCh <- func() {
+		o.archiveMessage(message)
+		close(continueCh)
+	}
+	<-continueCh
+}
+
+// StoreMessage stores a message delivered by a remote server
+// for an unavailable local user.
+// Same storing rules as ArchiveMessage apply.
+func StoreMessage(config *Config, message *xml.Message) error {
+	if !isStorable(message) {
+		return nil
+	}
+	return storeMessage(message, message.ToJID().Domain(), config.queueSize())
+}
+
 // DeliverOfflineMessages delivers every archived offline messages to the peer
 // deleting them from storage.
 func (o *ModOffline) DeliverOfflineMessages() {
@@ -72,43 +116,65 @@ func (o *ModOffline) actorLoop(doneCh <-chan struct{}) {
 }
 
 func (o *ModOffline) archiveMessage(message *xml.Message) {
-	toJid := message.ToJID()
-	queueSize, err := storage.Instance().CountOfflineMessages(toJid.Node())
-	if err != nil {
-		log.Error(err)
+	if !isStorable(message) {
 		return
 	}
-	if queueSize >= o.cfg.QueueSize {
+	switch err := storeMessage(message, o.stm.Domain(), o.cfg.queueSize()); err {
+	case nil:
+		break
+	case ErrQueueFull:
 		response := xml.NewElementFromElement(message)
-		response.SetFrom(toJid.String())
+		response.SetFrom(message.ToJID().String())
 		response.SetTo(o.stm.JID().String())
 		o.stm.SendElement(response.ServiceUnavailableError())
 		return
-	}
-	delayed := xml.NewElementFromElement(message)
-	delayed.Delay(o.stm.Domain(), "Offline Storage")
-	if err := storage.Instance().InsertOfflineMessage(delayed, toJid.Node()); err != nil {
-		log.Errorf("%v", err)
+	default:
+		c2s.Logger(o.stm).Error(err)
 		return
 	}
-	log.Infof("archived offline message... id: %s", message.ID())
+	c2s.Logger(o.stm).Infof("archived offline message... id: %s", message.ID())
+
+	if o.archiveFn != nil {
+		o.archiveFn(message)
+	}
 }
 
 func (o *ModOffline) deliverOfflineMessages() {
 	messages, err := storage.Instance().FetchOfflineMessages(o.stm.Username())
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(o.stm).Error(err)
 		return
 	}
 	if len(messages) == 0 {
 		return
 	}
-	log.Infof("delivering offline messages... count: %d", len(messages))
+	c2s.Logger(o.stm).Infof("delivering offline messages... count: %d", len(messages))
 
 	for _, m := range messages {
 		o.stm.SendElement(m)
 	}
 	if err := storage.Instance().DeleteOfflineMessages(o.stm.Username()); err != nil {
-		log.Error(err)
+		c2s.Logger(o.stm).Error(err)
+	}
+}
+
+func storeMessage(message *xml.Message, domain string, queueSize int) error {
+	toJid := message.ToJID()
+	count, err := storage.Instance().CountOfflineMessages(toJid.Node())
+	if err != nil {
+		return err
+	}
+	if count >= queueSize {
+		return ErrQueueFull
+	}
+	delayed := xml.NewElementFromElement(message)
+	delayed.Delay(domain, "Offline Storage")
+	return storage.Instance().InsertOfflineMessage(delayed, toJid.Node())
+}
+
+func isStorable(message *xml.Message) bool {
+	if !message.IsNormal() && !message.IsChat() {
+		return false // groupchat, headline and error messages are never stored
 	}
+	return message.IsMessageWithBody()
 }
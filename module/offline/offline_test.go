@@ -37,6 +37,7 @@ func TestOffline_ArchiveMessage(t *testing.T) {
 	msg := xml.NewMessageType(msgID, "normal")
 	msg.SetFromJID(j1)
 	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
 	x.ArchiveMessage(msg)
 
 	// wait for insertion...
@@ -66,4 +67,81 @@ func TestOffline_ArchiveMessage(t *testing.T) {
 	elem = stm2.FetchElement()
 	require.NotNil(t, elem)
 	require.Equal(t, msgID, elem.ID())
+	require.NotNil(t, elem.Elements().ChildNamespace("delay", "urn:xmpp:delay"))
+
+	msgs, _ = storage.Instance().FetchOfflineMessages("juliet")
+	require.Equal(t, 0, len(msgs))
+}
+
+func TestOffline_DiscardMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetDomain("jackal.im")
+
+	x := New(&Config{}, stm)
+
+	var archived []*xml.Message
+	x.OnArchive(func(m *xml.Message) { archived = append(archived, m) })
+
+	// chat state notification (no body)
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementNamespace("composing", "http://jabber.org/protocol/chatstates"))
+	x.ArchiveMessageAndWait(msg)
+
+	for _, typ := range []string{xml.GroupChatType, xml.HeadlineType} {
+		msg := xml.NewMessageType(uuid.New(), typ)
+		msg.SetFromJID(j1)
+		msg.SetToJID(j2)
+		msg.AppendElement(xml.NewElementName("body"))
+		x.ArchiveMessageAndWait(msg)
+	}
+	msgs, err := storage.Instance().FetchOfflineMessages("juliet")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(msgs))
+	require.Equal(t, 0, len(archived))
+
+	// default queue size applies when not configured
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	x.ArchiveMessageAndWait(msg)
+
+	msgs, _ = storage.Instance().FetchOfflineMessages("juliet")
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, 1, len(archived))
+	require.Equal(t, msg.ID(), archived[0].ID())
+	require.Equal(t, 0, stm.FetchElement().Elements().Count())
+}
+
+func TestOffline_StoreMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j1, _ := xml.NewJID("romeo", "remote.im", "garden", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "", true)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+
+	cfg := &Config{QueueSize: 1}
+	require.Nil(t, StoreMessage(cfg, msg))
+	require.Equal(t, ErrQueueFull, StoreMessage(cfg, msg))
+
+	msgs, err := storage.Instance().FetchOfflineMessages("juliet")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(msgs))
+
+	delay := msgs[0].Elements().ChildNamespace("delay", "urn:xmpp:delay")
+	require.NotNil(t, delay)
+	require.Equal(t, "jackal.im", delay.Attributes().Get("from"))
 }
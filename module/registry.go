@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+// Factory returns a new module instance associated to a stream.
+type Factory func(stm c2s.Stream) Module
+
+type registration struct {
+	name    string
+	factory Factory
+}
+
+var (
+	registrationsMu sync.RWMutex
+	registrations   []registration
+)
+
+// Register makes a module factory available under the provided name.
+// Stream modules are instantiated in registration order.
+// If Register is called twice with the same name or if factory is nil, it panics.
+func Register(name string, factory Factory) {
+	if factory == nil {
+		panic("module: Register factory is nil")
+	}
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+	for _, reg := range registrations {
+		if reg.name == name {
+			panic(fmt.Sprintf("module: Register called twice for module %s", name))
+		}
+	}
+	registrations = append(registrations, registration{name: name, factory: factory})
+}
+
+// IsRegistered returns whether or not a module factory
+// has been registered under the provided name.
+func IsRegistered(name string) bool {
+	registrationsMu.RLock()
+	defer registrationsMu.RUnlock()
+	for _, reg := range registrations {
+		if reg.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Registry manages the lifecycle of the modules associated to a stream.
+type Registry struct {
+	names      []string
+	modules    []Module
+	iqHandlers []IQHandler
+}
+
+// NewRegistry instantiates every registered module enabled for a stream.
+func NewRegistry(stm c2s.Stream, isEnabled func(name string) bool) *Registry {
+	registrationsMu.RLock()
+	regs := make([]registration, len(registrations))
+	copy(regs, registrations)
+	registrationsMu.RUnlock()
+
+	r := &Registry{}
+	for _, reg := range regs {
+		if !isEnabled(reg.name) {
+			continue
+		}
+		mod := reg.factory(stm)
+		r.names = append(r.names, reg.name)
+		r.modules = append(r.modules, mod)
+		if iqHandler, ok := mod.(IQHandler); ok {
+			r.iqHandlers = append(r.iqHandlers, iqHandler)
+		}
+	}
+	return r
+}
+
+// Module returns the module instantiated under the provided name,
+// or nil if it's not enabled.
+func (r *Registry) Module(name string) Module {
+	for i, n := range r.names {
+		if n == name {
+			return r.modules[i]
+		}
+	}
+	return nil
+}
+
+// Modules returns all stream modules.
+func (r *Registry) Modules() []Module {
+	return r.modules
+}
+
+// MatchingIQHandler returns the module that should process an IQ,
+// or nil if no module matches it.
+func (r *Registry) MatchingIQHandler(iq *xml.IQ) IQHandler {
+	for _, iqHandler := range r.iqHandlers {
+		if iqHandler.MatchesIQ(iq) {
+			return iqHandler
+		}
+	}
+	return nil
+}
+
+// ProcessIQ dispatches an IQ to the module matching it,
+// returning false if no module matched.
+func (r *Registry) ProcessIQ(iq *xml.IQ) bool {
+	iqHandler := r.MatchingIQHandler(iq)
+	if iqHandler == nil {
+		return false
+	}
+	iqHandler.ProcessIQ(iq)
+	return true
+}
+
+// AssociatedNamespaces returns all stream modules associated namespaces.
+func (r *Registry) AssociatedNamespaces() []string {
+	var namespaces []string
+	for _, mod := range r.modules {
+		namespaces = append(namespaces, mod.AssociatedNamespaces()...)
+	}
+	return namespaces
+}
+
+// Done signals stream termination to every module,
+// in reverse instantiation order.
+func (r *Registry) Done() {
+	for i := len(r.modules) - 1; i >= 0; i-- {
+		if d, ok := r.modules[i].(Disposable); ok {
+			d.Done()
+		}
+	}
+}
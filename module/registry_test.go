@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type testModule struct {
+	namespace string
+	processed []string
+	done      bool
+}
+
+func (m *testModule) AssociatedNamespaces() []string { return []string{m.namespace} }
+func (m *testModule) Done()                          { m.done = true }
+
+type testIQHandler struct {
+	testModule
+}
+
+func (m *testIQHandler) MatchesIQ(iq *xml.IQ) bool {
+	return iq.Elements().ChildNamespace("query", m.namespace) != nil
+}
+
+func (m *testIQHandler) ProcessIQ(iq *xml.IQ) {
+	m.processed = append(m.processed, iq.ID())
+}
+
+func TestRegistry_Register(t *testing.T) {
+	Register("test_register", func(stm c2s.Stream) Module { return &testModule{} })
+	require.True(t, IsRegistered("test_register"))
+	require.False(t, IsRegistered("test_unknown"))
+
+	require.Panics(t, func() {
+		Register("test_register", func(stm c2s.Stream) Module { return &testModule{} })
+	})
+	require.Panics(t, func() { Register("test_nil", nil) })
+}
+
+func TestRegistry_Lifecycle(t *testing.T) {
+	var stms []c2s.Stream
+	Register("test_a", func(stm c2s.Stream) Module {
+		stms = append(stms, stm)
+		return &testIQHandler{testModule{namespace: "urn:test:a"}}
+	})
+	Register("test_b", func(stm c2s.Stream) Module {
+		return &testModule{namespace: "urn:test:b"}
+	})
+	Register("test_c", func(stm c2s.Stream) Module {
+		return &testIQHandler{testModule{namespace: "urn:test:c"}}
+	})
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+
+	r := NewRegistry(stm, func(name string) bool { return name == "test_a" || name == "test_b" })
+	require.Equal(t, 2, len(r.Modules()))
+	require.Equal(t, []c2s.Stream{stm}, stms)
+	require.Nil(t, r.Module("test_c"))
+	require.Equal(t, []string{"urn:test:a", "urn:test:b"}, r.AssociatedNamespaces())
+
+	// IQ dispatching
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", "urn:test:a"))
+	require.True(t, r.ProcessIQ(iq))
+
+	a := r.Module("test_a").(*testIQHandler)
+	require.Equal(t, []string{iq.ID()}, a.processed)
+
+	iq2 := xml.NewIQType(uuid.New(), xml.GetType)
+	iq2.AppendElement(xml.NewElementNamespace("query", "urn:test:c"))
+	require.Nil(t, r.MatchingIQHandler(iq2))
+	require.False(t, r.ProcessIQ(iq2))
+
+	r.Done()
+	require.True(t, a.done)
+	require.True(t, r.Module("test_b").(*testModule).done)
+}
@@ -8,8 +8,14 @@ package roster
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ortuman/jackal/auth"
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
@@ -29,13 +35,99 @@ const (
 	SubscriptionRemove = "remove"
 )
 
+// maximum roster item group name length
+const maxGroupNameLength = 1023
+
+// errRosterFull will be returned when adding an item
+// to a roster that already reached the configured limit.
+var errRosterFull = errors.New("roster: maximum number of items reached")
+
 const (
 	rosterRequestedContextKey = "roster:requested"
+	rosterPushedVerContextKey = "roster:pushed_ver"
+)
+
+type rosterLock struct {
+	sync.Mutex
+	refs int
+}
+
+// roster mutation locks, keyed by user bare JID
+var (
+	rosterLocksMu sync.Mutex
+	rosterLocks   = make(map[string]*rosterLock)
+)
+
+// SubscriptionPolicy represents the policy applied to
+// incoming subscription requests on behalf of local contacts.
+type SubscriptionPolicy string
+
+const (
+	// ManualSubscriptions lets contacts approve or deny every subscription request.
+	ManualSubscriptions SubscriptionPolicy = "manual"
+
+	// AcceptSubscriptions automatically approves every subscription request.
+	AcceptSubscriptions SubscriptionPolicy = "accept"
+
+	// AcceptSameDomainSubscriptions automatically approves subscription requests
+	// coming from the contact's domain, letting contacts approve the rest.
+	AcceptSameDomainSubscriptions SubscriptionPolicy = "accept_same_domain"
+
+	// RejectSubscriptions automatically denies every subscription request.
+	RejectSubscriptions SubscriptionPolicy = "reject"
 )
 
 // Config represents roster module configuration.
 type Config struct {
-	Versioning bool `yaml:"versioning"`
+	Versioning         bool
+	SubscriptionPolicy SubscriptionPolicy
+
+	// PresenceCoalescing is the window during which successive presence
+	// changes are coalesced into a single broadcast of the latest one.
+	PresenceCoalescing time.Duration
+
+	// PresenceBroadcastRate limits the number of available presences
+	// routed per second while broadcasting (0 means unlimited).
+	PresenceBroadcastRate int
+
+	// MaxItems limits the number of items a user
+	// can add to its roster (0 means unlimited).
+	MaxItems int
+}
+
+type configProxyType struct {
+	Versioning            bool   `yaml:"versioning"`
+	SubscriptionPolicy    string `yaml:"subscription_policy"`
+	PresenceCoalescing    int    `yaml:"presence_coalescing"`
+	PresenceBroadcastRate int    `yaml:"presence_broadcast_rate"`
+	MaxItems              int    `yaml:"max_items"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (cfg *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := configProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	switch policy := SubscriptionPolicy(p.SubscriptionPolicy); policy {
+	case "":
+		cfg.SubscriptionPolicy = ManualSubscriptions
+	case ManualSubscriptions, AcceptSubscriptions, AcceptSameDomainSubscriptions, RejectSubscriptions:
+		cfg.SubscriptionPolicy = policy
+	default:
+		return fmt.Errorf("roster.Config: unrecognized subscription policy: %s", p.SubscriptionPolicy)
+	}
+	if p.PresenceCoalescing < 0 || p.PresenceBroadcastRate < 0 {
+		return errors.New("roster.Config: presence broadcast options can't be negative")
+	}
+	if p.MaxItems < 0 {
+		return errors.New("roster.Config: max_items can't be negative")
+	}
+	cfg.Versioning = p.Versioning
+	cfg.MaxItems = p.MaxItems
+	cfg.PresenceCoalescing = time.Millisecond * time.Duration(p.PresenceCoalescing)
+	cfg.PresenceBroadcastRate = p.PresenceBroadcastRate
+	return nil
 }
 
 // ModRoster represents a roster server stream module.
@@ -44,6 +136,15 @@ type ModRoster struct {
 	stm        c2s.Stream
 	actorCh    chan func()
 	errHandler func(error)
+	presenceFn func(*xml.Presence) bool
+	domainCfg  func(domain string) *Config
+	probed     map[string]struct{}
+	directed   map[string]*xml.JID
+
+	broadcastSeq    uint64     // incremented on every broadcast request
+	fanOutMu        sync.Mutex // serializes broadcasted presences routing
+	pendingPresence *xml.Presence
+	pendingTimer    *time.Timer
 }
 
 // New returns a roster server stream module.
@@ -52,12 +153,27 @@ func New(cfg *Config, stm c2s.Stream) *ModRoster {
 		cfg:        cfg,
 		stm:        stm,
 		actorCh:    make(chan func(), 32),
-		errHandler: func(err error) { log.Error(err) },
+		errHandler: func(err error) { c2s.Logger(stm).Error(err) },
+		probed:     make(map[string]struct{}),
+		directed:   make(map[string]*xml.JID),
 	}
 	go r.actorLoop(stm.Context().Done())
 	return r
 }
 
+// SetPresenceFilter sets the handler used to decide whether
+// or not a broadcasted presence should be routed to a contact.
+func (r *ModRoster) SetPresenceFilter(fn func(*xml.Presence) bool) {
+	r.presenceFn = fn
+}
+
+// SetDomainConfig sets the handler used to obtain the roster configuration
+// of a local domain, applied to subscription requests addressed to its users.
+// Module configuration applies if not set or if it returns nil.
+func (r *ModRoster) SetDomainConfig(fn func(domain string) *Config) {
+	r.domainCfg = fn
+}
+
 // AssociatedNamespaces returns namespaces associated
 // with roster module.
 func (r *ModRoster) AssociatedNamespaces() []string {
@@ -90,6 +206,7 @@ func (r *ModRoster) ProcessIQ(iq *xml.IQ) {
 }
 
 // ProcessPresence process an incoming roster presence.
+// Available and unavailable presences are handled as directed presences.
 func (r *ModRoster) ProcessPresence(presence *xml.Presence) {
 	r.actorCh <- func() {
 		if err := r.processPresence(presence); err != nil {
@@ -109,7 +226,7 @@ func (r *ModRoster) DeliverPendingApprovalNotifications() {
 }
 
 // ReceivePresences delivers all inbound roster available presences
-// to the associated module stream.
+// to the associated module stream, probing remote contacts' presence.
 func (r *ModRoster) ReceivePresences() {
 	r.actorCh <- func() {
 		if err := r.receivePresences(); err != nil {
@@ -119,8 +236,16 @@ func (r *ModRoster) ReceivePresences() {
 }
 
 // BroadcastPresence broadcasts presence to all outbound roster contacts.
+// Available presences are coalesced during the configured window,
+// so that only the latest one gets broadcasted.
 func (r *ModRoster) BroadcastPresence(presence *xml.Presence) {
+	atomic.AddUint64(&r.broadcastSeq, 1)
 	r.actorCh <- func() {
+		if r.cfg.PresenceCoalescing > 0 && !presence.IsUnavailable() {
+			r.coalescePresence(presence)
+			return
+		}
+		r.cancelPendingBroadcast()
 		if err := r.broadcastPresence(presence); err != nil {
 			r.errHandler(err)
 		}
@@ -130,8 +255,10 @@ func (r *ModRoster) BroadcastPresence(presence *xml.Presence) {
 // BroadcastPresenceAndWait broadcasts presence to all outbound
 // roster contacts in a synchronous manner.
 func (r *ModRoster) BroadcastPresenceAndWait(presence *xml.Presence) {
+	atomic.AddUint64(&r.broadcastSeq, 1)
 	continueCh := make(chan struct{})
 	r.actorCh <- func() {
+		r.cancelPendingBroadcast()
 		if err := r.broadcastPresence(presence); err != nil {
 			r.errHandler(err)
 		}
@@ -140,6 +267,19 @@ func (r *ModRoster) BroadcastPresenceAndWait(presence *xml.Presence) {
 	<-continueCh
 }
 
+// LeaveDirectedPresencesAndWait sends unavailable presence to every
+// directed presence recipient not notified yet, in a synchronous manner.
+// Intended for streams going away without having broadcasted
+// their availability.
+func (r *ModRoster) LeaveDirectedPresencesAndWait() {
+	continueCh := make(chan struct{})
+	r.actorCh <- func() {
+		r.leaveDirectedPresences()
+		close(continueCh)
+	}
+	<-continueCh
+}
+
 func (r *ModRoster) actorLoop(doneCh <-chan struct{}) {
 	for {
 		select {
@@ -152,6 +292,12 @@ func (r *ModRoster) actorLoop(doneCh <-chan struct{}) {
 }
 
 func (r *ModRoster) processPresence(presence *xml.Presence) error {
+	if presence.IsAvailable() || presence.IsUnavailable() {
+		return r.processDirectedPresence(presence)
+	}
+	unlock := lockRosters(r.stm.JID().ToBareJID(), presence.ToJID().ToBareJID())
+	defer unlock()
+
 	switch presence.Type() {
 	case xml.SubscribeType:
 		return r.processSubscribe(presence)
@@ -188,61 +334,213 @@ func (r *ModRoster) receivePresences() error {
 	for _, item := range items {
 		switch item.Subscription {
 		case SubscriptionTo, SubscriptionBoth:
-			r.routePresencesFrom(r.rosterItemJID(&item), usrJID, xml.AvailableType)
+			cntJID := r.rosterItemJID(&item)
+			if c2s.Instance().IsLocalDomain(cntJID.Domain()) {
+				r.routePresencesFrom(cntJID, usrJID, xml.AvailableType)
+				continue
+			}
+			if _, ok := r.probed[cntJID.String()]; ok {
+				continue // already probed
+			}
+			// remote contact presence will be answered by its server
+			c2s.Instance().Route(xml.NewPresence(usrJID.ToBareJID(), cntJID, xml.ProbeType))
+			r.probed[cntJID.String()] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// processDirectedPresence routes a presence addressed to a specific entity.
+// Entities not notified by presence broadcast (either not subscribed or
+// the user not being available) are tracked, so that they get notified
+// once the user becomes unavailable.
+// (https://xmpp.org/rfcs/rfc6121.html#presence-directed)
+func (r *ModRoster) processDirectedPresence(presence *xml.Presence) error {
+	toJID := presence.ToJID()
+	ri, err := storage.Instance().FetchRosterItem(r.stm.Username(), toJID.ToBareJID().String())
+	if err != nil {
+		return err
+	}
+	subscribed := ri != nil && (ri.Subscription == SubscriptionFrom || ri.Subscription == SubscriptionBoth)
+	if p := r.stm.Presence(); !subscribed || p == nil || !p.IsAvailable() {
+		if presence.IsAvailable() {
+			r.directed[toJID.String()] = toJID
+		} else {
+			delete(r.directed, toJID.String())
 		}
 	}
+	c2s.Instance().Route(presence)
 	return nil
 }
 
+// coalescePresence holds presence back until the coalescing window
+// expires, replacing any other presence still pending to be broadcasted.
+func (r *ModRoster) coalescePresence(presence *xml.Presence) {
+	r.pendingPresence = presence
+	if r.pendingTimer != nil {
+		return
+	}
+	r.pendingTimer = time.AfterFunc(r.cfg.PresenceCoalescing, func() {
+		select {
+		case r.actorCh <- r.flushPendingBroadcast:
+		case <-r.stm.Context().Done():
+		}
+	})
+}
+
+func (r *ModRoster) flushPendingBroadcast() {
+	presence := r.pendingPresence
+	r.pendingPresence = nil
+	r.pendingTimer = nil
+	if presence == nil {
+		return
+	}
+	if err := r.broadcastPresence(presence); err != nil {
+		r.errHandler(err)
+	}
+}
+
+func (r *ModRoster) cancelPendingBroadcast() {
+	if r.pendingTimer != nil {
+		r.pendingTimer.Stop()
+	}
+	r.pendingPresence = nil
+	r.pendingTimer = nil
+}
+
 func (r *ModRoster) broadcastPresence(presence *xml.Presence) error {
 	itms, _, err := storage.Instance().FetchRosterItems(r.stm.Username())
 	if err != nil {
 		return err
 	}
+	seq := atomic.LoadUint64(&r.broadcastSeq)
+	rate := r.cfg.PresenceBroadcastRate
+
+	var ps []*xml.Presence
 	for _, itm := range itms {
 		switch itm.Subscription {
 		case SubscriptionFrom, SubscriptionBoth:
 			p := xml.NewPresence(r.stm.JID(), r.rosterItemJID(&itm), presence.Type())
-			p.AppendElements(p.Elements().All())
-			c2s.Instance().Route(p)
+			p.AppendElements(presence.Elements().All())
+			if r.presenceFn != nil && !r.presenceFn(p) {
+				continue
+			}
+			ps = append(ps, p)
 		}
 	}
+	if rate > 0 && len(ps) > rate && presence.IsAvailable() {
+		// pace broadcast fan-out without holding the stream back
+		go r.routePacedPresences(ps, rate, seq)
+		return nil
+	}
+	r.fanOutMu.Lock()
+	for _, p := range ps {
+		c2s.Instance().Route(p)
+	}
+	r.fanOutMu.Unlock()
+
+	if presence.IsUnavailable() {
+		r.leaveDirectedPresences()
+	}
 	return nil
 }
 
+// routePacedPresences routes broadcasted presences at the configured rate,
+// giving up as soon as a newer presence broadcast is requested, as it will
+// reach every contact anyway, or the stream goes away.
+func (r *ModRoster) routePacedPresences(ps []*xml.Presence, rate int, seq uint64) {
+	for i, p := range ps {
+		if i > 0 && i%rate == 0 {
+			select {
+			case <-time.After(time.Second):
+			case <-r.stm.Context().Done():
+				return
+			}
+		}
+		r.fanOutMu.Lock()
+		if atomic.LoadUint64(&r.broadcastSeq) != seq {
+			r.fanOutMu.Unlock()
+			return
+		}
+		c2s.Instance().Route(p)
+		r.fanOutMu.Unlock()
+	}
+}
+
+func (r *ModRoster) leaveDirectedPresences() {
+	for k, j := range r.directed {
+		c2s.Instance().Route(xml.NewPresence(r.stm.JID(), j, xml.UnavailableType))
+		delete(r.directed, k)
+	}
+}
+
 func (r *ModRoster) sendRoster(iq *xml.IQ, query xml.XElement) {
 	if query.Elements().Count() > 0 {
 		r.stm.SendElement(iq.BadRequestError())
 		return
 	}
-	log.Infof("retrieving user roster... (%s/%s)", r.stm.Username(), r.stm.Resource())
+	c2s.Logger(r.stm).Infof("retrieving user roster... (%s/%s)", r.stm.Username(), r.stm.Resource())
 
-	itms, ver, err := storage.Instance().FetchRosterItems(r.stm.Username())
+	// no roster push must be missed or duplicated while retrieving the roster
+	unlock := lockRosters(r.stm.JID().ToBareJID())
+	defer unlock()
+
+	shared, err := r.sharedRosterItems()
 	if err != nil {
 		r.errHandler(err)
 		r.stm.SendElement(iq.InternalServerError())
 		return
 	}
-	v := r.parseVer(query.Attributes().Get("ver"))
+	// shared group changes are not tracked by roster version
+	versioning := r.cfg.Versioning && len(shared) == 0
 
+	v := r.parseVer(query.Attributes().Get("ver"))
+	if versioning && v > 0 {
+		ver, err := storage.Instance().FetchRosterVersion(r.stm.Username())
+		if err != nil {
+			r.errHandler(err)
+			r.stm.SendElement(iq.InternalServerError())
+			return
+		}
+		if v == ver.Ver {
+			// client roster is up to date
+			r.stm.SendElement(iq.ResultIQ())
+			r.stm.Context().SetInt(ver.Ver, rosterPushedVerContextKey)
+			r.stm.Context().SetBool(true, rosterRequestedContextKey)
+			return
+		}
+	}
+	itms, ver, err := storage.Instance().FetchRosterItems(r.stm.Username())
+	if err != nil {
+		r.errHandler(err)
+		r.stm.SendElement(iq.InternalServerError())
+		return
+	}
 	res := iq.ResultIQ()
-	if !r.cfg.Versioning || v == 0 || v < ver.DeletionVer {
+	if !versioning || v == 0 || v < ver.DeletionVer || v > ver.Ver {
 		// push all roster items
 		q := xml.NewElementNamespace("query", rosterNamespace)
-		if r.cfg.Versioning {
+		if versioning {
 			q.SetAttribute("ver", fmt.Sprintf("v%d", ver.Ver))
 		}
 		for _, itm := range itms {
 			q.AppendElement(r.elementFromRosterItem(&itm))
 		}
+		for _, itm := range shared {
+			if !containsRosterItem(itms, itm.JID) {
+				q.AppendElement(r.elementFromRosterItem(&itm))
+			}
+		}
 		res.AppendElement(q)
 		r.stm.SendElement(res)
 	} else {
 		// push roster changes
 		r.stm.SendElement(res)
+		sort.Slice(itms, func(i, j int) bool { return itms[i].Ver < itms[j].Ver })
 		for _, itm := range itms {
 			if itm.Ver > v {
 				iq := xml.NewIQType(uuid.New(), xml.SetType)
+				iq.SetTo(r.stm.JID().String())
 				q := xml.NewElementNamespace("query", rosterNamespace)
 				q.SetAttribute("ver", fmt.Sprintf("v%d", itm.Ver))
 				q.AppendElement(r.elementFromRosterItem(&itm))
@@ -251,6 +549,7 @@ func (r *ModRoster) sendRoster(iq *xml.IQ, query xml.XElement) {
 			}
 		}
 	}
+	r.stm.Context().SetInt(ver.Ver, rosterPushedVerContextKey)
 	r.stm.Context().SetBool(true, rosterRequestedContextKey)
 }
 
@@ -262,9 +561,12 @@ func (r *ModRoster) updateRoster(iq *xml.IQ, query xml.XElement) {
 	}
 	ri, err := r.rosterItemFromElement(itms[0])
 	if err != nil {
-		r.stm.SendElement(iq.BadRequestError())
+		r.stm.SendElement(xml.NewErrorElementFromElement(iq, err.(*xml.StanzaError), nil))
 		return
 	}
+	unlock := lockRosters(r.stm.JID().ToBareJID(), r.rosterItemJID(ri).ToBareJID())
+	defer unlock()
+
 	switch ri.Subscription {
 	case SubscriptionRemove:
 		if err := r.removeItem(ri); err != nil {
@@ -273,7 +575,13 @@ func (r *ModRoster) updateRoster(iq *xml.IQ, query xml.XElement) {
 			return
 		}
 	default:
-		if err := r.updateItem(ri); err != nil {
+		switch err := r.updateItem(ri); err {
+		case nil:
+			break
+		case errRosterFull:
+			r.stm.SendElement(iq.NotAcceptableError())
+			return
+		default:
 			r.errHandler(err)
 			r.stm.SendElement(iq.InternalServerError())
 			return
@@ -288,7 +596,7 @@ func (r *ModRoster) removeItem(ri *model.RosterItem) error {
 	usrJID := r.stm.JID().ToBareJID()
 	cntJID := r.rosterItemJID(ri).ToBareJID()
 
-	log.Infof("removing roster item: %v (%s/%s)", cntJID, r.stm.Username(), r.stm.Resource())
+	c2s.Logger(r.stm).Infof("removing roster item: %v (%s/%s)", cntJID, r.stm.Username(), r.stm.Resource())
 
 	usrRi, err := storage.Instance().FetchRosterItem(usrJID.Node(), cntJID.String())
 	if err != nil {
@@ -329,14 +637,14 @@ func (r *ModRoster) removeItem(ri *model.RosterItem) error {
 			switch cntRi.Subscription {
 			case SubscriptionBoth:
 				cntRi.Subscription = SubscriptionTo
-				if r.insertOrUpdateItem(cntRi, cntJID); err != nil {
+				if err := r.insertOrUpdateItem(cntRi, cntJID); err != nil {
 					return err
 				}
 				fallthrough
 
 			default:
 				cntRi.Subscription = SubscriptionNone
-				if r.insertOrUpdateItem(cntRi, cntJID); err != nil {
+				if err := r.insertOrUpdateItem(cntRi, cntJID); err != nil {
 					return err
 				}
 			}
@@ -359,7 +667,7 @@ func (r *ModRoster) updateItem(ri *model.RosterItem) error {
 	usrJID := r.stm.JID().ToBareJID()
 	cntJID := r.rosterItemJID(ri).ToBareJID()
 
-	log.Infof("updating roster item - contact: %s (%s/%s)", cntJID, r.stm.Username(), r.stm.Resource())
+	c2s.Logger(r.stm).Infof("updating roster item - contact: %s (%s/%s)", cntJID, r.stm.Username(), r.stm.Resource())
 
 	usrRi, err := storage.Instance().FetchRosterItem(usrJID.Node(), cntJID.String())
 	if err != nil {
@@ -373,6 +681,9 @@ func (r *ModRoster) updateItem(ri *model.RosterItem) error {
 		usrRi.Groups = ri.Groups
 
 	} else {
+		if err := r.checkRosterSize(); err != nil {
+			return err
+		}
 		usrRi = &model.RosterItem{
 			Username:     r.stm.Username(),
 			JID:          ri.JID,
@@ -385,11 +696,60 @@ func (r *ModRoster) updateItem(ri *model.RosterItem) error {
 	return r.insertOrUpdateItem(usrRi, r.stm.JID())
 }
 
+// checkRosterSize returns errRosterFull if user's roster
+// can't hold any other item.
+func (r *ModRoster) checkRosterSize() error {
+	if r.cfg.MaxItems == 0 {
+		return nil
+	}
+	itms, _, err := storage.Instance().FetchRosterItems(r.stm.Username())
+	if err != nil {
+		return err
+	}
+	if len(itms) >= r.cfg.MaxItems {
+		return errRosterFull
+	}
+	return nil
+}
+
+// ProcessRemotePresence processes a subscription presence sent by a remote entity
+// to a local user, updating user's roster the same way its roster module would do
+// before delivering it.
+// (https://xmpp.org/rfcs/rfc6121.html#sub)
+func ProcessRemotePresence(cfg *Config, presence *xml.Presence) error {
+	r := &ModRoster{cfg: cfg}
+
+	remoteJID := presence.FromJID().ToBareJID()
+	localJID := presence.ToJID().ToBareJID()
+
+	unlock := lockRosters(localJID)
+	defer unlock()
+
+	if c2s.Instance().IsBlockedJID(remoteJID, localJID.Node()) {
+		return nil
+	}
+	exists, err := storage.Instance().UserExists(localJID.Node())
+	if err != nil || !exists {
+		return err
+	}
+	switch presence.Type() {
+	case xml.SubscribeType:
+		return r.processRemoteSubscribe(remoteJID, localJID, presence)
+	case xml.SubscribedType:
+		return r.processRemoteSubscribed(localJID, remoteJID, presence)
+	case xml.UnsubscribeType:
+		return r.processRemoteUnsubscribe(remoteJID, localJID, presence)
+	case xml.UnsubscribedType:
+		return r.processRemoteUnsubscribed(localJID, remoteJID, presence)
+	}
+	return nil
+}
+
 func (r *ModRoster) processSubscribe(presence *xml.Presence) error {
 	usrJID := r.stm.JID().ToBareJID()
 	cntJID := presence.ToJID().ToBareJID()
 
-	log.Infof("processing 'subscribe' - contact: %s (%s/%s)", cntJID, r.stm.Username(), r.stm.Resource())
+	c2s.Logger(r.stm).Infof("processing 'subscribe' - contact: %s (%s/%s)", cntJID, r.stm.Username(), r.stm.Resource())
 
 	usrRi, err := storage.Instance().FetchRosterItem(usrJID.Node(), cntJID.String())
 	if err != nil {
@@ -415,7 +775,7 @@ func (r *ModRoster) processSubscribe(presence *xml.Presence) error {
 			Ask:          true,
 		}
 	}
-	if r.insertOrUpdateItem(usrRi, usrJID); err != nil {
+	if err := r.insertOrUpdateItem(usrRi, usrJID); err != nil {
 		return err
 	}
 	// stamp the presence stanza of type "subscribe" with the user's bare JID as the 'from' address
@@ -423,6 +783,16 @@ func (r *ModRoster) processSubscribe(presence *xml.Presence) error {
 	p.AppendElements(presence.Elements().All())
 
 	if c2s.Instance().IsLocalDomain(cntJID.Domain()) {
+		autoReply, err := r.subscriptionAutoReply(usrJID, cntJID)
+		if err != nil {
+			return err
+		}
+		switch autoReply {
+		case xml.SubscribedType:
+			return r.approveSubscription(cntJID, usrJID, nil)
+		case xml.UnsubscribedType:
+			return r.denySubscription(cntJID, usrJID, nil)
+		}
 		// archive roster approval notification
 		if err := r.insertOrUpdateNotification(cntJID.Node(), usrJID, p); err != nil {
 			return err
@@ -432,11 +802,42 @@ func (r *ModRoster) processSubscribe(presence *xml.Presence) error {
 	return nil
 }
 
+// subscriptionAutoReply returns the presence type to be replied on behalf
+// of a local contact to a user subscription request, or an empty string
+// if the request must be approved by the contact.
+func (r *ModRoster) subscriptionAutoReply(usrJID, cntJID *xml.JID) (string, error) {
+	exists, err := storage.Instance().UserExists(cntJID.Node())
+	if err != nil || !exists {
+		return "", err
+	}
+	cntRi, err := storage.Instance().FetchRosterItem(cntJID.Node(), usrJID.String())
+	if err != nil {
+		return "", err
+	}
+	if cntRi != nil && (cntRi.Subscription == SubscriptionFrom || cntRi.Subscription == SubscriptionBoth) {
+		return xml.SubscribedType, nil // already approved
+	}
+	switch r.domainConfig(cntJID.Domain()).SubscriptionPolicy {
+	case AcceptSubscriptions:
+		return xml.SubscribedType, nil
+	case AcceptSameDomainSubscriptions:
+		if usrJID.Domain() == cntJID.Domain() {
+			return xml.SubscribedType, nil
+		}
+	case RejectSubscriptions:
+		return xml.UnsubscribedType, nil
+	}
+	return "", nil
+}
+
 func (r *ModRoster) processSubscribed(presence *xml.Presence) error {
-	usrJID := presence.ToJID().ToBareJID()
-	cntJID := r.stm.JID().ToBareJID()
+	return r.approveSubscription(r.stm.JID().ToBareJID(), presence.ToJID().ToBareJID(), presence.Elements().All())
+}
 
-	log.Infof("processing 'subscribed' - user: %s (%s/%s)", usrJID, r.stm.Username(), r.stm.Resource())
+// approveSubscription grants user a subscription to contact's presence,
+// updating both rosters and notifying the user.
+func (r *ModRoster) approveSubscription(cntJID, usrJID *xml.JID, elements []xml.XElement) error {
+	r.logger().Infof("processing 'subscribed' - contact: %s, user: %s", cntJID, usrJID)
 
 	if err := r.deleteNotification(cntJID.Node(), usrJID); err != nil {
 		return err
@@ -461,12 +862,12 @@ func (r *ModRoster) processSubscribed(presence *xml.Presence) error {
 			Ask:          false,
 		}
 	}
-	if r.insertOrUpdateItem(cntRi, cntJID); err != nil {
+	if err := r.insertOrUpdateItem(cntRi, cntJID); err != nil {
 		return err
 	}
 	// stamp the presence stanza of type "subscribed" with the contact's bare JID as the 'from' address
 	p := xml.NewPresence(cntJID, usrJID, xml.SubscribedType)
-	p.AppendElements(presence.Elements().All())
+	p.AppendElements(elements)
 
 	if c2s.Instance().IsLocalDomain(usrJID.Domain()) {
 		usrRi, err := storage.Instance().FetchRosterItem(usrJID.Node(), cntJID.String())
@@ -483,7 +884,7 @@ func (r *ModRoster) processSubscribed(presence *xml.Presence) error {
 				return nil
 			}
 			usrRi.Ask = false
-			if r.insertOrUpdateItem(usrRi, usrJID); err != nil {
+			if err := r.insertOrUpdateItem(usrRi, usrJID); err != nil {
 				return err
 			}
 		}
@@ -497,7 +898,7 @@ func (r *ModRoster) processUnsubscribe(presence *xml.Presence) error {
 	usrJID := r.stm.JID().ToBareJID()
 	cntJID := presence.ToJID().ToBareJID()
 
-	log.Infof("processing 'unsubscribe' - contact: %s (%s/%s)", cntJID, r.stm.Username(), r.stm.Resource())
+	c2s.Logger(r.stm).Infof("processing 'unsubscribe' - contact: %s (%s/%s)", cntJID, r.stm.Username(), r.stm.Resource())
 
 	usrRi, err := storage.Instance().FetchRosterItem(usrJID.Node(), cntJID.String())
 	if err != nil {
@@ -509,10 +910,11 @@ func (r *ModRoster) processUnsubscribe(presence *xml.Presence) error {
 		switch usrSub {
 		case SubscriptionBoth:
 			usrRi.Subscription = SubscriptionFrom
-		default:
+		case SubscriptionTo:
 			usrRi.Subscription = SubscriptionNone
 		}
-		if r.insertOrUpdateItem(usrRi, usrJID); err != nil {
+		usrRi.Ask = false
+		if err := r.insertOrUpdateItem(usrRi, usrJID); err != nil {
 			return err
 		}
 	}
@@ -529,10 +931,10 @@ func (r *ModRoster) processUnsubscribe(presence *xml.Presence) error {
 			switch cntRi.Subscription {
 			case SubscriptionBoth:
 				cntRi.Subscription = SubscriptionTo
-			default:
+			case SubscriptionFrom:
 				cntRi.Subscription = SubscriptionNone
 			}
-			if r.insertOrUpdateItem(cntRi, cntJID); err != nil {
+			if err := r.insertOrUpdateItem(cntRi, cntJID); err != nil {
 				return err
 			}
 		}
@@ -546,10 +948,13 @@ func (r *ModRoster) processUnsubscribe(presence *xml.Presence) error {
 }
 
 func (r *ModRoster) processUnsubscribed(presence *xml.Presence) error {
-	usrJID := presence.ToJID().ToBareJID()
-	cntJID := r.stm.JID().ToBareJID()
+	return r.denySubscription(r.stm.JID().ToBareJID(), presence.ToJID().ToBareJID(), presence.Elements().All())
+}
 
-	log.Infof("processing 'unsubscribed' - user: %s (%s/%s)", usrJID, r.stm.Username(), r.stm.Resource())
+// denySubscription denies or cancels user subscription to contact's presence,
+// updating both rosters and notifying the user.
+func (r *ModRoster) denySubscription(cntJID, usrJID *xml.JID, elements []xml.XElement) error {
+	r.logger().Infof("processing 'unsubscribed' - contact: %s, user: %s", cntJID, usrJID)
 
 	if err := r.deleteNotification(cntJID.Node(), usrJID); err != nil {
 		return err
@@ -564,16 +969,16 @@ func (r *ModRoster) processUnsubscribed(presence *xml.Presence) error {
 		switch cntSub {
 		case SubscriptionBoth:
 			cntRi.Subscription = SubscriptionTo
-		default:
+		case SubscriptionFrom:
 			cntRi.Subscription = SubscriptionNone
 		}
-		if r.insertOrUpdateItem(cntRi, cntJID); err != nil {
+		if err := r.insertOrUpdateItem(cntRi, cntJID); err != nil {
 			return err
 		}
 	}
 	// stamp the presence stanza of type "unsubscribed" with the contact's bare JID as the 'from' address
 	p := xml.NewPresence(cntJID, usrJID, xml.UnsubscribedType)
-	p.AppendElements(presence.Elements().All())
+	p.AppendElements(elements)
 
 	if c2s.Instance().IsLocalDomain(usrJID.Domain()) {
 		usrRi, err := storage.Instance().FetchRosterItem(usrJID.Node(), cntJID.String())
@@ -584,11 +989,11 @@ func (r *ModRoster) processUnsubscribed(presence *xml.Presence) error {
 			switch usrRi.Subscription {
 			case SubscriptionBoth:
 				usrRi.Subscription = SubscriptionFrom
-			default:
+			case SubscriptionTo:
 				usrRi.Subscription = SubscriptionNone
 			}
 			usrRi.Ask = false
-			if r.insertOrUpdateItem(usrRi, usrJID); err != nil {
+			if err := r.insertOrUpdateItem(usrRi, usrJID); err != nil {
 				return err
 			}
 		}
@@ -601,6 +1006,110 @@ func (r *ModRoster) processUnsubscribed(presence *xml.Presence) error {
 	return nil
 }
 
+func (r *ModRoster) processRemoteSubscribe(usrJID, cntJID *xml.JID, presence *xml.Presence) error {
+	r.logger().Infof("processing remote 'subscribe' - contact: %s, user: %s", cntJID, usrJID)
+
+	autoReply, err := r.subscriptionAutoReply(usrJID, cntJID)
+	if err != nil {
+		return err
+	}
+	switch autoReply {
+	case xml.SubscribedType:
+		return r.approveSubscription(cntJID, usrJID, nil)
+	case xml.UnsubscribedType:
+		return r.denySubscription(cntJID, usrJID, nil)
+	}
+	p := xml.NewPresence(usrJID, cntJID, xml.SubscribeType)
+	p.AppendElements(presence.Elements().All())
+
+	// archive roster approval notification
+	if err := r.insertOrUpdateNotification(cntJID.Node(), usrJID, p); err != nil {
+		return err
+	}
+	c2s.Instance().Route(p)
+	return nil
+}
+
+func (r *ModRoster) processRemoteSubscribed(usrJID, cntJID *xml.JID, presence *xml.Presence) error {
+	r.logger().Infof("processing remote 'subscribed' - contact: %s, user: %s", cntJID, usrJID)
+
+	usrRi, err := storage.Instance().FetchRosterItem(usrJID.Node(), cntJID.String())
+	if err != nil {
+		return err
+	}
+	if usrRi == nil || !usrRi.Ask {
+		return nil // never requested... ignore it
+	}
+	switch usrRi.Subscription {
+	case SubscriptionFrom:
+		usrRi.Subscription = SubscriptionBoth
+	case SubscriptionNone:
+		usrRi.Subscription = SubscriptionTo
+	}
+	usrRi.Ask = false
+	if err := r.insertOrUpdateItem(usrRi, usrJID); err != nil {
+		return err
+	}
+	p := xml.NewPresence(cntJID, usrJID, xml.SubscribedType)
+	p.AppendElements(presence.Elements().All())
+	c2s.Instance().Route(p)
+	return nil
+}
+
+func (r *ModRoster) processRemoteUnsubscribe(usrJID, cntJID *xml.JID, presence *xml.Presence) error {
+	r.logger().Infof("processing remote 'unsubscribe' - contact: %s, user: %s", cntJID, usrJID)
+
+	// cancel any pending subscription request
+	if err := r.deleteNotification(cntJID.Node(), usrJID); err != nil {
+		return err
+	}
+	cntRi, err := storage.Instance().FetchRosterItem(cntJID.Node(), usrJID.String())
+	if err != nil {
+		return err
+	}
+	if cntRi != nil {
+		switch cntRi.Subscription {
+		case SubscriptionBoth:
+			cntRi.Subscription = SubscriptionTo
+		case SubscriptionFrom:
+			cntRi.Subscription = SubscriptionNone
+		}
+		if err := r.insertOrUpdateItem(cntRi, cntJID); err != nil {
+			return err
+		}
+	}
+	p := xml.NewPresence(usrJID, cntJID, xml.UnsubscribeType)
+	p.AppendElements(presence.Elements().All())
+	c2s.Instance().Route(p)
+	return nil
+}
+
+func (r *ModRoster) processRemoteUnsubscribed(usrJID, cntJID *xml.JID, presence *xml.Presence) error {
+	r.logger().Infof("processing remote 'unsubscribed' - contact: %s, user: %s", cntJID, usrJID)
+
+	usrRi, err := storage.Instance().FetchRosterItem(usrJID.Node(), cntJID.String())
+	if err != nil {
+		return err
+	}
+	if usrRi == nil {
+		return nil
+	}
+	switch usrRi.Subscription {
+	case SubscriptionBoth:
+		usrRi.Subscription = SubscriptionFrom
+	case SubscriptionTo:
+		usrRi.Subscription = SubscriptionNone
+	}
+	usrRi.Ask = false
+	if err := r.insertOrUpdateItem(usrRi, usrJID); err != nil {
+		return err
+	}
+	p := xml.NewPresence(cntJID, usrJID, xml.UnsubscribedType)
+	p.AppendElements(presence.Elements().All())
+	c2s.Instance().Route(p)
+	return nil
+}
+
 func (r *ModRoster) insertOrUpdateNotification(contact string, userJID *xml.JID, presence *xml.Presence) error {
 	rn := &model.RosterNotification{
 		Contact:  contact,
@@ -644,6 +1153,11 @@ func (r *ModRoster) pushItem(ri *model.RosterItem, to *xml.JID) error {
 		if !stm.Context().Bool(rosterRequestedContextKey) {
 			continue
 		}
+		if ri.Ver <= stm.Context().Int(rosterPushedVerContextKey) {
+			continue // already pushed
+		}
+		stm.Context().SetInt(ri.Ver, rosterPushedVerContextKey)
+
 		pushEl := xml.NewIQType(uuid.New(), xml.SetType)
 		pushEl.SetTo(stm.JID().String())
 		pushEl.AppendElement(query)
@@ -663,22 +1177,147 @@ func (r *ModRoster) routePresencesFrom(from *xml.JID, to *xml.JID, presenceType
 	}
 }
 
+// lockRosters serializes roster mutations of the given users, so that
+// roster versions are assigned and pushed in order.
+// Locks are always acquired in the same order to prevent deadlocks.
+func lockRosters(jids ...*xml.JID) (unlock func()) {
+	var keys []string
+	for _, j := range jids {
+		key := j.ToBareJID().String()
+		if !containsString(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	rosterLocksMu.Lock()
+	locks := make([]*rosterLock, len(keys))
+	for i, key := range keys {
+		l := rosterLocks[key]
+		if l == nil {
+			l = &rosterLock{}
+			rosterLocks[key] = l
+		}
+		l.refs++
+		locks[i] = l
+	}
+	rosterLocksMu.Unlock()
+
+	for _, l := range locks {
+		l.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+		rosterLocksMu.Lock()
+		for i, key := range keys {
+			locks[i].refs--
+			if locks[i].refs == 0 {
+				delete(rosterLocks, key)
+			}
+		}
+		rosterLocksMu.Unlock()
+	}
+}
+
+// sharedRosterItems returns the implicit roster items of the shared
+// groups the user is member of, as sourced by the authentication provider.
+func (r *ModRoster) sharedRosterItems() ([]model.RosterItem, error) {
+	gp, ok := auth.Instance().(auth.GroupsProvider)
+	if !ok {
+		return nil, nil
+	}
+	groups, err := gp.SharedGroups(r.stm.Username())
+	if err != nil {
+		return nil, err
+	}
+	var itms []model.RosterItem
+	for _, group := range groups {
+		for _, member := range group.Members {
+			if member == r.stm.Username() {
+				continue
+			}
+			j, err := xml.NewJID(member, r.stm.Domain(), "", false)
+			if err != nil {
+				continue
+			}
+			idx := -1
+			for i := range itms {
+				if itms[i].JID == j.String() {
+					idx = i
+					break
+				}
+			}
+			if idx == -1 {
+				itms = append(itms, model.RosterItem{
+					Username:     r.stm.Username(),
+					JID:          j.String(),
+					Subscription: SubscriptionBoth,
+				})
+				idx = len(itms) - 1
+			}
+			itms[idx].Groups = append(itms[idx].Groups, group.Name)
+		}
+	}
+	return itms, nil
+}
+
+func containsRosterItem(itms []model.RosterItem, jid string) bool {
+	for _, itm := range itms {
+		if itm.JID == jid {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ModRoster) domainConfig(domain string) *Config {
+	if r.domainCfg != nil {
+		if cfg := r.domainCfg(domain); cfg != nil {
+			return cfg
+		}
+	}
+	return r.cfg
+}
+
+// logger returns associated stream logger, or server logger
+// when processing presences sent by a remote server.
+func (r *ModRoster) logger() *log.Entry {
+	if r.stm == nil {
+		return log.WithFields(log.Fields{})
+	}
+	return c2s.Logger(r.stm)
+}
+
 func (r *ModRoster) rosterItemJID(ri *model.RosterItem) *xml.JID {
 	j, _ := xml.NewJIDString(ri.JID, true)
 	return j
 }
 
+// rosterItemFromElement parses a roster set item, returning the
+// stanza error to be reported in case it's not valid.
+// (https://xmpp.org/rfcs/rfc6121.html#roster-syntax-actions-set)
 func (r *ModRoster) rosterItemFromElement(item xml.XElement) (*model.RosterItem, error) {
 	ri := &model.RosterItem{}
-	if jid := item.Attributes().Get("jid"); len(jid) > 0 {
-		j, err := xml.NewJIDString(jid, false)
-		if err != nil {
-			return nil, err
-		}
-		ri.JID = j.String()
-	} else {
-		return nil, errors.New("item 'jid' attribute is required")
+	jid := item.Attributes().Get("jid")
+	if len(jid) == 0 {
+		return nil, xml.ErrBadRequest
+	}
+	j, err := xml.NewJIDString(jid, false)
+	if err != nil || j.IsFull() {
+		return nil, xml.ErrJidMalformed
 	}
+	ri.JID = j.String()
 	ri.Name = item.Attributes().Get("name")
 
 	subscription := item.Attributes().Get("subscription")
@@ -687,23 +1326,31 @@ func (r *ModRoster) rosterItemFromElement(item xml.XElement) (*model.RosterItem,
 		case SubscriptionBoth, SubscriptionFrom, SubscriptionTo, SubscriptionNone, SubscriptionRemove:
 			break
 		default:
-			return nil, fmt.Errorf("unrecognized 'subscription' enum type: %s", subscription)
+			return nil, xml.ErrBadRequest
 		}
 		ri.Subscription = subscription
 	}
 	ask := item.Attributes().Get("ask")
 	if len(ask) > 0 {
 		if ask != "subscribe" {
-			return nil, fmt.Errorf("unrecognized 'ask' enum type: %s", subscription)
+			return nil, xml.ErrBadRequest
 		}
 		ri.Ask = true
 	}
 	groups := item.Elements().Children("group")
 	for _, group := range groups {
 		if group.Attributes().Count() > 0 {
-			return nil, errors.New("group element must not contain any attribute")
+			return nil, xml.ErrBadRequest
+		}
+		name := group.Text()
+		if containsString(ri.Groups, name) {
+			return nil, xml.ErrBadRequest // duplicated group
+		}
+		// groups are stored as a semicolon separated list
+		if len(name) == 0 || len(name) > maxGroupNameLength || strings.Contains(name, ";") {
+			return nil, xml.ErrNotAcceptable
 		}
-		ri.Groups = append(ri.Groups, group.Text())
+		ri.Groups = append(ri.Groups, name)
 	}
 	return ri, nil
 }
@@ -6,7 +6,12 @@
 package roster
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
@@ -14,6 +19,7 @@ import (
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 )
 
 func TestRoster_MatchesIQ(t *testing.T) {
@@ -115,10 +121,27 @@ func TestRoster_FetchRoster(t *testing.T) {
 	elem = stm.FetchElement()
 	require.Equal(t, "iq", elem.Name())
 	require.Equal(t, xml.SetType, elem.Type())
+	require.Equal(t, stm.JID().String(), elem.To())
 	query2 = elem.Elements().ChildNamespace("query", rosterNamespace)
 	require.Equal(t, "v2", query2.Attributes().Get("ver"))
 	item := query2.Elements().Child("item")
 	require.Equal(t, "romeo@jackal.im", item.Attributes().Get("jid"))
+
+	// up to date roster
+	q.SetAttribute("ver", "v2")
+	r.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Nil(t, elem.Elements().ChildNamespace("query", rosterNamespace))
+
+	// unknown version
+	q.SetAttribute("ver", "v5")
+	r.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	query2 = elem.Elements().ChildNamespace("query", rosterNamespace)
+	require.Equal(t, "v2", query2.Attributes().Get("ver"))
+	require.Equal(t, 2, query2.Elements().Count())
 	r.Done()
 
 	storage.ActivateMockedError()
@@ -232,6 +255,162 @@ func TestRoster_ReceiveAndBroadcastPresence(t *testing.T) {
 	require.Equal(t, "presence", elem.Name())
 	require.Equal(t, "available", elem.Type())
 	require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
+
+	// filtered out presence
+	r.SetPresenceFilter(func(p *xml.Presence) bool { return p.ToJID().Node() != "noelia" })
+	r.BroadcastPresenceAndWait(presence)
+	require.Equal(t, &xml.Element{}, stm2.FetchElementTimeout(time.Millisecond*200))
+}
+
+func TestRoster_PresenceCoalescing(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1, stm2 := tUtilRosterInitializeRoster()
+	tUtilRosterInsertRosterItems()
+
+	r := New(&Config{PresenceCoalescing: time.Millisecond * 100}, stm1)
+	defer r.Done()
+
+	// rapid changes are broadcasted once, carrying the latest state
+	for _, show := range []string{"away", "dnd", "chat"} {
+		r.BroadcastPresence(tUtilRosterPresence(stm1.JID(), "show", show))
+	}
+	elem := stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, "chat", elem.Elements().Child("show").Text())
+
+	// unavailable presence supersedes pending ones right away
+	r.BroadcastPresence(xml.NewPresence(stm1.JID(), stm1.JID().ToBareJID(), xml.AvailableType))
+	r.BroadcastPresence(xml.NewPresence(stm1.JID(), stm1.JID().ToBareJID(), xml.UnavailableType))
+	elem = stm2.FetchElement()
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, &xml.Element{}, stm2.FetchElementTimeout(time.Millisecond*200))
+}
+
+func TestRoster_PresenceBroadcastRate(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1, stm2 := tUtilRosterInitializeRoster()
+	tUtilRosterInsertRosterItems()
+
+	j3, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	stm3 := c2s.NewMockStream("abcd9012", j3)
+	c2s.Instance().RegisterStream(stm3)
+	c2s.Instance().AuthenticateStream(stm3)
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "romeo@jackal.im",
+		Subscription: SubscriptionFrom,
+	})
+
+	r := New(&Config{PresenceBroadcastRate: 1}, stm1)
+	defer r.Done()
+
+	// fan-out is paced...
+	r.BroadcastPresence(tUtilRosterPresence(stm1.JID(), "status", "1"))
+	require.Equal(t, "1", stm2.FetchElement().Elements().Child("status").Text())
+
+	// ...without holding the stream back...
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", rosterNamespace))
+	r.ProcessIQ(iq)
+	require.Equal(t, iq.ID(), stm1.FetchElementTimeout(time.Millisecond*500).ID())
+
+	// ...and stale broadcasts are given up in favor of newer ones
+	r.BroadcastPresence(tUtilRosterPresence(stm1.JID(), "status", "2"))
+
+	require.Equal(t, "2", stm2.FetchElement().Elements().Child("status").Text())
+	require.Equal(t, "2", stm3.FetchElement().Elements().Child("status").Text())
+}
+
+func TestRoster_SharedGroups(t *testing.T) {
+	storage.Initialize(&storage.Config{
+		Type:         storage.Mock,
+		SharedGroups: []storage.SharedGroup{{Name: "Staff", Domain: "jackal.im", Members: []string{"ortuman", "noelia"}}},
+	})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1, stm2 := tUtilRosterInitializeRoster()
+
+	r := New(&Config{}, stm1)
+	defer r.Done()
+
+	// shared group members are listed...
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", rosterNamespace))
+	r.ProcessIQ(iq)
+
+	elem := stm1.FetchElement()
+	items := elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Children("item")
+	require.Equal(t, 1, len(items))
+	require.Equal(t, "noelia@jackal.im", items[0].Attributes().Get("jid"))
+	require.Equal(t, SubscriptionBoth, items[0].Attributes().Get("subscription"))
+	require.Equal(t, "Staff", items[0].Elements().Child("group").Text())
+
+	// ...and subscribed to each other presence
+	presence := xml.NewPresence(stm1.JID(), stm1.JID().ToBareJID(), xml.AvailableType)
+	r.BroadcastPresenceAndWait(presence)
+	elem = stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
+}
+
+func TestRoster_DirectedPresence(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1, stm2 := tUtilRosterInitializeRoster()
+
+	// remote contacts presence is probed once
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "juliet@example.org",
+		Subscription: SubscriptionTo,
+	})
+	r := New(&Config{}, stm1)
+	defer r.Done()
+
+	r.ReceivePresences()
+	r.BroadcastPresenceAndWait(xml.NewPresence(stm1.JID(), stm1.JID(), xml.AvailableType))
+	require.Equal(t, 1, len(r.probed))
+	_, ok := r.probed["juliet@example.org"]
+	require.True(t, ok)
+
+	// directed presence to a non subscribed entity
+	r.ProcessPresence(xml.NewPresence(stm1.JID(), stm2.JID(), xml.AvailableType))
+	elem := stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+
+	// directed presence recipients are notified when going unavailable
+	r.BroadcastPresenceAndWait(xml.NewPresence(stm1.JID(), stm1.JID(), xml.UnavailableType))
+	elem = stm2.FetchElement()
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
+	require.Equal(t, 0, len(r.directed))
+
+	// ...even if they never broadcasted their availability
+	r.ProcessPresence(xml.NewPresence(stm1.JID(), stm2.JID(), xml.AvailableType))
+	_ = stm2.FetchElement()
+
+	r.LeaveDirectedPresencesAndWait()
+	elem = stm2.FetchElement()
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, 0, len(r.directed))
 }
 
 func TestRoster_Update(t *testing.T) {
@@ -283,6 +462,112 @@ func TestRoster_Update(t *testing.T) {
 	require.Equal(t, "noelia@jackal.im", ri.JID)
 }
 
+func TestRoster_UpdateValidation(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm1 := c2s.NewMockStream("abcd1234", j1)
+	stm1.SetUsername("ortuman")
+	stm1.SetDomain("jackal.im")
+	stm1.SetResource("balcony")
+	stm1.SetAuthenticated(true)
+
+	r := New(&Config{}, stm1)
+	defer r.Done()
+
+	updateItem := func(jid string, groups ...string) xml.XElement {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		q := xml.NewElementNamespace("query", rosterNamespace)
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", jid)
+		for _, group := range groups {
+			g := xml.NewElementName("group")
+			g.SetText(group)
+			item.AppendElement(g)
+		}
+		q.AppendElement(item)
+		iq.AppendElement(q)
+
+		r.ProcessIQ(iq)
+		return stm1.FetchElement()
+	}
+	requireError := func(err error, elem xml.XElement) {
+		require.Equal(t, xml.ErrorType, elem.Type())
+		require.Equal(t, err.Error(), elem.Error().Elements().All()[0].Name())
+	}
+
+	// malformed JIDs
+	requireError(xml.ErrJidMalformed, updateItem("noelia@"))
+	requireError(xml.ErrJidMalformed, updateItem("noelia capulet@jackal.im"))
+	requireError(xml.ErrJidMalformed, updateItem("noelia@jackal.im/garden"))
+
+	// invalid group names
+	requireError(xml.ErrNotAcceptable, updateItem("noelia@jackal.im", ""))
+	requireError(xml.ErrNotAcceptable, updateItem("noelia@jackal.im", "Friends;Family"))
+	requireError(xml.ErrNotAcceptable, updateItem("noelia@jackal.im", strings.Repeat("a", maxGroupNameLength+1)))
+	requireError(xml.ErrBadRequest, updateItem("noelia@jackal.im", "Friends", "Friends"))
+
+	itms, _, _ := storage.Instance().FetchRosterItems("ortuman")
+	require.Equal(t, 0, len(itms))
+
+	elem := updateItem("noelia@jackal.im", "Friends", "Family")
+	require.Equal(t, xml.ResultType, elem.Type())
+}
+
+func TestRoster_MaxItems(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm1 := c2s.NewMockStream("abcd1234", j1)
+	stm1.SetUsername("ortuman")
+	stm1.SetDomain("jackal.im")
+	stm1.SetResource("balcony")
+	stm1.SetAuthenticated(true)
+
+	r := New(&Config{MaxItems: 1}, stm1)
+	defer r.Done()
+
+	updateItem := func(jid, name string) xml.XElement {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		q := xml.NewElementNamespace("query", rosterNamespace)
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", jid)
+		item.SetAttribute("name", name)
+		q.AppendElement(item)
+		iq.AppendElement(q)
+
+		r.ProcessIQ(iq)
+		return stm1.FetchElement()
+	}
+	elem := updateItem("noelia@jackal.im", "My Juliet")
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	// roster is full...
+	elem = updateItem("romeo@jackal.im", "Romeo")
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements().All()[0].Name())
+
+	ri, _ := storage.Instance().FetchRosterItem("ortuman", "romeo@jackal.im")
+	require.Nil(t, ri)
+
+	// ...but existing items can still be updated
+	elem = updateItem("noelia@jackal.im", "Juliet")
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	ri, _ = storage.Instance().FetchRosterItem("ortuman", "noelia@jackal.im")
+	require.Equal(t, "Juliet", ri.Name)
+}
+
 func TestRoster_Subscribe(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
@@ -371,6 +656,165 @@ func TestRoster_Subscribed(t *testing.T) {
 	require.Equal(t, SubscriptionTo, ri.Subscription)
 }
 
+func TestRoster_Config(t *testing.T) {
+	cfg := Config{}
+	err := yaml.Unmarshal([]byte("versioning: true\n"), &cfg)
+	require.Nil(t, err)
+	require.True(t, cfg.Versioning)
+	require.Equal(t, ManualSubscriptions, cfg.SubscriptionPolicy)
+
+	err = yaml.Unmarshal([]byte("subscription_policy: accept_same_domain\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, AcceptSameDomainSubscriptions, cfg.SubscriptionPolicy)
+
+	err = yaml.Unmarshal([]byte("subscription_policy: ignore\n"), &cfg)
+	require.NotNil(t, err)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("presence_coalescing: 250\npresence_broadcast_rate: 500\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, time.Millisecond*250, cfg.PresenceCoalescing)
+	require.Equal(t, 500, cfg.PresenceBroadcastRate)
+
+	err = yaml.Unmarshal([]byte("presence_broadcast_rate: -1\n"), &cfg)
+	require.NotNil(t, err)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("max_items: 500\n"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, 500, cfg.MaxItems)
+
+	err = yaml.Unmarshal([]byte("max_items: -1\n"), &cfg)
+	require.NotNil(t, err)
+}
+
+func TestRoster_SubscriptionStateMachine(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	tUtilRosterInsertUsers()
+	stm1, stm2 := tUtilRosterInitializeRoster()
+
+	// no roster pushes are expected
+	stm1.Context().SetBool(false, rosterRequestedContextKey)
+	stm2.Context().SetBool(false, rosterRequestedContextKey)
+
+	r1 := New(&Config{}, stm1)
+	r2 := New(&Config{}, stm2)
+	defer r1.Done()
+	defer r2.Done()
+
+	usrJID := stm1.JID().ToBareJID()
+	cntJID := stm2.JID().ToBareJID()
+
+	var transitions = []struct {
+		r              *ModRoster
+		presence       *xml.Presence
+		usrSub, cntSub string
+		usrAsk         bool
+	}{
+		{r1, xml.NewPresence(stm1.JID(), cntJID, xml.SubscribeType), SubscriptionNone, "", true},
+		{r2, xml.NewPresence(stm2.JID(), usrJID, xml.SubscribedType), SubscriptionTo, SubscriptionFrom, false},
+		{r2, xml.NewPresence(stm2.JID(), usrJID, xml.SubscribeType), SubscriptionTo, SubscriptionFrom, false},
+		{r1, xml.NewPresence(stm1.JID(), cntJID, xml.SubscribedType), SubscriptionBoth, SubscriptionBoth, false},
+		{r1, xml.NewPresence(stm1.JID(), cntJID, xml.UnsubscribeType), SubscriptionFrom, SubscriptionTo, false},
+		{r1, xml.NewPresence(stm1.JID(), cntJID, xml.UnsubscribedType), SubscriptionNone, SubscriptionNone, false},
+	}
+	for _, tr := range transitions {
+		tUtilRosterProcessPresence(tr.r, tr.presence)
+
+		usrRi, err := storage.Instance().FetchRosterItem("ortuman", "noelia@jackal.im")
+		require.Nil(t, err)
+		require.NotNil(t, usrRi)
+		require.Equal(t, tr.usrSub, usrRi.Subscription)
+		require.Equal(t, tr.usrAsk, usrRi.Ask)
+
+		cntRi, err := storage.Instance().FetchRosterItem("noelia", "ortuman@jackal.im")
+		require.Nil(t, err)
+		if len(tr.cntSub) > 0 {
+			require.NotNil(t, cntRi)
+			require.Equal(t, tr.cntSub, cntRi.Subscription)
+		} else {
+			require.Nil(t, cntRi)
+		}
+	}
+}
+
+func TestRoster_SubscriptionPolicy(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	tUtilRosterInsertUsers()
+	stm1, stm2 := tUtilRosterInitializeRoster()
+
+	r := New(&Config{SubscriptionPolicy: AcceptSameDomainSubscriptions}, stm1)
+	defer r.Done()
+
+	// auto-accepted subscription request
+	r.ProcessPresence(xml.NewPresence(stm1.JID(), stm2.JID().ToBareJID(), xml.SubscribeType))
+
+	elem := stm1.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	item := elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Child("item")
+	require.Equal(t, SubscriptionNone, item.Attributes().Get("subscription"))
+	require.Equal(t, "subscribe", item.Attributes().Get("ask"))
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	item = elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Child("item")
+	require.Equal(t, SubscriptionFrom, item.Attributes().Get("subscription"))
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	item = elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Child("item")
+	require.Equal(t, SubscriptionTo, item.Attributes().Get("subscription"))
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.SubscribedType, elem.Type())
+	require.Equal(t, "noelia@jackal.im", elem.From())
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "noelia@jackal.im/garden", elem.From())
+
+	// contact domain configuration rejects requests
+	r2 := New(&Config{}, stm2)
+	defer r2.Done()
+	r2.SetDomainConfig(func(domain string) *Config {
+		return &Config{SubscriptionPolicy: RejectSubscriptions}
+	})
+	r2.ProcessPresence(xml.NewPresence(stm2.JID(), stm1.JID().ToBareJID(), xml.SubscribeType))
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	item = elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Child("item")
+	require.Equal(t, "subscribe", item.Attributes().Get("ask"))
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	item = elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Child("item")
+	require.Equal(t, SubscriptionFrom, item.Attributes().Get("subscription"))
+	require.Equal(t, "", item.Attributes().Get("ask"))
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnsubscribedType, elem.Type())
+	require.Equal(t, "ortuman@jackal.im", elem.From())
+
+	ri, err := storage.Instance().FetchRosterItem("noelia", "ortuman@jackal.im")
+	require.Nil(t, err)
+	require.Equal(t, SubscriptionFrom, ri.Subscription)
+	require.False(t, ri.Ask)
+}
+
 func TestRoster_Unsubscribe(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
@@ -459,6 +903,89 @@ func TestRoster_Unsubscribed(t *testing.T) {
 	require.NotNil(t, elem.Elements().ChildNamespace("query", rosterNamespace))
 }
 
+func TestRoster_RemoteSubscription(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	tUtilRosterInsertUsers()
+	stm1, _ := tUtilRosterInitializeRoster()
+
+	remoteJID, _ := xml.NewJID("romeo", "remote.im", "garden", true)
+	userJID := stm1.JID().ToBareJID()
+
+	// subscription request pending for approval
+	err := ProcessRemotePresence(&Config{}, xml.NewPresence(remoteJID, userJID, xml.SubscribeType))
+	require.Nil(t, err)
+
+	elem := stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.SubscribeType, elem.Type())
+	require.Equal(t, "romeo@remote.im", elem.From())
+
+	rns, _ := storage.Instance().FetchRosterNotifications("ortuman")
+	require.Equal(t, 1, len(rns))
+
+	// cancelled subscription request
+	err = ProcessRemotePresence(&Config{}, xml.NewPresence(remoteJID, userJID, xml.UnsubscribeType))
+	require.Nil(t, err)
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnsubscribeType, elem.Type())
+
+	rns, _ = storage.Instance().FetchRosterNotifications("ortuman")
+	require.Equal(t, 0, len(rns))
+
+	// auto-accepted subscription request
+	err = ProcessRemotePresence(&Config{SubscriptionPolicy: AcceptSubscriptions}, xml.NewPresence(remoteJID, userJID, xml.SubscribeType))
+	require.Nil(t, err)
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	item := elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Child("item")
+	require.Equal(t, SubscriptionFrom, item.Attributes().Get("subscription"))
+
+	// unsolicited subscription approval
+	err = ProcessRemotePresence(&Config{}, xml.NewPresence(remoteJID, userJID, xml.SubscribedType))
+	require.Nil(t, err)
+
+	ri, _ := storage.Instance().FetchRosterItem("ortuman", "romeo@remote.im")
+	require.Equal(t, SubscriptionFrom, ri.Subscription)
+
+	// requested subscription approval
+	ri.Ask = true
+	storage.Instance().InsertOrUpdateRosterItem(ri)
+
+	err = ProcessRemotePresence(&Config{}, xml.NewPresence(remoteJID, userJID, xml.SubscribedType))
+	require.Nil(t, err)
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	item = elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Child("item")
+	require.Equal(t, SubscriptionBoth, item.Attributes().Get("subscription"))
+	require.Equal(t, "", item.Attributes().Get("ask"))
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.SubscribedType, elem.Type())
+
+	// cancelled subscription
+	err = ProcessRemotePresence(&Config{}, xml.NewPresence(remoteJID, userJID, xml.UnsubscribedType))
+	require.Nil(t, err)
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	item = elem.Elements().ChildNamespace("query", rosterNamespace).Elements().Child("item")
+	require.Equal(t, SubscriptionFrom, item.Attributes().Get("subscription"))
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnsubscribedType, elem.Type())
+}
+
 func TestRoster_DeleteItem(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
@@ -528,6 +1055,130 @@ func TestRoster_DeleteItem(t *testing.T) {
 	require.Equal(t, "ortuman@jackal.im", elem.From())
 }
 
+func TestRoster_ConcurrentUpdates(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+
+	stm1 := c2s.NewMockStream("abcd1234", j1)
+	stm2 := c2s.NewMockStream("abcd5678", j2)
+	stms := []*c2s.MockStream{stm1, stm2}
+
+	var rs []*ModRoster
+	for _, stm := range stms {
+		stm.SetAuthenticated(true)
+		stm.Context().SetBool(true, rosterRequestedContextKey)
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+
+		r := New(&Config{Versioning: true}, stm)
+		defer r.Done()
+		rs = append(rs, r)
+	}
+
+	// each resource concurrently updates the same contacts
+	const updateCount = 5
+	var wg sync.WaitGroup
+	for i, r := range rs {
+		wg.Add(1)
+		go func(i int, r *ModRoster) {
+			defer wg.Done()
+			for j := 0; j < updateCount; j++ {
+				item := xml.NewElementName("item")
+				item.SetAttribute("jid", fmt.Sprintf("contact%d@jackal.im", j%2))
+				item.SetAttribute("name", fmt.Sprintf("name%d-%d", i, j))
+				q := xml.NewElementNamespace("query", rosterNamespace)
+				q.AppendElement(item)
+				iq := xml.NewIQType(uuid.New(), xml.SetType)
+				iq.AppendElement(q)
+				r.ProcessIQ(iq)
+			}
+		}(i, r)
+	}
+	wg.Wait()
+
+	var states []map[string]string
+	for _, stm := range stms {
+		state := make(map[string]string)
+		lastVer := 0
+		pushCount := 0
+		for i := 0; i < updateCount*len(rs)+updateCount; i++ {
+			elem := stm.FetchElement()
+			require.Equal(t, "iq", elem.Name())
+			if elem.Type() != xml.SetType {
+				continue
+			}
+			pushCount++
+			q := elem.Elements().ChildNamespace("query", rosterNamespace)
+			ver := rs[0].parseVer(q.Attributes().Get("ver"))
+			require.True(t, ver > lastVer)
+			lastVer = ver
+
+			item := q.Elements().Child("item")
+			state[item.Attributes().Get("jid")] = item.Attributes().Get("name")
+		}
+		require.Equal(t, updateCount*len(rs), pushCount)
+		require.Equal(t, &xml.Element{}, stm.FetchElementTimeout(time.Millisecond*200))
+		states = append(states, state)
+	}
+	require.Equal(t, states[0], states[1])
+
+	ris, _, _ := storage.Instance().FetchRosterItems("ortuman")
+	require.Equal(t, 2, len(ris))
+	for _, ri := range ris {
+		require.Equal(t, ri.Name, states[0][ri.JID])
+	}
+}
+
+// presence changes broadcasted per benchmark iteration
+const benchmarkPresenceChanges = 10
+
+func BenchmarkRoster_BroadcastPresence(b *testing.B) {
+	benchmarkBroadcastPresence(b, &Config{})
+}
+
+func BenchmarkRoster_BroadcastPresenceCoalesced(b *testing.B) {
+	benchmarkBroadcastPresence(b, &Config{PresenceCoalescing: time.Hour})
+}
+
+func benchmarkBroadcastPresence(b *testing.B, cfg *Config) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm, _ := tUtilRosterInitializeRoster()
+	for i := 0; i < 5000; i++ {
+		storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+			Username:     "ortuman",
+			JID:          fmt.Sprintf("contact%d@jackal.im", i),
+			Subscription: SubscriptionBoth,
+		})
+	}
+	r := New(cfg, stm)
+	defer r.Done()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkPresenceChanges; j++ {
+			r.BroadcastPresence(tUtilRosterPresence(stm.JID(), "status", strconv.Itoa(j)))
+		}
+		// flush coalesced presence without waiting for window expiration
+		continueCh := make(chan struct{})
+		r.actorCh <- func() {
+			r.flushPendingBroadcast()
+			close(continueCh)
+		}
+		<-continueCh
+	}
+}
+
 func tUtilRosterInsertRosterItems() {
 	// insert roster item...
 	ri1 := &model.RosterItem{
@@ -546,6 +1197,30 @@ func tUtilRosterInsertRosterItems() {
 	storage.Instance().InsertOrUpdateRosterItem(ri2)
 }
 
+func tUtilRosterInsertUsers() {
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: ""})
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "noelia", Password: ""})
+}
+
+func tUtilRosterProcessPresence(r *ModRoster, presence *xml.Presence) {
+	continueCh := make(chan struct{})
+	r.actorCh <- func() {
+		if err := r.processPresence(presence); err != nil {
+			r.errHandler(err)
+		}
+		close(continueCh)
+	}
+	<-continueCh
+}
+
+func tUtilRosterPresence(from *xml.JID, child, text string) *xml.Presence {
+	elem := xml.NewElementName(child)
+	elem.SetText(text)
+	presence := xml.NewPresence(from, from.ToBareJID(), xml.AvailableType)
+	presence.AppendElement(elem)
+	return presence
+}
+
 func tUtilRosterRequestRoster(r *ModRoster, stm *c2s.MockStream) {
 	iq := xml.NewIQType(uuid.New(), xml.GetType)
 	iq.AppendElement(xml.NewElementNamespace("query", rosterNamespace))
@@ -9,7 +9,6 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/module/roster"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -18,18 +17,19 @@ import (
 
 const lastActivityNamespace = "jabber:iq:last"
 
+const lastActivityContextKey = "last_activity:time"
+
+// server uptime is measured since process start
+var startTime = time.Now()
+
 // XEPLastActivity represents a last activity stream module.
 type XEPLastActivity struct {
-	stm       c2s.Stream
-	startTime time.Time
+	stm c2s.Stream
 }
 
 // New returns a last activity IQ handler module.
 func New(stm c2s.Stream) *XEPLastActivity {
-	return &XEPLastActivity{
-		stm:       stm,
-		startTime: time.Now(),
-	}
+	return &XEPLastActivity{stm: stm}
 }
 
 // AssociatedNamespaces returns namespaces associated
@@ -44,16 +44,24 @@ func (x *XEPLastActivity) MatchesIQ(iq *xml.IQ) bool {
 	return iq.IsGet() && iq.Elements().ChildNamespace("query", lastActivityNamespace) != nil
 }
 
+// UpdateLastActivity records stream's user activity
+// in order to report its idle time.
+func (x *XEPLastActivity) UpdateLastActivity() {
+	x.stm.Context().SetObject(time.Now(), lastActivityContextKey)
+}
+
 // ProcessIQ processes a last activity IQ taking according actions
 // over the associated stream.
 func (x *XEPLastActivity) ProcessIQ(iq *xml.IQ) {
 	toJID := iq.ToJID()
 	if toJID.IsServer() {
 		x.sendServerUptime(iq)
+	} else if toJID.IsBare() && toJID.Node() == x.stm.Username() && toJID.Domain() == x.stm.Domain() {
+		x.sendUserLastActivity(iq, toJID)
 	} else if toJID.IsBare() {
 		ri, err := storage.Instance().FetchRosterItem(x.stm.Username(), toJID.ToBareJID().String())
 		if err != nil {
-			log.Error(err)
+			c2s.Logger(x.stm).Error(err)
 			x.stm.SendElement(iq.InternalServerError())
 			return
 		}
@@ -71,18 +79,18 @@ func (x *XEPLastActivity) ProcessIQ(iq *xml.IQ) {
 }
 
 func (x *XEPLastActivity) sendServerUptime(iq *xml.IQ) {
-	secs := int(time.Duration(time.Now().UnixNano()-x.startTime.UnixNano()) / time.Second)
+	secs := int(time.Since(startTime) / time.Second)
 	x.sendReply(iq, secs, "")
 }
 
 func (x *XEPLastActivity) sendUserLastActivity(iq *xml.IQ, to *xml.JID) {
-	if len(c2s.Instance().StreamsMatchingJID(to.ToBareJID())) > 0 { // user online
-		x.sendReply(iq, 0, "")
+	if stms := c2s.Instance().StreamsMatchingJID(to.ToBareJID()); len(stms) > 0 { // user online
+		x.sendReply(iq, x.idleSeconds(stms), "")
 		return
 	}
 	usr, err := storage.Instance().FetchUser(to.Node())
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
@@ -94,6 +102,20 @@ func (x *XEPLastActivity) sendUserLastActivity(iq *xml.IQ, to *xml.JID) {
 	x.sendReply(iq, secs, usr.LoggedOutStatus)
 }
 
+func (x *XEPLastActivity) idleSeconds(stms []c2s.Stream) int {
+	// least idle resource determines user's idle time
+	var lastActivity time.Time
+	for _, stm := range stms {
+		if t, ok := stm.Context().Object(lastActivityContextKey).(time.Time); ok && t.After(lastActivity) {
+			lastActivity = t
+		}
+	}
+	if lastActivity.IsZero() {
+		return 0
+	}
+	return int(time.Since(lastActivity) / time.Second)
+}
+
 func (x *XEPLastActivity) sendReply(iq *xml.IQ, secs int, status string) {
 	q := xml.NewElementNamespace("query", lastActivityNamespace)
 	q.SetText(status)
@@ -122,3 +122,39 @@ func TestXEP0012_GetOnlineUserLastActivity(t *testing.T) {
 	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements().All()[0].Name())
 	storage.DeactivateMockedError()
 }
+
+func TestXEP0012_GetIdleUserLastActivity(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+	stm1 := c2s.NewMockStream("abcd", j1)
+	stm2 := c2s.NewMockStream("abcde", j2)
+	for _, stm := range []*c2s.MockStream{stm1, stm2} {
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+	}
+	stm1.Context().SetObject(time.Now().Add(-time.Hour), lastActivityContextKey)
+	stm2.Context().SetObject(time.Now().Add(-time.Minute), lastActivityContextKey)
+
+	// own account last activity doesn't require a roster item
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j1.ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("query", lastActivityNamespace))
+
+	New(stm1).ProcessIQ(iq)
+	elem := stm1.FetchElement()
+	q := elem.Elements().ChildNamespace("query", lastActivityNamespace)
+	require.Equal(t, "60", q.Attributes().Get("seconds"))
+
+	New(stm2).UpdateLastActivity()
+	New(stm1).ProcessIQ(iq)
+	elem = stm1.FetchElement()
+	q = elem.Elements().ChildNamespace("query", lastActivityNamespace)
+	require.Equal(t, "0", q.Attributes().Get("seconds"))
+}
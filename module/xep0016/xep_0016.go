@@ -0,0 +1,631 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0016
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/ortuman/jackal/module/roster"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const privacyNamespace = "jabber:iq:privacy"
+
+const (
+	activeListContextKey  = "privacy:active_list"
+	defaultListContextKey = "privacy:default_list"
+	defaultListOnce       = "privacy:default_list_once"
+)
+
+const (
+	itemTypeJID          = "jid"
+	itemTypeGroup        = "group"
+	itemTypeSubscription = "subscription"
+)
+
+const (
+	actionAllow = "allow"
+	actionDeny  = "deny"
+)
+
+var (
+	errInvalidItem  = errors.New("xep0016: invalid privacy list item")
+	errUnknownGroup = errors.New("xep0016: unknown roster group")
+)
+
+type stanzaKind int
+
+const (
+	otherKind stanzaKind = iota
+	messageKind
+	iqKind
+	presenceInKind
+	presenceOutKind
+)
+
+// XEPPrivacy represents a privacy lists server stream module.
+// Lists in force are kept in stream context, so that its blocking
+// methods can be safely invoked from any goroutine.
+type XEPPrivacy struct {
+	stm c2s.Stream
+}
+
+// New returns a privacy lists IQ handler module.
+func New(stm c2s.Stream) *XEPPrivacy {
+	return &XEPPrivacy{stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with privacy lists module.
+func (x *XEPPrivacy) AssociatedNamespaces() []string {
+	return []string{privacyNamespace}
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the privacy lists module.
+func (x *XEPPrivacy) MatchesIQ(iq *xml.IQ) bool {
+	return (iq.IsGet() || iq.IsSet()) && iq.Elements().ChildNamespace("query", privacyNamespace) != nil
+}
+
+// ProcessIQ processes a privacy lists IQ taking according actions
+// over the associated stream.
+func (x *XEPPrivacy) ProcessIQ(iq *xml.IQ) {
+	q := iq.Elements().ChildNamespace("query", privacyNamespace)
+	elems := q.Elements().All()
+	if iq.IsGet() {
+		switch {
+		case len(elems) == 0:
+			x.sendListNames(iq)
+		case len(elems) == 1 && elems[0].Name() == "list":
+			x.sendList(iq, elems[0].Attributes().Get("name"))
+		default:
+			x.stm.SendElement(iq.BadRequestError())
+		}
+		return
+	}
+	if len(elems) != 1 {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	name := elems[0].Attributes().Get("name")
+	switch elems[0].Name() {
+	case "active":
+		x.setActiveList(iq, name)
+	case "default":
+		x.setDefaultList(iq, name)
+	case "list":
+		if len(name) == 0 {
+			x.stm.SendElement(iq.BadRequestError())
+			return
+		}
+		if elems[0].Elements().Count() == 0 {
+			x.deleteList(iq, name)
+		} else {
+			x.updateList(iq, name, elems[0].Elements().Children("item"))
+		}
+	default:
+		x.stm.SendElement(iq.BadRequestError())
+	}
+}
+
+// IsBlockedInbound returns whether or not a stanza addressed to the
+// associated stream is blocked by the privacy list in force.
+func (x *XEPPrivacy) IsBlockedInbound(stanza xml.Stanza) bool {
+	return x.isBlocked(stanza, stanza.FromJID(), true)
+}
+
+// IsBlockedOutbound returns whether or not a stanza sent by the
+// associated stream is blocked by the privacy list in force.
+func (x *XEPPrivacy) IsBlockedOutbound(stanza xml.Stanza) bool {
+	return x.isBlocked(stanza, stanza.ToJID(), false)
+}
+
+func (x *XEPPrivacy) sendListNames(iq *xml.IQ) {
+	lists, err := storage.Instance().FetchPrivacyLists(x.stm.Username())
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	q := xml.NewElementNamespace("query", privacyNamespace)
+	active := xml.NewElementName("active")
+	if l := activeList(x.stm); l != nil {
+		active.SetAttribute("name", l.Name)
+	}
+	q.AppendElement(active)
+
+	def := xml.NewElementName("default")
+	for _, l := range lists {
+		if l.IsDefault {
+			def.SetAttribute("name", l.Name)
+		}
+	}
+	q.AppendElement(def)
+
+	for _, l := range lists {
+		le := xml.NewElementName("list")
+		le.SetAttribute("name", l.Name)
+		q.AppendElement(le)
+	}
+	res := iq.ResultIQ()
+	res.AppendElement(q)
+	x.stm.SendElement(res)
+}
+
+func (x *XEPPrivacy) sendList(iq *xml.IQ, name string) {
+	l, err := storage.Instance().FetchPrivacyList(x.stm.Username(), name)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if l == nil {
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	q := xml.NewElementNamespace("query", privacyNamespace)
+	q.AppendElement(listElement(l))
+	res := iq.ResultIQ()
+	res.AppendElement(q)
+	x.stm.SendElement(res)
+}
+
+func (x *XEPPrivacy) setActiveList(iq *xml.IQ, name string) {
+	if len(name) == 0 {
+		// decline the use of any active list
+		x.stm.Context().SetObject(nil, activeListContextKey)
+		x.stm.SendElement(iq.ResultIQ())
+		return
+	}
+	l, err := storage.Instance().FetchPrivacyList(x.stm.Username(), name)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if l == nil {
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	x.stm.Context().SetObject(l, activeListContextKey)
+	x.stm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPPrivacy) setDefaultList(iq *xml.IQ, name string) {
+	var l *model.PrivacyList
+	if len(name) > 0 {
+		var err error
+		l, err = storage.Instance().FetchPrivacyList(x.stm.Username(), name)
+		if err != nil {
+			c2s.Logger(x.stm).Error(err)
+			x.stm.SendElement(iq.InternalServerError())
+			return
+		}
+		if l == nil {
+			x.stm.SendElement(iq.ItemNotFoundError())
+			return
+		}
+	}
+	// default list can't be changed while applied to any other resource
+	if def := x.defaultList(); def != nil && def.Name != name {
+		for _, stm := range x.otherStreams() {
+			if activeList(stm) == nil {
+				x.stm.SendElement(iq.ConflictError())
+				return
+			}
+		}
+	}
+	if err := storage.Instance().SetDefaultPrivacyList(x.stm.Username(), name); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if l != nil {
+		l.IsDefault = true
+	}
+	for _, stm := range c2s.Instance().StreamsMatchingJID(x.stm.JID().ToBareJID()) {
+		setDefaultList(stm, l)
+	}
+	x.stm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPPrivacy) deleteList(iq *xml.IQ, name string) {
+	l, err := storage.Instance().FetchPrivacyList(x.stm.Username(), name)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if l == nil {
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	if l.IsDefault {
+		x.stm.SendElement(iq.ConflictError())
+		return
+	}
+	for _, stm := range x.otherStreams() {
+		if active := activeList(stm); active != nil && active.Name == name {
+			x.stm.SendElement(iq.ConflictError())
+			return
+		}
+	}
+	if err := storage.Instance().DeletePrivacyList(x.stm.Username(), name); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if active := activeList(x.stm); active != nil && active.Name == name {
+		x.stm.Context().SetObject(nil, activeListContextKey)
+	}
+	x.stm.SendElement(iq.ResultIQ())
+	x.pushList(name)
+}
+
+func (x *XEPPrivacy) updateList(iq *xml.IQ, name string, itemElems []xml.XElement) {
+	items, err := x.parseItems(itemElems)
+	switch err {
+	case nil:
+		break
+	case errUnknownGroup:
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	case errInvalidItem:
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	default:
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	l := &model.PrivacyList{Username: x.stm.Username(), Name: name, Items: items}
+	if err := storage.Instance().InsertOrUpdatePrivacyList(l); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	// refresh list wherever it's in force
+	for _, stm := range c2s.Instance().StreamsMatchingJID(x.stm.JID().ToBareJID()) {
+		if active := activeList(stm); active != nil && active.Name == name {
+			stm.Context().SetObject(l, activeListContextKey)
+		}
+		if def := loadedDefaultList(stm); def != nil && def.Name == name {
+			updated := *l
+			updated.IsDefault = true
+			setDefaultList(stm, &updated)
+		}
+	}
+	x.stm.SendElement(iq.ResultIQ())
+	x.pushList(name)
+}
+
+func (x *XEPPrivacy) pushList(name string) {
+	for _, stm := range c2s.Instance().StreamsMatchingJID(x.stm.JID().ToBareJID()) {
+		le := xml.NewElementName("list")
+		le.SetAttribute("name", name)
+		q := xml.NewElementNamespace("query", privacyNamespace)
+		q.AppendElement(le)
+
+		push := xml.NewIQType(uuid.New(), xml.SetType)
+		push.SetToJID(stm.JID())
+		push.AppendElement(q)
+		stm.SendElement(push)
+	}
+}
+
+func (x *XEPPrivacy) parseItems(itemElems []xml.XElement) ([]model.PrivacyListItem, error) {
+	var groups map[string]struct{}
+	var items []model.PrivacyListItem
+	orders := make(map[int]struct{})
+	for _, elem := range itemElems {
+		itm, err := parseItem(elem)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := orders[itm.Order]; ok {
+			return nil, errInvalidItem
+		}
+		orders[itm.Order] = struct{}{}
+
+		if itm.Type == itemTypeGroup {
+			if groups == nil {
+				groups, err = x.rosterGroups()
+				if err != nil {
+					return nil, err
+				}
+			}
+			if _, ok := groups[itm.Value]; !ok {
+				return nil, errUnknownGroup
+			}
+		}
+		items = append(items, *itm)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Order < items[j].Order })
+	return items, nil
+}
+
+func (x *XEPPrivacy) rosterGroups() (map[string]struct{}, error) {
+	ris, _, err := storage.Instance().FetchRosterItems(x.stm.Username())
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]struct{})
+	for _, ri := range ris {
+		for _, group := range ri.Groups {
+			groups[group] = struct{}{}
+		}
+	}
+	return groups, nil
+}
+
+func (x *XEPPrivacy) isBlocked(stanza xml.Stanza, contact *xml.JID, inbound bool) bool {
+	l := activeList(x.stm)
+	if l == nil {
+		l = x.defaultList()
+	}
+	if l == nil || contact == nil {
+		return false
+	}
+	// communications with user's own resources or local server are never blocked
+	if contact.IsServer() && c2s.Instance().IsLocalDomain(contact.Domain()) {
+		return false
+	}
+	if contact.Node() == x.stm.Username() && contact.Domain() == x.stm.Domain() {
+		return false
+	}
+	kind := kindOf(stanza, inbound)
+
+	var ri *model.RosterItem
+	var riFetched bool
+	for i := range l.Items {
+		itm := &l.Items[i]
+		if !appliesTo(itm, kind) {
+			continue
+		}
+		switch itm.Type {
+		case itemTypeJID:
+			if !matchesJID(itm.Value, contact) {
+				continue
+			}
+		case itemTypeGroup, itemTypeSubscription:
+			if !riFetched {
+				ri = x.rosterItem(contact)
+				riFetched = true
+			}
+			if !matchesRosterItem(itm, ri) {
+				continue
+			}
+		}
+		return itm.Action == actionDeny
+	}
+	return false
+}
+
+func (x *XEPPrivacy) rosterItem(contact *xml.JID) *model.RosterItem {
+	ri, err := storage.Instance().FetchRosterItem(x.stm.Username(), contact.ToBareJID().String())
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return nil
+	}
+	return ri
+}
+
+func (x *XEPPrivacy) defaultList() *model.PrivacyList {
+	x.stm.Context().DoOnce(defaultListOnce, func() {
+		lists, err := storage.Instance().FetchPrivacyLists(x.stm.Username())
+		if err != nil {
+			c2s.Logger(x.stm).Error(err)
+			return
+		}
+		for i := range lists {
+			if lists[i].IsDefault {
+				x.stm.Context().SetObject(&lists[i], defaultListContextKey)
+				return
+			}
+		}
+	})
+	return loadedDefaultList(x.stm)
+}
+
+func (x *XEPPrivacy) otherStreams() []c2s.Stream {
+	var ret []c2s.Stream
+	for _, stm := range c2s.Instance().StreamsMatchingJID(x.stm.JID().ToBareJID()) {
+		if stm.ID() != x.stm.ID() {
+			ret = append(ret, stm)
+		}
+	}
+	return ret
+}
+
+func activeList(stm c2s.Stream) *model.PrivacyList {
+	switch l := stm.Context().Object(activeListContextKey).(type) {
+	case *model.PrivacyList:
+		return l
+	}
+	return nil
+}
+
+func loadedDefaultList(stm c2s.Stream) *model.PrivacyList {
+	switch l := stm.Context().Object(defaultListContextKey).(type) {
+	case *model.PrivacyList:
+		return l
+	}
+	return nil
+}
+
+func setDefaultList(stm c2s.Stream, l *model.PrivacyList) {
+	stm.Context().DoOnce(defaultListOnce, func() {}) // avoid reloading it from storage
+	stm.Context().SetObject(l, defaultListContextKey)
+}
+
+func parseItem(elem xml.XElement) (*model.PrivacyListItem, error) {
+	attrs := elem.Attributes()
+	order, err := strconv.Atoi(attrs.Get("order"))
+	if err != nil || order < 0 {
+		return nil, errInvalidItem
+	}
+	itm := &model.PrivacyListItem{
+		Type:   attrs.Get("type"),
+		Value:  attrs.Get("value"),
+		Action: attrs.Get("action"),
+		Order:  order,
+	}
+	switch itm.Action {
+	case actionAllow, actionDeny:
+		break
+	default:
+		return nil, errInvalidItem
+	}
+	if len(itm.Type) > 0 && len(itm.Value) == 0 {
+		return nil, errInvalidItem // typed items must hold a value
+	}
+	switch itm.Type {
+	case "":
+		if len(itm.Value) > 0 {
+			return nil, errInvalidItem
+		}
+	case itemTypeJID:
+		if _, err := xml.NewJIDString(itm.Value, false); err != nil {
+			return nil, errInvalidItem
+		}
+	case itemTypeGroup:
+		break
+	case itemTypeSubscription:
+		switch itm.Value {
+		case roster.SubscriptionNone, roster.SubscriptionTo, roster.SubscriptionFrom, roster.SubscriptionBoth:
+			break
+		default:
+			return nil, errInvalidItem
+		}
+	default:
+		return nil, errInvalidItem
+	}
+	for _, child := range elem.Elements().All() {
+		switch child.Name() {
+		case "message":
+			itm.Message = true
+		case "iq":
+			itm.IQ = true
+		case "presence-in":
+			itm.PresenceIn = true
+		case "presence-out":
+			itm.PresenceOut = true
+		default:
+			return nil, errInvalidItem
+		}
+	}
+	return itm, nil
+}
+
+func listElement(l *model.PrivacyList) xml.XElement {
+	le := xml.NewElementName("list")
+	le.SetAttribute("name", l.Name)
+	for _, itm := range l.Items {
+		ie := xml.NewElementName("item")
+		if len(itm.Type) > 0 {
+			ie.SetAttribute("type", itm.Type)
+			ie.SetAttribute("value", itm.Value)
+		}
+		ie.SetAttribute("action", itm.Action)
+		ie.SetAttribute("order", strconv.Itoa(itm.Order))
+		if itm.Message {
+			ie.AppendElement(xml.NewElementName("message"))
+		}
+		if itm.IQ {
+			ie.AppendElement(xml.NewElementName("iq"))
+		}
+		if itm.PresenceIn {
+			ie.AppendElement(xml.NewElementName("presence-in"))
+		}
+		if itm.PresenceOut {
+			ie.AppendElement(xml.NewElementName("presence-out"))
+		}
+		le.AppendElement(ie)
+	}
+	return le
+}
+
+func kindOf(stanza xml.Stanza, inbound bool) stanzaKind {
+	switch stanza := stanza.(type) {
+	case *xml.Message:
+		if inbound {
+			return messageKind
+		}
+	case *xml.IQ:
+		if inbound {
+			return iqKind
+		}
+	case *xml.Presence:
+		// only availability presences are subject to presence-in/out rules
+		if !stanza.IsAvailable() && !stanza.IsUnavailable() {
+			return otherKind
+		}
+		if inbound {
+			return presenceInKind
+		}
+		return presenceOutKind
+	}
+	return otherKind
+}
+
+func appliesTo(itm *model.PrivacyListItem, kind stanzaKind) bool {
+	if !itm.Message && !itm.IQ && !itm.PresenceIn && !itm.PresenceOut {
+		return true // item applies to every stanza
+	}
+	switch kind {
+	case messageKind:
+		return itm.Message
+	case iqKind:
+		return itm.IQ
+	case presenceInKind:
+		return itm.PresenceIn
+	case presenceOutKind:
+		return itm.PresenceOut
+	}
+	return false
+}
+
+func matchesJID(value string, contact *xml.JID) bool {
+	j, err := xml.NewJIDString(value, true)
+	if err != nil || j.Domain() != contact.Domain() {
+		return false
+	}
+	if len(j.Node()) > 0 && j.Node() != contact.Node() {
+		return false
+	}
+	if len(j.Resource()) > 0 && j.Resource() != contact.Resource() {
+		return false
+	}
+	return true
+}
+
+func matchesRosterItem(itm *model.PrivacyListItem, ri *model.RosterItem) bool {
+	switch itm.Type {
+	case itemTypeGroup:
+		if ri == nil {
+			return false
+		}
+		for _, group := range ri.Groups {
+			if group == itm.Value {
+				return true
+			}
+		}
+		return false
+	case itemTypeSubscription:
+		subscription := roster.SubscriptionNone
+		if ri != nil {
+			subscription = ri.Subscription
+		}
+		return subscription == itm.Value
+	}
+	return false
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0016
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0016_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := New(nil)
+	require.Equal(t, []string{privacyNamespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("query", privacyNamespace))
+	require.True(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0016_UpdateAndFetchLists(t *testing.T) {
+	stm, teardown := tUtilPrivacyInitialize()
+	defer teardown()
+
+	x := New(stm)
+
+	// invalid items
+	x.ProcessIQ(tUtilPrivacyListIQ(stm.JID(), "public", tUtilPrivacyItem("jid", "", "deny", "1")))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacyListIQ(stm.JID(), "public", tUtilPrivacyItem("subscription", "foo", "deny", "1")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacyListIQ(stm.JID(), "public",
+		tUtilPrivacyItem("jid", "juliet@jackal.im", "deny", "1"),
+		tUtilPrivacyItem("", "", "allow", "1"),
+	))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	// unknown roster group
+	x.ProcessIQ(tUtilPrivacyListIQ(stm.JID(), "public", tUtilPrivacyItem("group", "Friends", "allow", "1")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacyListIQ(stm.JID(), "public",
+		tUtilPrivacyItem("", "", "allow", "20"),
+		tUtilPrivacyItem("jid", "juliet@jackal.im", "deny", "10"),
+	))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	// list push
+	elem = stm.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, xml.SetType, elem.Type())
+	q := elem.Elements().ChildNamespace("query", privacyNamespace)
+	require.NotNil(t, q)
+	require.Equal(t, "public", q.Elements().Child("list").Attributes().Get("name"))
+
+	// fetch list names
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(stm.JID())
+	iq.SetToJID(stm.JID().ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("query", privacyNamespace))
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	q = elem.Elements().ChildNamespace("query", privacyNamespace)
+	require.NotNil(t, q)
+	require.Equal(t, "", q.Elements().Child("active").Attributes().Get("name"))
+	require.Equal(t, "", q.Elements().Child("default").Attributes().Get("name"))
+	require.Equal(t, 1, len(q.Elements().Children("list")))
+
+	// fetch list items
+	list := xml.NewElementName("list")
+	list.SetAttribute("name", "public")
+	query := xml.NewElementNamespace("query", privacyNamespace)
+	query.AppendElement(list)
+	iq = xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(stm.JID())
+	iq.SetToJID(stm.JID().ToBareJID())
+	iq.AppendElement(query)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	q = elem.Elements().ChildNamespace("query", privacyNamespace)
+	require.NotNil(t, q)
+	items := q.Elements().Child("list").Elements().Children("item")
+	require.Equal(t, 2, len(items))
+	require.Equal(t, "10", items[0].Attributes().Get("order"))
+	require.Equal(t, "juliet@jackal.im", items[0].Attributes().Get("value"))
+	require.Equal(t, "20", items[1].Attributes().Get("order"))
+
+	list.SetAttribute("name", "private")
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func TestXEP0016_ActiveAndDefaultLists(t *testing.T) {
+	stm, teardown := tUtilPrivacyInitialize()
+	defer teardown()
+
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	storage.Instance().InsertOrUpdatePrivacyList(&model.PrivacyList{
+		Username: "ortuman",
+		Name:     "public",
+		Items:    []model.PrivacyListItem{{Type: "jid", Value: "juliet@jackal.im", Action: "deny", Order: 1}},
+	})
+
+	x := New(stm)
+	x2 := New(stm2)
+
+	juliet, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(juliet)
+	msg.SetToJID(stm.JID())
+	require.False(t, x.IsBlockedInbound(msg))
+
+	x.ProcessIQ(tUtilPrivacySelectIQ(stm.JID(), "active", "private"))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacySelectIQ(stm.JID(), "active", "public"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.True(t, x.IsBlockedInbound(msg))
+	require.False(t, x2.IsBlockedInbound(msg))
+
+	// decline active list
+	x.ProcessIQ(tUtilPrivacySelectIQ(stm.JID(), "active", ""))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.False(t, x.IsBlockedInbound(msg))
+
+	// default list applies to every resource
+	x.ProcessIQ(tUtilPrivacySelectIQ(stm.JID(), "default", "public"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.True(t, x.IsBlockedInbound(msg))
+	require.True(t, x2.IsBlockedInbound(msg))
+
+	// default list can't be removed
+	x.ProcessIQ(tUtilPrivacyListIQ(stm.JID(), "public"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrConflict.Error(), elem.Error().Elements().All()[0].Name())
+
+	// ...nor changed while in use by another resource
+	x.ProcessIQ(tUtilPrivacySelectIQ(stm.JID(), "default", ""))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrConflict.Error(), elem.Error().Elements().All()[0].Name())
+
+	c2s.Instance().UnregisterStream(stm2)
+
+	x.ProcessIQ(tUtilPrivacySelectIQ(stm.JID(), "default", ""))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.False(t, x.IsBlockedInbound(msg))
+
+	x.ProcessIQ(tUtilPrivacyListIQ(stm.JID(), "public"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	l, _ := storage.Instance().FetchPrivacyList("ortuman", "public")
+	require.Nil(t, l)
+}
+
+func TestXEP0016_Blocking(t *testing.T) {
+	stm, teardown := tUtilPrivacyInitialize()
+	defer teardown()
+
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "juliet@jackal.im",
+		Subscription: "both",
+		Groups:       []string{"Friends"},
+	})
+	storage.Instance().InsertOrUpdatePrivacyList(&model.PrivacyList{
+		Username: "ortuman",
+		Name:     "invisible",
+		Items: []model.PrivacyListItem{
+			{Type: "jid", Value: "jabber.org/tablet", Action: "deny", Order: 1},
+			{Type: "group", Value: "Friends", Action: "allow", Order: 2},
+			{Type: "subscription", Value: "none", Action: "deny", Order: 3, Message: true},
+			{Action: "deny", Order: 4, PresenceOut: true},
+		},
+	})
+	storage.Instance().SetDefaultPrivacyList("ortuman", "invisible")
+
+	x := New(stm)
+
+	juliet, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+	romeo, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	remote, _ := xml.NewJID("", "jabber.org", "tablet", true)
+	local, _ := xml.NewJID("", "jackal.im", "", true)
+	own, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(romeo)
+	msg.SetToJID(stm.JID())
+	require.True(t, x.IsBlockedInbound(msg))
+
+	msg.SetFromJID(juliet)
+	require.False(t, x.IsBlockedInbound(msg))
+
+	msg.SetFromJID(remote)
+	require.True(t, x.IsBlockedInbound(msg))
+
+	msg.SetFromJID(local)
+	require.False(t, x.IsBlockedInbound(msg))
+
+	msg.SetFromJID(own)
+	require.False(t, x.IsBlockedInbound(msg))
+
+	// outbound messages aren't matched by message items
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(stm.JID())
+	msg.SetToJID(romeo)
+	require.False(t, x.IsBlockedOutbound(msg))
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(romeo)
+	iq.SetToJID(stm.JID())
+	require.False(t, x.IsBlockedInbound(iq))
+
+	p := xml.NewPresence(stm.JID(), romeo.ToBareJID(), xml.AvailableType)
+	require.True(t, x.IsBlockedOutbound(p))
+
+	p = xml.NewPresence(stm.JID(), juliet.ToBareJID(), xml.AvailableType)
+	require.False(t, x.IsBlockedOutbound(p))
+
+	// subscription requests aren't subject to presence-out items
+	p = xml.NewPresence(stm.JID(), romeo.ToBareJID(), xml.SubscribeType)
+	require.False(t, x.IsBlockedOutbound(p))
+}
+
+func tUtilPrivacyInitialize() (*c2s.MockStream, func()) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().AuthenticateStream(stm)
+
+	return stm, func() {
+		c2s.Shutdown()
+		storage.Shutdown()
+	}
+}
+
+func tUtilPrivacyItem(typ, value, action, order string) xml.XElement {
+	item := xml.NewElementName("item")
+	if len(typ) > 0 {
+		item.SetAttribute("type", typ)
+	}
+	if len(value) > 0 {
+		item.SetAttribute("value", value)
+	}
+	item.SetAttribute("action", action)
+	item.SetAttribute("order", order)
+	return item
+}
+
+func tUtilPrivacyListIQ(jid *xml.JID, name string, items ...xml.XElement) *xml.IQ {
+	list := xml.NewElementName("list")
+	list.SetAttribute("name", name)
+	list.AppendElements(items)
+	return tUtilPrivacySetIQ(jid, list)
+}
+
+func tUtilPrivacySelectIQ(jid *xml.JID, selection, name string) *xml.IQ {
+	elem := xml.NewElementName(selection)
+	if len(name) > 0 {
+		elem.SetAttribute("name", name)
+	}
+	return tUtilPrivacySetIQ(jid, elem)
+}
+
+func tUtilPrivacySetIQ(jid *xml.JID, elem xml.XElement) *xml.IQ {
+	query := xml.NewElementNamespace("query", privacyNamespace)
+	query.AppendElement(elem)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(jid)
+	iq.SetToJID(jid.ToBareJID())
+	iq.AppendElement(query)
+	return iq
+}
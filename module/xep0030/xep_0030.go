@@ -8,6 +8,7 @@ package xep0030
 import (
 	"sort"
 
+	"github.com/ortuman/jackal/module"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 )
@@ -22,9 +23,14 @@ type DiscoFeature = string
 
 // DiscoItem represents a disco info item entity.
 type DiscoItem struct {
-	Jid  string
-	Name string
-	Node string
+	Jid  string `yaml:"jid"`
+	Name string `yaml:"name"`
+	Node string `yaml:"node"`
+}
+
+// Config represents disco info module configuration.
+type Config struct {
+	Items []DiscoItem `yaml:"items"`
 }
 
 // DiscoIdentity represents a disco info identity entity.
@@ -34,12 +40,22 @@ type DiscoIdentity struct {
 	Name     string
 }
 
+// ItemsProvider represents a disco items node provider.
+type ItemsProvider interface {
+	// NodeItems returns the items associated to a disco node
+	// as seen by the requesting entity.
+	NodeItems(node string, requester *xml.JID) []DiscoItem
+}
+
 // XEPDiscoInfo represents a disco info server stream module.
 type XEPDiscoInfo struct {
-	stm        c2s.Stream
-	identities []DiscoIdentity
-	features   []DiscoFeature
-	items      []DiscoItem
+	stm            c2s.Stream
+	identities     []DiscoIdentity
+	features       []DiscoFeature
+	modules        []module.Module
+	items          []DiscoItem
+	itemsProviders map[string]ItemsProvider
+	extensions     []xml.XElement
 }
 
 // New returns a disco info IQ handler module.
@@ -57,16 +73,40 @@ func (x *XEPDiscoInfo) SetIdentities(identities []DiscoIdentity) {
 	x.identities = identities
 }
 
-// Features returns disco info module's features.
+// Features returns disco info module's features, including
+// namespaces associated to every registered module.
 func (x *XEPDiscoInfo) Features() []DiscoFeature {
-	return x.features
+	var features []DiscoFeature
+	set := make(map[DiscoFeature]struct{})
+	add := func(feature DiscoFeature) {
+		if _, ok := set[feature]; !ok {
+			set[feature] = struct{}{}
+			features = append(features, feature)
+		}
+	}
+	for _, feature := range x.features {
+		add(feature)
+	}
+	for _, mod := range x.modules {
+		for _, ns := range mod.AssociatedNamespaces() {
+			add(ns)
+		}
+	}
+	sort.Strings(features)
+	return features
 }
 
-// SetFeatures sets disco info module's features.
+// SetFeatures sets disco info module's additional features.
 func (x *XEPDiscoInfo) SetFeatures(features []DiscoFeature) {
 	x.features = features
 }
 
+// RegisterModule registers a module whose associated namespaces
+// will be advertised as disco info features.
+func (x *XEPDiscoInfo) RegisterModule(mod module.Module) {
+	x.modules = append(x.modules, mod)
+}
+
 // Items returns disco info module's items.
 func (x *XEPDiscoInfo) Items() []DiscoItem {
 	return x.items
@@ -77,6 +117,26 @@ func (x *XEPDiscoInfo) SetItems(items []DiscoItem) {
 	x.items = items
 }
 
+// RegisterItemsProvider registers the provider of
+// the items associated to a disco node.
+func (x *XEPDiscoInfo) RegisterItemsProvider(node string, provider ItemsProvider) {
+	if x.itemsProviders == nil {
+		x.itemsProviders = make(map[string]ItemsProvider)
+	}
+	x.itemsProviders[node] = provider
+}
+
+// Extensions returns disco info module's extended information forms.
+func (x *XEPDiscoInfo) Extensions() []xml.XElement {
+	return x.extensions
+}
+
+// SetExtensions sets disco info module's extended information
+// forms (XEP-0128).
+func (x *XEPDiscoInfo) SetExtensions(extensions []xml.XElement) {
+	x.extensions = extensions
+}
+
 // AssociatedNamespaces returns namespaces associated
 // with disco info module.
 func (x *XEPDiscoInfo) AssociatedNamespaces() []string {
@@ -105,13 +165,11 @@ func (x *XEPDiscoInfo) ProcessIQ(iq *xml.IQ) {
 	case discoInfoNamespace:
 		x.sendDiscoInfo(iq)
 	case discoItemsNamespace:
-		x.sendDiscoItems(iq)
+		x.sendDiscoItems(iq, q.Attributes().Get("node"))
 	}
 }
 
 func (x *XEPDiscoInfo) sendDiscoInfo(iq *xml.IQ) {
-	sort.Slice(x.features, func(i, j int) bool { return x.features[i] < x.features[j] })
-
 	result := iq.ResultIQ()
 	query := xml.NewElementNamespace("query", discoInfoNamespace)
 
@@ -126,21 +184,35 @@ func (x *XEPDiscoInfo) sendDiscoInfo(iq *xml.IQ) {
 		}
 		query.AppendElement(identityEl)
 	}
-	for _, feature := range x.features {
+	for _, feature := range x.Features() {
 		featureEl := xml.NewElementName("feature")
 		featureEl.SetAttribute("var", feature)
 		query.AppendElement(featureEl)
 	}
+	for _, extension := range x.extensions {
+		query.AppendElement(extension)
+	}
 
 	result.AppendElement(query)
 	x.stm.SendElement(result)
 }
 
-func (x *XEPDiscoInfo) sendDiscoItems(iq *xml.IQ) {
+func (x *XEPDiscoInfo) sendDiscoItems(iq *xml.IQ, node string) {
+	items := x.items
+	if len(node) > 0 {
+		provider := x.itemsProviders[node]
+		if provider == nil {
+			x.stm.SendElement(iq.ItemNotFoundError())
+			return
+		}
+		items = provider.NodeItems(node, iq.FromJID())
+	}
 	result := iq.ResultIQ()
 	query := xml.NewElementNamespace("query", discoItemsNamespace)
-
-	for _, item := range x.items {
+	if len(node) > 0 {
+		query.SetAttribute("node", node)
+	}
+	for _, item := range items {
 		itemEl := xml.NewElementName("item")
 		itemEl.SetAttribute("jid", item.Jid)
 		if len(item.Name) > 0 {
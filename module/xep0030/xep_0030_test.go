@@ -134,6 +134,16 @@ func TestXEP0030_GetFeatures(t *testing.T) {
 	require.Equal(t, 3, q.Elements().Count())
 	require.Equal(t, "identity", q.Elements().All()[0].Name())
 	require.Equal(t, "feature", q.Elements().All()[1].Name())
+
+	// extended information
+	x.SetExtensions([]xml.XElement{xml.NewElementNamespace("x", "jabber:x:data")})
+	require.Equal(t, 1, len(x.Extensions()))
+
+	x.ProcessIQ(iq1)
+	elem = stm.FetchElement()
+	q = elem.Elements().ChildNamespace("query", discoInfoNamespace)
+	require.Equal(t, 4, q.Elements().Count())
+	require.NotNil(t, q.Elements().ChildNamespace("x", "jabber:x:data"))
 }
 
 func TestXEP0030_GetItems(t *testing.T) {
@@ -161,4 +171,47 @@ func TestXEP0030_GetItems(t *testing.T) {
 	q := elem.Elements().ChildNamespace("query", discoItemsNamespace)
 	require.Equal(t, 2, q.Elements().Count())
 	require.Equal(t, "item", q.Elements().All()[0].Name())
+
+	// node items
+	x.RegisterItemsProvider("commands", &testItemsProvider{items: its[:1]})
+
+	iq2 := xml.NewIQType(uuid.New(), xml.GetType)
+	iq2.SetFromJID(j)
+	iq2.SetToJID(srvJid)
+	query := xml.NewElementNamespace("query", discoItemsNamespace)
+	query.SetAttribute("node", "commands")
+	iq2.AppendElement(query)
+
+	x.ProcessIQ(iq2)
+	elem = stm.FetchElement()
+	q = elem.Elements().ChildNamespace("query", discoItemsNamespace)
+	require.Equal(t, "commands", q.Attributes().Get("node"))
+	require.Equal(t, 1, q.Elements().Count())
+	require.Equal(t, "j1@jackal.im", q.Elements().All()[0].Attributes().Get("jid"))
+
+	query.SetAttribute("node", "unknown")
+	x.ProcessIQ(iq2)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+type testItemsProvider struct{ items []DiscoItem }
+
+func (p *testItemsProvider) NodeItems(_ string, _ *xml.JID) []DiscoItem { return p.items }
+
+type testModule struct{ namespaces []string }
+
+func (m *testModule) AssociatedNamespaces() []string { return m.namespaces }
+
+func TestXEP0030_RegisterModule(t *testing.T) {
+	x := New(nil)
+	x.SetFeatures([]DiscoFeature{discoItemsNamespace, discoInfoNamespace})
+	x.RegisterModule(x)
+	x.RegisterModule(&testModule{namespaces: []string{"urn:xmpp:blocking"}})
+
+	require.Equal(t, []DiscoFeature{
+		discoInfoNamespace,
+		discoItemsNamespace,
+		"urn:xmpp:blocking",
+	}, x.Features())
 }
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0048
+
+import (
+	"errors"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	// StorageNamespace is the private storage bookmarks namespace (XEP-0048).
+	StorageNamespace = "storage:bookmarks"
+
+	// NodeNamespace is the PEP native bookmarks node (XEP-0402).
+	NodeNamespace = "urn:xmpp:bookmarks:1"
+)
+
+var (
+	errInvalidStorage    = errors.New("xep0048: invalid bookmarks storage element")
+	errInvalidConference = errors.New("xep0048: invalid conference bookmark")
+)
+
+// Conference represents a MUC room bookmark.
+type Conference struct {
+	JID      string
+	Name     string
+	Autojoin bool
+	Nick     string
+	Password string
+}
+
+// ParseStorage returns the conference bookmarks contained
+// in a 'storage:bookmarks' private storage element.
+func ParseStorage(elem xml.XElement) ([]Conference, error) {
+	if elem.Name() != "storage" || elem.Namespace() != StorageNamespace {
+		return nil, errInvalidStorage
+	}
+	var ret []Conference
+	for _, c := range elem.Elements().Children("conference") {
+		conf, err := parseConference(c.Attributes().Get("jid"), c)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *conf)
+	}
+	return ret, nil
+}
+
+// ParseConference returns the conference bookmark published
+// as a PEP native bookmarks node item.
+func ParseConference(itemID string, elem xml.XElement) (*Conference, error) {
+	if elem.Name() != "conference" || elem.Namespace() != NodeNamespace {
+		return nil, errInvalidConference
+	}
+	return parseConference(itemID, elem)
+}
+
+// FetchConferences returns all conference bookmarks stored by a user,
+// either through private storage or PEP native bookmarks.
+// Whenever a room is bookmarked in both places PEP one takes precedence.
+func FetchConferences(userJID *xml.JID) ([]Conference, error) {
+	var ret []Conference
+	idx := map[string]int{}
+
+	privElems, err := storage.Instance().FetchPrivateXML(StorageNamespace, userJID.Node())
+	if err != nil {
+		return nil, err
+	}
+	for _, privElem := range privElems {
+		confs, err := ParseStorage(privElem)
+		if err != nil {
+			continue // skip malformed legacy storage
+		}
+		for _, conf := range confs {
+			idx[conf.JID] = len(ret)
+			ret = append(ret, conf)
+		}
+	}
+	items, err := storage.Instance().FetchPubSubItems(userJID.ToBareJID().String(), NodeNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		conf, err := ParseConference(item.ID, item.Payload)
+		if err != nil {
+			continue
+		}
+		if i, ok := idx[conf.JID]; ok {
+			ret[i] = *conf
+			continue
+		}
+		idx[conf.JID] = len(ret)
+		ret = append(ret, *conf)
+	}
+	return ret, nil
+}
+
+// FetchAutojoinConferences returns the conference bookmarks
+// a user wants to join automatically on login.
+func FetchAutojoinConferences(userJID *xml.JID) ([]Conference, error) {
+	confs, err := FetchConferences(userJID)
+	if err != nil {
+		return nil, err
+	}
+	var ret []Conference
+	for _, conf := range confs {
+		if conf.Autojoin {
+			ret = append(ret, conf)
+		}
+	}
+	return ret, nil
+}
+
+func parseConference(jid string, elem xml.XElement) (*Conference, error) {
+	roomJID, err := xml.NewJIDString(jid, false)
+	if err != nil || !roomJID.IsBare() {
+		return nil, errInvalidConference
+	}
+	conf := &Conference{
+		JID:  roomJID.String(),
+		Name: elem.Attributes().Get("name"),
+	}
+	switch elem.Attributes().Get("autojoin") {
+	case "true", "1":
+		conf.Autojoin = true
+	}
+	if nick := elem.Elements().Child("nick"); nick != nil {
+		conf.Nick = nick.Text()
+	}
+	if password := elem.Elements().Child("password"); password != nil {
+		conf.Password = password.Text()
+	}
+	return conf, nil
+}
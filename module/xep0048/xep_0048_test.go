@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0048
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0048_ParseStorage(t *testing.T) {
+	_, err := ParseStorage(xml.NewElementNamespace("storage", "exodus:ns"))
+	require.Equal(t, errInvalidStorage, err)
+
+	conf := xml.NewElementName("conference")
+	conf.SetAttribute("jid", "jackal.im")
+	st := xml.NewElementNamespace("storage", StorageNamespace)
+	st.AppendElement(conf)
+	_, err = ParseStorage(st)
+	require.Equal(t, errInvalidConference, err)
+
+	conf.SetAttribute("jid", "room@conference.jackal.im")
+	conf.SetAttribute("name", "The Room")
+	conf.SetAttribute("autojoin", "1")
+	nick := xml.NewElementName("nick")
+	nick.SetText("ortuman")
+	conf.AppendElement(nick)
+	confs, err := ParseStorage(st)
+	require.Nil(t, err)
+	require.Equal(t, []Conference{{JID: "room@conference.jackal.im", Name: "The Room", Autojoin: true, Nick: "ortuman"}}, confs)
+}
+
+func TestXEP0048_ParseConference(t *testing.T) {
+	conf := xml.NewElementNamespace("conference", StorageNamespace)
+	_, err := ParseConference("room@conference.jackal.im", conf)
+	require.Equal(t, errInvalidConference, err)
+
+	conf.SetNamespace(NodeNamespace)
+	_, err = ParseConference("room@conference.jackal.im/nick", conf)
+	require.Equal(t, errInvalidConference, err)
+
+	password := xml.NewElementName("password")
+	password.SetText("secret")
+	conf.AppendElement(password)
+	c, err := ParseConference("room@conference.jackal.im", conf)
+	require.Nil(t, err)
+	require.Equal(t, "room@conference.jackal.im", c.JID)
+	require.Equal(t, "secret", c.Password)
+	require.False(t, c.Autojoin)
+}
+
+func TestXEP0048_FetchAutojoinConferences(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	conf1 := xml.NewElementName("conference")
+	conf1.SetAttribute("jid", "room1@conference.jackal.im")
+	conf1.SetAttribute("autojoin", "true")
+	conf2 := xml.NewElementName("conference")
+	conf2.SetAttribute("jid", "room2@conference.jackal.im")
+	conf2.SetAttribute("autojoin", "true")
+	st := xml.NewElementNamespace("storage", StorageNamespace)
+	st.AppendElement(conf1)
+	st.AppendElement(conf2)
+	storage.Instance().InsertOrUpdatePrivateXML([]xml.XElement{st}, StorageNamespace, "ortuman")
+
+	// PEP bookmark overrides private storage one
+	conf3 := xml.NewElementNamespace("conference", NodeNamespace)
+	conf3.SetAttribute("autojoin", "false")
+	storage.Instance().InsertOrUpdatePubSubItem("ortuman@jackal.im", NodeNamespace, &model.PubSubItem{
+		ID:      "room2@conference.jackal.im",
+		Payload: conf3,
+	})
+	conf4 := xml.NewElementNamespace("conference", NodeNamespace)
+	conf4.SetAttribute("autojoin", "true")
+	storage.Instance().InsertOrUpdatePubSubItem("ortuman@jackal.im", NodeNamespace, &model.PubSubItem{
+		ID:      "room3@conference.jackal.im",
+		Payload: conf4,
+	})
+	confs, err := FetchConferences(j)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(confs))
+
+	confs, err = FetchAutojoinConferences(j)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(confs))
+	require.Equal(t, "room1@conference.jackal.im", confs[0].JID)
+	require.Equal(t, "room3@conference.jackal.im", confs[1].JID)
+
+	storage.ActivateMockedError()
+	_, err = FetchAutojoinConferences(j)
+	require.Equal(t, storage.ErrMockedError, err)
+	storage.DeactivateMockedError()
+}
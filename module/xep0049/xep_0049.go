@@ -8,7 +8,7 @@ package xep0049
 import (
 	"strings"
 
-	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module/xep0048"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
@@ -16,15 +16,24 @@ import (
 
 const privateStorageNamespace = "jabber:iq:private"
 
+const defaultMaxSize = 65536
+
+// Config represents Private XML Storage module configuration.
+type Config struct {
+	MaxSize int `yaml:"max_size"`
+}
+
 // XEPPrivateStorage represents a private storage server stream module.
 type XEPPrivateStorage struct {
+	cfg     *Config
 	stm     c2s.Stream
 	actorCh chan func()
 }
 
 // New returns a private storage IQ handler module.
-func New(stm c2s.Stream) *XEPPrivateStorage {
+func New(config *Config, stm c2s.Stream) *XEPPrivateStorage {
 	x := &XEPPrivateStorage{
+		cfg:     config,
 		stm:     stm,
 		actorCh: make(chan func(), 32),
 	}
@@ -92,11 +101,11 @@ func (x *XEPPrivateStorage) getPrivate(iq *xml.IQ, q xml.XElement) {
 		x.stm.SendElement(iq.NotAcceptableError())
 		return
 	}
-	log.Infof("retrieving private element. ns: %s... (%s/%s)", privNS, x.stm.Username(), x.stm.Resource())
+	c2s.Logger(x.stm).Infof("retrieving private element. ns: %s... (%s/%s)", privNS, x.stm.Username(), x.stm.Resource())
 
 	privElements, err := storage.Instance().FetchPrivateXML(privNS, x.stm.Username())
 	if err != nil {
-		log.Errorf("%v", err)
+		c2s.Logger(x.stm).Errorf("%v", err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
@@ -125,6 +134,12 @@ func (x *XEPPrivateStorage) setPrivate(iq *xml.IQ, q xml.XElement) {
 			x.stm.SendElement(iq.NotAcceptableError())
 			return
 		}
+		if ns == xep0048.StorageNamespace {
+			if _, err := xep0048.ParseStorage(privElement); err != nil {
+				x.stm.SendElement(iq.BadRequestError())
+				return
+			}
+		}
 		elems := nsElements[ns]
 		if elems == nil {
 			elems = []xml.XElement{privElement}
@@ -133,11 +148,21 @@ func (x *XEPPrivateStorage) setPrivate(iq *xml.IQ, q xml.XElement) {
 		}
 		nsElements[ns] = elems
 	}
+	for _, elements := range nsElements {
+		size := 0
+		for _, elem := range elements {
+			size += len(elem.String())
+		}
+		if size > x.maxSize() {
+			x.stm.SendElement(iq.NotAcceptableError())
+			return
+		}
+	}
 	for ns, elements := range nsElements {
-		log.Infof("saving private element. ns: %s... (%s/%s)", ns, x.stm.Username(), x.stm.Resource())
+		c2s.Logger(x.stm).Infof("saving private element. ns: %s... (%s/%s)", ns, x.stm.Username(), x.stm.Resource())
 
 		if err := storage.Instance().InsertOrUpdatePrivateXML(elements, ns, x.stm.Username()); err != nil {
-			log.Errorf("%v", err)
+			c2s.Logger(x.stm).Errorf("%v", err)
 			x.stm.SendElement(iq.InternalServerError())
 			return
 		}
@@ -145,6 +170,13 @@ func (x *XEPPrivateStorage) setPrivate(iq *xml.IQ, q xml.XElement) {
 	x.stm.SendElement(iq.ResultIQ())
 }
 
+func (x *XEPPrivateStorage) maxSize() int {
+	if x.cfg.MaxSize > 0 {
+		return x.cfg.MaxSize
+	}
+	return defaultMaxSize
+}
+
 func (x *XEPPrivateStorage) isValidNamespace(ns string) bool {
 	return !strings.HasPrefix(ns, "jabber:") && !strings.HasPrefix(ns, "http://jabber.org/") && ns != "vcard-temp"
 }
@@ -6,8 +6,10 @@
 package xep0049
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/ortuman/jackal/module/xep0048"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
@@ -18,7 +20,7 @@ import (
 func TestXEP0049_Matching(t *testing.T) {
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 
-	x := New(nil)
+	x := New(&Config{}, nil)
 	require.Equal(t, []string{}, x.AssociatedNamespaces())
 
 	iq := xml.NewIQType(uuid.New(), xml.GetType)
@@ -35,7 +37,7 @@ func TestXEP0049_InvalidIQ(t *testing.T) {
 	stm := c2s.NewMockStream("abcd", j)
 	stm.SetUsername("romeo")
 
-	x := New(stm)
+	x := New(&Config{}, stm)
 
 	iq := xml.NewIQType(uuid.New(), xml.GetType)
 	iq.SetFromJID(j)
@@ -86,7 +88,7 @@ func TestXEP0049_SetAndGetPrivate(t *testing.T) {
 	stm := c2s.NewMockStream("abcd", j)
 	stm.SetUsername("ortuman")
 
-	x := New(stm)
+	x := New(&Config{}, stm)
 
 	iqID := uuid.New()
 	iq := xml.NewIQType(iqID, xml.SetType)
@@ -143,3 +145,70 @@ func TestXEP0049_SetAndGetPrivate(t *testing.T) {
 	require.Equal(t, 1, q3.Elements().Count())
 	require.Equal(t, "exodus:ns:2", q3.Elements().All()[0].Namespace())
 }
+
+func TestXEP0049_MaxSize(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+	stm.SetUsername("ortuman")
+
+	x := New(&Config{MaxSize: 64}, stm)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	q := xml.NewElementNamespace("query", privateStorageNamespace)
+	exodus := xml.NewElementNamespace("exodus", "exodus:ns")
+	exodus.SetText(strings.Repeat("a", 64))
+	q.AppendElement(exodus)
+	iq.AppendElement(q)
+
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements().All()[0].Name())
+
+	elems, _ := storage.Instance().FetchPrivateXML("exodus:ns", "ortuman")
+	require.Nil(t, elems)
+
+	exodus.SetText("a")
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+}
+
+func TestXEP0049_Bookmarks(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+	stm.SetUsername("ortuman")
+
+	x := New(&Config{}, stm)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	q := xml.NewElementNamespace("query", privateStorageNamespace)
+	conf := xml.NewElementName("conference")
+	conf.SetAttribute("autojoin", "true")
+	st := xml.NewElementNamespace("storage", xep0048.StorageNamespace)
+	st.AppendElement(conf)
+	q.AppendElement(st)
+	iq.AppendElement(q)
+
+	// missing room JID
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	conf.SetAttribute("jid", "room@conference.jackal.im")
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	confs, _ := xep0048.FetchAutojoinConferences(j)
+	require.Equal(t, 1, len(confs))
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0050
+
+import (
+	"github.com/ortuman/jackal/module/xep0030"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+// Namespace is the ad-hoc commands namespace (XEP-0050).
+const Namespace = "http://jabber.org/protocol/commands"
+
+const dataFormNamespace = "jabber:x:data"
+
+// maximum number of pending command sessions per stream
+const maxSessions = 16
+
+// command execution status
+const (
+	statusExecuting = "executing"
+	statusCompleted = "completed"
+	statusCanceled  = "canceled"
+)
+
+// Command represents an ad-hoc command.
+type Command interface {
+	// Node returns the command node identifier.
+	Node() string
+
+	// Name returns the command human readable name.
+	Name() string
+
+	// IsAllowed returns whether or not an entity
+	// is allowed to execute the command.
+	IsAllowed(requester *xml.JID) bool
+
+	// Form returns the data form to be submitted in order to
+	// complete the command, or nil if no input is required.
+	Form() xml.XElement
+
+	// Execute completes the command using the submitted form values,
+	// returning an optional result data form.
+	// A stanza error should be returned if the command fails.
+	Execute(values map[string][]string) (xml.XElement, error)
+}
+
+// XEPAdHoc represents an ad-hoc commands server stream module.
+type XEPAdHoc struct {
+	stm      c2s.Stream
+	commands []Command
+	sessions map[string]string // pending sessions command node
+}
+
+// New returns an ad-hoc commands IQ handler module.
+func New(stm c2s.Stream) *XEPAdHoc {
+	return &XEPAdHoc{
+		stm:      stm,
+		sessions: make(map[string]string),
+	}
+}
+
+// RegisterCommand registers a new ad-hoc command.
+func (x *XEPAdHoc) RegisterCommand(cmd Command) {
+	x.commands = append(x.commands, cmd)
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with ad-hoc commands module.
+func (x *XEPAdHoc) AssociatedNamespaces() []string {
+	return []string{Namespace}
+}
+
+// NodeItems returns the commands an entity is allowed to execute.
+func (x *XEPAdHoc) NodeItems(node string, requester *xml.JID) []xep0030.DiscoItem {
+	var items []xep0030.DiscoItem
+	for _, cmd := range x.commands {
+		if !cmd.IsAllowed(requester) {
+			continue
+		}
+		items = append(items, xep0030.DiscoItem{
+			Jid:  x.stm.Domain(),
+			Name: cmd.Name(),
+			Node: cmd.Node(),
+		})
+	}
+	return items
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the ad-hoc commands module.
+func (x *XEPAdHoc) MatchesIQ(iq *xml.IQ) bool {
+	return iq.IsSet() && iq.Elements().ChildNamespace("command", Namespace) != nil
+}
+
+// ProcessIQ processes an ad-hoc commands IQ taking according actions
+// over the associated stream.
+func (x *XEPAdHoc) ProcessIQ(iq *xml.IQ) {
+	if !iq.ToJID().IsServer() {
+		x.stm.SendElement(iq.FeatureNotImplementedError())
+		return
+	}
+	cmdEl := iq.Elements().ChildNamespace("command", Namespace)
+	cmd := x.command(cmdEl.Attributes().Get("node"))
+	if cmd == nil {
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	if !cmd.IsAllowed(iq.FromJID()) {
+		x.stm.SendElement(iq.ForbiddenError())
+		return
+	}
+	action := cmdEl.Attributes().Get("action")
+	sessionID := cmdEl.Attributes().Get("sessionid")
+	if len(sessionID) == 0 {
+		switch action {
+		case "", "execute":
+			x.startCommand(iq, cmd)
+		default:
+			x.sendBadRequest(iq, "bad-action")
+		}
+		return
+	}
+	if x.sessions[sessionID] != cmd.Node() {
+		x.sendBadRequest(iq, "bad-sessionid")
+		return
+	}
+	switch action {
+	case "cancel":
+		delete(x.sessions, sessionID)
+		x.stm.SendElement(x.commandResult(iq, cmd, sessionID, statusCanceled, nil))
+	case "", "execute", "complete":
+		form := cmdEl.Elements().ChildNamespace("x", dataFormNamespace)
+		if form == nil || form.Type() != "submit" {
+			x.sendBadRequest(iq, "bad-payload")
+			return
+		}
+		delete(x.sessions, sessionID)
+		x.executeCommand(iq, cmd, sessionID, formValues(form))
+	default:
+		x.sendBadRequest(iq, "bad-action")
+	}
+}
+
+func (x *XEPAdHoc) startCommand(iq *xml.IQ, cmd Command) {
+	sessionID := uuid.New()
+	form := cmd.Form()
+	if form == nil {
+		// no input required... complete it right away
+		x.executeCommand(iq, cmd, sessionID, nil)
+		return
+	}
+	if len(x.sessions) >= maxSessions {
+		x.stm.SendElement(iq.ResourceConstraintError())
+		return
+	}
+	x.sessions[sessionID] = cmd.Node()
+
+	actions := xml.NewElementName("actions")
+	actions.SetAttribute("execute", "complete")
+	actions.AppendElement(xml.NewElementName("complete"))
+	x.stm.SendElement(x.commandResult(iq, cmd, sessionID, statusExecuting, []xml.XElement{actions, form}))
+}
+
+func (x *XEPAdHoc) executeCommand(iq *xml.IQ, cmd Command, sessionID string, values map[string][]string) {
+	result, err := cmd.Execute(values)
+	if err != nil {
+		if stanzaErr, ok := err.(*xml.StanzaError); ok {
+			x.stm.SendElement(xml.NewErrorElementFromElement(iq, stanzaErr, nil))
+			return
+		}
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	var elements []xml.XElement
+	if result != nil {
+		elements = append(elements, result)
+	}
+	x.stm.SendElement(x.commandResult(iq, cmd, sessionID, statusCompleted, elements))
+}
+
+func (x *XEPAdHoc) commandResult(iq *xml.IQ, cmd Command, sessionID, status string, elements []xml.XElement) *xml.IQ {
+	cmdEl := xml.NewElementNamespace("command", Namespace)
+	cmdEl.SetAttribute("node", cmd.Node())
+	cmdEl.SetAttribute("sessionid", sessionID)
+	cmdEl.SetAttribute("status", status)
+	cmdEl.AppendElements(elements)
+
+	result := iq.ResultIQ()
+	result.AppendElement(cmdEl)
+	return result
+}
+
+func (x *XEPAdHoc) sendBadRequest(iq *xml.IQ, condition string) {
+	specificErr := xml.NewElementNamespace(condition, Namespace)
+	x.stm.SendElement(xml.NewErrorElementFromElement(iq, xml.ErrBadRequest.(*xml.StanzaError), []xml.XElement{specificErr}))
+}
+
+func (x *XEPAdHoc) command(node string) Command {
+	for _, cmd := range x.commands {
+		if cmd.Node() == node {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func formValues(form xml.XElement) map[string][]string {
+	values := make(map[string][]string)
+	for _, field := range form.Elements().Children("field") {
+		name := field.Attributes().Get("var")
+		for _, v := range field.Elements().Children("value") {
+			values[name] = append(values[name], v.Text())
+		}
+	}
+	return values
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0050
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type testCommand struct {
+	node   string
+	form   xml.XElement
+	values map[string][]string
+	err    error
+}
+
+func (c *testCommand) Node() string                      { return c.node }
+func (c *testCommand) Name() string                      { return "Test Command" }
+func (c *testCommand) IsAllowed(requester *xml.JID) bool { return requester.Node() == "ortuman" }
+func (c *testCommand) Form() xml.XElement                { return c.form }
+
+func (c *testCommand) Execute(values map[string][]string) (xml.XElement, error) {
+	c.values = values
+	if c.err != nil {
+		return nil, c.err
+	}
+	return xml.NewElementNamespace("x", dataFormNamespace), nil
+}
+
+func TestXEP0050_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := New(c2s.NewMockStream(uuid.New(), j))
+	require.Equal(t, []string{Namespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("command", Namespace))
+	require.True(t, x.MatchesIQ(iq))
+
+	iq.SetType(xml.GetType)
+	require.False(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0050_NodeItems(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	x := New(c2s.NewMockStream(uuid.New(), j1))
+	x.RegisterCommand(&testCommand{node: "test"})
+
+	items := x.NodeItems(Namespace, j1)
+	require.Equal(t, 1, len(items))
+	require.Equal(t, "test", items[0].Node)
+	require.Equal(t, "jackal.im", items[0].Jid)
+
+	require.Equal(t, 0, len(x.NodeItems(Namespace, j2)))
+}
+
+func TestXEP0050_Execute(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+	srvJID, _ := xml.NewJID("", "jackal.im", "", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	x := New(stm)
+	cmd := &testCommand{node: "test", form: xml.NewElementNamespace("x", dataFormNamespace)}
+	x.RegisterCommand(cmd)
+
+	// unknown command
+	x.ProcessIQ(commandIQ(j1, srvJID, "unknown", "", "", nil))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+
+	// not allowed requester
+	x.ProcessIQ(commandIQ(j2, srvJID, "test", "", "", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements().All()[0].Name())
+
+	// start execution
+	x.ProcessIQ(commandIQ(j1, srvJID, "test", "", "execute", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	cmdEl := elem.Elements().ChildNamespace("command", Namespace)
+	require.NotNil(t, cmdEl)
+	require.Equal(t, statusExecuting, cmdEl.Attributes().Get("status"))
+	require.NotNil(t, cmdEl.Elements().Child("actions"))
+	require.NotNil(t, cmdEl.Elements().ChildNamespace("x", dataFormNamespace))
+	sessionID := cmdEl.Attributes().Get("sessionid")
+	require.True(t, len(sessionID) > 0)
+
+	// unknown session
+	x.ProcessIQ(commandIQ(j1, srvJID, "test", uuid.New(), "complete", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+	require.NotNil(t, elem.Error().Elements().ChildNamespace("bad-sessionid", Namespace))
+
+	// unsupported action
+	x.ProcessIQ(commandIQ(j1, srvJID, "test", sessionID, "next", nil))
+	elem = stm.FetchElement()
+	require.NotNil(t, elem.Error().Elements().ChildNamespace("bad-action", Namespace))
+
+	// missing submitted form
+	x.ProcessIQ(commandIQ(j1, srvJID, "test", sessionID, "complete", nil))
+	elem = stm.FetchElement()
+	require.NotNil(t, elem.Error().Elements().ChildNamespace("bad-payload", Namespace))
+
+	// complete execution
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetType("submit")
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", "accountjids")
+	for _, v := range []string{"a@jackal.im", "b@jackal.im"} {
+		value := xml.NewElementName("value")
+		value.SetText(v)
+		field.AppendElement(value)
+	}
+	form.AppendElement(field)
+	iq := commandIQ(j1, srvJID, "test", sessionID, "complete", form)
+
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	cmdEl = elem.Elements().ChildNamespace("command", Namespace)
+	require.Equal(t, statusCompleted, cmdEl.Attributes().Get("status"))
+	require.NotNil(t, cmdEl.Elements().ChildNamespace("x", dataFormNamespace))
+	require.Equal(t, []string{"a@jackal.im", "b@jackal.im"}, cmd.values["accountjids"])
+
+	// session is over
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.NotNil(t, elem.Error().Elements().ChildNamespace("bad-sessionid", Namespace))
+
+	// cancel execution
+	x.ProcessIQ(commandIQ(j1, srvJID, "test", "", "", nil))
+	elem = stm.FetchElement()
+	sessionID = elem.Elements().ChildNamespace("command", Namespace).Attributes().Get("sessionid")
+
+	x.ProcessIQ(commandIQ(j1, srvJID, "test", sessionID, "cancel", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, statusCanceled, elem.Elements().ChildNamespace("command", Namespace).Attributes().Get("status"))
+	require.Equal(t, 0, len(x.sessions))
+}
+
+func TestXEP0050_ExecuteWithoutInput(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	srvJID, _ := xml.NewJID("", "jackal.im", "", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := New(stm)
+	cmd := &testCommand{node: "test"}
+	x.RegisterCommand(cmd)
+
+	x.ProcessIQ(commandIQ(j, srvJID, "test", "", "execute", nil))
+	elem := stm.FetchElement()
+	cmdEl := elem.Elements().ChildNamespace("command", Namespace)
+	require.Equal(t, statusCompleted, cmdEl.Attributes().Get("status"))
+	require.Equal(t, 0, len(x.sessions))
+
+	cmd.err = xml.ErrNotAcceptable
+	x.ProcessIQ(commandIQ(j, srvJID, "test", "", "execute", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func commandIQ(from, to *xml.JID, node, sessionID, action string, form xml.XElement) *xml.IQ {
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(from)
+	iq.SetToJID(to)
+	cmd := xml.NewElementNamespace("command", Namespace)
+	cmd.SetAttribute("node", node)
+	if len(sessionID) > 0 {
+		cmd.SetAttribute("sessionid", sessionID)
+	}
+	if len(action) > 0 {
+		cmd.SetAttribute("action", action)
+	}
+	if form != nil {
+		cmd.AppendElement(form)
+	}
+	iq.AppendElement(cmd)
+	return iq
+}
@@ -6,18 +6,31 @@
 package xep0054
 
 import (
-	"github.com/ortuman/jackal/log"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 )
 
-const vCardNamespace = "vcard-temp"
+const (
+	vCardNamespace       = "vcard-temp"
+	vCardUpdateNamespace = "vcard-temp:x:update"
+)
+
+const (
+	photoHashContextKey       = "vcard:photo_hash"
+	photoHashLoadedContextKey = "vcard:photo_hash_loaded"
+)
 
 // XEPVCard represents a vCard server stream module.
 type XEPVCard struct {
-	stm     c2s.Stream
-	actorCh chan func()
+	stm           c2s.Stream
+	actorCh       chan func()
+	photoUpdateFn func()
 }
 
 // New returns a vCard IQ handler module.
@@ -57,6 +70,39 @@ func (x *XEPVCard) ProcessIQ(iq *xml.IQ) {
 	}
 }
 
+// OnPhotoUpdate sets the handler to be invoked every time
+// user's vCard photo changes.
+func (x *XEPVCard) OnPhotoUpdate(fn func()) {
+	x.photoUpdateFn = fn
+}
+
+// AnnotatePresence returns a copy of an available presence carrying
+// the current vCard photo hash (XEP-0153).
+func (x *XEPVCard) AnnotatePresence(presence *xml.Presence) *xml.Presence {
+	if !presence.IsAvailable() {
+		return presence
+	}
+	hash, err := x.photoHash()
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return presence
+	}
+	photo := xml.NewElementName("photo")
+	photo.SetText(hash)
+	update := xml.NewElementNamespace("x", vCardUpdateNamespace)
+	update.AppendElement(photo)
+
+	elem := xml.NewElementFromElement(presence)
+	elem.RemoveElementsNamespace("x", vCardUpdateNamespace)
+	elem.AppendElement(update)
+	p, err := xml.NewPresenceFromElement(elem, presence.FromJID(), presence.ToJID())
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return presence
+	}
+	return p
+}
+
 func (x *XEPVCard) actorLoop(doneCh <-chan struct{}) {
 	for {
 		select {
@@ -84,11 +130,11 @@ func (x *XEPVCard) getVCard(vCard xml.XElement, iq *xml.IQ) {
 
 	resElem, err := storage.Instance().FetchVCard(username)
 	if err != nil {
-		log.Errorf("%v", err)
+		c2s.Logger(x.stm).Errorf("%v", err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
-	log.Infof("retrieving vcard... (%s/%s)", x.stm.Username(), x.stm.Resource())
+	c2s.Logger(x.stm).Infof("retrieving vcard... (%s/%s)", x.stm.Username(), x.stm.Resource())
 
 	resultIQ := iq.ResultIQ()
 	if resElem != nil {
@@ -102,17 +148,67 @@ func (x *XEPVCard) getVCard(vCard xml.XElement, iq *xml.IQ) {
 
 func (x *XEPVCard) setVCard(vCard xml.XElement, iq *xml.IQ) {
 	toJid := iq.ToJID()
-	if toJid.IsServer() || (toJid.IsBare() && toJid.Node() == x.stm.Username()) {
-		log.Infof("saving vcard... (%s/%s)", x.stm.Username(), x.stm.Resource())
+	isOwnVCard := toJid.IsBare() && toJid.Node() == x.stm.Username() && toJid.Domain() == x.stm.Domain()
+	if toJid.IsServer() || isOwnVCard {
+		c2s.Logger(x.stm).Infof("saving vcard... (%s/%s)", x.stm.Username(), x.stm.Resource())
 
 		err := storage.Instance().InsertOrUpdateVCard(vCard, x.stm.Username())
 		if err != nil {
-			log.Errorf("%v", err)
+			c2s.Logger(x.stm).Errorf("%v", err)
 			x.stm.SendElement(iq.InternalServerError())
 			return
 		}
 		x.stm.SendElement(iq.ResultIQ())
+
+		if hash := vCardPhotoHash(vCard); x.setPhotoHash(hash) && x.photoUpdateFn != nil {
+			x.photoUpdateFn()
+		}
 	} else {
 		x.stm.SendElement(iq.ForbiddenError())
 	}
 }
+
+func (x *XEPVCard) photoHash() (string, error) {
+	ctx := x.stm.Context()
+	if ctx.Bool(photoHashLoadedContextKey) {
+		return ctx.String(photoHashContextKey), nil
+	}
+	vCard, err := storage.Instance().FetchVCard(x.stm.Username())
+	if err != nil {
+		return "", err
+	}
+	var hash string
+	if vCard != nil {
+		hash = vCardPhotoHash(vCard)
+	}
+	x.setPhotoHash(hash)
+	return hash, nil
+}
+
+// setPhotoHash caches photo hash value, returning true if it changed.
+func (x *XEPVCard) setPhotoHash(hash string) bool {
+	ctx := x.stm.Context()
+	changed := !ctx.Bool(photoHashLoadedContextKey) || ctx.String(photoHashContextKey) != hash
+	ctx.SetString(hash, photoHashContextKey)
+	ctx.SetBool(true, photoHashLoadedContextKey)
+	return changed
+}
+
+func vCardPhotoHash(vCard xml.XElement) string {
+	photo := vCard.Elements().Child("PHOTO")
+	if photo == nil {
+		return ""
+	}
+	binVal := photo.Elements().Child("BINVAL")
+	if binVal == nil {
+		return ""
+	}
+	// base64 encoded data may be split into several lines
+	b64 := strings.Join(strings.Fields(binVal.Text()), "")
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(b) == 0 {
+		return ""
+	}
+	h := sha1.Sum(b)
+	return hex.EncodeToString(h[:])
+}
@@ -7,6 +7,7 @@ package xep0054
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -96,6 +97,13 @@ func TestXEP0054_SetError(t *testing.T) {
 	elem := stm.FetchElement()
 	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements().All()[0].Name())
 
+	// same username at a different domain...
+	j3, _ := xml.NewJID("ortuman", "jabber.org", "", true)
+	iq.SetToJID(j3)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements().All()[0].Name())
+
 	// storage error
 	storage.ActivateMockedError()
 	defer storage.DeactivateMockedError()
@@ -198,6 +206,70 @@ func TestXEP0054_GetError(t *testing.T) {
 	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements().All()[0].Name())
 }
 
+func TestXEP0054_PhotoUpdate(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+
+	x := New(stm)
+	updateCh := make(chan struct{}, 1)
+	x.OnPhotoUpdate(func() { updateCh <- struct{}{} })
+
+	// no photo... empty hash
+	p := x.AnnotatePresence(xml.NewPresence(j, j, xml.AvailableType))
+	update := p.Elements().ChildNamespace("x", vCardUpdateNamespace)
+	require.NotNil(t, update)
+	require.Equal(t, "", update.Elements().Child("photo").Text())
+
+	// unavailable presences are left untouched
+	p = x.AnnotatePresence(xml.NewPresence(j, j, xml.UnavailableType))
+	require.Nil(t, p.Elements().ChildNamespace("x", vCardUpdateNamespace))
+
+	vCard := testVCard()
+	binVal := xml.NewElementName("BINVAL")
+	binVal.SetText("aGVsbG8g\nd29ybGQ=") // 'hello world'
+	photo := xml.NewElementName("PHOTO")
+	photo.AppendElement(binVal)
+	vCard.(*xml.Element).AppendElement(photo)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	iq.AppendElement(vCard)
+
+	x.ProcessIQ(iq)
+	_ = stm.FetchElement()
+	select {
+	case <-updateCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "photo update handler not invoked")
+	}
+	presence := xml.NewPresence(j, j, xml.AvailableType)
+	presence.AppendElement(xml.NewElementNamespace("x", vCardUpdateNamespace))
+	p = x.AnnotatePresence(presence)
+	updates := p.Elements().ChildrenNamespace("x", vCardUpdateNamespace)
+	require.Equal(t, 1, len(updates))
+	require.Equal(t, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", updates[0].Elements().Child("photo").Text())
+
+	// same photo... no update
+	x.ProcessIQ(iq)
+	_ = stm.FetchElement()
+	select {
+	case <-updateCh:
+		require.Fail(t, "unexpected photo update")
+	case <-time.After(time.Millisecond * 100):
+		break
+	}
+
+	// hash is recovered from storage on a new session
+	x2 := New(c2s.NewMockStream("efgh", j))
+	p = x2.AnnotatePresence(xml.NewPresence(j, j, xml.AvailableType))
+	require.Equal(t, "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", p.Elements().ChildNamespace("x", vCardUpdateNamespace).Elements().Child("photo").Text())
+}
+
 func testVCard() xml.XElement {
 	vCard := xml.NewElementNamespace("vCard", vCardNamespace)
 	fn := xml.NewElementName("FN")
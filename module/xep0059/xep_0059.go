@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0059
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+// Namespace is the result set management namespace (XEP-0059).
+const Namespace = "http://jabber.org/protocol/rsm"
+
+var (
+	// ErrInvalidSet is returned when parsing a malformed 'set' element.
+	ErrInvalidSet = errors.New("xep0059: invalid result set element")
+
+	// ErrInvalidMax is returned when parsing a non numeric or negative 'max' value.
+	ErrInvalidMax = errors.New("xep0059: invalid max value")
+
+	// ErrInvalidIndex is returned when parsing a non numeric or negative 'index' value.
+	ErrInvalidIndex = errors.New("xep0059: invalid index value")
+
+	// ErrItemNotFound is returned when paging from an unknown item
+	// or an out of range index.
+	ErrItemNotFound = errors.New("xep0059: item not found")
+)
+
+// Request represents a result set management request.
+type Request struct {
+	// Max is the maximum number of items to be returned.
+	// A negative value means no limit was requested.
+	Max int
+
+	// After is the id of the item preceding the requested page.
+	After string
+
+	// Before is the id of the item following the requested page.
+	Before string
+
+	// LastPage is set when an empty 'before' element is requested.
+	LastPage bool
+
+	// Index is the absolute position of the first requested item.
+	// A negative value means no index was requested.
+	Index int
+}
+
+// Result represents a result set management response.
+type Result struct {
+	First      string
+	FirstIndex int
+	Last       string
+	Count      int
+}
+
+// Items represents an ordered result set.
+type Items interface {
+	// Len returns the number of items in the result set.
+	Len() int
+
+	// ID returns the unique identifier of the i-th item.
+	ID(i int) string
+}
+
+// NewRequest returns an unlimited result set request.
+func NewRequest() *Request {
+	return &Request{Max: -1, Index: -1}
+}
+
+// ParseRequest returns the result set management request
+// contained in a 'set' element.
+func ParseRequest(set xml.XElement) (*Request, error) {
+	if set.Name() != "set" || set.Namespace() != Namespace {
+		return nil, ErrInvalidSet
+	}
+	req := NewRequest()
+	if max := set.Elements().Child("max"); max != nil {
+		n, err := strconv.Atoi(max.Text())
+		if err != nil || n < 0 {
+			return nil, ErrInvalidMax
+		}
+		req.Max = n
+	}
+	if index := set.Elements().Child("index"); index != nil {
+		n, err := strconv.Atoi(index.Text())
+		if err != nil || n < 0 {
+			return nil, ErrInvalidIndex
+		}
+		req.Index = n
+	}
+	if after := set.Elements().Child("after"); after != nil {
+		req.After = after.Text()
+	}
+	if before := set.Elements().Child("before"); before != nil {
+		req.Before = before.Text()
+		req.LastPage = len(req.Before) == 0
+	}
+	// index based paging can't be combined with item based one
+	if req.Index >= 0 && (len(req.After) > 0 || len(req.Before) > 0 || req.LastPage) {
+		return nil, ErrInvalidSet
+	}
+	return req, nil
+}
+
+// IsBackwards returns whether or not the request pages
+// backwards through the result set.
+func (r *Request) IsBackwards() bool {
+	return len(r.Before) > 0 || r.LastPage
+}
+
+// Paginate returns the [from, to) bounds of the items page
+// matching a request, along with its result set response.
+func Paginate(items Items, req *Request) (from, to int, res *Result, err error) {
+	count := items.Len()
+	from, to = 0, count
+
+	switch {
+	case req.Index >= 0:
+		if req.Index > 0 && req.Index >= count {
+			return 0, 0, nil, ErrItemNotFound
+		}
+		from = req.Index
+
+	default:
+		if len(req.After) > 0 {
+			i := indexOf(items, req.After)
+			if i < 0 {
+				return 0, 0, nil, ErrItemNotFound
+			}
+			from = i + 1
+		}
+		if len(req.Before) > 0 {
+			i := indexOf(items, req.Before)
+			if i < 0 {
+				return 0, 0, nil, ErrItemNotFound
+			}
+			to = i
+		}
+		if to < from {
+			to = from
+		}
+	}
+	if req.Max >= 0 && to-from > req.Max {
+		if req.IsBackwards() {
+			from = to - req.Max
+		} else {
+			to = from + req.Max
+		}
+	}
+	res = &Result{Count: count}
+	if to > from {
+		res.First = items.ID(from)
+		res.FirstIndex = from
+		res.Last = items.ID(to - 1)
+	}
+	return from, to, res, nil
+}
+
+// Element returns result set response XML node.
+func (r *Result) Element() xml.XElement {
+	set := xml.NewElementNamespace("set", Namespace)
+	if len(r.First) > 0 {
+		first := xml.NewElementName("first")
+		first.SetAttribute("index", strconv.Itoa(r.FirstIndex))
+		first.SetText(r.First)
+		set.AppendElement(first)
+
+		last := xml.NewElementName("last")
+		last.SetText(r.Last)
+		set.AppendElement(last)
+	}
+	count := xml.NewElementName("count")
+	count.SetText(strconv.Itoa(r.Count))
+	set.AppendElement(count)
+	return set
+}
+
+func indexOf(items Items, id string) int {
+	for i := 0; i < items.Len(); i++ {
+		if items.ID(i) == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0059
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+type testItems []string
+
+func (t testItems) Len() int        { return len(t) }
+func (t testItems) ID(i int) string { return t[i] }
+
+var items = testItems{"a", "b", "c", "d", "e"}
+
+func TestXEP0059_ParseRequest(t *testing.T) {
+	_, err := ParseRequest(xml.NewElementNamespace("set", "jabber:iq:roster"))
+	require.Equal(t, ErrInvalidSet, err)
+
+	req, err := ParseRequest(xml.NewElementNamespace("set", Namespace))
+	require.Nil(t, err)
+	require.Equal(t, NewRequest(), req)
+
+	set := xml.NewElementNamespace("set", Namespace)
+	max := xml.NewElementName("max")
+	max.SetText("10")
+	after := xml.NewElementName("after")
+	after.SetText("b")
+	set.AppendElement(max)
+	set.AppendElement(after)
+	req, err = ParseRequest(set)
+	require.Nil(t, err)
+	require.Equal(t, 10, req.Max)
+	require.Equal(t, "b", req.After)
+	require.Equal(t, -1, req.Index)
+	require.False(t, req.IsBackwards())
+
+	set = xml.NewElementNamespace("set", Namespace)
+	set.AppendElement(xml.NewElementName("before"))
+	req, err = ParseRequest(set)
+	require.Nil(t, err)
+	require.True(t, req.LastPage)
+	require.True(t, req.IsBackwards())
+
+	set = xml.NewElementNamespace("set", Namespace)
+	max = xml.NewElementName("max")
+	max.SetText("-1")
+	set.AppendElement(max)
+	_, err = ParseRequest(set)
+	require.Equal(t, ErrInvalidMax, err)
+
+	set = xml.NewElementNamespace("set", Namespace)
+	index := xml.NewElementName("index")
+	index.SetText("foo")
+	set.AppendElement(index)
+	_, err = ParseRequest(set)
+	require.Equal(t, ErrInvalidIndex, err)
+
+	// index can't be combined with after/before
+	set = xml.NewElementNamespace("set", Namespace)
+	index = xml.NewElementName("index")
+	index.SetText("2")
+	set.AppendElement(index)
+	set.AppendElement(after)
+	_, err = ParseRequest(set)
+	require.Equal(t, ErrInvalidSet, err)
+}
+
+func TestXEP0059_PaginateForward(t *testing.T) {
+	req := NewRequest()
+	from, to, res, err := Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, 0, from)
+	require.Equal(t, 5, to)
+	require.Equal(t, &Result{First: "a", FirstIndex: 0, Last: "e", Count: 5}, res)
+
+	req.Max = 2
+	from, to, res, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"a", "b"}, items[from:to])
+	require.Equal(t, &Result{First: "a", FirstIndex: 0, Last: "b", Count: 5}, res)
+
+	req.After = res.Last
+	from, to, res, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"c", "d"}, items[from:to])
+	require.Equal(t, 2, res.FirstIndex)
+
+	req.After = res.Last
+	from, to, res, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"e"}, items[from:to])
+
+	// paging after last item returns an empty page
+	req.After = res.Last
+	from, to, res, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, 0, to-from)
+	require.Equal(t, &Result{Count: 5}, res)
+
+	req.After = "z"
+	_, _, _, err = Paginate(items, req)
+	require.Equal(t, ErrItemNotFound, err)
+}
+
+func TestXEP0059_PaginateBackwards(t *testing.T) {
+	req := NewRequest()
+	req.Max = 2
+	req.LastPage = true
+	from, to, res, err := Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"d", "e"}, items[from:to])
+	require.Equal(t, &Result{First: "d", FirstIndex: 3, Last: "e", Count: 5}, res)
+
+	req.LastPage = false
+	req.Before = res.First
+	from, to, res, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"b", "c"}, items[from:to])
+
+	req.Before = res.First
+	from, to, res, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"a"}, items[from:to])
+
+	// paging before first item returns an empty page
+	req.Before = res.First
+	from, to, res, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, 0, to-from)
+	require.Equal(t, &Result{Count: 5}, res)
+
+	req.Before = "z"
+	_, _, _, err = Paginate(items, req)
+	require.Equal(t, ErrItemNotFound, err)
+
+	// after/before range boundaries are exclusive
+	req = NewRequest()
+	req.After = "a"
+	req.Before = "e"
+	from, to, _, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"b", "c", "d"}, items[from:to])
+
+	req.Max = 1
+	from, to, _, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"d"}, items[from:to])
+
+	// inverted range
+	req = NewRequest()
+	req.After = "d"
+	req.Before = "b"
+	from, to, _, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, 0, to-from)
+}
+
+func TestXEP0059_PaginateIndex(t *testing.T) {
+	req := NewRequest()
+	req.Max = 2
+	req.Index = 3
+	from, to, res, err := Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"d", "e"}, items[from:to])
+	require.Equal(t, 3, res.FirstIndex)
+
+	req.Index = 4
+	from, to, _, err = Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, testItems{"e"}, items[from:to])
+
+	// out of range
+	req.Index = 5
+	_, _, _, err = Paginate(items, req)
+	require.Equal(t, ErrItemNotFound, err)
+
+	req.Index = 100
+	_, _, _, err = Paginate(items, req)
+	require.Equal(t, ErrItemNotFound, err)
+
+	// first index of an empty set
+	req.Index = 0
+	from, to, res, err = Paginate(testItems{}, req)
+	require.Nil(t, err)
+	require.Equal(t, 0, to-from)
+	require.Equal(t, &Result{}, res)
+}
+
+func TestXEP0059_CountOnly(t *testing.T) {
+	req := NewRequest()
+	req.Max = 0
+	from, to, res, err := Paginate(items, req)
+	require.Nil(t, err)
+	require.Equal(t, 0, to-from)
+
+	set := res.Element()
+	require.Equal(t, Namespace, set.Namespace())
+	require.Nil(t, set.Elements().Child("first"))
+	require.Nil(t, set.Elements().Child("last"))
+	require.Equal(t, "5", set.Elements().Child("count").Text())
+}
+
+func TestXEP0059_ResultElement(t *testing.T) {
+	res := &Result{First: "b", FirstIndex: 1, Last: "c", Count: 5}
+	set := res.Element()
+	require.Equal(t, "set", set.Name())
+	require.Equal(t, Namespace, set.Namespace())
+
+	first := set.Elements().Child("first")
+	require.NotNil(t, first)
+	require.Equal(t, "b", first.Text())
+	require.Equal(t, "1", first.Attributes().Get("index"))
+	require.Equal(t, "c", set.Elements().Child("last").Text())
+	require.Equal(t, "5", set.Elements().Child("count").Text())
+}
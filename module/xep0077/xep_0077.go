@@ -6,7 +6,7 @@
 package xep0077
 
 import (
-	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/auth"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -20,6 +20,7 @@ type Config struct {
 	AllowRegistration bool `yaml:"allow_registration"`
 	AllowChange       bool `yaml:"allow_change"`
 	AllowCancel       bool `yaml:"allow_cancel"`
+	RequireTLS        bool `yaml:"require_tls"`
 }
 
 // XEPRegister represents an in-band server stream module.
@@ -59,11 +60,11 @@ func (x *XEPRegister) ProcessIQ(iq *xml.IQ) {
 
 	q := iq.Elements().ChildNamespace("query", registerNamespace)
 	if !x.stm.IsAuthenticated() {
+		if (iq.IsGet() || iq.IsSet()) && !x.IsRegistrationAllowed() {
+			x.stm.SendElement(iq.NotAllowedError())
+			return
+		}
 		if iq.IsGet() {
-			if !x.cfg.AllowRegistration {
-				x.stm.SendElement(iq.NotAllowedError())
-				return
-			}
 			// ...send registration fields to requester entity...
 			x.sendRegistrationFields(iq, q)
 		} else if iq.IsSet() {
@@ -116,22 +117,19 @@ func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.XElement) {
 		x.stm.SendElement(iq.BadRequestError())
 		return
 	}
-	exists, err := storage.Instance().UserExists(userEl.Text())
-	if err != nil {
-		log.Errorf("%v", err)
-		x.stm.SendElement(iq.InternalServerError())
+	user := model.User{Username: userEl.Text()}
+	if err := auth.SetPassword(&user, passwordEl.Text()); err != nil {
+		x.stm.SendElement(iq.NotAcceptableError())
 		return
 	}
-	if exists {
+	switch err := storage.Instance().InsertUser(&user); err {
+	case nil:
+		break
+	case storage.ErrUserExists:
 		x.stm.SendElement(iq.ConflictError())
 		return
-	}
-	user := model.User{
-		Username: userEl.Text(),
-		Password: passwordEl.Text(),
-	}
-	if err := storage.Instance().InsertOrUpdateUser(&user); err != nil {
-		log.Errorf("%v", err)
+	default:
+		c2s.Logger(x.stm).Errorf("%v", err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
@@ -149,15 +147,16 @@ func (x *XEPRegister) cancelRegistration(iq *xml.IQ, query xml.XElement) {
 		return
 	}
 	if err := storage.Instance().DeleteUser(x.stm.Username()); err != nil {
-		log.Error(err)
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
+	c2s.Instance().ReloadBlockList(x.stm.Username())
 	x.stm.SendElement(iq.ResultIQ())
 }
 
 func (x *XEPRegister) changePassword(password string, username string, iq *xml.IQ) {
-	if !x.cfg.AllowChange {
+	if !x.cfg.AllowChange || auth.IsExternal() {
 		x.stm.SendElement(iq.NotAllowedError())
 		return
 	}
@@ -172,7 +171,7 @@ func (x *XEPRegister) changePassword(password string, username string, iq *xml.I
 	}
 	user, err := storage.Instance().FetchUser(username)
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
@@ -180,10 +179,13 @@ func (x *XEPRegister) changePassword(password string, username string, iq *xml.I
 		x.stm.SendElement(iq.ResultIQ())
 		return
 	}
-	if user.Password != password {
-		user.Password = password
+	if !auth.VerifyPassword(user, password) {
+		if err := auth.SetPassword(user, password); err != nil {
+			x.stm.SendElement(iq.NotAcceptableError())
+			return
+		}
 		if err := storage.Instance().InsertOrUpdateUser(user); err != nil {
-			log.Error(err)
+			c2s.Logger(x.stm).Error(err)
 			x.stm.SendElement(iq.InternalServerError())
 			return
 		}
@@ -191,6 +193,17 @@ func (x *XEPRegister) changePassword(password string, username string, iq *xml.I
 	x.stm.SendElement(iq.ResultIQ())
 }
 
+// IsRegistrationAllowed reports whether a new account can be
+// registered over the associated stream.
+// Accounts managed by an external authentication provider can't be registered in-band.
+func (x *XEPRegister) IsRegistrationAllowed() bool {
+	if !x.cfg.AllowRegistration || auth.IsExternal() {
+		return false
+	}
+	// registration credentials should only travel over a secured channel
+	return !x.cfg.RequireTLS || x.stm.IsSecured()
+}
+
 func (x *XEPRegister) isValidToJid(jid *xml.JID) bool {
 	if x.stm.IsAuthenticated() {
 		return jid.IsServer()
@@ -8,9 +8,11 @@ package xep0077
 import (
 	"testing"
 
+	"github.com/ortuman/jackal/auth"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/util"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
@@ -179,12 +181,21 @@ func TestXEP0077_RegisterUser(t *testing.T) {
 
 	usr, _ := storage.Instance().FetchUser("ortuman")
 	require.NotNil(t, usr)
+
+	// SCRAM-SHA-256 credentials derived at registration
+	usr, _ = storage.Instance().FetchUser("juliet")
+	require.NotNil(t, usr)
+	_, err := util.ParseScramCredentials(usr.ScramSHA256)
+	require.Nil(t, err)
 }
 
 func TestXEP0077_CancelRegistration(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
 
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
 
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
@@ -231,6 +242,90 @@ func TestXEP0077_CancelRegistration(t *testing.T) {
 	require.Nil(t, usr)
 }
 
+func TestXEP0077_RegistrationPolicy(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd1234", j)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(srvJid)
+	iq.SetToJID(srvJid)
+
+	q := xml.NewElementNamespace("query", registerNamespace)
+	username := xml.NewElementName("username")
+	username.SetText("juliet")
+	password := xml.NewElementName("password")
+	password.SetText("1234")
+	q.AppendElement(username)
+	q.AppendElement(password)
+	iq.AppendElement(q)
+
+	// registration disabled
+	x := New(&Config{}, stm)
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements().All()[0].Name())
+
+	// non secured stream
+	x = New(&Config{AllowRegistration: true, RequireTLS: true}, stm)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements().All()[0].Name())
+
+	stm.SetSecured(true)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	usr, _ := storage.Instance().FetchUser("juliet")
+	require.NotNil(t, usr)
+}
+
+func TestXEP0077_ExternalAuthProvider(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	auth.Initialize(&auth.Config{Type: auth.HTTP, HTTP: &auth.HTTPConfig{URL: "http://localhost", Timeout: 1}})
+	defer auth.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd1234", j)
+	stm.SetSecured(true)
+
+	x := New(&Config{AllowRegistration: true, AllowChange: true}, stm)
+	require.False(t, x.IsRegistrationAllowed())
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(srvJid)
+	iq.SetToJID(srvJid)
+
+	q := xml.NewElementNamespace("query", registerNamespace)
+	username := xml.NewElementName("username")
+	username.SetText("ortuman")
+	password := xml.NewElementName("password")
+	password.SetText("1234")
+	q.AppendElement(username)
+	q.AppendElement(password)
+	iq.AppendElement(q)
+
+	// accounts are managed by the provider...
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements().All()[0].Name())
+
+	// ...and so are passwords
+	stm.SetAuthenticated(true)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements().All()[0].Name())
+}
+
 func TestXEP0077_ChangePassword(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
@@ -290,4 +385,6 @@ func TestXEP0077_ChangePassword(t *testing.T) {
 	usr, _ := storage.Instance().FetchUser("ortuman")
 	require.NotNil(t, usr)
 	require.Equal(t, "5678", usr.Password)
+	_, err := util.ParseScramCredentials(usr.ScramSHA256)
+	require.Nil(t, err)
 }
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0078
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const authNamespace = "jabber:iq:auth"
+
+// FeatureNamespace is the stream feature namespace advertising
+// non-SASL authentication availability.
+const FeatureNamespace = "http://jabber.org/features/iq-auth"
+
+// XEPLegacyAuth represents a non-SASL authentication server stream module.
+// Credentials are only accepted over secured streams.
+type XEPLegacyAuth struct {
+	stm      c2s.Stream
+	streamID string
+	authFn   func(iq *xml.IQ, username, resource string)
+}
+
+// New returns a non-SASL authentication IQ handler module.
+func New(stm c2s.Stream) *XEPLegacyAuth {
+	return &XEPLegacyAuth{stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with non-SASL authentication module.
+func (x *XEPLegacyAuth) AssociatedNamespaces() []string {
+	return []string{authNamespace}
+}
+
+// SetStreamID sets current stream identifier, used
+// to verify password digests.
+func (x *XEPLegacyAuth) SetStreamID(streamID string) {
+	x.streamID = streamID
+}
+
+// OnAuthenticate sets the handler to be invoked once the
+// requester entity credentials have been verified.
+// The handler is in charge of replying the authentication IQ.
+func (x *XEPLegacyAuth) OnAuthenticate(fn func(iq *xml.IQ, username, resource string)) {
+	x.authFn = fn
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the non-SASL authentication module.
+func (x *XEPLegacyAuth) MatchesIQ(iq *xml.IQ) bool {
+	return (iq.IsGet() || iq.IsSet()) && iq.Elements().ChildNamespace("query", authNamespace) != nil
+}
+
+// ProcessIQ processes a non-SASL authentication IQ
+// taking according actions over the associated stream.
+func (x *XEPLegacyAuth) ProcessIQ(iq *xml.IQ) {
+	if !x.stm.IsSecured() || x.stm.IsAuthenticated() {
+		x.stm.SendElement(iq.NotAllowedError())
+		return
+	}
+	q := iq.Elements().ChildNamespace("query", authNamespace)
+	if iq.IsGet() {
+		x.sendAuthFields(iq, q)
+	} else {
+		x.authenticate(iq, q)
+	}
+}
+
+func (x *XEPLegacyAuth) sendAuthFields(iq *xml.IQ, q xml.XElement) {
+	username := xml.NewElementName("username")
+	if u := q.Elements().Child("username"); u != nil {
+		username.SetText(u.Text())
+	}
+	query := xml.NewElementNamespace("query", authNamespace)
+	query.AppendElement(username)
+	query.AppendElement(xml.NewElementName("password"))
+	if _, ok := auth.Instance().(auth.CredentialsProvider); ok && !auth.HashesPasswords() {
+		query.AppendElement(xml.NewElementName("digest"))
+	}
+	query.AppendElement(xml.NewElementName("resource"))
+
+	result := iq.ResultIQ()
+	result.AppendElement(query)
+	x.stm.SendElement(result)
+}
+
+func (x *XEPLegacyAuth) authenticate(iq *xml.IQ, q xml.XElement) {
+	username := q.Elements().Child("username")
+	resource := q.Elements().Child("resource")
+	password := q.Elements().Child("password")
+	digest := q.Elements().Child("digest")
+	if username == nil || len(username.Text()) == 0 || resource == nil || len(resource.Text()) == 0 ||
+		(password == nil && digest == nil) {
+		x.stm.SendElement(iq.NotAcceptableError())
+		return
+	}
+	var authenticated bool
+	var err error
+	if password != nil {
+		authenticated, err = auth.Instance().Authenticate(username.Text(), password.Text())
+	} else {
+		authenticated, err = x.authenticateDigest(username.Text(), digest.Text())
+	}
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if !authenticated {
+		x.stm.SendElement(iq.NotAuthorizedError())
+		return
+	}
+	if x.authFn != nil {
+		x.authFn(iq, username.Text(), resource.Text())
+	}
+}
+
+// authenticateDigest verifies a password digest, only available
+// whenever the authentication provider exposes stored credentials.
+func (x *XEPLegacyAuth) authenticateDigest(username, digest string) (bool, error) {
+	cp, ok := auth.Instance().(auth.CredentialsProvider)
+	if !ok {
+		return false, nil
+	}
+	user, err := cp.FetchCredentials(username)
+	if err != nil || user == nil || !user.HasPlainPassword() {
+		return false, err
+	}
+	h := sha1.Sum([]byte(x.streamID + user.Password))
+	expected := hex.EncodeToString(h[:])
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(digest)), []byte(expected)) == 1, nil
+}
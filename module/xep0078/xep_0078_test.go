@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0078
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0078_Matching(t *testing.T) {
+	x := New(nil)
+	require.Equal(t, []string{authNamespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("query", authNamespace))
+	require.True(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0078_AuthFields(t *testing.T) {
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := New(stm)
+
+	iq := tUtilLegacyAuthIQ(xml.GetType, "ortuman", "", "", "")
+
+	// plaintext stream
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements().All()[0].Name())
+
+	stm.SetSecured(true)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q := elem.Elements().ChildNamespace("query", authNamespace)
+	require.NotNil(t, q)
+	require.Equal(t, "ortuman", q.Elements().Child("username").Text())
+	require.NotNil(t, q.Elements().Child("password"))
+	require.NotNil(t, q.Elements().Child("digest"))
+	require.NotNil(t, q.Elements().Child("resource"))
+}
+
+func TestXEP0078_Authenticate(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	stm.SetSecured(true)
+
+	var username, resource string
+	x := New(stm)
+	x.SetStreamID("abcd1234")
+	x.OnAuthenticate(func(_ *xml.IQ, u, r string) {
+		username = u
+		resource = r
+	})
+
+	// missing fields
+	x.ProcessIQ(tUtilLegacyAuthIQ(xml.SetType, "ortuman", "1234", "", ""))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements().All()[0].Name())
+
+	// wrong password
+	x.ProcessIQ(tUtilLegacyAuthIQ(xml.SetType, "ortuman", "12345", "", "balcony"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAuthorized.Error(), elem.Error().Elements().All()[0].Name())
+
+	// unknown user
+	x.ProcessIQ(tUtilLegacyAuthIQ(xml.SetType, "noelia", "1234", "", "balcony"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAuthorized.Error(), elem.Error().Elements().All()[0].Name())
+
+	storage.ActivateMockedError()
+	x.ProcessIQ(tUtilLegacyAuthIQ(xml.SetType, "ortuman", "1234", "", "balcony"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements().All()[0].Name())
+	storage.DeactivateMockedError()
+
+	x.ProcessIQ(tUtilLegacyAuthIQ(xml.SetType, "ortuman", "1234", "", "balcony"))
+	require.Equal(t, "ortuman", username)
+	require.Equal(t, "balcony", resource)
+
+	// password digest
+	username, resource = "", ""
+	h := sha1.Sum([]byte("abcd12341234"))
+	x.ProcessIQ(tUtilLegacyAuthIQ(xml.SetType, "ortuman", "", hex.EncodeToString(h[:]), "garden"))
+	require.Equal(t, "ortuman", username)
+	require.Equal(t, "garden", resource)
+
+	x.ProcessIQ(tUtilLegacyAuthIQ(xml.SetType, "ortuman", "", "0123456789abcdef", "garden"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAuthorized.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func tUtilLegacyAuthIQ(iqType, username, password, digest, resource string) *xml.IQ {
+	q := xml.NewElementNamespace("query", authNamespace)
+	u := xml.NewElementName("username")
+	u.SetText(username)
+	q.AppendElement(u)
+	if len(password) > 0 {
+		p := xml.NewElementName("password")
+		p.SetText(password)
+		q.AppendElement(p)
+	}
+	if len(digest) > 0 {
+		d := xml.NewElementName("digest")
+		d.SetText(digest)
+		q.AppendElement(d)
+	}
+	if len(resource) > 0 {
+		r := xml.NewElementName("resource")
+		r.SetText(resource)
+		q.AppendElement(r)
+	}
+	iq := xml.NewIQType(uuid.New(), iqType)
+	iq.AppendElement(q)
+	return iq
+}
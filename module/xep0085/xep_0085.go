@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0085
+
+import (
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const chatStatesNamespace = "http://jabber.org/protocol/chatstates"
+
+const chatStatesSupportedContextKey = "chat_states:supported"
+
+var chatStates = []string{"active", "composing", "paused", "inactive", "gone"}
+
+// XEPChatStates represents a chat state notifications server stream module.
+type XEPChatStates struct {
+	stm c2s.Stream
+}
+
+// New returns a chat state notifications server stream module.
+func New(stm c2s.Stream) *XEPChatStates {
+	return &XEPChatStates{stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with chat state notifications module.
+func (x *XEPChatStates) AssociatedNamespaces() []string {
+	return []string{chatStatesNamespace}
+}
+
+// IsSupported returns whether or not the associated stream resource
+// has shown chat state notifications support.
+func (x *XEPChatStates) IsSupported() bool {
+	return x.stm.Context().Bool(chatStatesSupportedContextKey)
+}
+
+// ProcessSentMessage validates chat states of a message sent by the
+// associated stream, returning the message to be routed.
+// A message carrying conflicting chat states is bounced with a bad-request
+// error and nil is returned.
+func (x *XEPChatStates) ProcessSentMessage(message *xml.Message) *xml.Message {
+	states := messageChatStates(message)
+	if len(states) == 0 {
+		return message
+	}
+	// sending chat states implies supporting them
+	x.stm.Context().SetBool(true, chatStatesSupportedContextKey)
+
+	state := states[0]
+	for _, st := range states[1:] {
+		if st != state {
+			x.stm.SendElement(message.BadRequestError())
+			return nil
+		}
+	}
+	if len(states) == 1 {
+		return message
+	}
+	// collapse duplicated chat state elements
+	normalized, _ := xml.NewMessageFromElement(message, message.FromJID(), message.ToJID())
+	normalized.RemoveElementsNamespace(state, chatStatesNamespace)
+	normalized.AppendElement(xml.NewElementNamespace(state, chatStatesNamespace))
+	return normalized
+}
+
+// IsDeliverable returns whether or not a message should be delivered
+// to the associated stream. Standalone chat state notifications are
+// discarded unless the receiving resource supports them.
+func (x *XEPChatStates) IsDeliverable(message *xml.Message) bool {
+	if message.IsMessageWithBody() || len(messageChatStates(message)) == 0 {
+		return true
+	}
+	return x.IsSupported()
+}
+
+func messageChatStates(message *xml.Message) []string {
+	var states []string
+	for _, elem := range message.Elements().All() {
+		if elem.Namespace() != chatStatesNamespace {
+			continue
+		}
+		for _, st := range chatStates {
+			if elem.Name() == st {
+				states = append(states, st)
+				break
+			}
+		}
+	}
+	return states
+}
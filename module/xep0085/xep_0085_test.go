@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0085
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0085_SentMessage(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	x := New(stm)
+	require.Equal(t, []string{chatStatesNamespace}, x.AssociatedNamespaces())
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	require.Equal(t, msg, x.ProcessSentMessage(msg))
+	require.False(t, x.IsSupported())
+
+	// duplicated states are collapsed
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementNamespace("composing", chatStatesNamespace))
+	msg.AppendElement(xml.NewElementNamespace("composing", chatStatesNamespace))
+	normalized := x.ProcessSentMessage(msg)
+	require.NotNil(t, normalized)
+	require.Equal(t, 1, len(normalized.Elements().Children("composing")))
+	require.Equal(t, j2.String(), normalized.ToJID().String())
+	require.True(t, x.IsSupported())
+
+	// conflicting states are rejected
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementNamespace("composing", chatStatesNamespace))
+	msg.AppendElement(xml.NewElementNamespace("paused", chatStatesNamespace))
+	require.Nil(t, x.ProcessSentMessage(msg))
+
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func TestXEP0085_Deliverable(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j2)
+	x := New(stm)
+
+	notification := xml.NewMessageType(uuid.New(), xml.ChatType)
+	notification.SetFromJID(j1)
+	notification.SetToJID(j2)
+	notification.AppendElement(xml.NewElementNamespace("composing", chatStatesNamespace))
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	msg.AppendElement(xml.NewElementNamespace("active", chatStatesNamespace))
+
+	require.False(t, x.IsDeliverable(notification))
+	require.True(t, x.IsDeliverable(msg))
+
+	stm.Context().SetBool(true, chatStatesSupportedContextKey)
+	require.True(t, x.IsDeliverable(notification))
+}
@@ -8,15 +8,22 @@ package xep0092
 import (
 	"os/exec"
 	"strings"
+	"time"
 
-	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module/xep0115"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/version"
 	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
 )
 
 const versionNamespace = "jabber:iq:version"
 
+const defaultSoftwareName = "jackal"
+
+// maximum time a client is given to answer a forwarded version request
+const forwardedRequestTimeout = time.Second * 10
+
 var osString string
 
 func init() {
@@ -26,6 +33,11 @@ func init() {
 
 // Config represents XMPP Software Version module (XEP-0092) configuration.
 type Config struct {
+	// Name and Version override the reported software name and version.
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+
+	// ShowOS reports the server operating system.
 	ShowOS bool `yaml:"show_os"`
 }
 
@@ -52,8 +64,13 @@ func (x *XEPVersion) AssociatedNamespaces() []string {
 
 // MatchesIQ returns whether or not an IQ should be
 // processed by the version module.
+// Requests are addressed either to the server or to a local user account.
 func (x *XEPVersion) MatchesIQ(iq *xml.IQ) bool {
-	return iq.IsGet() && iq.Elements().ChildNamespace("query", versionNamespace) != nil && iq.ToJID().IsServer()
+	if !iq.IsGet() || iq.Elements().ChildNamespace("query", versionNamespace) == nil {
+		return false
+	}
+	toJID := iq.ToJID()
+	return toJID.IsServer() || (toJID.IsBare() && len(toJID.Node()) > 0)
 }
 
 // ProcessIQ processes a version IQ taking according actions
@@ -64,23 +81,33 @@ func (x *XEPVersion) ProcessIQ(iq *xml.IQ) {
 		x.stm.SendElement(iq.BadRequestError())
 		return
 	}
-	x.sendSoftwareVersion(iq)
+	if iq.ToJID().IsServer() {
+		x.sendSoftwareVersion(iq)
+		return
+	}
+	x.forwardVersionRequest(iq)
 }
 
 func (x *XEPVersion) sendSoftwareVersion(iq *xml.IQ) {
 	username := x.stm.Username()
 	resource := x.stm.Resource()
-	log.Infof("retrieving software version: %v (%s/%s)", version.ApplicationVersion, username, resource)
+	c2s.Logger(x.stm).Infof("retrieving software version: %v (%s/%s)", version.ApplicationVersion, username, resource)
 
 	result := iq.ResultIQ()
 	query := xml.NewElementNamespace("query", versionNamespace)
 
 	name := xml.NewElementName("name")
-	name.SetText("jackal")
+	name.SetText(defaultSoftwareName)
+	if len(x.cfg.Name) > 0 {
+		name.SetText(x.cfg.Name)
+	}
 	query.AppendElement(name)
 
 	ver := xml.NewElementName("version")
 	ver.SetText(version.ApplicationVersion.String())
+	if len(x.cfg.Version) > 0 {
+		ver.SetText(x.cfg.Version)
+	}
 	query.AppendElement(ver)
 
 	if x.cfg.ShowOS {
@@ -91,3 +118,53 @@ func (x *XEPVersion) sendSoftwareVersion(iq *xml.IQ) {
 	result.AppendElement(query)
 	x.stm.SendElement(result)
 }
+
+// forwardVersionRequest forwards a request addressed to a user account
+// to its highest priority client supporting the feature, relaying
+// back the response on behalf of the account.
+func (x *XEPVersion) forwardVersionRequest(iq *xml.IQ) {
+	stm := x.supportingStream(iq.ToJID())
+	if stm == nil {
+		x.stm.SendElement(iq.ServiceUnavailableError())
+		return
+	}
+	req := xml.NewIQType(uuid.New(), xml.GetType)
+	req.SetFrom(stm.Domain())
+	req.SetToJID(stm.JID())
+	req.AppendElement(xml.NewElementNamespace("query", versionNamespace))
+
+	stm.SendIQ(req, func(resp *xml.IQ, err error) {
+		if err != nil {
+			x.stm.SendElement(iq.ServiceUnavailableError())
+			return
+		}
+		result := xml.NewIQType(iq.ID(), resp.Type())
+		result.SetFromJID(iq.ToJID())
+		result.SetToJID(iq.FromJID())
+		result.AppendElements(resp.Elements().All())
+		x.stm.SendElement(result)
+	}, forwardedRequestTimeout)
+}
+
+// supportingStream returns the available stream of a user whose client
+// advertises software version support, preferring the highest priority one.
+func (x *XEPVersion) supportingStream(userJID *xml.JID) c2s.Stream {
+	var ret c2s.Stream
+	for _, stm := range c2s.Instance().StreamsMatchingJID(userJID) {
+		if stm == x.stm {
+			continue
+		}
+		presence := stm.Presence()
+		if presence == nil || !presence.IsAvailable() {
+			continue
+		}
+		caps := xep0115.Capabilities(presence)
+		if caps == nil || !caps.HasFeature(versionNamespace) {
+			continue
+		}
+		if ret == nil || presence.Priority() > ret.Presence().Priority() {
+			ret = stm
+		}
+	}
+	return ret
+}
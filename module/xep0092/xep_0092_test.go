@@ -8,6 +8,8 @@ package xep0092
 import (
 	"testing"
 
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/version"
 	"github.com/ortuman/jackal/xml"
@@ -53,6 +55,14 @@ func TestXEP0092(t *testing.T) {
 	require.Equal(t, version.ApplicationVersion.String(), ver.Elements().Child("version").Text())
 	require.Nil(t, ver.Elements().Child("os"))
 
+	// custom software name and version
+	x = New(&Config{Name: "xmpp.jackal.im", Version: "1.0"}, stm)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	ver = elem.Elements().ChildNamespace("query", versionNamespace)
+	require.Equal(t, "xmpp.jackal.im", ver.Elements().Child("name").Text())
+	require.Equal(t, "1.0", ver.Elements().Child("version").Text())
+
 	// show OS
 	cfg.ShowOS = true
 
@@ -62,3 +72,77 @@ func TestXEP0092(t *testing.T) {
 	ver = elem.Elements().ChildNamespace("query", versionNamespace)
 	require.Equal(t, osString, ver.Elements().Child("os").Text())
 }
+
+func TestXEP0092_ForwardToUser(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+
+	stm1 := tUtilVersionStream(j1)
+	stm2 := tUtilVersionStream(j2)
+
+	p := xml.NewPresence(j2, j2.ToBareJID(), xml.AvailableType)
+	c := xml.NewElementNamespace("c", "http://jabber.org/protocol/caps")
+	c.SetAttribute("hash", "sha-1")
+	c.SetAttribute("node", "http://jackal.im/client")
+	c.SetAttribute("ver", "SoFtWaReVeRsIoNcApS=")
+	p.AppendElement(c)
+	stm2.SetPresence(p)
+
+	x := New(&Config{}, stm1)
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j2.ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("query", versionNamespace))
+	require.True(t, x.MatchesIQ(iq))
+
+	// client capabilities unknown
+	x.ProcessIQ(iq)
+	elem := stm1.FetchElement()
+	require.Equal(t, xml.ErrServiceUnavailable.Error(), elem.Error().Elements().All()[0].Name())
+
+	storage.Instance().InsertCapabilities(&model.Capabilities{
+		Node:     "http://jackal.im/client",
+		Ver:      "SoFtWaReVeRsIoNcApS=",
+		Features: []string{versionNamespace},
+	})
+	x.ProcessIQ(iq)
+
+	req := stm2.FetchElement()
+	require.Equal(t, "iq", req.Name())
+	require.Equal(t, "jackal.im", req.From())
+	require.Equal(t, j2.String(), req.To())
+	require.NotNil(t, req.Elements().ChildNamespace("query", versionNamespace))
+
+	resp := xml.NewIQType(req.ID(), xml.ResultType)
+	q := xml.NewElementNamespace("query", versionNamespace)
+	name := xml.NewElementName("name")
+	name.SetText("Exodus")
+	q.AppendElement(name)
+	resp.AppendElement(q)
+	require.True(t, stm2.ResolveIQ(resp))
+
+	// response is relayed on behalf of the account
+	elem = stm1.FetchElement()
+	require.Equal(t, iq.ID(), elem.ID())
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, "noelia@jackal.im", elem.From())
+	require.Equal(t, "Exodus", elem.Elements().ChildNamespace("query", versionNamespace).Elements().Child("name").Text())
+}
+
+func tUtilVersionStream(j *xml.JID) *c2s.MockStream {
+	stm := c2s.NewMockStream(uuid.New(), j)
+	stm.SetUsername(j.Node())
+	stm.SetDomain(j.Domain())
+	stm.SetResource(j.Resource())
+	stm.SetAuthenticated(true)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().AuthenticateStream(stm)
+	return stm
+}
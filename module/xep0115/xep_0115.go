@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0115
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1"   // register SHA-1 hash
+	_ "crypto/sha256" // register SHA-224 and SHA-256 hashes
+	_ "crypto/sha512" // register SHA-384 and SHA-512 hashes
+	"encoding/base64"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	capsNamespace      = "http://jabber.org/protocol/caps"
+	discoInfoNamespace = "http://jabber.org/protocol/disco#info"
+	xDataNamespace     = "jabber:x:data"
+)
+
+// maximum time a client is given to answer a capabilities disco#info request
+const discoInfoTimeout = time.Second * 15
+
+const maxCachedCapabilities = 4096
+
+// supported verification string hash functions (https://www.iana.org/assignments/hash-function-text-names)
+var hashFuncs = map[string]crypto.Hash{
+	"sha-1":   crypto.SHA1,
+	"sha-224": crypto.SHA224,
+	"sha-256": crypto.SHA256,
+	"sha-384": crypto.SHA384,
+	"sha-512": crypto.SHA512,
+}
+
+// verified capabilities shared across streams, keyed by node#ver
+var (
+	cacheMu sync.RWMutex
+	cache   = make(map[string]*model.Capabilities)
+	pending = make(map[string]struct{})
+)
+
+// XEPCaps represents an entity capabilities server stream module.
+type XEPCaps struct {
+	stm c2s.Stream
+}
+
+// New returns an entity capabilities server stream module.
+func New(stm c2s.Stream) *XEPCaps {
+	return &XEPCaps{stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with entity capabilities module.
+func (x *XEPCaps) AssociatedNamespaces() []string {
+	return []string{capsNamespace}
+}
+
+// ProcessPresence resolves the capabilities advertised in an available
+// presence sent by the associated stream client.
+// Unknown capabilities are requested to the client and cached
+// once their verification string has been checked.
+func (x *XEPCaps) ProcessPresence(presence *xml.Presence) {
+	if !presence.IsAvailable() {
+		return
+	}
+	node, ver, hash := capsAttributes(presence)
+	if len(node) == 0 || len(ver) == 0 {
+		return
+	}
+	if _, ok := hashFuncs[hash]; !ok {
+		return // legacy or unsupported hash... nothing to verify
+	}
+	caps, err := fetchCapabilities(node, ver)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	if caps != nil || !markPending(node, ver) {
+		return
+	}
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFrom(x.stm.Domain())
+	iq.SetTo(x.stm.JID().String())
+	query := xml.NewElementNamespace("query", discoInfoNamespace)
+	query.SetAttribute("node", node+"#"+ver)
+	iq.AppendElement(query)
+
+	x.stm.SendIQ(iq, func(resp *xml.IQ, err error) {
+		defer unmarkPending(node, ver)
+		if err != nil {
+			c2s.Logger(x.stm).Warnf("caps: disco info request failed: %v", err)
+			return
+		}
+		x.processDiscoInfo(resp, node, ver, hash)
+	}, discoInfoTimeout)
+}
+
+func (x *XEPCaps) processDiscoInfo(iq *xml.IQ, node, ver, hash string) {
+	query := iq.Elements().ChildNamespace("query", discoInfoNamespace)
+	if !iq.IsResult() || query == nil {
+		return
+	}
+	computedVer, ok := VerificationString(query, hash)
+	if !ok || computedVer != ver {
+		c2s.Logger(x.stm).Warnf("caps: verification string mismatch... node: %s, ver: %s", node, ver)
+		return
+	}
+	caps := &model.Capabilities{Node: node, Ver: ver}
+	for _, feature := range query.Elements().Children("feature") {
+		caps.Features = append(caps.Features, feature.Attributes().Get("var"))
+	}
+	if err := storage.Instance().InsertCapabilities(caps); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	cacheCapabilities(caps)
+}
+
+// Capabilities returns the verified capabilities advertised in a presence,
+// or nil if they are not known yet.
+func Capabilities(presence *xml.Presence) *model.Capabilities {
+	node, ver, _ := capsAttributes(presence)
+	if len(node) == 0 || len(ver) == 0 {
+		return nil
+	}
+	caps, err := fetchCapabilities(node, ver)
+	if err != nil {
+		return nil
+	}
+	return caps
+}
+
+// VerificationString generates the verification string of a disco#info
+// query element as described in XEP-0115 section 5.1, returning false
+// if either hash is not supported or the query is not well formed.
+func VerificationString(query xml.XElement, hash string) (string, bool) {
+	h, ok := hashFuncs[hash]
+	if !ok {
+		return "", false
+	}
+	var identities, features []string
+	for _, identity := range query.Elements().Children("identity") {
+		attrs := identity.Attributes()
+		identities = append(identities, attrs.Get("category")+"/"+attrs.Get("type")+"/"+identity.Language()+"/"+attrs.Get("name"))
+	}
+	for _, feature := range query.Elements().Children("feature") {
+		features = append(features, feature.Attributes().Get("var"))
+	}
+	if hasDuplicates(identities) || hasDuplicates(features) {
+		return "", false
+	}
+	forms, ok := extendedForms(query)
+	if !ok {
+		return "", false
+	}
+	var b bytes.Buffer
+	for _, s := range sortedStrings(identities) {
+		b.WriteString(s + "<")
+	}
+	for _, s := range sortedStrings(features) {
+		b.WriteString(s + "<")
+	}
+	for _, form := range forms {
+		b.WriteString(form)
+	}
+	hasher := h.New()
+	hasher.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil)), true
+}
+
+// extendedForms returns the verification string of every
+// service discovery extension form, sorted by FORM_TYPE.
+func extendedForms(query xml.XElement) ([]string, bool) {
+	type form struct {
+		formType string
+		s        string
+	}
+	var forms []form
+	for _, x := range query.Elements().ChildrenNamespace("x", xDataNamespace) {
+		var formType string
+		var fieldVars []string
+		fieldValues := make(map[string][]string)
+		for _, field := range x.Elements().Children("field") {
+			var values []string
+			for _, value := range field.Elements().Children("value") {
+				values = append(values, value.Text())
+			}
+			v := field.Attributes().Get("var")
+			if v == "FORM_TYPE" {
+				if len(values) != 1 || field.Attributes().Get("type") != "hidden" {
+					return nil, false
+				}
+				formType = values[0]
+				continue
+			}
+			if _, ok := fieldValues[v]; ok {
+				return nil, false
+			}
+			fieldVars = append(fieldVars, v)
+			fieldValues[v] = values
+		}
+		if len(formType) == 0 {
+			continue // forms without FORM_TYPE are ignored
+		}
+		for _, f := range forms {
+			if f.formType == formType {
+				return nil, false
+			}
+		}
+		var b bytes.Buffer
+		b.WriteString(formType + "<")
+		for _, v := range sortedStrings(fieldVars) {
+			b.WriteString(v + "<")
+			for _, value := range sortedStrings(fieldValues[v]) {
+				b.WriteString(value + "<")
+			}
+		}
+		forms = append(forms, form{formType: formType, s: b.String()})
+	}
+	sort.Slice(forms, func(i, j int) bool { return forms[i].formType < forms[j].formType })
+
+	ret := make([]string, len(forms))
+	for i, f := range forms {
+		ret[i] = f.s
+	}
+	return ret, true
+}
+
+func capsAttributes(presence *xml.Presence) (node, ver, hash string) {
+	c := presence.Elements().ChildNamespace("c", capsNamespace)
+	if c == nil {
+		return "", "", ""
+	}
+	attrs := c.Attributes()
+	return attrs.Get("node"), attrs.Get("ver"), attrs.Get("hash")
+}
+
+func fetchCapabilities(node, ver string) (*model.Capabilities, error) {
+	cacheMu.RLock()
+	caps := cache[node+"#"+ver]
+	cacheMu.RUnlock()
+	if caps != nil {
+		return caps, nil
+	}
+	caps, err := storage.Instance().FetchCapabilities(node, ver)
+	if err != nil {
+		return nil, err
+	}
+	if caps != nil {
+		cacheCapabilities(caps)
+	}
+	return caps, nil
+}
+
+func cacheCapabilities(caps *model.Capabilities) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if len(cache) >= maxCachedCapabilities {
+		for k := range cache { // evict any entry... persisted anyway
+			delete(cache, k)
+			break
+		}
+	}
+	cache[caps.Node+"#"+caps.Ver] = caps
+}
+
+// markPending returns false if capabilities are already being requested.
+func markPending(node, ver string) bool {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if _, ok := pending[node+"#"+ver]; ok {
+		return false
+	}
+	pending[node+"#"+ver] = struct{}{}
+	return true
+}
+
+func unmarkPending(node, ver string) {
+	cacheMu.Lock()
+	delete(pending, node+"#"+ver)
+	cacheMu.Unlock()
+}
+
+func hasDuplicates(s []string) bool {
+	seen := make(map[string]struct{}, len(s))
+	for _, v := range s {
+		if _, ok := seen[v]; ok {
+			return true
+		}
+		seen[v] = struct{}{}
+	}
+	return false
+}
+
+func sortedStrings(s []string) []string {
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0115
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0115_VerificationString(t *testing.T) {
+	// XEP-0115 simple generation example
+	query := tUtilCapsDiscoInfo()
+	ver, ok := VerificationString(query, "sha-1")
+	require.True(t, ok)
+	require.Equal(t, "QgayPKawpkPSDYmwT/WM94uAlu0=", ver)
+
+	_, ok = VerificationString(query, "md5")
+	require.False(t, ok)
+
+	// XEP-0115 complex generation example
+	query = xml.NewElementNamespace("query", discoInfoNamespace)
+	for _, lang := range []string{"en", "el"} {
+		identity := xml.NewElementName("identity")
+		identity.SetAttribute("xml:lang", lang)
+		identity.SetAttribute("category", "client")
+		identity.SetAttribute("type", "pc")
+		if lang == "en" {
+			identity.SetAttribute("name", "Psi 0.11")
+		} else {
+			identity.SetAttribute("name", "Ψ 0.11")
+		}
+		query.AppendElement(identity)
+	}
+	for _, v := range []string{"http://jabber.org/protocol/caps", "http://jabber.org/protocol/disco#info", "http://jabber.org/protocol/disco#items", "http://jabber.org/protocol/muc"} {
+		feature := xml.NewElementName("feature")
+		feature.SetAttribute("var", v)
+		query.AppendElement(feature)
+	}
+	form := xml.NewElementNamespace("x", xDataNamespace)
+	form.SetAttribute("type", "result")
+	form.AppendElement(tUtilCapsFormField("FORM_TYPE", "hidden", "urn:xmpp:dataforms:softwareinfo"))
+	form.AppendElement(tUtilCapsFormField("software_version", "", "0.11"))
+	form.AppendElement(tUtilCapsFormField("ip_version", "", "ipv6", "ipv4"))
+	form.AppendElement(tUtilCapsFormField("os", "", "Mac"))
+	form.AppendElement(tUtilCapsFormField("os_version", "", "10.5.1"))
+	form.AppendElement(tUtilCapsFormField("software", "", "Psi"))
+	query.AppendElement(form)
+
+	ver, ok = VerificationString(query, "sha-1")
+	require.True(t, ok)
+	require.Equal(t, "q07IKJEyjvHSyhy//CH0CxmKi8w=", ver)
+
+	// duplicated features are not allowed
+	feature := xml.NewElementName("feature")
+	feature.SetAttribute("var", "http://jabber.org/protocol/muc")
+	query.AppendElement(feature)
+	_, ok = VerificationString(query, "sha-1")
+	require.False(t, ok)
+}
+
+func TestXEP0115_ProcessPresence(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+	defer tUtilCapsResetCache()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	stm.SetDomain("jackal.im")
+
+	x := New(stm)
+	require.Equal(t, []string{capsNamespace}, x.AssociatedNamespaces())
+
+	// wrong verification string
+	p1 := tUtilCapsPresence(j, "http://code.google.com/p/exodus", "Wr0ngV3rCh0dzYmwT/WM94uAlu0=")
+	x.ProcessPresence(p1)
+
+	iq := stm.FetchElement()
+	require.Equal(t, "iq", iq.Name())
+	query := iq.Elements().ChildNamespace("query", discoInfoNamespace)
+	require.NotNil(t, query)
+	require.Equal(t, "http://code.google.com/p/exodus#Wr0ngV3rCh0dzYmwT/WM94uAlu0=", query.Attributes().Get("node"))
+
+	require.True(t, stm.ResolveIQ(tUtilCapsDiscoInfoResult(iq)))
+	require.Nil(t, Capabilities(p1))
+
+	// valid verification string
+	p2 := tUtilCapsPresence(j, "http://code.google.com/p/exodus", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	x.ProcessPresence(p2)
+
+	iq = stm.FetchElement()
+	require.True(t, stm.ResolveIQ(tUtilCapsDiscoInfoResult(iq)))
+
+	caps := Capabilities(p2)
+	require.NotNil(t, caps)
+	require.True(t, caps.HasFeature("http://jabber.org/protocol/muc"))
+
+	// known capabilities are not requested again...
+	x.ProcessPresence(p2)
+	require.Equal(t, "", stm.FetchElement().Name())
+
+	// ...even after server restart
+	tUtilCapsResetCache()
+	stored, _ := storage.Instance().FetchCapabilities("http://code.google.com/p/exodus", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	require.NotNil(t, stored)
+	require.Equal(t, caps.Features, Capabilities(p2).Features)
+}
+
+func TestXEP0115_PendingRequest(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+	defer tUtilCapsResetCache()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	stm.SetDomain("jackal.im")
+
+	x := New(stm)
+	p := tUtilCapsPresence(j, "http://code.google.com/p/exodus", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	x.ProcessPresence(p)
+	iq := stm.FetchElement()
+
+	// capabilities already being requested
+	x.ProcessPresence(p)
+	require.Equal(t, "", stm.FetchElement().Name())
+
+	errIQ := xml.NewIQType(iq.ID(), xml.ErrorType)
+	require.True(t, stm.ResolveIQ(errIQ))
+	require.Nil(t, Capabilities(p))
+
+	// failed requests can be retried
+	x.ProcessPresence(p)
+	require.Equal(t, "iq", stm.FetchElement().Name())
+}
+
+func tUtilCapsPresence(j *xml.JID, node, ver string) *xml.Presence {
+	p := xml.NewPresence(j, j.ToBareJID(), xml.AvailableType)
+	c := xml.NewElementNamespace("c", capsNamespace)
+	c.SetAttribute("hash", "sha-1")
+	c.SetAttribute("node", node)
+	c.SetAttribute("ver", ver)
+	p.AppendElement(c)
+	return p
+}
+
+func tUtilCapsDiscoInfo() *xml.Element {
+	query := xml.NewElementNamespace("query", discoInfoNamespace)
+	identity := xml.NewElementName("identity")
+	identity.SetAttribute("category", "client")
+	identity.SetAttribute("name", "Exodus 0.9.1")
+	identity.SetAttribute("type", "pc")
+	query.AppendElement(identity)
+	for _, v := range []string{"http://jabber.org/protocol/caps", "http://jabber.org/protocol/disco#info", "http://jabber.org/protocol/disco#items", "http://jabber.org/protocol/muc"} {
+		feature := xml.NewElementName("feature")
+		feature.SetAttribute("var", v)
+		query.AppendElement(feature)
+	}
+	return query
+}
+
+func tUtilCapsDiscoInfoResult(iq xml.XElement) *xml.IQ {
+	result := xml.NewIQType(iq.ID(), xml.ResultType)
+	query := tUtilCapsDiscoInfo()
+	query.SetAttribute("node", iq.Elements().ChildNamespace("query", discoInfoNamespace).Attributes().Get("node"))
+	result.AppendElement(query)
+	return result
+}
+
+func tUtilCapsFormField(v, typ string, values ...string) xml.XElement {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", v)
+	if len(typ) > 0 {
+		field.SetAttribute("type", typ)
+	}
+	for _, value := range values {
+		val := xml.NewElementName("value")
+		val.SetText(value)
+		field.AppendElement(val)
+	}
+	return field
+}
+
+func tUtilCapsResetCache() {
+	cacheMu.Lock()
+	cache = make(map[string]*model.Capabilities)
+	cacheMu.Unlock()
+}
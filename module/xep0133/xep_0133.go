@@ -0,0 +1,317 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0133
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/module/xep0050"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	adminNamespace    = "http://jabber.org/protocol/admin"
+	dataFormNamespace = "jabber:x:data"
+)
+
+const (
+	addUserNode            = adminNamespace + "#add-user"
+	deleteUserNode         = adminNamespace + "#delete-user"
+	changeUserPasswordNode = adminNamespace + "#change-user-password"
+	getOnlineUsersNumNode  = adminNamespace + "#get-online-users-num"
+	endUserSessionNode     = adminNamespace + "#end-user-session"
+	announceNode           = adminNamespace + "#announce"
+)
+
+// Config represents Service Administration module (XEP-0133) configuration.
+type Config struct {
+	Admins []string `yaml:"admins"`
+}
+
+type formField struct {
+	name     string
+	label    string
+	typ      string
+	required bool
+}
+
+type command struct {
+	cfg     *Config
+	node    string
+	name    string
+	fields  []formField
+	execute func(values map[string][]string) (xml.XElement, error)
+}
+
+// Commands returns service administration ad-hoc commands,
+// only allowed to be executed by configured admin JIDs.
+func Commands(cfg *Config) []xep0050.Command {
+	return []xep0050.Command{
+		&command{
+			cfg:  cfg,
+			node: addUserNode,
+			name: "Add User",
+			fields: []formField{
+				{name: "accountjid", label: "The Jabber ID for the account to be added", typ: "jid-single", required: true},
+				{name: "password", label: "The password for this account", typ: "text-private", required: true},
+				{name: "password-verify", label: "Retype password", typ: "text-private", required: true},
+			},
+			execute: addUser,
+		},
+		&command{
+			cfg:  cfg,
+			node: deleteUserNode,
+			name: "Delete User",
+			fields: []formField{
+				{name: "accountjids", label: "The Jabber ID(s) to delete", typ: "jid-multi", required: true},
+			},
+			execute: deleteUsers,
+		},
+		&command{
+			cfg:  cfg,
+			node: changeUserPasswordNode,
+			name: "Change User Password",
+			fields: []formField{
+				{name: "accountjid", label: "The Jabber ID for this account", typ: "jid-single", required: true},
+				{name: "password", label: "The password for this account", typ: "text-private", required: true},
+			},
+			execute: changeUserPassword,
+		},
+		&command{
+			cfg:     cfg,
+			node:    getOnlineUsersNumNode,
+			name:    "Get Number of Online Users",
+			execute: getOnlineUsersNum,
+		},
+		&command{
+			cfg:  cfg,
+			node: endUserSessionNode,
+			name: "End User Session",
+			fields: []formField{
+				{name: "accountjids", label: "The Jabber ID(s) for which to end sessions", typ: "jid-multi", required: true},
+			},
+			execute: endUserSessions,
+		},
+		&command{
+			cfg:  cfg,
+			node: announceNode,
+			name: "Send Announcement to Online Users",
+			fields: []formField{
+				{name: "subject", label: "Subject", typ: "text-single"},
+				{name: "announcement", label: "Announcement", typ: "text-multi", required: true},
+			},
+			execute: announce,
+		},
+	}
+}
+
+// Node returns the command node identifier.
+func (c *command) Node() string {
+	return c.node
+}
+
+// Name returns the command human readable name.
+func (c *command) Name() string {
+	return c.name
+}
+
+// IsAllowed returns whether or not an entity
+// is allowed to execute the command.
+func (c *command) IsAllowed(requester *xml.JID) bool {
+	if requester == nil {
+		return false
+	}
+	bareJID := requester.ToBareJID().String()
+	for _, admin := range c.cfg.Admins {
+		if admin == bareJID {
+			return true
+		}
+	}
+	return false
+}
+
+// Form returns the data form to be submitted in order to
+// complete the command, or nil if no input is required.
+func (c *command) Form() xml.XElement {
+	if len(c.fields) == 0 {
+		return nil
+	}
+	form := newForm("form")
+	title := xml.NewElementName("title")
+	title.SetText(c.name)
+	form.AppendElement(title)
+
+	for _, f := range c.fields {
+		field := xml.NewElementName("field")
+		field.SetAttribute("var", f.name)
+		field.SetAttribute("label", f.label)
+		field.SetAttribute("type", f.typ)
+		if f.required {
+			field.AppendElement(xml.NewElementName("required"))
+		}
+		form.AppendElement(field)
+	}
+	return form
+}
+
+// Execute completes the command using the submitted form values.
+func (c *command) Execute(values map[string][]string) (xml.XElement, error) {
+	for _, f := range c.fields {
+		if f.required && len(value(values, f.name)) == 0 {
+			return nil, xml.ErrBadRequest
+		}
+	}
+	return c.execute(values)
+}
+
+func addUser(values map[string][]string) (xml.XElement, error) {
+	jid, err := localJID(value(values, "accountjid"))
+	if err != nil {
+		return nil, err
+	}
+	password := value(values, "password")
+	if password != value(values, "password-verify") {
+		return nil, xml.ErrNotAcceptable
+	}
+	user := model.User{Username: jid.Node()}
+	if err := auth.SetPassword(&user, password); err != nil {
+		return nil, xml.ErrNotAcceptable
+	}
+	switch err := storage.Instance().InsertUser(&user); err {
+	case nil:
+		return nil, nil
+	case storage.ErrUserExists:
+		return nil, xml.ErrConflict
+	default:
+		return nil, err
+	}
+}
+
+func deleteUsers(values map[string][]string) (xml.XElement, error) {
+	jids, err := localJIDs(values["accountjids"])
+	if err != nil {
+		return nil, err
+	}
+	for _, jid := range jids {
+		if err := storage.Instance().DeleteUser(jid.Node()); err != nil {
+			return nil, err
+		}
+		c2s.Instance().ReloadBlockList(jid.Node())
+		for _, stm := range c2s.Instance().StreamsMatchingJID(jid.ToBareJID()) {
+			stm.Disconnect(streamerror.ErrNotAuthorized)
+		}
+	}
+	return nil, nil
+}
+
+func changeUserPassword(values map[string][]string) (xml.XElement, error) {
+	jid, err := localJID(value(values, "accountjid"))
+	if err != nil {
+		return nil, err
+	}
+	user, err := storage.Instance().FetchUser(jid.Node())
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, xml.ErrItemNotFound
+	}
+	password := value(values, "password")
+	if !auth.VerifyPassword(user, password) {
+		if err := auth.SetPassword(user, password); err != nil {
+			return nil, xml.ErrNotAcceptable
+		}
+		if err := storage.Instance().InsertOrUpdateUser(user); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func getOnlineUsersNum(_ map[string][]string) (xml.XElement, error) {
+	form := newForm("result")
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", "onlineusersnum")
+	field.SetAttribute("label", "The number of online users")
+	v := xml.NewElementName("value")
+	v.SetText(strconv.Itoa(c2s.Instance().OnlineUsersCount()))
+	field.AppendElement(v)
+	form.AppendElement(field)
+	return form, nil
+}
+
+func endUserSessions(values map[string][]string) (xml.XElement, error) {
+	jids, err := localJIDs(values["accountjids"])
+	if err != nil {
+		return nil, err
+	}
+	for _, jid := range jids {
+		// a full JID ends a single session, while a bare one ends all of them
+		for _, stm := range c2s.Instance().StreamsMatchingJID(jid) {
+			stm.Disconnect(streamerror.ErrPolicyViolation)
+		}
+	}
+	return nil, nil
+}
+
+func announce(values map[string][]string) (xml.XElement, error) {
+	// text-multi field lines are carried as separate values
+	c2s.Instance().Announce(&c2s.Announcement{
+		Subject: value(values, "subject"),
+		Body:    strings.Join(values["announcement"], "\n"),
+	})
+	return nil, nil
+}
+
+func newForm(formType string) *xml.Element {
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetType(formType)
+
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", "FORM_TYPE")
+	field.SetAttribute("type", "hidden")
+	v := xml.NewElementName("value")
+	v.SetText(adminNamespace)
+	field.AppendElement(v)
+	form.AppendElement(field)
+	return form
+}
+
+func localJIDs(values []string) ([]*xml.JID, error) {
+	var jids []*xml.JID
+	for _, v := range values {
+		jid, err := localJID(v)
+		if err != nil {
+			return nil, err
+		}
+		jids = append(jids, jid)
+	}
+	return jids, nil
+}
+
+func localJID(s string) (*xml.JID, error) {
+	jid, err := xml.NewJIDString(s, false)
+	if err != nil {
+		return nil, xml.ErrJidMalformed
+	}
+	if len(jid.Node()) == 0 || !c2s.Instance().IsLocalDomain(jid.Domain()) {
+		return nil, xml.ErrNotAcceptable
+	}
+	return jid, nil
+}
+
+func value(values map[string][]string, name string) string {
+	if v := values[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
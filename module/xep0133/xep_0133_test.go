@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0133
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/module/xep0050"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0133_Commands(t *testing.T) {
+	admin, _ := xml.NewJID("admin", "jackal.im", "balcony", true)
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	cmds := Commands(&Config{Admins: []string{"admin@jackal.im"}})
+	require.Equal(t, 6, len(cmds))
+	for _, cmd := range cmds {
+		require.True(t, cmd.IsAllowed(admin))
+		require.False(t, cmd.IsAllowed(j))
+	}
+	form := tUtilCommand(cmds, addUserNode).Form()
+	require.NotNil(t, form)
+	require.Equal(t, "form", form.Type())
+	require.Equal(t, 4, len(form.Elements().Children("field")))
+
+	require.Nil(t, tUtilCommand(cmds, getOnlineUsersNumNode).Form())
+}
+
+func TestXEP0133_AddUser(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	cmd := tUtilCommand(Commands(&Config{}), addUserNode)
+
+	_, err := cmd.Execute(map[string][]string{"accountjid": {"ortuman@jackal.im"}})
+	require.Equal(t, xml.ErrBadRequest, err)
+
+	values := map[string][]string{
+		"accountjid":      {"ortuman@example.org"},
+		"password":        {"1234"},
+		"password-verify": {"1234"},
+	}
+	_, err = cmd.Execute(values)
+	require.Equal(t, xml.ErrNotAcceptable, err)
+
+	values["accountjid"] = []string{"ortuman@jackal.im"}
+	values["password-verify"] = []string{"4321"}
+	_, err = cmd.Execute(values)
+	require.Equal(t, xml.ErrNotAcceptable, err)
+
+	values["password-verify"] = []string{"1234"}
+	_, err = cmd.Execute(values)
+	require.Nil(t, err)
+
+	user, _ := storage.Instance().FetchUser("ortuman")
+	require.NotNil(t, user)
+	require.Equal(t, "1234", user.Password)
+
+	_, err = cmd.Execute(values)
+	require.Equal(t, xml.ErrConflict, err)
+}
+
+func TestXEP0133_DeleteUserAndChangePassword(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+
+	cmds := Commands(&Config{})
+
+	changePassword := tUtilCommand(cmds, changeUserPasswordNode)
+	_, err := changePassword.Execute(map[string][]string{"accountjid": {"juliet@jackal.im"}, "password": {"4321"}})
+	require.Equal(t, xml.ErrItemNotFound, err)
+
+	_, err = changePassword.Execute(map[string][]string{"accountjid": {"ortuman@jackal.im"}, "password": {"4321"}})
+	require.Nil(t, err)
+	user, _ := storage.Instance().FetchUser("ortuman")
+	require.Equal(t, "4321", user.Password)
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().AuthenticateStream(stm)
+
+	deleteUser := tUtilCommand(cmds, deleteUserNode)
+	_, err = deleteUser.Execute(map[string][]string{"accountjids": {"ortuman@jackal.im"}})
+	require.Nil(t, err)
+	require.True(t, stm.IsDisconnected())
+
+	exists, _ := storage.Instance().UserExists("ortuman")
+	require.False(t, exists)
+}
+
+func TestXEP0133_OnlineUsersAndEndSession(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	c2s.Instance().RegisterStream(stm1)
+	c2s.Instance().AuthenticateStream(stm1)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	cmds := Commands(&Config{})
+
+	result, err := tUtilCommand(cmds, getOnlineUsersNumNode).Execute(nil)
+	require.Nil(t, err)
+	require.Equal(t, "result", result.Type())
+	fields := result.Elements().Children("field")
+	require.Equal(t, 2, len(fields))
+	require.Equal(t, "onlineusersnum", fields[1].Attributes().Get("var"))
+	require.Equal(t, "1", fields[1].Elements().Child("value").Text())
+
+	endSession := tUtilCommand(cmds, endUserSessionNode)
+	_, err = endSession.Execute(map[string][]string{"accountjids": {"ortuman@jackal.im/garden"}})
+	require.Nil(t, err)
+	require.False(t, stm1.IsDisconnected())
+	require.True(t, stm2.IsDisconnected())
+	c2s.Instance().UnregisterStream(stm2)
+
+	_, err = endSession.Execute(map[string][]string{"accountjids": {"ortuman@jackal.im"}})
+	require.Nil(t, err)
+	require.True(t, stm1.IsDisconnected())
+}
+
+func TestXEP0133_Announce(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	c2s.Instance().RegisterStream(stm1)
+	c2s.Instance().AuthenticateStream(stm1)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	cmd := tUtilCommand(Commands(&Config{}), announceNode)
+
+	_, err := cmd.Execute(map[string][]string{"subject": {"Maintenance"}})
+	require.Equal(t, xml.ErrBadRequest, err)
+
+	values := map[string][]string{
+		"subject":      {"Maintenance"},
+		"announcement": {"Server will restart", "at 10:00 UTC"},
+	}
+	_, err = cmd.Execute(values)
+	require.Nil(t, err)
+
+	for _, stm := range []*c2s.MockStream{stm1, stm2} {
+		elem := stm.FetchElement()
+		require.Equal(t, "message", elem.Name())
+		require.Equal(t, "jackal.im", elem.From())
+		require.Equal(t, stm.JID().String(), elem.To())
+		require.Equal(t, "Maintenance", elem.Elements().Child("subject").Text())
+		require.Equal(t, "Server will restart\nat 10:00 UTC", elem.Elements().Child("body").Text())
+	}
+}
+
+func tUtilCommand(cmds []xep0050.Command, node string) xep0050.Command {
+	for _, cmd := range cmds {
+		if cmd.Node() == node {
+			return cmd
+		}
+	}
+	return nil
+}
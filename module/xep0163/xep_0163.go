@@ -0,0 +1,577 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0163
+
+import (
+	"github.com/ortuman/jackal/module/roster"
+	"github.com/ortuman/jackal/module/xep0048"
+	"github.com/ortuman/jackal/router"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	pubSubNamespace      = "http://jabber.org/protocol/pubsub"
+	pubSubOwnerNamespace = "http://jabber.org/protocol/pubsub#owner"
+	pubSubEventNamespace = "http://jabber.org/protocol/pubsub#event"
+	dataFormNamespace    = "jabber:x:data"
+)
+
+const accessModelField = "pubsub#access_model"
+
+// supported node access models
+const (
+	AccessModelOpen      = "open"
+	AccessModelPresence  = "presence"
+	AccessModelRoster    = "roster"
+	AccessModelWhitelist = "whitelist"
+)
+
+// multiItemNodes keeps every published item instead of just the last one.
+var multiItemNodes = map[string]bool{
+	xep0048.NodeNamespace: true,
+}
+
+// XEPPep represents a personal eventing protocol server stream module.
+type XEPPep struct {
+	stm c2s.Stream
+}
+
+// New returns a personal eventing protocol IQ handler module.
+func New(stm c2s.Stream) *XEPPep {
+	return &XEPPep{stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with personal eventing protocol module.
+func (x *XEPPep) AssociatedNamespaces() []string {
+	return []string{
+		pubSubNamespace,
+		pubSubNamespace + "#access-open",
+		pubSubNamespace + "#access-presence",
+		pubSubNamespace + "#access-roster",
+		pubSubNamespace + "#access-whitelist",
+		pubSubNamespace + "#auto-create",
+		pubSubNamespace + "#create-nodes",
+		pubSubNamespace + "#delete-nodes",
+		pubSubNamespace + "#publish",
+		pubSubNamespace + "#retract-items",
+		pubSubNamespace + "#retrieve-items",
+	}
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the personal eventing protocol module.
+func (x *XEPPep) MatchesIQ(iq *xml.IQ) bool {
+	return iq.Elements().ChildNamespace("pubsub", pubSubNamespace) != nil ||
+		iq.Elements().ChildNamespace("pubsub", pubSubOwnerNamespace) != nil
+}
+
+// ProcessIQ processes a pubsub IQ taking according actions
+// over the associated stream.
+func (x *XEPPep) ProcessIQ(iq *xml.IQ) {
+	host := iq.ToJID().ToBareJID()
+	if host.IsServer() {
+		// no explicit destination... addressing user's own PEP service
+		host = x.stm.JID().ToBareJID()
+	}
+	if owner := iq.Elements().ChildNamespace("pubsub", pubSubOwnerNamespace); owner != nil {
+		x.processOwnerIQ(iq, host, owner)
+		return
+	}
+	pubSub := iq.Elements().ChildNamespace("pubsub", pubSubNamespace)
+	if iq.IsGet() {
+		if items := pubSub.Elements().Child("items"); items != nil {
+			x.sendItems(iq, host, items)
+			return
+		}
+		x.stm.SendElement(iq.FeatureNotImplementedError())
+		return
+	}
+	if !iq.IsSet() {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	if !x.isOwner(host) {
+		x.stm.SendElement(iq.ForbiddenError())
+		return
+	}
+	e := pubSub.Elements()
+	switch {
+	case e.Child("publish") != nil:
+		x.publish(iq, host, e.Child("publish"), e.Child("publish-options"))
+	case e.Child("retract") != nil:
+		x.retract(iq, host, e.Child("retract"))
+	case e.Child("create") != nil:
+		x.create(iq, host, e.Child("create"), e.Child("configure"))
+	default:
+		x.stm.SendElement(iq.FeatureNotImplementedError())
+	}
+}
+
+// DeliverLastItems sends the last published item of every PEP node
+// the stream's user has access to, including its own ones.
+func (x *XEPPep) DeliverLastItems() {
+	userJID := x.stm.JID().ToBareJID()
+	nodes, err := storage.Instance().FetchPubSubNodes(userJID.String())
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	if err := x.sendLastItems(userJID, x.stm.JID(), nodes); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	ris, _, err := storage.Instance().FetchRosterItems(x.stm.Username())
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	for _, ri := range ris {
+		if ri.Subscription != roster.SubscriptionTo && ri.Subscription != roster.SubscriptionBoth {
+			continue
+		}
+		host, err := xml.NewJIDString(ri.JID, true)
+		if err != nil || !c2s.Instance().IsLocalDomain(host.Domain()) {
+			continue
+		}
+		hostNodes, err := storage.Instance().FetchPubSubNodes(host.String())
+		if err != nil {
+			c2s.Logger(x.stm).Error(err)
+			return
+		}
+		var allowedNodes []model.PubSubNode
+		for i := range hostNodes {
+			allowed, err := x.isAccessAllowed(&hostNodes[i], userJID)
+			if err != nil {
+				c2s.Logger(x.stm).Error(err)
+				return
+			}
+			if allowed {
+				allowedNodes = append(allowedNodes, hostNodes[i])
+			}
+		}
+		if err := x.sendLastItems(host, x.stm.JID(), allowedNodes); err != nil {
+			c2s.Logger(x.stm).Error(err)
+			return
+		}
+	}
+}
+
+// DeliverLastItemsTo sends the last published item of every stream's user
+// PEP node to a contact whose presence subscription has just been approved.
+func (x *XEPPep) DeliverLastItemsTo(contact *xml.JID) {
+	userJID := x.stm.JID().ToBareJID()
+	if !c2s.Instance().IsLocalDomain(contact.Domain()) {
+		return
+	}
+	userNodes, err := storage.Instance().FetchPubSubNodes(userJID.String())
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	// an approved subscription grants access to every non whitelisted node
+	var nodes []model.PubSubNode
+	for _, node := range userNodes {
+		if node.AccessModel != AccessModelWhitelist {
+			nodes = append(nodes, node)
+		}
+	}
+	for _, stm := range c2s.Instance().StreamsMatchingJID(contact.ToBareJID()) {
+		if err := x.sendLastItems(userJID, stm.JID(), nodes); err != nil {
+			c2s.Logger(x.stm).Error(err)
+			return
+		}
+	}
+}
+
+func (x *XEPPep) processOwnerIQ(iq *xml.IQ, host *xml.JID, owner xml.XElement) {
+	if !x.isOwner(host) {
+		x.stm.SendElement(iq.ForbiddenError())
+		return
+	}
+	del := owner.Elements().Child("delete")
+	if !iq.IsSet() || del == nil {
+		x.stm.SendElement(iq.FeatureNotImplementedError())
+		return
+	}
+	nodeName := del.Attributes().Get("node")
+	if len(nodeName) == 0 {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	node, err := storage.Instance().FetchPubSubNode(host.String(), nodeName)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if node == nil {
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	if err := storage.Instance().DeletePubSubNode(host.String(), nodeName); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.stm.SendElement(iq.ResultIQ())
+
+	delEvent := xml.NewElementName("delete")
+	delEvent.SetAttribute("node", nodeName)
+	x.notify(node, host, delEvent)
+}
+
+func (x *XEPPep) create(iq *xml.IQ, host *xml.JID, create, configure xml.XElement) {
+	nodeName := create.Attributes().Get("node")
+	if len(nodeName) == 0 {
+		// instant nodes are not supported by PEP services
+		x.stm.SendElement(iq.NotAcceptableError())
+		return
+	}
+	accessModel, ok := x.extractAccessModel(configure)
+	if !ok {
+		x.stm.SendElement(iq.NotAcceptableError())
+		return
+	}
+	node, err := storage.Instance().FetchPubSubNode(host.String(), nodeName)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if node != nil {
+		x.stm.SendElement(iq.ConflictError())
+		return
+	}
+	node = &model.PubSubNode{Host: host.String(), Name: nodeName, AccessModel: accessModel}
+	if err := storage.Instance().InsertOrUpdatePubSubNode(node); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.stm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPPep) publish(iq *xml.IQ, host *xml.JID, publish, publishOptions xml.XElement) {
+	nodeName := publish.Attributes().Get("node")
+	item := publish.Elements().Child("item")
+	if len(nodeName) == 0 || item == nil || item.Elements().Count() != 1 {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	if nodeName == xep0048.NodeNamespace {
+		// native bookmarks are keyed by room JID
+		if _, err := xep0048.ParseConference(item.ID(), item.Elements().All()[0]); err != nil {
+			x.stm.SendElement(iq.BadRequestError())
+			return
+		}
+	}
+	node, err := storage.Instance().FetchPubSubNode(host.String(), nodeName)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if node == nil {
+		// auto-create node on first publication
+		accessModel, ok := x.extractAccessModel(publishOptions)
+		if !ok {
+			x.stm.SendElement(iq.NotAcceptableError())
+			return
+		}
+		node = &model.PubSubNode{Host: host.String(), Name: nodeName, AccessModel: accessModel}
+		if err := storage.Instance().InsertOrUpdatePubSubNode(node); err != nil {
+			c2s.Logger(x.stm).Error(err)
+			x.stm.SendElement(iq.InternalServerError())
+			return
+		}
+	}
+	itemID := item.ID()
+	if len(itemID) == 0 {
+		itemID = uuid.New()
+	}
+	if err := x.replaceItem(node, &model.PubSubItem{
+		ID:        itemID,
+		Publisher: x.stm.JID().ToBareJID().String(),
+		Payload:   item.Elements().All()[0],
+	}); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	published := xml.NewElementName("item")
+	published.SetID(itemID)
+	publishRes := xml.NewElementName("publish")
+	publishRes.SetAttribute("node", nodeName)
+	publishRes.AppendElement(published)
+	pubSubRes := xml.NewElementNamespace("pubsub", pubSubNamespace)
+	pubSubRes.AppendElement(publishRes)
+
+	reply := iq.ResultIQ()
+	reply.AppendElement(pubSubRes)
+	x.stm.SendElement(reply)
+
+	eventItem := xml.NewElementName("item")
+	eventItem.SetID(itemID)
+	eventItem.AppendElements(item.Elements().All())
+	items := xml.NewElementName("items")
+	items.SetAttribute("node", nodeName)
+	items.AppendElement(eventItem)
+	x.notify(node, host, items)
+}
+
+func (x *XEPPep) retract(iq *xml.IQ, host *xml.JID, retract xml.XElement) {
+	nodeName := retract.Attributes().Get("node")
+	item := retract.Elements().Child("item")
+	if len(nodeName) == 0 || item == nil || len(item.ID()) == 0 {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	node, err := storage.Instance().FetchPubSubNode(host.String(), nodeName)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if node == nil {
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	if err := storage.Instance().DeletePubSubItem(host.String(), nodeName, item.ID()); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.stm.SendElement(iq.ResultIQ())
+
+	if notify := retract.Attributes().Get("notify"); notify == "true" || notify == "1" {
+		retracted := xml.NewElementName("retract")
+		retracted.SetID(item.ID())
+		items := xml.NewElementName("items")
+		items.SetAttribute("node", nodeName)
+		items.AppendElement(retracted)
+		x.notify(node, host, items)
+	}
+}
+
+func (x *XEPPep) sendItems(iq *xml.IQ, host *xml.JID, items xml.XElement) {
+	nodeName := items.Attributes().Get("node")
+	if len(nodeName) == 0 {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	node, err := storage.Instance().FetchPubSubNode(host.String(), nodeName)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	if node == nil {
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	if !x.isOwner(host) {
+		allowed, err := x.isAccessAllowed(node, x.stm.JID().ToBareJID())
+		if err != nil {
+			c2s.Logger(x.stm).Error(err)
+			x.stm.SendElement(iq.InternalServerError())
+			return
+		}
+		if !allowed {
+			x.stm.SendElement(iq.NotAuthorizedError())
+			return
+		}
+	}
+	nodeItems, err := storage.Instance().FetchPubSubItems(host.String(), nodeName)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	// filter by requested item identifiers
+	requested := map[string]bool{}
+	for _, reqItem := range items.Elements().Children("item") {
+		requested[reqItem.ID()] = true
+	}
+	itemsRes := xml.NewElementName("items")
+	itemsRes.SetAttribute("node", nodeName)
+	for _, nodeItem := range nodeItems {
+		if len(requested) > 0 && !requested[nodeItem.ID] {
+			continue
+		}
+		itemElem := xml.NewElementName("item")
+		itemElem.SetID(nodeItem.ID)
+		itemElem.AppendElement(nodeItem.Payload)
+		itemsRes.AppendElement(itemElem)
+	}
+	pubSubRes := xml.NewElementNamespace("pubsub", pubSubNamespace)
+	pubSubRes.AppendElement(itemsRes)
+
+	reply := iq.ResultIQ()
+	reply.AppendElement(pubSubRes)
+	x.stm.SendElement(reply)
+}
+
+func (x *XEPPep) replaceItem(node *model.PubSubNode, item *model.PubSubItem) error {
+	if multiItemNodes[node.Name] {
+		return storage.Instance().InsertOrUpdatePubSubItem(node.Host, node.Name, item)
+	}
+	// PEP nodes keep a single item (max_items = 1)
+	items, err := storage.Instance().FetchPubSubItems(node.Host, node.Name)
+	if err != nil {
+		return err
+	}
+	for _, it := range items {
+		if it.ID == item.ID {
+			continue
+		}
+		if err := storage.Instance().DeletePubSubItem(node.Host, node.Name, it.ID); err != nil {
+			return err
+		}
+	}
+	return storage.Instance().InsertOrUpdatePubSubItem(node.Host, node.Name, item)
+}
+
+func (x *XEPPep) notify(node *model.PubSubNode, host *xml.JID, eventPayload xml.XElement) {
+	// owner resources always get notified
+	recipients := []*xml.JID{host}
+	if node.AccessModel == AccessModelWhitelist {
+		x.sendEvents(host, recipients, eventPayload)
+		return
+	}
+	ris, _, err := storage.Instance().FetchRosterItems(host.Node())
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	for _, ri := range ris {
+		if !x.isSubscribedFrom(&ri) {
+			continue
+		}
+		j, err := xml.NewJIDString(ri.JID, true)
+		if err != nil {
+			continue
+		}
+		recipients = append(recipients, j)
+	}
+	x.sendEvents(host, recipients, eventPayload)
+}
+
+func (x *XEPPep) sendEvents(host *xml.JID, recipients []*xml.JID, eventPayload xml.XElement) {
+	for _, recipient := range recipients {
+		stms := c2s.Instance().StreamsMatchingJID(recipient)
+		for _, stm := range stms {
+			x.sendEvent(host, stm.JID(), eventPayload)
+		}
+	}
+}
+
+func (x *XEPPep) sendLastItems(host, to *xml.JID, nodes []model.PubSubNode) error {
+	for _, node := range nodes {
+		items, err := storage.Instance().FetchPubSubItems(node.Host, node.Name)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			continue
+		}
+		lastItem := items[len(items)-1]
+
+		itemElem := xml.NewElementName("item")
+		itemElem.SetID(lastItem.ID)
+		itemElem.AppendElement(lastItem.Payload)
+		itemsElem := xml.NewElementName("items")
+		itemsElem.SetAttribute("node", node.Name)
+		itemsElem.AppendElement(itemElem)
+		x.sendEvent(host, to, itemsElem)
+	}
+	return nil
+}
+
+func (x *XEPPep) sendEvent(from, to *xml.JID, eventPayload xml.XElement) {
+	// publisher might be blocking the recipient as well
+	if c2s.Instance().IsBlockedJID(to, from.Node()) {
+		return
+	}
+	event := xml.NewElementNamespace("event", pubSubEventNamespace)
+	event.AppendElement(eventPayload)
+
+	msg := xml.NewMessageType(uuid.New(), xml.HeadlineType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	msg.AppendElement(event)
+
+	switch err := c2s.Instance().Route(msg); err {
+	case nil, router.ErrDropped, c2s.ErrBlockedJID, c2s.ErrNotAuthenticated, c2s.ErrResourceNotFound:
+		break
+	default:
+		c2s.Logger(x.stm).Error(err)
+	}
+}
+
+func (x *XEPPep) isAccessAllowed(node *model.PubSubNode, jid *xml.JID) (bool, error) {
+	if node.AccessModel == AccessModelOpen {
+		return true, nil
+	}
+	host, err := xml.NewJIDString(node.Host, true)
+	if err != nil {
+		return false, err
+	}
+	ris, _, err := storage.Instance().FetchRosterItems(host.Node())
+	if err != nil {
+		return false, err
+	}
+	for _, ri := range ris {
+		if ri.JID != jid.String() {
+			continue
+		}
+		switch node.AccessModel {
+		case AccessModelWhitelist:
+			return false, nil
+		case AccessModelPresence:
+			return x.isSubscribedFrom(&ri), nil
+		case AccessModelRoster:
+			return ri.Subscription != roster.SubscriptionRemove, nil
+		}
+	}
+	return false, nil
+}
+
+func (x *XEPPep) isSubscribedFrom(ri *model.RosterItem) bool {
+	return ri.Subscription == roster.SubscriptionFrom || ri.Subscription == roster.SubscriptionBoth
+}
+
+func (x *XEPPep) isOwner(host *xml.JID) bool {
+	return host.Node() == x.stm.Username() && host.Domain() == x.stm.Domain()
+}
+
+func (x *XEPPep) extractAccessModel(form xml.XElement) (string, bool) {
+	accessModel := AccessModelPresence
+	if form == nil {
+		return accessModel, true
+	}
+	xForm := form.Elements().ChildNamespace("x", dataFormNamespace)
+	if xForm == nil {
+		return accessModel, true
+	}
+	for _, field := range xForm.Elements().Children("field") {
+		if field.Attributes().Get("var") != accessModelField {
+			continue
+		}
+		if v := field.Elements().Child("value"); v != nil {
+			accessModel = v.Text()
+		}
+	}
+	switch accessModel {
+	case AccessModelOpen, AccessModelPresence, AccessModelRoster, AccessModelWhitelist:
+		return accessModel, true
+	}
+	return "", false
+}
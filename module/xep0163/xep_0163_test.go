@@ -0,0 +1,455 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0163
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/module/xep0048"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+const geolocNamespace = "http://jabber.org/protocol/geoloc"
+
+func TestXEP0163_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := New(nil)
+	require.Equal(t, pubSubNamespace, x.AssociatedNamespaces()[0])
+
+	iq1 := xml.NewIQType(uuid.New(), xml.SetType)
+	iq1.SetFromJID(j)
+	iq1.SetToJID(j.ToBareJID())
+	iq1.AppendElement(xml.NewElementNamespace("pubsub", pubSubNamespace))
+	require.True(t, x.MatchesIQ(iq1))
+
+	iq2 := xml.NewIQType(uuid.New(), xml.SetType)
+	iq2.SetFromJID(j)
+	iq2.SetToJID(j.ToBareJID())
+	iq2.AppendElement(xml.NewElementNamespace("pubsub", pubSubOwnerNamespace))
+	require.True(t, x.MatchesIQ(iq2))
+
+	iq3 := xml.NewIQType(uuid.New(), xml.GetType)
+	iq3.SetFromJID(j)
+	iq3.SetToJID(j.ToBareJID())
+	iq3.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
+	require.False(t, x.MatchesIQ(iq3))
+}
+
+func TestXEP0163_Publish(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1 := tUtilStreamInit("ortuman", "balcony")
+	stm2 := tUtilStreamInit("noelia", "garden")
+	stm3 := tUtilStreamInit("romeo", "jail")
+
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "noelia@jackal.im",
+		Subscription: "both",
+	})
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "romeo@jackal.im",
+		Subscription: "to",
+	})
+	x := New(stm1)
+
+	// bad request... missing payload
+	iq := tUtilPublishIQ(stm1.JID(), "", nil)
+	x.ProcessIQ(iq)
+	elem := stm1.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	storage.ActivateMockedError()
+	x.ProcessIQ(tUtilPublishIQ(stm1.JID(), "i1", xml.NewElementNamespace("geoloc", geolocNamespace)))
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements().All()[0].Name())
+	storage.DeactivateMockedError()
+
+	x.ProcessIQ(tUtilPublishIQ(stm1.JID(), "i1", xml.NewElementNamespace("geoloc", geolocNamespace)))
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, "i1", elem.Elements().Child("pubsub").Elements().Child("publish").Elements().Child("item").ID())
+
+	// owner and presence subscribed contacts get notified
+	for _, stm := range []*c2s.MockStream{stm1, stm2} {
+		elem = stm.FetchElement()
+		require.Equal(t, "message", elem.Name())
+		require.Equal(t, "ortuman@jackal.im", elem.From())
+		event := elem.Elements().ChildNamespace("event", pubSubEventNamespace)
+		require.NotNil(t, event)
+		items := event.Elements().Child("items")
+		require.Equal(t, geolocNamespace, items.Attributes().Get("node"))
+		require.NotNil(t, items.Elements().Child("item").Elements().ChildNamespace("geoloc", geolocNamespace))
+	}
+	elem = stm3.FetchElement()
+	require.Equal(t, "", elem.Name())
+
+	node, _ := storage.Instance().FetchPubSubNode("ortuman@jackal.im", geolocNamespace)
+	require.NotNil(t, node)
+	require.Equal(t, AccessModelPresence, node.AccessModel)
+
+	// a new publication replaces previous item
+	x.ProcessIQ(tUtilPublishIQ(stm1.JID(), "i2", xml.NewElementNamespace("geoloc", geolocNamespace)))
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	items, _ := storage.Instance().FetchPubSubItems("ortuman@jackal.im", geolocNamespace)
+	require.Equal(t, 1, len(items))
+	require.Equal(t, "i2", items[0].ID)
+
+	// only owner can publish
+	iq = tUtilPublishIQ(stm1.JID(), "i3", xml.NewElementNamespace("geoloc", geolocNamespace))
+	iq.SetFromJID(stm2.JID())
+	New(stm2).ProcessIQ(iq)
+	elem = stm2.FetchElement()
+	require.Equal(t, "message", elem.Name()) // pending notification
+	elem = stm2.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func TestXEP0163_AccessModel(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1 := tUtilStreamInit("noelia", "garden")
+	stm2 := tUtilStreamInit("romeo", "jail")
+
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "noelia@jackal.im",
+		Subscription: "from",
+	})
+	storage.Instance().InsertOrUpdatePubSubNode(&model.PubSubNode{
+		Host:        "ortuman@jackal.im",
+		Name:        geolocNamespace,
+		AccessModel: AccessModelPresence,
+	})
+	storage.Instance().InsertOrUpdatePubSubItem("ortuman@jackal.im", geolocNamespace, &model.PubSubItem{
+		ID:        "i1",
+		Publisher: "ortuman@jackal.im",
+		Payload:   xml.NewElementNamespace("geoloc", geolocNamespace),
+	})
+	owner, _ := xml.NewJID("ortuman", "jackal.im", "", true)
+
+	New(stm1).ProcessIQ(tUtilItemsIQ(stm1.JID(), owner, geolocNamespace))
+	elem := stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	items := elem.Elements().Child("pubsub").Elements().Child("items")
+	require.Equal(t, 1, len(items.Elements().Children("item")))
+	require.Equal(t, "i1", items.Elements().Child("item").ID())
+
+	// not subscribed to owner's presence
+	New(stm2).ProcessIQ(tUtilItemsIQ(stm2.JID(), owner, geolocNamespace))
+	elem = stm2.FetchElement()
+	require.Equal(t, xml.ErrNotAuthorized.Error(), elem.Error().Elements().All()[0].Name())
+
+	storage.Instance().InsertOrUpdatePubSubNode(&model.PubSubNode{
+		Host:        "ortuman@jackal.im",
+		Name:        geolocNamespace,
+		AccessModel: AccessModelOpen,
+	})
+	New(stm2).ProcessIQ(tUtilItemsIQ(stm2.JID(), owner, geolocNamespace))
+	elem = stm2.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	New(stm2).ProcessIQ(tUtilItemsIQ(stm2.JID(), owner, "urn:xmpp:avatar:data"))
+	elem = stm2.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func TestXEP0163_CreateAndDelete(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm := tUtilStreamInit("ortuman", "balcony")
+	x := New(stm)
+
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", accessModelField)
+	value := xml.NewElementName("value")
+	value.SetText(AccessModelRoster)
+	field.AppendElement(value)
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "submit")
+	form.AppendElement(field)
+	configure := xml.NewElementName("configure")
+	configure.AppendElement(form)
+
+	create := xml.NewElementName("create")
+	create.SetAttribute("node", geolocNamespace)
+	pubSub := xml.NewElementNamespace("pubsub", pubSubNamespace)
+	pubSub.AppendElement(create)
+	pubSub.AppendElement(configure)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(stm.JID())
+	iq.SetToJID(stm.JID().ToBareJID())
+	iq.AppendElement(pubSub)
+
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	node, _ := storage.Instance().FetchPubSubNode("ortuman@jackal.im", geolocNamespace)
+	require.NotNil(t, node)
+	require.Equal(t, AccessModelRoster, node.AccessModel)
+
+	// already existing node
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrConflict.Error(), elem.Error().Elements().All()[0].Name())
+
+	del := xml.NewElementName("delete")
+	del.SetAttribute("node", geolocNamespace)
+	pubSubOwner := xml.NewElementNamespace("pubsub", pubSubOwnerNamespace)
+	pubSubOwner.AppendElement(del)
+
+	iq = xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(stm.JID())
+	iq.SetToJID(stm.JID().ToBareJID())
+	iq.AppendElement(pubSubOwner)
+
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	elem = stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.NotNil(t, elem.Elements().ChildNamespace("event", pubSubEventNamespace).Elements().Child("delete"))
+
+	node, _ = storage.Instance().FetchPubSubNode("ortuman@jackal.im", geolocNamespace)
+	require.Nil(t, node)
+
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func TestXEP0163_BlockedNotifications(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1 := tUtilStreamInit("ortuman", "balcony")
+	stm2 := tUtilStreamInit("noelia", "garden")
+	stm3 := tUtilStreamInit("romeo", "jail")
+
+	for _, contact := range []string{"noelia@jackal.im", "romeo@jackal.im"} {
+		storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+			Username:     "ortuman",
+			JID:          contact,
+			Subscription: "from",
+		})
+	}
+	// contact blocking the publisher... and publisher blocking a contact
+	storage.Instance().InsertOrUpdateBlockListItems([]model.BlockListItem{
+		{Username: "noelia", JID: "ortuman@jackal.im"},
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+	})
+	x := New(stm1)
+
+	x.ProcessIQ(tUtilPublishIQ(stm1.JID(), "i1", xml.NewElementNamespace("geoloc", geolocNamespace)))
+	elem := stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	elem = stm1.FetchElement()
+	require.Equal(t, "message", elem.Name())
+
+	require.Equal(t, "", stm2.FetchElement().Name())
+	require.Equal(t, "", stm3.FetchElement().Name())
+}
+
+func TestXEP0163_DeliverLastItems(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1 := tUtilStreamInit("ortuman", "balcony")
+	stm2 := tUtilStreamInit("noelia", "garden")
+
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "noelia",
+		JID:          "ortuman@jackal.im",
+		Subscription: "to",
+	})
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "noelia@jackal.im",
+		Subscription: "from",
+	})
+	for _, n := range []model.PubSubNode{
+		{Host: "ortuman@jackal.im", Name: geolocNamespace, AccessModel: AccessModelPresence},
+		{Host: "ortuman@jackal.im", Name: "urn:xmpp:avatar:data", AccessModel: AccessModelRoster},
+		{Host: "noelia@jackal.im", Name: "urn:xmpp:avatar:data", AccessModel: AccessModelPresence},
+	} {
+		node := n
+		storage.Instance().InsertOrUpdatePubSubNode(&node)
+	}
+	storage.Instance().InsertOrUpdatePubSubItem("ortuman@jackal.im", geolocNamespace, &model.PubSubItem{
+		ID:        "i1",
+		Publisher: "ortuman@jackal.im",
+		Payload:   xml.NewElementNamespace("geoloc", geolocNamespace),
+	})
+	storage.Instance().InsertOrUpdatePubSubItem("noelia@jackal.im", "urn:xmpp:avatar:data", &model.PubSubItem{
+		ID:        "i2",
+		Publisher: "noelia@jackal.im",
+		Payload:   xml.NewElementName("data"),
+	})
+
+	// initial presence... own and subscribed contacts last items
+	New(stm2).DeliverLastItems()
+	elem := stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "noelia@jackal.im", elem.From())
+	require.Equal(t, "noelia@jackal.im/garden", elem.To())
+	elem = stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "ortuman@jackal.im", elem.From())
+	items := elem.Elements().ChildNamespace("event", pubSubEventNamespace).Elements().Child("items")
+	require.Equal(t, geolocNamespace, items.Attributes().Get("node"))
+	require.Equal(t, "i1", items.Elements().Child("item").ID())
+	require.Equal(t, "", stm2.FetchElement().Name())
+
+	// not subscribed to contact's presence
+	New(stm1).DeliverLastItems()
+	elem = stm1.FetchElement()
+	require.Equal(t, "ortuman@jackal.im", elem.From())
+	require.Equal(t, "", stm1.FetchElement().Name())
+
+	// presence subscription approval
+	New(stm1).DeliverLastItemsTo(stm2.JID().ToBareJID())
+	elem = stm2.FetchElement()
+	require.Equal(t, "ortuman@jackal.im", elem.From())
+	require.Equal(t, "", stm1.FetchElement().Name())
+	require.Equal(t, "", stm2.FetchElement().Name())
+
+	// blocked contact
+	storage.Instance().InsertOrUpdateBlockListItems([]model.BlockListItem{{Username: "noelia", JID: "ortuman@jackal.im"}})
+	c2s.Instance().ReloadBlockList("noelia")
+	New(stm1).DeliverLastItemsTo(stm2.JID().ToBareJID())
+	require.Equal(t, "", stm2.FetchElement().Name())
+}
+
+func TestXEP0163_Bookmarks(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1 := tUtilStreamInit("ortuman", "balcony")
+	stm2 := tUtilStreamInit("noelia", "garden")
+
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "noelia@jackal.im",
+		Subscription: "both",
+	})
+	storage.Instance().InsertOrUpdatePubSubNode(&model.PubSubNode{
+		Host:        "ortuman@jackal.im",
+		Name:        xep0048.NodeNamespace,
+		AccessModel: AccessModelWhitelist,
+	})
+	x := New(stm1)
+
+	// bookmarks must be keyed by room JID
+	conf := xml.NewElementNamespace("conference", xep0048.NodeNamespace)
+	conf.SetAttribute("autojoin", "true")
+	x.ProcessIQ(tUtilPublishNodeIQ(stm1.JID(), xep0048.NodeNamespace, "", conf))
+	elem := stm1.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	x.ProcessIQ(tUtilPublishNodeIQ(stm1.JID(), xep0048.NodeNamespace, "room1@conference.jackal.im", conf))
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	elem = stm1.FetchElement()
+	require.Equal(t, "message", elem.Name())
+
+	x.ProcessIQ(tUtilPublishNodeIQ(stm1.JID(), xep0048.NodeNamespace, "room2@conference.jackal.im", conf))
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	elem = stm1.FetchElement()
+	require.Equal(t, "message", elem.Name())
+
+	// every bookmark is kept
+	items, _ := storage.Instance().FetchPubSubItems("ortuman@jackal.im", xep0048.NodeNamespace)
+	require.Equal(t, 2, len(items))
+
+	// whitelisted nodes are private to its owner
+	elem = stm2.FetchElement()
+	require.Equal(t, "", elem.Name())
+
+	New(stm2).ProcessIQ(tUtilItemsIQ(stm2.JID(), stm1.JID().ToBareJID(), xep0048.NodeNamespace))
+	elem = stm2.FetchElement()
+	require.Equal(t, xml.ErrNotAuthorized.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func tUtilStreamInit(username, resource string) *c2s.MockStream {
+	j, _ := xml.NewJID(username, "jackal.im", resource, true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	stm.SetAuthenticated(true)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().AuthenticateStream(stm)
+	return stm
+}
+
+func tUtilPublishIQ(from *xml.JID, itemID string, payload xml.XElement) *xml.IQ {
+	return tUtilPublishNodeIQ(from, geolocNamespace, itemID, payload)
+}
+
+func tUtilPublishNodeIQ(from *xml.JID, node, itemID string, payload xml.XElement) *xml.IQ {
+	item := xml.NewElementName("item")
+	if len(itemID) > 0 {
+		item.SetID(itemID)
+	}
+	if payload != nil {
+		item.AppendElement(payload)
+	}
+	publish := xml.NewElementName("publish")
+	publish.SetAttribute("node", node)
+	publish.AppendElement(item)
+	pubSub := xml.NewElementNamespace("pubsub", pubSubNamespace)
+	pubSub.AppendElement(publish)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(from)
+	iq.SetToJID(from.ToBareJID())
+	iq.AppendElement(pubSub)
+	return iq
+}
+
+func tUtilItemsIQ(from, to *xml.JID, node string) *xml.IQ {
+	items := xml.NewElementName("items")
+	items.SetAttribute("node", node)
+	pubSub := xml.NewElementNamespace("pubsub", pubSubNamespace)
+	pubSub.AppendElement(items)
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(from)
+	iq.SetToJID(to)
+	iq.AppendElement(pubSub)
+	return iq
+}
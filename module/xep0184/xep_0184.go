@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0184
+
+import (
+	"github.com/ortuman/jackal/router"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const receiptsNamespace = "urn:xmpp:receipts"
+
+// Config represents Message Delivery Receipts module (XEP-0184) configuration.
+type Config struct {
+	OfflineReceipts bool `yaml:"offline_receipts"`
+}
+
+// XEPReceipts represents a message delivery receipts server stream module.
+type XEPReceipts struct {
+	cfg *Config
+	stm c2s.Stream
+}
+
+// New returns a message delivery receipts server stream module.
+func New(config *Config, stm c2s.Stream) *XEPReceipts {
+	return &XEPReceipts{cfg: config, stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with message delivery receipts module.
+func (x *XEPReceipts) AssociatedNamespaces() []string {
+	return []string{receiptsNamespace}
+}
+
+// ProcessSentMessage validates delivery receipts of a message sent by the
+// associated stream, returning the message to be routed.
+// Receipts requesting further receipts are stripped off the request, and
+// those lacking the acknowledged id are stamped with the message id.
+// A receipt request or receipt with no id to echo is bounced with
+// a bad-request error and nil is returned.
+func (x *XEPReceipts) ProcessSentMessage(message *xml.Message) *xml.Message {
+	request := message.Elements().ChildNamespace("request", receiptsNamespace)
+	received := message.Elements().ChildNamespace("received", receiptsNamespace)
+	if request == nil && received == nil {
+		return message
+	}
+	if received == nil {
+		// receipt requests must carry the id to be echoed back
+		if len(message.ID()) == 0 {
+			x.stm.SendElement(message.BadRequestError())
+			return nil
+		}
+		return message
+	}
+	receivedID := received.Attributes().Get("id")
+	if request == nil && len(receivedID) > 0 {
+		return message
+	}
+	if len(receivedID) == 0 && len(message.ID()) == 0 {
+		x.stm.SendElement(message.BadRequestError())
+		return nil
+	}
+	normalized, _ := xml.NewMessageFromElement(message, message.FromJID(), message.ToJID())
+
+	// a receipt must never request another receipt
+	normalized.RemoveElementsNamespace("request", receiptsNamespace)
+
+	if len(receivedID) == 0 {
+		// legacy clients echo the acknowledged id as the message id
+		stamped := xml.NewElementNamespace("received", receiptsNamespace)
+		stamped.SetID(message.ID())
+		normalized.RemoveElementsNamespace("received", receiptsNamespace)
+		normalized.AppendElement(stamped)
+	}
+	return normalized
+}
+
+// ProcessOfflineMessage notifies message sender that a message
+// requesting a delivery receipt has been stored offline, as long
+// as offline receipts are enabled.
+func (x *XEPReceipts) ProcessOfflineMessage(message *xml.Message) {
+	if !x.cfg.OfflineReceipts || !IsReceiptRequested(message) {
+		return
+	}
+	received := xml.NewElementNamespace("received", receiptsNamespace)
+	received.SetID(message.ID())
+
+	receipt := xml.NewMessageType(uuid.New(), message.Type())
+	receipt.SetFromJID(message.ToJID().ToBareJID())
+	receipt.SetToJID(message.FromJID())
+	receipt.AppendElement(received)
+	if err := c2s.Instance().Route(receipt); err != nil && err != router.ErrDropped {
+		c2s.Logger(x.stm).Error(err)
+	}
+}
+
+// IsReceiptRequested returns whether or not a message
+// requests a delivery receipt.
+// Receipts are never requested on receipts nor on error messages.
+func IsReceiptRequested(message *xml.Message) bool {
+	if message.IsError() || len(message.ID()) == 0 {
+		return false
+	}
+	elems := message.Elements()
+	return elems.ChildNamespace("request", receiptsNamespace) != nil &&
+		elems.ChildNamespace("received", receiptsNamespace) == nil
+}
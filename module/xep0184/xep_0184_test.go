@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0184
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0184_SentMessage(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	x := New(&Config{}, stm)
+	require.Equal(t, []string{receiptsNamespace}, x.AssociatedNamespaces())
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	msg.AppendElement(xml.NewElementNamespace("request", receiptsNamespace))
+	require.Equal(t, msg, x.ProcessSentMessage(msg))
+	require.True(t, IsReceiptRequested(msg))
+
+	// receipt echoing acknowledged id
+	received := xml.NewElementNamespace("received", receiptsNamespace)
+	received.SetID(msg.ID())
+	receipt := xml.NewMessageType(uuid.New(), xml.ChatType)
+	receipt.SetFromJID(j2)
+	receipt.SetToJID(j1)
+	receipt.AppendElement(received)
+	require.Equal(t, receipt, x.ProcessSentMessage(receipt))
+	require.False(t, IsReceiptRequested(receipt))
+
+	// receipts never request receipts
+	receipt.AppendElement(xml.NewElementNamespace("request", receiptsNamespace))
+	require.False(t, IsReceiptRequested(receipt))
+	normalized := x.ProcessSentMessage(receipt)
+	require.NotNil(t, normalized)
+	require.Nil(t, normalized.Elements().ChildNamespace("request", receiptsNamespace))
+	require.Equal(t, msg.ID(), normalized.Elements().ChildNamespace("received", receiptsNamespace).ID())
+
+	// legacy receipt gets stamped with message id
+	legacyID := uuid.New()
+	receipt = xml.NewMessageType(legacyID, xml.ChatType)
+	receipt.SetFromJID(j2)
+	receipt.SetToJID(j1)
+	receipt.AppendElement(xml.NewElementNamespace("received", receiptsNamespace))
+	normalized = x.ProcessSentMessage(receipt)
+	require.NotNil(t, normalized)
+	require.Equal(t, legacyID, normalized.Elements().ChildNamespace("received", receiptsNamespace).ID())
+	require.Equal(t, j1.String(), normalized.ToJID().String())
+}
+
+func TestXEP0184_MissingID(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	x := New(&Config{}, stm)
+
+	msg := xml.NewMessageType("", xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementNamespace("request", receiptsNamespace))
+	require.False(t, IsReceiptRequested(msg))
+	require.Nil(t, x.ProcessSentMessage(msg))
+
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	receipt := xml.NewMessageType("", xml.ChatType)
+	receipt.SetFromJID(j1)
+	receipt.SetToJID(j2)
+	receipt.AppendElement(xml.NewElementNamespace("received", receiptsNamespace))
+	require.Nil(t, x.ProcessSentMessage(receipt))
+
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func TestXEP0184_OfflineMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().AuthenticateStream(stm)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	msg.AppendElement(xml.NewElementNamespace("request", receiptsNamespace))
+
+	// offline receipts disabled
+	x := New(&Config{}, stm)
+	x.ProcessOfflineMessage(msg)
+	require.Equal(t, &xml.Element{}, stm.FetchElement())
+
+	x = New(&Config{OfflineReceipts: true}, stm)
+	x.ProcessOfflineMessage(msg)
+
+	elem := stm.FetchElement()
+	require.NotNil(t, elem)
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "juliet@jackal.im", elem.From())
+	require.Equal(t, j1.String(), elem.To())
+	received := elem.Elements().ChildNamespace("received", receiptsNamespace)
+	require.NotNil(t, received)
+	require.Equal(t, msg.ID(), received.ID())
+	require.Nil(t, elem.Elements().ChildNamespace("request", receiptsNamespace))
+}
@@ -6,8 +6,12 @@
 package xep0191
 
 import (
-	"github.com/ortuman/jackal/log"
+	"fmt"
+	"time"
+
 	"github.com/ortuman/jackal/module/roster"
+	"github.com/ortuman/jackal/module/xep0059"
+	"github.com/ortuman/jackal/router"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -17,24 +21,45 @@ import (
 
 const blockingCommandNamespace = "urn:xmpp:blocking"
 
+const reportingNamespace = "urn:xmpp:reporting:1"
+
+const (
+	spamReportReason  = "urn:xmpp:reporting:spam"
+	abuseReportReason = "urn:xmpp:reporting:abuse"
+)
+
 const (
 	xep191RequestedContextKey = "xep_191:requested"
 )
 
+// unblocking presence broadcasts are spread over several batches
+const (
+	presenceBatchSize     = 50
+	presenceBatchInterval = time.Millisecond * 100
+)
+
+// Config represents Blocking Command module (XEP-0191) configuration.
+type Config struct {
+	// ReportJID is the JID spam and abuse reports (XEP-0377) are forwarded to.
+	// Reports are only logged if no JID has been configured.
+	ReportJID string `yaml:"report_jid"`
+}
+
 // XEPBlockingCommand returns a blocking command IQ handler module.
 type XEPBlockingCommand struct {
+	cfg *Config
 	stm c2s.Stream
 }
 
 // New returns a blocking command IQ handler module.
-func New(stm c2s.Stream) *XEPBlockingCommand {
-	return &XEPBlockingCommand{stm: stm}
+func New(config *Config, stm c2s.Stream) *XEPBlockingCommand {
+	return &XEPBlockingCommand{cfg: config, stm: stm}
 }
 
 // AssociatedNamespaces returns namespaces associated
 // with blocking command module.
 func (x *XEPBlockingCommand) AssociatedNamespaces() []string {
-	return []string{blockingCommandNamespace}
+	return []string{blockingCommandNamespace, reportingNamespace}
 }
 
 // MatchesIQ returns whether or not an IQ should be
@@ -63,9 +88,27 @@ func (x *XEPBlockingCommand) ProcessIQ(iq *xml.IQ) {
 }
 
 func (x *XEPBlockingCommand) sendBlockList(iq *xml.IQ) {
-	blItms, err := storage.Instance().FetchBlockListItems(x.stm.Username())
+	var blItms []model.BlockListItem
+	var res *xep0059.Result
+	var err error
+
+	set := iq.Elements().ChildNamespace("blocklist", blockingCommandNamespace).Elements().ChildNamespace("set", xep0059.Namespace)
+	if set != nil {
+		req, parseErr := xep0059.ParseRequest(set)
+		if parseErr != nil {
+			x.stm.SendElement(iq.BadRequestError())
+			return
+		}
+		blItms, res, err = x.fetchBlockListPage(req)
+		if err == xep0059.ErrItemNotFound {
+			x.stm.SendElement(iq.ItemNotFoundError())
+			return
+		}
+	} else {
+		blItms, err = storage.Instance().FetchBlockListItems(x.stm.Username())
+	}
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
@@ -75,6 +118,9 @@ func (x *XEPBlockingCommand) sendBlockList(iq *xml.IQ) {
 		itElem.SetAttribute("jid", blItm.JID)
 		blockList.AppendElement(itElem)
 	}
+	if res != nil {
+		blockList.AppendElement(res.Element())
+	}
 	reply := iq.ResultIQ()
 	reply.AppendElement(blockList)
 	x.stm.SendElement(reply)
@@ -82,6 +128,40 @@ func (x *XEPBlockingCommand) sendBlockList(iq *xml.IQ) {
 	x.stm.Context().SetBool(true, xep191RequestedContextKey)
 }
 
+// fetchBlockListPage returns the block list items page matching a result set request.
+// Pages not relative to any other item are fetched straight from storage.
+func (x *XEPBlockingCommand) fetchBlockListPage(req *xep0059.Request) ([]model.BlockListItem, *xep0059.Result, error) {
+	if len(req.After) == 0 && !req.IsBackwards() {
+		offset := req.Index
+		if offset < 0 {
+			offset = 0
+		}
+		blItms, count, err := storage.Instance().FetchBlockListItemsRange(x.stm.Username(), offset, req.Max)
+		if err != nil {
+			return nil, nil, err
+		}
+		if offset > 0 && offset >= count {
+			return nil, nil, xep0059.ErrItemNotFound
+		}
+		res := &xep0059.Result{Count: count}
+		if len(blItms) > 0 {
+			res.First = blItms[0].JID
+			res.FirstIndex = offset
+			res.Last = blItms[len(blItms)-1].JID
+		}
+		return blItms, res, nil
+	}
+	blItms, err := storage.Instance().FetchBlockListItems(x.stm.Username())
+	if err != nil {
+		return nil, nil, err
+	}
+	from, to, res, err := xep0059.Paginate(blockListItems(blItms), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blItms[from:to], res, nil
+}
+
 func (x *XEPBlockingCommand) block(iq *xml.IQ, block xml.XElement) {
 	var bl []model.BlockListItem
 
@@ -92,28 +172,62 @@ func (x *XEPBlockingCommand) block(iq *xml.IQ, block xml.XElement) {
 	}
 	jds, err := x.extractItemJIDs(items)
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.JidMalformedError())
 		return
 	}
+	rps, err := x.extractItemReports(items, jds)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
 	blItems, ris, err := x.fetchBlockListAndRosterItems()
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
-	for _, j := range jds {
-		if !x.isJIDInBlockList(j, blItems) {
+	var reported []*report
+	for i, j := range jds {
+		if x.blockListItemIndex(j, bl) != -1 {
+			continue
+		}
+		if k := x.blockListItemIndex(j, blItems); k != -1 {
+			// already blocked JIDs can still be reported
+			if rps[i] != nil && blItems[k].Reason != rps[i].reason {
+				blItem := blItems[k]
+				blItem.Reason = rps[i].reason
+				bl = append(bl, blItem)
+				reported = append(reported, rps[i])
+			}
+			continue
+		}
+		if !x.isJIDInBlockList(j, blItems) && !x.isJIDInBlockList(j, bl) {
 			x.broadcastPresenceMatchingJID(j, ris, xml.UnavailableType)
-			bl = append(bl, model.BlockListItem{Username: x.stm.Username(), JID: j.String()})
 		}
+		blItem := model.BlockListItem{
+			Username: x.stm.Username(),
+			JID:      j.String(),
+			Domain:   j.IsServer() && !j.IsFull(),
+		}
+		if rps[i] != nil {
+			blItem.Reason = rps[i].reason
+			reported = append(reported, rps[i])
+		}
+		bl = append(bl, blItem)
 	}
-	if err := storage.Instance().InsertOrUpdateBlockListItems(bl); err != nil {
-		log.Error(err)
+	err = c2s.Instance().UpdateBlockList(x.stm.Username(), func() error {
+		return storage.Instance().InsertOrUpdateBlockListItems(bl)
+	})
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
-	c2s.Instance().ReloadBlockList(x.stm.Username())
+	for _, rp := range reported {
+		x.forwardReport(rp)
+	}
 
 	x.stm.SendElement(iq.ResultIQ())
 	x.pushIQ(block)
@@ -123,39 +237,54 @@ func (x *XEPBlockingCommand) unblock(iq *xml.IQ, unblock xml.XElement) {
 	items := unblock.Elements().Children("item")
 	jds, err := x.extractItemJIDs(items)
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.JidMalformedError())
 		return
 	}
 	blItems, ris, err := x.fetchBlockListAndRosterItems()
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
 
 	var bl []model.BlockListItem
+	var pps []pendingPresence
 	if len(jds) == 0 {
 		for _, blItem := range blItems {
 			j, _ := xml.NewJIDString(blItem.JID, true)
-			x.broadcastPresenceMatchingJID(j, ris, xml.AvailableType)
+			pps = append(pps, x.presencesMatchingJID(j, ris, xml.AvailableType)...)
 		}
 		bl = blItems
 
 	} else {
+		remaining := append([]model.BlockListItem(nil), blItems...)
 		for _, j := range jds {
-			if x.isJIDInBlockList(j, blItems) {
-				x.broadcastPresenceMatchingJID(j, ris, xml.AvailableType)
-				bl = append(bl, model.BlockListItem{Username: x.stm.Username(), JID: j.String()})
+			if i := x.blockListItemIndex(j, remaining); i != -1 {
+				bl = append(bl, remaining[i])
+				remaining = append(remaining[:i], remaining[i+1:]...)
+			}
+		}
+		for _, blItem := range bl {
+			j, _ := xml.NewJIDString(blItem.JID, true)
+			for _, pp := range x.presencesMatchingJID(j, ris, xml.AvailableType) {
+				// a contact may still be blocked by any of the remaining items
+				if x.isJIDInBlockList(x.presencePeerJID(pp.presence), remaining) {
+					continue
+				}
+				pps = append(pps, pp)
 			}
 		}
 	}
-	if err := storage.Instance().DeleteBlockListItems(bl); err != nil {
-		log.Error(err)
+	err = c2s.Instance().UpdateBlockList(x.stm.Username(), func() error {
+		return storage.Instance().DeleteBlockListItems(bl)
+	})
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
 		x.stm.SendElement(iq.InternalServerError())
 		return
 	}
-	c2s.Instance().ReloadBlockList(x.stm.Username())
+	x.routePresencesInBatches(coalescePresences(pps), ris)
 
 	x.stm.SendElement(iq.ResultIQ())
 	x.pushIQ(unblock)
@@ -173,7 +302,108 @@ func (x *XEPBlockingCommand) pushIQ(elem xml.XElement) {
 	}
 }
 
+// report represents a XEP-0377 spam or abuse report attached to a block list item.
+type report struct {
+	jid    *xml.JID
+	reason string // model.ReportSpam or model.ReportAbuse
+	text   string
+}
+
+// forwardReport logs a spam or abuse report, forwarding it to the configured report JID.
+func (x *XEPBlockingCommand) forwardReport(rp *report) {
+	desc := fmt.Sprintf("%s reported %s as %s", x.stm.JID().ToBareJID().String(), rp.jid.String(), rp.reason)
+	if len(rp.text) > 0 {
+		desc += ": " + rp.text
+	}
+	c2s.Logger(x.stm).Infof("%s", desc)
+
+	if x.cfg == nil || len(x.cfg.ReportJID) == 0 {
+		return
+	}
+	toJID, err := xml.NewJIDString(x.cfg.ReportJID, false)
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	fromJID, _ := xml.NewJID("", x.stm.Domain(), "", true)
+
+	msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+	msg.SetFromJID(fromJID)
+	msg.SetToJID(toJID)
+	body := xml.NewElementName("body")
+	body.SetText(desc)
+	msg.AppendElement(body)
+	if err := c2s.Instance().Route(msg); err != nil && err != router.ErrDropped {
+		c2s.Logger(x.stm).Error(err)
+	}
+}
+
+// pendingPresence represents a presence to be exchanged with a contact.
+type pendingPresence struct {
+	contact  *xml.JID // contact bare JID
+	presence *xml.Presence
+}
+
 func (x *XEPBlockingCommand) broadcastPresenceMatchingJID(jid *xml.JID, ris []model.RosterItem, presenceType string) {
+	for _, pp := range x.presencesMatchingJID(jid, ris, presenceType) {
+		c2s.Instance().MustRoute(pp.presence)
+	}
+}
+
+// routePresencesInBatches routes the first batch of presences right away,
+// spreading the remaining ones over time. Subscriptions are verified again
+// before routing every delayed batch, as they may have changed meanwhile.
+func (x *XEPBlockingCommand) routePresencesInBatches(pps []pendingPresence, ris []model.RosterItem) {
+	n := len(pps)
+	if n > presenceBatchSize {
+		n = presenceBatchSize
+	}
+	x.routeSubscribedPresences(pps[:n], ris)
+	if n == len(pps) {
+		return
+	}
+	username := x.stm.Username()
+	doneCh := x.stm.Context().Done()
+	go func(pps []pendingPresence) {
+		tc := time.NewTicker(presenceBatchInterval)
+		defer tc.Stop()
+		for len(pps) > 0 {
+			select {
+			case <-tc.C:
+			case <-doneCh:
+				return // stream disconnected...
+			}
+			ris, _, err := storage.Instance().FetchRosterItems(username)
+			if err != nil {
+				c2s.Logger(x.stm).Error(err)
+				return
+			}
+			n := len(pps)
+			if n > presenceBatchSize {
+				n = presenceBatchSize
+			}
+			x.routeSubscribedPresences(pps[:n], ris)
+			pps = pps[n:]
+		}
+	}(pps[n:])
+}
+
+func (x *XEPBlockingCommand) routeSubscribedPresences(pps []pendingPresence, ris []model.RosterItem) {
+	for _, pp := range pps {
+		if !x.isSubscribedFrom(pp.contact, ris) {
+			continue
+		}
+		c2s.Instance().MustRoute(pp.presence)
+	}
+}
+
+// presencesMatchingJID returns the presences to be exchanged between the user and
+// the contacts matching a block list JID. A bare JID matches every contact
+// resource, while a full JID only matches that specific resource.
+func (x *XEPBlockingCommand) presencesMatchingJID(jid *xml.JID, ris []model.RosterItem, presenceType string) []pendingPresence {
+	var ret []pendingPresence
+
+	// contact resources presence to user
 	stms := c2s.Instance().StreamsMatchingJID(jid)
 	for _, stm := range stms {
 		if !x.isSubscribedFrom(stm.JID().ToBareJID(), ris) {
@@ -183,19 +413,105 @@ func (x *XEPBlockingCommand) broadcastPresenceMatchingJID(jid *xml.JID, ris []mo
 		if presence := stm.Presence(); presence != nil && presenceType == xml.AvailableType {
 			p.AppendElements(presence.Elements().All())
 		}
-		c2s.Instance().MustRoute(p)
+		ret = append(ret, pendingPresence{contact: stm.JID().ToBareJID(), presence: p})
 	}
+	// user available resources presence to contacts
+	usrStms := c2s.Instance().StreamsMatchingJID(x.stm.JID().ToBareJID())
+	for _, ri := range ris {
+		if ri.Subscription != roster.SubscriptionFrom && ri.Subscription != roster.SubscriptionBoth {
+			continue
+		}
+		cntJID, err := xml.NewJIDString(ri.JID, true)
+		if err != nil || !x.contactMatchesJID(cntJID, jid) {
+			continue
+		}
+		toJID := cntJID
+		if jid.IsFull() {
+			// only notify blocked resource
+			toJID, _ = xml.NewJID(cntJID.Node(), cntJID.Domain(), jid.Resource(), true)
+		}
+		for _, stm := range usrStms {
+			presence := stm.Presence()
+			if presence == nil || !presence.IsAvailable() {
+				continue
+			}
+			p := xml.NewPresence(stm.JID(), toJID, presenceType)
+			if presenceType == xml.AvailableType {
+				p.AppendElements(presence.Elements().All())
+			}
+			ret = append(ret, pendingPresence{contact: cntJID, presence: p})
+		}
+	}
+	return ret
 }
 
+// coalescePresences discards presences already being routed to the same target,
+// including those addressed to a single resource when its bare JID is targeted as well.
+func coalescePresences(pps []pendingPresence) []pendingPresence {
+	bareTargets := make(map[string]bool)
+	for _, pp := range pps {
+		if !pp.presence.ToJID().IsFull() {
+			bareTargets[pp.presence.From()+" "+pp.presence.To()] = true
+		}
+	}
+	var ret []pendingPresence
+	seen := make(map[string]bool)
+	for _, pp := range pps {
+		toJID := pp.presence.ToJID()
+		if toJID.IsFull() && bareTargets[pp.presence.From()+" "+toJID.ToBareJID().String()] {
+			continue
+		}
+		key := pp.presence.From() + " " + pp.presence.To()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ret = append(ret, pp)
+	}
+	return ret
+}
+
+// presencePeerJID returns the contact JID a pending presence is exchanged with.
+func (x *XEPBlockingCommand) presencePeerJID(presence *xml.Presence) *xml.JID {
+	if presence.FromJID().Matches(x.stm.JID(), xml.JIDMatchesNode|xml.JIDMatchesDomain) {
+		return presence.ToJID()
+	}
+	return presence.FromJID()
+}
+
+func (x *XEPBlockingCommand) contactMatchesJID(cntJID, jid *xml.JID) bool {
+	if jid.IsServer() {
+		return cntJID.Domain() == jid.Domain()
+	}
+	return cntJID.Matches(jid, xml.JIDMatchesNode|xml.JIDMatchesDomain)
+}
+
+// isJIDInBlockList returns whether or not a JID is blocked by any
+// block list item, either by its full JID, its bare JID or its domain.
 func (x *XEPBlockingCommand) isJIDInBlockList(jid *xml.JID, blItems []model.BlockListItem) bool {
+	fullJID := jid.String()
+	bareJID := jid.ToBareJID().String()
 	for _, blItem := range blItems {
-		if blItem.JID == jid.String() {
+		switch {
+		case blItem.Domain && blItem.JID == jid.Domain():
+			return true
+		case blItem.JID == fullJID, blItem.JID == bareJID:
 			return true
 		}
 	}
 	return false
 }
 
+func (x *XEPBlockingCommand) blockListItemIndex(jid *xml.JID, blItems []model.BlockListItem) int {
+	str := jid.String()
+	for i, blItem := range blItems {
+		if blItem.JID == str {
+			return i
+		}
+	}
+	return -1
+}
+
 func (x *XEPBlockingCommand) isSubscribedFrom(jid *xml.JID, ris []model.RosterItem) bool {
 	str := jid.String()
 	for _, ri := range ris {
@@ -229,3 +545,34 @@ func (x *XEPBlockingCommand) extractItemJIDs(items []xml.XElement) ([]*xml.JID,
 	}
 	return ret, nil
 }
+
+// extractItemReports returns the report attached to every block item, if any.
+func (x *XEPBlockingCommand) extractItemReports(items []xml.XElement, jds []*xml.JID) ([]*report, error) {
+	ret := make([]*report, len(items))
+	for i, item := range items {
+		rep := item.Elements().ChildNamespace("report", reportingNamespace)
+		if rep == nil {
+			continue
+		}
+		rp := &report{jid: jds[i]}
+		switch reason := rep.Attributes().Get("reason"); reason {
+		case spamReportReason:
+			rp.reason = model.ReportSpam
+		case abuseReportReason:
+			rp.reason = model.ReportAbuse
+		default:
+			return nil, fmt.Errorf("xep0191: unrecognized report reason: %s", reason)
+		}
+		if text := rep.Elements().Child("text"); text != nil {
+			rp.text = text.Text()
+		}
+		ret[i] = rp
+	}
+	return ret, nil
+}
+
+// blockListItems represents a block list result set, identified by JID.
+type blockListItems []model.BlockListItem
+
+func (b blockListItems) Len() int        { return len(b) }
+func (b blockListItems) ID(i int) string { return b[i].JID }
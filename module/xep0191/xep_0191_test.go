@@ -6,8 +6,12 @@
 package xep0191
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ortuman/jackal/module/xep0059"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -19,9 +23,9 @@ import (
 func TestXEP0191_Matching(t *testing.T) {
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 
-	x := New(nil)
+	x := New(&Config{}, nil)
 
-	require.Equal(t, []string{blockingCommandNamespace}, x.AssociatedNamespaces())
+	require.Equal(t, []string{blockingCommandNamespace, reportingNamespace}, x.AssociatedNamespaces())
 
 	// test MatchesIQ
 	iq1 := xml.NewIQType(uuid.New(), xml.GetType)
@@ -50,7 +54,7 @@ func TestXEP0191_GetBlockList(t *testing.T) {
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream(uuid.New(), j)
 
-	x := New(stm)
+	x := New(&Config{}, stm)
 
 	storage.Instance().InsertOrUpdateBlockListItems([]model.BlockListItem{{
 		Username: "ortuman",
@@ -80,6 +84,107 @@ func TestXEP0191_GetBlockList(t *testing.T) {
 	storage.DeactivateMockedError()
 }
 
+func TestXEP0191_GetBlockListPage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+
+	x := New(&Config{}, stm)
+
+	var blItms []model.BlockListItem
+	for _, jid := range []string{"a@jackal.im", "b@jackal.im", "c@jackal.im", "d@jackal.im", "e@jackal.im"} {
+		blItms = append(blItms, model.BlockListItem{Username: "ortuman", JID: jid})
+	}
+	storage.Instance().InsertOrUpdateBlockListItems(blItms)
+
+	requestPage := func(set string) xml.XElement {
+		parser := xml.NewParser(strings.NewReader(set))
+		setElem, err := parser.ParseElement()
+		require.Nil(t, err)
+
+		iq := xml.NewIQType(uuid.New(), xml.GetType)
+		iq.SetFromJID(j)
+		iq.SetToJID(j)
+		blockList := xml.NewElementNamespace("blocklist", blockingCommandNamespace)
+		blockList.AppendElement(setElem)
+		iq.AppendElement(blockList)
+
+		x.ProcessIQ(iq)
+		return stm.FetchElement()
+	}
+	pageJIDs := func(elem xml.XElement) []string {
+		var jids []string
+		bl := elem.Elements().ChildNamespace("blocklist", blockingCommandNamespace)
+		for _, item := range bl.Elements().Children("item") {
+			jids = append(jids, item.Attributes().Get("jid"))
+		}
+		return jids
+	}
+	pageSet := func(elem xml.XElement) xml.XElement {
+		bl := elem.Elements().ChildNamespace("blocklist", blockingCommandNamespace)
+		return bl.Elements().ChildNamespace("set", xep0059.Namespace)
+	}
+
+	// first page
+	elem := requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>2</max></set>`)
+	require.Equal(t, []string{"a@jackal.im", "b@jackal.im"}, pageJIDs(elem))
+	set := pageSet(elem)
+	require.NotNil(t, set)
+	require.Equal(t, "a@jackal.im", set.Elements().Child("first").Text())
+	require.Equal(t, "0", set.Elements().Child("first").Attributes().Get("index"))
+	require.Equal(t, "b@jackal.im", set.Elements().Child("last").Text())
+	require.Equal(t, "5", set.Elements().Child("count").Text())
+
+	// next pages
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>2</max><after>b@jackal.im</after></set>`)
+	require.Equal(t, []string{"c@jackal.im", "d@jackal.im"}, pageJIDs(elem))
+	require.Equal(t, "2", pageSet(elem).Elements().Child("first").Attributes().Get("index"))
+
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>2</max><after>d@jackal.im</after></set>`)
+	require.Equal(t, []string{"e@jackal.im"}, pageJIDs(elem))
+
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>2</max><after>e@jackal.im</after></set>`)
+	require.Nil(t, pageJIDs(elem))
+	require.Nil(t, pageSet(elem).Elements().Child("first"))
+	require.Equal(t, "5", pageSet(elem).Elements().Child("count").Text())
+
+	// last page
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>2</max><before/></set>`)
+	require.Equal(t, []string{"d@jackal.im", "e@jackal.im"}, pageJIDs(elem))
+
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>2</max><before>b@jackal.im</before></set>`)
+	require.Equal(t, []string{"a@jackal.im"}, pageJIDs(elem))
+
+	// index based paging
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>3</max><index>3</index></set>`)
+	require.Equal(t, []string{"d@jackal.im", "e@jackal.im"}, pageJIDs(elem))
+	require.Equal(t, "3", pageSet(elem).Elements().Child("first").Attributes().Get("index"))
+
+	// items count only
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>0</max></set>`)
+	require.Nil(t, pageJIDs(elem))
+	require.Equal(t, "5", pageSet(elem).Elements().Child("count").Text())
+
+	// out of range index
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><index>5</index></set>`)
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+
+	// unknown item
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><after>z@jackal.im</after></set>`)
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+
+	// malformed request
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>-1</max></set>`)
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	storage.ActivateMockedError()
+	elem = requestPage(`<set xmlns="http://jabber.org/protocol/rsm"><max>2</max></set>`)
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements().All()[0].Name())
+	storage.DeactivateMockedError()
+}
+
 func TestXEP191_BlockAndUnblock(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
@@ -90,7 +195,7 @@ func TestXEP191_BlockAndUnblock(t *testing.T) {
 	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm1 := c2s.NewMockStream(uuid.New(), j1)
 
-	x := New(stm1)
+	x := New(&Config{}, stm1)
 
 	j2, _ := xml.NewJID("ortuman", "jackal.im", "yard", true)
 	stm2 := c2s.NewMockStream(uuid.New(), j2)
@@ -248,3 +353,444 @@ func TestXEP191_BlockAndUnblock(t *testing.T) {
 	blItms, _ := storage.Instance().FetchBlockListItems("ortuman")
 	require.Equal(t, 0, len(blItms))
 }
+
+func TestXEP191_BlockWhileRouting(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "yard", true)
+	j3, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	stm2.SetPresence(xml.NewPresence(j2, j2.ToBareJID(), xml.AvailableType))
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	x := New(&Config{}, stm1)
+
+	// consume delivered messages
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		for {
+			select {
+			case <-doneCh:
+				return
+			default:
+				stm2.FetchElement()
+			}
+		}
+	}()
+
+	// route messages from romeo while blocking him
+	routeCh := make(chan struct{})
+	go func() {
+		defer close(routeCh)
+		for i := 0; i < 100; i++ {
+			msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+			msg.SetFromJID(j3)
+			msg.SetToJID(j2.ToBareJID())
+			c2s.Instance().Route(msg)
+		}
+	}()
+	c2s.Instance().IsBlockedJID(j3, "ortuman") // cache block list
+
+	iqID := uuid.New()
+	iq := xml.NewIQType(iqID, xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j1.ToBareJID())
+	block := xml.NewElementNamespace("block", blockingCommandNamespace)
+	item := xml.NewElementName("item")
+	item.SetAttribute("jid", "romeo@jackal.im")
+	block.AppendElement(item)
+	iq.AppendElement(block)
+
+	x.ProcessIQ(iq)
+	elem := stm1.FetchElement()
+	require.Equal(t, iqID, elem.ID())
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	// once the block has been applied no message must pass through
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j3)
+	msg.SetToJID(j2.ToBareJID())
+	require.Equal(t, c2s.ErrBlockedJID, c2s.Instance().Route(msg))
+	require.True(t, c2s.Instance().IsBlockedJID(j3, "ortuman"))
+
+	<-routeCh
+	require.Equal(t, c2s.ErrBlockedJID, c2s.Instance().Route(msg))
+}
+
+func TestXEP191_BlockPresenceToContact(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("romeo", "jackal.im", "jail", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	stm3 := c2s.NewMockStream(uuid.New(), j3)
+	for _, stm := range []*c2s.MockStream{stm1, stm2, stm3} {
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+	}
+	stm1.SetPresence(xml.NewPresence(j1, j1.ToBareJID(), xml.AvailableType))
+
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "romeo@jackal.im",
+		Subscription: "from",
+	})
+	x := New(&Config{}, stm1)
+
+	blockIQ := func(name, jid string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetFromJID(j1)
+		iq.SetToJID(j1.ToBareJID())
+		block := xml.NewElementNamespace(name, blockingCommandNamespace)
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", jid)
+		block.AppendElement(item)
+		iq.AppendElement(block)
+		return iq
+	}
+
+	// full JID: only blocked resource is notified
+	x.ProcessIQ(blockIQ("block", "romeo@jackal.im/jail"))
+	elem := stm3.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
+	require.Equal(t, "romeo@jackal.im/jail", elem.To())
+
+	x.ProcessIQ(blockIQ("unblock", "romeo@jackal.im/jail"))
+	elem = stm3.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, &xml.Element{}, stm2.FetchElementTimeout(time.Millisecond*200))
+
+	// bare JID: every resource is notified
+	x.ProcessIQ(blockIQ("block", "romeo@jackal.im"))
+	for _, stm := range []*c2s.MockStream{stm2, stm3} {
+		elem = stm.FetchElement()
+		require.Equal(t, "presence", elem.Name())
+		require.Equal(t, xml.UnavailableType, elem.Type())
+		require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
+		require.Equal(t, "romeo@jackal.im", elem.To())
+	}
+}
+
+func TestXEP191_BlockDomain(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("romeo", "jabber.org", "garden", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	for _, stm := range []*c2s.MockStream{stm1, stm2} {
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+	}
+	stm1.SetPresence(xml.NewPresence(j1, j1.ToBareJID(), xml.AvailableType))
+
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "romeo@jackal.im",
+		Subscription: "both",
+	})
+	x := New(&Config{}, stm1)
+
+	blockIQ := func(name, jid string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetFromJID(j1)
+		iq.SetToJID(j1.ToBareJID())
+		block := xml.NewElementNamespace(name, blockingCommandNamespace)
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", jid)
+		block.AppendElement(item)
+		iq.AppendElement(block)
+		return iq
+	}
+
+	// domain
+	x.ProcessIQ(blockIQ("block", "jackal.im"))
+	elem := stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnavailableType, elem.Type())
+
+	bl, _ := storage.Instance().FetchBlockListItems("ortuman")
+	require.Equal(t, 1, len(bl))
+	require.True(t, bl[0].Domain)
+	require.True(t, c2s.Instance().IsBlockedJID(j2, "ortuman"))
+	require.True(t, c2s.Instance().IsBlockedJID(j2.ToBareJID(), "ortuman"))
+	require.False(t, c2s.Instance().IsBlockedJID(j3, "ortuman"))
+
+	// bare JID already blocked by domain
+	x.ProcessIQ(blockIQ("block", "romeo@jackal.im"))
+	require.Equal(t, &xml.Element{}, stm2.FetchElementTimeout(time.Millisecond*200))
+
+	bl, _ = storage.Instance().FetchBlockListItems("ortuman")
+	require.Equal(t, 2, len(bl))
+	require.False(t, bl[1].Domain)
+
+	// still blocked by bare JID
+	x.ProcessIQ(blockIQ("unblock", "jackal.im"))
+	require.Equal(t, &xml.Element{}, stm2.FetchElementTimeout(time.Millisecond*200))
+	require.True(t, c2s.Instance().IsBlockedJID(j2, "ortuman"))
+
+	x.ProcessIQ(blockIQ("unblock", "romeo@jackal.im"))
+	elem = stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.False(t, c2s.Instance().IsBlockedJID(j2, "ortuman"))
+}
+
+func TestXEP191_UnblockAll(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("juliet", "jackal.im", "balcony", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	stm3 := c2s.NewMockStream(uuid.New(), j3)
+	for _, stm := range []*c2s.MockStream{stm1, stm2, stm3} {
+		stm.SetPresence(xml.NewPresence(stm.JID(), stm.JID().ToBareJID(), xml.AvailableType))
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+	}
+	// romeo is blocked twice, and juliet's items are routed within the very last batch
+	bl := []model.BlockListItem{
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "romeo@jackal.im/garden"},
+	}
+	contacts := []string{"romeo@jackal.im"}
+	for i := 0; i < 300; i++ {
+		contact := fmt.Sprintf("hamlet%d@jackal.im", i)
+		bl = append(bl, model.BlockListItem{Username: "ortuman", JID: contact})
+		contacts = append(contacts, contact)
+	}
+	bl = append(bl, model.BlockListItem{Username: "ortuman", JID: "juliet@jackal.im"})
+	contacts = append(contacts, "juliet@jackal.im")
+
+	storage.Instance().InsertOrUpdateBlockListItems(bl)
+	for _, contact := range contacts {
+		storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+			Username:     "ortuman",
+			JID:          contact,
+			Subscription: "both",
+		})
+	}
+	x := New(&Config{}, stm1)
+
+	iqID := uuid.New()
+	iq := xml.NewIQType(iqID, xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j1.ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("unblock", blockingCommandNamespace))
+
+	x.ProcessIQ(iq)
+
+	// juliet is no longer subscribed by the time her presence is due
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "juliet@jackal.im",
+		Subscription: "none",
+	})
+
+	// duplicated presences are coalesced
+	elem := stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "romeo@jackal.im/garden", elem.From())
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, iqID, elem.ID())
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
+	require.Equal(t, "romeo@jackal.im", elem.To())
+	require.Equal(t, &xml.Element{}, stm2.FetchElementTimeout(time.Millisecond*200))
+
+	// wait for the very last batch
+	require.Equal(t, &xml.Element{}, stm3.FetchElementTimeout(time.Second))
+	require.Equal(t, &xml.Element{}, stm1.FetchElementTimeout(time.Millisecond*200))
+
+	blItms, _ := storage.Instance().FetchBlockListItems("ortuman")
+	require.Equal(t, 0, len(blItms))
+}
+
+func TestXEP191_UnblockAllAndDisconnect(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "balcony", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	for _, stm := range []*c2s.MockStream{stm1, stm2} {
+		stm.SetPresence(xml.NewPresence(stm.JID(), stm.JID().ToBareJID(), xml.AvailableType))
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+	}
+	// juliet's items are routed within a delayed batch
+	var bl []model.BlockListItem
+	var contacts []string
+	for i := 0; i < presenceBatchSize; i++ {
+		contact := fmt.Sprintf("hamlet%d@jackal.im", i)
+		bl = append(bl, model.BlockListItem{Username: "ortuman", JID: contact})
+		contacts = append(contacts, contact)
+	}
+	bl = append(bl, model.BlockListItem{Username: "ortuman", JID: "juliet@jackal.im"})
+	contacts = append(contacts, "juliet@jackal.im")
+
+	storage.Instance().InsertOrUpdateBlockListItems(bl)
+	for _, contact := range contacts {
+		storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+			Username:     "ortuman",
+			JID:          contact,
+			Subscription: "both",
+		})
+	}
+	x := New(&Config{}, stm1)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j1.ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("unblock", blockingCommandNamespace))
+
+	x.ProcessIQ(iq)
+	stm1.Context().Terminate()
+
+	// remaining batches are discarded once the stream is gone
+	require.Equal(t, &xml.Element{}, stm2.FetchElementTimeout(presenceBatchInterval*3))
+}
+
+func TestXEP191_BlockAndReport(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("admin", "jackal.im", "office", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	stm2.SetPresence(xml.NewPresence(j2, j2.ToBareJID(), xml.AvailableType))
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	x := New(&Config{ReportJID: "admin@jackal.im"}, stm1)
+
+	// unrecognized report reason
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j1.ToBareJID())
+	block := xml.NewElementNamespace("block", blockingCommandNamespace)
+	item := xml.NewElementName("item")
+	item.SetAttribute("jid", "romeo@jackal.im")
+	rep := xml.NewElementNamespace("report", reportingNamespace)
+	rep.SetAttribute("reason", "urn:xmpp:reporting:boredom")
+	item.AppendElement(rep)
+	block.AppendElement(item)
+	iq.AppendElement(block)
+
+	x.ProcessIQ(iq)
+	elem := stm1.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	// reported and plain items within the same request
+	iqID := uuid.New()
+	iq = xml.NewIQType(iqID, xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j1.ToBareJID())
+	block = xml.NewElementNamespace("block", blockingCommandNamespace)
+	item = xml.NewElementName("item")
+	item.SetAttribute("jid", "romeo@jackal.im")
+	rep = xml.NewElementNamespace("report", reportingNamespace)
+	rep.SetAttribute("reason", spamReportReason)
+	text := xml.NewElementName("text")
+	text.SetText("Buy cheap pills!")
+	rep.AppendElement(text)
+	item.AppendElement(rep)
+	block.AppendElement(item)
+	item = xml.NewElementName("item")
+	item.SetAttribute("jid", "juliet@jackal.im")
+	block.AppendElement(item)
+	iq.AppendElement(block)
+
+	x.ProcessIQ(iq)
+	elem = stm1.FetchElement()
+	require.Equal(t, iqID, elem.ID())
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	blItms, _ := storage.Instance().FetchBlockListItems("ortuman")
+	require.Equal(t, 2, len(blItms))
+	require.Equal(t, "romeo@jackal.im", blItms[0].JID)
+	require.Equal(t, model.ReportSpam, blItms[0].Reason)
+	require.Equal(t, "juliet@jackal.im", blItms[1].JID)
+	require.Equal(t, "", blItms[1].Reason)
+
+	// report forwarded to the configured JID
+	elem = stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "jackal.im", elem.From())
+	body := elem.Elements().Child("body")
+	require.NotNil(t, body)
+	require.Equal(t, "ortuman@jackal.im reported romeo@jackal.im as spam: Buy cheap pills!", body.Text())
+
+	// reporting an already blocked JID updates its reason
+	iq = xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j1.ToBareJID())
+	block = xml.NewElementNamespace("block", blockingCommandNamespace)
+	item = xml.NewElementName("item")
+	item.SetAttribute("jid", "juliet@jackal.im")
+	rep = xml.NewElementNamespace("report", reportingNamespace)
+	rep.SetAttribute("reason", abuseReportReason)
+	item.AppendElement(rep)
+	block.AppendElement(item)
+	iq.AppendElement(block)
+
+	x.ProcessIQ(iq)
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	blItms, _ = storage.Instance().FetchBlockListItems("ortuman")
+	require.Equal(t, 2, len(blItms))
+	require.Equal(t, model.ReportAbuse, blItms[1].Reason)
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "ortuman@jackal.im reported juliet@jackal.im as abuse", elem.Elements().Child("body").Text())
+}
@@ -10,7 +10,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
@@ -23,6 +22,7 @@ const pingNamespace = "urn:xmpp:ping"
 type Config struct {
 	Send         bool `yaml:"send"`
 	SendInterval int  `yaml:"send_interval"`
+	AckTimeout   int  `yaml:"ack_timeout"`
 }
 
 // XEPPing represents a ping server stream module.
@@ -32,12 +32,14 @@ type XEPPing struct {
 
 	pingTm *time.Timer
 	pongCh chan struct{}
+	doneCh chan struct{}
 
 	pingMu sync.RWMutex // guards 'pingID'
 	pingId string
 
 	waitingPing uint32
 	pingOnce    sync.Once
+	doneOnce    sync.Once
 }
 
 // New returns an ping IQ handler module.
@@ -46,6 +48,7 @@ func New(config *Config, stm c2s.Stream) *XEPPing {
 		cfg:    config,
 		stm:    stm,
 		pongCh: make(chan struct{}, 1),
+		doneCh: make(chan struct{}),
 	}
 }
 
@@ -78,9 +81,9 @@ func (x *XEPPing) ProcessIQ(iq *xml.IQ) {
 		x.stm.SendElement(iq.BadRequestError())
 		return
 	}
-	log.Infof("received ping... id: %s", iq.ID())
+	c2s.Logger(x.stm).Infof("received ping... id: %s", iq.ID())
 	if iq.IsGet() {
-		log.Infof("sent pong... id: %s", iq.ID())
+		c2s.Logger(x.stm).Infof("sent pong... id: %s", iq.ID())
 		x.stm.SendElement(iq.ResultIQ())
 	} else {
 		x.stm.SendElement(iq.BadRequestError())
@@ -104,6 +107,16 @@ func (x *XEPPing) ResetDeadline() {
 	}
 }
 
+// Done stops pinging peer, releasing any pending pong wait.
+func (x *XEPPing) Done() {
+	x.doneOnce.Do(func() {
+		if x.pingTm != nil {
+			x.pingTm.Stop()
+		}
+		close(x.doneCh)
+	})
+}
+
 func (x *XEPPing) isPongIQ(iq *xml.IQ) bool {
 	x.pingMu.RLock()
 	defer x.pingMu.RUnlock()
@@ -111,6 +124,11 @@ func (x *XEPPing) isPongIQ(iq *xml.IQ) bool {
 }
 
 func (x *XEPPing) sendPing() {
+	select {
+	case <-x.doneCh:
+		return
+	default:
+	}
 	atomic.StoreUint32(&x.waitingPing, 0)
 
 	x.pingMu.Lock()
@@ -124,29 +142,42 @@ func (x *XEPPing) sendPing() {
 
 	x.stm.SendElement(iq)
 
-	log.Infof("sent ping... id: %s", pingId)
+	c2s.Logger(x.stm).Infof("sent ping... id: %s", pingId)
 
 	x.waitForPong()
 }
 
 func (x *XEPPing) waitForPong() {
-	t := time.NewTimer(time.Second * time.Duration(x.cfg.SendInterval))
+	t := time.NewTimer(x.ackTimeout())
+	defer t.Stop()
 	select {
 	case <-x.pongCh:
 		return
+	case <-x.doneCh:
+		return
 	case <-t.C:
 		x.stm.Disconnect(streamerror.ErrConnectionTimeout)
 	}
 }
 
 func (x *XEPPing) handlePongIQ(iq *xml.IQ) {
-	log.Infof("received pong... id: %s", iq.ID())
+	c2s.Logger(x.stm).Infof("received pong... id: %s", iq.ID())
 
 	x.pingMu.Lock()
 	x.pingId = ""
 	x.pingMu.Unlock()
 
-	x.pongCh <- struct{}{}
+	select {
+	case x.pongCh <- struct{}{}:
+	default:
+	}
 	x.pingTm.Reset(time.Second * time.Duration(x.cfg.SendInterval))
 	atomic.StoreUint32(&x.waitingPing, 1)
 }
+
+func (x *XEPPing) ackTimeout() time.Duration {
+	if x.cfg.AckTimeout > 0 {
+		return time.Second * time.Duration(x.cfg.AckTimeout)
+	}
+	return time.Second * time.Duration(x.cfg.SendInterval)
+}
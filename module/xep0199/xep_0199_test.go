@@ -7,6 +7,7 @@ package xep0199
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
@@ -124,3 +125,50 @@ func TestXEP0199_Disconnect(t *testing.T) {
 	require.NotNil(t, err)
 	require.Equal(t, "connection-timeout", err.Error())
 }
+
+func TestXEP0199_AckTimeout(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetUsername("ortuman")
+
+	x := New(&Config{Send: true, SendInterval: 1, AckTimeout: 1}, stm)
+	require.Equal(t, time.Second, x.ackTimeout())
+
+	x = New(&Config{Send: true, SendInterval: 2}, stm)
+	require.Equal(t, time.Second*2, x.ackTimeout())
+}
+
+func TestXEP0199_Done(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetUsername("ortuman")
+
+	x := New(&Config{Send: true, SendInterval: 1, AckTimeout: 1}, stm)
+
+	x.StartPinging()
+
+	// wait for ping...
+	elem := stm.FetchElement()
+	require.NotNil(t, elem)
+	require.NotNil(t, elem.Elements().ChildNamespace("ping", pingNamespace))
+
+	x.Done()
+	x.Done() // must be idempotent
+
+	// no disconnection expected once module is done...
+	select {
+	case <-time.After(time.Millisecond * 1500):
+	case err := <-waitDisconnection(stm):
+		require.Fail(t, "unexpected disconnection", "%v", err)
+	}
+}
+
+func waitDisconnection(stm *c2s.MockStream) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- stm.WaitDisconnection() }()
+	return ch
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0202
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const timeNamespace = "urn:xmpp:time"
+
+const utcLayout = "2006-01-02T15:04:05Z"
+
+// Clock represents a time source.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// XEPTime represents an entity time server stream module.
+type XEPTime struct {
+	stm   c2s.Stream
+	clock Clock
+}
+
+// New returns an entity time IQ handler module.
+func New(stm c2s.Stream) *XEPTime {
+	return &XEPTime{stm: stm, clock: systemClock{}}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with entity time module.
+func (x *XEPTime) AssociatedNamespaces() []string {
+	return []string{timeNamespace}
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the entity time module.
+func (x *XEPTime) MatchesIQ(iq *xml.IQ) bool {
+	return iq.IsGet() && iq.Elements().ChildNamespace("time", timeNamespace) != nil && iq.ToJID().IsServer()
+}
+
+// ProcessIQ processes an entity time IQ taking according actions
+// over the associated stream.
+func (x *XEPTime) ProcessIQ(iq *xml.IQ) {
+	t := iq.Elements().ChildNamespace("time", timeNamespace)
+	if t.Elements().Count() != 0 {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	now := x.clock.Now()
+
+	tzo := xml.NewElementName("tzo")
+	tzo.SetText(tzoString(now))
+	utc := xml.NewElementName("utc")
+	utc.SetText(now.UTC().Format(utcLayout))
+
+	timeRes := xml.NewElementNamespace("time", timeNamespace)
+	timeRes.AppendElement(tzo)
+	timeRes.AppendElement(utc)
+
+	result := iq.ResultIQ()
+	result.AppendElement(timeRes)
+	x.stm.SendElement(result)
+}
+
+// tzoString returns local time zone offset in ([+-]hh:mm) format (XEP-0082).
+func tzoString(t time.Time) string {
+	_, offset := t.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, offset/3600, (offset%3600)/60)
+}
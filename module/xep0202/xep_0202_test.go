@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0202
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type frozenClock struct {
+	t time.Time
+}
+
+func (c frozenClock) Now() time.Time { return c.t }
+
+func TestXEP0202_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	srvJID, _ := xml.NewJID("", "jackal.im", "", true)
+
+	x := New(nil)
+	require.Equal(t, []string{timeNamespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(srvJID)
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("time", timeNamespace))
+	require.True(t, x.MatchesIQ(iq))
+
+	iq.SetToJID(j.ToBareJID())
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.SetToJID(srvJID)
+	iq.SetType(xml.SetType)
+	require.False(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0202_ProcessIQ(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	srvJID, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream("abcd", j)
+
+	x := New(stm)
+	loc := time.FixedZone("", -(6*3600 + 30*60))
+	x.clock = frozenClock{t: time.Date(2006, time.December, 19, 11, 58, 35, 0, loc)}
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(srvJID)
+	iq.AppendElement(xml.NewElementNamespace("time", timeNamespace))
+
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	timeRes := elem.Elements().ChildNamespace("time", timeNamespace)
+	require.NotNil(t, timeRes)
+	require.Equal(t, "-06:30", timeRes.Elements().Child("tzo").Text())
+	require.Equal(t, "2006-12-19T18:28:35Z", timeRes.Elements().Child("utc").Text())
+
+	x.clock = frozenClock{t: time.Date(2006, time.December, 19, 17, 58, 35, 0, time.UTC)}
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, "+00:00", elem.Elements().ChildNamespace("time", timeNamespace).Elements().Child("tzo").Text())
+
+	// bad request
+	tm := xml.NewElementNamespace("time", timeNamespace)
+	tm.AppendElement(xml.NewElementName("tzo"))
+	iq2 := xml.NewIQType(uuid.New(), xml.GetType)
+	iq2.SetFromJID(j)
+	iq2.SetToJID(srvJID)
+	iq2.AppendElement(tm)
+	x.ProcessIQ(iq2)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0280
+
+import (
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	carbonsNamespace = "urn:xmpp:carbons:2"
+	forwardNamespace = "urn:xmpp:forward:0"
+)
+
+const carbonsEnabledContextKey = "carbons:enabled"
+
+// XEPCarbons represents a message carbons server stream module.
+type XEPCarbons struct {
+	stm c2s.Stream
+}
+
+// New returns a message carbons IQ handler module.
+func New(stm c2s.Stream) *XEPCarbons {
+	return &XEPCarbons{stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with message carbons module.
+func (x *XEPCarbons) AssociatedNamespaces() []string {
+	return []string{carbonsNamespace}
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the message carbons module.
+func (x *XEPCarbons) MatchesIQ(iq *xml.IQ) bool {
+	return iq.Elements().ChildNamespace("enable", carbonsNamespace) != nil ||
+		iq.Elements().ChildNamespace("disable", carbonsNamespace) != nil
+}
+
+// ProcessIQ processes a message carbons IQ taking according actions
+// over the associated stream.
+func (x *XEPCarbons) ProcessIQ(iq *xml.IQ) {
+	toJid := iq.ToJID()
+	if !toJid.IsServer() && toJid.Node() != x.stm.Username() {
+		x.stm.SendElement(iq.ForbiddenError())
+		return
+	}
+	if !iq.IsSet() {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	switch {
+	case iq.Elements().ChildNamespace("enable", carbonsNamespace) != nil:
+		c2s.Logger(x.stm).Infof("enabling message carbons... (%s/%s)", x.stm.Username(), x.stm.Resource())
+		x.stm.Context().SetBool(true, carbonsEnabledContextKey)
+	default:
+		c2s.Logger(x.stm).Infof("disabling message carbons... (%s/%s)", x.stm.Username(), x.stm.Resource())
+		x.stm.Context().SetBool(false, carbonsEnabledContextKey)
+	}
+	x.stm.SendElement(iq.ResultIQ())
+}
+
+// IsEnabled returns whether or not message carbons have been
+// enabled over the associated stream.
+func (x *XEPCarbons) IsEnabled() bool {
+	return x.stm.Context().Bool(carbonsEnabledContextKey)
+}
+
+// ProcessSentMessage forwards a message sent by the associated stream
+// to every other carbons enabled resource of the same user.
+func (x *XEPCarbons) ProcessSentMessage(message *xml.Message) {
+	if !x.isCarbonable(message) {
+		return
+	}
+	x.forward(message, "sent")
+}
+
+// ProcessReceivedMessage forwards a message delivered to the associated stream
+// to every other carbons enabled resource of the same user.
+// Resources which already received a message addressed to the bare JID
+// (as happens in 'all' delivery mode or under equal priorities) are skipped,
+// and only the first of them forwards it, so that no resource is carboned twice.
+func (x *XEPCarbons) ProcessReceivedMessage(message *xml.Message) {
+	if !x.isCarbonable(message) {
+		return
+	}
+	var delivered []c2s.Stream
+	if !message.ToJID().IsFullWithUser() {
+		delivered = c2s.Instance().MessageRecipients(message.ToJID())
+		if containsStream(delivered, x.stm) && delivered[0].ID() != x.stm.ID() {
+			return // carboned by first recipient
+		}
+	}
+	x.forward(message, "received", delivered...)
+}
+
+func (x *XEPCarbons) forward(message *xml.Message, wrapperName string, skip ...c2s.Stream) {
+	messageType := message.Type()
+	if len(messageType) == 0 {
+		messageType = xml.NormalType
+	}
+	userJID := x.stm.JID().ToBareJID()
+	for _, stm := range c2s.Instance().StreamsMatchingJID(userJID) {
+		if stm.Resource() == x.stm.Resource() || !stm.Context().Bool(carbonsEnabledContextKey) {
+			continue
+		}
+		if containsStream(skip, stm) {
+			continue
+		}
+		forwarded := xml.NewElementNamespace("forwarded", forwardNamespace)
+		forwarded.AppendElement(xml.NewElementFromElement(message))
+
+		wrapper := xml.NewElementNamespace(wrapperName, carbonsNamespace)
+		wrapper.AppendElement(forwarded)
+
+		carbon := xml.NewMessageType(message.ID(), messageType)
+		carbon.SetFromJID(userJID)
+		carbon.SetToJID(stm.JID())
+		carbon.AppendElement(wrapper)
+		stm.SendElement(carbon)
+	}
+}
+
+func (x *XEPCarbons) isCarbonable(message *xml.Message) bool {
+	if message.IsError() || message.IsGroupChat() || message.IsHeadline() {
+		return false
+	}
+	if !message.IsChat() && !message.IsMessageWithBody() {
+		return false
+	}
+	if message.Elements().ChildNamespace("private", carbonsNamespace) != nil {
+		return false
+	}
+	// do not carbon already forwarded messages
+	if message.Elements().ChildNamespace("sent", carbonsNamespace) != nil ||
+		message.Elements().ChildNamespace("received", carbonsNamespace) != nil {
+		return false
+	}
+	return true
+}
+
+func containsStream(stms []c2s.Stream, stm c2s.Stream) bool {
+	for _, s := range stms {
+		if s.ID() == stm.ID() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0280
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0280_Matching(t *testing.T) {
+	t.Parallel()
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := New(nil)
+
+	require.Equal(t, []string{carbonsNamespace}, x.AssociatedNamespaces())
+
+	iq1 := xml.NewIQType(uuid.New(), xml.SetType)
+	iq1.SetFromJID(j)
+	iq1.SetToJID(j.ToBareJID())
+	iq1.AppendElement(xml.NewElementNamespace("enable", carbonsNamespace))
+	require.True(t, x.MatchesIQ(iq1))
+
+	iq2 := xml.NewIQType(uuid.New(), xml.SetType)
+	iq2.SetFromJID(j)
+	iq2.SetToJID(j.ToBareJID())
+	iq2.AppendElement(xml.NewElementNamespace("disable", carbonsNamespace))
+	require.True(t, x.MatchesIQ(iq2))
+
+	iq3 := xml.NewIQType(uuid.New(), xml.SetType)
+	iq3.SetFromJID(j)
+	iq3.SetToJID(j.ToBareJID())
+	iq3.AppendElement(xml.NewElementNamespace("enable", "urn:xmpp:carbons:1"))
+	require.False(t, x.MatchesIQ(iq3))
+}
+
+func TestXEP0280_EnableDisable(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	stm.SetUsername("ortuman")
+
+	x := New(stm)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j2.ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("enable", carbonsNamespace))
+
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements().All()[0].Name())
+
+	iq.SetToJID(j1.ToBareJID())
+	iq.SetType(xml.GetType)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	iq.SetType(xml.SetType)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.True(t, x.IsEnabled())
+
+	iq2 := xml.NewIQType(uuid.New(), xml.SetType)
+	iq2.SetFromJID(j1)
+	iq2.SetToJID(j1.ToBareJID())
+	iq2.AppendElement(xml.NewElementNamespace("disable", carbonsNamespace))
+	x.ProcessIQ(iq2)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.False(t, x.IsEnabled())
+}
+
+func TestXEP0280_ForwardMessages(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "yard", true)
+	j3, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+	j4, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	stm3 := c2s.NewMockStream(uuid.New(), j3)
+
+	for _, stm := range []*c2s.MockStream{stm1, stm2, stm3} {
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+	}
+	stm1.Context().SetBool(true, carbonsEnabledContextKey)
+	stm2.Context().SetBool(true, carbonsEnabledContextKey)
+
+	x := New(stm1)
+
+	body := xml.NewElementName("body")
+	body.SetText("Hi there!")
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j4)
+	msg.AppendElement(body)
+
+	x.ProcessSentMessage(msg)
+
+	elem := stm2.FetchElement()
+	require.NotNil(t, elem)
+	require.Equal(t, "ortuman@jackal.im", elem.From())
+	require.Equal(t, j2.String(), elem.To())
+	sent := elem.Elements().ChildNamespace("sent", carbonsNamespace)
+	require.NotNil(t, sent)
+	forwarded := sent.Elements().ChildNamespace("forwarded", forwardNamespace)
+	require.NotNil(t, forwarded)
+	require.Equal(t, msg.ID(), forwarded.Elements().Child("message").ID())
+
+	msg2 := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg2.SetFromJID(j4)
+	msg2.SetToJID(j1.ToBareJID())
+	msg2.AppendElement(body)
+
+	x.ProcessReceivedMessage(msg2)
+
+	elem = stm2.FetchElement()
+	require.NotNil(t, elem)
+	require.NotNil(t, elem.Elements().ChildNamespace("received", carbonsNamespace))
+
+	// resources which already received a bare JID message are not carboned
+	stm1.SetPresence(xml.NewPresence(j1, j1.ToBareJID(), xml.AvailableType))
+	stm2.SetPresence(xml.NewPresence(j2, j2.ToBareJID(), xml.AvailableType))
+	x.ProcessReceivedMessage(msg2)
+	require.Equal(t, &xml.Element{}, stm2.FetchElement())
+
+	// remaining resources are carboned just once, by the first recipient
+	stm3.Context().SetBool(true, carbonsEnabledContextKey)
+	New(stm2).ProcessReceivedMessage(msg2)
+	x.ProcessReceivedMessage(msg2)
+	elem = stm3.FetchElement()
+	require.NotNil(t, elem.Elements().ChildNamespace("received", carbonsNamespace))
+	require.Equal(t, &xml.Element{}, stm3.FetchElement())
+
+	// private, groupchat and error messages must not be carboned
+	msg3 := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg3.SetFromJID(j4)
+	msg3.SetToJID(j1.ToBareJID())
+	msg3.AppendElement(body)
+	msg3.AppendElement(xml.NewElementNamespace("private", carbonsNamespace))
+	require.False(t, x.isCarbonable(msg3))
+
+	msg3 = xml.NewMessageType(uuid.New(), xml.GroupChatType)
+	msg3.AppendElement(body)
+	require.False(t, x.isCarbonable(msg3))
+
+	msg3 = xml.NewMessageType(uuid.New(), xml.ErrorType)
+	msg3.AppendElement(body)
+	require.False(t, x.isCarbonable(msg3))
+}
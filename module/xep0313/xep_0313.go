@@ -0,0 +1,344 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0313
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	mamNamespace      = "urn:xmpp:mam:2"
+	forwardNamespace  = "urn:xmpp:forward:0"
+	rsmNamespace      = "http://jabber.org/protocol/rsm"
+	dataFormNamespace = "jabber:x:data"
+)
+
+const defaultMaxResults = 50
+
+var (
+	errInvalidFormType = errors.New("xep0313: invalid form type")
+	errInvalidMax      = errors.New("xep0313: invalid max value")
+)
+
+// Config represents Message Archive Management module (XEP-0313) configuration.
+type Config struct {
+	MaxResults int `yaml:"max_results"`
+}
+
+// XEPMam represents a message archive management server stream module.
+type XEPMam struct {
+	cfg     *Config
+	stm     c2s.Stream
+	actorCh chan func()
+}
+
+// New returns a message archive management IQ handler module.
+func New(config *Config, stm c2s.Stream) *XEPMam {
+	x := &XEPMam{
+		cfg:     config,
+		stm:     stm,
+		actorCh: make(chan func(), 32),
+	}
+	if stm != nil {
+		go x.actorLoop(stm.Context().Done())
+	}
+	return x
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with message archive management module.
+func (x *XEPMam) AssociatedNamespaces() []string {
+	return []string{mamNamespace}
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the message archive management module.
+func (x *XEPMam) MatchesIQ(iq *xml.IQ) bool {
+	return iq.Elements().ChildNamespace("query", mamNamespace) != nil
+}
+
+// ProcessIQ processes a message archive management IQ
+// taking according actions over the associated stream.
+func (x *XEPMam) ProcessIQ(iq *xml.IQ) {
+	x.actorCh <- func() {
+		toJid := iq.ToJID()
+		if !toJid.IsServer() && !(toJid.IsBare() && toJid.Node() == x.stm.Username()) {
+			x.stm.SendElement(iq.ForbiddenError())
+			return
+		}
+		q := iq.Elements().ChildNamespace("query", mamNamespace)
+		if iq.IsGet() {
+			x.sendQueryFields(iq)
+		} else if iq.IsSet() {
+			x.queryArchive(iq, q)
+		} else {
+			x.stm.SendElement(iq.BadRequestError())
+		}
+	}
+}
+
+// ArchiveMessage stores a message sent by the associated stream
+// into both sender and local recipient archives.
+// Both entries are keyed by the message server assigned stanza-id,
+// so that a message is never archived twice by the same user.
+func (x *XEPMam) ArchiveMessage(message *xml.Message) {
+	x.actorCh <- func() {
+		x.archiveMessage(message)
+	}
+}
+
+// ArchiveReceivedMessage stores a message delivered by a remote server
+// into its local recipient archive.
+func ArchiveReceivedMessage(message *xml.Message) error {
+	if !isArchivable(message) {
+		return nil
+	}
+	// never trust remote assigned stanza identifiers
+	return insertArchiveMessage(uuid.New(), message, message.ToJID().Node(), message.FromJID().String(), model.ArchiveReceived, time.Now().UTC())
+}
+
+// StampMessage assigns a message sent by the associated stream the
+// identifier it will be archived under by both sender and its local recipient (XEP-0359).
+func (x *XEPMam) StampMessage(message *xml.Message) {
+	toJid := message.ToJID()
+	if !isArchivable(message) || !x.isLocalRecipient(toJid) {
+		return
+	}
+	message.SetStanzaID(uuid.New(), toJid.ToBareJID().String())
+}
+
+func (x *XEPMam) actorLoop(doneCh <-chan struct{}) {
+	for {
+		select {
+		case f := <-x.actorCh:
+			f()
+		case <-doneCh:
+			return
+		}
+	}
+}
+
+func (x *XEPMam) archiveMessage(message *xml.Message) {
+	if !isArchivable(message) {
+		return
+	}
+	stamp := time.Now().UTC()
+	fromJid := message.FromJID()
+	toJid := message.ToJID()
+
+	// keep the identifier recipient has been delivered the message with
+	id := message.StanzaID(toJid.ToBareJID().String())
+	if len(id) == 0 {
+		id = uuid.New()
+	}
+	if err := insertArchiveMessage(id, message, x.stm.Username(), toJid.String(), model.ArchiveSent, stamp); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	if !x.isLocalRecipient(toJid) {
+		return
+	}
+	exists, err := storage.Instance().UserExists(toJid.Node())
+	if err != nil {
+		c2s.Logger(x.stm).Error(err)
+		return
+	}
+	if !exists {
+		return
+	}
+	if err := insertArchiveMessage(id, message, toJid.Node(), fromJid.String(), model.ArchiveReceived, stamp); err != nil {
+		c2s.Logger(x.stm).Error(err)
+	}
+}
+
+func (x *XEPMam) isLocalRecipient(toJid *xml.JID) bool {
+	return c2s.Instance().IsLocalDomain(toJid.Domain()) && len(toJid.Node()) > 0 && toJid.Node() != x.stm.Username()
+}
+
+func insertArchiveMessage(id string, message *xml.Message, username, jid, direction string, stamp time.Time) error {
+	return storage.Instance().InsertArchiveMessage(&model.ArchiveMessage{
+		ID:        id,
+		Username:  username,
+		JID:       jid,
+		Message:   message,
+		Stamp:     stamp,
+		Direction: direction,
+	})
+}
+
+func (x *XEPMam) sendQueryFields(iq *xml.IQ) {
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "form")
+
+	formType := xml.NewElementName("field")
+	formType.SetAttribute("var", "FORM_TYPE")
+	formType.SetAttribute("type", "hidden")
+	value := xml.NewElementName("value")
+	value.SetText(mamNamespace)
+	formType.AppendElement(value)
+	form.AppendElement(formType)
+
+	for _, v := range []string{"with", "start", "end"} {
+		field := xml.NewElementName("field")
+		field.SetAttribute("var", v)
+		field.SetAttribute("type", "text-single")
+		form.AppendElement(field)
+	}
+	query := xml.NewElementNamespace("query", mamNamespace)
+	query.AppendElement(form)
+
+	result := iq.ResultIQ()
+	result.AppendElement(query)
+	x.stm.SendElement(result)
+}
+
+func (x *XEPMam) queryArchive(iq *xml.IQ, query xml.XElement) {
+	filters, err := x.parseFilters(query)
+	if err != nil {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	max := filters.Max
+
+	// fetch an extra message in order to figure out whether or not this is the last page
+	filters.Max++
+	messages, err := storage.Instance().FetchArchiveMessages(x.stm.Username(), filters)
+	switch err {
+	case nil:
+		break
+	case storage.ErrArchiveMessageNotFound:
+		x.stm.SendElement(iq.ItemNotFoundError())
+		return
+	default:
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	complete := len(messages) <= max
+	if !complete {
+		if filters.IsBackwards() {
+			messages = messages[1:]
+		} else {
+			messages = messages[:max]
+		}
+	}
+	c2s.Logger(x.stm).Infof("retrieving archived messages... count: %d (%s/%s)", len(messages), x.stm.Username(), x.stm.Resource())
+
+	queryID := query.Attributes().Get("queryid")
+	userJID := x.stm.JID().ToBareJID()
+	for _, m := range messages {
+		forwarded := xml.NewElementNamespace("forwarded", forwardNamespace)
+		forwarded.AppendElement(xml.NewDelay("", m.Stamp, ""))
+		forwarded.AppendElement(m.Message)
+
+		result := xml.NewElementNamespace("result", mamNamespace)
+		if len(queryID) > 0 {
+			result.SetAttribute("queryid", queryID)
+		}
+		result.SetAttribute("id", m.ID)
+		result.AppendElement(forwarded)
+
+		msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+		msg.SetFromJID(userJID)
+		msg.SetToJID(x.stm.JID())
+		msg.AppendElement(result)
+		x.stm.SendElement(msg)
+	}
+	set := xml.NewElementNamespace("set", rsmNamespace)
+	if len(messages) > 0 {
+		first := xml.NewElementName("first")
+		first.SetText(messages[0].ID)
+		set.AppendElement(first)
+
+		last := xml.NewElementName("last")
+		last.SetText(messages[len(messages)-1].ID)
+		set.AppendElement(last)
+	}
+	fin := xml.NewElementNamespace("fin", mamNamespace)
+	if complete {
+		fin.SetAttribute("complete", "true")
+	}
+	fin.AppendElement(set)
+
+	result := iq.ResultIQ()
+	result.AppendElement(fin)
+	x.stm.SendElement(result)
+}
+
+func (x *XEPMam) parseFilters(query xml.XElement) (storage.ArchiveFilters, error) {
+	var filters storage.ArchiveFilters
+	if form := query.Elements().ChildNamespace("x", dataFormNamespace); form != nil {
+		for _, field := range form.Elements().Children("field") {
+			var value string
+			if v := field.Elements().Child("value"); v != nil {
+				value = v.Text()
+			}
+			switch field.Attributes().Get("var") {
+			case "FORM_TYPE":
+				if value != mamNamespace {
+					return filters, errInvalidFormType
+				}
+			case "with":
+				j, err := xml.NewJIDString(value, false)
+				if err != nil {
+					return filters, err
+				}
+				filters.With = j.String()
+			case "start":
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return filters, err
+				}
+				filters.Start = t
+			case "end":
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					return filters, err
+				}
+				filters.End = t
+			}
+		}
+	}
+	filters.Max = x.maxResults()
+	if set := query.Elements().ChildNamespace("set", rsmNamespace); set != nil {
+		if max := set.Elements().Child("max"); max != nil {
+			n, err := strconv.Atoi(max.Text())
+			if err != nil || n < 0 {
+				return filters, errInvalidMax
+			}
+			if n < filters.Max {
+				filters.Max = n
+			}
+		}
+		if after := set.Elements().Child("after"); after != nil {
+			filters.After = after.Text()
+		}
+		if before := set.Elements().Child("before"); before != nil {
+			filters.Before = before.Text()
+			filters.LastPage = len(filters.Before) == 0
+		}
+	}
+	return filters, nil
+}
+
+func (x *XEPMam) maxResults() int {
+	if x.cfg.MaxResults > 0 {
+		return x.cfg.MaxResults
+	}
+	return defaultMaxResults
+}
+
+func isArchivable(message *xml.Message) bool {
+	return !message.IsError() && !message.IsGroupChat() && message.IsMessageWithBody()
+}
@@ -0,0 +1,346 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0313
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/module/xep0280"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0313_Matching(t *testing.T) {
+	t.Parallel()
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := New(&Config{}, nil)
+
+	require.Equal(t, []string{mamNamespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("query", mamNamespace))
+	require.True(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0313_ArchiveMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "noelia", Password: "1234"})
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	stm.SetUsername("ortuman")
+
+	x := New(&Config{}, stm)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	x.archiveMessage(msg) // no body... not archived
+
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+	msg.AppendElement(body)
+	x.archiveMessage(msg)
+
+	msgs, _ := storage.Instance().FetchArchiveMessages("ortuman", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "noelia@jackal.im/garden", msgs[0].JID)
+
+	msgs, _ = storage.Instance().FetchArchiveMessages("noelia", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "ortuman@jackal.im/balcony", msgs[0].JID)
+}
+
+func TestXEP0313_ArchiveReceivedMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j1, _ := xml.NewJID("romeo", "remote.im", "garden", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "", true)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	require.Nil(t, ArchiveReceivedMessage(msg)) // no body... not archived
+
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+	msg.AppendElement(body)
+	msg.SetStanzaID("forged", "noelia@jackal.im")
+	require.Nil(t, ArchiveReceivedMessage(msg))
+
+	msgs, _ := storage.Instance().FetchArchiveMessages("noelia", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "romeo@remote.im/garden", msgs[0].JID)
+	require.Equal(t, model.ArchiveReceived, msgs[0].Direction)
+	require.NotEqual(t, "forged", msgs[0].ID)
+}
+
+func TestXEP0313_StampMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "noelia", Password: "1234"})
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("romeo", "example.org", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	stm.SetUsername("ortuman")
+
+	x := New(&Config{}, stm)
+
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+
+	// remote recipients assign their own identifiers
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j3)
+	msg.AppendElement(body)
+	x.StampMessage(msg)
+	require.Nil(t, msg.Elements().ChildNamespace("stanza-id", "urn:xmpp:sid:0"))
+
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(body)
+	x.StampMessage(msg)
+
+	stanzaID := msg.StanzaID("noelia@jackal.im")
+	require.NotEmpty(t, stanzaID)
+
+	// recipient archives message under its stanza-id
+	x.archiveMessage(msg)
+
+	msgs, _ := storage.Instance().FetchArchiveMessages("noelia", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, stanzaID, msgs[0].ID)
+	require.Equal(t, model.ArchiveReceived, msgs[0].Direction)
+
+	msgs, _ = storage.Instance().FetchArchiveMessages("ortuman", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, stanzaID, msgs[0].ID)
+	require.Equal(t, model.ArchiveSent, msgs[0].Direction)
+}
+
+func TestXEP0313_ArchiveCarbonsMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "noelia", Password: "1234"})
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "yard", true)
+	j3, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm1.SetUsername("ortuman")
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	stm2.SetUsername("ortuman")
+	for _, stm := range []*c2s.MockStream{stm1, stm2} {
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+	}
+	// enable carbons on second resource
+	enableIQ := xml.NewIQType(uuid.New(), xml.SetType)
+	enableIQ.SetFromJID(j2)
+	enableIQ.SetToJID(j2.ToBareJID())
+	enableIQ.AppendElement(xml.NewElementNamespace("enable", "urn:xmpp:carbons:2"))
+	xep0280.New(stm2).ProcessIQ(enableIQ)
+	require.Equal(t, xml.ResultType, stm2.FetchElement().Type())
+
+	x1 := New(&Config{}, stm1)
+	x2 := New(&Config{}, stm2)
+
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j3)
+	msg.AppendElement(body)
+	x1.StampMessage(msg)
+	xep0280.New(stm1).ProcessSentMessage(msg)
+
+	carbon := stm2.FetchElement().(*xml.Message)
+	sent := carbon.Elements().ChildNamespace("sent", "urn:xmpp:carbons:2")
+	require.NotNil(t, sent)
+	forwardedMsg, _ := xml.NewMessageFromElement(sent.Elements().ChildNamespace("forwarded", forwardNamespace).Elements().Child("message"), j1, j3)
+
+	// neither rerouted nor forked copies are archived twice
+	x1.archiveMessage(msg)
+	x1.archiveMessage(msg)
+	x2.archiveMessage(carbon)
+	x2.archiveMessage(forwardedMsg)
+
+	msgs, _ := storage.Instance().FetchArchiveMessages("noelia", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+
+	// read history from second resource
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j2)
+	iq.SetToJID(j2.ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("query", mamNamespace))
+	x2.ProcessIQ(iq)
+
+	elem := stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	result := elem.Elements().ChildNamespace("result", mamNamespace)
+	require.Equal(t, msg.StanzaID("noelia@jackal.im"), result.Attributes().Get("id"))
+	archived := result.Elements().ChildNamespace("forwarded", forwardNamespace).Elements().Child("message")
+	require.Equal(t, j1.String(), archived.From())
+	require.Equal(t, j3.String(), archived.To())
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	require.NotNil(t, elem.Elements().ChildNamespace("fin", mamNamespace))
+
+	msgs, _ = storage.Instance().FetchArchiveMessages("ortuman", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, model.ArchiveSent, msgs[0].Direction)
+}
+
+func TestXEP0313_QueryArchive(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	stm.SetUsername("ortuman")
+
+	now := time.Now()
+	for i, peer := range []string{"noelia@jackal.im", "romeo@jackal.im", "noelia@jackal.im"} {
+		storage.Instance().InsertArchiveMessage(&model.ArchiveMessage{
+			ID:       uuid.New(),
+			Username: "ortuman",
+			JID:      peer,
+			Message:  xml.NewMessageType(uuid.New(), xml.ChatType),
+			Stamp:    now.Add(time.Duration(i) * time.Second),
+		})
+	}
+	x := New(&Config{}, stm)
+
+	// forbidden...
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j2.ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("query", mamNamespace))
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements().All()[0].Name())
+
+	// filter by 'with' and page size...
+	query := xml.NewElementNamespace("query", mamNamespace)
+	query.SetAttribute("queryid", "q1")
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "submit")
+	form.AppendElement(tUtilFormField("FORM_TYPE", mamNamespace))
+	form.AppendElement(tUtilFormField("with", "noelia@jackal.im"))
+	query.AppendElement(form)
+
+	max := xml.NewElementName("max")
+	max.SetText("1")
+	set := xml.NewElementNamespace("set", rsmNamespace)
+	set.AppendElement(max)
+	query.AppendElement(set)
+
+	iq = xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j1.ToBareJID())
+	iq.AppendElement(query)
+	x.ProcessIQ(iq)
+
+	elem = stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	result := elem.Elements().ChildNamespace("result", mamNamespace)
+	require.NotNil(t, result)
+	require.Equal(t, "q1", result.Attributes().Get("queryid"))
+	require.NotNil(t, result.Elements().ChildNamespace("forwarded", forwardNamespace))
+
+	elem = stm.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, xml.ResultType, elem.Type())
+	fin := elem.Elements().ChildNamespace("fin", mamNamespace)
+	require.NotNil(t, fin)
+	require.Equal(t, "", fin.Attributes().Get("complete"))
+	last := fin.Elements().ChildNamespace("set", rsmNamespace).Elements().Child("last").Text()
+	require.Equal(t, result.Attributes().Get("id"), last)
+
+	// request next page...
+	after := xml.NewElementName("after")
+	after.SetText(last)
+	set.AppendElement(after)
+	x.ProcessIQ(iq)
+
+	elem = stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	elem = stm.FetchElement()
+	fin = elem.Elements().ChildNamespace("fin", mamNamespace)
+	require.Equal(t, "true", fin.Attributes().Get("complete"))
+
+	// unknown paging reference...
+	after.SetText(uuid.New())
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements().All()[0].Name())
+
+	// last page...
+	set.ClearElements()
+	set.AppendElement(max)
+	set.AppendElement(xml.NewElementName("before"))
+	x.ProcessIQ(iq)
+
+	elem = stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	lastID := elem.Elements().ChildNamespace("result", mamNamespace).Attributes().Get("id")
+	elem = stm.FetchElement()
+	fin = elem.Elements().ChildNamespace("fin", mamNamespace)
+	require.Equal(t, "", fin.Attributes().Get("complete"))
+	require.Equal(t, lastID, fin.Elements().ChildNamespace("set", rsmNamespace).Elements().Child("first").Text())
+	require.NotEqual(t, last, lastID)
+
+	// invalid form...
+	form.AppendElement(tUtilFormField("start", "yesterday"))
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func tUtilFormField(name, value string) xml.XElement {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", name)
+	v := xml.NewElementName("value")
+	v.SetText(value)
+	field.AppendElement(v)
+	return field
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0333
+
+import (
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const chatMarkersNamespace = "urn:xmpp:chat-markers:0"
+
+// markers acknowledging a previously sent markable message
+var chatMarkers = []string{"received", "displayed", "acknowledged"}
+
+// XEPChatMarkers represents a chat markers server stream module.
+type XEPChatMarkers struct {
+	stm c2s.Stream
+}
+
+// New returns a chat markers server stream module.
+func New(stm c2s.Stream) *XEPChatMarkers {
+	return &XEPChatMarkers{stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with chat markers module.
+func (x *XEPChatMarkers) AssociatedNamespaces() []string {
+	return []string{chatMarkersNamespace}
+}
+
+// ProcessSentMessage validates chat markers of a message sent by the
+// associated stream, returning the message to be routed untouched.
+// A marker lacking the id of the acknowledged message is bounced with
+// a bad-request error and nil is returned.
+func (x *XEPChatMarkers) ProcessSentMessage(message *xml.Message) *xml.Message {
+	for _, marker := range messageChatMarkers(message) {
+		if len(marker.Attributes().Get("id")) == 0 {
+			x.stm.SendElement(message.BadRequestError())
+			return nil
+		}
+	}
+	return message
+}
+
+// IsStandalone returns whether or not a message carries a chat marker
+// without any body to be piggybacked on.
+// Standalone markers addressed to an offline user are dropped
+// instead of being stored, archived or notified.
+func (x *XEPChatMarkers) IsStandalone(message *xml.Message) bool {
+	return !message.IsMessageWithBody() && len(messageChatMarkers(message)) > 0
+}
+
+func messageChatMarkers(message *xml.Message) []xml.XElement {
+	var markers []xml.XElement
+	for _, elem := range message.Elements().All() {
+		if elem.Namespace() != chatMarkersNamespace {
+			continue
+		}
+		for _, m := range chatMarkers {
+			if elem.Name() == m {
+				markers = append(markers, elem)
+				break
+			}
+		}
+	}
+	return markers
+}
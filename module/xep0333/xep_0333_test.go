@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0333
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0333_SentMessage(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	x := New(stm)
+	require.Equal(t, []string{chatMarkersNamespace}, x.AssociatedNamespaces())
+
+	// markable messages are routed untouched
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	msg.AppendElement(xml.NewElementNamespace("markable", chatMarkersNamespace))
+	require.Equal(t, msg, x.ProcessSentMessage(msg))
+
+	displayed := xml.NewElementNamespace("displayed", chatMarkersNamespace)
+	displayed.SetID("message-1")
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(displayed)
+	require.Equal(t, msg, x.ProcessSentMessage(msg))
+
+	// markers must reference the acknowledged message
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementNamespace("received", chatMarkersNamespace))
+	require.Nil(t, x.ProcessSentMessage(msg))
+
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+}
+
+func TestXEP0333_Standalone(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	x := New(c2s.NewMockStream(uuid.New(), j1))
+
+	acknowledged := xml.NewElementNamespace("acknowledged", chatMarkersNamespace)
+	acknowledged.SetID("message-1")
+
+	marker := xml.NewMessageType(uuid.New(), xml.ChatType)
+	marker.SetFromJID(j1)
+	marker.SetToJID(j2)
+	marker.AppendElement(acknowledged)
+	require.True(t, x.IsStandalone(marker))
+
+	// piggybacked markers
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	msg.AppendElement(acknowledged)
+	require.False(t, x.IsStandalone(msg))
+
+	markable := xml.NewMessageType(uuid.New(), xml.ChatType)
+	markable.SetFromJID(j1)
+	markable.SetToJID(j2)
+	markable.AppendElement(xml.NewElementNamespace("markable", chatMarkersNamespace))
+	require.False(t, x.IsStandalone(markable))
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0352
+
+import (
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	csiNamespace         = "urn:xmpp:csi:0"
+	pubSubEventNamespace = "http://jabber.org/protocol/pubsub#event"
+)
+
+const csiInactiveContextKey = "csi:inactive"
+
+const defaultQueueSize = 100
+
+// Config represents Client State Indication module (XEP-0352) configuration.
+type Config struct {
+	QueueSize int `yaml:"queue_size"`
+}
+
+// XEPClientState represents a client state indication server stream module.
+// Its methods are expected to be invoked from the stream actor loop.
+type XEPClientState struct {
+	cfg   *Config
+	stm   c2s.Stream
+	queue []xml.XElement
+}
+
+// New returns a client state indication server stream module.
+func New(config *Config, stm c2s.Stream) *XEPClientState {
+	return &XEPClientState{cfg: config, stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with client state indication module.
+func (x *XEPClientState) AssociatedNamespaces() []string {
+	return []string{csiNamespace}
+}
+
+// Feature returns client state indication stream feature element.
+func (x *XEPClientState) Feature() xml.XElement {
+	return xml.NewElementNamespace("csi", csiNamespace)
+}
+
+// MatchesElement returns whether or not an element should be
+// processed by the client state indication module.
+func (x *XEPClientState) MatchesElement(elem xml.XElement) bool {
+	return elem.Namespace() == csiNamespace
+}
+
+// IsActive returns whether or not the associated client is active.
+func (x *XEPClientState) IsActive() bool {
+	return !x.stm.Context().Bool(csiInactiveContextKey)
+}
+
+// ProcessElement processes a client state indication nonza, returning
+// the elements that should be immediately delivered to the client.
+func (x *XEPClientState) ProcessElement(elem xml.XElement) []xml.XElement {
+	switch elem.Name() {
+	case "active":
+		c2s.Logger(x.stm).Infof("client became active... (%s/%s)", x.stm.Username(), x.stm.Resource())
+		x.stm.Context().SetBool(false, csiInactiveContextKey)
+		return x.flush()
+	case "inactive":
+		c2s.Logger(x.stm).Infof("client became inactive... (%s/%s)", x.stm.Username(), x.stm.Resource())
+		x.stm.Context().SetBool(true, csiInactiveContextKey)
+	}
+	return nil
+}
+
+// Filter returns the elements to deliver to the client on outgoing
+// element arrival. While inactive, non-urgent traffic is queued until either
+// an urgent element arrives, the client becomes active or the queue is full.
+func (x *XEPClientState) Filter(elem xml.XElement) []xml.XElement {
+	if x.IsActive() {
+		return []xml.XElement{elem}
+	}
+	if isUrgent(elem) {
+		return append(x.flush(), elem)
+	}
+	x.enqueue(elem)
+	if len(x.queue) >= x.queueSize() {
+		return x.flush()
+	}
+	return nil
+}
+
+func (x *XEPClientState) enqueue(elem xml.XElement) {
+	if presence, ok := elem.(*xml.Presence); ok && presence.FromJID() != nil {
+		// only latest presence of every contact is relevant
+		from := presence.FromJID().String()
+		for i, queued := range x.queue {
+			if qp, ok := queued.(*xml.Presence); ok && qp.FromJID() != nil && qp.FromJID().String() == from {
+				x.queue = append(x.queue[:i], x.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	x.queue = append(x.queue, elem)
+}
+
+func (x *XEPClientState) flush() []xml.XElement {
+	elems := x.queue
+	x.queue = nil
+	return elems
+}
+
+func (x *XEPClientState) queueSize() int {
+	if x.cfg.QueueSize > 0 {
+		return x.cfg.QueueSize
+	}
+	return defaultQueueSize
+}
+
+func isUrgent(elem xml.XElement) bool {
+	switch elem := elem.(type) {
+	case *xml.Presence:
+		// subscription management presences should not be delayed
+		return !elem.IsAvailable() && !elem.IsUnavailable()
+	case *xml.Message:
+		// PEP notifications can wait
+		return elem.Elements().ChildNamespace("event", pubSubEventNamespace) == nil
+	}
+	return true
+}
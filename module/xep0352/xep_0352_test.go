@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0352
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0352_Matching(t *testing.T) {
+	x := New(&Config{}, nil)
+	require.Equal(t, []string{csiNamespace}, x.AssociatedNamespaces())
+	require.Equal(t, csiNamespace, x.Feature().Namespace())
+	require.True(t, x.MatchesElement(xml.NewElementNamespace("inactive", csiNamespace)))
+	require.False(t, x.MatchesElement(xml.NewElementNamespace("r", "urn:xmpp:sm:3")))
+}
+
+func TestXEP0352_Queueing(t *testing.T) {
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j1)
+	x := New(&Config{QueueSize: 3}, stm)
+
+	p1 := xml.NewPresence(j2, j1.ToBareJID(), xml.AvailableType)
+	require.Equal(t, 1, len(x.Filter(p1)))
+
+	require.Nil(t, x.ProcessElement(xml.NewElementNamespace("inactive", csiNamespace)))
+	require.False(t, x.IsActive())
+
+	// non-urgent traffic is queued
+	require.Nil(t, x.Filter(p1))
+	p2 := xml.NewPresence(j2, j1.ToBareJID(), xml.UnavailableType)
+	require.Nil(t, x.Filter(p2)) // replaces 'p1'
+
+	event := xml.NewMessageType(uuid.New(), xml.HeadlineType)
+	event.AppendElement(xml.NewElementNamespace("event", pubSubEventNamespace))
+	require.Nil(t, x.Filter(event))
+
+	// messages flush the queue
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	elems := x.Filter(msg)
+	require.Equal(t, 3, len(elems))
+	require.Equal(t, p2, elems[0])
+	require.Equal(t, event, elems[1])
+	require.Equal(t, msg, elems[2])
+
+	// bounded queue
+	j3, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	j4, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	require.Nil(t, x.Filter(xml.NewPresence(j2, j1.ToBareJID(), xml.AvailableType)))
+	require.Nil(t, x.Filter(xml.NewPresence(j3, j1.ToBareJID(), xml.AvailableType)))
+	require.Equal(t, 3, len(x.Filter(xml.NewPresence(j4, j1.ToBareJID(), xml.AvailableType))))
+
+	// becoming active flushes the queue
+	require.Nil(t, x.Filter(p1))
+	elems = x.ProcessElement(xml.NewElementNamespace("active", csiNamespace))
+	require.Equal(t, 1, len(elems))
+	require.True(t, x.IsActive())
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0357
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/router"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/s2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	pushNamespace           = "urn:xmpp:push:0"
+	pushSummaryNamespace    = "urn:xmpp:push:summary"
+	pubSubNamespace         = "http://jabber.org/protocol/pubsub"
+	publishOptionsNamespace = "http://jabber.org/protocol/pubsub#publish-options"
+	dataFormNamespace       = "jabber:x:data"
+)
+
+const defaultMinInterval = 10
+
+// Config represents Push Notifications module (XEP-0357) configuration.
+type Config struct {
+	MinInterval int `yaml:"min_interval"`
+}
+
+// XEPPush represents a push notifications server stream module.
+type XEPPush struct {
+	cfg     *Config
+	stm     c2s.Stream
+	actorCh chan func()
+}
+
+// New returns a push notifications IQ handler module.
+func New(config *Config, stm c2s.Stream) *XEPPush {
+	x := &XEPPush{
+		cfg:     config,
+		stm:     stm,
+		actorCh: make(chan func(), 32),
+	}
+	if stm != nil {
+		go x.actorLoop(stm.Context().Done())
+	}
+	return x
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with push notifications module.
+func (x *XEPPush) AssociatedNamespaces() []string {
+	return []string{pushNamespace}
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the push notifications module.
+func (x *XEPPush) MatchesIQ(iq *xml.IQ) bool {
+	return iq.Elements().ChildNamespace("enable", pushNamespace) != nil ||
+		iq.Elements().ChildNamespace("disable", pushNamespace) != nil
+}
+
+// ProcessIQ processes a push notifications IQ taking according actions
+// over the associated stream.
+func (x *XEPPush) ProcessIQ(iq *xml.IQ) {
+	x.actorCh <- func() {
+		toJid := iq.ToJID()
+		if !toJid.IsServer() && toJid.Node() != x.stm.Username() {
+			x.stm.SendElement(iq.ForbiddenError())
+			return
+		}
+		if !iq.IsSet() {
+			x.stm.SendElement(iq.BadRequestError())
+			return
+		}
+		if enable := iq.Elements().ChildNamespace("enable", pushNamespace); enable != nil {
+			x.enable(iq, enable)
+		} else {
+			x.disable(iq, iq.Elements().ChildNamespace("disable", pushNamespace))
+		}
+	}
+}
+
+// NotifyMessage sends a push notification to every push service
+// registered by the message recipient.
+func (x *XEPPush) NotifyMessage(message *xml.Message) {
+	if !isNotifiable(message) {
+		return
+	}
+	x.actorCh <- func() {
+		notify(x.cfg, message, c2s.Logger(x.stm).Error)
+	}
+}
+
+// NotifyRemoteMessage sends a push notification on behalf of a message
+// delivered by a remote server to every push service registered by its local recipient.
+func NotifyRemoteMessage(config *Config, message *xml.Message) {
+	if !isNotifiable(message) {
+		return
+	}
+	notify(config, message, log.Error)
+}
+
+func (x *XEPPush) actorLoop(doneCh <-chan struct{}) {
+	for {
+		select {
+		case f := <-x.actorCh:
+			f()
+		case <-doneCh:
+			return
+		}
+	}
+}
+
+func (x *XEPPush) enable(iq *xml.IQ, enable xml.XElement) {
+	jid := serviceJID(enable)
+	if jid == nil {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	reg := &model.PushRegistration{
+		Username: x.stm.Username(),
+		JID:      jid.String(),
+		Node:     enable.Attributes().Get("node"),
+	}
+	if form := enable.Elements().ChildNamespace("x", dataFormNamespace); form != nil {
+		if formType(form) != publishOptionsNamespace {
+			x.stm.SendElement(iq.BadRequestError())
+			return
+		}
+		reg.Options = form
+	}
+	if err := storage.Instance().InsertPushRegistration(reg); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	c2s.Logger(x.stm).Infof("enabled push notifications... (%s/%s) service: %s", x.stm.Username(), x.stm.Resource(), reg.JID)
+	x.stm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPPush) disable(iq *xml.IQ, disable xml.XElement) {
+	jid := serviceJID(disable)
+	if jid == nil {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	node := disable.Attributes().Get("node")
+	if err := storage.Instance().DeletePushRegistrations(x.stm.Username(), jid.String(), node); err != nil {
+		c2s.Logger(x.stm).Error(err)
+		x.stm.SendElement(iq.InternalServerError())
+		return
+	}
+	c2s.Logger(x.stm).Infof("disabled push notifications... (%s/%s) service: %s", x.stm.Username(), x.stm.Resource(), jid.String())
+	x.stm.SendElement(iq.ResultIQ())
+}
+
+func notify(cfg *Config, message *xml.Message, logError func(error)) {
+	toJID := message.ToJID()
+	regs, err := storage.Instance().FetchPushRegistrations(toJID.Node())
+	if err != nil {
+		logError(err)
+		return
+	}
+	userJID := toJID.ToBareJID()
+	for _, reg := range regs {
+		if !notifyThrottle.allow(userJID.String()+" "+reg.JID+" "+reg.Node, cfg.minInterval()) {
+			continue
+		}
+		serviceJID, err := xml.NewJIDString(reg.JID, true)
+		if err != nil {
+			logError(err)
+			continue
+		}
+		if !c2s.Instance().IsLocalDomain(serviceJID.Domain()) && !s2s.Enabled() {
+			continue // remote app servers are only reachable through federation
+		}
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetFromJID(userJID)
+		iq.SetToJID(serviceJID)
+		iq.AppendElement(pubSubNotification(&reg, message))
+
+		if err := c2s.Instance().MustRoute(iq); err != nil && err != router.ErrDropped {
+			logError(err)
+		}
+	}
+}
+
+func pubSubNotification(reg *model.PushRegistration, message *xml.Message) xml.XElement {
+	summary := xml.NewElementNamespace("x", dataFormNamespace)
+	summary.SetAttribute("type", "submit")
+	summary.AppendElement(formField("FORM_TYPE", pushSummaryNamespace))
+	summary.AppendElement(formField("message-count", "1"))
+	summary.AppendElement(formField("last-message-sender", message.FromJID().String()))
+
+	notification := xml.NewElementNamespace("notification", pushNamespace)
+	notification.AppendElement(summary)
+
+	item := xml.NewElementName("item")
+	item.AppendElement(notification)
+
+	publish := xml.NewElementName("publish")
+	publish.SetAttribute("node", reg.Node)
+	publish.AppendElement(item)
+
+	pubSub := xml.NewElementNamespace("pubsub", pubSubNamespace)
+	pubSub.AppendElement(publish)
+	if reg.Options != nil {
+		publishOptions := xml.NewElementName("publish-options")
+		publishOptions.AppendElement(reg.Options)
+		pubSub.AppendElement(publishOptions)
+	}
+	return pubSub
+}
+
+func (c *Config) minInterval() time.Duration {
+	if c.MinInterval > 0 {
+		return time.Second * time.Duration(c.MinInterval)
+	}
+	return time.Second * defaultMinInterval
+}
+
+func isNotifiable(message *xml.Message) bool {
+	if !message.IsNormal() && !message.IsChat() {
+		return false
+	}
+	return message.IsMessageWithBody()
+}
+
+func serviceJID(elem xml.XElement) *xml.JID {
+	jidStr := elem.Attributes().Get("jid")
+	if len(jidStr) == 0 {
+		return nil
+	}
+	jid, err := xml.NewJIDString(jidStr, false)
+	if err != nil {
+		return nil
+	}
+	return jid
+}
+
+func formType(form xml.XElement) string {
+	for _, field := range form.Elements().Children("field") {
+		if field.Attributes().Get("var") != "FORM_TYPE" {
+			continue
+		}
+		if v := field.Elements().Child("value"); v != nil {
+			return v.Text()
+		}
+	}
+	return ""
+}
+
+func formField(name, value string) xml.XElement {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", name)
+	v := xml.NewElementName("value")
+	v.SetText(value)
+	field.AppendElement(v)
+	return field
+}
+
+// throttle keeps track of last notification sent to every push service node,
+// preventing message bursts from flooding the push service.
+type throttle struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+var notifyThrottle = &throttle{last: make(map[string]time.Time)}
+
+func (t *throttle) allow(key string, interval time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if last, ok := t.last[key]; ok && now.Sub(last) < interval {
+		return false
+	}
+	t.last[key] = now
+
+	// purge expired entries
+	for k, last := range t.last {
+		if now.Sub(last) >= interval {
+			delete(t.last, k)
+		}
+	}
+	return true
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0357
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/s2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0357_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := New(&Config{}, nil)
+	require.Equal(t, []string{pushNamespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	iq.AppendElement(xml.NewElementNamespace("enable", pushNamespace))
+	require.True(t, x.MatchesIQ(iq))
+
+	iq2 := xml.NewIQType(uuid.New(), xml.SetType)
+	iq2.SetFromJID(j)
+	iq2.SetToJID(j.ToBareJID())
+	iq2.AppendElement(xml.NewElementNamespace("disable", pushNamespace))
+	require.True(t, x.MatchesIQ(iq2))
+
+	iq3 := xml.NewIQType(uuid.New(), xml.SetType)
+	iq3.SetFromJID(j)
+	iq3.SetToJID(j.ToBareJID())
+	iq3.AppendElement(xml.NewElementNamespace("enable", "urn:xmpp:push:1"))
+	require.False(t, x.MatchesIQ(iq3))
+}
+
+func TestXEP0357_EnableDisable(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	stm.SetUsername("ortuman")
+
+	x := New(&Config{}, stm)
+
+	// missing service JID
+	x.ProcessIQ(tUtilPushIQ(j, "enable", "", "n1", nil))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	// wrong publish options form
+	x.ProcessIQ(tUtilPushIQ(j, "enable", "push.jackal.im", "n1", tUtilForm("urn:xmpp:mam:2")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	x.ProcessIQ(tUtilPushIQ(j, "enable", "push.jackal.im", "n1", tUtilForm(publishOptionsNamespace)))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	x.ProcessIQ(tUtilPushIQ(j, "enable", "push.jackal.im", "n2", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	regs, _ := storage.Instance().FetchPushRegistrations("ortuman")
+	require.Equal(t, 2, len(regs))
+	require.NotNil(t, regs[0].Options)
+
+	x.ProcessIQ(tUtilPushIQ(j, "disable", "push.jackal.im", "n1", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	regs, _ = storage.Instance().FetchPushRegistrations("ortuman")
+	require.Equal(t, 1, len(regs))
+
+	storage.ActivateMockedError()
+	x.ProcessIQ(tUtilPushIQ(j, "disable", "push.jackal.im", "", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements().All()[0].Name())
+	storage.DeactivateMockedError()
+}
+
+func TestXEP0357_Notify(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("push", "jackal.im", "srv", true)
+
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm1.SetUsername("ortuman")
+
+	service := c2s.NewMockStream(uuid.New(), j3)
+	service.SetAuthenticated(true)
+	c2s.Instance().RegisterStream(service)
+	c2s.Instance().AuthenticateStream(service)
+
+	x := New(&Config{}, stm1)
+	x.ProcessIQ(tUtilPushIQ(j1, "enable", "push@jackal.im", uuid.New(), tUtilForm(publishOptionsNamespace)))
+	require.Equal(t, xml.ResultType, stm1.FetchElement().Type())
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j2)
+	msg.SetToJID(j1.ToBareJID())
+
+	// messages without body are not notified
+	x.NotifyMessage(msg)
+
+	msg.AppendElement(xml.NewElementName("body"))
+	x.NotifyMessage(msg)
+	x.NotifyMessage(msg) // throttled
+
+	elem := service.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, "ortuman@jackal.im", elem.From())
+	pubSub := elem.Elements().ChildNamespace("pubsub", pubSubNamespace)
+	require.NotNil(t, pubSub)
+	notification := pubSub.Elements().Child("publish").Elements().Child("item").Elements().ChildNamespace("notification", pushNamespace)
+	require.NotNil(t, notification)
+	require.NotNil(t, pubSub.Elements().Child("publish-options"))
+
+	elem = service.FetchElement()
+	require.Equal(t, "", elem.Name())
+}
+
+func TestXEP0357_NotifyRemoteService(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	out := &fakeOutStream{}
+	s2s.Initialize(&s2s.Config{}, func(localDomain, remoteDomain string) s2s.OutStream {
+		return out
+	})
+	defer s2s.Shutdown()
+
+	j1, _ := xml.NewJID("romeo", "remote.im", "garden", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "", true)
+
+	storage.Instance().InsertPushRegistration(&model.PushRegistration{Username: "noelia", JID: "push.remote.im", Node: "n1"})
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	NotifyRemoteMessage(&Config{}, msg)
+
+	elems := out.elements()
+	require.Equal(t, 1, len(elems))
+	require.Equal(t, "iq", elems[0].Name())
+	require.Equal(t, "noelia@jackal.im", elems[0].From())
+	require.Equal(t, "push.remote.im", elems[0].To())
+	require.NotNil(t, elems[0].Elements().ChildNamespace("pubsub", pubSubNamespace))
+}
+
+type fakeOutStream struct {
+	mu    sync.Mutex
+	elems []xml.XElement
+}
+
+func (f *fakeOutStream) ID() string { return "fake" }
+
+func (f *fakeOutStream) Disconnect(err error) {}
+
+func (f *fakeOutStream) SendElement(elem xml.XElement) {
+	f.mu.Lock()
+	f.elems = append(f.elems, elem)
+	f.mu.Unlock()
+}
+
+func (f *fakeOutStream) elements() []xml.XElement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.elems
+}
+
+func tUtilPushIQ(from *xml.JID, name, jid, node string, form xml.XElement) *xml.IQ {
+	elem := xml.NewElementNamespace(name, pushNamespace)
+	if len(jid) > 0 {
+		elem.SetAttribute("jid", jid)
+	}
+	if len(node) > 0 {
+		elem.SetAttribute("node", node)
+	}
+	if form != nil {
+		elem.AppendElement(form)
+	}
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(from)
+	iq.SetToJID(from.ToBareJID())
+	iq.AppendElement(elem)
+	return iq
+}
+
+func tUtilForm(formType string) xml.XElement {
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "submit")
+	form.AppendElement(formField("FORM_TYPE", formType))
+	form.AppendElement(formField("secret", "eruio234vzxc2kla-91"))
+	return form
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0363
+
+import (
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+)
+
+// Handler represents the HTTP handler accepting uploads
+// at signed slot URLs and serving uploaded files.
+type Handler struct {
+	cfg      *Config
+	basePath string
+}
+
+// NewHandler returns an HTTP file upload handler.
+func NewHandler(config *Config) *Handler {
+	h := &Handler{cfg: config}
+	if u, err := url.Parse(config.BaseURL); err == nil {
+		h.basePath = strings.TrimSuffix(u.Path, "/")
+	}
+	return h
+}
+
+// ServeHTTP satisfies http.Handler interface.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, PUT, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	slotID, filename, ok := h.parsePath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		h.put(w, r, slotID, filename)
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r, slotID, filename)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, slotID, filename string) {
+	q := r.URL.Query()
+	size, err1 := strconv.ParseInt(q.Get("size"), 10, 64)
+	expires, err2 := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err1 != nil || err2 != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	signature := signSlot(h.cfg.Secret, slotID, filename, size, expires)
+	if !hmac.Equal([]byte(signature), []byte(q.Get("signature"))) || time.Now().Unix() > expires {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.ContentLength != size {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dir := filepath.Join(h.cfg.StoragePath, slotID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	filePath := filepath.Join(dir, filename)
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, size))
+	f.Close()
+	if err != nil || n != size {
+		os.Remove(filePath)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, slotID, filename string) {
+	f, err := os.Open(filepath.Join(h.cfg.StoragePath, slotID, filename))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, filename, fi.ModTime(), f)
+}
+
+func (h *Handler) parsePath(p string) (slotID, filename string, ok bool) {
+	if !strings.HasPrefix(p, h.basePath+"/") {
+		return "", "", false
+	}
+	parts := strings.Split(p[len(h.basePath)+1:], "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	if sanitizeFilename(parts[1]) != parts[1] || strings.Contains(parts[0], "..") {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0363
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_UploadDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackal_upload")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	h := NewHandler(&Config{BaseURL: "https://upload.jackal.im/files", StoragePath: dir, Secret: "s3cr3t"})
+
+	content := "hello world"
+	expires := time.Now().Add(time.Minute).Unix()
+	sig := signSlot("s3cr3t", "abcd", "a b.txt", int64(len(content)), expires)
+	putURL := "/files/abcd/a%20b.txt?size=11&expires=" + strconv.FormatInt(expires, 10) + "&signature=" + sig
+
+	// bad signature
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/files/abcd/a%20b.txt?size=11&expires="+strconv.FormatInt(expires, 10)+"&signature=00", strings.NewReader(content)))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// size mismatch
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, putURL, strings.NewReader(content+"!")))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, putURL, strings.NewReader(content)))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// slot already used
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, putURL, strings.NewReader(content)))
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/abcd/a%20b.txt", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, content, rec.Body.String())
+	require.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+
+	for _, p := range []string{"/files/abcd/missing.txt", "/files/abcd", "/other/abcd/a%20b.txt", "/files/../a%20b.txt"} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		require.Equal(t, http.StatusNotFound, rec.Code, p)
+	}
+}
+
+func TestHandler_ExpiredSlot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackal_upload")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	h := NewHandler(&Config{BaseURL: "http://localhost:5443", StoragePath: dir, Secret: "s3cr3t"})
+
+	expires := time.Now().Add(-time.Second).Unix()
+	sig := signSlot("s3cr3t", "abcd", "a.txt", 1, expires)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/abcd/a.txt?size=1&expires="+strconv.FormatInt(expires, 10)+"&signature="+sig, strings.NewReader("a")))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/abcd/a.txt", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0363
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	uploadNamespace   = "urn:xmpp:http:upload:0"
+	dataFormNamespace = "jabber:x:data"
+)
+
+const (
+	defaultPort        = 5443
+	defaultMaxFileSize = 10 * 1024 * 1024
+	defaultExpiration  = 300
+)
+
+// Config represents HTTP File Upload module (XEP-0363) configuration.
+type Config struct {
+	BaseURL     string `yaml:"base_url"`
+	BindAddress string `yaml:"bind_addr"`
+	Port        int    `yaml:"port"`
+	StoragePath string `yaml:"storage_path"`
+	Secret      string `yaml:"secret"`
+	MaxFileSize int64  `yaml:"max_file_size"`
+	Expiration  int    `yaml:"expiration"`
+}
+
+// Address returns the address the upload HTTP handler should listen at.
+func (cfg *Config) Address() string {
+	port := cfg.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return cfg.BindAddress + ":" + strconv.Itoa(port)
+}
+
+func (cfg *Config) maxFileSize() int64 {
+	if cfg.MaxFileSize > 0 {
+		return cfg.MaxFileSize
+	}
+	return defaultMaxFileSize
+}
+
+func (cfg *Config) expiration() time.Duration {
+	if cfg.Expiration > 0 {
+		return time.Second * time.Duration(cfg.Expiration)
+	}
+	return time.Second * defaultExpiration
+}
+
+// XEPHTTPUpload represents an HTTP file upload server stream module.
+type XEPHTTPUpload struct {
+	cfg *Config
+	stm c2s.Stream
+}
+
+// New returns an HTTP file upload IQ handler module.
+func New(config *Config, stm c2s.Stream) *XEPHTTPUpload {
+	return &XEPHTTPUpload{cfg: config, stm: stm}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with HTTP file upload module.
+func (x *XEPHTTPUpload) AssociatedNamespaces() []string {
+	return []string{uploadNamespace}
+}
+
+// DiscoExtension returns the service discovery form
+// advertising the maximum allowed file size.
+func (x *XEPHTTPUpload) DiscoExtension() xml.XElement {
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "result")
+	form.AppendElement(formField("FORM_TYPE", uploadNamespace, "hidden"))
+	form.AppendElement(formField("max-file-size", strconv.FormatInt(x.cfg.maxFileSize(), 10), ""))
+	return form
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the HTTP file upload module.
+func (x *XEPHTTPUpload) MatchesIQ(iq *xml.IQ) bool {
+	return iq.IsGet() && iq.ToJID().IsServer() && iq.Elements().ChildNamespace("request", uploadNamespace) != nil
+}
+
+// ProcessIQ processes an HTTP file upload slot request
+// taking according actions over the associated stream.
+func (x *XEPHTTPUpload) ProcessIQ(iq *xml.IQ) {
+	req := iq.Elements().ChildNamespace("request", uploadNamespace)
+	filename := sanitizeFilename(req.Attributes().Get("filename"))
+	size, err := strconv.ParseInt(req.Attributes().Get("size"), 10, 64)
+	if len(filename) == 0 || err != nil || size <= 0 {
+		x.stm.SendElement(iq.BadRequestError())
+		return
+	}
+	if size > x.cfg.maxFileSize() {
+		maxSize := xml.NewElementName("max-file-size")
+		maxSize.SetText(strconv.FormatInt(x.cfg.maxFileSize(), 10))
+		tooLarge := xml.NewElementNamespace("file-too-large", uploadNamespace)
+		tooLarge.AppendElement(maxSize)
+		x.stm.SendElement(xml.NewErrorElementFromElement(iq, xml.ErrNotAcceptable.(*xml.StanzaError), []xml.XElement{tooLarge}))
+		return
+	}
+	slotID := uuid.New()
+	slotPath := slotID + "/" + url.PathEscape(filename)
+	expires := time.Now().Add(x.cfg.expiration()).Unix()
+
+	q := url.Values{}
+	q.Set("size", strconv.FormatInt(size, 10))
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", signSlot(x.cfg.Secret, slotID, filename, size, expires))
+
+	baseURL := strings.TrimSuffix(x.cfg.BaseURL, "/")
+	put := xml.NewElementName("put")
+	put.SetAttribute("url", baseURL+"/"+slotPath+"?"+q.Encode())
+	get := xml.NewElementName("get")
+	get.SetAttribute("url", baseURL+"/"+slotPath)
+
+	slot := xml.NewElementNamespace("slot", uploadNamespace)
+	slot.AppendElement(put)
+	slot.AppendElement(get)
+
+	c2s.Logger(x.stm).Infof("assigned upload slot... (%s/%s) file: %s (%d bytes)", x.stm.Username(), x.stm.Resource(), filename, size)
+
+	result := iq.ResultIQ()
+	result.AppendElement(slot)
+	x.stm.SendElement(result)
+}
+
+// signSlot returns the signature authorizing a slot upload.
+func signSlot(secret, slotID, filename string, size, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s/%s\n%d\n%d", slotID, filename, size, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func sanitizeFilename(filename string) string {
+	filename = path.Base(strings.Replace(filename, "\\", "/", -1))
+	switch filename {
+	case ".", "..", "/":
+		return ""
+	}
+	return filename
+}
+
+func formField(name, value, fieldType string) xml.XElement {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", name)
+	if len(fieldType) > 0 {
+		field.SetAttribute("type", fieldType)
+	}
+	v := xml.NewElementName("value")
+	v.SetText(value)
+	field.AppendElement(v)
+	return field
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xep0363
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0363_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	srvJID, _ := xml.NewJID("", "jackal.im", "", true)
+
+	x := New(&Config{}, nil)
+	require.Equal(t, []string{uploadNamespace}, x.AssociatedNamespaces())
+
+	iq := tUtilSlotRequestIQ(j, srvJID, "a.jpg", "1024")
+	require.True(t, x.MatchesIQ(iq))
+
+	iq = tUtilSlotRequestIQ(j, j.ToBareJID(), "a.jpg", "1024")
+	require.False(t, x.MatchesIQ(iq))
+
+	iq = tUtilSlotRequestIQ(j, srvJID, "a.jpg", "1024")
+	iq.SetType(xml.SetType)
+	require.False(t, x.MatchesIQ(iq))
+
+	form := x.DiscoExtension()
+	require.Equal(t, dataFormNamespace, form.Namespace())
+	require.Equal(t, "10485760", form.Elements().Children("field")[1].Elements().Child("value").Text())
+}
+
+func TestXEP0363_SlotRequest(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	srvJID, _ := xml.NewJID("", "jackal.im", "", true)
+
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := New(&Config{BaseURL: "https://upload.jackal.im/files/", Secret: "s3cr3t", MaxFileSize: 2048}, stm)
+
+	x.ProcessIQ(tUtilSlotRequestIQ(j, srvJID, "", "1024"))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	x.ProcessIQ(tUtilSlotRequestIQ(j, srvJID, "a.jpg", "abc"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements().All()[0].Name())
+
+	x.ProcessIQ(tUtilSlotRequestIQ(j, srvJID, "a.jpg", "4096"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements().All()[0].Name())
+	tooLarge := elem.Error().Elements().ChildNamespace("file-too-large", uploadNamespace)
+	require.NotNil(t, tooLarge)
+	require.Equal(t, "2048", tooLarge.Elements().Child("max-file-size").Text())
+
+	x.ProcessIQ(tUtilSlotRequestIQ(j, srvJID, "../très cool.jpg", "1024"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	slot := elem.Elements().ChildNamespace("slot", uploadNamespace)
+	require.NotNil(t, slot)
+
+	putURL := slot.Elements().Child("put").Attributes().Get("url")
+	getURL := slot.Elements().Child("get").Attributes().Get("url")
+	require.Regexp(t, `^https://upload\.jackal\.im/files/[^/]+/tr%C3%A8s%20cool\.jpg$`, getURL)
+	require.Contains(t, putURL, getURL+"?")
+	require.Contains(t, putURL, "signature=")
+}
+
+func tUtilSlotRequestIQ(from, to *xml.JID, filename, size string) *xml.IQ {
+	req := xml.NewElementNamespace("request", uploadNamespace)
+	if len(filename) > 0 {
+		req.SetAttribute("filename", filename)
+	}
+	req.SetAttribute("size", size)
+	req.SetAttribute("content-type", "image/jpeg")
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(from)
+	iq.SetToJID(to)
+	iq.AppendElement(req)
+	return iq
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+// ErrDropped will be returned when routing a stanza
+// that has been dropped by a routing hook.
+var ErrDropped = errors.New("router: stanza dropped")
+
+// Direction represents a routed stanza direction.
+type Direction int
+
+const (
+	// Inbound represents a stanza addressed to a local entity.
+	Inbound Direction = iota
+
+	// Outbound represents a stanza addressed to a remote domain.
+	Outbound
+)
+
+// String returns Direction string representation.
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	}
+	return ""
+}
+
+// Hook represents a routing middleware, invoked for every stanza before its delivery.
+type Hook interface {
+	// ProcessStanza inspects a routed stanza, returning the stanza to be delivered.
+	// It may return a modified copy, or nil to drop the stanza, in which case
+	// no further hook is invoked.
+	ProcessStanza(stanza xml.Stanza, dir Direction) xml.Stanza
+}
+
+// HookFunc type is an adapter to allow the use of ordinary functions as routing hooks.
+type HookFunc func(stanza xml.Stanza, dir Direction) xml.Stanza
+
+// ProcessStanza satisfies Hook interface.
+func (f HookFunc) ProcessStanza(stanza xml.Stanza, dir Direction) xml.Stanza {
+	return f(stanza, dir)
+}
+
+type registration struct {
+	name     string
+	priority int
+	hook     Hook
+}
+
+var (
+	hooksMu sync.RWMutex
+	hooks   []registration
+)
+
+// RegisterHook adds a routing hook under the provided name.
+// Hooks are invoked in descending priority order, and those sharing
+// the same priority in registration order.
+// If RegisterHook is called twice with the same name or if hook is nil, it panics.
+func RegisterHook(name string, priority int, hook Hook) {
+	if hook == nil {
+		panic("router: RegisterHook hook is nil")
+	}
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	for _, reg := range hooks {
+		if reg.name == name {
+			panic(fmt.Sprintf("router: RegisterHook called twice for hook %s", name))
+		}
+	}
+	// registrations are replaced instead of modified in place,
+	// so that slices handed out to ongoing routings remain unaltered
+	regs := make([]registration, len(hooks), len(hooks)+1)
+	copy(regs, hooks)
+	regs = append(regs, registration{name: name, priority: priority, hook: hook})
+	sort.SliceStable(regs, func(i, j int) bool { return regs[i].priority > regs[j].priority })
+	hooks = regs
+}
+
+// UnregisterHook removes the routing hook registered under the provided name.
+func UnregisterHook(name string) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	regs := make([]registration, 0, len(hooks))
+	for _, reg := range hooks {
+		if reg.name != name {
+			regs = append(regs, reg)
+		}
+	}
+	hooks = regs
+}
+
+// ProcessStanza runs a stanza through the registered hook chain,
+// returning the stanza to be delivered or nil if it has been dropped.
+func ProcessStanza(stanza xml.Stanza, dir Direction) xml.Stanza {
+	hooksMu.RLock()
+	regs := hooks
+	hooksMu.RUnlock()
+
+	for _, reg := range regs {
+		if stanza = reg.hook.ProcessStanza(stanza, dir); stanza == nil {
+			return nil
+		}
+	}
+	return stanza
+}
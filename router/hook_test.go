@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package router
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHook_ExecutionOrder(t *testing.T) {
+	var calls []string
+	hookNamed := func(name string) Hook {
+		return HookFunc(func(stanza xml.Stanza, dir Direction) xml.Stanza {
+			calls = append(calls, name)
+			return stanza
+		})
+	}
+	RegisterHook("logging", 0, hookNamed("logging"))
+	defer UnregisterHook("logging")
+	RegisterHook("spam", 10, hookNamed("spam"))
+	defer UnregisterHook("spam")
+	RegisterHook("archive", 0, hookNamed("archive"))
+	defer UnregisterHook("archive")
+
+	msg := tUtilHookMessage()
+	require.Equal(t, msg, ProcessStanza(msg, Inbound))
+	require.Equal(t, []string{"spam", "logging", "archive"}, calls)
+
+	// registering a hook twice is not allowed
+	require.Panics(t, func() { RegisterHook("spam", 0, hookNamed("spam")) })
+	require.Panics(t, func() { RegisterHook("nil", 0, nil) })
+
+	UnregisterHook("spam")
+	calls = nil
+	ProcessStanza(msg, Outbound)
+	require.Equal(t, []string{"logging", "archive"}, calls)
+}
+
+func TestHook_DropAndModify(t *testing.T) {
+	var reached bool
+	RegisterHook("drop_outbound", 10, HookFunc(func(stanza xml.Stanza, dir Direction) xml.Stanza {
+		if dir == Outbound {
+			return nil
+		}
+		return stanza
+	}))
+	defer UnregisterHook("drop_outbound")
+	RegisterHook("subject", 0, HookFunc(func(stanza xml.Stanza, dir Direction) xml.Stanza {
+		reached = true
+		msg, _ := xml.NewMessageFromElement(stanza, stanza.FromJID(), stanza.ToJID())
+		subject := xml.NewElementName("subject")
+		subject.SetText("hooked")
+		msg.AppendElement(subject)
+		return msg
+	}))
+	defer UnregisterHook("subject")
+
+	// dropped stanzas never reach lower priority hooks
+	require.Nil(t, ProcessStanza(tUtilHookMessage(), Outbound))
+	require.False(t, reached)
+
+	processed := ProcessStanza(tUtilHookMessage(), Inbound)
+	require.NotNil(t, processed)
+	require.True(t, reached)
+	require.Equal(t, "hooked", processed.Elements().Child("subject").Text())
+}
+
+func tUtilHookMessage() *xml.Message {
+	from, _ := xml.NewJIDString("romeo@jackal.im/garden", true)
+	to, _ := xml.NewJIDString("ortuman@jackal.im/balcony", true)
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	return msg
+}
@@ -5,7 +5,12 @@
 
 package server
 
-import "github.com/ortuman/jackal/xml"
+import (
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
 
 const saslNamespace = "urn:ietf:params:xml:ns:xmpp-sasl"
 
@@ -45,3 +50,51 @@ var (
 	errSASLNotAuthorized        = newSASLError("not-authorized")
 	errSASLTemporaryAuthFailure = newSASLError("temporary-auth-failure")
 )
+
+// requiresStoredCredentials returns whether or not a configured SASL mechanism
+// is a challenge-response one, thus requiring stored user credentials.
+func requiresStoredCredentials(mechanism string) bool {
+	switch mechanism {
+	case "digest_md5", "scram_sha_1", "scram_sha_256":
+		return true
+	}
+	return false
+}
+
+// requiresPlainPassword returns whether or not a configured SASL mechanism
+// can only verify passwords stored in plaintext.
+func requiresPlainPassword(mechanism string) bool {
+	switch mechanism {
+	case "digest_md5", "scram_sha_1":
+		return true
+	}
+	return false
+}
+
+// fetchCredentials returns the stored credentials of a user, or nil
+// if the authentication provider doesn't expose them.
+func fetchCredentials(username string) (*model.User, error) {
+	cp, ok := auth.Instance().(auth.CredentialsProvider)
+	if !ok {
+		return nil, nil
+	}
+	return cp.FetchCredentials(username)
+}
+
+// storeExternalUser creates the storage account of a user authenticated
+// by an external provider the first time it logs in, as local stanza
+// routing and user data rely on it.
+func storeExternalUser(username string) error {
+	if _, ok := auth.Instance().(auth.CredentialsProvider); ok {
+		return nil
+	}
+	exists, err := storage.Instance().UserExists(username)
+	if err != nil || exists {
+		return err
+	}
+	err = storage.Instance().InsertUser(&model.User{Username: username})
+	if err == storage.ErrUserExists {
+		return nil
+	}
+	return err
+}
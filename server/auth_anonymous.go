@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+type anonymousAuthenticator struct {
+	strm          c2s.Stream
+	username      string
+	authenticated bool
+}
+
+func newAnonymousAuthenticator(strm c2s.Stream) *anonymousAuthenticator {
+	return &anonymousAuthenticator{strm: strm}
+}
+
+func (a *anonymousAuthenticator) Mechanism() string {
+	return "ANONYMOUS"
+}
+
+func (a *anonymousAuthenticator) Username() string {
+	return a.username
+}
+
+func (a *anonymousAuthenticator) Authenticated() bool {
+	return a.authenticated
+}
+
+func (a *anonymousAuthenticator) UsesChannelBinding() bool {
+	return false
+}
+
+func (a *anonymousAuthenticator) ProcessElement(elem xml.XElement) error {
+	if a.authenticated {
+		return nil
+	}
+	// optional trace information is ignored
+	username := uuid.New()
+	exists, err := storage.Instance().UserExists(username)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errSASLTemporaryAuthFailure
+	}
+	a.username = username
+	a.authenticated = true
+
+	a.strm.SendElement(xml.NewElementNamespace("success", saslNamespace))
+	return nil
+}
+
+func (a *anonymousAuthenticator) Reset() {
+	a.username = ""
+	a.authenticated = false
+}
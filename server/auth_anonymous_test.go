@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthAnonymousAuthentication(t *testing.T) {
+	testStm := authTestSetup(&model.User{Username: "mariana", Password: "1234"})
+	defer authTestTeardown()
+
+	authr := newAnonymousAuthenticator(testStm)
+	require.Equal(t, "ANONYMOUS", authr.Mechanism())
+	require.False(t, authr.UsesChannelBinding())
+
+	elem := xml.NewElementNamespace("auth", "urn:ietf:params:xml:ns:xmpp-sasl")
+	elem.SetAttribute("mechanism", "ANONYMOUS")
+
+	// storage error...
+	storage.ActivateMockedError()
+	require.Equal(t, storage.ErrMockedError, authr.ProcessElement(elem))
+	require.False(t, authr.Authenticated())
+	storage.DeactivateMockedError()
+
+	elem.SetText("c2lyaGM=") // trace data
+	require.Nil(t, authr.ProcessElement(elem))
+	require.True(t, authr.Authenticated())
+	username := authr.Username()
+	require.NotEqual(t, 0, len(username))
+	require.Equal(t, "success", testStm.FetchElement().Name())
+
+	// already authenticated...
+	require.Nil(t, authr.ProcessElement(elem))
+	require.Equal(t, username, authr.Username())
+
+	// every authentication gets a new random username
+	authr.Reset()
+	require.False(t, authr.Authenticated())
+	require.Nil(t, authr.ProcessElement(elem))
+	require.NotEqual(t, username, authr.Username())
+}
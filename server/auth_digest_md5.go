@@ -13,7 +13,6 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/util"
@@ -176,11 +175,11 @@ func (d *digestMD5Authenticator) handleChallenged(elem xml.XElement) error {
 		return errSASLNotAuthorized
 	}
 	// validate user
-	user, err := storage.Instance().FetchUser(params.username)
+	user, err := fetchCredentials(params.username)
 	if err != nil {
 		return err
 	}
-	if user == nil {
+	if user == nil || !user.HasPlainPassword() {
 		return errSASLNotAuthorized
 	}
 	// validate response
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidXMPPAddr       = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 5}
+)
+
+type externalAuthenticator struct {
+	strm          c2s.Stream
+	tr            transport.Transport
+	cfg           *SASLExternalConfig
+	username      string
+	authenticated bool
+}
+
+func newExternalAuthenticator(strm c2s.Stream, tr transport.Transport, cfg *SASLExternalConfig) *externalAuthenticator {
+	return &externalAuthenticator{strm: strm, tr: tr, cfg: cfg}
+}
+
+func (e *externalAuthenticator) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (e *externalAuthenticator) Username() string {
+	return e.username
+}
+
+func (e *externalAuthenticator) Authenticated() bool {
+	return e.authenticated
+}
+
+func (e *externalAuthenticator) UsesChannelBinding() bool {
+	return false
+}
+
+func (e *externalAuthenticator) ProcessElement(elem xml.XElement) error {
+	if e.authenticated {
+		return nil
+	}
+	var authzID string
+	if txt := elem.Text(); len(txt) > 0 && txt != "=" {
+		b, err := base64.StdEncoding.DecodeString(txt)
+		if err != nil {
+			return errSASLIncorrectEncoding
+		}
+		authzID = string(b)
+	}
+	certs := e.tr.PeerCertificates()
+	if len(certs) == 0 {
+		return errSASLNotAuthorized
+	}
+	if err := e.verifyCertificates(certs); err != nil {
+		return err
+	}
+	username := e.mapUsername(certificateIdentities(certs[0]), authzID)
+	if len(username) == 0 {
+		return errSASLNotAuthorized
+	}
+	exists, err := auth.Instance().UserExists(username)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errSASLNotAuthorized
+	}
+	e.username = username
+	e.authenticated = true
+
+	e.strm.SendElement(xml.NewElementNamespace("success", saslNamespace))
+	return nil
+}
+
+func (e *externalAuthenticator) Reset() {
+	e.username = ""
+	e.authenticated = false
+}
+
+func (e *externalAuthenticator) verifyCertificates(certs []*x509.Certificate) error {
+	opts := x509.VerifyOptions{
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(e.cfg.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(e.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+		opts.Roots = x509.NewCertPool()
+		if !opts.Roots.AppendCertsFromPEM(pem) {
+			return errors.New("auth_external: no valid certificates found in CA file")
+		}
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return errSASLNotAuthorized
+	}
+	return nil
+}
+
+// mapUsername returns the local username a certificate identity maps to.
+// Whenever an authorization identity is requested, it must match one
+// of the certificate identities.
+func (e *externalAuthenticator) mapUsername(identities []string, authzID string) string {
+	for _, identity := range identities {
+		j, err := xml.NewJIDString(identity, false)
+		if err != nil || len(j.Node()) == 0 {
+			continue
+		}
+		if e.cfg.RequireDomainMatch && j.Domain() != e.strm.Domain() {
+			continue
+		}
+		if len(authzID) > 0 && j.ToBareJID().String() != authzID {
+			continue
+		}
+		return j.Node()
+	}
+	return ""
+}
+
+// certificateIdentities returns the identities a client certificate has been
+// issued for: xmppAddr and email subject alternative names, or its subject
+// common name when none of them is present.
+func certificateIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSubjectAltName) {
+			identities = append(identities, xmppAddrs(ext.Value)...)
+		}
+	}
+	identities = append(identities, cert.EmailAddresses...)
+	if len(identities) == 0 && len(cert.Subject.CommonName) > 0 {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return identities
+}
+
+func xmppAddrs(subjectAltName []byte) []string {
+	var seq asn1.RawValue
+	if rest, err := asn1.Unmarshal(subjectAltName, &seq); err != nil || len(rest) > 0 {
+		return nil
+	}
+	var addrs []string
+	rest := seq.Bytes
+	for len(rest) > 0 {
+		var name asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+			break
+		}
+		// otherName ::= [0] SEQUENCE { type-id OID, value [0] EXPLICIT ANY }
+		if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+			continue
+		}
+		var oid asn1.ObjectIdentifier
+		value, err := asn1.Unmarshal(name.Bytes, &oid)
+		if err != nil || !oid.Equal(oidXMPPAddr) {
+			continue
+		}
+		var explicit asn1.RawValue
+		if _, err := asn1.Unmarshal(value, &explicit); err != nil {
+			continue
+		}
+		var addr string
+		if _, err := asn1.UnmarshalWithParams(explicit.Bytes, &addr, "utf8"); err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthExternalAuthentication(t *testing.T) {
+	testStm := authTestSetup(&model.User{Username: "mariana", Password: "1234"})
+	defer authTestTeardown()
+
+	caCert, caKey := tUtilExternalCertificate(t, nil, nil, pkix.Name{CommonName: "Jackal CA"}, nil, nil)
+	caFile, err := ioutil.TempFile("", "jackal_ca")
+	require.Nil(t, err)
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	caFile.Close()
+
+	cfg := &SASLExternalConfig{CAFile: caFile.Name()}
+	tr := transport.NewMockTransport()
+
+	authr := newExternalAuthenticator(testStm, tr, cfg)
+	require.Equal(t, "EXTERNAL", authr.Mechanism())
+	require.False(t, authr.UsesChannelBinding())
+
+	elem := xml.NewElementNamespace("auth", "urn:ietf:params:xml:ns:xmpp-sasl")
+	elem.SetAttribute("mechanism", "EXTERNAL")
+
+	// no peer certificate...
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(elem))
+
+	// untrusted certificate...
+	selfSigned, _ := tUtilExternalCertificate(t, nil, nil, pkix.Name{CommonName: "mariana@localhost"}, nil, nil)
+	tr.SetPeerCertificates([]*x509.Certificate{selfSigned})
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(elem))
+
+	// xmppAddr identity...
+	cert, _ := tUtilExternalCertificate(t, caCert, caKey, pkix.Name{CommonName: "Mariana"}, []string{"mariana@jackal.im"}, nil)
+	tr.SetPeerCertificates([]*x509.Certificate{cert})
+	require.Nil(t, authr.ProcessElement(elem))
+	require.True(t, authr.Authenticated())
+	require.Equal(t, "mariana", authr.Username())
+	require.Equal(t, "success", testStm.FetchElement().Name())
+
+	// certificate domain must match stream domain
+	cfg.RequireDomainMatch = true
+	authr.Reset()
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(elem))
+
+	cert, _ = tUtilExternalCertificate(t, caCert, caKey, pkix.Name{}, nil, []string{"mariana@localhost"})
+	tr.SetPeerCertificates([]*x509.Certificate{cert})
+	require.Nil(t, authr.ProcessElement(elem))
+	require.Equal(t, "mariana", authr.Username())
+
+	// authorization identity...
+	authr.Reset()
+	elem.SetText(base64.StdEncoding.EncodeToString([]byte("noelia@localhost")))
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(elem))
+
+	elem.SetText(base64.StdEncoding.EncodeToString([]byte("mariana@localhost")))
+	require.Nil(t, authr.ProcessElement(elem))
+	require.True(t, authr.Authenticated())
+
+	// unknown user...
+	authr.Reset()
+	elem.SetText("=")
+	cert, _ = tUtilExternalCertificate(t, caCert, caKey, pkix.Name{CommonName: "noelia@localhost"}, nil, nil)
+	tr.SetPeerCertificates([]*x509.Certificate{cert})
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(elem))
+
+	// storage error...
+	cert, _ = tUtilExternalCertificate(t, caCert, caKey, pkix.Name{CommonName: "mariana@localhost"}, nil, nil)
+	tr.SetPeerCertificates([]*x509.Certificate{cert})
+	storage.ActivateMockedError()
+	require.Equal(t, storage.ErrMockedError, authr.ProcessElement(elem))
+	storage.DeactivateMockedError()
+
+	// invalid payload
+	elem.SetText("bad formed base64")
+	require.Equal(t, errSASLIncorrectEncoding, authr.ProcessElement(elem))
+}
+
+func tUtilExternalCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, subject pkix.Name, xmppAddrs, emails []string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        subject,
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		EmailAddresses: emails,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = tmpl, key
+	}
+	for _, addr := range xmppAddrs {
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, tUtilExternalXMPPAddrExtension(t, addr))
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert, key
+}
+
+func tUtilExternalXMPPAddrExtension(t *testing.T, addr string) pkix.Extension {
+	utf8, err := asn1.MarshalWithParams(addr, "utf8")
+	require.Nil(t, err)
+	oid, err := asn1.Marshal(oidXMPPAddr)
+	require.Nil(t, err)
+	value, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: utf8})
+	require.Nil(t, err)
+	otherName, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: append(oid, value...)})
+	require.Nil(t, err)
+	san, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: otherName})
+	require.Nil(t, err)
+	return pkix.Extension{Id: oidSubjectAltName, Value: san}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+// RFC 7628 error status sent along with a token rejection
+var oauthInvalidTokenStatus = []byte(`{"status":"invalid_token"}`)
+
+type oauthBearerState int
+
+const (
+	startOAuthBearerState oauthBearerState = iota
+	challengedOAuthBearerState
+	failedOAuthBearerState
+)
+
+type oauthBearerAuthenticator struct {
+	strm          c2s.Stream
+	cfg           *SASLOAuthBearerConfig
+	verifier      tokenVerifier
+	state         oauthBearerState
+	username      string
+	authenticated bool
+}
+
+func newOAuthBearerAuthenticator(strm c2s.Stream, cfg *SASLOAuthBearerConfig) *oauthBearerAuthenticator {
+	return &oauthBearerAuthenticator{strm: strm, cfg: cfg, verifier: oauthVerifier(cfg)}
+}
+
+func (o *oauthBearerAuthenticator) Mechanism() string {
+	return "OAUTHBEARER"
+}
+
+func (o *oauthBearerAuthenticator) Username() string {
+	return o.username
+}
+
+func (o *oauthBearerAuthenticator) Authenticated() bool {
+	return o.authenticated
+}
+
+func (o *oauthBearerAuthenticator) UsesChannelBinding() bool {
+	return false
+}
+
+func (o *oauthBearerAuthenticator) ProcessElement(elem xml.XElement) error {
+	if o.authenticated {
+		return nil
+	}
+	switch {
+	case elem.Name() == "auth" && o.state == startOAuthBearerState:
+		if len(elem.Text()) == 0 || elem.Text() == "=" {
+			// no initial response... ask for it
+			o.strm.SendElement(xml.NewElementNamespace("challenge", saslNamespace))
+			o.state = challengedOAuthBearerState
+			return nil
+		}
+		return o.handleClientResponse(elem.Text())
+
+	case elem.Name() == "response" && o.state == challengedOAuthBearerState:
+		return o.handleClientResponse(elem.Text())
+	}
+	// failedOAuthBearerState: client acknowledged the error status
+	return errSASLNotAuthorized
+}
+
+func (o *oauthBearerAuthenticator) Reset() {
+	o.state = startOAuthBearerState
+	o.username = ""
+	o.authenticated = false
+}
+
+func (o *oauthBearerAuthenticator) handleClientResponse(b64 string) error {
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return errSASLIncorrectEncoding
+	}
+	authzID, token, err := parseOAuthBearerMessage(b)
+	if err != nil {
+		return err
+	}
+	claims, err := o.verifier.verify(token)
+	switch err {
+	case nil:
+		break
+	case errOAuthInvalidToken:
+		o.failWithStatus()
+		return nil
+	default:
+		return err
+	}
+	username := o.mapUsername(claims)
+	if len(username) == 0 {
+		o.failWithStatus()
+		return nil
+	}
+	if len(authzID) > 0 && authzID != username+"@"+o.strm.Domain() {
+		return errSASLNotAuthorized
+	}
+	exists, err := auth.Instance().UserExists(username)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errSASLNotAuthorized
+	}
+	o.username = username
+	o.authenticated = true
+
+	o.strm.SendElement(xml.NewElementNamespace("success", saslNamespace))
+	return nil
+}
+
+// failWithStatus sends the token rejection status, which must be
+// acknowledged by the client before failing the authentication.
+func (o *oauthBearerAuthenticator) failWithStatus() {
+	challenge := xml.NewElementNamespace("challenge", saslNamespace)
+	challenge.SetText(base64.StdEncoding.EncodeToString(oauthInvalidTokenStatus))
+	o.strm.SendElement(challenge)
+	o.state = failedOAuthBearerState
+}
+
+// mapUsername returns the local username the token has been issued for.
+// Claims carrying a JID must refer to the stream domain.
+func (o *oauthBearerAuthenticator) mapUsername(claims map[string]interface{}) string {
+	identity, _ := claims[o.cfg.UsernameClaim].(string)
+	if !strings.Contains(identity, "@") {
+		return identity
+	}
+	j, err := xml.NewJIDString(identity, false)
+	if err != nil || j.Domain() != o.strm.Domain() {
+		return ""
+	}
+	return j.Node()
+}
+
+// parseOAuthBearerMessage parses an RFC 7628 client initial response,
+// returning requested authorization identity and bearer token.
+func parseOAuthBearerMessage(b []byte) (authzID string, token string, err error) {
+	kvs := bytes.Split(b, []byte{1})
+	if len(kvs) < 3 {
+		return "", "", errSASLMalformedRequest
+	}
+	// gs2-header
+	gs2 := strings.Split(string(kvs[0]), ",")
+	if len(gs2) != 3 || (gs2[0] != "n" && gs2[0] != "y") {
+		return "", "", errSASLMalformedRequest
+	}
+	if len(gs2[1]) > 0 {
+		if !strings.HasPrefix(gs2[1], "a=") {
+			return "", "", errSASLMalformedRequest
+		}
+		authzID = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(gs2[1][2:])
+	}
+	for _, kv := range kvs[1:] {
+		if bytes.HasPrefix(kv, []byte("auth=")) {
+			auth := string(kv[len("auth="):])
+			if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+				token = strings.TrimSpace(auth[7:])
+			}
+		}
+	}
+	if len(token) == 0 {
+		return "", "", errSASLMalformedRequest
+	}
+	return authzID, token, nil
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthOAuthBearerJWKS(t *testing.T) {
+	testStm := authTestSetup(&model.User{Username: "mariana", Password: "1234"})
+	defer authTestTeardown()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer srv.Close()
+
+	cfg := &SASLOAuthBearerConfig{
+		Verifier:      JWKSVerifier,
+		JWKSURL:       srv.URL,
+		Issuer:        "https://idp.jackal.im",
+		UsernameClaim: "preferred_username",
+		CacheTTL:      60,
+	}
+	authr := newOAuthBearerAuthenticator(testStm, cfg)
+	require.Equal(t, "OAUTHBEARER", authr.Mechanism())
+	require.False(t, authr.UsesChannelBinding())
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	// valid token...
+	token := tUtilOAuthJWT(t, key, "k1", map[string]interface{}{"iss": "https://idp.jackal.im", "exp": exp, "preferred_username": "mariana"})
+	require.Nil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", token)))
+	require.True(t, authr.Authenticated())
+	require.Equal(t, "mariana", authr.Username())
+	require.Equal(t, "success", testStm.FetchElement().Name())
+
+	// cached validation result...
+	authr.Reset()
+	require.Nil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,a=mariana@localhost,", token)))
+	require.True(t, authr.Authenticated())
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	_ = testStm.FetchElement()
+
+	// authorization identity mismatch...
+	authr.Reset()
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(tUtilOAuthBearerAuth("n,a=noelia@localhost,", token)))
+
+	// expired token...
+	authr.Reset()
+	expired := tUtilOAuthJWT(t, key, "k1", map[string]interface{}{"iss": "https://idp.jackal.im", "exp": time.Now().Add(-time.Minute).Unix(), "preferred_username": "mariana"})
+	require.Nil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", expired)))
+	require.False(t, authr.Authenticated())
+	elem := testStm.FetchElement()
+	require.Equal(t, "challenge", elem.Name())
+	status, _ := base64.StdEncoding.DecodeString(elem.Text())
+	require.Equal(t, `{"status":"invalid_token"}`, string(status))
+
+	// ...error status must be acknowledged
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(xml.NewElementNamespace("response", saslNamespace)))
+
+	// untrusted issuer...
+	authr.Reset()
+	untrusted := tUtilOAuthJWT(t, key, "k1", map[string]interface{}{"iss": "https://evil.im", "exp": exp, "preferred_username": "mariana"})
+	require.Nil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", untrusted)))
+	require.False(t, authr.Authenticated())
+	require.Equal(t, "challenge", testStm.FetchElement().Name())
+
+	// unknown signing key...
+	authr.Reset()
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	forged := tUtilOAuthJWT(t, otherKey, "k1", map[string]interface{}{"iss": "https://idp.jackal.im", "exp": exp, "preferred_username": "mariana"})
+	require.Nil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", forged)))
+	require.False(t, authr.Authenticated())
+	require.Equal(t, "challenge", testStm.FetchElement().Name())
+
+	// unknown user...
+	authr.Reset()
+	unknown := tUtilOAuthJWT(t, key, "k1", map[string]interface{}{"iss": "https://idp.jackal.im", "exp": exp, "preferred_username": "noelia"})
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", unknown)))
+
+	// malformed message...
+	authr.Reset()
+	malformed := xml.NewElementNamespace("auth", saslNamespace)
+	malformed.SetText("not base64!")
+	require.Equal(t, errSASLIncorrectEncoding, authr.ProcessElement(malformed))
+	require.Equal(t, errSASLMalformedRequest, authr.ProcessElement(tUtilOAuthBearerAuth("p=tls-unique,,", token)))
+}
+
+func TestAuthOAuthBearerIntrospection(t *testing.T) {
+	testStm := authTestSetup(&model.User{Username: "mariana", Password: "1234"})
+	defer authTestTeardown()
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if clientID, secret, ok := r.BasicAuth(); !ok || clientID != "jackal" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.PostFormValue("token") {
+		case "v4l1d":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "mariana@localhost"})
+		case "f0r31gn":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "mariana@jackal.im"})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		}
+	}))
+	defer srv.Close()
+
+	cfg := &SASLOAuthBearerConfig{
+		Verifier:         IntrospectionVerifier,
+		IntrospectionURL: srv.URL,
+		ClientID:         "jackal",
+		ClientSecret:     "s3cr3t",
+		UsernameClaim:    "sub",
+		CacheTTL:         60,
+	}
+	authr := newOAuthBearerAuthenticator(testStm, cfg)
+
+	// token is sent in a response to an empty challenge
+	require.Nil(t, authr.ProcessElement(xml.NewElementNamespace("auth", saslNamespace)))
+	require.Equal(t, "challenge", testStm.FetchElement().Name())
+
+	resp := xml.NewElementNamespace("response", saslNamespace)
+	resp.SetText(tUtilOAuthBearerAuth("n,,", "v4l1d").Text())
+	require.Nil(t, authr.ProcessElement(resp))
+	require.True(t, authr.Authenticated())
+	require.Equal(t, "mariana", authr.Username())
+	require.Equal(t, "success", testStm.FetchElement().Name())
+
+	// inactive tokens are cached too
+	for i := 0; i < 2; i++ {
+		authr.Reset()
+		require.Nil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", "r3v0k3d")))
+		require.False(t, authr.Authenticated())
+		require.Equal(t, "challenge", testStm.FetchElement().Name())
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// token issued for a foreign domain
+	authr.Reset()
+	require.Nil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", "f0r31gn")))
+	require.False(t, authr.Authenticated())
+	require.Equal(t, "challenge", testStm.FetchElement().Name())
+
+	// introspection endpoint failures are not cached
+	cfg2 := *cfg
+	cfg2.ClientSecret = "wr0ng"
+	authr = newOAuthBearerAuthenticator(testStm, &cfg2)
+	require.NotNil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", "v4l1d")))
+	require.NotNil(t, authr.ProcessElement(tUtilOAuthBearerAuth("n,,", "v4l1d")))
+	require.Equal(t, int32(5), atomic.LoadInt32(&requests))
+}
+
+func tUtilOAuthBearerAuth(gs2Header, token string) xml.XElement {
+	msg := gs2Header + "\x01host=localhost\x01port=5222\x01auth=Bearer " + token + "\x01\x01"
+	elem := xml.NewElementNamespace("auth", saslNamespace)
+	elem.SetAttribute("mechanism", "OAUTHBEARER")
+	elem.SetText(base64.StdEncoding.EncodeToString([]byte(msg)))
+	return elem
+}
+
+func tUtilOAuthJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.Nil(t, err)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
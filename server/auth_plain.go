@@ -9,7 +9,7 @@ import (
 	"bytes"
 	"encoding/base64"
 
-	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/auth"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 )
@@ -59,11 +59,11 @@ func (p *plainAuthenticator) ProcessElement(elem xml.XElement) error {
 	password := string(s[2])
 
 	// validate user and password
-	user, err := storage.Instance().FetchUser(username)
+	ok, err := auth.Instance().Authenticate(username, password)
 	if err != nil {
 		return err
 	}
-	if user == nil || user.Password != password {
+	if !ok {
 		return errSASLNotAuthorized
 	}
 	p.username = username
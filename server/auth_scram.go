@@ -25,8 +25,6 @@ import (
 	"golang.org/x/crypto/pbkdf2"
 )
 
-const iterationsCount = 4096
-
 type scramType int
 
 const (
@@ -73,6 +71,20 @@ func (s *scramParameters) String() string {
 	return ret
 }
 
+// upgradeScramCredentials stores SCRAM-SHA-256 credentials for
+// those users authenticated before they were available.
+func upgradeScramCredentials(username string) error {
+	user, err := storage.Instance().FetchUser(username)
+	if err != nil || user == nil {
+		return err
+	}
+	if len(user.ScramSHA256) > 0 || !user.HasPlainPassword() {
+		return nil
+	}
+	user.ScramSHA256 = util.NewScramSHA256Credentials(user.Password).String()
+	return storage.Instance().InsertOrUpdateUser(user)
+}
+
 type scramAuthenticator struct {
 	strm          c2s.Stream
 	tr            transport.Transport
@@ -83,7 +95,9 @@ type scramAuthenticator struct {
 	state         scramState
 	params        *scramParameters
 	user          *model.User
+	creds         *util.ScramCredentials
 	salt          []byte
+	iterations    int
 	srvNonce      string
 	firstMessage  string
 	authenticated bool
@@ -162,7 +176,9 @@ func (s *scramAuthenticator) Reset() {
 	s.state = startScramState
 	s.params = nil
 	s.user = nil
+	s.creds = nil
 	s.salt = nil
+	s.iterations = 0
 	s.srvNonce = ""
 	s.firstMessage = ""
 }
@@ -181,7 +197,7 @@ func (s *scramAuthenticator) handleStart(elem xml.XElement) error {
 	if len(username) == 0 || len(cNonce) == 0 {
 		return errSASLMalformedRequest
 	}
-	user, err := storage.Instance().FetchUser(username)
+	user, err := fetchCredentials(username)
 	if err != nil {
 		return err
 	}
@@ -190,10 +206,25 @@ func (s *scramAuthenticator) handleStart(elem xml.XElement) error {
 	}
 	s.user = user
 
+	// prefer stored salted credentials over plain password
+	if s.tp == sha256ScramType && len(user.ScramSHA256) > 0 {
+		creds, err := util.ParseScramCredentials(user.ScramSHA256)
+		if err != nil {
+			return err
+		}
+		s.creds = creds
+		s.salt = creds.Salt
+		s.iterations = creds.Iterations
+	} else if user.HasPlainPassword() {
+		s.salt = util.RandomBytes(32)
+		s.iterations = util.ScramIterationsCount
+	} else {
+		return errSASLNotAuthorized
+	}
+
 	s.srvNonce = cNonce + "-" + uuid.New()
-	s.salt = util.RandomBytes(32)
 	sb64 := base64.StdEncoding.EncodeToString(s.salt)
-	s.firstMessage = fmt.Sprintf("r=%s,s=%s,i=%d", s.srvNonce, sb64, iterationsCount)
+	s.firstMessage = fmt.Sprintf("r=%s,s=%s,i=%d", s.srvNonce, sb64, s.iterations)
 
 	respElem := xml.NewElementNamespace("challenge", saslNamespace)
 	respElem.SetText(base64.StdEncoding.EncodeToString([]byte(s.firstMessage)))
@@ -212,23 +243,35 @@ func (s *scramAuthenticator) handleChallenged(elem xml.XElement) error {
 	initialMessage := s.params.String()
 	clientFinalMessageBare := fmt.Sprintf("c=%s,r=%s", c, s.srvNonce)
 
-	saltedPassword := s.pbkdf2([]byte(s.user.Password))
-	clientKey := s.hmac([]byte("Client Key"), saltedPassword)
-	storedKey := s.hash(clientKey)
+	if !strings.HasPrefix(p, clientFinalMessageBare+",p=") {
+		return errSASLNotAuthorized
+	}
+	clientProof, err := base64.StdEncoding.DecodeString(p[len(clientFinalMessageBare)+3:])
+	if err != nil || len(clientProof) != s.hKeyLen {
+		return errSASLNotAuthorized
+	}
 	authMessage := initialMessage + "," + s.firstMessage + "," + clientFinalMessageBare
-	clientSignature := s.hmac([]byte(authMessage), storedKey)
 
-	clientProof := make([]byte, len(clientKey))
-	for i := 0; i < len(clientKey); i++ {
-		clientProof[i] = clientKey[i] ^ clientSignature[i]
+	var storedKey, serverKey []byte
+	if s.creds != nil {
+		storedKey = s.creds.StoredKey
+		serverKey = s.creds.ServerKey
+	} else {
+		saltedPassword := s.pbkdf2([]byte(s.user.Password))
+		storedKey = s.hash(s.hmac([]byte("Client Key"), saltedPassword))
+		serverKey = s.hmac([]byte("Server Key"), saltedPassword)
 	}
-	serverKey := s.hmac([]byte("Server Key"), saltedPassword)
-	serverSignature := s.hmac([]byte(authMessage), serverKey)
-
-	clientFinalMessage := clientFinalMessageBare + ",p=" + base64.StdEncoding.EncodeToString(clientProof)
-	if clientFinalMessage != p {
+	// recover client key from proof and verify it against stored key
+	clientSignature := s.hmac([]byte(authMessage), storedKey)
+	clientKey := make([]byte, len(clientProof))
+	for i := 0; i < len(clientProof); i++ {
+		clientKey[i] = clientProof[i] ^ clientSignature[i]
+	}
+	if !hmac.Equal(s.hash(clientKey), storedKey) {
 		return errSASLNotAuthorized
 	}
+	serverSignature := s.hmac([]byte(authMessage), serverKey)
+
 	v := "v=" + base64.StdEncoding.EncodeToString(serverSignature)
 
 	respElem := xml.NewElementNamespace("success", saslNamespace)
@@ -306,17 +349,13 @@ func (s *scramAuthenticator) getCBindInputString() string {
 }
 
 func (s *scramAuthenticator) pbkdf2(b []byte) []byte {
-	return pbkdf2.Key(b, s.salt, iterationsCount, s.hKeyLen, s.h)
+	return pbkdf2.Key(b, s.salt, s.iterations, s.hKeyLen, s.h)
 }
 
 func (s *scramAuthenticator) hmac(b []byte, key []byte) []byte {
-	m := hmac.New(s.h, key)
-	m.Write(b)
-	return m.Sum(nil)
+	return util.HMACSum(s.h, b, key)
 }
 
 func (s *scramAuthenticator) hash(b []byte) []byte {
-	h := s.h()
-	h.Write(b)
-	return h.Sum(nil)
+	return util.HashSum(s.h, b)
 }
@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/util"
 	"github.com/ortuman/jackal/xml"
@@ -35,6 +36,7 @@ type scramAuthTestCase struct {
 	n           string
 	r           string
 	password    string
+	user        *model.User
 	expectedErr error
 }
 
@@ -228,12 +230,59 @@ func TestScramSuccessTestCases(t *testing.T) {
 	}
 }
 
+func TestScramStoredCredentials(t *testing.T) {
+	creds := util.NewScramSHA256Credentials("1234")
+
+	// no plain password available
+	user := &model.User{Username: "ortuman", ScramSHA256: creds.String()}
+	tc := scramAuthTestCase{
+		scramType:   sha256ScramType,
+		gs2BindFlag: "n",
+		n:           "ortuman",
+		r:           "e5bde0c2-4a52-4d5c-8bd4-4f3bd6a0b1a4",
+		password:    "1234",
+		user:        user,
+	}
+	require.Nil(t, processScramTestCase(t, &tc))
+
+	tc.password = "4321"
+	require.Equal(t, errSASLNotAuthorized, processScramTestCase(t, &tc))
+
+	// SCRAM-SHA-1 requires plain password
+	tc.scramType = sha1ScramType
+	tc.password = "1234"
+	require.Equal(t, errSASLNotAuthorized, processScramTestCase(t, &tc))
+}
+
+func TestScramUpgradeCredentials(t *testing.T) {
+	authTestSetup(&model.User{Username: "ortuman", Password: "1234"})
+	defer authTestTeardown()
+
+	require.Nil(t, upgradeScramCredentials("ortuman"))
+	user, _ := storage.Instance().FetchUser("ortuman")
+	require.NotEqual(t, "", user.ScramSHA256)
+
+	creds, err := util.ParseScramCredentials(user.ScramSHA256)
+	require.Nil(t, err)
+	require.Equal(t, util.ScramIterationsCount, creds.Iterations)
+
+	// already upgraded... keep it untouched
+	prev := user.ScramSHA256
+	require.Nil(t, upgradeScramCredentials("ortuman"))
+	user, _ = storage.Instance().FetchUser("ortuman")
+	require.Equal(t, prev, user.ScramSHA256)
+}
+
 func processScramTestCase(t *testing.T, tc *scramAuthTestCase) error {
 	tr := transport.NewMockTransport()
 	if tc.usesCb {
 		tr.SetChannelBindingBytes(tc.cbBytes)
 	}
-	testStrm := authTestSetup(&model.User{Username: "ortuman", Password: "1234"})
+	user := tc.user
+	if user == nil {
+		user = &model.User{Username: "ortuman", Password: "1234"}
+	}
+	testStrm := authTestSetup(user)
 	defer authTestTeardown()
 
 	authr := newScram(testStrm, tr, tc.scramType, tc.usesCb)
@@ -6,8 +6,12 @@
 package server
 
 import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/ortuman/jackal/auth"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -47,3 +51,43 @@ func TestAuthError(t *testing.T) {
 	require.Equal(t, "not-authorized", errSASLNotAuthorized.(*saslErrorString).Element().Name())
 	require.Equal(t, "temporary-auth-failure", errSASLTemporaryAuthFailure.(*saslErrorString).Element().Name())
 }
+
+func TestAuthExternalProvider(t *testing.T) {
+	testStm := authTestSetup(&model.User{Username: "mariana", Password: "1234"})
+	defer authTestTeardown()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/authenticate" || r.PostFormValue("username") != "romeo" || r.PostFormValue("password") != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	auth.Initialize(&auth.Config{Type: auth.HTTP, HTTP: &auth.HTTPConfig{URL: srv.URL, Timeout: 1}})
+	defer auth.Shutdown()
+
+	// plaintext credentials are verified by the provider...
+	authr := newPlainAuthenticator(testStm)
+	elem := xml.NewElementNamespace("auth", saslNamespace)
+	elem.SetAttribute("mechanism", "PLAIN")
+	elem.SetText(base64.StdEncoding.EncodeToString([]byte("\x00romeo\x00s3cr3t")))
+	require.Nil(t, authr.ProcessElement(elem))
+	require.True(t, authr.Authenticated())
+
+	authr.Reset()
+	elem.SetText(base64.StdEncoding.EncodeToString([]byte("\x00mariana\x001234")))
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(elem))
+
+	// ...while stored credentials are not exposed
+	require.True(t, requiresStoredCredentials("scram_sha_256"))
+	require.False(t, requiresStoredCredentials("plain"))
+	user, err := fetchCredentials("mariana")
+	require.Nil(t, err)
+	require.Nil(t, user)
+
+	// externally authenticated users are stored on first login
+	require.Nil(t, storeExternalUser("romeo"))
+	exists, _ := storage.Instance().UserExists("romeo")
+	require.True(t, exists)
+	require.Nil(t, storeExternalUser("romeo"))
+}
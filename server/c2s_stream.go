@@ -8,26 +8,45 @@ package server
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/host"
+	"github.com/ortuman/jackal/metrics"
 	"github.com/ortuman/jackal/module"
 	"github.com/ortuman/jackal/module/offline"
 	"github.com/ortuman/jackal/module/roster"
 	"github.com/ortuman/jackal/module/xep0012"
+	"github.com/ortuman/jackal/module/xep0016"
 	"github.com/ortuman/jackal/module/xep0030"
 	"github.com/ortuman/jackal/module/xep0049"
+	"github.com/ortuman/jackal/module/xep0050"
 	"github.com/ortuman/jackal/module/xep0054"
 	"github.com/ortuman/jackal/module/xep0077"
-	"github.com/ortuman/jackal/module/xep0092"
+	"github.com/ortuman/jackal/module/xep0078"
+	"github.com/ortuman/jackal/module/xep0085"
+	"github.com/ortuman/jackal/module/xep0115"
+	"github.com/ortuman/jackal/module/xep0163"
+	"github.com/ortuman/jackal/module/xep0184"
 	"github.com/ortuman/jackal/module/xep0191"
 	"github.com/ortuman/jackal/module/xep0199"
+	"github.com/ortuman/jackal/module/xep0280"
+	"github.com/ortuman/jackal/module/xep0313"
+	"github.com/ortuman/jackal/module/xep0333"
+	"github.com/ortuman/jackal/module/xep0352"
+	"github.com/ortuman/jackal/module/xep0357"
+	"github.com/ortuman/jackal/module/xep0363"
+	"github.com/ortuman/jackal/router"
 	"github.com/ortuman/jackal/server/compress"
 	"github.com/ortuman/jackal/server/transport"
 	"github.com/ortuman/jackal/storage"
@@ -35,6 +54,7 @@ import (
 	"github.com/ortuman/jackal/stream"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/stream/s2s"
 	"github.com/ortuman/jackal/util"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
@@ -42,6 +62,15 @@ import (
 
 const streamMailboxSize = 64
 
+// maximum time a binding stream waits for the session it replaces to be terminated
+const replacedSessionTimeout = time.Second * 5
+
+// maximum length of a client provided resource hint
+const maxResourceHintLength = 64
+
+// incremented by every resource generated by 'counter' policy
+var resourceCounter uint64
+
 const (
 	connecting uint32 = iota
 	connected
@@ -60,6 +89,7 @@ const (
 	bindNamespace             = "urn:ietf:params:xml:ns:xmpp-bind"
 	sessionNamespace          = "urn:ietf:params:xml:ns:xmpp-session"
 	blockedErrorNamespace     = "urn:xmpp:blocking:errors"
+	stanzaIDNamespace         = "urn:xmpp:sid:0"
 )
 
 // stream context keys
@@ -72,40 +102,67 @@ const (
 	authenticatedContextKey = "authenticated"
 	compressedContextKey    = "compressed"
 	presenceContextKey      = "presence"
+	anonymousContextKey     = "anonymous"
 )
 
 // once dispatch handlers
 const (
 	rosterOnce  = "rosterOnce"
 	offlineOnce = "offlineOnce"
+	pepOnce     = "pepOnce"
 )
 
 type c2sStream struct {
-	cfg         *Config
-	tr          transport.Transport
-	id          string
-	connected   uint32
-	state       uint32
-	ctx         *stream.Context
-	authrs      []authenticator
-	activeAuthr authenticator
-	iqHandlers  []module.IQHandler
-	roster      *roster.ModRoster
-	register    *xep0077.XEPRegister
-	ping        *xep0199.XEPPing
-	blockCmd    *xep0191.XEPBlockingCommand
-	offline     *offline.ModOffline
-	actorCh     chan func()
+	cfg          *Config
+	host         *host.Config // selected virtual host, if any
+	hostSelected bool
+	trMu         sync.RWMutex // guards transport replacement on stream resumption
+	tr           transport.Transport
+	id           string
+	connected    uint32
+	state        uint32
+	ctx          *stream.Context
+	authrs       []authenticator
+	activeAuthr  authenticator
+	modules      *module.Registry
+	roster       *roster.ModRoster
+	lastActivity *xep0012.XEPLastActivity
+	privacy      *xep0016.XEPPrivacy
+	vCard        *xep0054.XEPVCard
+	register     *xep0077.XEPRegister
+	legacyAuth   *xep0078.XEPLegacyAuth
+	chatStates   *xep0085.XEPChatStates
+	caps         *xep0115.XEPCaps
+	receipts     *xep0184.XEPReceipts
+	ping         *xep0199.XEPPing
+	pep          *xep0163.XEPPep
+	carbons      *xep0280.XEPCarbons
+	mam          *xep0313.XEPMam
+	chatMarkers  *xep0333.XEPChatMarkers
+	csi          *xep0352.XEPClientState
+	push         *xep0357.XEPPush
+	offline      *offline.ModOffline
+	sm           streamMgmt
+	rateLimiter  *rateLimiter
+	iqTracker    *iqTracker
+	idleTm       *time.Timer
+	actorCh      chan func()
+	overflowed   uint32
 }
 
 func newC2SStream(id string, tr transport.Transport, cfg *Config) *c2sStream {
+	queueSize := cfg.Transport.SendQueueSize
+	if queueSize == 0 {
+		queueSize = streamMailboxSize
+	}
 	s := &c2sStream{
-		cfg:     cfg,
-		id:      id,
-		tr:      tr,
-		state:   connecting,
-		ctx:     stream.NewContext(),
-		actorCh: make(chan func(), streamMailboxSize),
+		cfg:       cfg,
+		id:        id,
+		tr:        tr,
+		state:     connecting,
+		ctx:       stream.NewContext(),
+		iqTracker: newIQTracker(),
+		actorCh:   make(chan func(), queueSize),
 	}
 	// initialize stream context
 	secured := !(cfg.Transport.Type == transport.Socket)
@@ -120,12 +177,17 @@ func newC2SStream(id string, tr transport.Transport, cfg *Config) *c2sStream {
 	// initialize authenticators
 	s.initializeAuthenticators()
 
-	// initialize XEPs
-	s.initializeXEPs()
-
+	if cfg.RateLimit.StanzasPerSecond > 0 {
+		s.rateLimiter = newRateLimiter(cfg.RateLimit.StanzasPerSecond, cfg.RateLimit.Burst)
+	}
 	if cfg.Transport.ConnectTimeout > 0 {
 		go s.startConnectTimeoutTimer(cfg.Transport.ConnectTimeout)
 	}
+	if cfg.Transport.Type == transport.Socket && cfg.Transport.IdleTimeout > 0 {
+		s.idleTm = time.AfterFunc(s.idleTimeout(), func() {
+			s.postActor(s.sendKeepAlive)
+		})
+	}
 	go s.actorLoop()
 	go s.doRead() // start reading transport...
 
@@ -191,9 +253,27 @@ func (s *c2sStream) Presence() *xml.Presence {
 
 // SendElement sends the given XML element.
 func (s *c2sStream) SendElement(element xml.XElement) {
-	s.actorCh <- func() {
-		s.writeElement(element)
-	}
+	s.enqueueOutbound(func() {
+		s.sendElement(element)
+	})
+}
+
+// SendIQ sends a server originated IQ, invoking handler
+// once its response is received or with c2s.ErrIQTimeout
+// if none arrived before timeout elapsed.
+// A non positive timeout waits for the response until stream termination.
+func (s *c2sStream) SendIQ(iq *xml.IQ, handler c2s.IQResultHandler, timeout time.Duration) {
+	s.enqueueOutbound(func() {
+		id := iq.ID()
+		var tm *time.Timer
+		if timeout > 0 {
+			tm = time.AfterFunc(timeout, func() {
+				s.postActor(func() { s.iqTracker.expire(id) })
+			})
+		}
+		s.iqTracker.track(id, handler, tm)
+		s.sendElement(iq)
+	})
 }
 
 // Disconnect disconnects remote peer by closing
@@ -204,12 +284,85 @@ func (s *c2sStream) Disconnect(err error) {
 	}
 }
 
+// postActor schedules f on the actor loop, unless the stream
+// is terminated before it can be received.
+func (s *c2sStream) postActor(f func()) {
+	select {
+	case s.actorCh <- f:
+	case <-s.ctx.Done():
+		break // already disconnected...
+	}
+}
+
+// enqueueOutbound schedules an outbound delivery without ever blocking the caller.
+// A peer too slow to keep its queue from filling up is dropped with a policy-violation.
+func (s *c2sStream) enqueueOutbound(f func()) {
+	if s.getState() == disconnected {
+		return
+	}
+	select {
+	case s.actorCh <- f:
+		metrics.ObserveC2SSendQueueLength(len(s.actorCh))
+	default:
+		if !atomic.CompareAndSwapUint32(&s.overflowed, 0, 1) {
+			return // already being dropped...
+		}
+		metrics.C2SSendQueueOverflows.Inc()
+		c2s.Logger(s).Warnf("outbound queue full (%d elements)... dropping slow stream", cap(s.actorCh))
+
+		// the actor is the one falling behind, so wait for it apart,
+		// giving up if the stream is terminated meanwhile...
+		go s.postActor(func() { s.disconnect(streamerror.ErrPolicyViolation) })
+	}
+}
+
+func (s *c2sStream) sendElement(element xml.XElement) {
+	if stanza, ok := element.(xml.Stanza); ok && s.privacy != nil && s.privacy.IsBlockedInbound(stanza) {
+		s.bounceBlockedStanza(stanza)
+		return
+	}
+	if message, ok := element.(*xml.Message); ok {
+		if s.chatStates != nil && !s.chatStates.IsDeliverable(message) {
+			return
+		}
+		if s.carbons != nil {
+			s.carbons.ProcessReceivedMessage(message)
+		}
+		if s.push != nil && (s.sm.detached || (s.csi != nil && !s.csi.IsActive())) {
+			s.push.NotifyMessage(message)
+		}
+	}
+	if s.csi != nil {
+		for _, elem := range s.csi.Filter(element) {
+			s.writeElement(elem)
+		}
+		return
+	}
+	s.writeElement(element)
+}
+
 func (s *c2sStream) initializeAuthenticators() {
+	_, hasCredentials := auth.Instance().(auth.CredentialsProvider)
 	for _, a := range s.cfg.SASL {
+		if requiresStoredCredentials(a) && !hasCredentials {
+			continue // not supported by authentication provider
+		}
+		if requiresPlainPassword(a) && auth.HashesPasswords() {
+			continue // not able to verify hashed passwords
+		}
 		switch a {
 		case "plain":
 			s.authrs = append(s.authrs, newPlainAuthenticator(s))
 
+		case "anonymous":
+			s.authrs = append(s.authrs, newAnonymousAuthenticator(s))
+
+		case "external":
+			s.authrs = append(s.authrs, newExternalAuthenticator(s, s.tr, &s.cfg.SASLExternal))
+
+		case "oauthbearer":
+			s.authrs = append(s.authrs, newOAuthBearerAuthenticator(s, &s.cfg.SASLOAuthBearer))
+
 		case "digest_md5":
 			s.authrs = append(s.authrs, newDigestMD5(s))
 
@@ -225,72 +378,101 @@ func (s *c2sStream) initializeAuthenticators() {
 }
 
 func (s *c2sStream) initializeXEPs() {
-	// Roster (https://xmpp.org/rfcs/rfc3921.html#roster)
-	s.roster = roster.New(&s.cfg.ModRoster, s)
-	s.iqHandlers = append(s.iqHandlers, s.roster)
-
-	// XEP-0012: Last Activity (https://xmpp.org/extensions/xep-0012.html)
-	if _, ok := s.cfg.Modules["last_activity"]; ok {
-		s.iqHandlers = append(s.iqHandlers, xep0012.New(s))
-	}
-
-	// XEP-0030: Service Discovery (https://xmpp.org/extensions/xep-0030.html)
-	discoInfo := xep0030.New(s)
-	s.iqHandlers = append(s.iqHandlers, discoInfo)
-
-	// XEP-0049: Private XML Storage (https://xmpp.org/extensions/xep-0049.html)
-	if _, ok := s.cfg.Modules["private"]; ok {
-		s.iqHandlers = append(s.iqHandlers, xep0049.New(s))
-	}
-
-	// XEP-0054: vcard-temp (https://xmpp.org/extensions/xep-0054.html)
-	if _, ok := s.cfg.Modules["vcard"]; ok {
-		s.iqHandlers = append(s.iqHandlers, xep0054.New(s))
-	}
-
-	// XEP-0077: In-band registration (https://xmpp.org/extensions/xep-0077.html)
-	if _, ok := s.cfg.Modules["registration"]; ok {
-		s.register = xep0077.New(&s.cfg.ModRegistration, s)
-		s.iqHandlers = append(s.iqHandlers, s.register)
+	s.modules = module.NewRegistry(s, func(name string) bool {
+		return isCoreModule(name) || s.isModuleEnabled(name)
+	})
+	s.roster, _ = s.modules.Module("roster").(*roster.ModRoster)
+	s.lastActivity, _ = s.modules.Module("last_activity").(*xep0012.XEPLastActivity)
+	s.privacy, _ = s.modules.Module("privacy").(*xep0016.XEPPrivacy)
+	s.vCard, _ = s.modules.Module("vcard").(*xep0054.XEPVCard)
+	s.register, _ = s.modules.Module("registration").(*xep0077.XEPRegister)
+	s.legacyAuth, _ = s.modules.Module("legacy_auth").(*xep0078.XEPLegacyAuth)
+	s.chatStates, _ = s.modules.Module("chat_states").(*xep0085.XEPChatStates)
+	s.caps, _ = s.modules.Module("caps").(*xep0115.XEPCaps)
+	s.pep, _ = s.modules.Module("pep").(*xep0163.XEPPep)
+	s.receipts, _ = s.modules.Module("receipts").(*xep0184.XEPReceipts)
+	s.ping, _ = s.modules.Module("ping").(*xep0199.XEPPing)
+	s.carbons, _ = s.modules.Module("carbons").(*xep0280.XEPCarbons)
+	s.mam, _ = s.modules.Module("mam").(*xep0313.XEPMam)
+	s.chatMarkers, _ = s.modules.Module("chat_markers").(*xep0333.XEPChatMarkers)
+	s.csi, _ = s.modules.Module("csi").(*xep0352.XEPClientState)
+	s.push, _ = s.modules.Module("push").(*xep0357.XEPPush)
+	s.offline, _ = s.modules.Module("offline").(*offline.ModOffline)
+
+	// wire up module dependencies
+	s.roster.SetDomainConfig(func(domain string) *roster.Config {
+		if h := host.Instance(domain); h != nil && h.Roster != nil {
+			return h.Roster
+		}
+		return &s.cfg.ModRoster
+	})
+	if s.privacy != nil {
+		s.roster.SetPresenceFilter(func(presence *xml.Presence) bool {
+			return !s.privacy.IsBlockedOutbound(presence)
+		})
 	}
-
-	// XEP-0092: Software Version (https://xmpp.org/extensions/xep-0092.html)
-	if _, ok := s.cfg.Modules["version"]; ok {
-		s.iqHandlers = append(s.iqHandlers, xep0092.New(&s.cfg.ModVersion, s))
+	if s.vCard != nil {
+		s.vCard.OnPhotoUpdate(func() {
+			s.postActor(s.broadcastPhotoUpdate)
+		})
 	}
-
-	// XEP-0191: Blocking Command (https://xmpp.org/extensions/xep-0191.html)
-	if _, ok := s.cfg.Modules["blocking_command"]; ok {
-		s.blockCmd = xep0191.New(s)
-		s.iqHandlers = append(s.iqHandlers, s.blockCmd)
+	if s.legacyAuth != nil {
+		s.legacyAuth.OnAuthenticate(s.finishLegacyAuthentication)
 	}
-
-	// XEP-0199: XMPP Ping (https://xmpp.org/extensions/xep-0199.html)
-	if _, ok := s.cfg.Modules["ping"]; ok {
-		s.ping = xep0199.New(&s.cfg.ModPing, s)
-		s.iqHandlers = append(s.iqHandlers, s.ping)
+	if s.offline != nil && s.receipts != nil {
+		s.offline.OnArchive(s.receipts.ProcessOfflineMessage)
 	}
 
 	// register server disco info identities
+	discoInfo := s.modules.Module("disco").(*xep0030.XEPDiscoInfo)
 	identities := []xep0030.DiscoIdentity{{
 		Category: "server",
 		Type:     "im",
 		Name:     s.cfg.ID,
 	}}
 	discoInfo.SetIdentities(identities)
+	discoInfo.SetItems(s.cfg.ModDisco.Items)
+
+	if adHoc, ok := s.modules.Module("admin").(*xep0050.XEPAdHoc); ok {
+		discoInfo.RegisterItemsProvider(xep0050.Namespace, adHoc)
+	}
+	if upload, ok := s.modules.Module("upload").(*xep0363.XEPHTTPUpload); ok {
+		discoInfo.SetExtensions([]xml.XElement{upload.DiscoExtension()})
+	}
+	// advertise every loaded module namespaces as disco info features
+	for _, mod := range s.modules.Modules() {
+		discoInfo.RegisterModule(mod)
+	}
+}
+
+func (s *c2sStream) isModuleEnabled(module string) bool {
+	modules := s.cfg.Modules
+	if s.host != nil && s.host.Modules != nil {
+		modules = s.host.Modules
+	}
+	_, ok := modules[module]
+	return ok
+}
+
+func (s *c2sStream) rosterConfig() *roster.Config {
+	if s.host != nil && s.host.Roster != nil {
+		return s.host.Roster
+	}
+	return &s.cfg.ModRoster
+}
 
-	// register disco info features
-	var features []string
-	for _, iqHandler := range s.iqHandlers {
-		features = append(features, iqHandler.AssociatedNamespaces()...)
+func (s *c2sStream) registrationConfig() *xep0077.Config {
+	if s.host != nil && s.host.Registration != nil {
+		return s.host.Registration
 	}
+	return &s.cfg.ModRegistration
+}
 
-	// XEP-0160: Offline message storage (https://xmpp.org/extensions/xep-0160.html)
-	if _, ok := s.cfg.Modules["offline"]; ok {
-		s.offline = offline.New(&s.cfg.ModOffline, s)
-		features = append(features, s.offline.AssociatedNamespaces()...)
+func (s *c2sStream) loginMessage() *c2s.Announcement {
+	if s.host != nil && s.host.LoginMessage != nil {
+		return s.host.LoginMessage
 	}
-	discoInfo.SetFeatures(features)
+	return s.cfg.LoginMessage
 }
 
 func (s *c2sStream) startConnectTimeoutTimer(timeoutInSeconds int) {
@@ -304,12 +486,52 @@ func (s *c2sStream) startConnectTimeoutTimer(timeoutInSeconds int) {
 	}
 }
 
+func (s *c2sStream) idleTimeout() time.Duration {
+	return time.Second * time.Duration(s.cfg.Transport.IdleTimeout)
+}
+
+// sendKeepAlive probes an idle connection, closing the stream
+// right away in case the underlying socket is found dead.
+func (s *c2sStream) sendKeepAlive() {
+	if s.getState() == disconnected {
+		return
+	}
+	if !s.sm.detached {
+		var err error
+		if s.sm.enabled {
+			// an ack request doubles as keepalive without altering stream management counters
+			err = s.tr.WriteElement(xml.NewElementNamespace("r", streamMgmtNamespace), true)
+		} else {
+			err = s.tr.WriteString(" ")
+		}
+		if err != nil {
+			c2s.Logger(s).Infof("dead connection detected... id: %s", s.id)
+			s.disconnectClosingStream(false)
+			return
+		}
+	}
+	s.idleTm.Reset(s.idleTimeout())
+}
+
 func (s *c2sStream) handleElement(elem xml.XElement) {
-	isWebSocketTr := s.cfg.Transport.Type == transport.WebSocket
-	if isWebSocketTr && elem.Name() == "close" && elem.Namespace() == framedStreamNamespace {
-		s.disconnect(nil)
+	isFramedTr := s.cfg.Transport.Type == transport.WebSocket || s.cfg.Transport.Type == transport.Bosh
+	if isFramedTr && elem.Name() == "close" && elem.Namespace() == framedStreamNamespace {
+		// acknowledge framed stream closing (RFC 7395, section 3.6)
+		s.disconnectClosingStream(true)
 		return
 	}
+	if elem.Namespace() == streamMgmtNamespace {
+		switch s.getState() {
+		case authenticated, sessionStarted:
+			s.handleStreamMgmt(elem)
+		default:
+			s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+		}
+		return
+	}
+	if s.sm.enabled && isStanzaElement(elem) {
+		s.sm.inH++
+	}
 	switch s.getState() {
 	case connecting:
 		s.handleConnecting(elem)
@@ -335,8 +557,15 @@ func (s *c2sStream) handleConnecting(elem xml.XElement) {
 		s.disconnectWithStreamError(err)
 		return
 	}
-	// assign stream domain
-	s.ctx.SetString(elem.To(), domainContextKey)
+	// assign stream domain (aliases are replaced by their canonical host)
+	s.ctx.SetString(c2s.Instance().CanonicalDomain(elem.To()), domainContextKey)
+
+	// apply selected virtual host configuration
+	if !s.hostSelected {
+		s.host = host.Instance(s.Domain())
+		s.hostSelected = true
+		s.initializeXEPs()
+	}
 
 	// open stream
 	s.openStream()
@@ -348,20 +577,25 @@ func (s *c2sStream) handleConnecting(elem xml.XElement) {
 	isSocketTransport := s.cfg.Transport.Type == transport.Socket
 
 	if !s.IsAuthenticated() {
-		if isSocketTransport && !s.IsSecured() {
+		if isSocketTransport && !s.IsSecured() && s.startTLSPolicy() != StartTLSDisabled {
 			startTLS := xml.NewElementName("starttls")
 			startTLS.SetNamespace("urn:ietf:params:xml:ns:xmpp-tls")
-			startTLS.AppendElement(xml.NewElementName("required"))
+			if s.startTLSPolicy() == StartTLSRequired {
+				startTLS.AppendElement(xml.NewElementName("required"))
+			}
 			features.AppendElement(startTLS)
 		}
 
 		// attach SASL mechanisms
-		shouldOfferSASL := (!isSocketTransport || (isSocketTransport && s.IsSecured()))
+		shouldOfferSASL := !s.isTLSRequired()
 
 		if shouldOfferSASL && len(s.authrs) > 0 {
 			mechanisms := xml.NewElementName("mechanisms")
 			mechanisms.SetNamespace(saslNamespace)
 			for _, athr := range s.authrs {
+				if !s.isMechanismAvailable(athr) {
+					continue
+				}
 				mechanism := xml.NewElementName("mechanism")
 				mechanism.SetText(athr.Mechanism())
 				mechanisms.AppendElement(mechanism)
@@ -369,10 +603,13 @@ func (s *c2sStream) handleConnecting(elem xml.XElement) {
 			features.AppendElement(mechanisms)
 		}
 
-		// allow In-band registration over encrypted stream only
-		allowRegistration := s.IsSecured()
+		// offer non-SASL authentication over secured streams
+		if s.legacyAuth != nil && s.IsSecured() {
+			features.AppendElement(xml.NewElementNamespace("auth", xep0078.FeatureNamespace))
+		}
 
-		if _, ok := s.cfg.Modules["registration"]; ok && allowRegistration {
+		// offer In-band registration according to module policy
+		if s.register != nil && s.register.IsRegistrationAllowed() {
 			registerFeature := xml.NewElementNamespace("register", "http://jabber.org/features/iq-register")
 			features.AppendElement(registerFeature)
 		}
@@ -380,9 +617,7 @@ func (s *c2sStream) handleConnecting(elem xml.XElement) {
 
 	} else {
 		// attach compression feature
-		compressionAvailable := isSocketTransport && s.cfg.Compression.Level != compress.NoCompression
-
-		if !s.IsCompressed() && compressionAvailable {
+		if !s.IsCompressed() && s.isCompressionAvailable() {
 			compression := xml.NewElementNamespace("compression", "http://jabber.org/features/compress")
 			method := xml.NewElementName("method")
 			method.SetText("zlib")
@@ -396,10 +631,16 @@ func (s *c2sStream) handleConnecting(elem xml.XElement) {
 		session := xml.NewElementNamespace("session", "urn:ietf:params:xml:ns:xmpp-session")
 		features.AppendElement(session)
 
-		if s.roster != nil && s.cfg.ModRoster.Versioning {
+		if s.roster != nil && s.rosterConfig().Versioning {
 			ver := xml.NewElementNamespace("ver", "urn:xmpp:features:rosterver")
 			features.AppendElement(ver)
 		}
+		if s.cfg.StreamManagement.Enabled {
+			features.AppendElement(xml.NewElementNamespace("sm", streamMgmtNamespace))
+		}
+		if s.csi != nil {
+			features.AppendElement(s.csi.Feature())
+		}
 		s.setState(authenticated)
 	}
 	s.writeElement(features)
@@ -412,6 +653,11 @@ func (s *c2sStream) handleConnected(elem xml.XElement) {
 			s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
 			return
 		}
+		if s.cfg.Transport.Type != transport.Socket || s.startTLSPolicy() == StartTLSDisabled {
+			s.writeElement(xml.NewElementNamespace("failure", tlsNamespace))
+			s.disconnectClosingStream(true)
+			return
+		}
 		s.proceedStartTLS()
 
 	case "auth":
@@ -419,6 +665,10 @@ func (s *c2sStream) handleConnected(elem xml.XElement) {
 			s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
 			return
 		}
+		if s.isTLSRequired() {
+			s.disconnectWithStreamError(streamerror.ErrPolicyViolation)
+			return
+		}
 		s.startAuthentication(elem)
 
 	case "iq":
@@ -433,6 +683,14 @@ func (s *c2sStream) handleConnected(elem xml.XElement) {
 			s.register.ProcessIQ(iq)
 			return
 
+		} else if s.isTLSRequired() && isAuthOrBindIQ(iq) {
+			s.disconnectWithStreamError(streamerror.ErrPolicyViolation)
+			return
+
+		} else if s.legacyAuth != nil && s.legacyAuth.MatchesIQ(iq) {
+			s.legacyAuth.ProcessIQ(iq)
+			return
+
 		} else if iq.Elements().ChildNamespace("query", "jabber:iq:auth") != nil {
 			// don't allow non-SASL authentication
 			s.writeElement(iq.ServiceUnavailableError())
@@ -456,7 +714,8 @@ func (s *c2sStream) handleAuthenticating(elem xml.XElement) {
 	authr := s.activeAuthr
 	s.continueAuthentication(elem, authr)
 	if authr.Authenticated() {
-		s.finishAuthentication(authr.Username())
+		metrics.ObserveAuthentication(authr.Mechanism(), true)
+		s.finishAuthentication(authr)
 	}
 }
 
@@ -493,12 +752,21 @@ func (s *c2sStream) handleSessionStarted(elem xml.XElement) {
 	if s.ping != nil {
 		s.ping.ResetDeadline()
 	}
+	if s.csi != nil && s.csi.MatchesElement(elem) {
+		for _, e := range s.csi.ProcessElement(elem) {
+			s.writeElement(e)
+		}
+		return
+	}
 
 	stanza, err := s.buildStanza(elem, true)
 	if err != nil {
 		s.handleElementError(elem, err)
 		return
 	}
+	if s.lastActivity != nil {
+		s.lastActivity.UpdateLastActivity()
+	}
 	if s.isComponentDomain(stanza.ToJID().Domain()) {
 		s.processComponentStanza(stanza)
 	} else {
@@ -511,20 +779,28 @@ func (s *c2sStream) proceedStartTLS() {
 		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
 		return
 	}
-	tlsCfg, err := util.LoadCertificate(s.cfg.TLS.PrivKeyFile, s.cfg.TLS.CertFile, s.Domain())
+	privKeyFile, certFile := s.cfg.TLS.PrivKeyFile, s.cfg.TLS.CertFile
+	if s.host != nil && len(s.host.TLS.CertFile) > 0 {
+		privKeyFile, certFile = s.host.TLS.PrivKeyFile, s.host.TLS.CertFile
+	}
+	tlsCfg, err := util.LoadCertificate(privKeyFile, certFile, s.Domain())
 	if err != nil {
-		log.Error(err)
+		c2s.Logger(s).Error(err)
 		s.writeElement(xml.NewElementNamespace("failure", tlsNamespace))
 		s.disconnectClosingStream(true)
 		return
 	}
+	if s.isMechanismEnabled("EXTERNAL") {
+		// ask for a client certificate in order to offer SASL EXTERNAL
+		tlsCfg.ClientAuth = tls.RequestClientCert
+	}
 	s.ctx.SetBool(true, securedContextKey)
 
 	s.writeElement(xml.NewElementNamespace("proceed", tlsNamespace))
 
-	s.tr.StartTLS(tlsCfg)
+	s.tr.StartTLS(withSNI(s.cfg.TLS.apply(tlsCfg)))
 
-	log.Infof("secured stream... id: %s", s.id)
+	c2s.Logger(s).Infof("secured stream... id: %s", s.id)
 
 	s.restart()
 }
@@ -535,7 +811,7 @@ func (s *c2sStream) compress(elem xml.XElement) {
 		return
 	}
 	method := elem.Elements().Child("method")
-	if method == nil || len(method.Text()) == 0 {
+	if method == nil || len(method.Text()) == 0 || !s.isCompressionAvailable() {
 		failure := xml.NewElementNamespace("failure", compressProtocolNamespace)
 		failure.AppendElement(xml.NewElementName("setup-failed"))
 		s.writeElement(failure)
@@ -553,20 +829,84 @@ func (s *c2sStream) compress(elem xml.XElement) {
 
 	s.tr.EnableCompression(s.cfg.Compression.Level)
 
-	log.Infof("compressed stream... id: %s", s.id)
+	c2s.Logger(s).Infof("compressed stream... id: %s", s.id)
 
 	s.restart()
 }
 
+func (s *c2sStream) isMechanismEnabled(mechanism string) bool {
+	for _, authr := range s.authrs {
+		if authr.Mechanism() == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *c2sStream) isMechanismAvailable(authr authenticator) bool {
+	switch authr.Mechanism() {
+	case "ANONYMOUS":
+		// anonymous login may be restricted to a subset of local domains
+		domains := s.cfg.SASLAnonymous.Domains
+		if len(domains) == 0 {
+			return true
+		}
+		for _, domain := range domains {
+			if domain == s.Domain() {
+				return true
+			}
+		}
+		return false
+
+	case "EXTERNAL":
+		// only offered over TLS when the peer presented a certificate
+		return s.IsSecured() && len(s.tr.PeerCertificates()) > 0
+
+	case "OAUTHBEARER":
+		// bearer tokens are never sent over plaintext streams
+		return s.IsSecured()
+	}
+	return true
+}
+
+// startTLSPolicy returns the listener STARTTLS policy,
+// requiring TLS unless otherwise configured.
+func (s *c2sStream) startTLSPolicy() StartTLSPolicy {
+	if len(s.cfg.TLS.StartTLS) == 0 {
+		return StartTLSRequired
+	}
+	return s.cfg.TLS.StartTLS
+}
+
+// isTLSRequired returns whether or not the stream must be secured
+// before attempting to authenticate.
+func (s *c2sStream) isTLSRequired() bool {
+	return s.cfg.Transport.Type == transport.Socket && !s.IsSecured() && s.startTLSPolicy() == StartTLSRequired
+}
+
+func isAuthOrBindIQ(iq *xml.IQ) bool {
+	return iq.Elements().ChildNamespace("query", "jabber:iq:auth") != nil ||
+		iq.Elements().ChildNamespace("bind", bindNamespace) != nil
+}
+
+func (s *c2sStream) isCompressionAvailable() bool {
+	if s.cfg.Transport.Type != transport.Socket || s.cfg.Compression.Level == compress.NoCompression {
+		return false
+	}
+	// compressing an encrypted stream may leak its content (CRIME like attacks)
+	return !s.IsSecured() || s.cfg.Compression.AllowOverTLS
+}
+
 func (s *c2sStream) startAuthentication(elem xml.XElement) {
 	mechanism := elem.Attributes().Get("mechanism")
 	for _, authr := range s.authrs {
-		if authr.Mechanism() == mechanism {
+		if authr.Mechanism() == mechanism && s.isMechanismAvailable(authr) {
 			if err := s.continueAuthentication(elem, authr); err != nil {
 				return
 			}
 			if authr.Authenticated() {
-				s.finishAuthentication(authr.Username())
+				metrics.ObserveAuthentication(authr.Mechanism(), true)
+				s.finishAuthentication(authr)
 			} else {
 				s.activeAuthr = authr
 				s.setState(authenticating)
@@ -583,24 +923,38 @@ func (s *c2sStream) startAuthentication(elem xml.XElement) {
 
 func (s *c2sStream) continueAuthentication(elem xml.XElement, authr authenticator) error {
 	err := authr.ProcessElement(elem)
+	if err != nil {
+		metrics.ObserveAuthentication(authr.Mechanism(), false)
+	}
 	if saslErr, ok := err.(saslError); ok {
 		s.failAuthentication(saslErr.Element())
 	} else if err != nil {
-		log.Error(err)
+		c2s.Logger(s).Error(err)
 		s.failAuthentication(errSASLTemporaryAuthFailure.(saslError).Element())
 	}
 	return err
 }
 
-func (s *c2sStream) finishAuthentication(username string) {
+func (s *c2sStream) finishAuthentication(authr authenticator) {
+	username := authr.Username()
+	anonymous := authr.Mechanism() == "ANONYMOUS"
 	if s.activeAuthr != nil {
 		s.activeAuthr.Reset()
 		s.activeAuthr = nil
 	}
+	if !anonymous {
+		if err := storeExternalUser(username); err != nil {
+			c2s.Logger(s).Error(err)
+		}
+		if err := upgradeScramCredentials(username); err != nil {
+			c2s.Logger(s).Error(err)
+		}
+	}
 	j, _ := xml.NewJID(username, s.Domain(), "", true)
 
 	s.ctx.SetString(username, usernameContextKey)
 	s.ctx.SetBool(true, authenticatedContextKey)
+	s.ctx.SetBool(anonymous, anonymousContextKey)
 	s.ctx.SetObject(j, jidContextKey)
 
 	s.restart()
@@ -628,10 +982,77 @@ func (s *c2sStream) bindResource(iq *xml.IQ) {
 	if resourceElem := bind.Elements().Child("resource"); resourceElem != nil {
 		resource = resourceElem.Text()
 	} else {
-		resource = uuid.New()
+		resource = s.generateResource(bind)
+	}
+	if err := s.bind(resource); err != nil {
+		s.writeElement(xml.NewErrorElementFromElement(iq, err.(*xml.StanzaError), nil))
+		return
+	}
+	//...notify successful binding
+	result := xml.NewIQType(iq.ID(), xml.ResultType)
+	result.SetNamespace(iq.Namespace())
+
+	binded := xml.NewElementNamespace("bind", bindNamespace)
+	jid := xml.NewElementName("jid")
+	jid.SetText(s.Username() + "@" + s.Domain() + "/" + s.Resource())
+	binded.AppendElement(jid)
+	result.AppendElement(binded)
+
+	s.writeElement(result)
+
+	s.authenticateStream()
+}
+
+// generateResource returns a server generated resourcepart, according to
+// the resource generation policy, not bound to any other user session.
+func (s *c2sStream) generateResource(bind xml.XElement) string {
+	bound := make(map[string]bool)
+	for _, stm := range c2s.Instance().StreamsMatchingJID(s.JID().ToBareJID()) {
+		bound[stm.Resource()] = true
+	}
+	var hint string
+	if s.cfg.ResourceGeneration == ClientHintResource {
+		hint = s.resourceHint(bind)
+	}
+	for {
+		var resource string
+		switch {
+		case s.cfg.ResourceGeneration == CounterResource:
+			resource = strconv.FormatUint(atomic.AddUint64(&resourceCounter, 1), 10)
+		case len(hint) > 0:
+			// keep the client provided hint, appending a random suffix to it...
+			resource = hint + "." + strings.Split(uuid.New(), "-")[0]
+		default:
+			resource = uuid.New()
+		}
+		if !bound[resource] {
+			return resource
+		}
 	}
-	// try binding...
-	var stm c2s.Stream
+}
+
+// resourceHint returns the client software identifier provided along
+// with a bind request (as XEP-0386 <tag/> element), if it's a valid resourcepart.
+func (s *c2sStream) resourceHint(bind xml.XElement) string {
+	tag := bind.Elements().Child("tag")
+	if tag == nil {
+		return ""
+	}
+	hint := strings.TrimSpace(tag.Text())
+	if len(hint) == 0 || len(hint) > maxResourceHintLength {
+		return ""
+	}
+	if _, err := xml.NewJID(s.Username(), s.Domain(), hint, false); err != nil {
+		return ""
+	}
+	return hint
+}
+
+// bind binds a resource to the authenticated stream according
+// to the resource conflict policy and the configured session limits,
+// returning the stanza error to be reported in case of failure.
+func (s *c2sStream) bind(resource string) error {
+	var stm, replaced c2s.Stream
 	stms := c2s.Instance().StreamsMatchingJID(s.JID().ToBareJID())
 	for _, s := range stms {
 		if s.Resource() == resource {
@@ -646,40 +1067,95 @@ func (s *c2sStream) bindResource(iq *xml.IQ) {
 			h := sha256.New()
 			h.Write([]byte(s.ID()))
 			resource = hex.EncodeToString(h.Sum(nil))
+		case RandomSuffix:
+			// keep the requested resourcepart, appending a random suffix to it...
+			resource = resource + "-" + strings.Split(uuid.New(), "-")[0]
 		case Replace:
-			// terminate the session of the currently connected client...
-			stm.Disconnect(streamerror.ErrResourceConstraint)
+			replaced = stm
 		default:
 			// disallow resource binding attempt...
-			s.writeElement(iq.ConflictError())
-			return
+			return xml.ErrConflict
+		}
+	}
+	if replaced == nil {
+		// a new session is about to be established...
+		if max := c2s.Instance().MaxSessionsPerUser(); max > 0 && len(stms) >= max {
+			if s.cfg.ResourceConflict != Replace {
+				return xml.ErrResourceConstraint
+			}
+			replaced = stms[0] // make room by replacing user's oldest session
+		} else if max := c2s.Instance().MaxSessions(); max > 0 && c2s.Instance().AuthenticatedStreamsCount() >= max {
+			return xml.ErrResourceConstraint
 		}
 	}
+	if replaced != nil {
+		s.replaceSession(replaced)
+	}
 	userJID, err := xml.NewJID(s.Username(), s.Domain(), resource, false)
 	if err != nil {
-		s.writeElement(iq.BadRequestError())
-		return
+		return xml.ErrBadRequest
 	}
 	s.ctx.SetString(resource, resourceContextKey)
 	s.ctx.SetObject(userJID, jidContextKey)
 
-	log.Infof("binded resource... (%s/%s)", s.Username(), s.Resource())
+	c2s.Logger(s).Infof("binded resource... (%s/%s)", s.Username(), s.Resource())
+	return nil
+}
 
-	//...notify successful binding
-	result := xml.NewIQType(iq.ID(), xml.ResultType)
-	result.SetNamespace(iq.Namespace())
+// replaceSession terminates the session of a currently connected client,
+// waiting until its unavailable presence has been broadcasted.
+func (s *c2sStream) replaceSession(stm c2s.Stream) {
+	stm.Disconnect(streamerror.ErrConflict)
+	select {
+	case <-stm.Context().Done():
+	case <-time.After(replacedSessionTimeout):
+		c2s.Logger(s).Warnf("replaced session termination timeout... (%s/%s)", stm.Username(), stm.Resource())
+	}
+}
 
-	binded := xml.NewElementNamespace("bind", bindNamespace)
-	jid := xml.NewElementName("jid")
-	jid.SetText(s.Username() + "@" + s.Domain() + "/" + s.Resource())
-	binded.AppendElement(jid)
-	result.AppendElement(binded)
+func (s *c2sStream) authenticateStream() {
+	if err := c2s.Instance().AuthenticateStream(s); err != nil {
+		c2s.Logger(s).Error(err)
+	}
+	s.updateResource()
 
-	s.writeElement(result)
+	// greet the user once the resource has been bound
+	if msg := s.loginMessage(); msg != nil {
+		s.writeElement(msg.Message(s.JID()))
+	}
+}
 
-	if err := c2s.Instance().AuthenticateStream(s); err != nil {
-		log.Error(err)
+func (s *c2sStream) finishLegacyAuthentication(iq *xml.IQ, username, resource string) {
+	if err := storeExternalUser(username); err != nil {
+		c2s.Logger(s).Error(err)
+	}
+	if err := upgradeScramCredentials(username); err != nil {
+		c2s.Logger(s).Error(err)
+	}
+	prevJID := s.JID()
+	j, _ := xml.NewJID(username, s.Domain(), "", true)
+
+	s.ctx.SetString(username, usernameContextKey)
+	s.ctx.SetBool(true, authenticatedContextKey)
+	s.ctx.SetObject(j, jidContextKey)
+
+	if err := s.bind(resource); err != nil {
+		s.ctx.SetString("", usernameContextKey)
+		s.ctx.SetBool(false, authenticatedContextKey)
+		s.ctx.SetObject(prevJID, jidContextKey)
+
+		s.writeElement(xml.NewErrorElementFromElement(iq, err.(*xml.StanzaError), nil))
+		return
+	}
+	s.writeElement(iq.ResultIQ())
+
+	s.authenticateStream()
+
+	// non-SASL authentication establishes the session right away
+	if s.ping != nil {
+		s.ping.StartPinging()
 	}
+	s.setState(sessionStarted)
 }
 
 func (s *c2sStream) startSession(iq *xml.IQ) {
@@ -703,10 +1179,24 @@ func (s *c2sStream) startSession(iq *xml.IQ) {
 
 func (s *c2sStream) processStanza(stanza xml.Stanza) {
 	toJID := stanza.ToJID()
+	if iq, ok := stanza.(*xml.IQ); ok && s.isServerOriginatedIQResponse(iq) && s.iqTracker.resolve(iq) {
+		return
+	}
 	if s.isBlockedJID(toJID) { // blocked JID?
-		blocked := xml.NewElementNamespace("blocked", blockedErrorNamespace)
-		resp := xml.NewErrorElementFromElement(stanza, xml.ErrNotAcceptable.(*xml.StanzaError), []xml.XElement{blocked})
-		s.writeElement(resp)
+		s.bounceOutboundBlockedStanza(stanza)
+		return
+	}
+	if s.privacy != nil && s.privacy.IsBlockedOutbound(stanza) { // blocked by privacy list?
+		switch stanza := stanza.(type) {
+		case *xml.Message:
+			if !stanza.IsError() {
+				s.writeElement(stanza.NotAcceptableError())
+			}
+		case *xml.IQ:
+			if stanza.IsGet() || stanza.IsSet() {
+				s.writeElement(stanza.NotAcceptableError())
+			}
+		}
 		return
 	}
 	switch stanza := stanza.(type) {
@@ -719,39 +1209,73 @@ func (s *c2sStream) processStanza(stanza xml.Stanza) {
 	}
 }
 
+// isServerOriginatedIQResponse returns whether or not an IQ is addressed
+// to the server on behalf of this stream, as responses to server originated IQs are.
+func (s *c2sStream) isServerOriginatedIQResponse(iq *xml.IQ) bool {
+	toJID := iq.ToJID()
+	if !c2s.Instance().IsLocalDomain(toJID.Domain()) {
+		return false
+	}
+	return toJID.IsServer() || (toJID.IsBare() && toJID.Node() == s.Username())
+}
+
 func (s *c2sStream) processComponentStanza(stanza xml.Stanza) {
 }
 
 func (s *c2sStream) processIQ(iq *xml.IQ) {
 	toJID := iq.ToJID()
 	if !c2s.Instance().IsLocalDomain(toJID.Domain()) {
-		// TODO(ortuman): Implement XMPP federation
+		switch err := c2s.Instance().Route(iq); err {
+		case nil, router.ErrDropped:
+			break
+		case s2s.ErrRemoteServerNotFound:
+			if iq.IsGet() || iq.IsSet() {
+				s.writeElement(iq.RemoteServerNotFoundError())
+			}
+		case s2s.ErrRemoteDomainNotAllowed:
+			if iq.IsGet() || iq.IsSet() {
+				s.writeElement(iq.NotAllowedError())
+			}
+		default:
+			c2s.Logger(s).Error(err)
+		}
 		return
 	}
 	if node := toJID.Node(); len(node) > 0 && c2s.Instance().IsBlockedJID(s.JID(), node) {
 		// destination user blocked stream JID
-		if iq.IsGet() || iq.IsSet() {
-			s.writeElement(iq.ServiceUnavailableError())
-		}
+		s.replyUnhandledIQ(iq)
 		return
 	}
 	if toJID.IsFullWithUser() {
-		switch c2s.Instance().Route(iq) {
-		case c2s.ErrResourceNotFound:
-			s.writeElement(iq.ServiceUnavailableError())
+		switch err := c2s.Instance().Route(iq); err {
+		case nil, router.ErrDropped:
+			break
+		case c2s.ErrResourceNotFound, c2s.ErrNotAuthenticated, c2s.ErrNotExistingAccount, c2s.ErrBlockedJID:
+			s.replyUnhandledIQ(iq)
+		default:
+			c2s.Logger(s).Error(err)
 		}
 		return
 	}
 
-	for _, handler := range s.iqHandlers {
-		if !handler.MatchesIQ(iq) {
-			continue
+	if handler := s.modules.MatchingIQHandler(iq); handler != nil {
+		if s.isAnonymous() && iq.IsSet() && isPersistentModule(handler) {
+			// anonymous users are not allowed to persist any data
+			s.writeElement(iq.ForbiddenError())
+			return
 		}
 		handler.ProcessIQ(iq)
 		return
 	}
 
 	// ...IQ not handled...
+	s.replyUnhandledIQ(iq)
+}
+
+// replyUnhandledIQ answers an IQ request no entity is able to handle
+// with a service-unavailable error, as mandated by RFC 6120.
+// Result and error IQs are never answered.
+func (s *c2sStream) replyUnhandledIQ(iq *xml.IQ) {
 	if iq.IsGet() || iq.IsSet() {
 		s.writeElement(iq.ServiceUnavailableError())
 	}
@@ -759,22 +1283,41 @@ func (s *c2sStream) processIQ(iq *xml.IQ) {
 
 func (s *c2sStream) processPresence(presence *xml.Presence) {
 	toJID := presence.ToJID()
-	if !c2s.Instance().IsLocalDomain(toJID.Domain()) {
-		// TODO(ortuman): Implement XMPP federation
+	if !c2s.Instance().IsLocalDomain(toJID.Domain()) && !toJID.IsBare() {
+		// directed presence to a remote entity (subscriptions go through roster)
+		s.routeDirectedPresence(presence)
 		return
 	}
 	if toJID.IsBare() && (toJID.Node() != s.Username() || toJID.Domain() != s.Domain()) {
+		if s.isAnonymous() && !presence.IsAvailable() && !presence.IsUnavailable() {
+			// anonymous users can't manage roster subscriptions
+			s.writeElement(presence.ForbiddenError())
+			return
+		}
 		if s.roster != nil {
 			s.roster.ProcessPresence(presence)
 		}
+		if s.pep != nil && presence.IsSubscribed() {
+			s.pep.DeliverLastItemsTo(toJID)
+		}
 		return
 	}
 	if toJID.IsFullWithUser() {
-		c2s.Instance().Route(presence)
+		s.routeDirectedPresence(presence)
 		return
 	}
+	// XEP-0153: vCard-Based Avatars (https://xmpp.org/extensions/xep-0153.html)
+	if s.vCard != nil {
+		presence = s.vCard.AnnotatePresence(presence)
+	}
 	// set context presence
 	s.ctx.SetObject(presence, presenceContextKey)
+	s.updateResource()
+
+	// XEP-0115: Entity Capabilities (https://xmpp.org/extensions/xep-0115.html)
+	if s.caps != nil {
+		s.caps.ProcessPresence(presence)
+	}
 
 	// deliver pending approval notifications
 	if s.roster != nil {
@@ -786,40 +1329,162 @@ func (s *c2sStream) processPresence(presence *xml.Presence) {
 	}
 
 	// deliver offline messages
-	if p := s.Presence(); s.offline != nil && p != nil && p.Priority() >= 0 {
+	if s.offline != nil && c2s.IsMessageRecipient(s) {
 		s.ctx.DoOnce(offlineOnce, func() {
 			s.offline.DeliverOfflineMessages()
 		})
 	}
+
+	// deliver last published PEP items
+	if s.pep != nil && presence.IsAvailable() {
+		s.ctx.DoOnce(pepOnce, func() {
+			s.pep.DeliverLastItems()
+		})
+	}
+}
+
+// routeDirectedPresence routes a presence addressed to a specific entity.
+// Available and unavailable presences go through roster, so that
+// directed presence recipients are notified once the user goes unavailable.
+func (s *c2sStream) routeDirectedPresence(presence *xml.Presence) {
+	if s.roster != nil && (presence.IsAvailable() || presence.IsUnavailable()) {
+		s.roster.ProcessPresence(presence)
+		return
+	}
+	if err := c2s.Instance().Route(presence); err != nil && err != router.ErrDropped {
+		c2s.Logger(s).Error(err)
+	}
+}
+
+func (s *c2sStream) broadcastPhotoUpdate() {
+	presence := s.Presence()
+	if presence == nil || !presence.IsAvailable() {
+		return
+	}
+	presence = s.vCard.AnnotatePresence(presence)
+	s.ctx.SetObject(presence, presenceContextKey)
+	s.updateResource()
+
+	if s.roster != nil {
+		s.roster.BroadcastPresence(presence)
+	}
 }
 
 func (s *c2sStream) processMessage(message *xml.Message) {
 	toJID := message.ToJID()
+	s.removeLocalStanzaIDs(message)
+
+	if s.chatStates != nil {
+		if message = s.chatStates.ProcessSentMessage(message); message == nil {
+			return
+		}
+	}
+	if s.receipts != nil {
+		if message = s.receipts.ProcessSentMessage(message); message == nil {
+			return
+		}
+	}
+	if s.chatMarkers != nil {
+		if message = s.chatMarkers.ProcessSentMessage(message); message == nil {
+			return
+		}
+	}
+	if s.mam != nil && !s.isAnonymous() {
+		s.mam.StampMessage(message)
+	}
+
 	if !c2s.Instance().IsLocalDomain(toJID.Domain()) {
-		// TODO(ortuman): Implement XMPP federation
+		routed, err := c2s.Instance().RouteStanza(message)
+		switch err {
+		case nil:
+			s.acceptMessage(routedMessage(routed, message))
+		case router.ErrDropped:
+			break
+		case s2s.ErrRemoteServerNotFound:
+			s.writeElement(message.RemoteServerNotFoundError())
+		case s2s.ErrRemoteDomainNotAllowed:
+			s.writeElement(message.NotAllowedError())
+		default:
+			c2s.Logger(s).Error(err)
+		}
 		return
 	}
 
 sendMessage:
-	err := c2s.Instance().Route(message)
+	routed, err := c2s.Instance().RouteStanza(message)
 	switch err {
 	case nil:
+		s.acceptMessage(routedMessage(routed, message))
+	case router.ErrDropped:
 		break
 	case c2s.ErrNotAuthenticated:
+		message := routedMessage(routed, message)
+		if message.IsHeadline() || message.Type() == xml.ErrorType {
+			return // only delivered to available resources, never stored offline
+		}
+		if s.chatMarkers != nil && s.chatMarkers.IsStandalone(message) {
+			return // avoid piling up markers while the user is offline
+		}
+		s.acceptMessage(message)
 		if s.offline != nil {
-			if (message.IsChat() || message.IsGroupChat()) && message.IsMessageWithBody() {
-				return
-			}
 			s.offline.ArchiveMessage(message)
 		}
+		if s.push != nil {
+			s.push.NotifyMessage(message)
+		}
 	case c2s.ErrResourceNotFound:
+		switch {
+		case message.IsHeadline() || message.Type() == xml.ErrorType:
+			return // silently ignored
+		case message.IsGroupChat():
+			s.writeElement(message.ServiceUnavailableError())
+			return
+		}
 		// treat the stanza as if it were addressed to <node@domain>
 		toJID = toJID.ToBareJID()
+		bareMessage, err := xml.NewMessageFromElement(message, message.FromJID(), toJID)
+		if err != nil {
+			c2s.Logger(s).Error(err)
+			return
+		}
+		message = bareMessage
 		goto sendMessage
 	case c2s.ErrNotExistingAccount, c2s.ErrBlockedJID:
 		s.writeElement(message.ServiceUnavailableError())
 	default:
-		log.Error(err)
+		c2s.Logger(s).Error(err)
+	}
+}
+
+// routedMessage returns the message delivered by the router,
+// as modified by routing hooks.
+func routedMessage(routed xml.Stanza, message *xml.Message) *xml.Message {
+	if m, ok := routed.(*xml.Message); ok {
+		return m
+	}
+	return message
+}
+
+// removeLocalStanzaIDs removes every stanza-id (XEP-0359) claiming to be
+// assigned by a local entity, as clients are not allowed to spoof them.
+// Sender's origin-id is left untouched.
+func (s *c2sStream) removeLocalStanzaIDs(message *xml.Message) {
+	for _, sid := range message.Elements().ChildrenNamespace("stanza-id", stanzaIDNamespace) {
+		by := sid.Attributes().Get("by")
+		byJID, err := xml.NewJIDString(by, true)
+		if err != nil || c2s.Instance().IsLocalDomain(byJID.Domain()) {
+			message.RemoveStanzaID(by)
+		}
+	}
+}
+
+func (s *c2sStream) acceptMessage(message *xml.Message) {
+	// only carbon and archive messages accepted by the router (neither blocked nor bounced)
+	if s.carbons != nil {
+		s.carbons.ProcessSentMessage(message)
+	}
+	if s.mam != nil && !s.isAnonymous() {
+		s.mam.ArchiveMessage(message)
 	}
 }
 
@@ -834,7 +1499,8 @@ func (s *c2sStream) actorLoop() {
 }
 
 func (s *c2sStream) doRead() {
-	if elem, err := s.tr.ReadElement(); err == nil {
+	tr := s.tr
+	if elem, err := tr.ReadElement(); err == nil {
 		s.actorCh <- func() {
 			s.readElement(elem)
 		}
@@ -853,9 +1519,18 @@ func (s *c2sStream) doRead() {
 				discErr = streamerror.ErrInvalidXML
 			}
 
-		case transport.ErrTooLargeStanza:
+		case transport.ErrTooLargeStanza, xml.ErrTooDeepElement:
 			discErr = streamerror.ErrPolicyViolation
 
+		case xml.ErrRestrictedXML:
+			discErr = streamerror.ErrRestrictedXML
+
+		case transport.ErrTruncatedStanza:
+			discErr = streamerror.ErrNotWellFormed
+
+		case compress.ErrProcessingFailed:
+			discErr = streamerror.ErrUndefinedCondition
+
 		default:
 			switch e := err.(type) {
 			case net.Error:
@@ -869,24 +1544,60 @@ func (s *c2sStream) doRead() {
 				break // connection closed by peer...
 
 			default:
-				log.Error(err)
+				c2s.Logger(s).Error(err)
 				discErr = streamerror.ErrInvalidXML
 			}
 		}
+		isClosedByPeer := err == xml.ErrStreamClosedByPeer
+		isCompressionFailure := err == compress.ErrProcessingFailed
 		s.actorCh <- func() {
+			if tr != s.tr {
+				return // transport replaced on stream resumption...
+			}
+			if isCompressionFailure {
+				failure := xml.NewElementNamespace("failure", compressProtocolNamespace)
+				failure.AppendElement(xml.NewElementName("processing-failed"))
+				s.writeElement(failure)
+				s.disconnect(discErr)
+				return
+			}
+			if !isClosedByPeer && s.sm.isResumable() && s.getState() == sessionStarted {
+				s.detach()
+				return
+			}
 			s.disconnect(discErr)
 		}
 	}
 }
 
 func (s *c2sStream) writeElement(element xml.XElement) {
-	log.Debugf("SEND: %v", element)
+	isQueued := s.sm.enabled && isStanzaElement(element)
+	if isQueued && !s.queueStreamMgmtElement(element) {
+		return
+	}
+	if s.sm.detached {
+		return // wait until stream is resumed...
+	}
+	c2s.Logger(s).Debugf("SEND: %v", element)
 	s.tr.WriteElement(element, true)
+
+	if isQueued {
+		s.requestStreamMgmtAck()
+	}
 }
 
 func (s *c2sStream) readElement(elem xml.XElement) {
 	if elem != nil {
-		log.Debugf("RECV: %v", elem)
+		c2s.Logger(s).Debugf("RECV: %v", elem)
+		if s.idleTm != nil {
+			s.idleTm.Reset(s.idleTimeout())
+		}
+		// only stanzas are rate limited; stream negotiation and stream management nonzas are not
+		if s.rateLimiter != nil && isStanzaElement(elem) && !s.rateLimiter.allow(time.Now()) {
+			c2s.Logger(s).Infof("inbound rate limit exceeded... id: %s", s.id)
+			s.disconnectWithStreamError(streamerror.ErrPolicyViolation)
+			return
+		}
 		s.handleElement(elem)
 	}
 	if s.getState() != disconnected {
@@ -902,7 +1613,7 @@ func (s *c2sStream) disconnect(err error) {
 		if strmErr, ok := err.(*streamerror.Error); ok {
 			s.disconnectWithStreamError(strmErr)
 		} else {
-			log.Error(err)
+			c2s.Logger(s).Error(err)
 			s.disconnectClosingStream(false)
 		}
 	}
@@ -920,7 +1631,7 @@ func (s *c2sStream) openStream() {
 		ops.SetAttribute("xmlns:stream", streamNamespace)
 		buf.WriteString(`<?xml version="1.0"?>`)
 
-	case transport.WebSocket:
+	case transport.WebSocket, transport.Bosh:
 		ops = xml.NewElementName("open")
 		ops.SetAttribute("xmlns", framedStreamNamespace)
 		includeClosing = true
@@ -928,13 +1639,17 @@ func (s *c2sStream) openStream() {
 	default:
 		return
 	}
-	ops.SetAttribute("id", uuid.New())
+	streamID := uuid.New()
+	if s.legacyAuth != nil {
+		s.legacyAuth.SetStreamID(streamID)
+	}
+	ops.SetAttribute("id", streamID)
 	ops.SetAttribute("from", s.Domain())
 	ops.SetAttribute("version", "1.0")
 	ops.ToXML(buf, includeClosing)
 
 	openStr := buf.String()
-	log.Debugf("SEND: %s", openStr)
+	c2s.Logger(s).Debugf("SEND: %s", openStr)
 
 	s.tr.WriteString(buf.String())
 }
@@ -951,7 +1666,7 @@ func (s *c2sStream) buildStanza(elem xml.XElement, validateFrom bool) (xml.Stanz
 	case "iq":
 		iq, err := xml.NewIQFromElement(elem, fromJID, toJID)
 		if err != nil {
-			log.Error(err)
+			c2s.Logger(s).Error(err)
 			return nil, xml.ErrBadRequest
 		}
 		return iq, nil
@@ -959,7 +1674,7 @@ func (s *c2sStream) buildStanza(elem xml.XElement, validateFrom bool) (xml.Stanz
 	case "presence":
 		presence, err := xml.NewPresenceFromElement(elem, fromJID, toJID)
 		if err != nil {
-			log.Error(err)
+			c2s.Logger(s).Error(err)
 			return nil, xml.ErrBadRequest
 		}
 		return presence, nil
@@ -967,7 +1682,7 @@ func (s *c2sStream) buildStanza(elem xml.XElement, validateFrom bool) (xml.Stanz
 	case "message":
 		message, err := xml.NewMessageFromElement(elem, fromJID, toJID)
 		if err != nil {
-			log.Error(err)
+			c2s.Logger(s).Error(err)
 			return nil, xml.ErrBadRequest
 		}
 		return message, nil
@@ -981,7 +1696,7 @@ func (s *c2sStream) handleElementError(elem xml.XElement, err error) {
 	} else if stanzaErr, ok := err.(*xml.StanzaError); ok {
 		s.writeElement(xml.NewErrorElementFromElement(elem, stanzaErr, nil))
 	} else {
-		log.Error(err)
+		c2s.Logger(s).Error(err)
 	}
 }
 
@@ -995,7 +1710,7 @@ func (s *c2sStream) validateStreamElement(elem xml.XElement) *streamerror.Error
 			return streamerror.ErrInvalidNamespace
 		}
 
-	case transport.WebSocket:
+	case transport.WebSocket, transport.Bosh:
 		if elem.Name() != "open" {
 			return streamerror.ErrUnsupportedStanzaType
 		}
@@ -1003,10 +1718,14 @@ func (s *c2sStream) validateStreamElement(elem xml.XElement) *streamerror.Error
 			return streamerror.ErrInvalidNamespace
 		}
 	}
-	to := elem.To()
+	to := c2s.Instance().CanonicalDomain(elem.To())
 	if len(to) > 0 && !c2s.Instance().IsLocalDomain(to) {
 		return streamerror.ErrHostUnknown
 	}
+	// a restarted stream can't switch to a different host
+	if s.hostSelected && to != s.Domain() {
+		return streamerror.ErrHostUnknown
+	}
 	if elem.Version() != "1.0" {
 		return streamerror.ErrUnsupportedVersion
 	}
@@ -1036,6 +1755,9 @@ func (s *c2sStream) extractAddresses(elem xml.XElement, validateFrom bool) (from
 		if err != nil {
 			return nil, nil, xml.ErrJidMalformed
 		}
+		if domain := c2s.Instance().CanonicalDomain(toJID.Domain()); domain != toJID.Domain() {
+			toJID, _ = xml.NewJID(toJID.Node(), domain, toJID.Resource(), true)
+		}
 	} else {
 		toJID, err = xml.NewJID("", s.Domain(), "", true)
 	}
@@ -1047,7 +1769,7 @@ func (s *c2sStream) isValidFrom(from string) bool {
 	j, err := xml.NewJIDString(from, false)
 	if err == nil && j != nil {
 		node := j.Node()
-		domain := j.Domain()
+		domain := c2s.Instance().CanonicalDomain(j.Domain())
 		resource := j.Resource()
 
 		userJID := s.JID()
@@ -1072,29 +1794,84 @@ func (s *c2sStream) disconnectWithStreamError(err *streamerror.Error) {
 }
 
 func (s *c2sStream) disconnectClosingStream(closeStream bool) {
+	wasDetached := s.sm.detached
+	s.handOffUnackedStanzas()
+	s.releaseStreamMgmt()
+
 	if err := s.updateLogoutInfo(); err != nil {
-		log.Error(err)
+		c2s.Logger(s).Error(err)
 	}
-	if presence := s.Presence(); presence != nil && presence.IsAvailable() && s.roster != nil {
-		s.roster.BroadcastPresenceAndWait(xml.NewPresence(s.JID(), s.JID(), xml.UnavailableType))
+	if s.roster != nil {
+		if presence := s.Presence(); presence != nil && presence.IsAvailable() {
+			s.roster.BroadcastPresenceAndWait(xml.NewPresence(s.JID(), s.JID(), xml.UnavailableType))
+		} else {
+			// directed presences may have been sent without any initial presence
+			s.roster.LeaveDirectedPresencesAndWait()
+		}
+	}
+	if s.modules != nil {
+		s.modules.Done()
 	}
-	if closeStream {
+	s.iqTracker.reset()
+	if closeStream && !wasDetached {
 		switch s.cfg.Transport.Type {
 		case transport.Socket:
 			s.tr.WriteString("</stream:stream>")
-		case transport.WebSocket:
+		case transport.WebSocket, transport.Bosh:
 			s.tr.WriteString(fmt.Sprintf(`<close xmlns="%s" />`, framedStreamNamespace))
 		}
 	}
+	if s.idleTm != nil {
+		s.idleTm.Stop()
+	}
 	// signal termination...
 	s.ctx.Terminate()
 
 	// unregister stream
 	if err := c2s.Instance().UnregisterStream(s); err != nil {
-		log.Error(err)
+		c2s.Logger(s).Error(err)
+	}
+	if resource := s.Resource(); len(resource) > 0 {
+		if err := storage.Instance().DeleteResource(s.Username(), resource, s.ID()); err != nil {
+			c2s.Logger(s).Error(err)
+		}
+	}
+	if s.isAnonymous() {
+		// tear down any anonymous user trace
+		if err := storage.Instance().DeleteUser(s.Username()); err != nil {
+			c2s.Logger(s).Error(err)
+		}
 	}
 	s.setState(disconnected)
-	s.tr.Close()
+	if !wasDetached {
+		s.tr.Close()
+	}
+}
+
+// forceClose closes stream's underlying transport without going
+// through the actor loop, which might be blocked on a stalled peer.
+func (s *c2sStream) forceClose() {
+	s.trMu.RLock()
+	tr := s.tr
+	s.trMu.RUnlock()
+	tr.Close()
+}
+
+// updateResource stores stream's online resource
+// along with its current presence.
+func (s *c2sStream) updateResource() {
+	res := &model.Resource{
+		Username:     s.Username(),
+		Resource:     s.Resource(),
+		StreamID:     s.ID(),
+		LastActivity: time.Now(),
+	}
+	if presence := s.Presence(); presence != nil {
+		res.Presence = presence
+	}
+	if err := storage.Instance().InsertOrUpdateResource(res); err != nil {
+		c2s.Logger(s).Error(err)
+	}
 }
 
 func (s *c2sStream) updateLogoutInfo() error {
@@ -1112,6 +1889,53 @@ func (s *c2sStream) updateLogoutInfo() error {
 	return err
 }
 
+func (s *c2sStream) bounceBlockedStanza(stanza xml.Stanza) {
+	// blocked presences are silently dropped
+	var resp xml.Stanza
+	var err error
+	switch stanza := stanza.(type) {
+	case *xml.Message:
+		if stanza.IsError() {
+			return
+		}
+		resp, err = xml.NewMessageFromElement(stanza.ServiceUnavailableError(), stanza.ToJID(), stanza.FromJID())
+	case *xml.IQ:
+		if !stanza.IsGet() && !stanza.IsSet() {
+			return
+		}
+		resp, err = xml.NewIQFromElement(stanza.ServiceUnavailableError(), stanza.ToJID(), stanza.FromJID())
+	default:
+		return
+	}
+	if err != nil {
+		c2s.Logger(s).Error(err)
+		return
+	}
+	if err := c2s.Instance().Route(resp); err != nil && err != router.ErrDropped {
+		c2s.Logger(s).Error(err)
+	}
+}
+
+// bounceOutboundBlockedStanza replies to a stanza addressed to a blocked JID
+// (https://xmpp.org/extensions/xep-0191.html#block-send)
+func (s *c2sStream) bounceOutboundBlockedStanza(stanza xml.Stanza) {
+	switch stanza := stanza.(type) {
+	case *xml.Message:
+		if stanza.IsError() {
+			return
+		}
+	case *xml.IQ:
+		if !stanza.IsGet() && !stanza.IsSet() {
+			return
+		}
+	default:
+		// blocked presences are silently dropped
+		return
+	}
+	blocked := xml.NewElementNamespace("blocked", blockedErrorNamespace)
+	s.writeElement(xml.NewErrorElementFromElement(stanza, xml.ErrNotAcceptable.(*xml.StanzaError), []xml.XElement{blocked}))
+}
+
 func (s *c2sStream) isBlockedJID(jid *xml.JID) bool {
 	if jid.IsServer() && c2s.Instance().IsLocalDomain(jid.Domain()) {
 		return false
@@ -1119,6 +1943,19 @@ func (s *c2sStream) isBlockedJID(jid *xml.JID) bool {
 	return c2s.Instance().IsBlockedJID(jid, s.Username())
 }
 
+func (s *c2sStream) isAnonymous() bool {
+	return s.ctx.Bool(anonymousContextKey)
+}
+
+func isPersistentModule(handler module.IQHandler) bool {
+	switch handler.(type) {
+	case *roster.ModRoster, *xep0016.XEPPrivacy, *xep0049.XEPPrivateStorage, *xep0054.XEPVCard,
+		*xep0077.XEPRegister, *xep0163.XEPPep, *xep0191.XEPBlockingCommand, *xep0357.XEPPush:
+		return true
+	}
+	return false
+}
+
 func (s *c2sStream) restart() {
 	s.setState(connecting)
 }
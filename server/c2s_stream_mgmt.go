@@ -0,0 +1,356 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	streamMgmtNamespace = "urn:xmpp:sm:3"
+	stanzasNamespace    = "urn:ietf:params:xml:ns:xmpp-stanzas"
+)
+
+// request an acknowledgement every 'streamMgmtRequestAckInterval' outbound stanzas
+const streamMgmtRequestAckInterval = 5
+
+// resumable streams indexed by resumption id
+var (
+	resumableStreamsMu sync.RWMutex
+	resumableStreams   = map[string]*c2sStream{}
+)
+
+type streamMgmtFailure struct {
+	condition    string
+	h            uint32
+	handledCount uint32
+	sendCount    uint32
+}
+
+func (f *streamMgmtFailure) element() xml.XElement {
+	failed := xml.NewElementNamespace("failed", streamMgmtNamespace)
+	failed.AppendElement(xml.NewElementNamespace(f.condition, stanzasNamespace))
+	if f.handledCount > f.sendCount {
+		failed.SetAttribute("h", strconv.FormatUint(uint64(f.h), 10))
+
+		tooHigh := xml.NewElementNamespace("handled-count-too-high", streamMgmtNamespace)
+		tooHigh.SetAttribute("h", strconv.FormatUint(uint64(f.handledCount), 10))
+		tooHigh.SetAttribute("send-count", strconv.FormatUint(uint64(f.sendCount), 10))
+		failed.AppendElement(tooHigh)
+	}
+	return failed
+}
+
+type streamMgmtQueueItem struct {
+	h    uint32
+	elem xml.XElement
+}
+
+// streamMgmt holds stream management state.
+// It must only be accessed from stream's actor loop.
+type streamMgmt struct {
+	enabled  bool
+	id       string
+	inH      uint32
+	outH     uint32
+	queue    []streamMgmtQueueItem
+	detached bool
+	detachTm *time.Timer
+}
+
+func (sm *streamMgmt) isResumable() bool {
+	return sm.enabled && len(sm.id) > 0
+}
+
+func (sm *streamMgmt) ack(h uint32) {
+	var i int
+	for i = 0; i < len(sm.queue); i++ {
+		// compare using serial number arithmetic, as counters wrap around
+		if int32(sm.queue[i].h-h) > 0 {
+			break
+		}
+	}
+	sm.queue = sm.queue[i:]
+}
+
+func isStanzaElement(elem xml.XElement) bool {
+	switch elem.Name() {
+	case "iq", "message", "presence":
+		return true
+	}
+	return false
+}
+
+func (s *c2sStream) handleStreamMgmt(elem xml.XElement) {
+	switch elem.Name() {
+	case "enable":
+		s.enableStreamMgmt(elem)
+	case "resume":
+		s.resumeStream(elem)
+	case "r":
+		if !s.sm.enabled {
+			s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+			return
+		}
+		a := xml.NewElementNamespace("a", streamMgmtNamespace)
+		a.SetAttribute("h", strconv.FormatUint(uint64(s.sm.inH), 10))
+		s.writeElement(a)
+	case "a":
+		if !s.sm.enabled {
+			s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+			return
+		}
+		h, err := strconv.ParseUint(elem.Attributes().Get("h"), 10, 32)
+		if err != nil {
+			s.disconnectWithStreamError(streamerror.ErrInvalidXML)
+			return
+		}
+		s.sm.ack(uint32(h))
+	default:
+		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+	}
+}
+
+func (s *c2sStream) enableStreamMgmt(elem xml.XElement) {
+	if !s.cfg.StreamManagement.Enabled || s.sm.enabled || len(s.Resource()) == 0 {
+		s.failStreamMgmt("unexpected-request")
+		return
+	}
+	s.sm.enabled = true
+
+	enabled := xml.NewElementNamespace("enabled", streamMgmtNamespace)
+	resume := elem.Attributes().Get("resume")
+	if (resume == "true" || resume == "1") && s.cfg.StreamManagement.MaxResumeTimeout > 0 {
+		s.sm.id = uuid.New()
+
+		resumableStreamsMu.Lock()
+		resumableStreams[s.sm.id] = s
+		resumableStreamsMu.Unlock()
+
+		enabled.SetAttribute("id", s.sm.id)
+		enabled.SetAttribute("resume", "true")
+		enabled.SetAttribute("max", strconv.Itoa(s.cfg.StreamManagement.MaxResumeTimeout))
+	}
+	s.writeElement(enabled)
+
+	c2s.Logger(s).Infof("enabled stream management... (%s/%s)", s.Username(), s.Resource())
+}
+
+func (s *c2sStream) resumeStream(elem xml.XElement) {
+	if !s.cfg.StreamManagement.Enabled || !s.IsAuthenticated() || len(s.Resource()) > 0 {
+		s.failStreamMgmt("unexpected-request")
+		return
+	}
+	h, err := strconv.ParseUint(elem.Attributes().Get("h"), 10, 32)
+	if err != nil {
+		s.failStreamMgmt("bad-request")
+		return
+	}
+	resumableStreamsMu.RLock()
+	prev := resumableStreams[elem.Attributes().Get("previd")]
+	resumableStreamsMu.RUnlock()
+
+	if prev == nil || prev.Username() != s.Username() || prev.Domain() != s.Domain() {
+		s.failStreamMgmt("item-not-found")
+		return
+	}
+	// hand over underlying transport to the previous stream
+	resCh := make(chan *streamMgmtFailure, 1)
+	prev.actorCh <- func() {
+		resCh <- prev.resume(s.tr, uint32(h), s.IsSecured(), s.IsCompressed())
+	}
+	failure := &streamMgmtFailure{condition: "item-not-found"}
+	select {
+	case failure = <-resCh:
+	case <-prev.ctx.Done():
+	}
+	if failure != nil {
+		s.writeElement(failure.element())
+		return
+	}
+	// this stream is no longer in use
+	s.setState(disconnected)
+	s.ctx.Terminate()
+	if err := c2s.Instance().UnregisterStream(s); err != nil {
+		c2s.Logger(s).Error(err)
+	}
+}
+
+func (s *c2sStream) resume(tr transport.Transport, h uint32, secured, compressed bool) *streamMgmtFailure {
+	if !s.sm.isResumable() || s.getState() == disconnected {
+		return &streamMgmtFailure{condition: "item-not-found"}
+	}
+	if int32(h-s.sm.outH) > 0 {
+		// peer claims to have handled more stanzas than were ever sent
+		c2s.Logger(s).Infof("stream resumption handled count too high... (%s/%s)", s.Username(), s.Resource())
+		return &streamMgmtFailure{condition: "undefined-condition", h: s.sm.inH, handledCount: h, sendCount: s.sm.outH}
+	}
+	if s.sm.detachTm != nil {
+		s.sm.detachTm.Stop()
+		s.sm.detachTm = nil
+	}
+	if !s.sm.detached {
+		// previous connection still alive... close it
+		s.tr.Close()
+	}
+	s.sm.detached = false
+	s.trMu.Lock()
+	s.tr = tr
+	s.trMu.Unlock()
+	s.ctx.SetBool(secured, securedContextKey)
+	s.ctx.SetBool(compressed, compressedContextKey)
+
+	s.sm.ack(h)
+
+	resumed := xml.NewElementNamespace("resumed", streamMgmtNamespace)
+	resumed.SetAttribute("h", strconv.FormatUint(uint64(s.sm.inH), 10))
+	resumed.SetAttribute("previd", s.sm.id)
+	s.writeElement(resumed)
+
+	// resend unacknowledged stanzas
+	for _, item := range s.sm.queue {
+		c2s.Logger(s).Debugf("SEND: %v", item.elem)
+		s.tr.WriteElement(item.elem, true)
+	}
+	c2s.Logger(s).Infof("resumed stream... (%s/%s)", s.Username(), s.Resource())
+
+	go s.doRead()
+	return nil
+}
+
+// detach keeps the session (and so its presence) alive after losing
+// the underlying connection, until either it's resumed or the resumption
+// window expires, at which point contacts are notified as usual.
+func (s *c2sStream) detach() {
+	s.sm.detached = true
+	s.tr.Close()
+
+	timeout := time.Second * time.Duration(s.cfg.StreamManagement.MaxResumeTimeout)
+	s.sm.detachTm = time.AfterFunc(timeout, func() {
+		s.actorCh <- func() {
+			if s.sm.detached {
+				c2s.Logger(s).Infof("stream resumption timeout... (%s/%s)", s.Username(), s.Resource())
+				s.disconnectClosingStream(false)
+			}
+		}
+	})
+	c2s.Logger(s).Infof("detached stream... (%s/%s)", s.Username(), s.Resource())
+}
+
+func (s *c2sStream) queueStreamMgmtElement(elem xml.XElement) bool {
+	s.sm.outH++
+	s.sm.queue = append(s.sm.queue, streamMgmtQueueItem{h: s.sm.outH, elem: elem})
+	if len(s.sm.queue) > s.cfg.StreamManagement.MaxQueueSize {
+		// stalled client... stop buffering and terminate session
+		c2s.Logger(s).Infof("stream management queue overflow... (%s/%s)", s.Username(), s.Resource())
+		s.sm.id = ""
+		if s.sm.detached {
+			s.disconnectClosingStream(false)
+		} else {
+			s.disconnectWithStreamError(streamerror.ErrPolicyViolation)
+		}
+		return false
+	}
+	return true
+}
+
+func (s *c2sStream) requestStreamMgmtAck() {
+	if s.sm.outH%streamMgmtRequestAckInterval == 0 {
+		s.writeElement(xml.NewElementNamespace("r", streamMgmtNamespace))
+	}
+}
+
+func (s *c2sStream) failStreamMgmt(condition string) {
+	failure := &streamMgmtFailure{condition: condition}
+	s.writeElement(failure.element())
+}
+
+// handOffUnackedStanzas treats every unacknowledged stanza as if it had
+// never been delivered: messages are stored offline, the rest bounced.
+func (s *c2sStream) handOffUnackedStanzas() {
+	queue := s.sm.queue
+	s.sm.queue = nil
+
+	for _, item := range queue {
+		elem := item.elem
+		if elem.Type() == xml.ErrorType {
+			continue // never bounce an error
+		}
+		fromJID, err := xml.NewJIDString(elem.From(), true)
+		if err != nil {
+			continue
+		}
+		toJID, err := xml.NewJIDString(elem.To(), true)
+		if err != nil {
+			continue
+		}
+		switch elem.Name() {
+		case "message":
+			message, err := xml.NewMessageFromElement(elem, fromJID, toJID)
+			if err != nil {
+				c2s.Logger(s).Error(err)
+				continue
+			}
+			if message.IsHeadline() {
+				continue // neither stored offline nor bounced
+			}
+			if s.offline != nil && message.IsMessageWithBody() && !message.IsGroupChat() {
+				s.offline.ArchiveMessageAndWait(message)
+				continue
+			}
+			s.bounceUnackedStanza(elem, toJID, fromJID)
+
+		case "iq":
+			if elem.Type() == xml.GetType || elem.Type() == xml.SetType {
+				s.bounceUnackedStanza(elem, toJID, fromJID)
+			}
+		}
+	}
+}
+
+func (s *c2sStream) bounceUnackedStanza(elem xml.XElement, fromJID, toJID *xml.JID) {
+	errElem := xml.NewErrorElementFromElement(elem, xml.ErrRecipientUnavailable.(*xml.StanzaError), nil)
+	stanza, err := s.buildBouncedStanza(errElem, fromJID, toJID)
+	if err != nil {
+		c2s.Logger(s).Error(err)
+		return
+	}
+	if err := c2s.Instance().Route(stanza); err != nil {
+		c2s.Logger(s).Infof("could not bounce unacknowledged stanza: %v", err)
+	}
+}
+
+func (s *c2sStream) buildBouncedStanza(elem xml.XElement, fromJID, toJID *xml.JID) (xml.Stanza, error) {
+	if elem.Name() == "iq" {
+		return xml.NewIQFromElement(elem, fromJID, toJID)
+	}
+	return xml.NewMessageFromElement(elem, fromJID, toJID)
+}
+
+func (s *c2sStream) releaseStreamMgmt() {
+	if s.sm.detachTm != nil {
+		s.sm.detachTm.Stop()
+		s.sm.detachTm = nil
+	}
+	if len(s.sm.id) > 0 {
+		resumableStreamsMu.Lock()
+		if resumableStreams[s.sm.id] == s {
+			delete(resumableStreams, s.sm.id)
+		}
+		resumableStreamsMu.Unlock()
+	}
+	s.sm.enabled = false
+	s.sm.detached = false
+	s.sm.queue = nil
+}
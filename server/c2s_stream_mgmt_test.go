@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamMgmt_Ack(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234")
+	tUtilStreamMgmtStartSession(conn, t)
+
+	// not resumable...
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3"/>`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "enabled", elem.Name())
+	require.Equal(t, "", elem.Attributes().Get("id"))
+
+	// already enabled...
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
+	conn.ClientWriteBytes([]byte(iq.String()))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+
+	conn.ClientWriteBytes([]byte(`<r xmlns="urn:xmpp:sm:3"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "a", elem.Name())
+	require.Equal(t, "1", elem.Attributes().Get("h"))
+
+	require.Equal(t, 1, tUtilStreamMgmtQueueLen(stm))
+
+	conn.ClientWriteBytes([]byte(`<a xmlns="urn:xmpp:sm:3" h="1"/>`))
+	time.Sleep(time.Millisecond * 100) // wait until ack is processed
+	require.Equal(t, 0, tUtilStreamMgmtQueueLen(stm))
+}
+
+func TestStreamMgmt_Resume(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm1, conn1 := tUtilStreamMgmtInit("abcd1234")
+	tUtilStreamMgmtStartSession(conn1, t)
+
+	conn1.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3" resume="true"/>`))
+	elem := conn1.ClientReadElement()
+	require.Equal(t, "enabled", elem.Name())
+	require.Equal(t, "true", elem.Attributes().Get("resume"))
+	smID := elem.Attributes().Get("id")
+	require.NotEqual(t, "", smID)
+
+	iqID := uuid.New()
+	iq := xml.NewIQType(iqID, xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
+	conn1.ClientWriteBytes([]byte(iq.String()))
+	_ = conn1.ClientReadElement()
+
+	// simulate connection loss...
+	tUtilStreamMgmtDetach(stm1)
+	require.True(t, conn1.WaitClose())
+	require.Equal(t, sessionStarted, stm1.getState())
+
+	stm2, conn2 := tUtilStreamMgmtInit("abcd5678")
+	tUtilStreamOpen(conn2)
+	_ = conn2.ClientReadElement() // read stream opening...
+	_ = conn2.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn2, t)
+
+	tUtilStreamOpen(conn2)
+	_ = conn2.ClientReadElement() // read stream opening...
+	_ = conn2.ClientReadElement() // read stream features...
+
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" h="0" previd="unknown"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.NotNil(t, elem.Elements().Child("item-not-found"))
+
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" h="2" previd="` + smID + `"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.Equal(t, "1", elem.Attributes().Get("h"))
+	require.NotNil(t, elem.Elements().ChildNamespace("handled-count-too-high", streamMgmtNamespace))
+
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" h="0" previd="` + smID + `"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "resumed", elem.Name())
+	require.Equal(t, smID, elem.Attributes().Get("previd"))
+	require.Equal(t, "1", elem.Attributes().Get("h"))
+
+	// unacknowledged stanza resent...
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, iqID, elem.ID())
+
+	time.Sleep(time.Millisecond * 100) // wait until stream internal state changes
+	require.Equal(t, disconnected, stm2.getState())
+	require.Equal(t, sessionStarted, stm1.getState())
+
+	// resumed stream keeps reading from new transport
+	conn2.ClientWriteBytes([]byte(`<r xmlns="urn:xmpp:sm:3"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "a", elem.Name())
+}
+
+func TestStreamMgmt_ResumePresence(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{Username: "user", JID: "ortuman@localhost", Subscription: "both"})
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{Username: "ortuman", JID: "user@localhost", Subscription: "both"})
+
+	jContact, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	contact := c2s.NewMockStream("abcd7890", jContact)
+	c2s.Instance().RegisterStream(contact)
+	c2s.Instance().AuthenticateStream(contact)
+
+	stm1, conn1 := tUtilStreamMgmtInit("abcd1234")
+	tUtilStreamMgmtStartSession(conn1, t)
+
+	conn1.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3" resume="true"/>`))
+	smID := conn1.ClientReadElement().Attributes().Get("id")
+
+	conn1.ClientWriteBytes([]byte(`<presence/>`))
+	elem := contact.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.True(t, elem.(*xml.Presence).IsAvailable())
+	require.Equal(t, "user@localhost/balcony", elem.From())
+
+	// presence is kept while waiting for resumption...
+	tUtilStreamMgmtDetach(stm1)
+	require.True(t, conn1.WaitClose())
+	require.True(t, stm1.Presence().IsAvailable())
+
+	_, conn2 := tUtilStreamMgmtInit("abcd5678")
+	tUtilStreamOpen(conn2)
+	_ = conn2.ClientReadElement() // read stream opening...
+	_ = conn2.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn2, t)
+
+	tUtilStreamOpen(conn2)
+	_ = conn2.ClientReadElement() // read stream opening...
+	_ = conn2.ClientReadElement() // read stream features...
+
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" h="0" previd="` + smID + `"/>`))
+	require.Equal(t, "resumed", conn2.ClientReadElement().Name())
+	require.True(t, stm1.Presence().IsAvailable())
+
+	// ...so that contacts are only notified once the resumed session ends
+	stm1.Disconnect(nil)
+	require.True(t, conn2.WaitClose())
+
+	elem = contact.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, "user@localhost/balcony", elem.From())
+}
+
+func TestStreamMgmt_ResumeTimeout(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{Username: "user", JID: "ortuman@localhost", Subscription: "both"})
+
+	jContact, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	contact := c2s.NewMockStream("abcd7890", jContact)
+	c2s.Instance().RegisterStream(contact)
+	c2s.Instance().AuthenticateStream(contact)
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234")
+	stm.cfg.StreamManagement.MaxResumeTimeout = 1
+	tUtilStreamMgmtStartSession(conn, t)
+
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3" resume="true"/>`))
+	_ = conn.ClientReadElement()
+
+	conn.ClientWriteBytes([]byte(`<presence/>`))
+	require.True(t, contact.FetchElement().(*xml.Presence).IsAvailable())
+
+	tUtilStreamMgmtDetach(stm)
+	require.True(t, conn.WaitClose())
+
+	// delivered while detached...
+	from, _ := xml.NewJID("noelia", "localhost", "garden", true)
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(from)
+	msg.SetToJID(stm.JID())
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+	msg.AppendElement(body)
+	stm.SendElement(msg)
+
+	time.Sleep(time.Millisecond * 1500) // wait until resumption times out
+	require.Equal(t, disconnected, stm.getState())
+
+	// contacts notified once resumption window expired
+	elem := contact.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnavailableType, elem.Type())
+
+	// unacknowledged message stored offline
+	count, _ := storage.Instance().CountOfflineMessages("user")
+	require.Equal(t, 1, count)
+}
+
+func TestStreamMgmt_QueueOverflow(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234")
+	stm.cfg.StreamManagement.MaxQueueSize = 1
+	tUtilStreamMgmtStartSession(conn, t)
+
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3" resume="true"/>`))
+	_ = conn.ClientReadElement()
+
+	for i := 0; i < 2; i++ {
+		iq := xml.NewIQType(uuid.New(), xml.GetType)
+		iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
+		conn.ClientWriteBytes([]byte(iq.String()))
+	}
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+}
+
+func tUtilStreamMgmtInit(id string) (*c2sStream, *transport.MockConn) {
+	cfg := tUtilStreamDefaultConfig()
+	cfg.StreamManagement = StreamMgmtConfig{Enabled: true, MaxResumeTimeout: 5, MaxQueueSize: 16}
+
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	stm := newC2SStream(id, tr, cfg)
+	c2s.Instance().RegisterStream(stm)
+	return stm, conn
+}
+
+func tUtilStreamMgmtStartSession(conn *transport.MockConn, t *testing.T) {
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features := conn.ClientReadElement()
+	require.NotNil(t, features.Elements().ChildNamespace("sm", streamMgmtNamespace))
+
+	tUtilStreamStartSession(conn, t)
+}
+
+func tUtilStreamMgmtQueueLen(stm *c2sStream) int {
+	ch := make(chan int, 1)
+	stm.actorCh <- func() {
+		ch <- len(stm.sm.queue)
+	}
+	return <-ch
+}
+
+func tUtilStreamMgmtDetach(stm *c2sStream) {
+	ch := make(chan struct{})
+	stm.actorCh <- func() {
+		stm.detach()
+		close(ch)
+	}
+	<-ch
+}
@@ -6,18 +6,26 @@
 package server
 
 import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ortuman/jackal/host"
 	"github.com/ortuman/jackal/module/offline"
 	"github.com/ortuman/jackal/module/xep0077"
 	"github.com/ortuman/jackal/module/xep0092"
 	"github.com/ortuman/jackal/module/xep0199"
+	"github.com/ortuman/jackal/router"
 	"github.com/ortuman/jackal/server/compress"
 	"github.com/ortuman/jackal/server/transport"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
@@ -68,6 +76,278 @@ func TestStream_Features(t *testing.T) {
 	require.Equal(t, connected, stm.getState())
 }
 
+func TestStream_RegistrationFeature(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features := conn.ClientReadElement()
+	require.NotNil(t, features.Elements().ChildNamespace("register", "http://jabber.org/features/iq-register"))
+	stm.Disconnect(nil)
+
+	// registration requires a secured channel
+	stm, conn = tUtilStreamInit()
+	stm.cfg.ModRegistration.RequireTLS = true
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features = conn.ClientReadElement()
+	require.Nil(t, features.Elements().ChildNamespace("register", "http://jabber.org/features/iq-register"))
+	stm.Disconnect(nil)
+
+	// registration disabled
+	stm, conn = tUtilStreamInit()
+	stm.cfg.ModRegistration.AllowRegistration = false
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features = conn.ClientReadElement()
+	require.Nil(t, features.Elements().ChildNamespace("register", "http://jabber.org/features/iq-register"))
+}
+
+func TestStream_VirtualHostAlias(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{
+		Domains: []string{"localhost", "jackal.im"},
+		Aliases: map[string]string{"jackal.net": "jackal.im"},
+	})
+	defer c2s.Shutdown()
+
+	host.Initialize([]host.Config{{Name: "jackal.im", Aliases: []string{"jackal.net"}}})
+	defer host.Shutdown()
+
+	// alias domain is accepted, selecting its canonical host
+	stm, conn := tUtilStreamInit()
+	conn.ClientWriteBytes([]byte(`<?xml version="1.0"?>
+	<stream:stream xmlns:stream="http://etherx.jabber.org/streams"
+	version="1.0" xmlns="jabber:client" to="jackal.net" xml:lang="en" xmlns:xml="http://www.w3.org/XML/1998/namespace">
+`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "jackal.im", elem.From())
+	_ = conn.ClientReadElement() // read stream features...
+	require.Equal(t, "jackal.im", stm.Domain())
+	require.NotNil(t, stm.host)
+	require.Equal(t, "jackal.im", stm.host.Name)
+	stm.Disconnect(nil)
+
+	// unknown domains are still rejected
+	_, conn = tUtilStreamInit()
+	conn.ClientWriteBytes([]byte(`<?xml version="1.0"?>
+	<stream:stream xmlns:stream="http://etherx.jabber.org/streams"
+	version="1.0" xmlns="jabber:client" to="jackal.org" xml:lang="en" xmlns:xml="http://www.w3.org/XML/1998/namespace">
+`))
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("host-unknown"))
+}
+
+func TestStream_WebSocketFraming(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	// unframed stream opening over websocket
+	stm, conn := tUtilWebSocketStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("unsupported-stanza-type"))
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+
+	stm, conn = tUtilWebSocketStreamInit()
+	conn.ClientWriteBytes([]byte(`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="localhost" version="1.0"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "open", elem.Name())
+	require.Equal(t, framedStreamNamespace, elem.Namespace())
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:features", elem.Name())
+
+	// closing is acknowledged before terminating
+	conn.ClientWriteBytes([]byte(`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "close", elem.Name())
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+}
+
+func TestStream_SessionsAcrossTransports(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	// socket session...
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["carbons"] = struct{}{}
+
+	conn1 := transport.NewMockConn()
+	stm1 := newC2SStream("abcd1234", transport.NewSocketTransport(conn1, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm1)
+
+	tUtilStreamOpen(conn1)
+	_ = conn1.ClientReadElement() // read stream opening...
+	_ = conn1.ClientReadElement() // read stream features...
+	tUtilStreamAuthenticate(conn1, t)
+	tUtilStreamOpen(conn1)
+	_ = conn1.ClientReadElement() // read stream opening...
+	_ = conn1.ClientReadElement() // read stream features...
+	tUtilStreamStartSession(conn1, t)
+
+	// ...and websocket session of the very same account
+	wsCfg := tUtilStreamDefaultConfig()
+	wsCfg.Modules["carbons"] = struct{}{}
+	wsCfg.Transport.Type = transport.WebSocket
+
+	conn2 := transport.NewMockConn()
+	stm2 := newC2SStream("abcd5678", transport.NewSocketTransport(conn2, 4096, 4096), wsCfg)
+	c2s.Instance().RegisterStream(stm2)
+
+	wsOpen := []byte(`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="localhost" version="1.0"/>`)
+	conn2.ClientWriteBytes(wsOpen)
+	_ = conn2.ClientReadElement() // read stream opening...
+	_ = conn2.ClientReadElement() // read stream features...
+	tUtilStreamAuthenticate(conn2, t)
+	conn2.ClientWriteBytes(wsOpen)
+	_ = conn2.ClientReadElement() // read stream opening...
+	_ = conn2.ClientReadElement() // read stream features...
+
+	// resource conflict policy applies regardless of transport
+	conn2.ClientWriteBytes([]byte(`<iq type="set" id="bind_1"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><resource>balcony</resource></bind></iq>`))
+	elem := conn2.ClientReadElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrConflict.Error(), elem.Error().Elements().All()[0].Name())
+
+	conn2.ClientWriteBytes([]byte(`<iq type="set" id="bind_2"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><resource>garden</resource></bind></iq>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	conn2.ClientWriteBytes([]byte(`<iq type="set" id="session_1"><session xmlns="urn:ietf:params:xml:ns:xmpp-session"/></iq>`))
+	require.Equal(t, xml.ResultType, conn2.ClientReadElement().Type())
+	time.Sleep(time.Millisecond * 100) // wait until stream internal state changes
+
+	j, _ := xml.NewJIDString("user@localhost", true)
+	require.Equal(t, 2, len(c2s.Instance().StreamsMatchingJID(j)))
+
+	for _, conn := range []*transport.MockConn{conn1, conn2} {
+		conn.ClientWriteBytes([]byte(`<iq type="get" id="roster_1"><query xmlns="jabber:iq:roster"/></iq>`))
+		require.Equal(t, xml.ResultType, conn.ClientReadElement().Type())
+
+		conn.ClientWriteBytes([]byte(`<iq type="set" id="carbons_1"><enable xmlns="urn:xmpp:carbons:2"/></iq>`))
+		require.Equal(t, xml.ResultType, conn.ClientReadElement().Type())
+	}
+
+	// roster pushes reach both sessions
+	conn1.ClientWriteBytes([]byte(`<iq type="set" id="roster_2"><query xmlns="jabber:iq:roster"><item jid="noelia@localhost"/></query></iq>`))
+	for _, conn := range []*transport.MockConn{conn1, conn2} {
+		n := 1
+		if conn == conn1 {
+			n = 2 // ...along with roster set result
+		}
+		var push xml.XElement
+		for i := 0; i < n; i++ {
+			if elem := conn.ClientReadElement(); elem.ID() != "roster_2" {
+				push = elem
+			}
+		}
+		require.NotNil(t, push)
+		require.Equal(t, xml.SetType, push.Type())
+		require.NotNil(t, push.Elements().ChildNamespace("query", "jabber:iq:roster"))
+	}
+
+	// ...and so do message carbons
+	from, _ := xml.NewJID("noelia", "localhost", "yard", true)
+	msgID := uuid.New()
+	msg := xml.NewMessageType(msgID, xml.ChatType)
+	msg.SetFromJID(from)
+	msg.SetToJID(stm1.JID())
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+	msg.AppendElement(body)
+	require.Nil(t, c2s.Instance().Route(msg))
+
+	elem = conn1.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msgID, elem.ID())
+
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	received := elem.Elements().ChildNamespace("received", "urn:xmpp:carbons:2")
+	require.NotNil(t, received)
+	require.Equal(t, msgID, received.Elements().Child("forwarded").Elements().Child("message").ID())
+
+	// bounced messages are not carboned...
+	conn1.ClientWriteBytes([]byte(`<message type="chat" id="msg_1" to="romeo@localhost"><body>Hi!</body></message>`))
+	elem = conn1.ClientReadElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrServiceUnavailable.Error(), elem.Error().Elements().All()[0].Name())
+
+	// ...unlike the accepted ones
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "noelia", Password: "pencil"})
+	conn1.ClientWriteBytes([]byte(`<message type="chat" id="msg_2" to="noelia@localhost"><body>Hi!</body></message>`))
+	elem = conn2.ClientReadElement()
+	sent := elem.Elements().ChildNamespace("sent", "urn:xmpp:carbons:2")
+	require.NotNil(t, sent)
+	require.Equal(t, "msg_2", sent.Elements().Child("forwarded").Elements().Child("message").ID())
+}
+
+func TestStream_SendQueueOverflow(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Transport.SendQueueSize = 4
+
+	conn := transport.NewMockConn()
+	stm := newC2SStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	// a peer not reading its connection must never block senders
+	doneCh := make(chan struct{})
+	go func() {
+		for i := 0; i < 128; i++ {
+			stm.SendElement(xml.NewMessageType(uuid.New(), xml.NormalType))
+		}
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "blocked while sending to a slow peer")
+	}
+
+	var streamErr xml.XElement
+	for i := 0; i < 128 && streamErr == nil; i++ {
+		if elem := conn.ClientReadElement(); elem.Name() == "stream:error" {
+			streamErr = elem
+		}
+	}
+	require.NotNil(t, streamErr)
+	require.NotNil(t, streamErr.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+}
+
 func TestStream_TLS(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
@@ -92,7 +372,7 @@ func TestStream_TLS(t *testing.T) {
 	require.True(t, stm.IsSecured())
 }
 
-func TestStream_Compression(t *testing.T) {
+func TestStream_StartTLSPolicy(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
 
@@ -101,29 +381,89 @@ func TestStream_Compression(t *testing.T) {
 
 	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
 
-	stm, conn := tUtilStreamInit()
+	cfg := tUtilStreamDefaultConfig()
+	cfg.TLS.StartTLS = StartTLSRequired
+
+	// plaintext authentication is rejected
+	conn := transport.NewMockConn()
+	stm := newC2SStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:features", elem.Name())
+	require.NotNil(t, elem.Elements().ChildNamespace("starttls", tlsNamespace).Elements().Child("required"))
+	require.Nil(t, elem.Elements().ChildNamespace("mechanisms", saslNamespace))
+
+	conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">AHVzZXIAcGVuY2ls</auth>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+	require.False(t, stm.IsAuthenticated())
+
+	// plaintext binding is rejected
+	conn = transport.NewMockConn()
+	stm = newC2SStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
 
+	conn.ClientWriteBytes([]byte(`<iq type="set" id="bind_1"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/></iq>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+
+	// secured streams are offered SASL mechanisms
+	conn = transport.NewMockConn()
+	stm = newC2SStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	stm.ctx.SetBool(true, securedContextKey)
+	c2s.Instance().RegisterStream(stm)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.Nil(t, elem.Elements().ChildNamespace("starttls", tlsNamespace))
+	require.NotNil(t, elem.Elements().ChildNamespace("mechanisms", saslNamespace))
+
 	tUtilStreamAuthenticate(conn, t)
+	require.True(t, stm.IsAuthenticated())
+	stm.Disconnect(nil)
 
+	// optional
+	stm, conn = tUtilStreamInit()
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
-	_ = conn.ClientReadElement() // read stream features...
+	elem = conn.ClientReadElement()
+	startTLS := elem.Elements().ChildNamespace("starttls", tlsNamespace)
+	require.NotNil(t, startTLS)
+	require.Nil(t, startTLS.Elements().Child("required"))
+	require.NotNil(t, elem.Elements().ChildNamespace("mechanisms", saslNamespace))
 
-	conn.ClientWriteBytes([]byte(`<compress xmlns="http://jabber.org/protocol/compress">
-<method>zlib</method>
-</compress>`))
+	tUtilStreamAuthenticate(conn, t)
+	require.True(t, stm.IsAuthenticated())
+	stm.Disconnect(nil)
 
-	elem := conn.ClientReadElement()
-	require.Equal(t, "compressed", elem.Name())
-	require.Equal(t, "http://jabber.org/protocol/compress", elem.Namespace())
+	// disabled
+	cfg.TLS.StartTLS = StartTLSDisabled
+	conn = transport.NewMockConn()
+	stm = newC2SStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.Nil(t, elem.Elements().ChildNamespace("starttls", tlsNamespace))
+	require.NotNil(t, elem.Elements().ChildNamespace("mechanisms", saslNamespace))
 
-	require.True(t, stm.IsCompressed())
+	conn.ClientWriteBytes([]byte(`<starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "failure", elem.Name())
+	require.True(t, conn.WaitClose())
+	require.False(t, stm.IsSecured())
 }
 
-func TestStream_StartSession(t *testing.T) {
+func TestStream_Compression(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
 
@@ -143,12 +483,22 @@ func TestStream_StartSession(t *testing.T) {
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
 
-	tUtilStreamStartSession(conn, t)
+	conn.ClientWriteBytes([]byte(`<compress xmlns="http://jabber.org/protocol/compress">
+<method>zlib</method>
+</compress>`))
 
-	require.Equal(t, sessionStarted, stm.getState())
+	elem := conn.ClientReadElement()
+	require.Equal(t, "compressed", elem.Name())
+	require.Equal(t, "http://jabber.org/protocol/compress", elem.Namespace())
+
+	require.True(t, stm.IsCompressed())
+
+	// undecodable compressed data
+	conn.ClientWriteBytes([]byte("this is garbage!"))
+	require.True(t, conn.WaitClose())
 }
 
-func TestStream_SendIQ(t *testing.T) {
+func TestStream_CompressionOverTLS(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
 
@@ -158,6 +508,7 @@ func TestStream_SendIQ(t *testing.T) {
 	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
 
 	stm, conn := tUtilStreamInit()
+	stm.ctx.SetBool(true, securedContextKey)
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
@@ -166,28 +517,21 @@ func TestStream_SendIQ(t *testing.T) {
 
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
-	_ = conn.ClientReadElement() // read stream features...
-
-	tUtilStreamStartSession(conn, t)
-
-	require.Equal(t, sessionStarted, stm.getState())
-
-	// request roster...
-	iqID := uuid.New()
-	iq := xml.NewIQType(iqID, xml.GetType)
-	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
-
-	conn.ClientWriteBytes([]byte(iq.String()))
-
 	elem := conn.ClientReadElement()
-	require.Equal(t, "iq", elem.Name())
-	require.Equal(t, iqID, elem.ID())
-	require.NotNil(t, elem.Elements().ChildNamespace("query", "jabber:iq:roster"))
+	require.Equal(t, "stream:features", elem.Name())
+	require.Nil(t, elem.Elements().ChildNamespace("compression", "http://jabber.org/features/compress"))
 
-	require.True(t, stm.Context().Bool("roster:requested"))
+	conn.ClientWriteBytes([]byte(`<compress xmlns="http://jabber.org/protocol/compress">
+<method>zlib</method>
+</compress>`))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "failure", elem.Name())
+	require.NotNil(t, elem.Elements().Child("setup-failed"))
+	require.False(t, stm.IsCompressed())
 }
 
-func TestStream_SendPresence(t *testing.T) {
+func TestStream_StartSession(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
 
@@ -210,31 +554,9 @@ func TestStream_SendPresence(t *testing.T) {
 	tUtilStreamStartSession(conn, t)
 
 	require.Equal(t, sessionStarted, stm.getState())
-
-	conn.ClientWriteBytes([]byte(`
-<presence>
-<show>away</show>
-<status>away!</status>
-<priority>5</priority>
-<x xmlns="vcard-temp:x:update">
-<photo>b7d050434f5441e377dc57f72ac5239e1f493fd0</photo>
-</x>
-</presence>
-	`))
-	time.Sleep(time.Millisecond * 100) // wait until processed...
-
-	p := stm.Presence()
-	require.NotNil(t, p)
-	require.Equal(t, int8(5), p.Priority())
-	x := xml.NewElementName("x")
-	x.AppendElements(stm.Presence().Elements().All())
-	require.NotNil(t, x.Elements().Child("show"))
-	require.NotNil(t, x.Elements().Child("status"))
-	require.NotNil(t, x.Elements().Child("priority"))
-	require.NotNil(t, x.Elements().Child("x"))
 }
 
-func TestStream_SendMessage(t *testing.T) {
+func TestStream_LoginMessage(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
 
@@ -244,6 +566,8 @@ func TestStream_SendMessage(t *testing.T) {
 	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
 
 	stm, conn := tUtilStreamInit()
+	stm.cfg.LoginMessage = &c2s.Announcement{Subject: "Welcome", Body: "Welcome to jackal!"}
+
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
@@ -254,40 +578,1047 @@ func TestStream_SendMessage(t *testing.T) {
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
 
-	tUtilStreamStartSession(conn, t)
+	conn.ClientWriteBytes([]byte(`<iq type="set" id="bind_1">
+<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind">
+<resource>balcony</resource>
+</bind>
+</iq>`))
 
-	require.Equal(t, sessionStarted, stm.getState())
+	elem := conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.NotNil(t, elem.Elements().Child("bind"))
 
-	// define a second stream...
-	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
-	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	// login message follows resource binding result
+	elem = conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "localhost", elem.From())
+	require.Equal(t, "user@localhost/balcony", elem.To())
+	require.Equal(t, "Welcome", elem.Elements().Child("subject").Text())
+	require.Equal(t, "Welcome to jackal!", elem.Elements().Child("body").Text())
+}
 
-	stm2 := c2s.NewMockStream("abcd7890", jTo)
+func TestStream_ResourceConflict(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	j, _ := xml.NewJID("user", "localhost", "balcony", true)
+	stm2 := c2s.NewMockStream("abcd7890", j)
 	c2s.Instance().RegisterStream(stm2)
 	c2s.Instance().AuthenticateStream(stm2)
 
-	msgID := uuid.New()
-	msg := xml.NewMessageType(msgID, xml.ChatType)
-	msg.SetFromJID(jFrom)
-	msg.SetToJID(jTo)
-	body := xml.NewElementName("body")
-	body.SetText("Hi buddy!")
-	msg.AppendElement(body)
+	bindResource := func(policy ResourceConflictPolicy) (*c2sStream, xml.XElement) {
+		stm, conn := tUtilStreamInit()
+		stm.cfg.ResourceConflict = policy
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
 
-	conn.ClientWriteBytes([]byte(msg.String()))
+		tUtilStreamAuthenticate(conn, t)
 
-	// to full jid...
-	elem := stm2.FetchElement()
-	require.Equal(t, "message", elem.Name())
-	require.Equal(t, msgID, elem.ID())
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
 
-	// to bare jid...
-	msg.SetToJID(jTo.ToBareJID())
-	conn.ClientWriteBytes([]byte(msg.String()))
-	elem = stm2.FetchElement()
-	require.Equal(t, "message", elem.Name())
-	require.Equal(t, msgID, elem.ID())
-}
+		conn.ClientWriteBytes([]byte(`<iq type="set" id="bind_1">
+<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind">
+<resource>balcony</resource>
+</bind>
+</iq>`))
+		return stm, conn.ClientReadElement()
+	}
+
+	// reject
+	_, elem := bindResource(Reject)
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrConflict.Error(), elem.Error().Elements().All()[0].Name())
+
+	// random suffix
+	stm, elem := bindResource(RandomSuffix)
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.True(t, strings.HasPrefix(elem.Elements().Child("bind").Elements().Child("jid").Text(), "user@localhost/balcony-"))
+	require.True(t, strings.HasPrefix(stm.Resource(), "balcony-"))
+	require.False(t, stm2.IsDisconnected())
+
+	// replace
+	discCh := make(chan error, 1)
+	go func() {
+		discCh <- stm2.WaitDisconnection()
+		stm2.Context().Terminate()
+	}()
+	stm, elem = bindResource(Replace)
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, "balcony", stm.Resource())
+	require.Equal(t, streamerror.ErrConflict, <-discCh)
+}
+
+func TestStream_SessionLimits(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	bindResource := func(policy ResourceConflictPolicy) (*c2sStream, xml.XElement) {
+		stm, conn := tUtilStreamInit()
+		stm.cfg.ResourceConflict = policy
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
+
+		tUtilStreamAuthenticate(conn, t)
+
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
+
+		conn.ClientWriteBytes([]byte(`<iq type="set" id="bind_1">
+<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind">
+<resource>garden</resource>
+</bind>
+</iq>`))
+		elem := conn.ClientReadElement()
+		time.Sleep(time.Millisecond * 100) // wait until stream internal state changes
+		return stm, elem
+	}
+
+	// per-user limit
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}, MaxSessionsPerUser: 1})
+
+	j, _ := xml.NewJID("user", "localhost", "balcony", true)
+	stm2 := c2s.NewMockStream("abcd7890", j)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	_, elem := bindResource(Reject)
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrResourceConstraint.Error(), elem.Error().Elements().All()[0].Name())
+	require.False(t, stm2.IsDisconnected())
+
+	_, elem = bindResource(RandomSuffix)
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrResourceConstraint.Error(), elem.Error().Elements().All()[0].Name())
+
+	// oldest session is replaced
+	discCh := make(chan error, 1)
+	go func() {
+		discCh <- stm2.WaitDisconnection()
+		stm2.Context().Terminate()
+	}()
+	stm, elem := bindResource(Replace)
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, "garden", stm.Resource())
+	require.Equal(t, streamerror.ErrConflict, <-discCh)
+	c2s.Shutdown()
+
+	// global limit
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}, MaxSessions: 1})
+	defer c2s.Shutdown()
+
+	j, _ = xml.NewJID("noelia", "localhost", "balcony", true)
+	stm3 := c2s.NewMockStream("abcd5678", j)
+	c2s.Instance().RegisterStream(stm3)
+	c2s.Instance().AuthenticateStream(stm3)
+
+	_, elem = bindResource(Replace)
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrResourceConstraint.Error(), elem.Error().Elements().All()[0].Name())
+	require.False(t, stm3.IsDisconnected())
+
+	c2s.Instance().UnregisterStream(stm3)
+
+	_, elem = bindResource(Reject)
+	require.Equal(t, xml.ResultType, elem.Type())
+}
+
+func TestStream_ResourceGeneration(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	bindResource := func(policy ResourceGenerationPolicy, bind string) *c2sStream {
+		stm, conn := tUtilStreamInit()
+		stm.cfg.ResourceGeneration = policy
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
+
+		tUtilStreamAuthenticate(conn, t)
+
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
+
+		conn.ClientWriteBytes([]byte(`<iq type="set" id="bind_1">` + bind + `</iq>`))
+		elem := conn.ClientReadElement()
+		require.Equal(t, xml.ResultType, elem.Type())
+		require.Equal(t, "user@localhost/"+stm.Resource(), elem.Elements().Child("bind").Elements().Child("jid").Text())
+		return stm
+	}
+	resources := map[string]bool{}
+	requireUnique := func(resource string) {
+		require.NotEqual(t, "", resource)
+		require.False(t, resources[resource])
+		resources[resource] = true
+	}
+
+	// uuid
+	stm := bindResource(UUIDResource, `<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/>`)
+	require.Equal(t, 36, len(stm.Resource()))
+	requireUnique(stm.Resource())
+
+	// counter... never colliding with a resource already bound
+	next := strconv.FormatUint(atomic.LoadUint64(&resourceCounter)+1, 10)
+	j, _ := xml.NewJID("user", "localhost", next, true)
+	stm2 := c2s.NewMockStream("abcd7890", j)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+	requireUnique(next)
+
+	stm = bindResource(CounterResource, `<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/>`)
+	_, err := strconv.ParseUint(stm.Resource(), 10, 64)
+	require.Nil(t, err)
+	requireUnique(stm.Resource())
+
+	// client hint
+	stm = bindResource(ClientHintResource, `<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><tag>Gajim</tag></bind>`)
+	require.True(t, strings.HasPrefix(stm.Resource(), "Gajim."))
+	requireUnique(stm.Resource())
+
+	// ...falling back to a random resource if no hint was provided
+	stm = bindResource(ClientHintResource, `<bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/>`)
+	require.Equal(t, 36, len(stm.Resource()))
+	requireUnique(stm.Resource())
+}
+
+func TestStream_SendIQ(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	require.Equal(t, sessionStarted, stm.getState())
+
+	// request roster...
+	iqID := uuid.New()
+	iq := xml.NewIQType(iqID, xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
+
+	conn.ClientWriteBytes([]byte(iq.String()))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, iqID, elem.ID())
+	require.NotNil(t, elem.Elements().ChildNamespace("query", "jabber:iq:roster"))
+
+	require.True(t, stm.Context().Bool("roster:requested"))
+}
+
+func TestStream_SendUnhandledIQ(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: ""})
+
+	_, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	requireServiceUnavailable := func(id, from string) {
+		elem := conn.ClientReadElement()
+		require.Equal(t, "iq", elem.Name())
+		require.Equal(t, xml.ErrorType, elem.Type())
+		require.Equal(t, id, elem.ID())
+		require.Equal(t, from, elem.From())
+		require.Equal(t, "user@localhost/balcony", elem.To())
+		require.NotNil(t, elem.Elements().Child("error").Elements().Child("service-unavailable"))
+	}
+
+	// unknown namespace addressed to the server...
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="unknown_1" to="localhost"><query xmlns="urn:xmpp:unknown"/></iq>`))
+	requireServiceUnavailable("unknown_1", "localhost")
+
+	// ...to the user's account
+	conn.ClientWriteBytes([]byte(`<iq type="set" id="unknown_2" to="user@localhost"><query xmlns="urn:xmpp:unknown"/></iq>`))
+	requireServiceUnavailable("unknown_2", "user@localhost")
+
+	// ...or to an offline user resource
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="unknown_3" to="ortuman@localhost/garden"><query xmlns="urn:xmpp:unknown"/></iq>`))
+	requireServiceUnavailable("unknown_3", "ortuman@localhost/garden")
+
+	// responses are never answered
+	conn.ClientWriteBytes([]byte(`<iq type="result" id="unknown_4" to="localhost"/>`))
+	conn.ClientWriteBytes([]byte(`<iq type="result" id="unknown_5" to="ortuman@localhost/garden"/>`))
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="unknown_6" to="localhost"><query xmlns="urn:xmpp:unknown"/></iq>`))
+	requireServiceUnavailable("unknown_6", "localhost")
+}
+
+func TestStream_ForgedFrom(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	// own bare JID is stamped with the session full JID
+	conn.ClientWriteBytes([]byte(`<message id="m1" from="user@localhost" to="ortuman@localhost/garden"><body>Hi!</body></message>`))
+	elem := stm2.FetchElement()
+	require.Equal(t, "m1", elem.ID())
+	require.Equal(t, "user@localhost/balcony", elem.From())
+
+	// no from attribute at all
+	conn.ClientWriteBytes([]byte(`<message id="m2" to="ortuman@localhost/garden"><body>Hi!</body></message>`))
+	elem = stm2.FetchElement()
+	require.Equal(t, "m2", elem.ID())
+	require.Equal(t, "user@localhost/balcony", elem.From())
+
+	// another session resource can't be impersonated...
+	conn.ClientWriteBytes([]byte(`<message id="m3" from="user@localhost/garden" to="ortuman@localhost/garden"><body>Hi!</body></message>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("invalid-from"))
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+
+	// ...and the forged stanza is never routed
+	require.Equal(t, &xml.Element{}, stm2.FetchElement())
+
+	// neither can any other user
+	stm, conn = tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	conn.ClientWriteBytes([]byte(`<presence from="ortuman@localhost/garden" to="ortuman@localhost/garden"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("invalid-from"))
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+	require.Equal(t, &xml.Element{}, stm2.FetchElement())
+}
+
+func TestStream_SendPresence(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	require.Equal(t, sessionStarted, stm.getState())
+
+	conn.ClientWriteBytes([]byte(`
+<presence>
+<show>away</show>
+<status>away!</status>
+<priority>5</priority>
+<x xmlns="vcard-temp:x:update">
+<photo>b7d050434f5441e377dc57f72ac5239e1f493fd0</photo>
+</x>
+</presence>
+	`))
+	time.Sleep(time.Millisecond * 100) // wait until processed...
+
+	p := stm.Presence()
+	require.NotNil(t, p)
+	require.Equal(t, int8(5), p.Priority())
+	x := xml.NewElementName("x")
+	x.AppendElements(stm.Presence().Elements().All())
+	require.NotNil(t, x.Elements().Child("show"))
+	require.NotNil(t, x.Elements().Child("status"))
+	require.NotNil(t, x.Elements().Child("priority"))
+	require.NotNil(t, x.Elements().Child("x"))
+}
+
+func TestStream_DirectedPresenceOnDisconnect(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	// a non roster entity (e.g. MUC occupant)...
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	// directed presence without initial presence
+	conn.ClientWriteBytes([]byte(`<presence to="ortuman@localhost/garden"/>`))
+	elem := stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.True(t, elem.(*xml.Presence).IsAvailable())
+
+	stm.Disconnect(nil)
+	require.True(t, conn.WaitClose())
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, "user@localhost/balcony", elem.From())
+}
+
+func TestStream_SendMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	require.Equal(t, sessionStarted, stm.getState())
+
+	// define a second stream...
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	stm2.SetPresence(xml.NewPresence(jTo, jTo.ToBareJID(), xml.AvailableType))
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	msgID := uuid.New()
+	msg := xml.NewMessageType(msgID, xml.ChatType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo)
+	body := xml.NewElementName("body")
+	body.SetText("Hi buddy!")
+	msg.AppendElement(body)
+
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	// to full jid...
+	elem := stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msgID, elem.ID())
+
+	// to bare jid...
+	msg.SetToJID(jTo.ToBareJID())
+	conn.ClientWriteBytes([]byte(msg.String()))
+	elem = stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msgID, elem.ID())
+}
+
+func TestStream_SendMessageNegativePriority(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: ""})
+
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo1, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	jTo2, _ := xml.NewJID("ortuman", "localhost", "yard", true)
+
+	newMessage := func(from, to *xml.JID) *xml.Message {
+		msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+		msg.SetFromJID(from)
+		msg.SetToJID(to)
+		body := xml.NewElementName("body")
+		body.SetText("Hi buddy!")
+		msg.AppendElement(body)
+		return msg
+	}
+	pendingMsg := newMessage(jTo1, jFrom.ToBareJID())
+	storage.Instance().InsertOfflineMessage(pendingMsg, "user")
+
+	_, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	negativePresence := func(j *xml.JID) *xml.Presence {
+		p := xml.NewElementName("presence")
+		priority := xml.NewElementName("priority")
+		priority.SetText("-1")
+		p.AppendElement(priority)
+		presence, _ := xml.NewPresenceFromElement(p, j, j.ToBareJID())
+		return presence
+	}
+	fetchOfflineMessages := func(username string, count int) []xml.XElement {
+		var messages []xml.XElement
+		for i := 0; i < 50 && len(messages) != count; i++ {
+			time.Sleep(time.Millisecond * 20)
+			messages, _ = storage.Instance().FetchOfflineMessages(username)
+		}
+		return messages
+	}
+
+	// every resource has a negative priority... store it offline
+	stm2 := c2s.NewMockStream("abcd7890", jTo1)
+	stm2.SetPresence(negativePresence(jTo1))
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	msg1 := newMessage(jFrom, jTo1.ToBareJID())
+	conn.ClientWriteBytes([]byte(msg1.String()))
+
+	messages := fetchOfflineMessages("ortuman", 1)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, msg1.ID(), messages[0].ID())
+
+	// ...though a negative priority resource can still be addressed by its full JID
+	msg2 := newMessage(jFrom, jTo1)
+	conn.ClientWriteBytes([]byte(msg2.String()))
+	require.Equal(t, msg2.ID(), stm2.FetchElement().ID())
+
+	// mixed priorities... only non-negative resources receive it
+	stm3 := c2s.NewMockStream("abcd5678", jTo2)
+	stm3.SetPresence(xml.NewPresence(jTo2, jTo2.ToBareJID(), xml.AvailableType))
+	c2s.Instance().RegisterStream(stm3)
+	c2s.Instance().AuthenticateStream(stm3)
+
+	msg3 := newMessage(jFrom, jTo1.ToBareJID())
+	conn.ClientWriteBytes([]byte(msg3.String()))
+	require.Equal(t, msg3.ID(), stm3.FetchElement().ID())
+	require.Equal(t, &xml.Element{}, stm2.FetchElement())
+	require.Equal(t, 1, len(fetchOfflineMessages("ortuman", 1)))
+
+	// offline messages are held back while the session has a negative priority
+	conn.ClientWriteBytes([]byte(`<presence><priority>-1</priority></presence>`))
+	time.Sleep(time.Millisecond * 100) // wait until stream internal state changes
+	messages, _ = storage.Instance().FetchOfflineMessages("user")
+	require.Equal(t, 1, len(messages))
+
+	conn.ClientWriteBytes([]byte(`<presence><priority>1</priority></presence>`))
+	var elem xml.XElement
+	for i := 0; i < 4; i++ {
+		if elem = conn.ClientReadElement(); elem.Name() == "message" {
+			break
+		}
+	}
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, pendingMsg.ID(), elem.ID())
+	require.Equal(t, 0, len(fetchOfflineMessages("user", 0)))
+}
+
+func TestStream_SendMessageChatMarkers(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: ""})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["chat_markers"] = struct{}{}
+
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	stm := newC2SStream("abcd1234", tr, cfg)
+	c2s.Instance().RegisterStream(stm)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	newMarker := func(to *xml.JID, name, id string) *xml.Message {
+		msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+		msg.SetFromJID(jFrom)
+		msg.SetToJID(to)
+		marker := xml.NewElementNamespace(name, "urn:xmpp:chat-markers:0")
+		if len(id) > 0 {
+			marker.SetID(id)
+		}
+		msg.AppendElement(marker)
+		return msg
+	}
+
+	// markers are routed transparently
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	displayed := newMarker(jTo, "displayed", "message-1")
+	conn.ClientWriteBytes([]byte(displayed.String()))
+	elem := stm2.FetchElement()
+	require.Equal(t, displayed.ID(), elem.ID())
+	require.Equal(t, "message-1", elem.Elements().ChildNamespace("displayed", "urn:xmpp:chat-markers:0").ID())
+
+	// markers not referencing any message are bounced
+	conn.ClientWriteBytes([]byte(newMarker(jTo, "received", "").String()))
+	elem = conn.ClientReadElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Elements().Child("error").Elements().Child("bad-request"))
+
+	// standalone markers addressed to an offline user are dropped...
+	c2s.Instance().UnregisterStream(stm2)
+
+	conn.ClientWriteBytes([]byte(newMarker(jTo.ToBareJID(), "acknowledged", "message-1").String()))
+
+	// ...while piggybacked ones are stored along with their message
+	msg := newMarker(jTo.ToBareJID(), "displayed", "message-1")
+	body := xml.NewElementName("body")
+	body.SetText("Hi buddy!")
+	msg.AppendElement(body)
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	var messages []xml.XElement
+	for i := 0; i < 50 && len(messages) == 0; i++ {
+		time.Sleep(time.Millisecond * 20)
+		messages, _ = storage.Instance().FetchOfflineMessages("ortuman")
+	}
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, msg.ID(), messages[0].ID())
+}
+
+func TestStream_SendMessageDropped(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	router.RegisterHook("spam", 0, router.HookFunc(func(stanza xml.Stanza, dir router.Direction) xml.Stanza {
+		if msg, ok := stanza.(*xml.Message); ok && msg.IsMessageWithBody() && msg.Elements().Child("body").Text() == "spam" {
+			return nil
+		}
+		return stanza
+	}))
+	defer router.UnregisterHook("spam")
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["mam"] = struct{}{}
+
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	stm := newC2SStream("abcd1234", tr, cfg)
+	c2s.Instance().RegisterStream(stm)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	for _, text := range []string{"spam", "Hi buddy!"} {
+		msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+		msg.SetFromJID(jFrom)
+		msg.SetToJID(jTo)
+		body := xml.NewElementName("body")
+		body.SetText(text)
+		msg.AppendElement(body)
+		conn.ClientWriteBytes([]byte(msg.String()))
+	}
+	elem := stm2.FetchElement()
+	require.Equal(t, "Hi buddy!", elem.Elements().Child("body").Text())
+
+	// wait for archiving...
+	time.Sleep(time.Millisecond * 100)
+
+	// dropped messages are never archived
+	msgs, _ := storage.Instance().FetchArchiveMessages("user", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+}
+
+func TestStream_SendMessageStanzaID(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["mam"] = struct{}{}
+
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	stm := newC2SStream("abcd1234", tr, cfg)
+	c2s.Instance().RegisterStream(stm)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo)
+	body := xml.NewElementName("body")
+	body.SetText("Hi buddy!")
+	msg.AppendElement(body)
+
+	// spoofed server assigned identifiers...
+	msg.AppendElement(xml.NewStanzaID("sp00f3d", "ortuman@localhost"))
+	msg.AppendElement(xml.NewStanzaID("sp00f3d", "localhost"))
+	msg.AppendElement(xml.NewStanzaID("3xt3rn4l", "example.org"))
+	originID := xml.NewElementNamespace("origin-id", "urn:xmpp:sid:0")
+	originID.SetAttribute("id", "0r1g1n")
+	msg.AppendElement(originID)
+
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	elem := stm2.FetchElement().(*xml.Message)
+	require.Equal(t, "message", elem.Name())
+
+	stanzaID := elem.StanzaID("ortuman@localhost")
+	require.NotEmpty(t, stanzaID)
+	require.NotEqual(t, "sp00f3d", stanzaID)
+	require.Equal(t, "", elem.StanzaID("localhost"))
+	require.Equal(t, "3xt3rn4l", elem.StanzaID("example.org"))
+	require.Equal(t, "0r1g1n", elem.OriginID())
+	require.Equal(t, 2, len(elem.Elements().ChildrenNamespace("stanza-id", "urn:xmpp:sid:0")))
+}
+
+func TestStream_SendHeadlineMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: ""})
+
+	_, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	newMessage := func(msgType string, to *xml.JID) *xml.Message {
+		msg := xml.NewMessageType(uuid.New(), msgType)
+		msg.SetFromJID(jFrom)
+		msg.SetToJID(to)
+		body := xml.NewElementName("body")
+		body.SetText("Hi buddy!")
+		msg.AppendElement(body)
+		return msg
+	}
+
+	// headlines to an offline user are dropped...
+	conn.ClientWriteBytes([]byte(newMessage(xml.HeadlineType, jTo.ToBareJID()).String()))
+
+	chatMsg := newMessage(xml.ChatType, jTo.ToBareJID())
+	conn.ClientWriteBytes([]byte(chatMsg.String()))
+
+	var messages []xml.XElement
+	for i := 0; i < 50 && len(messages) == 0; i++ {
+		time.Sleep(time.Millisecond * 20)
+		messages, _ = storage.Instance().FetchOfflineMessages("ortuman")
+	}
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, chatMsg.ID(), messages[0].ID())
+
+	// ...as well as headlines to an unavailable resource
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	stm2.SetPresence(xml.NewPresence(jTo, jTo.ToBareJID(), xml.AvailableType))
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	jUnknown, _ := xml.NewJID("ortuman", "localhost", "balcony", true)
+	conn.ClientWriteBytes([]byte(newMessage(xml.HeadlineType, jUnknown).String()))
+
+	chatMsg = newMessage(xml.ChatType, jUnknown)
+	conn.ClientWriteBytes([]byte(chatMsg.String()))
+
+	elem := stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, chatMsg.ID(), elem.ID())
+}
+
+func TestStream_SendToBlockedJID(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateBlockListItems([]model.BlockListItem{{Username: "user", JID: "ortuman@localhost"}})
+
+	_, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	// presences are silently dropped
+	p := xml.NewPresence(jFrom, jTo, xml.AvailableType)
+	conn.ClientWriteBytes([]byte(p.String()))
+
+	// error messages are not replied
+	msg := xml.NewMessageType(uuid.New(), xml.ErrorType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo)
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	msgID := uuid.New()
+	msg = xml.NewMessageType(msgID, xml.ChatType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo.ToBareJID())
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msgID, elem.ID())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements().All()[0].Name())
+	require.NotNil(t, elem.Error().Elements().ChildNamespace("blocked", blockedErrorNamespace))
+
+	iqID := uuid.New()
+	iq := xml.NewIQType(iqID, xml.GetType)
+	iq.SetFromJID(jFrom)
+	iq.SetToJID(jTo)
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:version"))
+	conn.ClientWriteBytes([]byte(iq.String()))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, iqID, elem.ID())
+	require.NotNil(t, elem.Error().Elements().ChildNamespace("blocked", blockedErrorNamespace))
+
+	// nothing reached blocked contact
+	require.Equal(t, &xml.Element{}, stm2.FetchElement())
+}
+
+func TestStream_ServerOriginatedIQ(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	type iqResponse struct {
+		iq  *xml.IQ
+		err error
+	}
+	respCh := make(chan iqResponse, 1)
+	handler := func(iq *xml.IQ, err error) { respCh <- iqResponse{iq, err} }
+
+	iqID := uuid.New()
+	iq := xml.NewIQType(iqID, xml.GetType)
+	iq.SetTo(stm.JID().String())
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:version"))
+	stm.SendIQ(iq, handler, time.Minute)
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, iqID, elem.ID())
+
+	result := xml.NewIQType(iqID, xml.ResultType)
+	result.SetTo("localhost")
+	conn.ClientWriteBytes([]byte(result.String()))
+
+	resp := <-respCh
+	require.Nil(t, resp.err)
+	require.Equal(t, iqID, resp.iq.ID())
+	require.True(t, resp.iq.IsResult())
+
+	// unanswered IQ
+	iq = xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetTo(stm.JID().String())
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:version"))
+	stm.SendIQ(iq, handler, time.Millisecond*100)
+	_ = conn.ClientReadElement()
+
+	resp = <-respCh
+	require.Nil(t, resp.iq)
+	require.Equal(t, c2s.ErrIQTimeout, resp.err)
+}
 
 func tUtilStreamOpen(conn *transport.MockConn) {
 	s := `<?xml version="1.0"?>
@@ -337,6 +1668,275 @@ func tUtilStreamStartSession(conn *transport.MockConn, t *testing.T) {
 	time.Sleep(time.Millisecond * 100) // wait until stream internal state changes
 }
 
+func TestStream_AnonymousAuthentication(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.SASL = []string{"anonymous"}
+	cfg.SASLAnonymous.Domains = []string{"jackal.im"}
+
+	// anonymous login not allowed for stream domain
+	conn := transport.NewMockConn()
+	stm := newC2SStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="ANONYMOUS"/>`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "failure", elem.Name())
+	require.NotNil(t, elem.Elements().Child("invalid-mechanism"))
+	stm.Disconnect(nil)
+	require.True(t, conn.WaitClose())
+
+	cfg.SASLAnonymous.Domains = nil
+
+	conn = transport.NewMockConn()
+	stm = newC2SStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="ANONYMOUS"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "success", elem.Name())
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+	require.True(t, stm.isAnonymous())
+
+	// anonymous users can't persist data
+	conn.ClientWriteBytes([]byte(`<iq type="set" id="roster_1">
+<query xmlns="jabber:iq:roster"><item jid="romeo@localhost"/></query>
+</iq>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().Elements().Child("forbidden"))
+
+	stm.Disconnect(nil)
+	require.True(t, conn.WaitClose())
+}
+
+func TestStream_VirtualHost(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost", "jackal.im"}})
+	defer c2s.Shutdown()
+
+	host.Initialize([]host.Config{{
+		Name:         "jackal.im",
+		Modules:      map[string]struct{}{"registration": {}},
+		Registration: &xep0077.Config{AllowRegistration: false},
+	}})
+	defer host.Shutdown()
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features := conn.ClientReadElement()
+	require.Nil(t, stm.host)
+	require.NotNil(t, stm.vCard)
+	require.NotNil(t, features.Elements().ChildNamespace("register", "http://jabber.org/features/iq-register"))
+	stm.Disconnect(nil)
+
+	// host modules and registration policy override server ones
+	stm, conn = tUtilStreamInit()
+	conn.ClientWriteBytes([]byte(`<?xml version="1.0"?>
+	<stream:stream xmlns:stream="http://etherx.jabber.org/streams"
+	version="1.0" xmlns="jabber:client" to="jackal.im" xml:lang="en" xmlns:xml="http://www.w3.org/XML/1998/namespace">
+`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "jackal.im", elem.From())
+	features = conn.ClientReadElement()
+	require.NotNil(t, stm.host)
+	require.Equal(t, "jackal.im", stm.host.Name)
+	require.Nil(t, stm.vCard)
+	require.NotNil(t, stm.register)
+	require.Nil(t, features.Elements().ChildNamespace("register", "http://jabber.org/features/iq-register"))
+}
+
+func TestStream_IdleKeepAlive(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Transport.ConnectTimeout = 0
+	cfg.Transport.IdleTimeout = 1
+
+	conn := transport.NewMockConn()
+	stm := newC2SStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	// whitespace ping on idle connection
+	require.Equal(t, []byte(" "), conn.ClientReadBytes())
+
+	// dead connection
+	conn.Break()
+	require.True(t, conn.WaitCloseWithTimeout(time.Second*2))
+	require.Equal(t, disconnected, stm.getState())
+}
+
+func TestStream_RateLimit(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	// limit inbound rate once session has been started
+	ch := make(chan struct{})
+	stm.actorCh <- func() {
+		stm.rateLimiter = newRateLimiter(1, 5)
+		close(ch)
+	}
+	<-ch
+
+	buf := new(bytes.Buffer)
+	for i := 0; i < 10; i++ {
+		iq := xml.NewIQType(uuid.New(), xml.GetType)
+		iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
+		buf.WriteString(iq.String())
+	}
+	conn.ClientWriteBytes(buf.Bytes())
+
+	// allowed requests may be answered after stream error has been sent
+	var streamErr xml.XElement
+	for i := 0; i < 6 && streamErr == nil; i++ {
+		if elem := conn.ClientReadElement(); elem.Name() == "stream:error" {
+			streamErr = elem
+		}
+	}
+	require.NotNil(t, streamErr)
+	require.NotNil(t, streamErr.Elements().Child("policy-violation"))
+
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+}
+
+func TestStream_RateLimitNonzas(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+
+	// stream headers and SASL elements don't consume rate limit tokens
+	ch := make(chan struct{})
+	stm.actorCh <- func() {
+		stm.rateLimiter = newRateLimiter(1, 2)
+		close(ch)
+	}
+	<-ch
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+	require.Equal(t, sessionStarted, stm.getState())
+}
+
+func TestStream_StanzaLimits(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	// oversized stanza
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	body := xml.NewElementName("body")
+	body.SetText(strings.Repeat("a", 16384))
+	msg.AppendElement(body)
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+
+	// deeply nested element
+	stm, conn = tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(strings.Repeat("<a>", 512)))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+}
+
+func TestStream_BillionLaughs(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	var entities bytes.Buffer
+	entities.WriteString(`<!ENTITY lol0 "lol">`)
+	for i := 1; i < 10; i++ {
+		entities.WriteString(fmt.Sprintf(`<!ENTITY lol%d "%s">`, i, strings.Repeat(fmt.Sprintf("&lol%d;", i-1), 10)))
+	}
+	conn.ClientWriteBytes([]byte(`<!DOCTYPE lolz [` + entities.String() + `]><message>&lol9;</message>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("restricted-xml"))
+	require.True(t, conn.WaitClose())
+	require.Equal(t, disconnected, stm.getState())
+}
+
 func tUtilStreamInit() (*c2sStream, *transport.MockConn) {
 	conn := transport.NewMockConn()
 	tr := transport.NewSocketTransport(conn, 4096, 4096)
@@ -345,6 +1945,17 @@ func tUtilStreamInit() (*c2sStream, *transport.MockConn) {
 	return stm, conn
 }
 
+func tUtilWebSocketStreamInit() (*c2sStream, *transport.MockConn) {
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Transport.Type = transport.WebSocket
+
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	stm := newC2SStream("abcd1234", tr, cfg)
+	c2s.Instance().RegisterStream(stm)
+	return stm, conn
+}
+
 func tUtilStreamDefaultConfig() *Config {
 	modules := map[string]struct{}{}
 	modules["roster"] = struct{}{}
@@ -367,6 +1978,7 @@ func tUtilStreamDefaultConfig() *Config {
 		TLS: TLSConfig{
 			PrivKeyFile: "../testdata/cert/test.server.key",
 			CertFile:    "../testdata/cert/test.server.crt",
+			StartTLS:    StartTLSOptional,
 		},
 		Compression:     CompressConfig{Level: compress.DefaultCompression},
 		SASL:            []string{"plain", "digest_md5", "scram_sha_1", "scram_sha_256"},
@@ -374,6 +1986,6 @@ func tUtilStreamDefaultConfig() *Config {
 		ModOffline:      offline.Config{QueueSize: 10},
 		ModRegistration: xep0077.Config{AllowRegistration: true, AllowChange: true},
 		ModVersion:      xep0092.Config{ShowOS: true},
-		ModPing:         xep0199.Config{SendInterval: 5, Send: true},
+		ModPing:         xep0199.Config{SendInterval: 5},
 	}
 }
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"github.com/ortuman/jackal/cluster"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+// ClusterDeliverFunc returns the function delivering those stanzas forwarded
+// by other cluster nodes to local streams.
+// A bare JID message none of the local resources is eligible for is passed on
+// to the next node holding a session of its recipient, being stored offline
+// according to the first c2s server configuration once there's none left.
+func ClusterDeliverFunc(srvConfigurations []Config) cluster.DeliverFunc {
+	cfg := &Config{}
+	for i := 0; i < len(srvConfigurations); i++ {
+		if srvConfigurations[i].Type == C2SServerType {
+			cfg = &srvConfigurations[i]
+			break
+		}
+	}
+	return func(stanza xml.Stanza) {
+		err := c2s.Instance().DeliverLocal(stanza)
+		if err == nil {
+			return
+		}
+		message, ok := stanza.(*xml.Message)
+		if !ok || err != c2s.ErrNotAuthenticated || message.ToJID().IsFullWithUser() {
+			log.Warnf("couldn't deliver forwarded stanza: %v", err)
+			return
+		}
+		switch err := cluster.Instance().RouteNext(message); err {
+		case nil:
+			return
+		case cluster.ErrSessionNotFound:
+			break
+		default:
+			log.Error(err)
+		}
+		storeOfflineMessage(cfg, message)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/ortuman/jackal/cluster"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterDeliverFunc(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+
+	s, err := miniredis.Run()
+	require.Nil(t, err)
+	defer s.Close()
+
+	// ortuman is connected to another alive node as well
+	s.Set("cluster:node:node2", "1")
+	s.SetAdd("cluster:members", "node2")
+	s.HSet("cluster:sessions:ortuman", "garden", "node2")
+
+	cluster.Initialize(&cluster.Config{
+		Name:              "node1",
+		Redis:             cluster.RedisConfig{Address: s.Addr(), PoolSize: 2},
+		HeartbeatInterval: 1,
+		NodeTimeout:       2,
+	}, nil)
+	defer cluster.Shutdown()
+
+	cfg := &Config{Type: C2SServerType, Modules: map[string]struct{}{"offline": {}}}
+	deliver := ClusterDeliverFunc([]Config{*tUtilS2SDefaultConfig(), *cfg})
+
+	j1, _ := xml.NewJIDString("romeo@jackal.im/orchard", false)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+
+	// local resource is not available...
+	stm := c2s.NewMockStream(uuid.New(), j2)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().AuthenticateStream(stm)
+	defer c2s.Instance().UnregisterStream(stm)
+
+	msg := xml.NewMessageType("m1", xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2.ToBareJID())
+	msg.AppendElement(xml.NewElementName("body"))
+
+	// ...so message is passed on to the next node
+	deliver(msg)
+	inbox, _ := s.List("cluster:inbox:node2")
+	require.Equal(t, 1, len(inbox))
+
+	msgs, _ := storage.Instance().FetchOfflineMessages("ortuman")
+	require.Equal(t, 0, len(msgs))
+
+	// last node stores it offline
+	s.HDel("cluster:sessions:ortuman", "garden")
+	deliver(msg)
+
+	msgs, _ = storage.Instance().FetchOfflineMessages("ortuman")
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "m1", msgs[0].ID())
+}
@@ -5,7 +5,14 @@
 
 package compress
 
-import "io"
+import (
+	"errors"
+	"io"
+)
+
+// ErrProcessingFailed will be returned by a compressor whenever
+// received data could not be decompressed.
+var ErrProcessingFailed = errors.New("compress: processing failed")
 
 // Level represents a stream compression level.
 type Level int
@@ -6,6 +6,7 @@
 package compress
 
 import (
+	"compress/flate"
 	"compress/zlib"
 	"io"
 )
@@ -47,17 +48,35 @@ func (z *ZlibCompressor) Write(p []byte) (int, error) {
 		z.zw = zw
 	}
 	zw := z.zw.(*zlib.Writer)
-	defer zw.Flush()
-	return zw.Write(p)
+	n, err := zw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, zw.Flush()
 }
 
 func (z *ZlibCompressor) Read(p []byte) (int, error) {
 	if z.zr == nil {
 		zr, err := zlib.NewReader(z.r)
 		if err != nil {
-			return 0, err
+			return 0, processingError(err)
 		}
 		z.zr = zr
 	}
-	return z.zr.Read(p)
+	n, err := z.zr.Read(p)
+	return n, processingError(err)
+}
+
+// processingError maps zlib data format errors to ErrProcessingFailed,
+// preserving underlying reader errors.
+func processingError(err error) error {
+	switch err {
+	case zlib.ErrChecksum, zlib.ErrDictionary, zlib.ErrHeader:
+		return ErrProcessingFailed
+	}
+	switch err.(type) {
+	case flate.CorruptInputError, flate.InternalError:
+		return ErrProcessingFailed
+	}
+	return err
 }
@@ -101,5 +101,12 @@ func TestInvalidInflate(t *testing.T) {
 	rBuf.Write([]byte("this is garbage!"))
 	compressor := NewZlibCompressor(rBuf, nil, DefaultCompression)
 	_, err := ioutil.ReadAll(compressor)
-	require.NotNil(t, err)
+	require.Equal(t, ErrProcessingFailed, err)
+
+	// corrupted deflate data
+	rBuf.Reset()
+	rBuf.Write([]byte{120, 156, 255, 255, 255, 255})
+	compressor = NewZlibCompressor(rBuf, nil, DefaultCompression)
+	_, err = ioutil.ReadAll(compressor)
+	require.Equal(t, ErrProcessingFailed, err)
 }
@@ -6,17 +6,30 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/ortuman/jackal/module/offline"
 	"github.com/ortuman/jackal/module/roster"
+	"github.com/ortuman/jackal/module/xep0030"
+	"github.com/ortuman/jackal/module/xep0049"
 	"github.com/ortuman/jackal/module/xep0077"
 	"github.com/ortuman/jackal/module/xep0092"
+	"github.com/ortuman/jackal/module/xep0133"
+	"github.com/ortuman/jackal/module/xep0184"
+	"github.com/ortuman/jackal/module/xep0191"
 	"github.com/ortuman/jackal/module/xep0199"
+	"github.com/ortuman/jackal/module/xep0313"
+	"github.com/ortuman/jackal/module/xep0352"
+	"github.com/ortuman/jackal/module/xep0357"
+	"github.com/ortuman/jackal/module/xep0363"
 	"github.com/ortuman/jackal/server/compress"
 	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/s2s"
 )
 
 const (
@@ -24,6 +37,28 @@ const (
 	defaultTransportMaxStanzaSize  = 32768
 	defaultTransportConnectTimeout = 5
 	defaultTransportKeepAlive      = 120
+	defaultTransportMaxWait        = 60
+	defaultTransportSendQueueSize  = 64
+)
+
+const (
+	defaultS2SDialTimeout  = 15
+	defaultS2SIdleTimeout  = 600
+	defaultS2SMaxDials     = 4
+	defaultS2SMaxBackoff   = 300
+	defaultS2SPingFailures = 3
+)
+
+const defaultShutdownDrainTimeout = 10
+
+const (
+	defaultOAuthUsernameClaim = "sub"
+	defaultOAuthCacheTTL      = 60
+)
+
+const (
+	defaultStreamMgmtMaxResumeTimeout = 120
+	defaultStreamMgmtMaxQueueSize     = 1024
 )
 
 // ServerType represents a server type (c2s, s2s).
@@ -32,7 +67,7 @@ type ServerType int
 const (
 	// C2SServerType represents a client to client server type.
 	C2SServerType ServerType = iota
-	// S2SServerType represents a server-to-client server type.
+	// S2SServerType represents a server-to-server server type.
 	S2SServerType
 )
 
@@ -59,39 +94,93 @@ const (
 
 	// Replace represents 'replace' resource conflict policy.
 	Replace
+
+	// RandomSuffix represents 'random_suffix' resource conflict policy.
+	RandomSuffix
+)
+
+// ResourceGenerationPolicy represents the policy used to generate a resource
+// whenever a client binds without requesting any.
+type ResourceGenerationPolicy int
+
+const (
+	// UUIDResource represents 'uuid' resource generation policy.
+	UUIDResource ResourceGenerationPolicy = iota
+
+	// CounterResource represents 'counter' resource generation policy.
+	CounterResource
+
+	// ClientHintResource represents 'hint' resource generation policy.
+	ClientHintResource
 )
 
 // Config represents an XMPP server configuration.
 type Config struct {
-	ID               string
-	Type             ServerType
-	ResourceConflict ResourceConflictPolicy
-	Transport        TransportConfig
-	SASL             []string
-	TLS              TLSConfig
-	Modules          map[string]struct{}
-	Compression      CompressConfig
-	ModRoster        roster.Config
-	ModOffline       offline.Config
-	ModRegistration  xep0077.Config
-	ModVersion       xep0092.Config
-	ModPing          xep0199.Config
+	ID                 string
+	Type               ServerType
+	ResourceConflict   ResourceConflictPolicy
+	ResourceGeneration ResourceGenerationPolicy
+	Transport          TransportConfig
+	SASL               []string
+	SASLAnonymous      SASLAnonymousConfig
+	SASLExternal       SASLExternalConfig
+	SASLOAuthBearer    SASLOAuthBearerConfig
+	TLS                TLSConfig
+	Modules            map[string]struct{}
+	Compression        CompressConfig
+	StreamManagement   StreamMgmtConfig
+	RateLimit          RateLimitConfig
+	ConnLimit          ConnLimitConfig
+	S2S                S2SConfig
+	LoginMessage       *c2s.Announcement
+	ModRoster          roster.Config
+	ModDisco           xep0030.Config
+	ModPrivate         xep0049.Config
+	ModOffline         offline.Config
+	ModRegistration    xep0077.Config
+	ModVersion         xep0092.Config
+	ModReceipts        xep0184.Config
+	ModBlocking        xep0191.Config
+	ModPing            xep0199.Config
+	ModMam             xep0313.Config
+	ModCsi             xep0352.Config
+	ModPush            xep0357.Config
+	ModUpload          xep0363.Config
+	ModAdmin           xep0133.Config
 }
 
 type configProxyType struct {
-	ID               string          `yaml:"id"`
-	Type             string          `yaml:"type"`
-	ResourceConflict string          `yaml:"resource_conflict"`
-	Transport        TransportConfig `yaml:"transport"`
-	SASL             []string        `yaml:"sasl"`
-	TLS              TLSConfig       `yaml:"tls"`
-	Modules          []string        `yaml:"modules"`
-	Compression      CompressConfig  `yaml:"compression"`
-	ModRoster        roster.Config   `yaml:"mod_roster"`
-	ModOffline       offline.Config  `yaml:"mod_offline"`
-	ModRegistration  xep0077.Config  `yaml:"mod_registration"`
-	ModVersion       xep0092.Config  `yaml:"mod_version"`
-	ModPing          xep0199.Config  `yaml:"mod_ping"`
+	ID                 string                `yaml:"id"`
+	Type               string                `yaml:"type"`
+	ResourceConflict   string                `yaml:"resource_conflict"`
+	ResourceGeneration string                `yaml:"resource_generation"`
+	Transport          TransportConfig       `yaml:"transport"`
+	SASL               []string              `yaml:"sasl"`
+	SASLAnonymous      SASLAnonymousConfig   `yaml:"sasl_anonymous"`
+	SASLExternal       SASLExternalConfig    `yaml:"sasl_external"`
+	SASLOAuthBearer    SASLOAuthBearerConfig `yaml:"sasl_oauthbearer"`
+	TLS                TLSConfig             `yaml:"tls"`
+	Modules            []string              `yaml:"modules"`
+	Compression        CompressConfig        `yaml:"compression"`
+	StreamManagement   StreamMgmtConfig      `yaml:"stream_management"`
+	RateLimit          RateLimitConfig       `yaml:"rate_limit"`
+	ConnLimit          ConnLimitConfig       `yaml:"conn_limit"`
+	S2S                S2SConfig             `yaml:"s2s"`
+	LoginMessage       *c2s.Announcement     `yaml:"login_message"`
+	ModRoster          roster.Config         `yaml:"mod_roster"`
+	ModDisco           xep0030.Config        `yaml:"mod_disco"`
+	ModPrivate         xep0049.Config        `yaml:"mod_private"`
+	ModOffline         offline.Config        `yaml:"mod_offline"`
+	ModRegistration    xep0077.Config        `yaml:"mod_registration"`
+	ModVersion         xep0092.Config        `yaml:"mod_version"`
+	ModReceipts        xep0184.Config        `yaml:"mod_receipts"`
+	ModBlocking        xep0191.Config        `yaml:"mod_blocking"`
+	ModPing            xep0199.Config        `yaml:"mod_ping"`
+	ModMam             xep0313.Config        `yaml:"mod_mam"`
+	ModCsi             xep0352.Config        `yaml:"mod_csi"`
+	ModPush            xep0357.Config        `yaml:"mod_push"`
+	ModUpload          xep0363.Config        `yaml:"mod_upload"`
+	ModAdmin           xep0133.Config        `yaml:"mod_admin"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
@@ -105,7 +194,10 @@ func (cfg *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	case "c2s":
 		cfg.Type = C2SServerType
 	case "s2s":
-		return errors.New("server.Config: s2s server type not yet supported")
+		if p.Transport.Type == transport.WebSocket || p.Transport.Type == transport.Bosh {
+			return errors.New("server.Config: s2s server type requires socket transport")
+		}
+		cfg.Type = S2SServerType
 	default:
 		return fmt.Errorf("server.Config: unrecognized server type: %s", p.Type)
 	}
@@ -118,14 +210,32 @@ func (cfg *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		cfg.ResourceConflict = Reject
 	case "", "replace":
 		cfg.ResourceConflict = Replace
+	case "random_suffix":
+		cfg.ResourceConflict = RandomSuffix
 	default:
 		return fmt.Errorf("invalid resource_conflict option: %s", rc)
 	}
+	// validate resource generation policy type
+	rg := strings.ToLower(p.ResourceGeneration)
+	switch rg {
+	case "", "uuid":
+		cfg.ResourceGeneration = UUIDResource
+	case "counter":
+		cfg.ResourceGeneration = CounterResource
+	case "hint":
+		cfg.ResourceGeneration = ClientHintResource
+	default:
+		return fmt.Errorf("invalid resource_generation option: %s", rg)
+	}
 	// validate SASL mechanisms
 	for _, sasl := range p.SASL {
 		switch sasl {
-		case "plain", "digest_md5", "scram_sha_1", "scram_sha_256":
+		case "plain", "digest_md5", "scram_sha_1", "scram_sha_256", "anonymous", "external":
 			continue
+		case "oauthbearer":
+			if len(p.SASLOAuthBearer.Verifier) == 0 {
+				return errors.New("server.Config: oauthbearer SASL mechanism requires a token verifier")
+			}
 		default:
 			return fmt.Errorf("server.Config: unrecognized SASL mechanism: %s", sasl)
 		}
@@ -133,45 +243,122 @@ func (cfg *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	// validate modules
 	cfg.Modules = map[string]struct{}{}
 	for _, module := range p.Modules {
-		switch module {
-		case "roster", "last_activity", "private", "vcard", "registration", "version", "blocking_command", "ping",
-			"offline":
-			break
-		default:
+		if !isModuleAvailable(module) {
 			return fmt.Errorf("config.Server: unrecognized module: %s", module)
 		}
 		cfg.Modules[module] = struct{}{}
 	}
+	if _, ok := cfg.Modules["upload"]; ok {
+		if len(p.ModUpload.BaseURL) == 0 || len(p.ModUpload.StoragePath) == 0 || len(p.ModUpload.Secret) == 0 {
+			return errors.New("server.Config: upload module requires base_url, storage_path and secret")
+		}
+	}
+	if p.LoginMessage != nil {
+		if err := p.LoginMessage.Validate(); err != nil {
+			return fmt.Errorf("server.Config: invalid login_message: %v", err)
+		}
+	}
 	cfg.ID = p.ID
 	cfg.Transport = p.Transport
 	cfg.SASL = p.SASL
+	cfg.SASLAnonymous = p.SASLAnonymous
+	cfg.SASLExternal = p.SASLExternal
+	cfg.SASLOAuthBearer = p.SASLOAuthBearer
 	cfg.TLS = p.TLS
 	cfg.Compression = p.Compression
+	cfg.StreamManagement = p.StreamManagement
+	cfg.RateLimit = p.RateLimit
+	cfg.ConnLimit = p.ConnLimit
+	cfg.S2S = p.S2S
+	cfg.LoginMessage = p.LoginMessage
 	cfg.ModRoster = p.ModRoster
+	cfg.ModDisco = p.ModDisco
+	cfg.ModPrivate = p.ModPrivate
 	cfg.ModOffline = p.ModOffline
 	cfg.ModRegistration = p.ModRegistration
 	cfg.ModVersion = p.ModVersion
+	cfg.ModReceipts = p.ModReceipts
+	cfg.ModBlocking = p.ModBlocking
 	cfg.ModPing = p.ModPing
+	cfg.ModMam = p.ModMam
+	cfg.ModCsi = p.ModCsi
+	cfg.ModPush = p.ModPush
+	cfg.ModUpload = p.ModUpload
+	cfg.ModAdmin = p.ModAdmin
 	return nil
 }
 
+// ValidateListeners checks a set of server configurations as a whole,
+// verifying that listener identifiers and addresses don't collide, and that
+// in-band registration requiring TLS is reachable through at least one secure c2s listener.
+func ValidateListeners(cfgs []Config) error {
+	var requireTLSRegistration, hasSecureListener bool
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		if len(cfg.ID) == 0 {
+			return errors.New("server.Config: no server id specified")
+		}
+		for j := 0; j < i; j++ {
+			if cfgs[j].ID == cfg.ID {
+				return fmt.Errorf("server.Config: duplicated server id: %s", cfg.ID)
+			}
+			if cfgs[j].Transport.overlaps(&cfg.Transport) {
+				return fmt.Errorf("server.Config: servers %s and %s listen at the same address", cfgs[j].ID, cfg.ID)
+			}
+		}
+		if cfg.Type != C2SServerType {
+			continue
+		}
+		if cfg.isSecure() {
+			hasSecureListener = true
+		}
+		if _, ok := cfg.Modules["registration"]; ok && cfg.ModRegistration.AllowRegistration && cfg.ModRegistration.RequireTLS {
+			requireTLSRegistration = true
+		}
+	}
+	if requireTLSRegistration && !hasSecureListener {
+		return errors.New("server.Config: registration requires TLS, but no c2s server can secure its streams")
+	}
+	return nil
+}
+
+// isSecure returns whether or not the server is able to secure its streams.
+// WebSocket and BOSH transports are always served over TLS (or behind a TLS offloading proxy).
+func (cfg *Config) isSecure() bool {
+	return cfg.Transport.Type != transport.Socket || cfg.TLS.StartTLS != StartTLSDisabled
+}
+
 // TransportConfig represents an XMPP stream transport configuration.
 type TransportConfig struct {
-	Type           transport.TransportType
-	BindAddress    string
-	Port           int
-	ConnectTimeout int
-	KeepAlive      int
-	MaxStanzaSize  int
+	Type            transport.TransportType
+	BindAddress     string
+	Port            int
+	ConnectTimeout  int
+	KeepAlive       int
+	IdleTimeout     int
+	MaxStanzaSize   int
+	URLPath         string
+	TLSOffload      bool
+	MaxWait         int
+	ReadBufferSize  int
+	WriteBufferSize int
+	SendQueueSize   int
 }
 
 type transportProxyType struct {
-	Type           string `yaml:"type"`
-	BindAddress    string `yaml:"bind_addr"`
-	Port           int    `yaml:"port"`
-	ConnectTimeout int    `yaml:"connect_timeout"`
-	KeepAlive      int    `yaml:"keep_alive"`
-	MaxStanzaSize  int    `yaml:"max_stanza_size"`
+	Type            string `yaml:"type"`
+	BindAddress     string `yaml:"bind_addr"`
+	Port            int    `yaml:"port"`
+	ConnectTimeout  int    `yaml:"connect_timeout"`
+	KeepAlive       int    `yaml:"keep_alive"`
+	IdleTimeout     int    `yaml:"idle_timeout"`
+	MaxStanzaSize   int    `yaml:"max_stanza_size"`
+	URLPath         string `yaml:"url_path"`
+	TLSOffload      bool   `yaml:"tls_offload"`
+	MaxWait         int    `yaml:"max_wait"`
+	ReadBufferSize  int    `yaml:"read_buffer_size"`
+	WriteBufferSize int    `yaml:"write_buffer_size"`
+	SendQueueSize   int    `yaml:"send_queue_size"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
@@ -188,6 +375,9 @@ func (t *TransportConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	case "websocket":
 		t.Type = transport.WebSocket
 
+	case "bosh":
+		t.Type = transport.Bosh
+
 	default:
 		return fmt.Errorf("server.TransportConfig: unrecognized transport type: %s", p.Type)
 	}
@@ -206,26 +396,264 @@ func (t *TransportConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	if t.KeepAlive == 0 {
 		t.KeepAlive = defaultTransportKeepAlive
 	}
+	if p.IdleTimeout < 0 || (p.IdleTimeout > 0 && p.IdleTimeout >= t.KeepAlive) {
+		return fmt.Errorf("server.TransportConfig: invalid idle timeout: %d", p.IdleTimeout)
+	}
+	t.IdleTimeout = p.IdleTimeout
 	t.MaxStanzaSize = p.MaxStanzaSize
 	if t.MaxStanzaSize == 0 {
 		t.MaxStanzaSize = defaultTransportMaxStanzaSize
 	}
+	if len(p.URLPath) > 0 && !strings.HasPrefix(p.URLPath, "/") {
+		return fmt.Errorf("server.TransportConfig: invalid URL path: %s", p.URLPath)
+	}
+	t.URLPath = p.URLPath
+	t.TLSOffload = p.TLSOffload
+	if p.MaxWait < 0 {
+		return fmt.Errorf("server.TransportConfig: invalid max wait: %d", p.MaxWait)
+	}
+	t.MaxWait = p.MaxWait
+	if t.MaxWait == 0 {
+		t.MaxWait = defaultTransportMaxWait
+	}
+	if p.ReadBufferSize < 0 || p.WriteBufferSize < 0 {
+		return errors.New("server.TransportConfig: invalid socket buffer size")
+	}
+	t.ReadBufferSize = p.ReadBufferSize
+	t.WriteBufferSize = p.WriteBufferSize
+	if p.SendQueueSize < 0 {
+		return fmt.Errorf("server.TransportConfig: invalid send queue size: %d", p.SendQueueSize)
+	}
+	t.SendQueueSize = p.SendQueueSize
+	if t.SendQueueSize == 0 {
+		t.SendQueueSize = defaultTransportSendQueueSize
+	}
+	return nil
+}
+
+// overlaps returns whether or not both transports listen at the same address,
+// taking into account that an unspecified bind address listens at every interface.
+func (t *TransportConfig) overlaps(other *TransportConfig) bool {
+	if t.Port != other.Port {
+		return false
+	}
+	return t.BindAddress == other.BindAddress || isUnspecifiedAddress(t.BindAddress) || isUnspecifiedAddress(other.BindAddress)
+}
+
+func isUnspecifiedAddress(address string) bool {
+	switch address {
+	case "", "0.0.0.0", "::", "[::]":
+		return true
+	}
+	return false
+}
+
+// SASLAnonymousConfig represents SASL ANONYMOUS authentication configuration.
+type SASLAnonymousConfig struct {
+	// Domains restricts anonymous logins to a subset of local domains.
+	// Every local domain allows them when empty.
+	Domains []string `yaml:"domains"`
+}
+
+// SASLExternalConfig represents SASL EXTERNAL (client certificate) authentication configuration.
+type SASLExternalConfig struct {
+	// CAFile is the PEM file of the authorities trusted to issue client
+	// certificates. System roots are used when empty.
+	CAFile string `yaml:"ca_path"`
+
+	// RequireDomainMatch rejects certificates issued for a domain
+	// other than the stream's one.
+	RequireDomainMatch bool `yaml:"require_domain_match"`
+}
+
+// OAuthVerifierType represents an OAuth 2.0 bearer token verifier type.
+type OAuthVerifierType string
+
+const (
+	// JWKSVerifier verifies JWT tokens against the keys published at a JWKS URL.
+	JWKSVerifier OAuthVerifierType = "jwks"
+
+	// IntrospectionVerifier verifies tokens against an RFC 7662 introspection endpoint.
+	IntrospectionVerifier OAuthVerifierType = "introspection"
+)
+
+// SASLOAuthBearerConfig represents SASL OAUTHBEARER (OAuth 2.0 bearer token) authentication configuration.
+type SASLOAuthBearerConfig struct {
+	Verifier OAuthVerifierType
+
+	// JWKSURL is the location of the identity provider signing keys (jwks verifier).
+	JWKSURL string
+
+	// Issuer and Audience, when set, must match the token ones (jwks verifier).
+	Issuer   string
+	Audience string
+
+	// IntrospectionURL is the token introspection endpoint location,
+	// authenticated with ClientID and ClientSecret when set (introspection verifier).
+	IntrospectionURL string
+	ClientID         string
+	ClientSecret     string
+
+	// UsernameClaim is the token claim carrying the local username (or bare JID).
+	UsernameClaim string
+
+	// CacheTTL is the time (in seconds) token validation results are cached.
+	CacheTTL int
+}
+
+type saslOAuthBearerProxyType struct {
+	Verifier         string `yaml:"verifier"`
+	JWKSURL          string `yaml:"jwks_url"`
+	Issuer           string `yaml:"issuer"`
+	Audience         string `yaml:"audience"`
+	IntrospectionURL string `yaml:"introspection_url"`
+	ClientID         string `yaml:"client_id"`
+	ClientSecret     string `yaml:"client_secret"`
+	UsernameClaim    string `yaml:"username_claim"`
+	CacheTTL         int    `yaml:"cache_ttl"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (c *SASLOAuthBearerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := saslOAuthBearerProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	verifier := OAuthVerifierType(strings.ToLower(p.Verifier))
+	switch verifier {
+	case JWKSVerifier:
+		if len(p.JWKSURL) == 0 {
+			return errors.New("server.SASLOAuthBearerConfig: jwks verifier requires jwks_url")
+		}
+	case IntrospectionVerifier:
+		if len(p.IntrospectionURL) == 0 {
+			return errors.New("server.SASLOAuthBearerConfig: introspection verifier requires introspection_url")
+		}
+	default:
+		return fmt.Errorf("server.SASLOAuthBearerConfig: unrecognized verifier: %s", p.Verifier)
+	}
+	if p.CacheTTL < 0 {
+		return fmt.Errorf("server.SASLOAuthBearerConfig: invalid cache ttl: %d", p.CacheTTL)
+	}
+	c.Verifier = verifier
+	c.JWKSURL = p.JWKSURL
+	c.Issuer = p.Issuer
+	c.Audience = p.Audience
+	c.IntrospectionURL = p.IntrospectionURL
+	c.ClientID = p.ClientID
+	c.ClientSecret = p.ClientSecret
+	c.UsernameClaim = p.UsernameClaim
+	if len(c.UsernameClaim) == 0 {
+		c.UsernameClaim = defaultOAuthUsernameClaim
+	}
+	c.CacheTTL = p.CacheTTL
+	if c.CacheTTL == 0 {
+		c.CacheTTL = defaultOAuthCacheTTL
+	}
 	return nil
 }
 
+// StartTLSPolicy represents a listener STARTTLS policy.
+type StartTLSPolicy string
+
+const (
+	// StartTLSRequired requires streams to be secured before authenticating.
+	StartTLSRequired StartTLSPolicy = "required"
+
+	// StartTLSOptional offers STARTTLS, but also allows authenticating over plaintext streams.
+	StartTLSOptional StartTLSPolicy = "optional"
+
+	// StartTLSDisabled doesn't offer STARTTLS at all.
+	StartTLSDisabled StartTLSPolicy = "disabled"
+)
+
 // TLSConfig represents a server TLS configuration.
 type TLSConfig struct {
-	CertFile    string `yaml:"cert_path"`
-	PrivKeyFile string `yaml:"privkey_path"`
+	CertFile    string
+	PrivKeyFile string
+
+	// STARTTLS policy (server type default if empty)
+	StartTLS StartTLSPolicy
+
+	// minimum accepted TLS version (TLS 1.2 if zero)
+	MinVersion uint16
+
+	// enabled TLS 1.2 cipher suites and elliptic curves in preference order
+	// (Go defaults if empty)
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+}
+
+type tlsProxyType struct {
+	CertFile     string   `yaml:"cert_path"`
+	PrivKeyFile  string   `yaml:"privkey_path"`
+	StartTLS     string   `yaml:"starttls"`
+	MinVersion   string   `yaml:"min_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	Curves       []string `yaml:"curves"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (c *TLSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := tlsProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	policy := StartTLSPolicy(strings.ToLower(p.StartTLS))
+	switch policy {
+	case "", StartTLSRequired, StartTLSOptional, StartTLSDisabled:
+		break
+	default:
+		return fmt.Errorf("server.TLSConfig: unrecognized starttls policy: %s", p.StartTLS)
+	}
+	var minVersion uint16
+	if len(p.MinVersion) > 0 {
+		v, ok := tlsVersions[p.MinVersion]
+		if !ok {
+			return fmt.Errorf("server.TLSConfig: unrecognized min_version: %s", p.MinVersion)
+		}
+		if v < tls.VersionTLS12 {
+			return fmt.Errorf("server.TLSConfig: insecure min_version: %s", p.MinVersion)
+		}
+		minVersion = v
+	}
+	var cipherSuites []uint16
+	for _, name := range p.CipherSuites {
+		if weakTLSCipherSuites[name] {
+			return fmt.Errorf("server.TLSConfig: insecure cipher suite: %s", name)
+		}
+		id, ok := tlsCipherSuites[name]
+		if !ok {
+			return fmt.Errorf("server.TLSConfig: unrecognized cipher suite: %s", name)
+		}
+		cipherSuites = append(cipherSuites, id)
+	}
+	var curves []tls.CurveID
+	for _, name := range p.Curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("server.TLSConfig: unrecognized curve: %s", name)
+		}
+		curves = append(curves, id)
+	}
+	c.CertFile = p.CertFile
+	c.PrivKeyFile = p.PrivKeyFile
+	c.StartTLS = policy
+	c.MinVersion = minVersion
+	c.CipherSuites = cipherSuites
+	c.CurvePreferences = curves
+	return nil
 }
 
 // CompressConfig represents a server stream compression configuration.
 type CompressConfig struct {
-	Level compress.Level
+	Level        compress.Level
+	AllowOverTLS bool
 }
 
 type compressionProxyType struct {
-	Level string `yaml:"level"`
+	Level        string `yaml:"level"`
+	AllowOverTLS bool   `yaml:"allow_over_tls"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
@@ -235,7 +663,7 @@ func (c *CompressConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 		return err
 	}
 	switch p.Level {
-	case "":
+	case "", "none":
 		c.Level = compress.NoCompression
 	case "best":
 		c.Level = compress.BestCompression
@@ -246,5 +674,218 @@ func (c *CompressConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	default:
 		return fmt.Errorf("server.CompressConfig: unrecognized compression level: %s", p.Level)
 	}
+	c.AllowOverTLS = p.AllowOverTLS
+	return nil
+}
+
+// StreamMgmtConfig represents a server stream management configuration.
+type StreamMgmtConfig struct {
+	Enabled          bool
+	MaxResumeTimeout int
+	MaxQueueSize     int
+}
+
+type streamMgmtProxyType struct {
+	Enabled          bool `yaml:"enabled"`
+	MaxResumeTimeout int  `yaml:"max_resume_timeout"`
+	MaxQueueSize     int  `yaml:"max_queue_size"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (sm *StreamMgmtConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := streamMgmtProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.MaxResumeTimeout < 0 {
+		return fmt.Errorf("server.StreamMgmtConfig: invalid max resume timeout: %d", p.MaxResumeTimeout)
+	}
+	sm.Enabled = p.Enabled
+	sm.MaxResumeTimeout = p.MaxResumeTimeout
+	if sm.MaxResumeTimeout == 0 {
+		sm.MaxResumeTimeout = defaultStreamMgmtMaxResumeTimeout
+	}
+	sm.MaxQueueSize = p.MaxQueueSize
+	if sm.MaxQueueSize == 0 {
+		sm.MaxQueueSize = defaultStreamMgmtMaxQueueSize
+	}
+	return nil
+}
+
+// RateLimitConfig represents a server inbound stanza rate limit configuration.
+type RateLimitConfig struct {
+	StanzasPerSecond int
+	Burst            int
+}
+
+type rateLimitProxyType struct {
+	StanzasPerSecond int `yaml:"stanzas_per_second"`
+	Burst            int `yaml:"burst"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (rl *RateLimitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := rateLimitProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.StanzasPerSecond < 0 {
+		return fmt.Errorf("server.RateLimitConfig: invalid stanzas per second: %d", p.StanzasPerSecond)
+	}
+	if p.Burst < 0 {
+		return fmt.Errorf("server.RateLimitConfig: invalid burst size: %d", p.Burst)
+	}
+	rl.StanzasPerSecond = p.StanzasPerSecond
+	rl.Burst = p.Burst
+	if rl.Burst == 0 {
+		rl.Burst = rl.StanzasPerSecond
+	}
+	return nil
+}
+
+// ConnLimitConfig represents a server listener connection limit configuration.
+type ConnLimitConfig struct {
+	AcceptsPerSecond int
+	MaxPerIP         int
+}
+
+type connLimitProxyType struct {
+	AcceptsPerSecond int `yaml:"accepts_per_second"`
+	MaxPerIP         int `yaml:"max_per_ip"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (cl *ConnLimitConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := connLimitProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.AcceptsPerSecond < 0 {
+		return fmt.Errorf("server.ConnLimitConfig: invalid accepts per second: %d", p.AcceptsPerSecond)
+	}
+	if p.MaxPerIP < 0 {
+		return fmt.Errorf("server.ConnLimitConfig: invalid max connections per ip: %d", p.MaxPerIP)
+	}
+	cl.AcceptsPerSecond = p.AcceptsPerSecond
+	cl.MaxPerIP = p.MaxPerIP
 	return nil
 }
+
+// S2SConfig represents a server-to-server configuration.
+type S2SConfig struct {
+	DialTimeout  int
+	IdleTimeout  int
+	MaxDials     int
+	MaxBackoff   int
+	PingInterval int
+	PingFailures int
+	Dialback     DialbackConfig
+
+	// Filter restricts the remote domains local domains federate with.
+	Filter s2s.DomainFilter
+}
+
+type s2sProxyType struct {
+	DialTimeout  int            `yaml:"dial_timeout"`
+	IdleTimeout  int            `yaml:"idle_timeout"`
+	MaxDials     int            `yaml:"max_dials"`
+	MaxBackoff   int            `yaml:"max_backoff"`
+	PingInterval int            `yaml:"ping_interval"`
+	PingFailures int            `yaml:"ping_failures"`
+	Dialback     DialbackConfig `yaml:"dialback"`
+	Allow        []string       `yaml:"allow"`
+	Deny         []string       `yaml:"deny"`
+}
+
+// DialbackConfig represents a server dialback (XEP-0220) configuration.
+type DialbackConfig struct {
+	Disabled   bool   `yaml:"disabled"`
+	RequireTLS bool   `yaml:"require_tls"`
+	Secret     string `yaml:"secret"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (c *S2SConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := s2sProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.DialTimeout < 0 {
+		return fmt.Errorf("server.S2SConfig: invalid dial timeout: %d", p.DialTimeout)
+	}
+	if p.IdleTimeout < 0 {
+		return fmt.Errorf("server.S2SConfig: invalid idle timeout: %d", p.IdleTimeout)
+	}
+	if p.MaxDials < 0 {
+		return fmt.Errorf("server.S2SConfig: invalid max dials: %d", p.MaxDials)
+	}
+	if p.MaxBackoff < 0 {
+		return fmt.Errorf("server.S2SConfig: invalid max backoff: %d", p.MaxBackoff)
+	}
+	if p.PingInterval < 0 {
+		return fmt.Errorf("server.S2SConfig: invalid ping interval: %d", p.PingInterval)
+	}
+	if p.PingFailures < 0 {
+		return fmt.Errorf("server.S2SConfig: invalid ping failures: %d", p.PingFailures)
+	}
+	filter := s2s.DomainFilter{Allow: p.Allow, Deny: p.Deny}
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+	c.DialTimeout = p.DialTimeout
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultS2SDialTimeout
+	}
+	c.IdleTimeout = p.IdleTimeout
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultS2SIdleTimeout
+	}
+	c.MaxDials = p.MaxDials
+	if c.MaxDials == 0 {
+		c.MaxDials = defaultS2SMaxDials
+	}
+	c.MaxBackoff = p.MaxBackoff
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = defaultS2SMaxBackoff
+	}
+	c.PingInterval = p.PingInterval
+	c.PingFailures = p.PingFailures
+	if c.PingFailures == 0 {
+		c.PingFailures = defaultS2SPingFailures
+	}
+	c.Dialback = p.Dialback
+	c.Filter = filter
+	return nil
+}
+
+// ShutdownConfig represents the server graceful shutdown configuration.
+type ShutdownConfig struct {
+	DrainTimeout int
+	SeeOtherHost string
+}
+
+type shutdownProxyType struct {
+	DrainTimeout int    `yaml:"drain_timeout"`
+	SeeOtherHost string `yaml:"see_other_host"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (s *ShutdownConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := shutdownProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.DrainTimeout < 0 {
+		return fmt.Errorf("server.ShutdownConfig: invalid drain timeout: %d", p.DrainTimeout)
+	}
+	s.DrainTimeout = p.DrainTimeout
+	s.SeeOtherHost = p.SeeOtherHost
+	return nil
+}
+
+func (s *ShutdownConfig) drainTimeout() time.Duration {
+	if s.DrainTimeout > 0 {
+		return time.Second * time.Duration(s.DrainTimeout)
+	}
+	return time.Second * defaultShutdownDrainTimeout
+}
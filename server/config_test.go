@@ -6,7 +6,9 @@
 package server
 
 import (
+	"crypto/tls"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/server/compress"
 	"github.com/ortuman/jackal/server/transport"
@@ -33,6 +35,15 @@ func TestCompressionConfig(t *testing.T) {
 	err = yaml.Unmarshal([]byte("{level: speed}"), &cmp)
 	require.Nil(t, err)
 	require.Equal(t, compress.SpeedCompression, cmp.Level)
+	require.False(t, cmp.AllowOverTLS)
+
+	err = yaml.Unmarshal([]byte("{level: none}"), &cmp)
+	require.Nil(t, err)
+	require.Equal(t, compress.NoCompression, cmp.Level)
+
+	err = yaml.Unmarshal([]byte("{level: default, allow_over_tls: true}"), &cmp)
+	require.Nil(t, err)
+	require.True(t, cmp.AllowOverTLS)
 
 	err = yaml.Unmarshal([]byte("{level: unknown}"), &cmp)
 	require.NotNil(t, err)
@@ -41,6 +52,139 @@ func TestCompressionConfig(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func TestSASLOAuthBearerConfig(t *testing.T) {
+	oc := SASLOAuthBearerConfig{}
+	err := yaml.Unmarshal([]byte("{verifier: jwks, jwks_url: https://idp.jackal.im/certs, issuer: https://idp.jackal.im}"), &oc)
+	require.Nil(t, err)
+	require.Equal(t, JWKSVerifier, oc.Verifier)
+	require.Equal(t, "https://idp.jackal.im/certs", oc.JWKSURL)
+	require.Equal(t, "https://idp.jackal.im", oc.Issuer)
+	require.Equal(t, defaultOAuthUsernameClaim, oc.UsernameClaim)
+	require.Equal(t, defaultOAuthCacheTTL, oc.CacheTTL)
+
+	err = yaml.Unmarshal([]byte("{verifier: introspection, introspection_url: https://idp.jackal.im/introspect, username_claim: username, cache_ttl: 10}"), &oc)
+	require.Nil(t, err)
+	require.Equal(t, IntrospectionVerifier, oc.Verifier)
+	require.Equal(t, "username", oc.UsernameClaim)
+	require.Equal(t, 10, oc.CacheTTL)
+
+	err = yaml.Unmarshal([]byte("{verifier: jwks}"), &oc)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{verifier: introspection}"), &oc)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{verifier: saml}"), &oc)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{verifier: jwks, jwks_url: https://idp.jackal.im/certs, cache_ttl: -1}"), &oc)
+	require.NotNil(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	tc := TLSConfig{}
+	err := yaml.Unmarshal([]byte("{privkey_path: key.pem, cert_path: cert.pem}"), &tc)
+	require.Nil(t, err)
+	require.Equal(t, "key.pem", tc.PrivKeyFile)
+	require.Equal(t, "cert.pem", tc.CertFile)
+	require.Equal(t, StartTLSPolicy(""), tc.StartTLS)
+
+	err = yaml.Unmarshal([]byte("{starttls: optional}"), &tc)
+	require.Nil(t, err)
+	require.Equal(t, StartTLSOptional, tc.StartTLS)
+
+	err = yaml.Unmarshal([]byte("{starttls: Required}"), &tc)
+	require.Nil(t, err)
+	require.Equal(t, StartTLSRequired, tc.StartTLS)
+
+	err = yaml.Unmarshal([]byte("{starttls: disabled}"), &tc)
+	require.Nil(t, err)
+	require.Equal(t, StartTLSDisabled, tc.StartTLS)
+
+	err = yaml.Unmarshal([]byte("{starttls: sometimes}"), &tc)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{min_version: \"1.3\", cipher_suites: [TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384], curves: [X25519, P256]}"), &tc)
+	require.Nil(t, err)
+	require.Equal(t, uint16(versionTLS13), tc.MinVersion)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, tc.CipherSuites)
+	require.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, tc.CurvePreferences)
+
+	err = yaml.Unmarshal([]byte("{min_version: \"1.1\"}"), &tc)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{min_version: \"2.0\"}"), &tc)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{cipher_suites: [TLS_RSA_WITH_RC4_128_SHA]}"), &tc)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{cipher_suites: [TLS_FOO]}"), &tc)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{curves: [P192]}"), &tc)
+	require.NotNil(t, err)
+}
+
+func TestStreamMgmtConfig(t *testing.T) {
+	sm := StreamMgmtConfig{}
+	err := yaml.Unmarshal([]byte("{enabled: true}"), &sm)
+	require.Nil(t, err)
+	require.True(t, sm.Enabled)
+	require.Equal(t, defaultStreamMgmtMaxResumeTimeout, sm.MaxResumeTimeout)
+	require.Equal(t, defaultStreamMgmtMaxQueueSize, sm.MaxQueueSize)
+
+	err = yaml.Unmarshal([]byte("{enabled: true, max_resume_timeout: 60, max_queue_size: 10}"), &sm)
+	require.Nil(t, err)
+	require.Equal(t, 60, sm.MaxResumeTimeout)
+	require.Equal(t, 10, sm.MaxQueueSize)
+
+	err = yaml.Unmarshal([]byte("{max_resume_timeout: -1}"), &sm)
+	require.NotNil(t, err)
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	rl := RateLimitConfig{}
+	err := yaml.Unmarshal([]byte("{stanzas_per_second: 20}"), &rl)
+	require.Nil(t, err)
+	require.Equal(t, 20, rl.StanzasPerSecond)
+	require.Equal(t, 20, rl.Burst)
+
+	err = yaml.Unmarshal([]byte("{stanzas_per_second: 20, burst: 50}"), &rl)
+	require.Nil(t, err)
+	require.Equal(t, 50, rl.Burst)
+
+	err = yaml.Unmarshal([]byte("{stanzas_per_second: -1}"), &rl)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{stanzas_per_second: 10, burst: -1}"), &rl)
+	require.NotNil(t, err)
+}
+
+func TestConnLimitConfig(t *testing.T) {
+	cl := ConnLimitConfig{}
+	err := yaml.Unmarshal([]byte("{accepts_per_second: 50, max_per_ip: 10}"), &cl)
+	require.Nil(t, err)
+	require.Equal(t, 50, cl.AcceptsPerSecond)
+	require.Equal(t, 10, cl.MaxPerIP)
+
+	err = yaml.Unmarshal([]byte("{accepts_per_second: -1}"), &cl)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{max_per_ip: -1}"), &cl)
+	require.NotNil(t, err)
+}
+
+func TestShutdownConfig(t *testing.T) {
+	sc := ShutdownConfig{}
+	err := yaml.Unmarshal([]byte("{see_other_host: xmpp2.jackal.im}"), &sc)
+	require.Nil(t, err)
+	require.Equal(t, "xmpp2.jackal.im", sc.SeeOtherHost)
+	require.Equal(t, time.Second*defaultShutdownDrainTimeout, sc.drainTimeout())
+
+	err = yaml.Unmarshal([]byte("{drain_timeout: 30}"), &sc)
+	require.Nil(t, err)
+	require.Equal(t, time.Second*30, sc.drainTimeout())
+
+	err = yaml.Unmarshal([]byte("{drain_timeout: -1}"), &sc)
+	require.NotNil(t, err)
+}
+
 func TestTransportConfig(t *testing.T) {
 	cfg := `
 type: socket
@@ -68,8 +212,62 @@ max_stanza_size: 8192
 	require.Equal(t, defaultTransportPort, tr.Port)
 	require.Equal(t, defaultTransportConnectTimeout, tr.ConnectTimeout)
 	require.Equal(t, defaultTransportKeepAlive, tr.KeepAlive)
+	require.Equal(t, 0, tr.IdleTimeout)
 	require.Equal(t, defaultTransportMaxStanzaSize, tr.MaxStanzaSize)
 
+	// websocket URL path
+	err = yaml.Unmarshal([]byte("{type: websocket, url_path: /xmpp-websocket, tls_offload: yes}"), &tr)
+	require.Nil(t, err)
+	require.Equal(t, transport.WebSocket, tr.Type)
+	require.Equal(t, "/xmpp-websocket", tr.URLPath)
+	require.True(t, tr.TLSOffload)
+
+	err = yaml.Unmarshal([]byte("{type: websocket, url_path: xmpp-websocket}"), &tr)
+	require.NotNil(t, err)
+
+	// idle timeout
+	err = yaml.Unmarshal([]byte("{type: socket, keep_alive: 120, idle_timeout: 60}"), &tr)
+	require.Nil(t, err)
+	require.Equal(t, 60, tr.IdleTimeout)
+
+	err = yaml.Unmarshal([]byte("{type: socket, keep_alive: 120, idle_timeout: 120}"), &tr)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{type: socket, idle_timeout: -1}"), &tr)
+	require.NotNil(t, err)
+
+	// BOSH max wait
+	err = yaml.Unmarshal([]byte("{type: bosh}"), &tr)
+	require.Nil(t, err)
+	require.Equal(t, transport.Bosh, tr.Type)
+	require.Equal(t, defaultTransportMaxWait, tr.MaxWait)
+
+	err = yaml.Unmarshal([]byte("{type: bosh, max_wait: 30}"), &tr)
+	require.Nil(t, err)
+	require.Equal(t, 30, tr.MaxWait)
+
+	err = yaml.Unmarshal([]byte("{type: bosh, max_wait: -1}"), &tr)
+	require.NotNil(t, err)
+
+	// socket buffers and send queue
+	err = yaml.Unmarshal([]byte("{type: socket}"), &tr)
+	require.Nil(t, err)
+	require.Equal(t, 0, tr.ReadBufferSize)
+	require.Equal(t, 0, tr.WriteBufferSize)
+	require.Equal(t, defaultTransportSendQueueSize, tr.SendQueueSize)
+
+	err = yaml.Unmarshal([]byte("{type: socket, read_buffer_size: 65536, write_buffer_size: 131072, send_queue_size: 256}"), &tr)
+	require.Nil(t, err)
+	require.Equal(t, 65536, tr.ReadBufferSize)
+	require.Equal(t, 131072, tr.WriteBufferSize)
+	require.Equal(t, 256, tr.SendQueueSize)
+
+	err = yaml.Unmarshal([]byte("{type: socket, write_buffer_size: -1}"), &tr)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{type: socket, send_queue_size: -1}"), &tr)
+	require.NotNil(t, err)
+
 	// invalid transport type
 	err = yaml.Unmarshal([]byte("{type: invalid}"), &tr)
 	require.NotNil(t, err)
@@ -84,8 +282,51 @@ func TestServerConfig(t *testing.T) {
 	err := yaml.Unmarshal([]byte("{id: default, type: c2s}"), &s)
 	require.Nil(t, err)
 
-	// s2s not yet supported...
+	// s2s server type...
 	err = yaml.Unmarshal([]byte("{id: default, type: s2s}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, S2SServerType, s.Type)
+
+	s2sCfg := `
+id: default
+type: s2s
+s2s:
+  dial_timeout: 5
+  idle_timeout: 60
+  max_dials: 2
+  ping_interval: 120
+  dialback:
+    require_tls: true
+    secret: s3cr3t
+  allow: ["*.example.com"]
+  deny: [evil.example.com]
+`
+	err = yaml.Unmarshal([]byte(s2sCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, 5, s.S2S.DialTimeout)
+	require.Equal(t, 60, s.S2S.IdleTimeout)
+	require.Equal(t, 2, s.S2S.MaxDials)
+	require.Equal(t, defaultS2SMaxBackoff, s.S2S.MaxBackoff)
+	require.Equal(t, 120, s.S2S.PingInterval)
+	require.Equal(t, defaultS2SPingFailures, s.S2S.PingFailures)
+	require.True(t, s.S2S.Dialback.RequireTLS)
+	require.Equal(t, "s3cr3t", s.S2S.Dialback.Secret)
+	require.Equal(t, []string{"*.example.com"}, s.S2S.Filter.Allow)
+	require.Equal(t, []string{"evil.example.com"}, s.S2S.Filter.Deny)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: s2s, s2s: {dial_timeout: -1}}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{id: default, type: s2s, s2s: {ping_interval: -1}}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{id: default, type: s2s, s2s: {idle_timeout: -1}}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{id: default, type: s2s, s2s: {max_dials: -1}}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{id: default, type: s2s, s2s: {deny: [\"*\"]}}"), &s)
+	require.NotNil(t, err)
+
+	// s2s requires socket transport...
+	err = yaml.Unmarshal([]byte("{id: default, type: s2s, transport: {type: websocket}}"), &s)
 	require.NotNil(t, err)
 
 	// resource conflict options...
@@ -95,10 +336,39 @@ func TestServerConfig(t *testing.T) {
 	err = yaml.Unmarshal([]byte("{id: default, type: c2s, resource_conflict: override}"), &s)
 	require.Nil(t, err)
 
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, resource_conflict: random_suffix}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, RandomSuffix, s.ResourceConflict)
+
+	// login message...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, login_message: {subject: Welcome, body: Welcome!}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, "Welcome", s.LoginMessage.Subject)
+	require.Equal(t, "Welcome!", s.LoginMessage.Body)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, login_message: {subject: Welcome}}"), &s)
+	require.NotNil(t, err)
+
 	// invalid resource conflict option...
 	err = yaml.Unmarshal([]byte("{id: default, type: c2s, resource_conflict: invalid}"), &s)
 	require.NotNil(t, err)
 
+	// resource generation options...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, UUIDResource, s.ResourceGeneration)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, resource_generation: counter}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, CounterResource, s.ResourceGeneration)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, resource_generation: hint}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, ClientHintResource, s.ResourceGeneration)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, resource_generation: invalid}"), &s)
+	require.NotNil(t, err)
+
 	// auth mechanisms...
 	authCfg := `
 id: default
@@ -113,6 +383,48 @@ sasl: [plain, digest_md5, scram_sha_1, scram_sha_256]
 	err = yaml.Unmarshal([]byte("{id: default, type: c2s, sasl: [invalid]}"), &s)
 	require.NotNil(t, err)
 
+	// anonymous auth mechanism...
+	anonymousCfg := `
+id: default
+type: c2s
+sasl: [plain, anonymous]
+sasl_anonymous:
+  domains: [guest.jackal.im]
+`
+	err = yaml.Unmarshal([]byte(anonymousCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, []string{"guest.jackal.im"}, s.SASLAnonymous.Domains)
+
+	// external auth mechanism...
+	externalCfg := `
+id: default
+type: c2s
+sasl: [external]
+sasl_external:
+  ca_path: /etc/jackal/ca.pem
+  require_domain_match: true
+`
+	err = yaml.Unmarshal([]byte(externalCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, "/etc/jackal/ca.pem", s.SASLExternal.CAFile)
+	require.True(t, s.SASLExternal.RequireDomainMatch)
+
+	// oauthbearer auth mechanism...
+	oauthCfg := `
+id: default
+type: c2s
+sasl: [oauthbearer]
+sasl_oauthbearer:
+  verifier: introspection
+  introspection_url: https://idp.jackal.im/introspect
+`
+	err = yaml.Unmarshal([]byte(oauthCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, IntrospectionVerifier, s.SASLOAuthBearer.Verifier)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, sasl: [oauthbearer]}"), &s)
+	require.NotNil(t, err)
+
 	// server modules...
 	modulesCfg := `
 id: default
@@ -126,6 +438,14 @@ modules: [roster, private, vcard, registration, version, ping, offline]
 	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [invalid]}"), &s)
 	require.NotNil(t, err)
 
+	// upload module requires storage settings
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [upload], mod_upload: {base_url: 'https://jackal.im:5443'}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [upload], mod_upload: {base_url: 'https://jackal.im:5443', storage_path: /tmp, secret: s}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, "/tmp", s.ModUpload.StoragePath)
+
 	// invalid type
 	err = yaml.Unmarshal([]byte("{id: default, type: invalid}"), &s)
 	require.NotNil(t, err)
@@ -134,3 +454,59 @@ modules: [roster, private, vcard, registration, version, ping, offline]
 	err = yaml.Unmarshal([]byte("type"), &s)
 	require.NotNil(t, err)
 }
+
+func TestValidateListeners(t *testing.T) {
+	var cfgs []Config
+	b := []byte(`
+- id: admin
+  type: c2s
+  transport:
+    bind_addr: 127.0.0.1
+    port: 5223
+  tls:
+    starttls: disabled
+  sasl: [plain]
+- id: public
+  type: c2s
+  transport:
+    port: 5222
+  tls:
+    starttls: required
+  sasl: [scram_sha_256]
+  rate_limit:
+    stanzas_per_second: 10
+  modules: [registration]
+  mod_registration:
+    allow_registration: true
+    require_tls: true
+`)
+	err := yaml.Unmarshal(b, &cfgs)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(cfgs))
+	require.Equal(t, StartTLSDisabled, cfgs[0].TLS.StartTLS)
+	require.Equal(t, []string{"plain"}, cfgs[0].SASL)
+	require.Equal(t, 10, cfgs[1].RateLimit.StanzasPerSecond)
+	require.Nil(t, ValidateListeners(cfgs))
+
+	// no secure listener to register over...
+	cfgs[1].TLS.StartTLS = StartTLSDisabled
+	require.NotNil(t, ValidateListeners(cfgs))
+
+	// WebSocket streams are always secured...
+	cfgs[1].Transport.Type = transport.WebSocket
+	require.Nil(t, ValidateListeners(cfgs))
+	cfgs[1].Transport.Type = transport.Socket
+	cfgs[1].TLS.StartTLS = StartTLSOptional
+
+	// duplicated identifiers...
+	cfgs[1].ID = "admin"
+	require.NotNil(t, ValidateListeners(cfgs))
+	cfgs[1].ID = "public"
+
+	// overlapping addresses...
+	cfgs[1].Transport.Port = 5223
+	require.NotNil(t, ValidateListeners(cfgs))
+
+	cfgs[1].Transport.BindAddress = "192.168.0.1"
+	require.Nil(t, ValidateListeners(cfgs))
+}
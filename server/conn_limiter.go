@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/server/transport"
+)
+
+// connLimiter limits the rate at which a listener accepts new connections
+// and the number of concurrent connections per source IP.
+// It's safe for concurrent use.
+type connLimiter struct {
+	mu       sync.Mutex
+	rl       *rateLimiter // nil if accept rate is not limited
+	maxPerIP int
+	conns    map[string]int
+}
+
+func newConnLimiter(cfg *ConnLimitConfig) *connLimiter {
+	l := &connLimiter{
+		maxPerIP: cfg.MaxPerIP,
+		conns:    make(map[string]int),
+	}
+	if cfg.AcceptsPerSecond > 0 {
+		l.rl = newRateLimiter(cfg.AcceptsPerSecond, cfg.AcceptsPerSecond)
+	}
+	return l
+}
+
+// acquire registers a new connection coming from remoteAddr,
+// returning false if any of the limits has been reached.
+func (l *connLimiter) acquire(remoteAddr string, now time.Time) bool {
+	ip := remoteIP(remoteAddr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxPerIP > 0 && l.conns[ip] >= l.maxPerIP {
+		return false
+	}
+	if l.rl != nil && !l.rl.allow(now) {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+// release unregisters a connection previously acquired from remoteAddr.
+func (l *connLimiter) release(remoteAddr string) {
+	ip := remoteIP(remoteAddr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
+
+// limitedTransport releases its connection limiter slot once closed.
+type limitedTransport struct {
+	transport.Transport
+	once    sync.Once
+	release func()
+}
+
+func (t *limitedTransport) Close() error {
+	t.once.Do(t.release)
+	return t.Transport.Close()
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
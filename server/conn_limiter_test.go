@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnLimiter_MaxPerIP(t *testing.T) {
+	l := newConnLimiter(&ConnLimitConfig{MaxPerIP: 2})
+
+	now := time.Now()
+	require.True(t, l.acquire("77.230.105.223:5222", now))
+	require.True(t, l.acquire("77.230.105.223:5223", now))
+	require.False(t, l.acquire("77.230.105.223:5224", now))
+	require.True(t, l.acquire("[::1]:5222", now))
+
+	l.release("77.230.105.223:5222")
+	require.True(t, l.acquire("77.230.105.223:5225", now))
+
+	// released addresses are cleaned up
+	l.release("[::1]:5222")
+	l.release("77.230.105.223:5223")
+	l.release("77.230.105.223:5225")
+	require.Equal(t, 0, len(l.conns))
+}
+
+func TestConnLimiter_AcceptRate(t *testing.T) {
+	l := newConnLimiter(&ConnLimitConfig{AcceptsPerSecond: 2})
+
+	now := time.Now()
+	require.True(t, l.acquire("77.230.105.223:5222", now))
+	require.True(t, l.acquire("77.230.105.224:5222", now))
+	require.False(t, l.acquire("77.230.105.225:5222", now))
+	require.Equal(t, 2, len(l.conns))
+
+	now = now.Add(time.Millisecond * 500)
+	require.True(t, l.acquire("77.230.105.225:5222", now))
+
+	// unlimited
+	l = newConnLimiter(&ConnLimitConfig{})
+	for i := 0; i < 100; i++ {
+		require.True(t, l.acquire("77.230.105.223:5222", now))
+	}
+}
+
+func TestConnLimiter_Transport(t *testing.T) {
+	l := newConnLimiter(&ConnLimitConfig{MaxPerIP: 1})
+
+	conn := transport.NewMockConn()
+	remoteAddr := conn.RemoteAddr().String()
+	require.True(t, l.acquire(remoteAddr, time.Now()))
+
+	tr := &limitedTransport{
+		Transport: transport.NewSocketTransport(conn, 4096, 0),
+		release:   func() { l.release(remoteAddr) },
+	}
+	require.False(t, l.acquire(remoteAddr, time.Now()))
+
+	tr.Close()
+	require.Equal(t, 0, len(l.conns))
+	require.True(t, l.acquire(remoteAddr, time.Now()))
+}
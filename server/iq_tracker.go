@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"time"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+// iqTracker correlates server originated IQs with their responses.
+// It's not safe for concurrent use.
+type iqTracker struct {
+	pending map[string]*trackedIQ
+}
+
+type trackedIQ struct {
+	handler c2s.IQResultHandler
+	tm      *time.Timer
+}
+
+func newIQTracker() *iqTracker {
+	return &iqTracker{pending: make(map[string]*trackedIQ)}
+}
+
+// track registers a pending IQ response handler.
+// tm, if not nil, is the IQ timeout timer, stopped once the response arrives.
+func (t *iqTracker) track(id string, handler c2s.IQResultHandler, tm *time.Timer) {
+	if prev, ok := t.pending[id]; ok && prev.tm != nil {
+		prev.tm.Stop()
+	}
+	t.pending[id] = &trackedIQ{handler: handler, tm: tm}
+}
+
+// resolve routes a result or error IQ to its pending handler,
+// returning false if it's not a response to a tracked IQ.
+func (t *iqTracker) resolve(iq *xml.IQ) bool {
+	if !iq.IsResult() && iq.Type() != xml.ErrorType {
+		return false
+	}
+	p, ok := t.pending[iq.ID()]
+	if !ok {
+		return false
+	}
+	delete(t.pending, iq.ID())
+	if p.tm != nil {
+		p.tm.Stop()
+	}
+	p.handler(iq, nil)
+	return true
+}
+
+// expire fires a timeout error on a still pending IQ handler.
+func (t *iqTracker) expire(id string) {
+	p, ok := t.pending[id]
+	if !ok {
+		return // already resolved
+	}
+	delete(t.pending, id)
+	p.handler(nil, c2s.ErrIQTimeout)
+}
+
+// reset discards every pending IQ, stopping its timeout timer.
+func (t *iqTracker) reset() {
+	for id, p := range t.pending {
+		if p.tm != nil {
+			p.tm.Stop()
+		}
+		delete(t.pending, id)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIQTracker(t *testing.T) {
+	tr := newIQTracker()
+
+	var resp *xml.IQ
+	var respErr error
+	handler := func(iq *xml.IQ, err error) { resp, respErr = iq, err }
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	tm := time.NewTimer(time.Minute)
+	tr.track(iq.ID(), handler, tm)
+
+	// requests are not responses
+	require.False(t, tr.resolve(xml.NewIQType(iq.ID(), xml.GetType)))
+	require.False(t, tr.resolve(xml.NewIQType(uuid.New(), xml.ResultType)))
+
+	require.True(t, tr.resolve(iq.ResultIQ()))
+	require.Equal(t, iq.ID(), resp.ID())
+	require.Nil(t, respErr)
+	require.False(t, tm.Stop()) // already stopped
+	require.False(t, tr.resolve(iq.ResultIQ()))
+
+	// timeout
+	resp = nil
+	iq = xml.NewIQType(uuid.New(), xml.GetType)
+	tr.track(iq.ID(), handler, nil)
+	tr.expire(iq.ID())
+	require.Nil(t, resp)
+	require.Equal(t, c2s.ErrIQTimeout, respErr)
+	require.False(t, tr.resolve(iq.ResultIQ()))
+
+	// reset
+	tr.track(uuid.New(), handler, nil)
+	tr.reset()
+	require.Equal(t, 0, len(tr.pending))
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"github.com/ortuman/jackal/module"
+	"github.com/ortuman/jackal/module/offline"
+	"github.com/ortuman/jackal/module/roster"
+	"github.com/ortuman/jackal/module/xep0012"
+	"github.com/ortuman/jackal/module/xep0016"
+	"github.com/ortuman/jackal/module/xep0030"
+	"github.com/ortuman/jackal/module/xep0049"
+	"github.com/ortuman/jackal/module/xep0050"
+	"github.com/ortuman/jackal/module/xep0054"
+	"github.com/ortuman/jackal/module/xep0077"
+	"github.com/ortuman/jackal/module/xep0078"
+	"github.com/ortuman/jackal/module/xep0085"
+	"github.com/ortuman/jackal/module/xep0092"
+	"github.com/ortuman/jackal/module/xep0115"
+	"github.com/ortuman/jackal/module/xep0133"
+	"github.com/ortuman/jackal/module/xep0163"
+	"github.com/ortuman/jackal/module/xep0184"
+	"github.com/ortuman/jackal/module/xep0191"
+	"github.com/ortuman/jackal/module/xep0199"
+	"github.com/ortuman/jackal/module/xep0202"
+	"github.com/ortuman/jackal/module/xep0280"
+	"github.com/ortuman/jackal/module/xep0313"
+	"github.com/ortuman/jackal/module/xep0333"
+	"github.com/ortuman/jackal/module/xep0352"
+	"github.com/ortuman/jackal/module/xep0357"
+	"github.com/ortuman/jackal/module/xep0363"
+	"github.com/ortuman/jackal/stream/c2s"
+)
+
+func init() {
+	// Roster (https://xmpp.org/rfcs/rfc3921.html#roster)
+	module.Register("roster", func(stm c2s.Stream) module.Module {
+		return roster.New(stm.(*c2sStream).rosterConfig(), stm)
+	})
+	// XEP-0012: Last Activity (https://xmpp.org/extensions/xep-0012.html)
+	module.Register("last_activity", func(stm c2s.Stream) module.Module {
+		return xep0012.New(stm)
+	})
+	// XEP-0016: Privacy Lists (https://xmpp.org/extensions/xep-0016.html)
+	module.Register("privacy", func(stm c2s.Stream) module.Module {
+		return xep0016.New(stm)
+	})
+	// XEP-0030: Service Discovery (https://xmpp.org/extensions/xep-0030.html)
+	module.Register("disco", func(stm c2s.Stream) module.Module {
+		return xep0030.New(stm)
+	})
+	// XEP-0049: Private XML Storage (https://xmpp.org/extensions/xep-0049.html)
+	module.Register("private", func(stm c2s.Stream) module.Module {
+		return xep0049.New(&streamConfig(stm).ModPrivate, stm)
+	})
+	// XEP-0050: Ad-Hoc Commands (https://xmpp.org/extensions/xep-0050.html)
+	// XEP-0133: Service Administration (https://xmpp.org/extensions/xep-0133.html)
+	module.Register("admin", func(stm c2s.Stream) module.Module {
+		adHoc := xep0050.New(stm)
+		for _, cmd := range xep0133.Commands(&streamConfig(stm).ModAdmin) {
+			adHoc.RegisterCommand(cmd)
+		}
+		return adHoc
+	})
+	// XEP-0054: vcard-temp (https://xmpp.org/extensions/xep-0054.html)
+	module.Register("vcard", func(stm c2s.Stream) module.Module {
+		return xep0054.New(stm)
+	})
+	// XEP-0077: In-band registration (https://xmpp.org/extensions/xep-0077.html)
+	module.Register("registration", func(stm c2s.Stream) module.Module {
+		return xep0077.New(stm.(*c2sStream).registrationConfig(), stm)
+	})
+	// XEP-0078: Non-SASL Authentication (https://xmpp.org/extensions/xep-0078.html)
+	module.Register("legacy_auth", func(stm c2s.Stream) module.Module {
+		return xep0078.New(stm)
+	})
+	// XEP-0085: Chat State Notifications (https://xmpp.org/extensions/xep-0085.html)
+	module.Register("chat_states", func(stm c2s.Stream) module.Module {
+		return xep0085.New(stm)
+	})
+	// XEP-0092: Software Version (https://xmpp.org/extensions/xep-0092.html)
+	module.Register("version", func(stm c2s.Stream) module.Module {
+		return xep0092.New(&streamConfig(stm).ModVersion, stm)
+	})
+	// XEP-0115: Entity Capabilities (https://xmpp.org/extensions/xep-0115.html)
+	module.Register("caps", func(stm c2s.Stream) module.Module {
+		return xep0115.New(stm)
+	})
+	// XEP-0163: Personal Eventing Protocol (https://xmpp.org/extensions/xep-0163.html)
+	module.Register("pep", func(stm c2s.Stream) module.Module {
+		return xep0163.New(stm)
+	})
+	// XEP-0184: Message Delivery Receipts (https://xmpp.org/extensions/xep-0184.html)
+	module.Register("receipts", func(stm c2s.Stream) module.Module {
+		return xep0184.New(&streamConfig(stm).ModReceipts, stm)
+	})
+	// XEP-0191: Blocking Command (https://xmpp.org/extensions/xep-0191.html)
+	module.Register("blocking_command", func(stm c2s.Stream) module.Module {
+		return xep0191.New(&streamConfig(stm).ModBlocking, stm)
+	})
+	// XEP-0199: XMPP Ping (https://xmpp.org/extensions/xep-0199.html)
+	module.Register("ping", func(stm c2s.Stream) module.Module {
+		return xep0199.New(&streamConfig(stm).ModPing, stm)
+	})
+	// XEP-0202: Entity Time (https://xmpp.org/extensions/xep-0202.html)
+	module.Register("time", func(stm c2s.Stream) module.Module {
+		return xep0202.New(stm)
+	})
+	// XEP-0280: Message Carbons (https://xmpp.org/extensions/xep-0280.html)
+	module.Register("carbons", func(stm c2s.Stream) module.Module {
+		return xep0280.New(stm)
+	})
+	// XEP-0313: Message Archive Management (https://xmpp.org/extensions/xep-0313.html)
+	module.Register("mam", func(stm c2s.Stream) module.Module {
+		return xep0313.New(&streamConfig(stm).ModMam, stm)
+	})
+	// XEP-0333: Chat Markers (https://xmpp.org/extensions/xep-0333.html)
+	module.Register("chat_markers", func(stm c2s.Stream) module.Module {
+		return xep0333.New(stm)
+	})
+	// XEP-0352: Client State Indication (https://xmpp.org/extensions/xep-0352.html)
+	module.Register("csi", func(stm c2s.Stream) module.Module {
+		return xep0352.New(&streamConfig(stm).ModCsi, stm)
+	})
+	// XEP-0357: Push Notifications (https://xmpp.org/extensions/xep-0357.html)
+	module.Register("push", func(stm c2s.Stream) module.Module {
+		return xep0357.New(&streamConfig(stm).ModPush, stm)
+	})
+	// XEP-0363: HTTP File Upload (https://xmpp.org/extensions/xep-0363.html)
+	module.Register("upload", func(stm c2s.Stream) module.Module {
+		return xep0363.New(&streamConfig(stm).ModUpload, stm)
+	})
+	// XEP-0160: Offline message storage (https://xmpp.org/extensions/xep-0160.html)
+	module.Register("offline", func(stm c2s.Stream) module.Module {
+		return offline.New(&streamConfig(stm).ModOffline, stm)
+	})
+}
+
+// streamConfig returns the server configuration of a module's stream.
+func streamConfig(stm c2s.Stream) *Config {
+	return stm.(*c2sStream).cfg
+}
+
+// isCoreModule returns whether or not a module is always
+// instantiated, regardless of configuration.
+func isCoreModule(name string) bool {
+	return name == "roster" || name == "disco"
+}
+
+func isModuleAvailable(name string) bool {
+	if name == "disco" {
+		return false // not configurable
+	}
+	return module.IsRegistered(name)
+}
@@ -0,0 +1,380 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register SHA-256 and SHA-384 hashes
+	_ "crypto/sha512" // register SHA-512 hash
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const oauthRequestTimeout = time.Second * 5
+
+const maxOAuthCacheSize = 4096
+
+var errOAuthInvalidToken = errors.New("oauth: invalid token")
+
+// tokenVerifier validates an OAuth 2.0 bearer token, returning its claims.
+// errOAuthInvalidToken is returned whenever the token has been rejected.
+type tokenVerifier interface {
+	verify(token string) (map[string]interface{}, error)
+}
+
+// token verifiers shared across streams, keyed by configuration
+var (
+	oauthVerifiersMu sync.Mutex
+	oauthVerifiers   = make(map[*SASLOAuthBearerConfig]tokenVerifier)
+)
+
+// oauthVerifier returns the caching token verifier associated to cfg.
+func oauthVerifier(cfg *SASLOAuthBearerConfig) tokenVerifier {
+	oauthVerifiersMu.Lock()
+	defer oauthVerifiersMu.Unlock()
+	if v := oauthVerifiers[cfg]; v != nil {
+		return v
+	}
+	client := &http.Client{Timeout: oauthRequestTimeout}
+	ttl := time.Second * time.Duration(cfg.CacheTTL)
+
+	var v tokenVerifier
+	switch cfg.Verifier {
+	case JWKSVerifier:
+		v = &jwksVerifier{cfg: cfg, client: client, refreshInterval: ttl}
+	default:
+		v = &introspectionVerifier{cfg: cfg, client: client}
+	}
+	v = newCachedTokenVerifier(v, ttl)
+	oauthVerifiers[cfg] = v
+	return v
+}
+
+type tokenCacheEntry struct {
+	claims    map[string]interface{}
+	err       error
+	expiresAt time.Time
+}
+
+// cachedTokenVerifier caches validation results, either successful or not,
+// during a while in order to avoid querying the identity provider for every login.
+type cachedTokenVerifier struct {
+	v   tokenVerifier
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*tokenCacheEntry
+}
+
+func newCachedTokenVerifier(v tokenVerifier, ttl time.Duration) *cachedTokenVerifier {
+	return &cachedTokenVerifier{v: v, ttl: ttl, entries: make(map[string]*tokenCacheEntry)}
+}
+
+func (c *cachedTokenVerifier) verify(token string) (map[string]interface{}, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e := c.entries[token]
+	c.mu.Unlock()
+	if e != nil && now.Before(e.expiresAt) {
+		return e.claims, e.err
+	}
+	claims, err := c.v.verify(token)
+	if err != nil && err != errOAuthInvalidToken {
+		return nil, err // don't cache transient failures
+	}
+	e = &tokenCacheEntry{claims: claims, err: err, expiresAt: now.Add(c.ttl)}
+	if exp, ok := numericClaim(claims, "exp"); ok && time.Unix(exp, 0).Before(e.expiresAt) {
+		e.expiresAt = time.Unix(exp, 0)
+	}
+	c.mu.Lock()
+	if len(c.entries) >= maxOAuthCacheSize {
+		for k, ce := range c.entries {
+			if !now.Before(ce.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) < maxOAuthCacheSize {
+		c.entries[token] = e
+	}
+	c.mu.Unlock()
+	return claims, err
+}
+
+// introspectionVerifier validates tokens against an RFC 7662 token introspection endpoint.
+type introspectionVerifier struct {
+	cfg    *SASLOAuthBearerConfig
+	client *http.Client
+}
+
+func (v *introspectionVerifier) verify(token string) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequest(http.MethodPost, v.cfg.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(v.cfg.ClientID) > 0 {
+		req.SetBasicAuth(v.cfg.ClientID, v.cfg.ClientSecret)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth: introspection endpoint response status: %d", resp.StatusCode)
+	}
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errOAuthInvalidToken
+	}
+	if exp, ok := numericClaim(claims, "exp"); ok && time.Now().Unix() >= exp {
+		return nil, errOAuthInvalidToken
+	}
+	return claims, nil
+}
+
+// jwksVerifier validates JWT tokens signed with any of the keys
+// published by the identity provider at a JWKS URL.
+type jwksVerifier struct {
+	cfg             *SASLOAuthBearerConfig
+	client          *http.Client
+	refreshInterval time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (v *jwksVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errOAuthInvalidToken
+	}
+	var hdr jwtHeader
+	if err := decodeJWTSegment(parts[0], &hdr); err != nil {
+		return nil, errOAuthInvalidToken
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, errOAuthInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errOAuthInvalidToken
+	}
+	key, err := v.key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errOAuthInvalidToken
+	}
+	if !verifyJWTSignature(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errOAuthInvalidToken
+	}
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *jwksVerifier) validateClaims(claims map[string]interface{}) error {
+	now := time.Now().Unix()
+	exp, ok := numericClaim(claims, "exp")
+	if !ok || now >= exp {
+		return errOAuthInvalidToken
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now < nbf {
+		return errOAuthInvalidToken
+	}
+	if len(v.cfg.Issuer) > 0 {
+		if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+			return errOAuthInvalidToken
+		}
+	}
+	if len(v.cfg.Audience) > 0 {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud == v.cfg.Audience {
+				return nil
+			}
+		case []interface{}:
+			for _, a := range aud {
+				if a == v.cfg.Audience {
+					return nil
+				}
+			}
+		}
+		return errOAuthInvalidToken
+	}
+	return nil
+}
+
+// key returns the signing key identified by kid, refreshing published keys
+// whenever it's not known (at most once per refresh interval).
+func (v *jwksVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if v.keys != nil && time.Since(v.fetchedAt) < v.refreshInterval {
+		return nil, nil
+	}
+	keys, err := v.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.fetchedAt = time.Now()
+	return v.keys[kid], nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (v *jwksVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	resp, err := v.client.Get(v.cfg.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth: jwks endpoint response status: %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		if key := k.publicKey(); key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() crypto.PublicKey {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	return nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "ES384":
+		h = crypto.SHA384
+	case "RS512", "ES512":
+		h = crypto.SHA512
+	default:
+		return false // unsigned or unsupported algorithm
+	}
+	hasher := h.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg[0] == 'R' && rsa.VerifyPKCS1v15(k, h, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+func decodeJWTSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	switch n := claims[name].(type) {
+	case float64:
+		return int64(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
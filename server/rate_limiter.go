@@ -0,0 +1,41 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import "time"
+
+// rateLimiter implements a token bucket rate limiter.
+// It's not safe for concurrent use.
+type rateLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// allow consumes a token returning false if the bucket is empty.
+func (rl *rateLimiter) allow(now time.Time) bool {
+	if !rl.last.IsZero() {
+		rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+		if rl.tokens > rl.burst {
+			rl.tokens = rl.burst
+		}
+	}
+	rl.last = now
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
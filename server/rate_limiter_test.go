@@ -0,0 +1,35 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(10, 3)
+
+	now := time.Now()
+	require.True(t, rl.allow(now))
+	require.True(t, rl.allow(now))
+	require.True(t, rl.allow(now))
+	require.False(t, rl.allow(now))
+
+	// a token is refilled every 100ms
+	now = now.Add(time.Millisecond * 100)
+	require.True(t, rl.allow(now))
+	require.False(t, rl.allow(now))
+
+	// bucket never exceeds its burst size
+	now = now.Add(time.Second * 10)
+	for i := 0; i < 3; i++ {
+		require.True(t, rl.allow(now))
+	}
+	require.False(t, rl.allow(now))
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module/offline"
+	"github.com/ortuman/jackal/module/xep0313"
+	"github.com/ortuman/jackal/module/xep0357"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+)
+
+const defaultS2SPort = 5269
+
+const (
+	jabberServerNamespace    = "jabber:server"
+	dialbackNamespace        = "jabber:server:dialback"
+	dialbackFeatureNamespace = "urn:xmpp:features:dialback"
+	pingNamespace            = "urn:xmpp:ping"
+)
+
+var errS2SServiceNotAvailable = errors.New("s2s: remote domain does not offer xmpp-server service")
+
+// s2sDial connects to a remote domain XMPP server resolving
+// its '_xmpp-server._tcp' SRV record (RFC 6120, section 3.2).
+var s2sDial = func(domain string, timeout time.Duration) (net.Conn, error) {
+	_, addrs, err := net.LookupSRV("xmpp-server", "tcp", domain)
+	if err == nil {
+		if len(addrs) == 1 && addrs[0].Target == "." {
+			return nil, errS2SServiceNotAvailable
+		}
+		for _, addr := range addrs {
+			target := strings.TrimSuffix(addr.Target, ".")
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(target, strconv.Itoa(int(addr.Port))), timeout)
+			if err == nil {
+				return conn, nil
+			}
+			log.Error(err)
+		}
+	}
+	// fallback to domain A/AAAA records
+	return net.DialTimeout("tcp", net.JoinHostPort(domain, strconv.Itoa(defaultS2SPort)), timeout)
+}
+
+// verifyPeerCertificates reports whether a certificate chain
+// has been issued for a given domain by a trusted authority.
+func verifyPeerCertificates(certs []*x509.Certificate, domain string) bool {
+	if len(certs) == 0 || len(domain) == 0 {
+		return false
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       domain,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err == nil
+}
+
+// buildServerStanza builds a stanza received over a server-to-server stream.
+// Unlike client streams, both 'from' and 'to' addresses are mandatory.
+func buildServerStanza(elem xml.XElement) (xml.Stanza, error) {
+	if ns := elem.Namespace(); len(ns) > 0 && ns != jabberServerNamespace {
+		return nil, streamerror.ErrInvalidNamespace
+	}
+	if len(elem.From()) == 0 || len(elem.To()) == 0 {
+		return nil, streamerror.ErrImproperAddressing
+	}
+	fromJID, err := xml.NewJIDString(elem.From(), false)
+	if err != nil {
+		return nil, xml.ErrJidMalformed
+	}
+	toJID, err := xml.NewJIDString(elem.To(), false)
+	if err != nil {
+		return nil, xml.ErrJidMalformed
+	}
+	stanza, err := newStanza(elem, fromJID, toJID)
+	if err != nil {
+		log.Error(err)
+		return nil, xml.ErrBadRequest
+	}
+	return stanza, nil
+}
+
+// bounceStanza routes back an error copy of a stanza to its sender.
+func bounceStanza(stanza xml.Stanza, stanzaErr error) {
+	if stanza.Type() == xml.ErrorType {
+		return // never bounce errors
+	}
+	if iq, ok := stanza.(*xml.IQ); ok && !iq.IsGet() && !iq.IsSet() {
+		return
+	}
+	errElem := xml.NewErrorElementFromElement(stanza, stanzaErr.(*xml.StanzaError), nil)
+	resp, err := newStanza(errElem, stanza.ToJID(), stanza.FromJID())
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	c2s.Instance().Route(resp)
+}
+
+// storeOfflineMessage stores a message addressed to an unavailable local user
+// the same way a locally sent one would be, bouncing it if offline storage is not enabled.
+func storeOfflineMessage(cfg *Config, message *xml.Message) {
+	if _, ok := cfg.Modules["offline"]; !ok {
+		bounceStanza(message, xml.ErrServiceUnavailable)
+		return
+	}
+	if _, ok := cfg.Modules["mam"]; ok {
+		if err := xep0313.ArchiveReceivedMessage(message); err != nil {
+			log.Error(err)
+		}
+	}
+	switch err := offline.StoreMessage(&cfg.ModOffline, message); err {
+	case nil:
+		break
+	case offline.ErrQueueFull:
+		bounceStanza(message, xml.ErrServiceUnavailable)
+		return
+	default:
+		log.Error(err)
+		return
+	}
+	if _, ok := cfg.Modules["push"]; ok {
+		xep0357.NotifyRemoteMessage(&cfg.ModPush, message)
+	}
+}
+
+func newStanza(elem xml.XElement, fromJID, toJID *xml.JID) (xml.Stanza, error) {
+	switch elem.Name() {
+	case "iq":
+		iq, err := xml.NewIQFromElement(elem, fromJID, toJID)
+		if err != nil {
+			return nil, err
+		}
+		return iq, nil
+	case "presence":
+		presence, err := xml.NewPresenceFromElement(elem, fromJID, toJID)
+		if err != nil {
+			return nil, err
+		}
+		return presence, nil
+	case "message":
+		message, err := xml.NewMessageFromElement(elem, fromJID, toJID)
+		if err != nil {
+			return nil, err
+		}
+		return message, nil
+	}
+	return nil, streamerror.ErrUnsupportedStanzaType
+}
@@ -0,0 +1,631 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortuman/jackal/host"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module/roster"
+	"github.com/ortuman/jackal/router"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/stream/s2s"
+	"github.com/ortuman/jackal/util"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+type s2sInStream struct {
+	cfg           *Config
+	tr            transport.Transport
+	id            string
+	streamID      string
+	connected     uint32
+	state         uint32
+	localDomain   string
+	remoteDomain  string
+	secured       bool
+	authenticated map[string]bool
+	verifying     map[string]bool
+	actorCh       chan func()
+	doneCh        chan struct{}
+}
+
+func newS2SInStream(id string, tr transport.Transport, cfg *Config) *s2sInStream {
+	s := &s2sInStream{
+		cfg:           cfg,
+		id:            id,
+		tr:            tr,
+		state:         connecting,
+		authenticated: make(map[string]bool),
+		verifying:     make(map[string]bool),
+		actorCh:       make(chan func(), streamMailboxSize),
+		doneCh:        make(chan struct{}),
+	}
+	if cfg.Transport.ConnectTimeout > 0 {
+		go s.startConnectTimeoutTimer(cfg.Transport.ConnectTimeout)
+	}
+	go s.actorLoop()
+	go s.doRead() // start reading transport...
+
+	return s
+}
+
+// ID returns stream identifier.
+func (s *s2sInStream) ID() string {
+	return s.id
+}
+
+// Disconnect disconnects remote peer by closing
+// the underlying TCP socket connection.
+func (s *s2sInStream) Disconnect(err error) {
+	s.postActor(func() {
+		s.disconnect(err)
+	})
+}
+
+func (s *s2sInStream) postActor(f func()) {
+	select {
+	case s.actorCh <- f:
+	case <-s.doneCh:
+		break // already disconnected...
+	}
+}
+
+func (s *s2sInStream) startConnectTimeoutTimer(timeoutInSeconds int) {
+	tr := time.NewTimer(time.Second * time.Duration(timeoutInSeconds))
+	<-tr.C
+	if atomic.LoadUint32(&s.connected) == 0 {
+		// connection timeout...
+		s.postActor(func() {
+			s.disconnect(streamerror.ErrConnectionTimeout)
+		})
+	}
+}
+
+func (s *s2sInStream) handleElement(elem xml.XElement) {
+	switch s.getState() {
+	case connecting:
+		s.handleConnecting(elem)
+	case connected:
+		s.handleConnected(elem)
+	default:
+		break
+	}
+}
+
+func (s *s2sInStream) handleConnecting(elem xml.XElement) {
+	// activate 'connected' flag
+	atomic.StoreUint32(&s.connected, 1)
+
+	// validate stream element
+	if err := s.validateStreamElement(elem); err != nil {
+		s.disconnectWithStreamError(err)
+		return
+	}
+	// 'from' attribute is optional on legacy streams
+	if len(elem.From()) > 0 && !s.isAllowedDomain(elem.To(), elem.From()) {
+		s.disconnectWithStreamError(streamerror.ErrPolicyViolation)
+		return
+	}
+	s.localDomain = elem.To()
+	s.remoteDomain = elem.From()
+
+	// open stream
+	s.openStream()
+
+	// legacy dialback peers don't expect stream features
+	if elem.Version() == "1.0" {
+		features := xml.NewElementName("stream:features")
+		features.SetAttribute("xmlns:stream", streamNamespace)
+		features.SetAttribute("version", "1.0")
+
+		if !s.secured {
+			if s.startTLSPolicy() != StartTLSDisabled {
+				startTLS := xml.NewElementNamespace("starttls", tlsNamespace)
+				if s.startTLSPolicy() == StartTLSRequired {
+					startTLS.AppendElement(xml.NewElementName("required"))
+				}
+				features.AppendElement(startTLS)
+			}
+		} else if s.isExternalAuthAllowed(s.remoteDomain) {
+			mechanisms := xml.NewElementNamespace("mechanisms", saslNamespace)
+			mechanism := xml.NewElementName("mechanism")
+			mechanism.SetText("EXTERNAL")
+			mechanisms.AppendElement(mechanism)
+			features.AppendElement(mechanisms)
+		}
+		if s.isDialbackAllowed() {
+			dialback := xml.NewElementNamespace("dialback", dialbackFeatureNamespace)
+			dialback.AppendElement(xml.NewElementName("errors"))
+			features.AppendElement(dialback)
+		}
+		s.writeElement(features)
+	}
+	s.setState(connected)
+}
+
+func (s *s2sInStream) handleConnected(elem xml.XElement) {
+	switch elem.Name() {
+	case "starttls":
+		if len(elem.Namespace()) > 0 && elem.Namespace() != tlsNamespace {
+			s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
+			return
+		}
+		if s.startTLSPolicy() == StartTLSDisabled {
+			s.writeElement(xml.NewElementNamespace("failure", tlsNamespace))
+			s.disconnectClosingStream(true)
+			return
+		}
+		s.proceedStartTLS()
+
+	case "auth":
+		if elem.Namespace() != saslNamespace {
+			s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
+			return
+		}
+		if s.isTLSRequired() {
+			s.disconnectWithStreamError(streamerror.ErrPolicyViolation)
+			return
+		}
+		s.authenticateExternal(elem)
+
+	case "db:result":
+		s.processDialbackResult(elem)
+
+	case "db:verify":
+		s.processDialbackVerify(elem)
+
+	case "iq", "presence", "message":
+		s.processStanzaElement(elem)
+
+	default:
+		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+	}
+}
+
+func (s *s2sInStream) proceedStartTLS() {
+	if s.secured {
+		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		return
+	}
+	tlsCfg, err := util.LoadCertificate(s.cfg.TLS.PrivKeyFile, s.cfg.TLS.CertFile, s.localDomain)
+	if err != nil {
+		log.Error(err)
+		s.writeElement(xml.NewElementNamespace("failure", tlsNamespace))
+		s.disconnectClosingStream(true)
+		return
+	}
+	// ask for a peer certificate in order to offer SASL EXTERNAL
+	tlsCfg.ClientAuth = tls.RequestClientCert
+
+	s.secured = true
+
+	s.writeElement(xml.NewElementNamespace("proceed", tlsNamespace))
+
+	s.tr.StartTLS(s.cfg.TLS.apply(tlsCfg))
+
+	log.Infof("secured s2s stream... id: %s", s.id)
+
+	s.restart()
+}
+
+func (s *s2sInStream) authenticateExternal(elem xml.XElement) {
+	domain := s.remoteDomain
+	if authzID, err := base64.StdEncoding.DecodeString(elem.Text()); err == nil && len(authzID) > 0 {
+		domain = string(authzID)
+	}
+	if elem.Attributes().Get("mechanism") != "EXTERNAL" || !s.isExternalAuthAllowed(domain) {
+		failure := xml.NewElementNamespace("failure", saslNamespace)
+		failure.AppendElement(xml.NewElementName("not-authorized"))
+		s.writeElement(failure)
+		s.disconnectClosingStream(true)
+		return
+	}
+	if !s.isAllowedDomain(s.localDomain, domain) {
+		s.disconnectWithStreamError(streamerror.ErrPolicyViolation)
+		return
+	}
+	s.authenticated[domain] = true
+	s.writeElement(xml.NewElementNamespace("success", saslNamespace))
+
+	log.Infof("authenticated s2s stream... id: %s (domain: %s)", s.id, domain)
+
+	s.restart()
+}
+
+// processDialbackResult acts as receiving server verifying the key
+// against originating domain authoritative server.
+func (s *s2sInStream) processDialbackResult(elem xml.XElement) {
+	localDomain := elem.To()
+	remoteDomain := elem.From()
+	if !c2s.Instance().IsLocalDomain(localDomain) {
+		s.disconnectWithStreamError(streamerror.ErrHostUnknown)
+		return
+	}
+	if len(remoteDomain) == 0 {
+		s.disconnectWithStreamError(streamerror.ErrImproperAddressing)
+		return
+	}
+	if !s.isAllowedDomain(localDomain, remoteDomain) {
+		s.disconnectWithStreamError(streamerror.ErrPolicyViolation)
+		return
+	}
+	if !s.isDialbackAllowed() {
+		s.writeElement(s.dialbackError(elem, xml.ErrNotAllowed))
+		return
+	}
+	if s.authenticated[remoteDomain] || s.verifying[remoteDomain] {
+		return // already authenticated or in progress...
+	}
+	s.verifying[remoteDomain] = true
+
+	log.Infof("verifying dialback key... id: %s (domain: %s)", s.id, remoteDomain)
+
+	newS2SVerifyStream(localDomain, remoteDomain, s.streamID, elem.Text(), s.cfg, func(valid bool) {
+		s.postActor(func() {
+			s.finishDialback(localDomain, remoteDomain, valid)
+		})
+	})
+}
+
+func (s *s2sInStream) finishDialback(localDomain, remoteDomain string, valid bool) {
+	delete(s.verifying, remoteDomain)
+
+	result := xml.NewElementName("db:result")
+	result.SetFrom(localDomain)
+	result.SetTo(remoteDomain)
+	if valid {
+		result.SetType("valid")
+		s.authenticated[remoteDomain] = true
+		log.Infof("authenticated s2s stream... id: %s (domain: %s)", s.id, remoteDomain)
+	} else {
+		result.SetType("invalid")
+		log.Infof("invalid dialback key... id: %s (domain: %s)", s.id, remoteDomain)
+	}
+	s.writeElement(result)
+}
+
+// processDialbackVerify acts as authoritative server
+// checking a previously generated key.
+func (s *s2sInStream) processDialbackVerify(elem xml.XElement) {
+	localDomain := elem.To()
+	remoteDomain := elem.From()
+	if !c2s.Instance().IsLocalDomain(localDomain) {
+		s.disconnectWithStreamError(streamerror.ErrHostUnknown)
+		return
+	}
+	key := s2s.Instance().DialbackKey(remoteDomain, localDomain, elem.ID())
+
+	verify := xml.NewElementName("db:verify")
+	verify.SetID(elem.ID())
+	verify.SetFrom(localDomain)
+	verify.SetTo(remoteDomain)
+	if hmac.Equal([]byte(elem.Text()), []byte(key)) {
+		verify.SetType("valid")
+	} else {
+		verify.SetType("invalid")
+	}
+	s.writeElement(verify)
+}
+
+// isAllowedDomain returns whether or not a remote domain is allowed
+// to federate with a local one, logging rejected attempts.
+func (s *s2sInStream) isAllowedDomain(localDomain, remoteDomain string) bool {
+	if s2s.Instance().IsAllowedDomain(localDomain, remoteDomain) {
+		return true
+	}
+	log.Warnf("s2s: %s not allowed to federate with %s... id: %s", remoteDomain, localDomain, s.id)
+	return false
+}
+
+func (s *s2sInStream) processStanzaElement(elem xml.XElement) {
+	if len(s.authenticated) == 0 {
+		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		return
+	}
+	stanza, err := buildServerStanza(elem)
+	if err != nil {
+		s.handleElementError(elem, err)
+		return
+	}
+	if !s.authenticated[stanza.FromJID().Domain()] {
+		s.disconnectWithStreamError(streamerror.ErrInvalidFrom)
+		return
+	}
+	if !c2s.Instance().IsLocalDomain(stanza.ToJID().Domain()) {
+		s.disconnectWithStreamError(streamerror.ErrHostUnknown)
+		return
+	}
+	switch stanza := stanza.(type) {
+	case *xml.Presence:
+		s.processPresence(stanza)
+	case *xml.IQ:
+		s.processIQ(stanza)
+	case *xml.Message:
+		s.processMessage(stanza)
+	}
+}
+
+func (s *s2sInStream) processPresence(presence *xml.Presence) {
+	switch presence.Type() {
+	case xml.SubscribeType, xml.SubscribedType, xml.UnsubscribeType, xml.UnsubscribedType:
+		if presence.ToJID().IsServer() {
+			return
+		}
+		if err := roster.ProcessRemotePresence(s.rosterConfig(presence.ToJID().Domain()), presence); err != nil {
+			log.Error(err)
+		}
+	default:
+		c2s.Instance().Route(presence)
+	}
+}
+
+func (s *s2sInStream) processIQ(iq *xml.IQ) {
+	if iq.ToJID().IsServer() && s2s.Instance().ResolveIQ(iq) {
+		return // response to an outgoing stream ping
+	}
+	if !iq.ToJID().IsFullWithUser() {
+		// server side IQ handlers are bound to client streams
+		bounceStanza(iq, xml.ErrServiceUnavailable)
+		return
+	}
+	switch err := c2s.Instance().Route(iq); err {
+	case nil, router.ErrDropped:
+		break
+	case c2s.ErrResourceNotFound, c2s.ErrNotAuthenticated, c2s.ErrNotExistingAccount, c2s.ErrBlockedJID:
+		bounceStanza(iq, xml.ErrServiceUnavailable)
+	default:
+		log.Error(err)
+	}
+}
+
+func (s *s2sInStream) processMessage(message *xml.Message) {
+	switch err := c2s.Instance().Route(message); err {
+	case nil, router.ErrDropped:
+		break
+	case c2s.ErrResourceNotFound:
+		if message.IsHeadline() {
+			return // silently ignored
+		}
+		// treat the stanza as if it were addressed to <node@domain>
+		bareMessage, err := xml.NewMessageFromElement(message, message.FromJID(), message.ToJID().ToBareJID())
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		s.processMessage(bareMessage)
+	case c2s.ErrNotAuthenticated:
+		if message.IsHeadline() {
+			return // only delivered to available resources, never stored offline
+		}
+		storeOfflineMessage(s.cfg, message)
+	case c2s.ErrNotExistingAccount, c2s.ErrBlockedJID:
+		bounceStanza(message, xml.ErrServiceUnavailable)
+	default:
+		log.Error(err)
+	}
+}
+
+// rosterConfig returns roster configuration applied to subscriptions
+// addressed to a local domain users.
+func (s *s2sInStream) rosterConfig(domain string) *roster.Config {
+	if h := host.Instance(domain); h != nil && h.Roster != nil {
+		return h.Roster
+	}
+	return &s.cfg.ModRoster
+}
+
+func (s *s2sInStream) actorLoop() {
+	for {
+		f := <-s.actorCh
+		f()
+		if s.getState() == disconnected {
+			return
+		}
+	}
+}
+
+func (s *s2sInStream) doRead() {
+	if elem, err := s.tr.ReadElement(); err == nil {
+		s.postActor(func() {
+			s.readElement(elem)
+		})
+	} else {
+		if s.getState() == disconnected {
+			return // already disconnected...
+		}
+
+		var discErr error
+		switch err {
+		case nil, io.EOF, io.ErrUnexpectedEOF, xml.ErrStreamClosedByPeer:
+			break
+
+		case transport.ErrTooLargeStanza, xml.ErrTooDeepElement:
+			discErr = streamerror.ErrPolicyViolation
+
+		case xml.ErrRestrictedXML:
+			discErr = streamerror.ErrRestrictedXML
+
+		default:
+			switch e := err.(type) {
+			case net.Error:
+				if e.Timeout() {
+					discErr = streamerror.ErrConnectionTimeout
+				} else {
+					discErr = streamerror.ErrInvalidXML
+				}
+
+			default:
+				log.Error(err)
+				discErr = streamerror.ErrInvalidXML
+			}
+		}
+		s.postActor(func() {
+			s.disconnect(discErr)
+		})
+	}
+}
+
+func (s *s2sInStream) writeElement(element xml.XElement) {
+	log.Debugf("SEND: %v", element)
+	s.tr.WriteElement(element, true)
+}
+
+func (s *s2sInStream) readElement(elem xml.XElement) {
+	if elem != nil {
+		log.Debugf("RECV: %v", elem)
+		s.handleElement(elem)
+	}
+	if s.getState() != disconnected {
+		go s.doRead()
+	}
+}
+
+func (s *s2sInStream) disconnect(err error) {
+	switch err {
+	case nil:
+		s.disconnectClosingStream(false)
+	default:
+		if strmErr, ok := err.(*streamerror.Error); ok {
+			s.disconnectWithStreamError(strmErr)
+		} else {
+			log.Error(err)
+			s.disconnectClosingStream(false)
+		}
+	}
+}
+
+func (s *s2sInStream) openStream() {
+	s.streamID = uuid.New()
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<?xml version="1.0"?>`)
+
+	ops := xml.NewElementName("stream:stream")
+	ops.SetAttribute("xmlns", jabberServerNamespace)
+	ops.SetAttribute("xmlns:stream", streamNamespace)
+	ops.SetAttribute("xmlns:db", dialbackNamespace)
+	ops.SetAttribute("id", s.streamID)
+	if len(s.localDomain) > 0 {
+		ops.SetAttribute("from", s.localDomain)
+	}
+	if len(s.remoteDomain) > 0 {
+		ops.SetAttribute("to", s.remoteDomain)
+	}
+	ops.SetAttribute("version", "1.0")
+	ops.ToXML(buf, false)
+
+	openStr := buf.String()
+	log.Debugf("SEND: %s", openStr)
+
+	s.tr.WriteString(openStr)
+}
+
+func (s *s2sInStream) dialbackError(elem xml.XElement, stanzaErr error) xml.XElement {
+	resp := xml.NewElementName(elem.Name())
+	resp.SetFrom(elem.To())
+	resp.SetTo(elem.From())
+	resp.SetType(xml.ErrorType)
+	resp.AppendElement(stanzaErr.(*xml.StanzaError).Element())
+	return resp
+}
+
+func (s *s2sInStream) handleElementError(elem xml.XElement, err error) {
+	if streamErr, ok := err.(*streamerror.Error); ok {
+		s.disconnectWithStreamError(streamErr)
+	} else if stanzaErr, ok := err.(*xml.StanzaError); ok {
+		s.writeElement(xml.NewErrorElementFromElement(elem, stanzaErr, nil))
+	} else {
+		log.Error(err)
+	}
+}
+
+func (s *s2sInStream) validateStreamElement(elem xml.XElement) *streamerror.Error {
+	if elem.Name() != "stream:stream" {
+		return streamerror.ErrUnsupportedStanzaType
+	}
+	if elem.Namespace() != jabberServerNamespace || elem.Attributes().Get("xmlns:stream") != streamNamespace {
+		return streamerror.ErrInvalidNamespace
+	}
+	if !c2s.Instance().IsLocalDomain(elem.To()) {
+		return streamerror.ErrHostUnknown
+	}
+	if v := elem.Version(); len(v) > 0 && v != "1.0" {
+		return streamerror.ErrUnsupportedVersion
+	}
+	return nil
+}
+
+func (s *s2sInStream) isDialbackAllowed() bool {
+	return !s.cfg.S2S.Dialback.Disabled && !s.isTLSRequired()
+}
+
+// startTLSPolicy returns the listener STARTTLS policy. Unless otherwise configured
+// TLS is only required if dialback can't be used over plaintext streams.
+func (s *s2sInStream) startTLSPolicy() StartTLSPolicy {
+	if len(s.cfg.TLS.StartTLS) > 0 {
+		return s.cfg.TLS.StartTLS
+	}
+	if dbCfg := &s.cfg.S2S.Dialback; dbCfg.RequireTLS || dbCfg.Disabled {
+		return StartTLSRequired
+	}
+	return StartTLSOptional
+}
+
+// isTLSRequired returns whether or not the stream must be secured
+// before attempting to authenticate.
+func (s *s2sInStream) isTLSRequired() bool {
+	return !s.secured && s.startTLSPolicy() == StartTLSRequired
+}
+
+func (s *s2sInStream) isExternalAuthAllowed(domain string) bool {
+	return s.secured && verifyPeerCertificates(s.tr.PeerCertificates(), domain)
+}
+
+func (s *s2sInStream) disconnectWithStreamError(err *streamerror.Error) {
+	if s.getState() == connecting {
+		s.openStream()
+	}
+	s.writeElement(err.Element())
+	s.disconnectClosingStream(true)
+}
+
+func (s *s2sInStream) disconnectClosingStream(closeStream bool) {
+	if closeStream {
+		s.tr.WriteString("</stream:stream>")
+	}
+	close(s.doneCh)
+
+	if s2s.Enabled() {
+		s2s.Instance().UnregisterInStream(s)
+	}
+
+	s.setState(disconnected)
+	s.tr.Close()
+}
+
+func (s *s2sInStream) restart() {
+	s.setState(connecting)
+}
+
+func (s *s2sInStream) setState(state uint32) {
+	atomic.StoreUint32(&s.state, state)
+}
+
+func (s *s2sInStream) getState() uint32 {
+	return atomic.LoadUint32(&s.state)
+}
@@ -0,0 +1,413 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/s2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS2SInStream_Features(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	_, conn := tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:stream", elem.Name())
+	require.Equal(t, jabberServerNamespace, elem.Namespace())
+	require.Equal(t, dialbackNamespace, elem.Attributes().Get("xmlns:db"))
+	require.NotEqual(t, "", elem.ID())
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:features", elem.Name())
+	startTLS := elem.Elements().ChildNamespace("starttls", tlsNamespace)
+	require.NotNil(t, startTLS)
+	require.Nil(t, startTLS.Elements().Child("required"))
+	require.NotNil(t, elem.Elements().ChildNamespace("dialback", dialbackFeatureNamespace))
+	require.Nil(t, elem.Elements().ChildNamespace("mechanisms", saslNamespace))
+
+	// dialback requires TLS...
+	cfg := tUtilS2SDefaultConfig()
+	cfg.S2S.Dialback.RequireTLS = true
+	_, conn = tUtilS2SInStreamInit(cfg)
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.NotNil(t, elem.Elements().ChildNamespace("starttls", tlsNamespace).Elements().Child("required"))
+	require.Nil(t, elem.Elements().ChildNamespace("dialback", dialbackFeatureNamespace))
+
+	// unknown host...
+	_, conn = tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "remote.im", "example.org")
+
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("host-unknown"))
+	require.True(t, conn.WaitClose())
+}
+
+func TestS2SInStream_StartTLSPolicy(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	cfg := tUtilS2SDefaultConfig()
+	cfg.TLS.StartTLS = StartTLSRequired
+	_, conn := tUtilS2SInStreamInit(cfg)
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+
+	_ = conn.ClientReadElement() // read stream opening...
+	elem := conn.ClientReadElement()
+	require.NotNil(t, elem.Elements().ChildNamespace("starttls", tlsNamespace).Elements().Child("required"))
+	require.Nil(t, elem.Elements().ChildNamespace("dialback", dialbackFeatureNamespace))
+
+	conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="EXTERNAL">=</auth>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+
+	cfg.TLS.StartTLS = StartTLSDisabled
+	_, conn = tUtilS2SInStreamInit(cfg)
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.Nil(t, elem.Elements().ChildNamespace("starttls", tlsNamespace))
+	require.NotNil(t, elem.Elements().ChildNamespace("dialback", dialbackFeatureNamespace))
+
+	conn.ClientWriteBytes([]byte(`<starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "failure", elem.Name())
+	require.True(t, conn.WaitClose())
+}
+
+func TestS2SInStream_DialbackVerify(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	_, conn := tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	// act as authoritative server
+	key := s2s.Instance().DialbackKey("remote.im", "jackal.im", "abcd1234")
+	conn.ClientWriteBytes([]byte(`<db:verify from="remote.im" to="jackal.im" id="abcd1234">` + key + `</db:verify>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "db:verify", elem.Name())
+	require.Equal(t, "abcd1234", elem.ID())
+	require.Equal(t, "jackal.im", elem.From())
+	require.Equal(t, "remote.im", elem.To())
+	require.Equal(t, "valid", elem.Type())
+
+	conn.ClientWriteBytes([]byte(`<db:verify from="remote.im" to="jackal.im" id="abcd4321">` + key + `</db:verify>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "invalid", elem.Type())
+}
+
+func TestS2SInStream_Dialback(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	stm := c2s.NewMockStream("abcd", j)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().AuthenticateStream(stm)
+
+	authConn := transport.NewMockConn()
+	defer tUtilS2SDial(authConn)()
+
+	_, conn := tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	streamID := conn.ClientReadElement().ID()
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im">k3y</db:result>`))
+
+	// verify key against authoritative server
+	elem := authConn.ClientReadElement()
+	require.Equal(t, "stream:stream", elem.Name())
+	require.Equal(t, "jackal.im", elem.From())
+	require.Equal(t, "remote.im", elem.To())
+
+	tUtilS2SStreamOpen(authConn, "remote.im", "jackal.im")
+	authConn.ClientWriteBytes([]byte(`<stream:features><dialback xmlns="urn:xmpp:features:dialback"/></stream:features>`))
+
+	elem = authConn.ClientReadElement()
+	require.Equal(t, "db:verify", elem.Name())
+	require.Equal(t, streamID, elem.ID())
+	require.Equal(t, "k3y", elem.Text())
+
+	authConn.ClientWriteBytes([]byte(`<db:verify from="remote.im" to="jackal.im" id="` + streamID + `" type="valid"/>`))
+	require.True(t, authConn.WaitClose())
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "db:result", elem.Name())
+	require.Equal(t, "jackal.im", elem.From())
+	require.Equal(t, "remote.im", elem.To())
+	require.Equal(t, "valid", elem.Type())
+
+	// route remote stanzas
+	conn.ClientWriteBytes([]byte(`<message id="m1" type="chat" from="romeo@remote.im/garden" to="ortuman@jackal.im/balcony"><body>Hi!</body></message>`))
+	elem = stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "m1", elem.ID())
+
+	// not yet authenticated domain
+	conn.ClientWriteBytes([]byte(`<message id="m2" type="chat" from="romeo@example.org/garden" to="ortuman@jackal.im/balcony"><body>Hi!</body></message>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("invalid-from"))
+	require.True(t, conn.WaitClose())
+}
+
+func TestS2SInStream_DialbackInvalid(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	authConn := transport.NewMockConn()
+	defer tUtilS2SDial(authConn)()
+
+	_, conn := tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	streamID := conn.ClientReadElement().ID()
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im">k3y</db:result>`))
+
+	_ = authConn.ClientReadElement() // read stream opening...
+	tUtilS2SStreamOpen(authConn, "remote.im", "jackal.im")
+	authConn.ClientWriteBytes([]byte(`<stream:features/>`))
+	_ = authConn.ClientReadElement() // read db:verify...
+	authConn.ClientWriteBytes([]byte(`<db:verify from="remote.im" to="jackal.im" id="` + streamID + `" type="invalid"/>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "db:result", elem.Name())
+	require.Equal(t, "invalid", elem.Type())
+
+	conn.ClientWriteBytes([]byte(`<message id="m1" type="chat" from="romeo@remote.im/garden" to="ortuman@jackal.im/balcony"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("not-authorized"))
+	require.True(t, conn.WaitClose())
+}
+
+func TestS2SInStream_DialbackNotAllowed(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	// cert-only authentication
+	cfg := tUtilS2SDefaultConfig()
+	cfg.S2S.Dialback.Disabled = true
+	_, conn := tUtilS2SInStreamInit(cfg)
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	_ = conn.ClientReadElement() // read stream opening...
+	elem := conn.ClientReadElement()
+	require.NotNil(t, elem.Elements().ChildNamespace("starttls", tlsNamespace).Elements().Child("required"))
+	require.Nil(t, elem.Elements().ChildNamespace("dialback", dialbackFeatureNamespace))
+
+	conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im">k3y</db:result>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "db:result", elem.Name())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().Elements().Child("not-allowed"))
+
+	// TLS required before dialback
+	cfg = tUtilS2SDefaultConfig()
+	cfg.S2S.Dialback.RequireTLS = true
+	_, conn = tUtilS2SInStreamInit(cfg)
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im">k3y</db:result>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+}
+
+func TestS2SInStream_DomainFilter(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	// allow-only
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t", Filter: s2s.DomainFilter{Allow: []string{"*.remote.im"}}}, nil)
+
+	_, conn := tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+
+	_ = conn.ClientReadElement() // read stream opening...
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+
+	_, conn = tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "chat.remote.im", "jackal.im")
+
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:features", elem.Name())
+
+	// domains multiplexed over an allowed stream are checked as well
+	conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im">k3y</db:result>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+
+	s2s.Shutdown()
+
+	// deny-list
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t", Filter: s2s.DomainFilter{Deny: []string{"spam.im"}}}, nil)
+	defer s2s.Shutdown()
+
+	_, conn = tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "spam.im", "jackal.im")
+
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.Elements().Child("policy-violation"))
+	require.True(t, conn.WaitClose())
+
+	_, conn = tUtilS2SInStreamInit(tUtilS2SDefaultConfig())
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+
+	_ = conn.ClientReadElement() // read stream opening...
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:features", elem.Name())
+}
+
+func TestS2SInStream_OfflineMessage(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+
+	cfg := tUtilS2SDefaultConfig()
+	cfg.Modules = map[string]struct{}{"offline": {}, "mam": {}}
+	s := &s2sInStream{cfg: cfg}
+
+	j1, _ := xml.NewJIDString("romeo@remote.im/garden", false)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+
+	msg := xml.NewMessageType("m1", xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(xml.NewElementName("body"))
+	s.processMessage(msg)
+
+	msgs, _ := storage.Instance().FetchOfflineMessages("ortuman")
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "m1", msgs[0].ID())
+
+	archived, _ := storage.Instance().FetchArchiveMessages("ortuman", storage.ArchiveFilters{})
+	require.Equal(t, 1, len(archived))
+	require.Equal(t, model.ArchiveReceived, archived[0].Direction)
+}
+
+func TestS2SInStream_SubscriptionPresence(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+
+	s := &s2sInStream{cfg: tUtilS2SDefaultConfig()}
+
+	j1, _ := xml.NewJIDString("romeo@remote.im/garden", false)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im", false)
+
+	s.processPresence(xml.NewPresence(j1, j2, xml.SubscribeType))
+
+	rns, _ := storage.Instance().FetchRosterNotifications("ortuman")
+	require.Equal(t, 1, len(rns))
+	require.Equal(t, "romeo@remote.im", rns[0].JID)
+}
+
+func tUtilS2SInStreamInit(cfg *Config) (*s2sInStream, *transport.MockConn) {
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	stm := newS2SInStream("s2s-id:1234", tr, cfg)
+	s2s.Instance().RegisterInStream(stm)
+	return stm, conn
+}
+
+func tUtilS2SStreamOpen(conn *transport.MockConn, from, to string) {
+	s := `<?xml version="1.0"?>
+	<stream:stream xmlns:stream="http://etherx.jabber.org/streams" xmlns:db="jabber:server:dialback"
+	version="1.0" xmlns="jabber:server" id="s2s-1234" from="` + from + `" to="` + to + `">
+`
+	conn.ClientWriteBytes([]byte(s))
+}
+
+// tUtilS2SDial makes outgoing s2s connections to be established
+// against a mocked connection, returning a function to restore it.
+func tUtilS2SDial(conn *transport.MockConn) func() {
+	dial := s2sDial
+	s2sDial = func(domain string, timeout time.Duration) (net.Conn, error) {
+		return conn, nil
+	}
+	return func() { s2sDial = dial }
+}
+
+func tUtilS2SDefaultConfig() *Config {
+	return &Config{
+		ID:   "s2s-id:1234",
+		Type: S2SServerType,
+		Transport: TransportConfig{
+			Type:           transport.Socket,
+			ConnectTimeout: 1,
+			KeepAlive:      5,
+			MaxStanzaSize:  4096,
+		},
+		TLS: TLSConfig{
+			PrivKeyFile: "../testdata/cert/test.server.key",
+			CertFile:    "../testdata/cert/test.server.crt",
+		},
+		S2S: S2SConfig{DialTimeout: 1},
+	}
+}
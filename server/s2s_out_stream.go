@@ -0,0 +1,570 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stream/s2s"
+	"github.com/ortuman/jackal/util"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	outConnecting uint32 = iota
+	outConnected
+	outSecuring
+	outAuthenticating
+	outDialingBack
+	outVerifying
+	outAuthorized
+	outDisconnected
+)
+
+var (
+	errS2SStreamClosed  = errors.New("s2s: stream closed by remote server")
+	errS2SAuthFailed    = errors.New("s2s: remote server authentication failed")
+	errS2SNoAuthMethods = errors.New("s2s: no authentication method available")
+	errS2SPingTimeout   = errors.New("s2s: remote server not answering pings")
+)
+
+type dialbackVerify struct {
+	streamID string
+	key      string
+	onResult func(valid bool)
+	done     bool
+}
+
+type s2sOutStream struct {
+	cfg           *Config
+	tr            transport.Transport
+	id            string
+	localDomain   string
+	remoteDomain  string
+	streamID      string
+	state         uint32
+	secured       bool
+	authenticated bool
+	verify        *dialbackVerify
+	queue         []xml.XElement
+	lastActivity  time.Time
+	idleTm        *time.Timer
+	pingTm        *time.Timer
+	pingID        string
+	pingFailures  int
+	actorCh       chan func()
+	doneCh        chan struct{}
+}
+
+func newS2SOutStream(localDomain, remoteDomain string, cfg *Config) *s2sOutStream {
+	s := &s2sOutStream{
+		cfg:          cfg,
+		id:           fmt.Sprintf("%s->%s", localDomain, remoteDomain),
+		localDomain:  localDomain,
+		remoteDomain: remoteDomain,
+		state:        outConnecting,
+		actorCh:      make(chan func(), streamMailboxSize),
+		doneCh:       make(chan struct{}),
+	}
+	go s.actorLoop()
+	go s.dial()
+	return s
+}
+
+// newS2SVerifyStream opens a connection against an authoritative server
+// in order to verify a dialback key (XEP-0220, section 2.3).
+func newS2SVerifyStream(localDomain, remoteDomain, streamID, key string, cfg *Config, onResult func(valid bool)) *s2sOutStream {
+	s := &s2sOutStream{
+		cfg:          cfg,
+		id:           fmt.Sprintf("%s->%s (verify)", localDomain, remoteDomain),
+		localDomain:  localDomain,
+		remoteDomain: remoteDomain,
+		state:        outConnecting,
+		verify: &dialbackVerify{
+			streamID: streamID,
+			key:      key,
+			onResult: onResult,
+		},
+		actorCh: make(chan func(), streamMailboxSize),
+		doneCh:  make(chan struct{}),
+	}
+	go s.actorLoop()
+	go s.dial()
+	return s
+}
+
+// ID returns stream identifier.
+func (s *s2sOutStream) ID() string {
+	return s.id
+}
+
+// SendElement sends the given XML element,
+// queueing it until remote server has been authenticated.
+func (s *s2sOutStream) SendElement(element xml.XElement) {
+	posted := s.postActor(func() {
+		if s.getState() != outAuthorized {
+			s.queue = append(s.queue, element)
+			return
+		}
+		s.writeElement(element)
+	})
+	if posted {
+		return
+	}
+	// stream closed in the meantime (ie. idle timeout)... route it again
+	stanza, ok := element.(xml.Stanza)
+	if !ok || s.verify != nil || !s2s.Enabled() {
+		return
+	}
+	if err := s2s.Instance().Route(stanza); err != nil {
+		bounceStanza(stanza, xml.ErrRemoteServerNotFound)
+	}
+}
+
+// Disconnect disconnects remote peer by closing
+// the underlying TCP socket connection.
+func (s *s2sOutStream) Disconnect(err error) {
+	s.postActor(func() {
+		s.disconnect(err)
+	})
+}
+
+func (s *s2sOutStream) postActor(f func()) bool {
+	select {
+	case <-s.doneCh:
+		return false // already disconnected...
+	default:
+	}
+	select {
+	case s.actorCh <- f:
+		return true
+	case <-s.doneCh:
+		return false
+	}
+}
+
+func (s *s2sOutStream) dial() {
+	if s2s.Enabled() {
+		release := s2s.Instance().AcquireDial(s.remoteDomain)
+		defer release()
+	}
+	conn, err := s2sDial(s.remoteDomain, s.dialTimeout())
+	s.postActor(func() {
+		if err != nil {
+			s.disconnect(err)
+			return
+		}
+		tc := s.cfg.Transport
+		s.tr = transport.NewClientSocketTransport(conn, tc.MaxStanzaSize, tc.KeepAlive)
+		s.openStream()
+		go s.doRead()
+	})
+}
+
+func (s *s2sOutStream) handleElement(elem xml.XElement) {
+	if elem.Name() == "stream:error" {
+		log.Infof("s2s stream error... id: %s (%v)", s.id, elem)
+		s.disconnect(errS2SStreamClosed)
+		return
+	}
+	switch s.getState() {
+	case outConnecting:
+		s.handleConnecting(elem)
+	case outConnected:
+		s.handleConnected(elem)
+	case outSecuring:
+		s.handleSecuring(elem)
+	case outAuthenticating:
+		s.handleAuthenticating(elem)
+	case outDialingBack:
+		s.handleDialingBack(elem)
+	case outVerifying:
+		s.handleVerifying(elem)
+	default:
+		break // ignore anything received once authorized
+	}
+}
+
+func (s *s2sOutStream) handleConnecting(elem xml.XElement) {
+	if elem.Name() != "stream:stream" || elem.Namespace() != jabberServerNamespace {
+		s.disconnect(errS2SStreamClosed)
+		return
+	}
+	s.streamID = elem.ID()
+	if elem.Version() != "1.0" {
+		// legacy server... no stream features
+		s.authenticate(nil)
+		return
+	}
+	s.setState(outConnected)
+}
+
+func (s *s2sOutStream) handleConnected(elem xml.XElement) {
+	if elem.Name() != "stream:features" {
+		s.disconnect(errS2SStreamClosed)
+		return
+	}
+	if !s.secured && elem.Elements().ChildNamespace("starttls", tlsNamespace) != nil {
+		s.writeElement(xml.NewElementNamespace("starttls", tlsNamespace))
+		s.setState(outSecuring)
+		return
+	}
+	s.authenticate(elem)
+}
+
+func (s *s2sOutStream) handleSecuring(elem xml.XElement) {
+	if elem.Name() != "proceed" || elem.Namespace() != tlsNamespace {
+		s.disconnect(errS2SStreamClosed)
+		return
+	}
+	tlsCfg, err := util.LoadCertificate(s.cfg.TLS.PrivKeyFile, s.cfg.TLS.CertFile, s.localDomain)
+	if err != nil {
+		// SASL EXTERNAL won't be available without a client certificate
+		tlsCfg = &tls.Config{}
+	}
+	tlsCfg.ServerName = s.remoteDomain
+
+	// remote server identity is not required to be backed by a certificate,
+	// dialback relies on DNS to authenticate the peer.
+	tlsCfg.InsecureSkipVerify = true
+
+	s.tr.StartTLS(s.cfg.TLS.apply(tlsCfg))
+	s.secured = true
+
+	log.Infof("secured s2s stream... id: %s", s.id)
+
+	s.restart()
+}
+
+func (s *s2sOutStream) authenticate(features xml.XElement) {
+	if s.verify != nil {
+		verify := xml.NewElementName("db:verify")
+		verify.SetID(s.verify.streamID)
+		verify.SetFrom(s.localDomain)
+		verify.SetTo(s.remoteDomain)
+		verify.SetText(s.verify.key)
+		s.writeElement(verify)
+		s.setState(outVerifying)
+		return
+	}
+	if s.authenticated {
+		s.authorize()
+		return
+	}
+	if s.secured && features != nil && hasSASLMechanism(features, "EXTERNAL") {
+		auth := xml.NewElementNamespace("auth", saslNamespace)
+		auth.SetAttribute("mechanism", "EXTERNAL")
+		auth.SetText(base64.StdEncoding.EncodeToString([]byte(s.localDomain)))
+		s.writeElement(auth)
+		s.setState(outAuthenticating)
+		return
+	}
+	s.dialback()
+}
+
+func (s *s2sOutStream) handleAuthenticating(elem xml.XElement) {
+	if elem.Namespace() != saslNamespace {
+		s.disconnect(errS2SStreamClosed)
+		return
+	}
+	switch elem.Name() {
+	case "success":
+		s.authenticated = true
+		s.restart()
+	default:
+		// fallback to dialback
+		s.dialback()
+	}
+}
+
+func (s *s2sOutStream) dialback() {
+	dbCfg := &s.cfg.S2S.Dialback
+	if dbCfg.Disabled || (dbCfg.RequireTLS && !s.secured) {
+		s.disconnect(errS2SNoAuthMethods)
+		return
+	}
+	result := xml.NewElementName("db:result")
+	result.SetFrom(s.localDomain)
+	result.SetTo(s.remoteDomain)
+	result.SetText(s2s.Instance().DialbackKey(s.remoteDomain, s.localDomain, s.streamID))
+	s.writeElement(result)
+	s.setState(outDialingBack)
+}
+
+func (s *s2sOutStream) handleDialingBack(elem xml.XElement) {
+	if elem.Name() != "db:result" {
+		s.disconnect(errS2SStreamClosed)
+		return
+	}
+	if elem.Type() != "valid" {
+		s.disconnect(errS2SAuthFailed)
+		return
+	}
+	s.authorize()
+}
+
+func (s *s2sOutStream) handleVerifying(elem xml.XElement) {
+	if elem.Name() != "db:verify" || elem.ID() != s.verify.streamID {
+		s.disconnect(errS2SStreamClosed)
+		return
+	}
+	s.verify.onResult(elem.Type() == "valid")
+	s.verify.done = true
+	s.disconnect(nil)
+}
+
+func (s *s2sOutStream) authorize() {
+	s.setState(outAuthorized)
+
+	log.Infof("authorized s2s stream... id: %s", s.id)
+
+	if s2s.Enabled() {
+		s2s.Instance().ReportConnectionSuccess(s.remoteDomain)
+	}
+	for _, elem := range s.queue {
+		s.writeElement(elem)
+	}
+	s.queue = nil
+
+	s.scheduleIdleCheck(s.idleTimeout())
+	if s.cfg.S2S.PingInterval > 0 && s2s.Enabled() {
+		s.schedulePing()
+	}
+}
+
+func (s *s2sOutStream) scheduleIdleCheck(d time.Duration) {
+	s.idleTm = time.AfterFunc(d, func() {
+		s.postActor(s.checkIdle)
+	})
+}
+
+func (s *s2sOutStream) checkIdle() {
+	idleTimeout := s.idleTimeout()
+	if elapsed := time.Since(s.lastActivity); elapsed < idleTimeout {
+		s.scheduleIdleCheck(idleTimeout - elapsed)
+		return
+	}
+	log.Infof("closing idle s2s stream... id: %s", s.id)
+	s.disconnect(nil)
+}
+
+func (s *s2sOutStream) schedulePing() {
+	s.pingTm = time.AfterFunc(time.Second*time.Duration(s.cfg.S2S.PingInterval), func() {
+		s.postActor(s.ping)
+	})
+}
+
+// ping sends an XEP-0199 ping to the remote server, keeping alive
+// the connection state of any middlebox in between, and evicts the
+// stream once too many consecutive pings have not been answered.
+// (https://xmpp.org/extensions/xep-0199.html#s2s)
+func (s *s2sOutStream) ping() {
+	if !s2s.Enabled() {
+		return
+	}
+	if len(s.pingID) > 0 {
+		// previous ping not answered yet...
+		s2s.Instance().UntrackIQ(s.pingID)
+		s.pingFailures++
+		if s.pingFailures >= s.pingMaxFailures() {
+			s.disconnect(errS2SPingTimeout)
+			return
+		}
+	}
+	id := uuid.New()
+	iq := xml.NewIQType(id, xml.GetType)
+	iq.SetFrom(s.localDomain)
+	iq.SetTo(s.remoteDomain)
+	iq.AppendElement(xml.NewElementNamespace("ping", pingNamespace))
+
+	// any response, even an error one, proves remote server is alive
+	s2s.Instance().TrackIQ(id, s.remoteDomain, func(*xml.IQ) {
+		s.postActor(func() {
+			if s.pingID == id {
+				s.pingID = ""
+				s.pingFailures = 0
+			}
+		})
+	})
+	s.pingID = id
+
+	// pings don't count as activity, so that idle streams are still closed
+	log.Debugf("SEND: %v", iq)
+	s.tr.WriteElement(iq, true)
+
+	s.schedulePing()
+}
+
+func (s *s2sOutStream) actorLoop() {
+	for {
+		f := <-s.actorCh
+		f()
+		if s.getState() == outDisconnected {
+			return
+		}
+	}
+}
+
+func (s *s2sOutStream) doRead() {
+	if elem, err := s.tr.ReadElement(); err == nil {
+		s.postActor(func() {
+			s.readElement(elem)
+		})
+	} else {
+		if s.getState() == outDisconnected {
+			return // already disconnected...
+		}
+		var discErr error
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF, xml.ErrStreamClosedByPeer:
+			discErr = errS2SStreamClosed
+		default:
+			discErr = err
+		}
+		s.postActor(func() {
+			s.disconnect(discErr)
+		})
+	}
+}
+
+func (s *s2sOutStream) writeElement(element xml.XElement) {
+	log.Debugf("SEND: %v", element)
+	s.tr.WriteElement(element, true)
+	s.lastActivity = time.Now()
+}
+
+func (s *s2sOutStream) readElement(elem xml.XElement) {
+	if elem != nil {
+		log.Debugf("RECV: %v", elem)
+		s.handleElement(elem)
+	}
+	if s.getState() != outDisconnected {
+		go s.doRead()
+	}
+}
+
+func (s *s2sOutStream) openStream() {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<?xml version="1.0"?>`)
+
+	ops := xml.NewElementName("stream:stream")
+	ops.SetAttribute("xmlns", jabberServerNamespace)
+	ops.SetAttribute("xmlns:stream", streamNamespace)
+	ops.SetAttribute("xmlns:db", dialbackNamespace)
+	ops.SetAttribute("from", s.localDomain)
+	ops.SetAttribute("to", s.remoteDomain)
+	ops.SetAttribute("version", "1.0")
+	ops.ToXML(buf, false)
+
+	openStr := buf.String()
+	log.Debugf("SEND: %s", openStr)
+
+	s.tr.WriteString(openStr)
+}
+
+func (s *s2sOutStream) disconnect(err error) {
+	if err != nil {
+		log.Infof("s2s stream failed... id: %s (%v)", s.id, err)
+	}
+	authorized := s.getState() == outAuthorized
+	if s.idleTm != nil {
+		s.idleTm.Stop()
+	}
+	if s.pingTm != nil {
+		s.pingTm.Stop()
+	}
+	if len(s.pingID) > 0 && s2s.Enabled() {
+		s2s.Instance().UntrackIQ(s.pingID)
+	}
+	if s.tr != nil {
+		s.tr.WriteString("</stream:stream>")
+		s.tr.Close()
+	}
+	if s.verify != nil {
+		close(s.doneCh)
+		s.setState(outDisconnected)
+
+		if !s.verify.done {
+			s.verify.onResult(false)
+		}
+		return
+	}
+	// unregister before closing the stream so that
+	// late stanzas are routed through a new one
+	if s2s.Enabled() {
+		if err != nil && !authorized {
+			s2s.Instance().ReportConnectionFailure(s.remoteDomain)
+		}
+		s2s.Instance().UnregisterOutStream(s.localDomain, s.remoteDomain, s)
+	}
+	close(s.doneCh)
+	s.setState(outDisconnected)
+
+	// bounce never delivered stanzas
+	for _, elem := range s.queue {
+		if stanza, ok := elem.(xml.Stanza); ok {
+			bounceStanza(stanza, xml.ErrRemoteServerNotFound)
+		}
+	}
+	s.queue = nil
+}
+
+func (s *s2sOutStream) dialTimeout() time.Duration {
+	if s.cfg.S2S.DialTimeout > 0 {
+		return time.Second * time.Duration(s.cfg.S2S.DialTimeout)
+	}
+	return time.Second * defaultS2SDialTimeout
+}
+
+func (s *s2sOutStream) idleTimeout() time.Duration {
+	if s.cfg.S2S.IdleTimeout > 0 {
+		return time.Second * time.Duration(s.cfg.S2S.IdleTimeout)
+	}
+	return time.Second * defaultS2SIdleTimeout
+}
+
+func (s *s2sOutStream) pingMaxFailures() int {
+	if s.cfg.S2S.PingFailures > 0 {
+		return s.cfg.S2S.PingFailures
+	}
+	return defaultS2SPingFailures
+}
+
+func (s *s2sOutStream) restart() {
+	s.openStream()
+	s.setState(outConnecting)
+}
+
+func (s *s2sOutStream) setState(state uint32) {
+	atomic.StoreUint32(&s.state, state)
+}
+
+func (s *s2sOutStream) getState() uint32 {
+	return atomic.LoadUint32(&s.state)
+}
+
+func hasSASLMechanism(features xml.XElement, mechanism string) bool {
+	mechanisms := features.Elements().ChildNamespace("mechanisms", saslNamespace)
+	if mechanisms == nil {
+		return false
+	}
+	for _, m := range mechanisms.Elements().Children("mechanism") {
+		if m.Text() == mechanism {
+			return true
+		}
+	}
+	return false
+}
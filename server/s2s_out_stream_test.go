@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/s2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS2SOutStream_Dialback(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	conn := transport.NewMockConn()
+	defer tUtilS2SDial(conn)()
+
+	stm := newS2SOutStream("jackal.im", "remote.im", tUtilS2SDefaultConfig())
+
+	// queued until authorized
+	stm.SendElement(tUtilS2SMessage("m1", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:stream", elem.Name())
+	require.Equal(t, jabberServerNamespace, elem.Namespace())
+	require.Equal(t, "jackal.im", elem.From())
+	require.Equal(t, "remote.im", elem.To())
+
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	conn.ClientWriteBytes([]byte(`<stream:features><dialback xmlns="urn:xmpp:features:dialback"><errors/></dialback></stream:features>`))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "db:result", elem.Name())
+	require.Equal(t, s2s.Instance().DialbackKey("remote.im", "jackal.im", "s2s-1234"), elem.Text())
+
+	conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im" type="valid"/>`))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "m1", elem.ID())
+
+	stm.SendElement(tUtilS2SMessage("m2", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "m2", elem.ID())
+
+	stm.Disconnect(nil)
+	require.True(t, conn.WaitClose())
+}
+
+func TestS2SOutStream_DialbackFailed(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	senderStm := c2s.NewMockStream("abcd", j)
+	c2s.Instance().RegisterStream(senderStm)
+	c2s.Instance().AuthenticateStream(senderStm)
+
+	conn := transport.NewMockConn()
+	defer tUtilS2SDial(conn)()
+
+	stm := newS2SOutStream("jackal.im", "remote.im", tUtilS2SDefaultConfig())
+	stm.SendElement(tUtilS2SMessage("m1", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+
+	_ = conn.ClientReadElement() // read stream opening...
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	conn.ClientWriteBytes([]byte(`<stream:features/>`))
+	_ = conn.ClientReadElement() // read db:result...
+	conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im" type="invalid"/>`))
+	require.True(t, conn.WaitClose())
+
+	// queued stanzas are bounced
+	elem := senderStm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "m1", elem.ID())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().Elements().Child("remote-server-not-found"))
+}
+
+func TestS2SOutStream_DialbackNotAllowed(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	conn := transport.NewMockConn()
+	defer tUtilS2SDial(conn)()
+
+	// TLS required before dialback
+	cfg := tUtilS2SDefaultConfig()
+	cfg.S2S.Dialback.RequireTLS = true
+	newS2SOutStream("jackal.im", "remote.im", cfg)
+
+	_ = conn.ClientReadElement() // read stream opening...
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	conn.ClientWriteBytes([]byte(`<stream:features><dialback xmlns="urn:xmpp:features:dialback"/></stream:features>`))
+	require.True(t, conn.WaitClose())
+}
+
+func TestS2SOutStream_DialFailed(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	senderStm := c2s.NewMockStream("abcd", j)
+	c2s.Instance().RegisterStream(senderStm)
+	c2s.Instance().AuthenticateStream(senderStm)
+
+	dial := s2sDial
+	defer func() { s2sDial = dial }()
+
+	dialCh := make(chan struct{})
+	s2sDial = func(domain string, timeout time.Duration) (net.Conn, error) {
+		<-dialCh
+		return nil, errors.New("connection refused")
+	}
+	stm := newS2SOutStream("jackal.im", "remote.im", tUtilS2SDefaultConfig())
+	stm.SendElement(tUtilS2SMessage("m1", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+	close(dialCh)
+
+	elem := senderStm.FetchElement()
+	require.Equal(t, "m1", elem.ID())
+	require.NotNil(t, elem.Error().Elements().Child("remote-server-not-found"))
+
+	// remote domain not dialed again until backoff expires
+	err := s2s.Instance().Route(tUtilS2SMessage("m2", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+	require.Equal(t, s2s.ErrRemoteServerNotFound, err)
+}
+
+func TestS2SOutStream_IdleTimeout(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	conn := transport.NewMockConn()
+	defer tUtilS2SDial(conn)()
+
+	cfg := tUtilS2SDefaultConfig()
+	cfg.S2S.IdleTimeout = 1
+
+	var stms []*s2sOutStream
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, func(localDomain, remoteDomain string) s2s.OutStream {
+		stm := newS2SOutStream(localDomain, remoteDomain, cfg)
+		stms = append(stms, stm)
+		return stm
+	})
+	defer s2s.Shutdown()
+
+	s2s.Instance().Route(tUtilS2SMessage("m1", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+
+	_ = conn.ClientReadElement() // read stream opening...
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	conn.ClientWriteBytes([]byte(`<stream:features/>`))
+	_ = conn.ClientReadElement() // read db:result...
+	conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im" type="valid"/>`))
+	require.Equal(t, "m1", conn.ClientReadElement().ID())
+
+	// established stream is reused
+	s2s.Instance().Route(tUtilS2SMessage("m2", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+	require.Equal(t, "m2", conn.ClientReadElement().ID())
+	require.Equal(t, 1, len(stms))
+
+	// closed after being idle
+	require.True(t, conn.WaitCloseWithTimeout(time.Second*2))
+}
+
+func TestS2SOutStream_PingEviction(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	conn1, conn2 := transport.NewMockConn(), transport.NewMockConn()
+	conns := make(chan net.Conn, 2)
+	conns <- conn1
+	conns <- conn2
+
+	dial := s2sDial
+	defer func() { s2sDial = dial }()
+	s2sDial = func(domain string, timeout time.Duration) (net.Conn, error) {
+		return <-conns, nil
+	}
+
+	cfg := tUtilS2SDefaultConfig()
+	cfg.S2S.PingInterval = 1
+	cfg.S2S.PingFailures = 1
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, func(localDomain, remoteDomain string) s2s.OutStream {
+		return newS2SOutStream(localDomain, remoteDomain, cfg)
+	})
+	defer s2s.Shutdown()
+
+	authorize := func(conn *transport.MockConn, msgID string) {
+		_ = conn.ClientReadElement() // read stream opening...
+		tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+		conn.ClientWriteBytes([]byte(`<stream:features/>`))
+		_ = conn.ClientReadElement() // read db:result...
+		conn.ClientWriteBytes([]byte(`<db:result from="remote.im" to="jackal.im" type="valid"/>`))
+		require.Equal(t, msgID, conn.ClientReadElement().ID())
+	}
+	s2s.Instance().Route(tUtilS2SMessage("m1", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+	authorize(conn1, "m1")
+
+	// answered ping keeps stream alive...
+	elem := conn1.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, xml.GetType, elem.Type())
+	require.Equal(t, "jackal.im", elem.From())
+	require.Equal(t, "remote.im", elem.To())
+	require.NotNil(t, elem.Elements().ChildNamespace("ping", pingNamespace))
+
+	fromJID, _ := xml.NewJIDString("remote.im", false)
+	toJID, _ := xml.NewJIDString("jackal.im", false)
+	result, _ := xml.NewIQFromElement(xml.NewIQType(elem.ID(), xml.ResultType), fromJID, toJID)
+	require.True(t, s2s.Instance().ResolveIQ(result))
+
+	// ...while a dead remote server is evicted
+	elem = conn1.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.True(t, conn1.WaitCloseWithTimeout(time.Second*2))
+
+	// stream is established again on next routing
+	s2s.Instance().Route(tUtilS2SMessage("m2", "ortuman@jackal.im/balcony", "romeo@remote.im/garden"))
+	authorize(conn2, "m2")
+}
+
+func TestS2SOutStream_Verify(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	s2s.Initialize(&s2s.Config{DialbackSecret: "s3cr3t"}, nil)
+	defer s2s.Shutdown()
+
+	conn := transport.NewMockConn()
+	defer tUtilS2SDial(conn)()
+
+	resCh := make(chan bool, 1)
+	newS2SVerifyStream("jackal.im", "remote.im", "abcd1234", "k3y", tUtilS2SDefaultConfig(), func(valid bool) {
+		resCh <- valid
+	})
+	_ = conn.ClientReadElement() // read stream opening...
+	tUtilS2SStreamOpen(conn, "remote.im", "jackal.im")
+	conn.ClientWriteBytes([]byte(`<stream:features/>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "db:verify", elem.Name())
+	require.Equal(t, "abcd1234", elem.ID())
+	require.Equal(t, "jackal.im", elem.From())
+	require.Equal(t, "remote.im", elem.To())
+	require.Equal(t, "k3y", elem.Text())
+
+	conn.ClientWriteBytes([]byte(`<db:verify from="remote.im" to="jackal.im" id="abcd1234" type="valid"/>`))
+	require.True(t, <-resCh)
+	require.True(t, conn.WaitClose())
+}
+
+func tUtilS2SMessage(id, from, to string) *xml.Message {
+	fromJID, _ := xml.NewJIDString(from, false)
+	toJID, _ := xml.NewJIDString(to, false)
+	elem := xml.NewElementName("message")
+	elem.SetID(id)
+	elem.SetType(xml.ChatType)
+	msg, _ := xml.NewMessageFromElement(elem, fromJID, toJID)
+	return msg
+}
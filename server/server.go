@@ -12,22 +12,33 @@ import (
 	_ "net/http/pprof" // http profile handlers
 	"net/url"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/ortuman/jackal/auth"
+	"github.com/ortuman/jackal/host"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module/xep0363"
 	"github.com/ortuman/jackal/server/transport"
 	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/stream/s2s"
 	"github.com/ortuman/jackal/util"
 )
 
 type server struct {
 	cfg        *Config
 	ln         net.Listener
-	wsSrv      *http.Server
+	httpSrv    *http.Server
 	wsUpgrader *websocket.Upgrader
+	boshMgr    *transport.BoshManager
+	uploadSrv  *http.Server
+	connLmt    *connLimiter
 	strCounter int32
 	listening  uint32
+	draining   uint32
 }
 
 var (
@@ -38,7 +49,9 @@ var (
 )
 
 // Initialize spawns a connection listener for every server configuration.
-func Initialize(srvConfigurations []Config, debugPort int) {
+// Once shut down, connected client streams are drained according to
+// the shutdown configuration before closing every listener.
+func Initialize(srvConfigurations []Config, shutdownCfg *ShutdownConfig, debugPort int) {
 	if !atomic.CompareAndSwapUint32(&initialized, 0, 1) {
 		return
 	}
@@ -50,6 +63,15 @@ func Initialize(srvConfigurations []Config, debugPort int) {
 		}()
 	}
 
+	// validate virtual hosts modules
+	for _, h := range host.All() {
+		for module := range h.Modules {
+			if !isModuleAvailable(module) {
+				log.Fatalf("host %s: unrecognized module: %s", h.Name, module)
+			}
+		}
+	}
+
 	// initialize all servers
 	for i := 0; i < len(srvConfigurations); i++ {
 		initializeServer(&srvConfigurations[i])
@@ -58,7 +80,14 @@ func Initialize(srvConfigurations []Config, debugPort int) {
 	// wait until shutdown...
 	<-shutdownCh
 
+	// stop accepting new streams
+	for _, srv := range servers {
+		srv.stopAccepting()
+	}
+	drainC2SStreams(shutdownCfg)
+
 	// close all servers
+	s2s.Shutdown()
 	for k, srv := range servers {
 		if err := srv.shutdown(); err != nil {
 			log.Error(err)
@@ -67,8 +96,8 @@ func Initialize(srvConfigurations []Config, debugPort int) {
 	}
 }
 
-// Shutdown closes every server listener.
-// This method should be used only for testing purposes.
+// Shutdown stops accepting new streams, making Initialize drain
+// connected ones and close every server listener before returning.
 func Shutdown() {
 	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
 		if debugSrv != nil {
@@ -78,8 +107,44 @@ func Shutdown() {
 	}
 }
 
+// drainC2SStreams disconnects every client stream, force-closing
+// those not terminated after drain timeout.
+func drainC2SStreams(cfg *ShutdownConfig) {
+	var err error = streamerror.ErrSystemShutdown
+	if len(cfg.SeeOtherHost) > 0 {
+		err = streamerror.NewSeeOtherHostError(cfg.SeeOtherHost)
+	}
+	stms := c2s.Instance().DisconnectAll(err, cfg.drainTimeout())
+	if len(stms) == 0 {
+		return
+	}
+	log.Warnf("%d streams not drained in time... forcing close", len(stms))
+	for _, stm := range stms {
+		if c2sStm, ok := stm.(*c2sStream); ok {
+			c2sStm.forceClose()
+		}
+	}
+}
+
 func initializeServer(srvConfig *Config) {
-	srv := &server{cfg: srvConfig}
+	if srvConfig.Type == S2SServerType {
+		s2sCfg := &s2s.Config{
+			DialbackSecret: srvConfig.S2S.Dialback.Secret,
+			MaxDials:       srvConfig.S2S.MaxDials,
+			MaxBackoff:     time.Second * time.Duration(srvConfig.S2S.MaxBackoff),
+			Filter:         srvConfig.S2S.Filter,
+			HostFilters:    make(map[string]s2s.DomainFilter),
+		}
+		for _, h := range host.All() {
+			if !h.S2S.IsEmpty() {
+				s2sCfg.HostFilters[h.Name] = h.S2S
+			}
+		}
+		s2s.Initialize(s2sCfg, func(localDomain, remoteDomain string) s2s.OutStream {
+			return newS2SOutStream(localDomain, remoteDomain, srvConfig)
+		})
+	}
+	srv := &server{cfg: srvConfig, connLmt: newConnLimiter(&srvConfig.ConnLimit)}
 	servers[srvConfig.ID] = srv
 	go srv.start()
 }
@@ -91,12 +156,31 @@ func (s *server) start() {
 
 	log.Infof("%s: listening at %s [transport: %v]", s.cfg.ID, address, s.cfg.Transport.Type)
 
+	if _, ok := auth.Instance().(auth.CredentialsProvider); !ok {
+		for _, sasl := range s.cfg.SASL {
+			if requiresStoredCredentials(sasl) {
+				log.Warnf("%s: %s SASL mechanism disabled... authentication provider doesn't expose stored credentials", s.cfg.ID, sasl)
+			}
+		}
+	} else if auth.HashesPasswords() {
+		for _, sasl := range s.cfg.SASL {
+			if requiresPlainPassword(sasl) {
+				log.Warnf("%s: %s SASL mechanism disabled... stored passwords are hashed", s.cfg.ID, sasl)
+			}
+		}
+	}
+
+	if _, ok := s.cfg.Modules["upload"]; ok {
+		s.listenUpload()
+	}
+
 	switch s.cfg.Transport.Type {
 	case transport.Socket:
 		s.listenSocketConn(address)
 	case transport.WebSocket:
 		s.listenWebSocketConn(address)
-		break
+	case transport.Bosh:
+		s.listenBoshConn(address)
 	}
 }
 
@@ -124,60 +208,199 @@ func (s *server) listenWebSocketConn(address string) {
 			log.Fatalf("%v", err)
 		}
 	}()
-	tlsCfg, err := util.LoadCertificate(s.cfg.TLS.PrivKeyFile, s.cfg.TLS.CertFile, c2s.Instance().DefaultLocalDomain())
-	if err != nil {
-		log.Fatalf("%v", err)
-	}
-	wsSrv := &http.Server{
-		Addr:      address,
-		TLSConfig: tlsCfg,
+	urlPath := s.cfg.Transport.URLPath
+	if len(urlPath) == 0 {
+		urlPath = fmt.Sprintf("/%s/ws", url.PathEscape(s.cfg.ID))
 	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(urlPath, s.websocketUpgrade)
+
 	s.wsUpgrader = &websocket.Upgrader{
 		Subprotocols: []string{"xmpp"},
 		CheckOrigin: func(r *http.Request) bool {
 			return r.Header.Get("Sec-WebSocket-Protocol") == "xmpp"
 		},
 	}
-	s.wsSrv = wsSrv
+	log.Infof("%s: serving websocket endpoint at %s", s.cfg.ID, urlPath)
+	s.serveHTTP(address, mux)
+}
+
+func (s *server) listenBoshConn(address string) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}()
+	urlPath := s.cfg.Transport.URLPath
+	if len(urlPath) == 0 {
+		urlPath = fmt.Sprintf("/%s/http-bind", url.PathEscape(s.cfg.ID))
+	}
+	tr := s.cfg.Transport
+	s.boshMgr = transport.NewBoshManager(tr.MaxStanzaSize, tr.MaxWait, tr.KeepAlive, s.startStream)
+	s.boshMgr.SetSessionLimiter(func(remoteAddr string) bool {
+		if !s.connLmt.acquire(remoteAddr, time.Now()) {
+			log.Debugf("%s: connection limit reached... refusing %s", s.cfg.ID, remoteAddr)
+			return false
+		}
+		return true
+	}, s.connLmt.release)
+
+	mux := http.NewServeMux()
+	mux.Handle(urlPath, s.boshMgr)
 
-	http.HandleFunc(fmt.Sprintf("/%s/ws", url.PathEscape(s.cfg.ID)), s.websocketUpgrade)
+	log.Infof("%s: serving BOSH endpoint at %s", s.cfg.ID, urlPath)
+	s.serveHTTP(address, mux)
+}
+
+func (s *server) serveHTTP(address string, handler http.Handler) {
+	httpSrv := &http.Server{
+		Addr:    address,
+		Handler: handler,
+	}
+	if !s.cfg.Transport.TLSOffload {
+		tlsCfg, err := util.LoadCertificate(s.cfg.TLS.PrivKeyFile, s.cfg.TLS.CertFile, c2s.Instance().DefaultLocalDomain())
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		httpSrv.TLSConfig = withSNI(s.cfg.TLS.apply(tlsCfg))
+	}
+	s.httpSrv = httpSrv
 
 	atomic.StoreUint32(&s.listening, 1)
-	if err := s.wsSrv.ListenAndServeTLS("", ""); err != nil {
+	var err error
+	if s.cfg.Transport.TLSOffload {
+		// TLS terminated by a fronting proxy... serve plain HTTP
+		err = s.httpSrv.ListenAndServe()
+	} else {
+		err = s.httpSrv.ListenAndServeTLS("", "")
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("%v", err)
 	}
 }
 
+func (s *server) listenUpload() {
+	cfg := &s.cfg.ModUpload
+	s.uploadSrv = &http.Server{
+		Addr:    cfg.Address(),
+		Handler: xep0363.NewHandler(cfg),
+	}
+	isTLS := strings.HasPrefix(cfg.BaseURL, "https://")
+	if isTLS {
+		tlsCfg, err := util.LoadCertificate(s.cfg.TLS.PrivKeyFile, s.cfg.TLS.CertFile, c2s.Instance().DefaultLocalDomain())
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		s.uploadSrv.TLSConfig = s.cfg.TLS.apply(tlsCfg)
+	}
+	log.Infof("%s: serving file upload endpoint at %s", s.cfg.ID, cfg.Address())
+
+	go func(srv *http.Server) {
+		var err error
+		if isTLS {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			// plain HTTP base URL... TLS terminated by a fronting proxy
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("%v", err)
+		}
+	}(s.uploadSrv)
+}
+
 func (s *server) websocketUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !s.connLmt.acquire(r.RemoteAddr, time.Now()) {
+		log.Debugf("%s: connection limit reached... refusing %s", s.cfg.ID, r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
 	conn, err := s.wsUpgrader.Upgrade(w, r, nil)
 	if err != nil {
+		s.connLmt.release(r.RemoteAddr)
 		log.Error(err)
 		return
 	}
-	go s.handleWebSocketConn(conn)
+	go s.handleWebSocketConn(conn, r.RemoteAddr)
+}
+
+// stopAccepting rejects new incoming streams.
+// HTTP based listeners keep serving already established sessions
+// until shut down, so that pending stream errors can be delivered.
+func (s *server) stopAccepting() {
+	atomic.StoreUint32(&s.draining, 1)
+	if s.cfg.Transport.Type == transport.Socket && atomic.CompareAndSwapUint32(&s.listening, 1, 0) {
+		if err := s.ln.Close(); err != nil {
+			log.Error(err)
+		}
+	}
 }
 
 func (s *server) shutdown() error {
+	if s.uploadSrv != nil {
+		s.uploadSrv.Close()
+	}
 	if atomic.CompareAndSwapUint32(&s.listening, 1, 0) {
 		switch s.cfg.Transport.Type {
 		case transport.Socket:
 			return s.ln.Close()
 		case transport.WebSocket:
-			return s.wsSrv.Close()
+			return s.httpSrv.Close()
+		case transport.Bosh:
+			s.boshMgr.Close()
+			return s.httpSrv.Close()
 		}
 	}
 	return nil
 }
 
 func (s *server) handleSocketConn(conn net.Conn) {
-	s.startStream(transport.NewSocketTransport(conn, s.cfg.Transport.MaxStanzaSize, s.cfg.Transport.KeepAlive))
+	remoteAddr := conn.RemoteAddr().String()
+	if !s.connLmt.acquire(remoteAddr, time.Now()) {
+		log.Debugf("%s: connection limit reached... refusing %s", s.cfg.ID, remoteAddr)
+		conn.Close()
+		return
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if idleTimeout := s.cfg.Transport.IdleTimeout; idleTimeout > 0 {
+			// let the OS detect dead peers on idle connections as well
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(time.Second * time.Duration(idleTimeout))
+		}
+		if s.cfg.Transport.ReadBufferSize > 0 {
+			tcpConn.SetReadBuffer(s.cfg.Transport.ReadBufferSize)
+		}
+		if s.cfg.Transport.WriteBufferSize > 0 {
+			tcpConn.SetWriteBuffer(s.cfg.Transport.WriteBufferSize)
+		}
+	}
+	tr := transport.NewSocketTransport(conn, s.cfg.Transport.MaxStanzaSize, s.cfg.Transport.KeepAlive)
+	s.startStream(s.limitTransport(tr, remoteAddr))
 }
 
-func (s *server) handleWebSocketConn(conn *websocket.Conn) {
-	s.startStream(transport.NewWebSocketTransport(conn, s.cfg.Transport.MaxStanzaSize, s.cfg.Transport.KeepAlive))
+func (s *server) handleWebSocketConn(conn *websocket.Conn, remoteAddr string) {
+	tr := transport.NewWebSocketTransport(conn, s.cfg.Transport.MaxStanzaSize, s.cfg.Transport.KeepAlive)
+	s.startStream(s.limitTransport(tr, remoteAddr))
+}
+
+// limitTransport returns a transport releasing its
+// connection limiter slot once closed.
+func (s *server) limitTransport(tr transport.Transport, remoteAddr string) transport.Transport {
+	return &limitedTransport{
+		Transport: tr,
+		release:   func() { s.connLmt.release(remoteAddr) },
+	}
 }
 
 func (s *server) startStream(tr transport.Transport) {
+	if atomic.LoadUint32(&s.draining) == 1 {
+		tr.Close() // shutting down...
+		return
+	}
+	if s.cfg.Type == S2SServerType {
+		s2s.Instance().RegisterInStream(newS2SInStream(s.nextID(), tr, s.cfg))
+		return
+	}
 	stm := newC2SStream(s.nextID(), tr, s.cfg)
 	if err := c2s.Instance().RegisterStream(stm); err != nil {
 		log.Error(err)
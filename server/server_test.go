@@ -7,8 +7,10 @@ package server
 
 import (
 	"crypto/tls"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	"github.com/ortuman/jackal/server/transport"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
 	"github.com/stretchr/testify/require"
 )
 
@@ -61,7 +64,58 @@ func TestSocketServer(t *testing.T) {
 			Port: 5123,
 		},
 	}
-	Initialize([]Config{cfg}, 9123)
+	Initialize([]Config{cfg}, &ShutdownConfig{}, 9123)
+}
+
+func TestSocketServer_GracefulShutdown(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	outCh := make(chan string, 1)
+	go func() {
+		time.Sleep(time.Millisecond * 150)
+
+		conn, err := net.Dial("tcp", "localhost:5124")
+		require.Nil(t, err)
+		defer conn.Close()
+
+		open := []byte(`<?xml version="1.0"?><stream:stream xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams" to="jackal.im" version="1.0">`)
+		_, err = conn.Write(open)
+		require.Nil(t, err)
+
+		time.Sleep(time.Millisecond * 150) // wait until stream is opened
+
+		go Shutdown()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		b, _ := ioutil.ReadAll(conn)
+		outCh <- string(b)
+	}()
+	cfg := Config{
+		ID: "srv-1234",
+		TLS: TLSConfig{
+			PrivKeyFile: "../testdata/cert/test.server.key",
+			CertFile:    "../testdata/cert/test.server.crt",
+		},
+		Transport: TransportConfig{
+			Type:          transport.Socket,
+			Port:          5124,
+			KeepAlive:     120,
+			MaxStanzaSize: 4096,
+		},
+	}
+	Initialize([]Config{cfg}, &ShutdownConfig{SeeOtherHost: "xmpp2.jackal.im"}, 0)
+
+	out := <-outCh
+	require.True(t, strings.Contains(out, `<see-other-host xmlns="urn:ietf:params:xml:ns:xmpp-streams">xmpp2.jackal.im</see-other-host>`))
+	require.True(t, strings.HasSuffix(out, "</stream:stream>"))
+
+	// new connections are no longer accepted
+	_, err := net.Dial("tcp", "localhost:5124")
+	require.NotNil(t, err)
 }
 
 func TestWebSocketServer(t *testing.T) {
@@ -104,5 +158,46 @@ func TestWebSocketServer(t *testing.T) {
 			Port: 9876,
 		},
 	}
-	Initialize([]Config{cfg}, 0)
+	Initialize([]Config{cfg}, &ShutdownConfig{}, 0)
+}
+
+func TestBoshServer(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&c2s.Config{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	go func() {
+		time.Sleep(time.Millisecond * 150)
+		cl := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
+		body := `<body xmlns="http://jabber.org/protocol/httpbind" rid="1" to="jackal.im" wait="1" xmpp:version="1.0" xmlns:xmpp="urn:xmpp:xbosh"/>`
+		resp, err := cl.Post("https://localhost:9877/srv-1234/http-bind", "text/xml", strings.NewReader(body))
+		require.Nil(t, err)
+		elem, err := xml.NewParser(resp.Body).ParseElement()
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.NotEqual(t, "", elem.Attributes().Get("sid"))
+		require.NotNil(t, elem.Elements().Child("stream:features"))
+
+		Shutdown()
+	}()
+	cfg := Config{
+		ID: "srv-1234",
+		TLS: TLSConfig{
+			PrivKeyFile: "../testdata/cert/test.server.key",
+			CertFile:    "../testdata/cert/test.server.crt",
+		},
+		Transport: TransportConfig{
+			Type:           transport.Bosh,
+			Port:           9877,
+			ConnectTimeout: 5,
+			KeepAlive:      30,
+			MaxStanzaSize:  8192,
+			MaxWait:        1,
+		},
+	}
+	Initialize([]Config{cfg}, &ShutdownConfig{}, 0)
 }
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"strings"
+	"sync"
+
+	"github.com/ortuman/jackal/host"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/util"
+)
+
+// loaded virtual host certificates, keyed by certificate file
+var (
+	hostCertsMu sync.Mutex
+	hostCerts   = make(map[string]*tls.Certificate)
+)
+
+// versionTLS13 is defined by crypto/tls as of Go 1.12 only.
+const versionTLS13 = 0x0304
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": versionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// broken cipher suites, refused even if explicitly configured
+var weakTLSCipherSuites = map[string]bool{
+	"TLS_RSA_WITH_RC4_128_SHA":            true,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":       true,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":    true,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":      true,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA": true,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+// apply restricts a TLS configuration to configured protocol versions,
+// cipher suites and elliptic curves.
+func (c *TLSConfig) apply(tlsCfg *tls.Config) *tls.Config {
+	tlsCfg.MinVersion = c.MinVersion
+	if tlsCfg.MinVersion == 0 {
+		tlsCfg.MinVersion = tls.VersionTLS12
+	}
+	tlsCfg.CipherSuites = c.CipherSuites
+	tlsCfg.CurvePreferences = c.CurvePreferences
+	return tlsCfg
+}
+
+// withSNI makes a TLS configuration present the certificate of the virtual host
+// matching the server name requested by the client (SNI).
+// Configured certificates are presented if no virtual host matches it.
+func withSNI(tlsCfg *tls.Config) *tls.Config {
+	tlsCfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if len(hello.ServerName) == 0 {
+			return nil, nil
+		}
+		serverName := strings.ToLower(hello.ServerName)
+		cert, err := hostCertificate(serverName)
+		if err != nil {
+			return nil, err
+		}
+		if cert == nil && !c2s.Instance().IsLocalDomain(serverName) {
+			log.Warnf("tls: requested server name %s doesn't match any host... presenting default certificate", serverName)
+		}
+		return cert, nil
+	}
+	return tlsCfg
+}
+
+// hostCertificate returns the certificate configured for a virtual host,
+// or nil if domain is not a virtual host or it has no certificate of its own.
+func hostCertificate(domain string) (*tls.Certificate, error) {
+	h := host.Instance(domain)
+	if h == nil || len(h.TLS.CertFile) == 0 {
+		return nil, nil
+	}
+	hostCertsMu.Lock()
+	defer hostCertsMu.Unlock()
+	if cert := hostCerts[h.TLS.CertFile]; cert != nil {
+		return cert, nil
+	}
+	tlsCfg, err := util.LoadCertificate(h.TLS.PrivKeyFile, h.TLS.CertFile, h.Name)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tlsCfg.Certificates[0]
+	hostCerts[h.TLS.CertFile] = cert
+	return cert, nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/ortuman/jackal/host"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLS_SNI(t *testing.T) {
+	c2s.Initialize(&c2s.Config{Domains: []string{"localhost", "jackal.im"}})
+	defer c2s.Shutdown()
+
+	host.Initialize([]host.Config{{
+		Name: "jackal.im",
+		TLS: host.TLSConfig{
+			PrivKeyFile: "../testdata/cert/test.jackal.im.key",
+			CertFile:    "../testdata/cert/test.jackal.im.crt",
+		},
+	}})
+	defer host.Shutdown()
+
+	tlsCfg, err := util.LoadCertificate("../testdata/cert/test.server.key", "../testdata/cert/test.server.crt", "localhost")
+	require.Nil(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", withSNI(tlsCfg))
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	peerCommonName := func(serverName string) string {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		require.Nil(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	require.Equal(t, "jackal.im", peerCommonName("jackal.im"))
+	require.Equal(t, "jackal.im", peerCommonName("JACKAL.IM"))
+	require.Equal(t, "localhost", peerCommonName("localhost"))
+
+	// unknown server names fall back to default certificate
+	require.Equal(t, "localhost", peerCommonName("example.org"))
+}
+
+func TestTLS_CipherSuites(t *testing.T) {
+	cfg := TLSConfig{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}}
+
+	tlsCfg, err := util.LoadCertificate("../testdata/cert/test.server.key", "../testdata/cert/test.server.crt", "localhost")
+	require.Nil(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg.apply(tlsCfg))
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	dial := func(version uint16, cipherSuite uint16) (*tls.Conn, error) {
+		return tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         version,
+			MaxVersion:         version,
+			CipherSuites:       []uint16{cipherSuite},
+		})
+	}
+	conn, err := dial(tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384)
+	require.Nil(t, err)
+	require.Equal(t, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, conn.ConnectionState().CipherSuite)
+	conn.Close()
+
+	// client only offering a disabled cipher suite
+	_, err = dial(tls.VersionTLS12, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	require.NotNil(t, err)
+
+	// TLS 1.1 clients are refused by default
+	_, err = dial(tls.VersionTLS11, tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA)
+	require.NotNil(t, err)
+}
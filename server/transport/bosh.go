@@ -0,0 +1,532 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/server/compress"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const (
+	boshNamespace         = "http://jabber.org/protocol/httpbind"
+	xBoshNamespace        = "urn:xmpp:xbosh"
+	framedStreamNamespace = "urn:ietf:params:xml:ns:xmpp-framing"
+	streamNamespace       = "http://etherx.jabber.org/streams"
+)
+
+const (
+	boshVersion       = "1.11"
+	boshMaxHold       = 1
+	boshPolling       = 2
+	boshGCInterval    = time.Second
+	boshResponseCache = boshMaxHold + 1
+)
+
+// BOSH terminal binding conditions (https://xmpp.org/extensions/xep-0124.html#errorstatus-terminal)
+const (
+	boshBadRequest        = "bad-request"
+	boshItemNotFound      = "item-not-found"
+	boshPolicyViolation   = "policy-violation"
+	boshRemoteStreamError = "remote-stream-error"
+	boshHostUnknown       = "host-unknown"
+)
+
+// BoshManager represents a BOSH (XEP-0124/XEP-0206) connection manager.
+// Every BOSH session is exposed as a regular stream transport, so that
+// HTTP bound clients are handled exactly as socket ones.
+type BoshManager struct {
+	maxStanzaSize int
+	maxWait       time.Duration
+	inactivity    time.Duration
+	startStream   func(Transport)
+	acquireFn     func(remoteAddr string) bool
+	releaseFn     func(remoteAddr string)
+	mu            sync.RWMutex
+	sessions      map[string]*boshTransport
+	closeCh       chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewBoshManager returns a BOSH connection manager.
+// startStream will be invoked every time a new BOSH session is created.
+func NewBoshManager(maxStanzaSize, maxWait, inactivity int, startStream func(Transport)) *BoshManager {
+	m := &BoshManager{
+		maxStanzaSize: maxStanzaSize,
+		maxWait:       time.Second * time.Duration(maxWait),
+		inactivity:    time.Second * time.Duration(inactivity),
+		startStream:   startStream,
+		sessions:      make(map[string]*boshTransport),
+		closeCh:       make(chan struct{}),
+	}
+	go m.gcLoop()
+	return m
+}
+
+// SetSessionLimiter sets the handlers used to limit BOSH sessions.
+// acquire is invoked before creating a session requested from remoteAddr,
+// refusing it if returns false, and release once an admitted session is gone.
+func (m *BoshManager) SetSessionLimiter(acquire func(remoteAddr string) bool, release func(remoteAddr string)) {
+	m.acquireFn = acquire
+	m.releaseFn = release
+}
+
+// ServeHTTP satisfies http.Handler interface.
+func (m *BoshManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+
+	switch r.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+		break
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, cond := m.readBody(r)
+	if cond != "" {
+		m.writeBody(w, terminateBody(cond))
+		return
+	}
+	sid := body.Attributes().Get("sid")
+	if len(sid) == 0 {
+		m.createSession(w, body, r.RemoteAddr)
+		return
+	}
+	m.mu.RLock()
+	b := m.sessions[sid]
+	m.mu.RUnlock()
+	if b == nil {
+		m.writeBody(w, terminateBody(boshItemNotFound))
+		return
+	}
+	m.writeBody(w, b.handleRequest(body))
+}
+
+// Close terminates every active BOSH session.
+func (m *BoshManager) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+
+		m.mu.Lock()
+		sessions := m.sessions
+		m.sessions = make(map[string]*boshTransport)
+		m.mu.Unlock()
+
+		for _, b := range sessions {
+			b.expire()
+		}
+	})
+}
+
+func (m *BoshManager) readBody(r *http.Request) (xml.XElement, string) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(m.maxStanzaSize)+1))
+	if err != nil {
+		return nil, boshBadRequest
+	}
+	if len(buf) > m.maxStanzaSize {
+		return nil, boshPolicyViolation
+	}
+	body, err := xml.NewParser(bytes.NewReader(buf)).ParseElement()
+	if err != nil || body == nil {
+		return nil, boshBadRequest
+	}
+	if body.Name() != "body" || body.Namespace() != boshNamespace {
+		return nil, boshBadRequest
+	}
+	if _, err := strconv.ParseInt(body.Attributes().Get("rid"), 10, 64); err != nil {
+		return nil, boshBadRequest
+	}
+	return body, ""
+}
+
+func (m *BoshManager) createSession(w http.ResponseWriter, body xml.XElement, remoteAddr string) {
+	to := body.To()
+	if len(to) == 0 {
+		m.writeBody(w, terminateBody(boshHostUnknown))
+		return
+	}
+	if m.acquireFn != nil && !m.acquireFn(remoteAddr) {
+		m.writeBody(w, terminateBody(boshPolicyViolation))
+		return
+	}
+	rid, _ := strconv.ParseInt(body.Attributes().Get("rid"), 10, 64)
+
+	wait := m.maxWait
+	if v, err := strconv.Atoi(body.Attributes().Get("wait")); err == nil && v >= 0 {
+		if reqWait := time.Second * time.Duration(v); reqWait < wait {
+			wait = reqWait
+		}
+	}
+	hold := boshMaxHold
+	if v, err := strconv.Atoi(body.Attributes().Get("hold")); err == nil && v >= 0 && v < hold {
+		hold = v
+	}
+	b := &boshTransport{
+		sid:          uuid.New(),
+		m:            m,
+		remoteAddr:   remoteAddr,
+		wait:         wait,
+		hold:         hold,
+		rid:          rid,
+		pending:      make(map[int64]xml.XElement),
+		responses:    make(map[int64]xml.XElement),
+		lastActivity: time.Now(),
+	}
+	b.cond = sync.NewCond(&b.mu)
+
+	m.mu.Lock()
+	m.sessions[b.sid] = b
+	m.mu.Unlock()
+
+	log.Infof("bosh: session created... (sid: %s)", b.sid)
+
+	m.startStream(b)
+
+	// session creation request opens the XMPP stream (XEP-0206, section 4)
+	b.mu.Lock()
+	b.push(openElement(to))
+	req := b.holdRequest(rid)
+	b.mu.Unlock()
+
+	m.writeBody(w, b.waitResponse(req))
+}
+
+func (m *BoshManager) writeBody(w http.ResponseWriter, body xml.XElement) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	io.WriteString(w, body.String())
+}
+
+func (m *BoshManager) removeSession(sid string) {
+	m.mu.Lock()
+	delete(m.sessions, sid)
+	m.mu.Unlock()
+}
+
+func (m *BoshManager) gcLoop() {
+	tc := time.NewTicker(boshGCInterval)
+	defer tc.Stop()
+	for {
+		select {
+		case <-tc.C:
+			m.collectInactiveSessions()
+		case <-m.closeCh:
+			return
+		}
+	}
+}
+
+func (m *BoshManager) collectInactiveSessions() {
+	m.mu.RLock()
+	sessions := make([]*boshTransport, 0, len(m.sessions))
+	for _, b := range m.sessions {
+		sessions = append(sessions, b)
+	}
+	m.mu.RUnlock()
+
+	for _, b := range sessions {
+		if b.isInactive(m.inactivity) {
+			log.Infof("bosh: abandoned session collected... (sid: %s)", b.sid)
+			b.expire()
+		}
+	}
+}
+
+type boshRequest struct {
+	rid    int64
+	respCh chan xml.XElement
+}
+
+type boshTransport struct {
+	sid         string
+	m           *BoshManager
+	remoteAddr  string
+	wait        time.Duration
+	hold        int
+	releaseOnce sync.Once
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	rid          int64
+	pending      map[int64]xml.XElement
+	responses    map[int64]xml.XElement
+	inQueue      []xml.XElement
+	outQueue     []xml.XElement
+	held         []*boshRequest
+	authID       string
+	created      bool
+	terminated   bool
+	closed       bool
+	lastActivity time.Time
+}
+
+func (b *boshTransport) ReadElement() (xml.XElement, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.inQueue) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if len(b.inQueue) == 0 {
+		return nil, io.EOF
+	}
+	elem := b.inQueue[0]
+	b.inQueue = b.inQueue[1:]
+	return elem, nil
+}
+
+func (b *boshTransport) WriteString(str string) error {
+	elem, err := xml.NewParser(strings.NewReader(str)).ParseElement()
+	if err != nil || elem == nil || elem.Namespace() != framedStreamNamespace {
+		return err
+	}
+	// stream framing is carried by the session request bodies
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch elem.Name() {
+	case "open":
+		b.authID = elem.ID()
+	case "close":
+		b.terminated = true
+		b.flush()
+	}
+	return nil
+}
+
+func (b *boshTransport) WriteElement(elem xml.XElement, includeClosing bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.terminated {
+		return nil
+	}
+	b.outQueue = append(b.outQueue, elem)
+	b.flush()
+	return nil
+}
+
+func (b *boshTransport) Close() error {
+	b.releaseSession()
+
+	b.mu.Lock()
+	b.terminated = true
+	b.closed = true
+	b.flush()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *boshTransport) StartTLS(cfg *tls.Config) {
+}
+
+func (b *boshTransport) EnableCompression(level compress.Level) {
+}
+
+func (b *boshTransport) ChannelBindingBytes(mechanism ChannelBindingMechanism) []byte {
+	return nil
+}
+
+func (b *boshTransport) PeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+func (b *boshTransport) handleRequest(body xml.XElement) xml.XElement {
+	rid, _ := strconv.ParseInt(body.Attributes().Get("rid"), 10, 64)
+
+	b.mu.Lock()
+	if rid <= b.rid {
+		// retransmitted request... resend previous response
+		resp := b.responses[rid]
+		b.mu.Unlock()
+		if resp == nil {
+			return terminateBody(boshItemNotFound)
+		}
+		return resp
+	}
+	if rid > b.rid+int64(b.hold)+1 || b.pending[rid] != nil {
+		b.mu.Unlock()
+		b.expire()
+		return terminateBody(boshItemNotFound)
+	}
+	// process payloads in 'rid' order
+	b.pending[rid] = body
+	for next := b.pending[b.rid+1]; next != nil; next = b.pending[b.rid+1] {
+		b.rid++
+		delete(b.pending, b.rid)
+		b.processBody(next)
+	}
+	req := b.holdRequest(rid)
+	b.mu.Unlock()
+
+	return b.waitResponse(req)
+}
+
+func (b *boshTransport) processBody(body xml.XElement) {
+	for _, elem := range body.Elements().All() {
+		b.push(elem)
+	}
+	if body.Attributes().Get("xmpp:restart") == "true" {
+		b.push(openElement(body.To()))
+	}
+	if body.Type() == "terminate" {
+		b.push(xml.NewElementNamespace("close", framedStreamNamespace))
+	}
+}
+
+func (b *boshTransport) push(elem xml.XElement) {
+	b.inQueue = append(b.inQueue, elem)
+	b.cond.Signal()
+}
+
+func (b *boshTransport) holdRequest(rid int64) *boshRequest {
+	req := &boshRequest{rid: rid, respCh: make(chan xml.XElement, 1)}
+	b.held = append(b.held, req)
+	b.flush()
+	return req
+}
+
+func (b *boshTransport) waitResponse(req *boshRequest) xml.XElement {
+	tr := time.NewTimer(b.wait)
+	defer tr.Stop()
+
+	select {
+	case resp := <-req.respCh:
+		return resp
+	case <-tr.C:
+		break
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case resp := <-req.respCh:
+		return resp // delivered meanwhile...
+	default:
+		for i, r := range b.held {
+			if r == req {
+				b.held = append(b.held[:i], b.held[i+1:]...)
+				break
+			}
+		}
+		resp := b.responseBody()
+		b.cacheResponse(req.rid, resp)
+		if len(b.held) == 0 {
+			b.lastActivity = time.Now()
+		}
+		return resp
+	}
+}
+
+func (b *boshTransport) flush() {
+	for len(b.held) > 0 && (len(b.outQueue) > 0 || b.terminated || len(b.held) > b.hold) {
+		req := b.held[0]
+		b.held = b.held[1:]
+
+		resp := b.responseBody()
+		b.cacheResponse(req.rid, resp)
+		req.respCh <- resp
+	}
+	if len(b.held) == 0 {
+		b.lastActivity = time.Now()
+		if b.terminated {
+			b.m.removeSession(b.sid)
+		}
+	}
+}
+
+func (b *boshTransport) responseBody() xml.XElement {
+	body := xml.NewElementNamespace("body", boshNamespace)
+	if !b.created {
+		// session creation response (https://xmpp.org/extensions/xep-0124.html#session-create)
+		body.SetAttribute("xmlns:xmpp", xBoshNamespace)
+		body.SetAttribute("xmlns:stream", streamNamespace)
+		body.SetAttribute("sid", b.sid)
+		body.SetAttribute("wait", strconv.Itoa(int(b.wait/time.Second)))
+		body.SetAttribute("hold", strconv.Itoa(b.hold))
+		body.SetAttribute("requests", strconv.Itoa(b.hold+1))
+		body.SetAttribute("inactivity", strconv.Itoa(int(b.m.inactivity/time.Second)))
+		body.SetAttribute("polling", strconv.Itoa(boshPolling))
+		body.SetAttribute("maxpause", strconv.Itoa(int(b.m.inactivity/time.Second)))
+		body.SetAttribute("ver", boshVersion)
+		body.SetAttribute("authid", b.authID)
+		body.SetAttribute("xmpp:version", "1.0")
+		body.SetAttribute("xmpp:restartlogic", "true")
+		b.created = true
+	}
+	if b.terminated {
+		body.SetAttribute("type", "terminate")
+		for _, elem := range b.outQueue {
+			if elem.Name() == "stream:error" {
+				body.SetAttribute("condition", boshRemoteStreamError)
+				body.SetAttribute("xmlns:stream", streamNamespace)
+				break
+			}
+		}
+	}
+	body.AppendElements(b.outQueue)
+	b.outQueue = nil
+	return body
+}
+
+func (b *boshTransport) cacheResponse(rid int64, resp xml.XElement) {
+	b.responses[rid] = resp
+	delete(b.responses, rid-boshResponseCache)
+}
+
+func (b *boshTransport) isInactive(inactivity time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.terminated && len(b.held) == 0 {
+		return true
+	}
+	return len(b.held) == 0 && time.Since(b.lastActivity) > inactivity
+}
+
+func (b *boshTransport) expire() {
+	b.m.removeSession(b.sid)
+	b.releaseSession()
+
+	b.mu.Lock()
+	b.terminated = true
+	b.closed = true
+	b.flush()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// releaseSession releases session limiter slot, if any.
+func (b *boshTransport) releaseSession() {
+	if b.m.releaseFn != nil {
+		b.releaseOnce.Do(func() { b.m.releaseFn(b.remoteAddr) })
+	}
+}
+
+func openElement(to string) xml.XElement {
+	open := xml.NewElementNamespace("open", framedStreamNamespace)
+	open.SetTo(to)
+	open.SetVersion("1.0")
+	return open
+}
+
+func terminateBody(condition string) xml.XElement {
+	body := xml.NewElementNamespace("body", boshNamespace)
+	body.SetType("terminate")
+	body.SetAttribute("condition", condition)
+	return body
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoshTransport_Session(t *testing.T) {
+	trCh := make(chan Transport, 1)
+	m := NewBoshManager(8192, 1, 5, func(tr Transport) { trCh <- tr })
+	defer m.Close()
+
+	respCh := tUtilBoshRequest(m, `<body xmlns="http://jabber.org/protocol/httpbind" rid="100" to="jackal.im" wait="1" hold="1" xmpp:version="1.0" xmlns:xmpp="urn:xmpp:xbosh"/>`)
+	tr := <-trCh
+
+	// session creation opens the stream
+	elem, err := tr.ReadElement()
+	require.Nil(t, err)
+	require.Equal(t, "open", elem.Name())
+	require.Equal(t, framedStreamNamespace, elem.Namespace())
+	require.Equal(t, "jackal.im", elem.To())
+
+	tr.WriteString(`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" id="s1" from="jackal.im" version="1.0"/>`)
+	tr.WriteElement(xml.NewElementName("stream:features"), true)
+
+	body := <-respCh
+	sid := body.Attributes().Get("sid")
+	require.NotEqual(t, "", sid)
+	require.Equal(t, "s1", body.Attributes().Get("authid"))
+	require.Equal(t, "1", body.Attributes().Get("wait"))
+	require.Equal(t, "2", body.Attributes().Get("requests"))
+	require.NotNil(t, body.Elements().Child("stream:features"))
+
+	// out of order requests are processed in 'rid' order
+	respCh2 := tUtilBoshRequest(m, fmt.Sprintf(`<body xmlns="http://jabber.org/protocol/httpbind" rid="102" sid="%s"><iq id="2"/></body>`, sid))
+	time.Sleep(time.Millisecond * 50)
+	respCh1 := tUtilBoshRequest(m, fmt.Sprintf(`<body xmlns="http://jabber.org/protocol/httpbind" rid="101" sid="%s"><iq id="1"/></body>`, sid))
+
+	elem, _ = tr.ReadElement()
+	require.Equal(t, "1", elem.ID())
+	elem, _ = tr.ReadElement()
+	require.Equal(t, "2", elem.ID())
+
+	// oldest held request is released when exceeding 'hold'
+	body = <-respCh2
+	require.Equal(t, 0, body.Elements().Count())
+
+	msg := xml.NewMessageType("m1", xml.ChatType)
+	tr.WriteElement(msg, true)
+	body = <-respCh1
+	require.Equal(t, "m1", body.Elements().Child("message").ID())
+
+	// retransmitted request
+	body = <-tUtilBoshRequest(m, fmt.Sprintf(`<body xmlns="http://jabber.org/protocol/httpbind" rid="101" sid="%s"/>`, sid))
+	require.Equal(t, "m1", body.Elements().Child("message").ID())
+
+	// stream restart
+	respCh = tUtilBoshRequest(m, fmt.Sprintf(`<body xmlns="http://jabber.org/protocol/httpbind" rid="103" sid="%s" to="jackal.im" xmpp:restart="true" xmlns:xmpp="urn:xmpp:xbosh"/>`, sid))
+	elem, _ = tr.ReadElement()
+	require.Equal(t, "open", elem.Name())
+	body = <-respCh
+	require.Equal(t, "", body.Type())
+
+	// session termination
+	respCh = tUtilBoshRequest(m, fmt.Sprintf(`<body xmlns="http://jabber.org/protocol/httpbind" rid="104" sid="%s" type="terminate"><presence type="unavailable"/></body>`, sid))
+	elem, _ = tr.ReadElement()
+	require.Equal(t, "presence", elem.Name())
+	elem, _ = tr.ReadElement()
+	require.Equal(t, "close", elem.Name())
+
+	tr.WriteString(`<close xmlns="urn:ietf:params:xml:ns:xmpp-framing" />`)
+	tr.Close()
+	body = <-respCh
+	require.Equal(t, "terminate", body.Type())
+
+	_, err = tr.ReadElement()
+	require.Equal(t, io.EOF, err)
+
+	body = <-tUtilBoshRequest(m, fmt.Sprintf(`<body xmlns="http://jabber.org/protocol/httpbind" rid="105" sid="%s"/>`, sid))
+	require.Equal(t, "terminate", body.Type())
+	require.Equal(t, boshItemNotFound, body.Attributes().Get("condition"))
+}
+
+func TestBoshTransport_BadRequests(t *testing.T) {
+	trCh := make(chan Transport, 1)
+	m := NewBoshManager(256, 1, 5, func(tr Transport) { trCh <- tr })
+	defer m.Close()
+
+	for req, cond := range map[string]string{
+		`<body xmlns="http://jabber.org/protocol/httpbind" to="jackal.im"/>`:                                boshBadRequest,
+		`<iq xmlns="http://jabber.org/protocol/httpbind" rid="1" to="jackal.im"/>`:                          boshBadRequest,
+		`<body xmlns="http://jabber.org/protocol/httpbind" rid="1"/>`:                                       boshHostUnknown,
+		`<body xmlns="http://jabber.org/protocol/httpbind" rid="1" sid="unknown"/>`:                         boshItemNotFound,
+		`<body xmlns="http://jabber.org/protocol/httpbind" rid="1">` + strings.Repeat("a", 256) + `</body>`: boshPolicyViolation,
+	} {
+		body := <-tUtilBoshRequest(m, req)
+		require.Equal(t, "terminate", body.Type())
+		require.Equal(t, cond, body.Attributes().Get("condition"))
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/http-bind", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// 'rid' out of window
+	respCh := tUtilBoshRequest(m, `<body xmlns="http://jabber.org/protocol/httpbind" rid="1" to="jackal.im"/>`)
+	tr := <-trCh
+	tr.ReadElement()
+	tr.WriteElement(xml.NewElementName("stream:features"), true)
+	sid := (<-respCh).Attributes().Get("sid")
+
+	body := <-tUtilBoshRequest(m, fmt.Sprintf(`<body xmlns="http://jabber.org/protocol/httpbind" rid="9" sid="%s"/>`, sid))
+	require.Equal(t, boshItemNotFound, body.Attributes().Get("condition"))
+
+	_, err := tr.ReadElement()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestBoshTransport_Inactivity(t *testing.T) {
+	trCh := make(chan Transport, 1)
+	m := NewBoshManager(8192, 1, 1, func(tr Transport) { trCh <- tr })
+	defer m.Close()
+
+	respCh := tUtilBoshRequest(m, `<body xmlns="http://jabber.org/protocol/httpbind" rid="1" to="jackal.im"/>`)
+	tr := <-trCh
+	tr.ReadElement()
+	tr.WriteElement(xml.NewElementName("stream:features"), true)
+	<-respCh
+
+	// abandoned session gets collected
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := tr.ReadElement()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		require.Equal(t, io.EOF, err)
+	case <-time.After(time.Second * 5):
+		require.Fail(t, "BOSH session not collected")
+	}
+	m.mu.RLock()
+	require.Equal(t, 0, len(m.sessions))
+	m.mu.RUnlock()
+}
+
+func TestBoshTransport_SessionLimiter(t *testing.T) {
+	trCh := make(chan Transport, 1)
+	m := NewBoshManager(8192, 1, 5, func(tr Transport) { trCh <- tr })
+	defer m.Close()
+
+	var mu sync.Mutex
+	sessions := 0
+	m.SetSessionLimiter(func(remoteAddr string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if sessions == 1 {
+			return false
+		}
+		sessions++
+		return true
+	}, func(remoteAddr string) {
+		mu.Lock()
+		sessions--
+		mu.Unlock()
+	})
+	respCh := tUtilBoshRequest(m, `<body xmlns="http://jabber.org/protocol/httpbind" rid="1" to="jackal.im"/>`)
+	tr := <-trCh
+	tr.ReadElement()
+	tr.WriteElement(xml.NewElementName("stream:features"), true)
+	<-respCh
+
+	// limit reached
+	body := <-tUtilBoshRequest(m, `<body xmlns="http://jabber.org/protocol/httpbind" rid="1" to="jackal.im"/>`)
+	require.Equal(t, "terminate", body.Type())
+	require.Equal(t, boshPolicyViolation, body.Attributes().Get("condition"))
+
+	// closed sessions release their slot
+	tr.Close()
+	tr.Close()
+
+	mu.Lock()
+	require.Equal(t, 0, sessions)
+	mu.Unlock()
+
+	respCh = tUtilBoshRequest(m, `<body xmlns="http://jabber.org/protocol/httpbind" rid="1" to="jackal.im"/>`)
+	tr = <-trCh
+	tr.ReadElement()
+	tr.WriteElement(xml.NewElementName("stream:features"), true)
+	require.NotEqual(t, "", (<-respCh).Attributes().Get("sid"))
+}
+
+func tUtilBoshRequest(m *BoshManager, body string) <-chan xml.XElement {
+	respCh := make(chan xml.XElement, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/http-bind", strings.NewReader(body)))
+		elem, _ := xml.NewParser(bytes.NewReader(rec.Body.Bytes())).ParseElement()
+		respCh <- elem
+	}()
+	return respCh
+}
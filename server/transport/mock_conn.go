@@ -129,6 +129,12 @@ func (mc *MockConn) Close() error {
 	return nil
 }
 
+// Break makes every subsequent write operation fail,
+// mocking an unreachable peer.
+func (mc *MockConn) Break() {
+	mc.clPipe.r.Close()
+}
+
 // WaitClose expects until the mocked connection closes.
 func (mc *MockConn) WaitClose() bool {
 	return mc.WaitCloseWithTimeout(time.Second)
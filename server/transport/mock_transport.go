@@ -9,6 +9,7 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"sync"
 
 	"github.com/ortuman/jackal/server/compress"
@@ -23,6 +24,7 @@ type MockTransport struct {
 	br            *bufio.Reader
 	bw            *bufio.Writer
 	cBindingBytes []byte
+	peerCerts     []*x509.Certificate
 	closed        bool
 	secured       bool
 	compressed    bool
@@ -138,3 +140,17 @@ func (mt *MockTransport) SetChannelBindingBytes(cBindingBytes []byte) {
 	mt.cBindingBytes = cBindingBytes
 	mt.mu.Unlock()
 }
+
+// PeerCertificates returns mocked transport peer certificates.
+func (mt *MockTransport) PeerCertificates() []*x509.Certificate {
+	mt.mu.RLock()
+	defer mt.mu.RUnlock()
+	return mt.peerCerts
+}
+
+// SetPeerCertificates sets mocked transport peer certificates.
+func (mt *MockTransport) SetPeerCertificates(peerCerts []*x509.Certificate) {
+	mt.mu.Lock()
+	mt.peerCerts = peerCerts
+	mt.mu.Unlock()
+}
@@ -7,8 +7,8 @@ package transport
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"strings"
@@ -22,12 +22,11 @@ type socketTransport struct {
 	conn               net.Conn
 	rw                 io.ReadWriter
 	bw                 *bufio.Writer
-	r                  *bytes.Reader
-	rbuf               []byte
 	p                  *xml.Parser
 	maxStanzaSize      int
 	keepAlive          int
 	compressionEnabled bool
+	isClient           bool
 }
 
 // NewSocketTransport creates a socket class stream transport.
@@ -36,17 +35,27 @@ func NewSocketTransport(conn net.Conn, maxStanzaSize, keepAlive int) Transport {
 		conn:          conn,
 		rw:            conn,
 		bw:            bufio.NewWriter(conn),
-		rbuf:          make([]byte, maxStanzaSize+1),
 		maxStanzaSize: maxStanzaSize,
 		keepAlive:     keepAlive,
 	}
 	return s
 }
 
+// NewClientSocketTransport creates a socket class stream transport
+// for an outgoing connection, acting as TLS client when secured.
+func NewClientSocketTransport(conn net.Conn, maxStanzaSize, keepAlive int) Transport {
+	s := NewSocketTransport(conn, maxStanzaSize, keepAlive).(*socketTransport)
+	s.isClient = true
+	return s
+}
+
 func (s *socketTransport) ReadElement() (xml.XElement, error) {
-	if err := s.readFromConn(); err != nil {
-		return nil, err
+	if s.p == nil {
+		// elements may span several reads, so parser state
+		// is kept until the underlying reader changes
+		s.p = xml.NewLimitedParser(s.rw, s.maxStanzaSize)
 	}
+	s.conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(s.keepAlive)))
 	return s.p.ParseElement()
 }
 
@@ -56,9 +65,8 @@ func (s *socketTransport) WriteString(str string) error {
 }
 
 func (s *socketTransport) WriteElement(elem xml.XElement, includeClosing bool) error {
-	defer s.bw.Flush()
 	elem.ToXML(s.bw, includeClosing)
-	return nil
+	return s.bw.Flush()
 }
 
 func (s *socketTransport) Close() error {
@@ -67,10 +75,14 @@ func (s *socketTransport) Close() error {
 
 func (s *socketTransport) StartTLS(cfg *tls.Config) {
 	if _, ok := s.conn.(*tls.Conn); !ok {
-		s.conn = tls.Server(s.conn, cfg)
+		if s.isClient {
+			s.conn = tls.Client(s.conn, cfg)
+		} else {
+			s.conn = tls.Server(s.conn, cfg)
+		}
 		s.rw = s.conn
 		s.bw.Reset(s.rw)
-		s.r = nil
+		s.p = nil
 	}
 }
 
@@ -78,7 +90,7 @@ func (s *socketTransport) EnableCompression(level compress.Level) {
 	if !s.compressionEnabled {
 		s.rw = compress.NewZlibCompressor(s.rw, s.rw, level)
 		s.bw.Reset(s.rw)
-		s.r = nil
+		s.p = nil
 		s.compressionEnabled = true
 	}
 }
@@ -96,19 +108,9 @@ func (s *socketTransport) ChannelBindingBytes(mechanism ChannelBindingMechanism)
 	return nil
 }
 
-func (s *socketTransport) readFromConn() error {
-	if s.r != nil && s.r.Len() > 0 {
-		return nil // remaining bytes in buffer...
-	}
-	s.conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(s.keepAlive)))
-	n, err := s.rw.Read(s.rbuf)
-	if err != nil {
-		return err
-	}
-	if n > s.maxStanzaSize {
-		return ErrTooLargeStanza
+func (s *socketTransport) PeerCertificates() []*x509.Certificate {
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState().PeerCertificates
 	}
-	s.r = bytes.NewReader(s.rbuf[:n])
-	s.p = xml.NewParser(s.r)
 	return nil
 }
@@ -8,6 +8,7 @@ package transport
 import (
 	"bytes"
 	"crypto/tls"
+	"strings"
 	"testing"
 
 	"github.com/ortuman/jackal/server/compress"
@@ -44,3 +45,24 @@ func TestSocket(t *testing.T) {
 	st.Close()
 	require.True(t, mc.IsClosed())
 }
+
+func TestSocket_MaxStanzaSize(t *testing.T) {
+	mc := NewMockConn()
+	st := NewSocketTransport(mc, 1024, 120)
+
+	// element spanning several reads
+	elem := xml.NewElementNamespace("elem", "exodus:ns")
+	elem.SetText(strings.Repeat("a", 512))
+	b := []byte(elem.String())
+	mc.ClientWriteBytes(b[:100])
+	mc.ClientWriteBytes(b[100:])
+
+	el, err := st.ReadElement()
+	require.Nil(t, err)
+	require.Equal(t, elem.String(), el.String())
+
+	elem.SetText(strings.Repeat("a", 8192))
+	mc.ClientWriteBytes([]byte(elem.String()))
+	_, err = st.ReadElement()
+	require.Equal(t, ErrTooLargeStanza, err)
+}
@@ -7,6 +7,7 @@ package transport
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 
@@ -14,9 +15,15 @@ import (
 	"github.com/ortuman/jackal/xml"
 )
 
-// ErrTooLargeStanza is returned by ReadElement when the size of
-// the received stanza is too large.
-var ErrTooLargeStanza = errors.New("too large stanza")
+var (
+	// ErrTooLargeStanza is returned by ReadElement when the size of
+	// the received stanza is too large.
+	ErrTooLargeStanza = xml.ErrTooLargeStanza
+
+	// ErrTruncatedStanza is returned by ReadElement when a framed
+	// transport message doesn't carry a whole element.
+	ErrTruncatedStanza = errors.New("truncated stanza")
+)
 
 // TransportType represents a stream transport type (socket).
 type TransportType int
@@ -27,6 +34,9 @@ const (
 
 	// WebSocket represents a websocket transport type.
 	WebSocket
+
+	// Bosh represents a BOSH (HTTP binding) transport type.
+	Bosh
 )
 
 // String returns TransportType string representation.
@@ -36,6 +46,8 @@ func (tt TransportType) String() string {
 		return "socket"
 	case WebSocket:
 		return "websocket"
+	case Bosh:
+		return "bosh"
 	}
 	return ""
 }
@@ -72,4 +84,8 @@ type Transport interface {
 	// ChannelBindingBytes returns current transport
 	// channel binding bytes.
 	ChannelBindingBytes(ChannelBindingMechanism) []byte
+
+	// PeerCertificates returns the certificate chain
+	// presented by the remote peer, if any.
+	PeerCertificates() []*x509.Certificate
 }
@@ -8,6 +8,7 @@ package transport
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"strings"
@@ -51,7 +52,11 @@ func (wst *websocketTransport) ReadElement() (xml.XElement, error) {
 	if err := wst.readFromConn(); err != nil {
 		return nil, err
 	}
-	return wst.p.ParseElement()
+	elem, err := wst.p.ParseElement()
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedStanza
+	}
+	return elem, err
 }
 
 func (wst *websocketTransport) WriteString(str string) error {
@@ -97,22 +102,33 @@ func (wst *websocketTransport) ChannelBindingBytes(mechanism ChannelBindingMecha
 	return nil
 }
 
+func (wst *websocketTransport) PeerCertificates() []*x509.Certificate {
+	if tlsConn, ok := wst.conn.UnderlyingConn().(*tls.Conn); ok {
+		return tlsConn.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
 func (wst *websocketTransport) readFromConn() error {
 	if wst.r != nil && wst.r.Len() > 0 {
 		return nil // remaining bytes in buffer...
 	}
+	wst.conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(wst.keepAlive)))
 	_, r, err := wst.conn.NextReader()
 	if err != nil {
 		return err
 	}
-	n, err := r.Read(wst.rbuf)
-	if err != nil {
-		return err
-	}
-	if n > wst.maxStanzaSize {
+	// every websocket message carries a whole framed element (RFC 7395)
+	n, err := io.ReadFull(r, wst.rbuf)
+	switch err {
+	case nil:
 		return ErrTooLargeStanza
+	case io.EOF, io.ErrUnexpectedEOF:
+		break
+	default:
+		return err
 	}
 	wst.r = bytes.NewReader(wst.rbuf[:n])
-	wst.p = xml.NewParser(wst.r)
+	wst.p = xml.NewLimitedParser(wst.r, wst.maxStanzaSize)
 	return nil
 }
@@ -82,3 +82,26 @@ func TestWebSocketTransport(t *testing.T) {
 	wst.Close()
 	require.True(t, conn.closed)
 }
+
+func TestWebSocketTransportTooLargeStanza(t *testing.T) {
+	conn := newFakeWebSocketConn()
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	b := xml.NewElementName("body")
+	b.SetText("Hi buddy!")
+	msg.AppendElement(b)
+	msg.ToXML(conn.r.buf, true)
+
+	wst := NewWebSocketTransport(conn, 16, 10)
+	_, err := wst.ReadElement()
+	require.Equal(t, ErrTooLargeStanza, err)
+}
+
+func TestWebSocketTransportTruncatedStanza(t *testing.T) {
+	conn := newFakeWebSocketConn()
+	conn.r.buf.WriteString(`<message type="chat"><body>Hi buddy!</body>`)
+
+	wst := NewWebSocketTransport(conn, 16384, 10)
+	_, err := wst.ReadElement()
+	require.Equal(t, ErrTruncatedStanza, err)
+}
@@ -0,0 +1,9 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds salted SCRAM-SHA-256 credentials column to databases created
+-- before v0.3.0. Existing users get their credentials derived on next login.
+
+ALTER TABLE users ADD COLUMN scram_sha_256 VARCHAR(256) NOT NULL DEFAULT '' AFTER password;
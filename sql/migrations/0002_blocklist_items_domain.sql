@@ -0,0 +1,10 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds domain block flag column to databases created before v0.3.0.
+-- Existing domain JID items are flagged as domain blocks.
+
+ALTER TABLE blocklist_items ADD COLUMN domain BOOL NOT NULL DEFAULT 0 AFTER jid;
+UPDATE blocklist_items SET domain = 1 WHERE jid NOT LIKE '%@%' AND jid NOT LIKE '%/%';
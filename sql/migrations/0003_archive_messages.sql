@@ -0,0 +1,17 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds the message archive (XEP-0313) table to databases created before v0.3.0.
+
+CREATE TABLE IF NOT EXISTS archive_messages (
+    serial BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    id VARCHAR(36) NOT NULL,
+    username VARCHAR(256) NOT NULL,
+    jid VARCHAR(512) NOT NULL,
+    data MEDIUMTEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    UNIQUE KEY (id),
+    INDEX i_archive_messages_username_created_at (username, created_at)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
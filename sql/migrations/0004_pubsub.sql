@@ -0,0 +1,26 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds the personal eventing (XEP-0163) node and item tables to databases created before v0.3.0.
+
+CREATE TABLE IF NOT EXISTS pubsub_nodes (
+    host VARCHAR(256) NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    access_model VARCHAR(32) NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (host, name)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS pubsub_items (
+    host VARCHAR(256) NOT NULL,
+    node VARCHAR(256) NOT NULL,
+    item_id VARCHAR(256) NOT NULL,
+    publisher VARCHAR(512) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (host, node, item_id)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
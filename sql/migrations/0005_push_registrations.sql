@@ -0,0 +1,15 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds the push notifications (XEP-0357) registrations table to databases created before v0.3.0.
+
+CREATE TABLE IF NOT EXISTS push_registrations (
+    username VARCHAR(256) NOT NULL,
+    jid VARCHAR(256) NOT NULL,
+    node VARCHAR(256) NOT NULL,
+    options TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, jid, node)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
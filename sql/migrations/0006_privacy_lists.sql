@@ -0,0 +1,29 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds the privacy lists (XEP-0016) tables to databases created before v0.3.0.
+
+CREATE TABLE IF NOT EXISTS privacy_lists (
+    username VARCHAR(256) NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    is_default BOOL NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, name)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS privacy_list_items (
+    username VARCHAR(256) NOT NULL,
+    list VARCHAR(256) NOT NULL,
+    ord INT NOT NULL,
+    type VARCHAR(16) NOT NULL,
+    value VARCHAR(512) NOT NULL,
+    action VARCHAR(8) NOT NULL,
+    message BOOL NOT NULL,
+    iq BOOL NOT NULL,
+    presence_in BOOL NOT NULL,
+    presence_out BOOL NOT NULL,
+    PRIMARY KEY (username, list, ord)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
@@ -0,0 +1,9 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds the indexes used by the storage retention job to databases created before v0.3.0.
+
+CREATE INDEX i_offline_messages_created_at ON offline_messages(created_at);
+CREATE INDEX i_archive_messages_created_at ON archive_messages(created_at);
@@ -0,0 +1,14 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds the entity capabilities (XEP-0115) cache table to databases created before v0.3.0.
+
+CREATE TABLE IF NOT EXISTS capabilities (
+    node VARCHAR(256) NOT NULL,
+    ver VARCHAR(256) NOT NULL,
+    features TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (node, ver)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
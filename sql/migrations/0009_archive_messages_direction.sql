@@ -0,0 +1,11 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds archived messages direction column to databases created before v0.3.0.
+-- Archive identifiers are unique per user, as both sender and recipient
+-- archive a message under its server assigned stanza-id.
+
+ALTER TABLE archive_messages ADD COLUMN direction VARCHAR(8) NOT NULL DEFAULT '' AFTER data;
+ALTER TABLE archive_messages DROP INDEX id, ADD UNIQUE KEY (username, id);
@@ -0,0 +1,8 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds block list items report reason column to databases created before v0.3.0.
+
+ALTER TABLE blocklist_items ADD COLUMN reason VARCHAR(16) NOT NULL DEFAULT '' AFTER domain;
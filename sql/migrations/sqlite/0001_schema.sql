@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Initial SQLite schema, equivalent to sql/mysql.sql.
+
+CREATE TABLE IF NOT EXISTS users (
+    username TEXT PRIMARY KEY,
+    password TEXT NOT NULL,
+    scram_sha_256 TEXT NOT NULL DEFAULT '',
+    logged_out_status TEXT NOT NULL,
+    logged_out_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS roster_notifications (
+    contact TEXT NOT NULL,
+    jid TEXT NOT NULL,
+    elements TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (contact, jid)
+);
+
+CREATE INDEX IF NOT EXISTS i_roster_notifications_jid ON roster_notifications(jid);
+
+CREATE TABLE IF NOT EXISTS roster_items (
+    username TEXT NOT NULL,
+    jid TEXT NOT NULL,
+    name TEXT NOT NULL,
+    subscription TEXT NOT NULL,
+    groups TEXT NOT NULL,
+    ask BOOL NOT NULL,
+    ver INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, jid)
+);
+
+CREATE INDEX IF NOT EXISTS i_roster_items_username ON roster_items(username);
+CREATE INDEX IF NOT EXISTS i_roster_items_jid ON roster_items(jid);
+
+CREATE TABLE IF NOT EXISTS roster_versions (
+    username TEXT NOT NULL,
+    ver INTEGER NOT NULL DEFAULT 0,
+    last_deletion_ver INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username)
+);
+
+CREATE TABLE IF NOT EXISTS blocklist_items (
+    username TEXT NOT NULL,
+    jid TEXT NOT NULL,
+    domain BOOL NOT NULL DEFAULT 0,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, jid)
+);
+
+CREATE INDEX IF NOT EXISTS i_blocklist_items_username ON blocklist_items(username);
+
+CREATE TABLE IF NOT EXISTS private_storage (
+    username TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    data TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, namespace)
+);
+
+CREATE INDEX IF NOT EXISTS i_private_storage_username ON private_storage(username);
+
+CREATE TABLE IF NOT EXISTS vcards (
+    username TEXT PRIMARY KEY,
+    vcard TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS offline_messages (
+    username TEXT NOT NULL,
+    data TEXT NOT NULL,
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS i_offline_messages_username ON offline_messages(username);
+CREATE INDEX IF NOT EXISTS i_offline_messages_created_at ON offline_messages(created_at);
+
+CREATE TABLE IF NOT EXISTS archive_messages (
+    serial INTEGER PRIMARY KEY AUTOINCREMENT,
+    id TEXT NOT NULL,
+    username TEXT NOT NULL,
+    jid TEXT NOT NULL,
+    data TEXT NOT NULL,
+    direction TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    UNIQUE (username, id)
+);
+
+CREATE INDEX IF NOT EXISTS i_archive_messages_username_created_at ON archive_messages(username, created_at);
+CREATE INDEX IF NOT EXISTS i_archive_messages_created_at ON archive_messages(created_at);
+
+CREATE TABLE IF NOT EXISTS capabilities (
+    node TEXT NOT NULL,
+    ver TEXT NOT NULL,
+    features TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (node, ver)
+);
+
+CREATE TABLE IF NOT EXISTS pubsub_nodes (
+    host TEXT NOT NULL,
+    name TEXT NOT NULL,
+    access_model TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (host, name)
+);
+
+CREATE TABLE IF NOT EXISTS pubsub_items (
+    host TEXT NOT NULL,
+    node TEXT NOT NULL,
+    item_id TEXT NOT NULL,
+    publisher TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (host, node, item_id)
+);
+
+CREATE TABLE IF NOT EXISTS push_registrations (
+    username TEXT NOT NULL,
+    jid TEXT NOT NULL,
+    node TEXT NOT NULL,
+    options TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, jid, node)
+);
+
+CREATE TABLE IF NOT EXISTS privacy_lists (
+    username TEXT NOT NULL,
+    name TEXT NOT NULL,
+    is_default BOOL NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, name)
+);
+
+CREATE TABLE IF NOT EXISTS privacy_list_items (
+    username TEXT NOT NULL,
+    list TEXT NOT NULL,
+    ord INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    value TEXT NOT NULL,
+    action TEXT NOT NULL,
+    message BOOL NOT NULL,
+    iq BOOL NOT NULL,
+    presence_in BOOL NOT NULL,
+    presence_out BOOL NOT NULL,
+    PRIMARY KEY (username, list, ord)
+);
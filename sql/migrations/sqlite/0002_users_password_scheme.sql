@@ -0,0 +1,9 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+-- Adds the stored password hashing scheme column.
+-- Existing passwords are flagged as plaintext, and get hashed on next login.
+
+ALTER TABLE users ADD COLUMN password_scheme TEXT NOT NULL DEFAULT '';
@@ -6,6 +6,8 @@
 CREATE TABLE IF NOT EXISTS users (
     username VARCHAR(256) PRIMARY KEY,
     password TEXT NOT NULL,
+    password_scheme VARCHAR(16) NOT NULL DEFAULT '',
+    scram_sha_256 VARCHAR(256) NOT NULL DEFAULT '',
     logged_out_status TEXT NOT NULL,
     logged_out_at DATETIME NOT NULL,
     updated_at DATETIME NOT NULL,
@@ -51,6 +53,8 @@ CREATE TABLE roster_versions (
 CREATE TABLE IF NOT EXISTS blocklist_items (
     username VARCHAR(256) NOT NULL,
     jid VARCHAR(512) NOT NULL,
+    domain BOOL NOT NULL DEFAULT 0,
+    reason VARCHAR(16) NOT NULL DEFAULT '',
     created_at DATETIME NOT NULL,
     PRIMARY KEY(username, jid)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
@@ -82,3 +86,100 @@ CREATE TABLE IF NOT EXISTS offline_messages (
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
 CREATE INDEX i_offline_messages_username ON offline_messages(username);
+CREATE INDEX i_offline_messages_created_at ON offline_messages(created_at);
+
+CREATE TABLE IF NOT EXISTS archive_messages (
+    serial BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    id VARCHAR(36) NOT NULL,
+    username VARCHAR(256) NOT NULL,
+    jid VARCHAR(512) NOT NULL,
+    data MEDIUMTEXT NOT NULL,
+    direction VARCHAR(8) NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    UNIQUE KEY (username, id)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE INDEX i_archive_messages_username_created_at ON archive_messages(username, created_at);
+CREATE INDEX i_archive_messages_created_at ON archive_messages(created_at);
+
+CREATE TABLE IF NOT EXISTS capabilities (
+    node VARCHAR(256) NOT NULL,
+    ver VARCHAR(256) NOT NULL,
+    features TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (node, ver)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS pubsub_nodes (
+    host VARCHAR(256) NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    access_model VARCHAR(32) NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (host, name)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS pubsub_items (
+    host VARCHAR(256) NOT NULL,
+    node VARCHAR(256) NOT NULL,
+    item_id VARCHAR(256) NOT NULL,
+    publisher VARCHAR(512) NOT NULL,
+    payload MEDIUMTEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (host, node, item_id)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS push_registrations (
+    username VARCHAR(256) NOT NULL,
+    jid VARCHAR(256) NOT NULL,
+    node VARCHAR(256) NOT NULL,
+    options TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, jid, node)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS privacy_lists (
+    username VARCHAR(256) NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    is_default BOOL NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (username, name)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS privacy_list_items (
+    username VARCHAR(256) NOT NULL,
+    list VARCHAR(256) NOT NULL,
+    ord INT NOT NULL,
+    type VARCHAR(16) NOT NULL,
+    value VARCHAR(512) NOT NULL,
+    action VARCHAR(8) NOT NULL,
+    message BOOL NOT NULL,
+    iq BOOL NOT NULL,
+    presence_in BOOL NOT NULL,
+    presence_out BOOL NOT NULL,
+    PRIMARY KEY (username, list, ord)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS schema_version (
+    version INT NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    applied_at DATETIME NOT NULL,
+    PRIMARY KEY (version)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+-- This schema already includes every migration under sql/migrations.
+
+INSERT IGNORE INTO schema_version (version, name, applied_at) VALUES
+    (1, 'users_scram_sha_256', NOW()),
+    (2, 'blocklist_items_domain', NOW()),
+    (3, 'archive_messages', NOW()),
+    (4, 'pubsub', NOW()),
+    (5, 'push_registrations', NOW()),
+    (6, 'privacy_lists', NOW()),
+    (7, 'retention_indexes', NOW()),
+    (8, 'capabilities', NOW()),
+    (9, 'archive_messages_direction', NOW()),
+    (10, 'blocklist_items_reason', NOW()),
+    (11, 'users_password_scheme', NOW());
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// ErrArchiveMessageNotFound is returned when a paging reference
+// does not match any archived message.
+var ErrArchiveMessageNotFound = errors.New("storage archive message not found")
+
+// ArchiveFilters represents the set of filters applied
+// when fetching archived messages.
+type ArchiveFilters struct {
+	// With restricts results to messages exchanged with this JID.
+	// A bare JID matches every resource, while a full JID must match exactly.
+	With string
+
+	// Start and End restrict results to a time interval.
+	Start time.Time
+	End   time.Time
+
+	// After and Before restrict results to messages archived
+	// after or before the given archive message identifier.
+	After  string
+	Before string
+
+	// LastPage requests the last page of results (empty RSM 'before' element).
+	LastPage bool
+
+	// Max limits the number of returned messages. A zero value means no limit.
+	Max int
+}
+
+// IsBackwards returns whether or not results should be paged backwards.
+func (f *ArchiveFilters) IsBackwards() bool {
+	return len(f.Before) > 0 || f.LastPage
+}
+
+// matchesWith returns whether or not an archived peer JID satisfies 'with' filter.
+func (f *ArchiveFilters) matchesWith(jid string) bool {
+	if len(f.With) == 0 || jid == f.With {
+		return true
+	}
+	return !strings.Contains(f.With, "/") && strings.HasPrefix(jid, f.With+"/")
+}
+
+// filterArchiveMessages applies archive filters over a set of archived
+// messages sorted in ascending chronological order.
+func filterArchiveMessages(messages []model.ArchiveMessage, filters ArchiveFilters) ([]model.ArchiveMessage, error) {
+	if !containsArchiveMessage(messages, filters.After) || !containsArchiveMessage(messages, filters.Before) {
+		return nil, ErrArchiveMessageNotFound
+	}
+	var ret []model.ArchiveMessage
+	afterFound := len(filters.After) == 0
+	for _, m := range messages {
+		if !afterFound {
+			afterFound = m.ID == filters.After
+			continue
+		}
+		if len(filters.Before) > 0 && m.ID == filters.Before {
+			break
+		}
+		if !filters.matchesWith(m.JID) {
+			continue
+		}
+		if !filters.Start.IsZero() && m.Stamp.Before(filters.Start) {
+			continue
+		}
+		if !filters.End.IsZero() && m.Stamp.After(filters.End) {
+			continue
+		}
+		ret = append(ret, m)
+	}
+	if filters.Max > 0 && len(ret) > filters.Max {
+		if filters.IsBackwards() {
+			// paging backwards... keep last page
+			return ret[len(ret)-filters.Max:], nil
+		}
+		return ret[:filters.Max], nil
+	}
+	return ret, nil
+}
+
+func containsArchiveMessage(messages []model.ArchiveMessage, id string) bool {
+	if len(id) == 0 {
+		return true
+	}
+	for _, m := range messages {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
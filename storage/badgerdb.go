@@ -10,6 +10,7 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -28,6 +29,7 @@ var (
 )
 
 type badgerDB struct {
+	*memoryResources
 	db     *badger.DB
 	pool   *pool.BufferPool
 	doneCh chan chan bool
@@ -35,8 +37,9 @@ type badgerDB struct {
 
 func newBadgerDB(cfg *BadgerDb) *badgerDB {
 	b := &badgerDB{
-		pool:   pool.NewBufferPool(),
-		doneCh: make(chan chan bool),
+		memoryResources: newMemoryResources(),
+		pool:            pool.NewBufferPool(),
+		doneCh:          make(chan chan bool),
 	}
 	if err := os.MkdirAll(filepath.Dir(cfg.DataDir), os.ModePerm); err != nil {
 		log.Fatalf("%v", err)
@@ -59,14 +62,51 @@ func (b *badgerDB) Shutdown() {
 	<-ch
 }
 
+func (b *badgerDB) Healthy() bool {
+	// embedded database... always reachable while opened
+	return true
+}
+
 func (b *badgerDB) InsertOrUpdateUser(user *model.User) error {
 	return b.db.Update(func(tx *badger.Txn) error {
 		return b.insertOrUpdate(user, b.userKey(user.Username), tx)
 	})
 }
 
+func (b *badgerDB) InsertUser(user *model.User) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		val, err := b.getVal(b.userKey(user.Username), tx)
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			return ErrUserExists
+		}
+		return b.insertOrUpdate(user, b.userKey(user.Username), tx)
+	})
+}
+
 func (b *badgerDB) DeleteUser(username string) error {
 	return b.db.Update(func(tx *badger.Txn) error {
+		prefixes := []string{"rosterItems:", "rosterNotifications:", "privateElements:", "offlineMessages:", "archiveMessages:", "blockListItems:",
+			"pushRegistrations:", "privacyLists:"}
+		for _, prefix := range prefixes {
+			if err := b.deletePrefix([]byte(prefix+username+":"), tx); err != nil {
+				return err
+			}
+		}
+		// PEP nodes hosted at any of user's bare JIDs
+		for _, prefix := range []string{"pubSubNodes:", "pubSubItems:"} {
+			if err := b.deletePrefix([]byte(prefix+url.QueryEscape(username+"@")), tx); err != nil {
+				return err
+			}
+		}
+		if err := b.delete(b.rosterVersionKey(username), tx); err != nil {
+			return err
+		}
+		if err := b.delete(b.vCardKey(username), tx); err != nil {
+			return err
+		}
 		return b.delete(b.userKey(username), tx)
 	})
 }
@@ -96,13 +136,31 @@ func (b *badgerDB) UserExists(username string) (bool, error) {
 	}
 }
 
+func (b *badgerDB) FetchUsernames() ([]string, error) {
+	var usernames []string
+	prefix := []byte("users:")
+	err := b.forEachKey(prefix, func(k []byte) error {
+		usernames = append(usernames, string(k[len(prefix):]))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
 func (b *badgerDB) InsertOrUpdateRosterItem(ri *model.RosterItem) (model.RosterVersion, error) {
+	v, err := b.updateRosterVer(ri.Username, false)
+	if err != nil {
+		return model.RosterVersion{}, err
+	}
+	ri.Ver = v.Ver
 	if err := b.db.Update(func(tx *badger.Txn) error {
 		return b.insertOrUpdate(ri, b.rosterItemKey(ri.Username, ri.JID), tx)
 	}); err != nil {
 		return model.RosterVersion{}, err
 	}
-	return b.updateRosterVer(ri.Username, false)
+	return v, nil
 }
 
 func (b *badgerDB) DeleteRosterItem(user, contact string) (model.RosterVersion, error) {
@@ -116,7 +174,7 @@ func (b *badgerDB) DeleteRosterItem(user, contact string) (model.RosterVersion,
 
 func (b *badgerDB) FetchRosterItems(user string) ([]model.RosterItem, model.RosterVersion, error) {
 	var ris []model.RosterItem
-	if err := b.fetchAll(&ris, []byte("rosterItems:"+user)); err != nil {
+	if err := b.fetchAll(&ris, []byte("rosterItems:"+user+":")); err != nil {
 		return nil, model.RosterVersion{}, err
 	}
 	ver, err := b.fetchRosterVer(user)
@@ -136,6 +194,10 @@ func (b *badgerDB) FetchRosterItem(user, contact string) (*model.RosterItem, err
 	}
 }
 
+func (b *badgerDB) FetchRosterVersion(user string) (model.RosterVersion, error) {
+	return b.fetchRosterVer(user)
+}
+
 func (b *badgerDB) InsertOrUpdateRosterNotification(rn *model.RosterNotification) error {
 	return b.db.Update(func(tx *badger.Txn) error {
 		return b.insertOrUpdate(rn, b.rosterNotificationKey(rn.Contact, rn.JID), tx)
@@ -150,7 +212,7 @@ func (b *badgerDB) DeleteRosterNotification(contact, jid string) error {
 
 func (b *badgerDB) FetchRosterNotifications(contact string) ([]model.RosterNotification, error) {
 	var rns []model.RosterNotification
-	if err := b.fetchAll(&rns, []byte("rosterNotifications:"+contact)); err != nil {
+	if err := b.fetchAll(&rns, []byte("rosterNotifications:"+contact+":")); err != nil {
 		return nil, err
 	}
 	return rns, nil
@@ -204,7 +266,7 @@ func (b *badgerDB) InsertOfflineMessage(message xml.XElement, username string) e
 
 func (b *badgerDB) CountOfflineMessages(username string) (int, error) {
 	cnt := 0
-	prefix := []byte("offlineMessages:" + username)
+	prefix := []byte("offlineMessages:" + username + ":")
 	err := b.forEachKey(prefix, func(key []byte) error {
 		cnt++
 		return nil
@@ -214,7 +276,7 @@ func (b *badgerDB) CountOfflineMessages(username string) (int, error) {
 
 func (b *badgerDB) FetchOfflineMessages(username string) ([]xml.XElement, error) {
 	var msgs []xml.Element
-	if err := b.fetchAll(&msgs, []byte("offlineMessages:"+username)); err != nil {
+	if err := b.fetchAll(&msgs, []byte("offlineMessages:"+username+":")); err != nil {
 		return nil, err
 	}
 	switch len(msgs) {
@@ -231,10 +293,27 @@ func (b *badgerDB) FetchOfflineMessages(username string) ([]xml.XElement, error)
 
 func (b *badgerDB) DeleteOfflineMessages(username string) error {
 	return b.db.Update(func(tx *badger.Txn) error {
-		return b.deletePrefix([]byte("offlineMessages:"+username), tx)
+		return b.deletePrefix([]byte("offlineMessages:"+username+":"), tx)
 	})
 }
 
+func (b *badgerDB) DeleteExpiredOfflineMessages(before time.Time) (int, error) {
+	var keys [][]byte
+	err := b.forEachKeyAndValue([]byte("offlineMessages:"), func(k, val []byte) error {
+		var msg xml.Element
+		msg.FromGob(gob.NewDecoder(bytes.NewReader(val)))
+		if stamp, ok := offlineMessageStamp(&msg); ok && stamp.Before(before) {
+			// iterator reuses key buffer... keep a copy
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), b.deleteKeys(keys)
+}
+
 func (b *badgerDB) InsertOrUpdateBlockListItems(items []model.BlockListItem) error {
 	return b.db.Update(func(tx *badger.Txn) error {
 		for _, item := range items {
@@ -265,6 +344,223 @@ func (b *badgerDB) FetchBlockListItems(username string) ([]model.BlockListItem,
 	return blItems, nil
 }
 
+func (b *badgerDB) FetchBlockListItemsRange(username string, offset, limit int) ([]model.BlockListItem, int, error) {
+	blItems, err := b.FetchBlockListItems(username)
+	if err != nil {
+		return nil, 0, err
+	}
+	return blockListItemsRange(blItems, offset, limit), len(blItems), nil
+}
+
+func (b *badgerDB) InsertArchiveMessage(message *model.ArchiveMessage) error {
+	// archive keys are ordered by stamp... look for an already archived identifier
+	var exists bool
+	suffix := []byte(":" + message.ID)
+	if err := b.forEachKey([]byte("archiveMessages:"+message.Username+":"), func(key []byte) error {
+		exists = exists || bytes.HasSuffix(key, suffix)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.insertOrUpdate(message, b.archiveMessageKey(message.Username, message.Stamp, message.ID), tx)
+	})
+}
+
+func (b *badgerDB) FetchArchiveMessages(username string, filters ArchiveFilters) ([]model.ArchiveMessage, error) {
+	var msgs []model.ArchiveMessage
+	if err := b.fetchAll(&msgs, []byte("archiveMessages:"+username+":")); err != nil {
+		return nil, err
+	}
+	return filterArchiveMessages(msgs, filters)
+}
+
+func (b *badgerDB) TrimArchive(before time.Time, maxCount int) (int, error) {
+	var msgs []model.ArchiveMessage
+	if err := b.fetchAll(&msgs, []byte("archiveMessages:")); err != nil {
+		return 0, err
+	}
+	archives := make(map[string][]model.ArchiveMessage)
+	for _, m := range msgs {
+		archives[m.Username] = append(archives[m.Username], m)
+	}
+	var keys [][]byte
+	for _, archive := range archives {
+		kept := trimArchiveMessages(archive, before, maxCount)
+		for _, m := range archive[:len(archive)-len(kept)] {
+			keys = append(keys, b.archiveMessageKey(m.Username, m.Stamp, m.ID))
+		}
+	}
+	return len(keys), b.deleteKeys(keys)
+}
+
+func (b *badgerDB) InsertCapabilities(caps *model.Capabilities) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.insertOrUpdate(caps, b.capabilitiesKey(caps.Node, caps.Ver), tx)
+	})
+}
+
+func (b *badgerDB) FetchCapabilities(node, ver string) (*model.Capabilities, error) {
+	var caps model.Capabilities
+	err := b.fetch(&caps, b.capabilitiesKey(node, ver))
+	switch err {
+	case nil:
+		return &caps, nil
+	case errBadgerDBEntityNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (b *badgerDB) InsertOrUpdatePubSubNode(node *model.PubSubNode) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.insertOrUpdate(node, b.pubSubNodeKey(node.Host, node.Name), tx)
+	})
+}
+
+func (b *badgerDB) FetchPubSubNode(host, name string) (*model.PubSubNode, error) {
+	var node model.PubSubNode
+	err := b.fetch(&node, b.pubSubNodeKey(host, name))
+	switch err {
+	case nil:
+		return &node, nil
+	case errBadgerDBEntityNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (b *badgerDB) FetchPubSubNodes(host string) ([]model.PubSubNode, error) {
+	var nodes []model.PubSubNode
+	if err := b.fetchAll(&nodes, b.pubSubNodesPrefix(host)); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (b *badgerDB) DeletePubSubNode(host, name string) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		if err := b.deletePrefix(b.pubSubItemsPrefix(host, name), tx); err != nil {
+			return err
+		}
+		return b.delete(b.pubSubNodeKey(host, name), tx)
+	})
+}
+
+func (b *badgerDB) InsertOrUpdatePubSubItem(host, name string, item *model.PubSubItem) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.insertOrUpdate(item, b.pubSubItemKey(host, name, item.ID), tx)
+	})
+}
+
+func (b *badgerDB) FetchPubSubItems(host, name string) ([]model.PubSubItem, error) {
+	var items []model.PubSubItem
+	if err := b.fetchAll(&items, b.pubSubItemsPrefix(host, name)); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (b *badgerDB) DeletePubSubItem(host, name, id string) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.delete(b.pubSubItemKey(host, name, id), tx)
+	})
+}
+
+func (b *badgerDB) InsertPushRegistration(reg *model.PushRegistration) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.insertOrUpdate(reg, b.pushRegistrationKey(reg.Username, reg.JID, reg.Node), tx)
+	})
+}
+
+func (b *badgerDB) DeletePushRegistrations(username, jid, node string) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		if len(node) == 0 {
+			return b.deletePrefix(b.pushRegistrationsPrefix(username, jid), tx)
+		}
+		return b.delete(b.pushRegistrationKey(username, jid, node), tx)
+	})
+}
+
+func (b *badgerDB) FetchPushRegistrations(username string) ([]model.PushRegistration, error) {
+	var regs []model.PushRegistration
+	if err := b.fetchAll(&regs, []byte("pushRegistrations:"+username+":")); err != nil {
+		return nil, err
+	}
+	return regs, nil
+}
+
+func (b *badgerDB) InsertOrUpdatePrivacyList(list *model.PrivacyList) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		var isDefault bool
+		key := b.privacyListKey(list.Username, list.Name)
+		val, err := b.getVal(key, tx)
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			var prev model.PrivacyList
+			prev.FromGob(gob.NewDecoder(bytes.NewReader(val)))
+			isDefault = prev.IsDefault
+		}
+		l := *list
+		l.IsDefault = isDefault
+		return b.insertOrUpdate(&l, key, tx)
+	})
+}
+
+func (b *badgerDB) DeletePrivacyList(username, name string) error {
+	return b.db.Update(func(tx *badger.Txn) error {
+		return b.delete(b.privacyListKey(username, name), tx)
+	})
+}
+
+func (b *badgerDB) FetchPrivacyList(username, name string) (*model.PrivacyList, error) {
+	var list model.PrivacyList
+	err := b.fetch(&list, b.privacyListKey(username, name))
+	switch err {
+	case nil:
+		return &list, nil
+	case errBadgerDBEntityNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (b *badgerDB) FetchPrivacyLists(username string) ([]model.PrivacyList, error) {
+	var lists []model.PrivacyList
+	if err := b.fetchAll(&lists, b.privacyListsPrefix(username)); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+func (b *badgerDB) SetDefaultPrivacyList(username, name string) error {
+	lists, err := b.FetchPrivacyLists(username)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *badger.Txn) error {
+		for _, list := range lists {
+			isDefault := list.Name == name
+			if list.IsDefault == isDefault {
+				continue
+			}
+			list.IsDefault = isDefault
+			if err := b.insertOrUpdate(&list, b.privacyListKey(username, list.Name), tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (b *badgerDB) updateRosterVer(username string, isDeletion bool) (model.RosterVersion, error) {
 	v, err := b.fetchRosterVer(username)
 	if err != nil {
@@ -309,6 +605,20 @@ func (b *badgerDB) loop() {
 	}
 }
 
+func (b *badgerDB) deleteKeys(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return b.db.Update(func(tx *badger.Txn) error {
+		for _, k := range keys {
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (b *badgerDB) insertOrUpdate(entity interface{}, key []byte, tx *badger.Txn) error {
 	gs, ok := entity.(model.GobSerializer)
 	if !ok {
@@ -331,7 +641,8 @@ func (b *badgerDB) delete(key []byte, txn *badger.Txn) error {
 func (b *badgerDB) deletePrefix(prefix []byte, txn *badger.Txn) error {
 	var keys [][]byte
 	if err := b.forEachKey(prefix, func(key []byte) error {
-		keys = append(keys, key)
+		// iterator reuses key buffer... keep a copy
+		keys = append(keys, append([]byte(nil), key...))
 		return nil
 	}); err != nil {
 		return err
@@ -461,6 +772,48 @@ func (b *badgerDB) offlineMessageKey(username, identifier string) []byte {
 	return []byte("offlineMessages:" + username + ":" + identifier)
 }
 
+func (b *badgerDB) archiveMessageKey(username string, stamp time.Time, identifier string) []byte {
+	// zero padded timestamp keeps keys sorted in chronological order
+	return []byte(fmt.Sprintf("archiveMessages:%s:%020d:%s", username, stamp.UnixNano(), identifier))
+}
+
 func (b *badgerDB) blockListItemKey(username, jid string) []byte {
 	return []byte("blockListItems:" + username + ":" + jid)
 }
+
+// node names may contain ':' separator... escape key components
+func (b *badgerDB) pubSubNodesPrefix(host string) []byte {
+	return []byte("pubSubNodes:" + url.QueryEscape(host) + ":")
+}
+
+func (b *badgerDB) capabilitiesKey(node, ver string) []byte {
+	return []byte("capabilities:" + url.QueryEscape(node) + ":" + ver)
+}
+
+func (b *badgerDB) pubSubNodeKey(host, name string) []byte {
+	return append(b.pubSubNodesPrefix(host), url.QueryEscape(name)...)
+}
+
+func (b *badgerDB) pubSubItemsPrefix(host, name string) []byte {
+	return []byte("pubSubItems:" + url.QueryEscape(host) + ":" + url.QueryEscape(name) + ":")
+}
+
+func (b *badgerDB) pubSubItemKey(host, name, identifier string) []byte {
+	return append(b.pubSubItemsPrefix(host, name), identifier...)
+}
+
+func (b *badgerDB) pushRegistrationsPrefix(username, jid string) []byte {
+	return []byte("pushRegistrations:" + username + ":" + url.QueryEscape(jid) + ":")
+}
+
+func (b *badgerDB) pushRegistrationKey(username, jid, node string) []byte {
+	return append(b.pushRegistrationsPrefix(username, jid), url.QueryEscape(node)...)
+}
+
+func (b *badgerDB) privacyListsPrefix(username string) []byte {
+	return []byte("privacyLists:" + username + ":")
+}
+
+func (b *badgerDB) privacyListKey(username, name string) []byte {
+	return append(b.privacyListsPrefix(username), url.QueryEscape(name)...)
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
@@ -42,6 +43,10 @@ func TestBadgerDB_User(t *testing.T) {
 	require.Nil(t, err)
 	require.True(t, exists)
 
+	usernames, err := h.db.FetchUsernames()
+	require.Nil(t, err)
+	require.Equal(t, []string{"ortuman"}, usernames)
+
 	usr3, err := h.db.FetchUser("ortuman2")
 	require.Nil(t, usr3)
 	require.Nil(t, err)
@@ -54,6 +59,47 @@ func TestBadgerDB_User(t *testing.T) {
 	require.False(t, exists)
 }
 
+func TestBadgerDB_InsertNewUser(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	user := model.User{Username: "ortuman", Password: "1234"}
+	require.Nil(t, h.db.InsertUser(&user))
+	require.Equal(t, ErrUserExists, h.db.InsertUser(&user))
+}
+
+func TestBadgerDB_DeleteUserData(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	require.Nil(t, h.db.InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"}))
+	_, err := h.db.InsertOrUpdateRosterItem(&model.RosterItem{Username: "ortuman", JID: "romeo@jackal.im"})
+	require.Nil(t, err)
+	_, err = h.db.InsertOrUpdateRosterItem(&model.RosterItem{Username: "ortuman2", JID: "romeo@jackal.im"})
+	require.Nil(t, err)
+	require.Nil(t, h.db.InsertOrUpdateBlockListItems([]model.BlockListItem{{Username: "ortuman", JID: "juliet@jackal.im"}}))
+	require.Nil(t, h.db.InsertOrUpdateRosterNotification(&model.RosterNotification{Contact: "ortuman", JID: "romeo@jackal.im"}))
+
+	require.Nil(t, h.db.DeleteUser("ortuman"))
+
+	ris, _, err := h.db.FetchRosterItems("ortuman:")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ris))
+	ris, _, err = h.db.FetchRosterItems("ortuman2")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ris))
+	bl, err := h.db.FetchBlockListItems("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(bl))
+	rns, err := h.db.FetchRosterNotifications("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(rns))
+}
+
 func TestBadgerDB_VCard(t *testing.T) {
 	t.Parallel()
 
@@ -131,6 +177,11 @@ func TestBadgerDB_RosterItems(t *testing.T) {
 	ri3, err := h.db.FetchRosterItem("ortuman", "juliet")
 	require.Nil(t, err)
 	require.Equal(t, ri1, ri3)
+	require.Equal(t, 1, ri3.Ver)
+
+	ri4, err := h.db.FetchRosterItem("ortuman", "romeo")
+	require.Nil(t, err)
+	require.Equal(t, 2, ri4.Ver)
 
 	_, err = h.db.DeleteRosterItem("ortuman", "juliet")
 	require.NoError(t, err)
@@ -140,6 +191,11 @@ func TestBadgerDB_RosterItems(t *testing.T) {
 	ris, _, err = h.db.FetchRosterItems("ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 0, len(ris))
+
+	ver, err := h.db.FetchRosterVersion("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 4, ver.Ver)
+	require.Equal(t, 4, ver.DeletionVer)
 }
 
 func TestBadgerDB_RosterNotifications(t *testing.T) {
@@ -200,6 +256,7 @@ func TestBadgerDB_OfflineMessages(t *testing.T) {
 
 	require.NoError(t, h.db.InsertOfflineMessage(msg1, "ortuman"))
 	require.NoError(t, h.db.InsertOfflineMessage(msg2, "ortuman"))
+	require.NoError(t, h.db.InsertOfflineMessage(msg2, "ortuman2"))
 
 	cnt, err := h.db.CountOfflineMessages("ortuman")
 	require.Nil(t, err)
@@ -211,12 +268,20 @@ func TestBadgerDB_OfflineMessages(t *testing.T) {
 
 	msgs2, err := h.db.FetchOfflineMessages("ortuman2")
 	require.Nil(t, err)
-	require.Equal(t, 0, len(msgs2))
+	require.Equal(t, 1, len(msgs2))
+
+	msgs3, err := h.db.FetchOfflineMessages("ortuman3")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(msgs3))
 
 	require.NoError(t, h.db.DeleteOfflineMessages("ortuman"))
 	cnt, err = h.db.CountOfflineMessages("ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 0, cnt)
+
+	cnt, err = h.db.CountOfflineMessages("ortuman2")
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
 }
 
 func TestBadgerDB_BlockListItems(t *testing.T) {
@@ -226,9 +291,9 @@ func TestBadgerDB_BlockListItems(t *testing.T) {
 	defer tUtilBadgerDBTeardown(h)
 
 	items := []model.BlockListItem{
-		{"ortuman", "juliet@jackal.im"},
-		{"ortuman", "user@jackal.im"},
-		{"ortuman", "romeo@jackal.im"},
+		{Username: "ortuman", JID: "juliet@jackal.im"},
+		{Username: "ortuman", JID: "user@jackal.im"},
+		{Username: "ortuman", JID: "romeo@jackal.im"},
 	}
 	sort.Slice(items, func(i, j int) bool { return items[i].JID < items[j].JID })
 
@@ -241,7 +306,7 @@ func TestBadgerDB_BlockListItems(t *testing.T) {
 	require.Equal(t, items, sItems)
 
 	items = append(items[:1], items[2:]...)
-	h.db.DeleteBlockListItems([]model.BlockListItem{{"ortuman", "romeo@jackal.im"}})
+	h.db.DeleteBlockListItems([]model.BlockListItem{{Username: "ortuman", JID: "romeo@jackal.im"}})
 
 	sItems, err = h.db.FetchBlockListItems("ortuman")
 	sort.Slice(items, func(i, j int) bool { return items[i].JID < items[j].JID })
@@ -254,6 +319,107 @@ func TestBadgerDB_BlockListItems(t *testing.T) {
 	require.Equal(t, 0, len(sItems))
 }
 
+func TestBadgerDB_ArchiveMessages(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		am := model.ArchiveMessage{
+			ID:       uuid.New(),
+			Username: "ortuman",
+			JID:      "noelia@jackal.im",
+			Message:  xml.NewElementName("message"),
+			Stamp:    now.Add(time.Duration(i) * time.Second),
+		}
+		require.Nil(t, h.db.InsertArchiveMessage(&am))
+		ids = append(ids, am.ID)
+	}
+	msgs, err := h.db.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(msgs))
+	for i := range msgs {
+		require.Equal(t, ids[i], msgs[i].ID)
+	}
+	msgs, err = h.db.FetchArchiveMessages("ortuman", ArchiveFilters{After: ids[0], Max: 1})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, ids[1], msgs[0].ID)
+
+	// already archived identifier
+	am := model.ArchiveMessage{
+		ID:        ids[1],
+		Username:  "ortuman",
+		JID:       "noelia@jackal.im",
+		Message:   xml.NewElementName("message"),
+		Stamp:     now.Add(time.Minute),
+		Direction: model.ArchiveSent,
+	}
+	require.Nil(t, h.db.InsertArchiveMessage(&am))
+	msgs, _ = h.db.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Equal(t, 3, len(msgs))
+	require.Equal(t, "", msgs[1].Direction)
+
+	msgs, _ = h.db.FetchArchiveMessages("noelia", ArchiveFilters{})
+	require.Equal(t, 0, len(msgs))
+}
+
+func TestBadgerDB_Retention(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+		msg.AppendElement(xml.NewDelay("jackal.im", now.Add(-time.Duration(i)*time.Hour), "Offline Storage"))
+		require.NoError(t, h.db.InsertOfflineMessage(msg, "ortuman"))
+
+		am := model.ArchiveMessage{
+			ID:       uuid.New(),
+			Username: "ortuman",
+			JID:      "noelia@jackal.im",
+			Message:  xml.NewElementName("message"),
+			Stamp:    now.Add(time.Duration(i) * time.Second),
+		}
+		require.Nil(t, h.db.InsertArchiveMessage(&am))
+	}
+	cnt, err := h.db.DeleteExpiredOfflineMessages(now.Add(-time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 2, cnt)
+	cnt, _ = h.db.CountOfflineMessages("ortuman")
+	require.Equal(t, 1, cnt)
+
+	cnt, err = h.db.TrimArchive(time.Time{}, 1)
+	require.Nil(t, err)
+	require.Equal(t, 2, cnt)
+	msgs, _ := h.db.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, now.Add(2*time.Second).Unix(), msgs[0].Stamp.Unix())
+}
+
+func TestBadgerDB_Capabilities(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	caps := model.Capabilities{Node: "http://code.google.com/p/exodus", Ver: "QgayPKawpkPSDYmwT/WM94uAlu0=", Features: []string{"urn:xmpp:ping"}}
+	require.Nil(t, h.db.InsertCapabilities(&caps))
+
+	fetched, err := h.db.FetchCapabilities(caps.Node, caps.Ver)
+	require.Nil(t, err)
+	require.Equal(t, caps, *fetched)
+
+	fetched, err = h.db.FetchCapabilities(caps.Node, "unknown")
+	require.Nil(t, err)
+	require.Nil(t, fetched)
+}
+
 func tUtilBadgerDBSetup() *testBadgerDBHelper {
 	h := &testBadgerDBHelper{}
 	dir, _ := ioutil.TempDir("", "")
@@ -267,3 +433,153 @@ func tUtilBadgerDBTeardown(h *testBadgerDBHelper) {
 	h.db.Shutdown()
 	os.RemoveAll(h.dataDir)
 }
+
+func TestBadgerDB_PubSub(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	node := model.PubSubNode{Host: "ortuman@jackal.im", Name: "urn:xmpp:avatar:data", AccessModel: "open"}
+	require.Nil(t, h.db.InsertOrUpdatePubSubNode(&node))
+
+	n, err := h.db.FetchPubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, err)
+	require.Equal(t, node, *n)
+
+	n, err = h.db.FetchPubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:metadata")
+	require.Nil(t, err)
+	require.Nil(t, n)
+
+	for _, id := range []string{"1", "2"} {
+		item := model.PubSubItem{ID: id, Publisher: "ortuman@jackal.im", Payload: xml.NewElementName("data")}
+		require.Nil(t, h.db.InsertOrUpdatePubSubItem("ortuman@jackal.im", "urn:xmpp:avatar:data", &item))
+	}
+	items, err := h.db.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(items))
+	require.Equal(t, "<data/>", items[0].Payload.String())
+
+	require.Nil(t, h.db.DeletePubSubItem("ortuman@jackal.im", "urn:xmpp:avatar:data", "1"))
+	items, _ = h.db.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Equal(t, 1, len(items))
+	require.Equal(t, "2", items[0].ID)
+
+	require.Nil(t, h.db.DeletePubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data"))
+	n, _ = h.db.FetchPubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, n)
+	items, _ = h.db.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Equal(t, 0, len(items))
+}
+
+func TestBadgerDB_PubSubNodes(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	// node names sharing a ':' separated prefix must not collide
+	for _, name := range []string{"a", "a:b"} {
+		require.Nil(t, h.db.InsertOrUpdatePubSubNode(&model.PubSubNode{Host: "ortuman@jackal.im", Name: name, AccessModel: "open"}))
+		item := model.PubSubItem{ID: "1", Publisher: "ortuman@jackal.im", Payload: xml.NewElementName(name)}
+		require.Nil(t, h.db.InsertOrUpdatePubSubItem("ortuman@jackal.im", name, &item))
+	}
+	require.Nil(t, h.db.InsertOrUpdatePubSubNode(&model.PubSubNode{Host: "noelia@jackal.im", Name: "a", AccessModel: "open"}))
+
+	nodes, err := h.db.FetchPubSubNodes("ortuman@jackal.im")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(nodes))
+
+	items, _ := h.db.FetchPubSubItems("ortuman@jackal.im", "a")
+	require.Equal(t, 1, len(items))
+	require.Equal(t, "<a/>", items[0].Payload.String())
+
+	require.Nil(t, h.db.DeletePubSubNode("ortuman@jackal.im", "a"))
+	items, _ = h.db.FetchPubSubItems("ortuman@jackal.im", "a:b")
+	require.Equal(t, 1, len(items))
+
+	require.Nil(t, h.db.DeleteUser("ortuman"))
+	nodes, _ = h.db.FetchPubSubNodes("ortuman@jackal.im")
+	require.Equal(t, 0, len(nodes))
+	items, _ = h.db.FetchPubSubItems("ortuman@jackal.im", "a:b")
+	require.Equal(t, 0, len(items))
+	nodes, _ = h.db.FetchPubSubNodes("noelia@jackal.im")
+	require.Equal(t, 1, len(nodes))
+}
+
+func TestBadgerDB_PushRegistrations(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	for _, node := range []string{"n1", "n:2"} {
+		require.Nil(t, h.db.InsertPushRegistration(&model.PushRegistration{Username: "ortuman", JID: "push.jackal.im", Node: node}))
+	}
+	opts := xml.NewElementNamespace("x", "jabber:x:data")
+	require.Nil(t, h.db.InsertPushRegistration(&model.PushRegistration{Username: "ortuman", JID: "push.jackal.im", Node: "n1", Options: opts}))
+	require.Nil(t, h.db.InsertPushRegistration(&model.PushRegistration{Username: "ortuman", JID: "push2.jackal.im", Node: "n1"}))
+	require.Nil(t, h.db.InsertPushRegistration(&model.PushRegistration{Username: "noelia", JID: "push.jackal.im", Node: "n1"}))
+
+	regs, err := h.db.FetchPushRegistrations("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(regs))
+
+	require.Nil(t, h.db.DeletePushRegistrations("ortuman", "push2.jackal.im", "n1"))
+	regs, _ = h.db.FetchPushRegistrations("ortuman")
+	require.Equal(t, 2, len(regs))
+	for _, reg := range regs {
+		if reg.Node == "n1" {
+			require.Equal(t, opts.String(), reg.Options.String())
+		}
+	}
+	require.Nil(t, h.db.DeletePushRegistrations("ortuman", "push.jackal.im", ""))
+	regs, _ = h.db.FetchPushRegistrations("ortuman")
+	require.Equal(t, 0, len(regs))
+
+	require.Nil(t, h.db.DeleteUser("noelia"))
+	regs, _ = h.db.FetchPushRegistrations("noelia")
+	require.Equal(t, 0, len(regs))
+}
+
+func TestBadgerDB_PrivacyLists(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	items := []model.PrivacyListItem{{Type: "jid", Value: "juliet@jackal.im", Action: "deny", Order: 1, Message: true}}
+	require.Nil(t, h.db.InsertOrUpdatePrivacyList(&model.PrivacyList{Username: "ortuman", Name: "public", Items: items}))
+	require.Nil(t, h.db.InsertOrUpdatePrivacyList(&model.PrivacyList{Username: "ortuman", Name: "private:1"}))
+	require.Nil(t, h.db.InsertOrUpdatePrivacyList(&model.PrivacyList{Username: "noelia", Name: "public"}))
+
+	lists, err := h.db.FetchPrivacyLists("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(lists))
+
+	require.Nil(t, h.db.SetDefaultPrivacyList("ortuman", "public"))
+	l, err := h.db.FetchPrivacyList("ortuman", "public")
+	require.Nil(t, err)
+	require.NotNil(t, l)
+	require.True(t, l.IsDefault)
+	require.Equal(t, items, l.Items)
+
+	// updating a list keeps its default state
+	require.Nil(t, h.db.InsertOrUpdatePrivacyList(&model.PrivacyList{Username: "ortuman", Name: "public"}))
+	l, _ = h.db.FetchPrivacyList("ortuman", "public")
+	require.True(t, l.IsDefault)
+	require.Equal(t, 0, len(l.Items))
+
+	require.Nil(t, h.db.SetDefaultPrivacyList("ortuman", ""))
+	l, _ = h.db.FetchPrivacyList("ortuman", "public")
+	require.False(t, l.IsDefault)
+
+	require.Nil(t, h.db.DeletePrivacyList("ortuman", "private:1"))
+	l, err = h.db.FetchPrivacyList("ortuman", "private:1")
+	require.Nil(t, err)
+	require.Nil(t, l)
+
+	require.Nil(t, h.db.DeleteUser("noelia"))
+	lists, _ = h.db.FetchPrivacyLists("noelia")
+	require.Equal(t, 0, len(lists))
+}
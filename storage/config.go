@@ -10,7 +10,28 @@ import (
 	"fmt"
 )
 
-const defaultMySQLPoolSize = 16
+const (
+	defaultMySQLPoolSize            = 16
+	defaultMySQLMaxIdleConns        = 4
+	defaultMySQLIdleTimeout         = 300
+	defaultMySQLHealthCheckInterval = 15
+	defaultMySQLHealthCheckTimeout  = 5
+	defaultMySQLQueryTimeout        = 10
+	defaultMySQLMigrationsDir       = "sql/migrations"
+)
+
+const (
+	defaultSQLitePath          = "./jackal.db"
+	defaultSQLiteMigrationsDir = "sql/migrations/sqlite"
+)
+
+const defaultRetentionInterval = 3600
+
+const (
+	defaultRedisAddress     = "localhost:6379"
+	defaultRedisPoolSize    = 16
+	defaultRedisDialTimeout = 5
+)
 
 // StorageType represents a storage manager type.
 type StorageType int
@@ -24,13 +45,32 @@ const (
 
 	// Mock represents a in-memory storage type.
 	Mock
+
+	// SQLite represents a SQLite storage type.
+	SQLite
+)
+
+// CacheType represents a storage cache type.
+type CacheType int
+
+const (
+	// NoCache represents an in-memory ephemeral data storage.
+	NoCache CacheType = iota
+
+	// RedisCache represents a Redis ephemeral data storage.
+	RedisCache
 )
 
 // Config represents an storage manager configuration.
 type Config struct {
-	Type     StorageType
-	MySQL    *MySQLDb
-	BadgerDB *BadgerDb
+	Type         StorageType
+	MySQL        *MySQLDb
+	SQLite       *SQLiteDb
+	BadgerDB     *BadgerDb
+	Cache        CacheType
+	Redis        *RedisDb
+	Retention    *RetentionConfig
+	SharedGroups []SharedGroup
 }
 
 // MySQLDb represents MySQL storage configuration.
@@ -40,6 +80,21 @@ type MySQLDb struct {
 	Password string `yaml:"password"`
 	Database string `yaml:"database"`
 	PoolSize int    `yaml:"pool_size"`
+
+	MaxIdleConns        int `yaml:"max_idle_conns"`
+	IdleTimeout         int `yaml:"idle_timeout"`
+	HealthCheckInterval int `yaml:"health_check_interval"`
+	HealthCheckTimeout  int `yaml:"health_check_timeout"`
+	QueryTimeout        int `yaml:"query_timeout"`
+
+	MigrationsDir string `yaml:"migrations_dir"`
+	AutoMigrate   bool   `yaml:"auto_migrate"`
+}
+
+// SQLiteDb represents SQLite storage configuration.
+type SQLiteDb struct {
+	Path          string `yaml:"path"`
+	MigrationsDir string `yaml:"migrations_dir"`
 }
 
 // BadgerDb represents BadgerDB storage configuration.
@@ -47,10 +102,56 @@ type BadgerDb struct {
 	DataDir string `yaml:"data_dir"`
 }
 
+// RedisDb represents Redis storage cache configuration.
+type RedisDb struct {
+	Address     string `yaml:"address"`
+	Password    string `yaml:"password"`
+	Database    int    `yaml:"database"`
+	PoolSize    int    `yaml:"pool_size"`
+	DialTimeout int    `yaml:"dial_timeout"`
+}
+
+// RetentionConfig represents stored messages retention configuration.
+// Zero values disable their corresponding limit.
+type RetentionConfig struct {
+	// Interval is the time (in seconds) elapsed between cleanup cycles.
+	Interval int `yaml:"interval"`
+
+	// OfflineTTL is the time (in seconds) offline messages are kept.
+	OfflineTTL int `yaml:"offline_ttl"`
+
+	// ArchiveMaxAge is the time (in seconds) archived messages are kept.
+	ArchiveMaxAge int `yaml:"archive_max_age"`
+
+	// ArchiveMaxCount is the maximum number of archived messages kept per user.
+	ArchiveMaxCount int `yaml:"archive_max_count"`
+}
+
+// SharedGroup represents a shared roster group configuration.
+// Group members are automatically added to each other's roster.
+type SharedGroup struct {
+	// Name is the roster group members are listed under.
+	Name string `yaml:"name"`
+
+	// Domain is the domain members JID belong to.
+	Domain string `yaml:"domain"`
+
+	// AllUsers makes every registered user a member of the group.
+	AllUsers bool `yaml:"all_users"`
+
+	// Members is the list of member usernames.
+	Members []string `yaml:"members"`
+}
+
 type storageProxyType struct {
-	Type     string    `yaml:"type"`
-	MySQL    *MySQLDb  `yaml:"mysql"`
-	BadgerDB *BadgerDb `yaml:"badgerdb"`
+	Type         string           `yaml:"type"`
+	MySQL        *MySQLDb         `yaml:"mysql"`
+	SQLite       *SQLiteDb        `yaml:"sqlite"`
+	BadgerDB     *BadgerDb        `yaml:"badgerdb"`
+	Cache        string           `yaml:"cache"`
+	Redis        *RedisDb         `yaml:"redis"`
+	Retention    *RetentionConfig `yaml:"retention"`
+	SharedGroups []SharedGroup    `yaml:"shared_groups"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
@@ -68,9 +169,47 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 		// assign storage defaults
 		c.MySQL = p.MySQL
-		if c.MySQL != nil && c.MySQL.PoolSize == 0 {
+		if c.MySQL.PoolSize == 0 {
 			c.MySQL.PoolSize = defaultMySQLPoolSize
 		}
+		if c.MySQL.MaxIdleConns == 0 {
+			c.MySQL.MaxIdleConns = defaultMySQLMaxIdleConns
+			if c.MySQL.MaxIdleConns > c.MySQL.PoolSize {
+				c.MySQL.MaxIdleConns = c.MySQL.PoolSize
+			}
+		}
+		if c.MySQL.IdleTimeout == 0 {
+			c.MySQL.IdleTimeout = defaultMySQLIdleTimeout
+		}
+		if c.MySQL.HealthCheckInterval == 0 {
+			c.MySQL.HealthCheckInterval = defaultMySQLHealthCheckInterval
+		}
+		if c.MySQL.HealthCheckTimeout == 0 {
+			c.MySQL.HealthCheckTimeout = defaultMySQLHealthCheckTimeout
+		}
+		if c.MySQL.QueryTimeout == 0 {
+			c.MySQL.QueryTimeout = defaultMySQLQueryTimeout
+		}
+		if len(c.MySQL.MigrationsDir) == 0 {
+			c.MySQL.MigrationsDir = defaultMySQLMigrationsDir
+		}
+		if c.MySQL.MaxIdleConns > c.MySQL.PoolSize {
+			return errors.New("storage.Config: max_idle_conns must not exceed pool_size")
+		}
+
+	case "sqlite":
+		if p.SQLite == nil {
+			p.SQLite = &SQLiteDb{}
+		}
+		c.Type = SQLite
+
+		c.SQLite = p.SQLite
+		if len(c.SQLite.Path) == 0 {
+			c.SQLite.Path = defaultSQLitePath
+		}
+		if len(c.SQLite.MigrationsDir) == 0 {
+			c.SQLite.MigrationsDir = defaultSQLiteMigrationsDir
+		}
 
 	case "badgerdb":
 		if p.BadgerDB == nil {
@@ -92,5 +231,51 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	default:
 		return fmt.Errorf("storage.Config: unrecognized storage type: %s", p.Type)
 	}
+
+	switch p.Cache {
+	case "redis":
+		c.Cache = RedisCache
+
+		c.Redis = p.Redis
+		if c.Redis == nil {
+			c.Redis = &RedisDb{}
+		}
+		if len(c.Redis.Address) == 0 {
+			c.Redis.Address = defaultRedisAddress
+		}
+		if c.Redis.PoolSize == 0 {
+			c.Redis.PoolSize = defaultRedisPoolSize
+		}
+		if c.Redis.DialTimeout == 0 {
+			c.Redis.DialTimeout = defaultRedisDialTimeout
+		}
+
+	case "":
+		c.Cache = NoCache
+
+	default:
+		return fmt.Errorf("storage.Config: unrecognized storage cache: %s", p.Cache)
+	}
+
+	c.Retention = p.Retention
+	if c.Retention != nil {
+		r := c.Retention
+		if r.Interval < 0 || r.OfflineTTL < 0 || r.ArchiveMaxAge < 0 || r.ArchiveMaxCount < 0 {
+			return errors.New("storage.Config: retention settings must not be negative")
+		}
+		if r.Interval == 0 {
+			r.Interval = defaultRetentionInterval
+		}
+	}
+
+	for _, g := range p.SharedGroups {
+		if len(g.Name) == 0 || len(g.Domain) == 0 {
+			return errors.New("storage.Config: shared groups require name and domain")
+		}
+		if !g.AllUsers && len(g.Members) == 0 {
+			return fmt.Errorf("storage.Config: shared group %s has no members", g.Name)
+		}
+	}
+	c.SharedGroups = p.SharedGroups
 	return nil
 }
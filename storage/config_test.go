@@ -30,6 +30,8 @@ func TestStorageConfig(t *testing.T) {
     password: password
     database: jackaldb
     pool_size: 16
+    migrations_dir: /usr/share/jackal/migrations
+    auto_migrate: true
 `
 
 	err = yaml.Unmarshal([]byte(mySQLCfg), &cfg)
@@ -39,6 +41,8 @@ func TestStorageConfig(t *testing.T) {
 	require.Equal(t, "password", cfg.MySQL.Password)
 	require.Equal(t, "jackaldb", cfg.MySQL.Database)
 	require.Equal(t, 16, cfg.MySQL.PoolSize)
+	require.Equal(t, "/usr/share/jackal/migrations", cfg.MySQL.MigrationsDir)
+	require.True(t, cfg.MySQL.AutoMigrate)
 
 	mySQLCfg2 := `
   type: mysql
@@ -53,6 +57,39 @@ func TestStorageConfig(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, MySQL, cfg.Type)
 	require.Equal(t, defaultMySQLPoolSize, cfg.MySQL.PoolSize)
+	require.Equal(t, defaultMySQLMaxIdleConns, cfg.MySQL.MaxIdleConns)
+	require.Equal(t, defaultMySQLIdleTimeout, cfg.MySQL.IdleTimeout)
+	require.Equal(t, defaultMySQLHealthCheckInterval, cfg.MySQL.HealthCheckInterval)
+	require.Equal(t, defaultMySQLHealthCheckTimeout, cfg.MySQL.HealthCheckTimeout)
+	require.Equal(t, defaultMySQLQueryTimeout, cfg.MySQL.QueryTimeout)
+	require.Equal(t, defaultMySQLMigrationsDir, cfg.MySQL.MigrationsDir)
+	require.False(t, cfg.MySQL.AutoMigrate)
+
+	smallPoolCfg := `
+  type: mysql
+  mysql:
+    host: 127.0.0.1
+    user: jackal
+    password: password
+    database: jackaldb
+    pool_size: 2
+`
+	err = yaml.Unmarshal([]byte(smallPoolCfg), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, 2, cfg.MySQL.MaxIdleConns)
+
+	mySQLCfg3 := `
+  type: mysql
+  mysql:
+    host: 127.0.0.1
+    user: jackal
+    password: password
+    database: jackaldb
+    pool_size: 4
+    max_idle_conns: 8
+`
+	err = yaml.Unmarshal([]byte(mySQLCfg3), &cfg)
+	require.NotNil(t, err)
 
 	invalidMySQLCfg := `
   type: mysql
@@ -60,11 +97,114 @@ func TestStorageConfig(t *testing.T) {
 	err = yaml.Unmarshal([]byte(invalidMySQLCfg), &cfg)
 	require.NotNil(t, err)
 
+	sqliteCfg := `
+  type: sqlite
+  sqlite:
+    path: /var/lib/jackal/jackal.db
+`
+	err = yaml.Unmarshal([]byte(sqliteCfg), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, SQLite, cfg.Type)
+	require.Equal(t, "/var/lib/jackal/jackal.db", cfg.SQLite.Path)
+	require.Equal(t, defaultSQLiteMigrationsDir, cfg.SQLite.MigrationsDir)
+
+	err = yaml.Unmarshal([]byte("type: sqlite"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, defaultSQLitePath, cfg.SQLite.Path)
+
 	invalidCfg := `
   type: invalid
 `
 	err = yaml.Unmarshal([]byte(invalidCfg), &cfg)
 	require.NotNil(t, err)
+	redisCfg := `
+  type: mock
+  cache: redis
+  redis:
+    address: 10.0.0.1:6379
+    pool_size: 32
+`
+	err = yaml.Unmarshal([]byte(redisCfg), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, RedisCache, cfg.Cache)
+	require.Equal(t, "10.0.0.1:6379", cfg.Redis.Address)
+	require.Equal(t, 32, cfg.Redis.PoolSize)
+	require.Equal(t, defaultRedisDialTimeout, cfg.Redis.DialTimeout)
+
+	redisCfg2 := `
+  type: mock
+  cache: redis
+`
+	err = yaml.Unmarshal([]byte(redisCfg2), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, defaultRedisAddress, cfg.Redis.Address)
+	require.Equal(t, defaultRedisPoolSize, cfg.Redis.PoolSize)
+
+	err = yaml.Unmarshal([]byte(mockCfg), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, NoCache, cfg.Cache)
+
+	invalidCacheCfg := `
+  type: mock
+  cache: memcached
+`
+	err = yaml.Unmarshal([]byte(invalidCacheCfg), &cfg)
+	require.NotNil(t, err)
+}
+
+func TestStorageRetentionConfig(t *testing.T) {
+	cfg := Config{}
+
+	retentionCfg := `
+  type: mock
+  retention:
+    offline_ttl: 604800
+    archive_max_count: 1000
+`
+	err := yaml.Unmarshal([]byte(retentionCfg), &cfg)
+	require.Nil(t, err)
+	require.NotNil(t, cfg.Retention)
+	require.Equal(t, defaultRetentionInterval, cfg.Retention.Interval)
+	require.Equal(t, 604800, cfg.Retention.OfflineTTL)
+	require.Equal(t, 0, cfg.Retention.ArchiveMaxAge)
+	require.Equal(t, 1000, cfg.Retention.ArchiveMaxCount)
+
+	invalidRetentionCfg := `
+  type: mock
+  retention:
+    archive_max_age: -1
+`
+	err = yaml.Unmarshal([]byte(invalidRetentionCfg), &cfg)
+	require.NotNil(t, err)
+}
+
+func TestStorageSharedGroupsConfig(t *testing.T) {
+	cfg := Config{}
+
+	sharedGroupsCfg := `
+  type: mock
+  shared_groups:
+    - name: Everyone
+      domain: jackal.im
+      all_users: true
+    - name: Staff
+      domain: jackal.im
+      members: [ortuman, noelia]
+`
+	err := yaml.Unmarshal([]byte(sharedGroupsCfg), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(cfg.SharedGroups))
+	require.True(t, cfg.SharedGroups[0].AllUsers)
+	require.Equal(t, []string{"ortuman", "noelia"}, cfg.SharedGroups[1].Members)
+
+	invalidSharedGroupsCfg := `
+  type: mock
+  shared_groups:
+    - name: Staff
+      domain: jackal.im
+`
+	err = yaml.Unmarshal([]byte(invalidSharedGroupsCfg), &cfg)
+	require.NotNil(t, err)
 }
 
 func TestStorageBadConfig(t *testing.T) {
@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"github.com/ortuman/jackal/metrics"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+// meteredStorage decorates a storage manager observing
+// every operation latency.
+type meteredStorage struct {
+	Storage
+}
+
+func newMeteredStorage(s Storage) *meteredStorage {
+	return &meteredStorage{Storage: s}
+}
+
+func (m *meteredStorage) observe(operation string, start time.Time) {
+	metrics.StorageOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (m *meteredStorage) InsertUser(user *model.User) error {
+	defer m.observe("InsertUser", time.Now())
+	return m.Storage.InsertUser(user)
+}
+
+func (m *meteredStorage) InsertOrUpdateUser(user *model.User) error {
+	defer m.observe("InsertOrUpdateUser", time.Now())
+	return m.Storage.InsertOrUpdateUser(user)
+}
+
+func (m *meteredStorage) DeleteUser(username string) error {
+	defer m.observe("DeleteUser", time.Now())
+	return m.Storage.DeleteUser(username)
+}
+
+func (m *meteredStorage) FetchUser(username string) (*model.User, error) {
+	defer m.observe("FetchUser", time.Now())
+	return m.Storage.FetchUser(username)
+}
+
+func (m *meteredStorage) UserExists(username string) (bool, error) {
+	defer m.observe("UserExists", time.Now())
+	return m.Storage.UserExists(username)
+}
+
+func (m *meteredStorage) FetchUsernames() ([]string, error) {
+	defer m.observe("FetchUsernames", time.Now())
+	return m.Storage.FetchUsernames()
+}
+
+func (m *meteredStorage) InsertOrUpdateRosterItem(ri *model.RosterItem) (model.RosterVersion, error) {
+	defer m.observe("InsertOrUpdateRosterItem", time.Now())
+	return m.Storage.InsertOrUpdateRosterItem(ri)
+}
+
+func (m *meteredStorage) DeleteRosterItem(username, jid string) (model.RosterVersion, error) {
+	defer m.observe("DeleteRosterItem", time.Now())
+	return m.Storage.DeleteRosterItem(username, jid)
+}
+
+func (m *meteredStorage) FetchRosterItems(username string) ([]model.RosterItem, model.RosterVersion, error) {
+	defer m.observe("FetchRosterItems", time.Now())
+	return m.Storage.FetchRosterItems(username)
+}
+
+func (m *meteredStorage) FetchRosterItem(username, jid string) (*model.RosterItem, error) {
+	defer m.observe("FetchRosterItem", time.Now())
+	return m.Storage.FetchRosterItem(username, jid)
+}
+
+func (m *meteredStorage) FetchRosterVersion(username string) (model.RosterVersion, error) {
+	defer m.observe("FetchRosterVersion", time.Now())
+	return m.Storage.FetchRosterVersion(username)
+}
+
+func (m *meteredStorage) InsertOrUpdateRosterNotification(rn *model.RosterNotification) error {
+	defer m.observe("InsertOrUpdateRosterNotification", time.Now())
+	return m.Storage.InsertOrUpdateRosterNotification(rn)
+}
+
+func (m *meteredStorage) DeleteRosterNotification(contact, jid string) error {
+	defer m.observe("DeleteRosterNotification", time.Now())
+	return m.Storage.DeleteRosterNotification(contact, jid)
+}
+
+func (m *meteredStorage) FetchRosterNotifications(contact string) ([]model.RosterNotification, error) {
+	defer m.observe("FetchRosterNotifications", time.Now())
+	return m.Storage.FetchRosterNotifications(contact)
+}
+
+func (m *meteredStorage) InsertOrUpdateVCard(vCard xml.XElement, username string) error {
+	defer m.observe("InsertOrUpdateVCard", time.Now())
+	return m.Storage.InsertOrUpdateVCard(vCard, username)
+}
+
+func (m *meteredStorage) FetchVCard(username string) (xml.XElement, error) {
+	defer m.observe("FetchVCard", time.Now())
+	return m.Storage.FetchVCard(username)
+}
+
+func (m *meteredStorage) FetchPrivateXML(namespace string, username string) ([]xml.XElement, error) {
+	defer m.observe("FetchPrivateXML", time.Now())
+	return m.Storage.FetchPrivateXML(namespace, username)
+}
+
+func (m *meteredStorage) InsertOrUpdatePrivateXML(privateXML []xml.XElement, namespace string, username string) error {
+	defer m.observe("InsertOrUpdatePrivateXML", time.Now())
+	return m.Storage.InsertOrUpdatePrivateXML(privateXML, namespace, username)
+}
+
+func (m *meteredStorage) InsertOfflineMessage(message xml.XElement, username string) error {
+	defer m.observe("InsertOfflineMessage", time.Now())
+	return m.Storage.InsertOfflineMessage(message, username)
+}
+
+func (m *meteredStorage) CountOfflineMessages(username string) (int, error) {
+	defer m.observe("CountOfflineMessages", time.Now())
+	return m.Storage.CountOfflineMessages(username)
+}
+
+func (m *meteredStorage) FetchOfflineMessages(username string) ([]xml.XElement, error) {
+	defer m.observe("FetchOfflineMessages", time.Now())
+	return m.Storage.FetchOfflineMessages(username)
+}
+
+func (m *meteredStorage) DeleteOfflineMessages(username string) error {
+	defer m.observe("DeleteOfflineMessages", time.Now())
+	return m.Storage.DeleteOfflineMessages(username)
+}
+
+func (m *meteredStorage) DeleteExpiredOfflineMessages(before time.Time) (int, error) {
+	defer m.observe("DeleteExpiredOfflineMessages", time.Now())
+	return m.Storage.DeleteExpiredOfflineMessages(before)
+}
+
+func (m *meteredStorage) InsertOrUpdateBlockListItems(items []model.BlockListItem) error {
+	defer m.observe("InsertOrUpdateBlockListItems", time.Now())
+	return m.Storage.InsertOrUpdateBlockListItems(items)
+}
+
+func (m *meteredStorage) DeleteBlockListItems(items []model.BlockListItem) error {
+	defer m.observe("DeleteBlockListItems", time.Now())
+	return m.Storage.DeleteBlockListItems(items)
+}
+
+func (m *meteredStorage) FetchBlockListItems(username string) ([]model.BlockListItem, error) {
+	defer m.observe("FetchBlockListItems", time.Now())
+	return m.Storage.FetchBlockListItems(username)
+}
+
+func (m *meteredStorage) FetchBlockListItemsRange(username string, offset, limit int) ([]model.BlockListItem, int, error) {
+	defer m.observe("FetchBlockListItemsRange", time.Now())
+	return m.Storage.FetchBlockListItemsRange(username, offset, limit)
+}
+
+func (m *meteredStorage) InsertArchiveMessage(message *model.ArchiveMessage) error {
+	defer m.observe("InsertArchiveMessage", time.Now())
+	return m.Storage.InsertArchiveMessage(message)
+}
+
+func (m *meteredStorage) FetchArchiveMessages(username string, filters ArchiveFilters) ([]model.ArchiveMessage, error) {
+	defer m.observe("FetchArchiveMessages", time.Now())
+	return m.Storage.FetchArchiveMessages(username, filters)
+}
+
+func (m *meteredStorage) TrimArchive(before time.Time, maxCount int) (int, error) {
+	defer m.observe("TrimArchive", time.Now())
+	return m.Storage.TrimArchive(before, maxCount)
+}
+
+func (m *meteredStorage) InsertCapabilities(caps *model.Capabilities) error {
+	defer m.observe("InsertCapabilities", time.Now())
+	return m.Storage.InsertCapabilities(caps)
+}
+
+func (m *meteredStorage) FetchCapabilities(node, ver string) (*model.Capabilities, error) {
+	defer m.observe("FetchCapabilities", time.Now())
+	return m.Storage.FetchCapabilities(node, ver)
+}
+
+func (m *meteredStorage) InsertOrUpdatePubSubNode(node *model.PubSubNode) error {
+	defer m.observe("InsertOrUpdatePubSubNode", time.Now())
+	return m.Storage.InsertOrUpdatePubSubNode(node)
+}
+
+func (m *meteredStorage) FetchPubSubNode(host, name string) (*model.PubSubNode, error) {
+	defer m.observe("FetchPubSubNode", time.Now())
+	return m.Storage.FetchPubSubNode(host, name)
+}
+
+func (m *meteredStorage) FetchPubSubNodes(host string) ([]model.PubSubNode, error) {
+	defer m.observe("FetchPubSubNodes", time.Now())
+	return m.Storage.FetchPubSubNodes(host)
+}
+
+func (m *meteredStorage) DeletePubSubNode(host, name string) error {
+	defer m.observe("DeletePubSubNode", time.Now())
+	return m.Storage.DeletePubSubNode(host, name)
+}
+
+func (m *meteredStorage) InsertOrUpdatePubSubItem(host, name string, item *model.PubSubItem) error {
+	defer m.observe("InsertOrUpdatePubSubItem", time.Now())
+	return m.Storage.InsertOrUpdatePubSubItem(host, name, item)
+}
+
+func (m *meteredStorage) FetchPubSubItems(host, name string) ([]model.PubSubItem, error) {
+	defer m.observe("FetchPubSubItems", time.Now())
+	return m.Storage.FetchPubSubItems(host, name)
+}
+
+func (m *meteredStorage) DeletePubSubItem(host, name, id string) error {
+	defer m.observe("DeletePubSubItem", time.Now())
+	return m.Storage.DeletePubSubItem(host, name, id)
+}
+
+func (m *meteredStorage) InsertPushRegistration(reg *model.PushRegistration) error {
+	defer m.observe("InsertPushRegistration", time.Now())
+	return m.Storage.InsertPushRegistration(reg)
+}
+
+func (m *meteredStorage) DeletePushRegistrations(username, jid, node string) error {
+	defer m.observe("DeletePushRegistrations", time.Now())
+	return m.Storage.DeletePushRegistrations(username, jid, node)
+}
+
+func (m *meteredStorage) FetchPushRegistrations(username string) ([]model.PushRegistration, error) {
+	defer m.observe("FetchPushRegistrations", time.Now())
+	return m.Storage.FetchPushRegistrations(username)
+}
+
+func (m *meteredStorage) InsertOrUpdatePrivacyList(list *model.PrivacyList) error {
+	defer m.observe("InsertOrUpdatePrivacyList", time.Now())
+	return m.Storage.InsertOrUpdatePrivacyList(list)
+}
+
+func (m *meteredStorage) DeletePrivacyList(username, name string) error {
+	defer m.observe("DeletePrivacyList", time.Now())
+	return m.Storage.DeletePrivacyList(username, name)
+}
+
+func (m *meteredStorage) FetchPrivacyList(username, name string) (*model.PrivacyList, error) {
+	defer m.observe("FetchPrivacyList", time.Now())
+	return m.Storage.FetchPrivacyList(username, name)
+}
+
+func (m *meteredStorage) FetchPrivacyLists(username string) ([]model.PrivacyList, error) {
+	defer m.observe("FetchPrivacyLists", time.Now())
+	return m.Storage.FetchPrivacyLists(username)
+}
+
+func (m *meteredStorage) SetDefaultPrivacyList(username, name string) error {
+	defer m.observe("SetDefaultPrivacyList", time.Now())
+	return m.Storage.SetDefaultPrivacyList(username, name)
+}
+
+func (m *meteredStorage) InsertOrUpdateResource(res *model.Resource) error {
+	defer m.observe("InsertOrUpdateResource", time.Now())
+	return m.Storage.InsertOrUpdateResource(res)
+}
+
+func (m *meteredStorage) DeleteResource(username, resource, streamID string) error {
+	defer m.observe("DeleteResource", time.Now())
+	return m.Storage.DeleteResource(username, resource, streamID)
+}
+
+func (m *meteredStorage) FetchResources(username string) ([]model.Resource, error) {
+	defer m.observe("FetchResources", time.Now())
+	return m.Storage.FetchResources(username)
+}
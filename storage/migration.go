@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const createSchemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+    version INT NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    applied_at DATETIME NOT NULL,
+    PRIMARY KEY (version)
+)`
+
+// ErrMigrationsNotSupported will be returned when managing schema
+// migrations of a non SQL storage.
+var ErrMigrationsNotSupported = errors.New("storage: schema migrations are only supported by SQL storages")
+
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_(\w+)\.sql$`)
+
+// Migration represents a versioned SQL schema migration.
+type Migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// String returns the migration file base name.
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// MigrationState represents a schema migration along with
+// its applied state.
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// LoadMigrations reads the schema migrations contained in a directory,
+// sorted by version.
+// Migration files are named after their version followed by a
+// description (e.g. '0001_users_scram_sha_256.sql').
+func LoadMigrations(dir string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("storage: couldn't read migrations directory: %v", err)
+	}
+	var migrations []Migration
+	versions := make(map[int]string)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		m := migrationFileRegex.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(m[1])
+		if prev, ok := versions[version]; ok {
+			return nil, fmt.Errorf("storage: duplicated migration version %d: %s, %s", version, prev, f.Name())
+		}
+		versions[version] = f.Name()
+
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		stmts := splitSQLStatements(string(b))
+		if len(stmts) == 0 {
+			return nil, fmt.Errorf("storage: empty migration: %s", f.Name())
+		}
+		migrations = append(migrations, Migration{Version: version, Name: m[2], Statements: stmts})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// MigrationStatus returns the applied state of every schema
+// migration found in the configured migrations directory.
+func MigrationStatus(cfg *Config) ([]MigrationState, error) {
+	m, err := newMigrator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer m.db.Close()
+	return m.status()
+}
+
+// Migrate applies pending schema migrations in version order,
+// returning the applied ones.
+// If dryRun is set pending migrations are returned without being applied.
+func Migrate(cfg *Config, dryRun bool) ([]Migration, error) {
+	m, err := newMigrator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer m.db.Close()
+	return m.migrate(dryRun)
+}
+
+// BaselineMigrations records every pending migration up to version as
+// applied without running it, so that databases upgraded by hand
+// can be handed over to the migration runner.
+func BaselineMigrations(cfg *Config, version int) ([]Migration, error) {
+	m, err := newMigrator(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer m.db.Close()
+	return m.baseline(version)
+}
+
+type migrator struct {
+	db         *sql.DB
+	dialect    *sqlDialect
+	migrations []Migration
+}
+
+func newMigrator(cfg *Config) (*migrator, error) {
+	var dir string
+	var dialect *sqlDialect
+	var open func() (*sql.DB, error)
+	switch cfg.Type {
+	case MySQL:
+		dir, dialect = cfg.MySQL.MigrationsDir, mysqlDialect
+		open = func() (*sql.DB, error) { return openMySQL(cfg.MySQL) }
+	case SQLite:
+		dir, dialect = cfg.SQLite.MigrationsDir, sqliteDialect
+		open = func() (*sql.DB, error) { return openSQLite(cfg.SQLite) }
+	default:
+		return nil, ErrMigrationsNotSupported
+	}
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	db, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+func (m *migrator) status() ([]MigrationState, error) {
+	applied, err := m.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, len(m.migrations))
+	for i, mg := range m.migrations {
+		appliedAt, ok := applied[mg.Version]
+		states[i] = MigrationState{Migration: mg, Applied: ok, AppliedAt: appliedAt}
+	}
+	return states, nil
+}
+
+func (m *migrator) migrate(dryRun bool) ([]Migration, error) {
+	pending, err := m.pending()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || len(pending) == 0 {
+		return pending, nil
+	}
+	if _, err := m.db.Exec(createSchemaVersionTable); err != nil {
+		return nil, err
+	}
+	for i, mg := range pending {
+		for _, stmt := range mg.Statements {
+			if _, err := m.db.Exec(stmt); err != nil {
+				return pending[:i], fmt.Errorf("storage: migration %v failed: %v", mg, err)
+			}
+		}
+		if err := m.insertVersion(mg); err != nil {
+			return pending[:i], fmt.Errorf("storage: migration %v applied but not recorded: %v", mg, err)
+		}
+	}
+	return pending, nil
+}
+
+func (m *migrator) baseline(version int) ([]Migration, error) {
+	pending, err := m.pending()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.db.Exec(createSchemaVersionTable); err != nil {
+		return nil, err
+	}
+	var recorded []Migration
+	for _, mg := range pending {
+		if mg.Version > version {
+			break
+		}
+		if err := m.insertVersion(mg); err != nil {
+			return recorded, err
+		}
+		recorded = append(recorded, mg)
+	}
+	return recorded, nil
+}
+
+func (m *migrator) pending() ([]Migration, error) {
+	states, err := m.status()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, st := range states {
+		if !st.Applied {
+			pending = append(pending, st.Migration)
+		}
+	}
+	return pending, nil
+}
+
+func (m *migrator) appliedVersions() (map[int]time.Time, error) {
+	rows, err := sq.Select("version", "applied_at").
+		From("schema_version").
+		RunWith(m.db).Query()
+	if m.dialect.isNoSuchTable(err) {
+		return nil, nil // nothing applied yet
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func (m *migrator) insertVersion(mg Migration) error {
+	_, err := sq.Insert("schema_version").
+		Columns("version", "name", "applied_at").
+		Values(mg.Version, mg.Name, nowExpr).
+		RunWith(m.db).Exec()
+	return err
+}
+
+// splitSQLStatements splits a SQL script into its statements,
+// stripping out comments.
+func splitSQLStatements(script string) []string {
+	var stmts []string
+	var buf bytes.Buffer
+	var quote byte
+
+	flush := func() {
+		if stmt := strings.TrimSpace(buf.String()); len(stmt) > 0 {
+			stmts = append(stmts, stmt)
+		}
+		buf.Reset()
+	}
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case quote != 0:
+			buf.WriteByte(c)
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			buf.WriteByte(c)
+			quote = c
+		case strings.HasPrefix(script[i:], "--"):
+			j := strings.IndexByte(script[i:], '\n')
+			if j == -1 {
+				i = len(script)
+			} else {
+				i += j - 1 // keep line break
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			j := strings.Index(script[i+2:], "*/")
+			if j == -1 {
+				i = len(script)
+			} else {
+				i += j + 3
+			}
+		case c == ';':
+			flush()
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+	return stmts
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigration_SplitStatements(t *testing.T) {
+	script := `/*
+ * Copyright header.
+ */
+
+-- Adds a column; and updates it.
+
+ALTER TABLE t ADD COLUMN c BOOL NOT NULL DEFAULT 0; -- trailing comment
+UPDATE t SET c = 1 WHERE v LIKE '%;--%' /* inline */ AND w = "a;b";
+`
+	stmts := splitSQLStatements(script)
+	require.Equal(t, []string{
+		"ALTER TABLE t ADD COLUMN c BOOL NOT NULL DEFAULT 0",
+		`UPDATE t SET c = 1 WHERE v LIKE '%;--%'  AND w = "a;b"`,
+	}, stmts)
+
+	require.Equal(t, []string{"SELECT 1"}, splitSQLStatements("SELECT 1"))
+	require.Nil(t, splitSQLStatements("-- nothing to do\n"))
+}
+
+func TestMigration_Load(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackal_migrations")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeMigration := func(name, content string) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	writeMigration("0002_second.sql", "ALTER TABLE b ADD COLUMN c INT; ALTER TABLE b ADD COLUMN d INT;")
+	writeMigration("0001_first.sql", "CREATE TABLE a (id INT);")
+	writeMigration("README.md", "not a migration")
+
+	migrations, err := LoadMigrations(dir)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(migrations))
+	require.Equal(t, 1, migrations[0].Version)
+	require.Equal(t, "first", migrations[0].Name)
+	require.Equal(t, "0001_first", migrations[0].String())
+	require.Equal(t, 2, migrations[1].Version)
+	require.Equal(t, 2, len(migrations[1].Statements))
+
+	writeMigration("0002_duplicated.sql", "SELECT 1;")
+	_, err = LoadMigrations(dir)
+	require.NotNil(t, err)
+	os.Remove(filepath.Join(dir, "0002_duplicated.sql"))
+
+	writeMigration("0003_empty.sql", "-- empty")
+	_, err = LoadMigrations(dir)
+	require.NotNil(t, err)
+
+	_, err = LoadMigrations(filepath.Join(dir, "unknown"))
+	require.NotNil(t, err)
+}
+
+func TestMigration_Repository(t *testing.T) {
+	for _, dir := range []string{"../sql/migrations", "../sql/migrations/sqlite"} {
+		migrations, err := LoadMigrations(dir)
+		require.Nil(t, err)
+		require.True(t, len(migrations) > 0)
+		for i, m := range migrations {
+			require.Equal(t, i+1, m.Version)
+		}
+	}
+}
+
+func TestMigration_Status(t *testing.T) {
+	migrations := testMigrations()
+	now := time.Now()
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, now))
+
+	states, err := (&migrator{db: s.db, dialect: mysqlDialect, migrations: migrations}).status()
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(states))
+	require.True(t, states[0].Applied)
+	require.Equal(t, now, states[0].AppliedAt)
+	require.False(t, states[1].Applied)
+
+	// schema version table not yet created
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnError(&mysql.MySQLError{Number: mysqlErrNoSuchTable})
+
+	states, err = (&migrator{db: s.db, dialect: mysqlDialect, migrations: migrations}).status()
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.False(t, states[0].Applied)
+	require.False(t, states[1].Applied)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnError(errMySQLStorage)
+
+	_, err = (&migrator{db: s.db, dialect: mysqlDialect, migrations: migrations}).status()
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMigration_Migrate(t *testing.T) {
+	migrations := testMigrations()
+
+	// dry run
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+
+	pending, err := (&migrator{db: s.db, dialect: mysqlDialect, migrations: migrations}).migrate(true)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []Migration{migrations[1]}, pending)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnError(&mysql.MySQLError{Number: mysqlErrNoSuchTable})
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version (.+)").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE a").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_version (.+)").
+		WithArgs(int64(1), "first").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("ALTER TABLE b ADD COLUMN c").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE b ADD COLUMN d").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_version (.+)").
+		WithArgs(int64(2), "second").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	applied, err := (&migrator{db: s.db, dialect: mysqlDialect, migrations: migrations}).migrate(false)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, migrations, applied)
+
+	// failing migration stops the runner
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version (.+)").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE a").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_version (.+)").
+		WithArgs(int64(1), "first").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("ALTER TABLE b ADD COLUMN c").WillReturnError(errMySQLStorage)
+
+	applied, err = (&migrator{db: s.db, dialect: mysqlDialect, migrations: migrations}).migrate(false)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.NotNil(t, err)
+	require.Equal(t, []Migration{migrations[0]}, applied)
+}
+
+func TestMigration_Baseline(t *testing.T) {
+	migrations := testMigrations()
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_version").
+		WillReturnError(&mysql.MySQLError{Number: mysqlErrNoSuchTable})
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version (.+)").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_version (.+)").
+		WithArgs(int64(1), "first").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	recorded, err := (&migrator{db: s.db, dialect: mysqlDialect, migrations: migrations}).baseline(1)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []Migration{migrations[0]}, recorded)
+}
+
+func testMigrations() []Migration {
+	return []Migration{
+		{Version: 1, Name: "first", Statements: []string{"CREATE TABLE a (id INT)"}},
+		{Version: 2, Name: "second", Statements: []string{
+			"ALTER TABLE b ADD COLUMN c INT",
+			"ALTER TABLE b ADD COLUMN d INT",
+		}},
+	}
+}
@@ -6,8 +6,11 @@
 package storage
 
 import (
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
@@ -24,6 +27,13 @@ type mockStorage struct {
 	privateXML          map[string][]xml.XElement
 	offlineMessages     map[string][]xml.XElement
 	blockListItems      map[string][]model.BlockListItem
+	archiveMessages     map[string][]model.ArchiveMessage
+	capabilities        map[string]model.Capabilities
+	pubSubNodes         map[string]model.PubSubNode
+	pubSubItems         map[string][]model.PubSubItem
+	pushRegistrations   map[string][]model.PushRegistration
+	privacyLists        map[string][]model.PrivacyList
+	resources           map[string][]model.Resource
 }
 
 func newMockStorage() *mockStorage {
@@ -36,12 +46,23 @@ func newMockStorage() *mockStorage {
 		privateXML:          make(map[string][]xml.XElement),
 		offlineMessages:     make(map[string][]xml.XElement),
 		blockListItems:      make(map[string][]model.BlockListItem),
+		archiveMessages:     make(map[string][]model.ArchiveMessage),
+		capabilities:        make(map[string]model.Capabilities),
+		pubSubNodes:         make(map[string]model.PubSubNode),
+		pubSubItems:         make(map[string][]model.PubSubItem),
+		pushRegistrations:   make(map[string][]model.PushRegistration),
+		privacyLists:        make(map[string][]model.PrivacyList),
+		resources:           make(map[string][]model.Resource),
 	}
 }
 
 func (m *mockStorage) Shutdown() {
 }
 
+func (m *mockStorage) Healthy() bool {
+	return atomic.LoadUint32(&m.mockErr) == 0
+}
+
 func (m *mockStorage) FetchUser(username string) (*model.User, error) {
 	var ret *model.User
 	err := m.inReadLock(func() error {
@@ -51,6 +72,16 @@ func (m *mockStorage) FetchUser(username string) (*model.User, error) {
 	return ret, err
 }
 
+func (m *mockStorage) InsertUser(user *model.User) error {
+	return m.inWriteLock(func() error {
+		if m.users[user.Username] != nil {
+			return ErrUserExists
+		}
+		m.users[user.Username] = user
+		return nil
+	})
+}
+
 func (m *mockStorage) InsertOrUpdateUser(user *model.User) error {
 	return m.inWriteLock(func() error {
 		m.users[user.Username] = user
@@ -61,6 +92,26 @@ func (m *mockStorage) InsertOrUpdateUser(user *model.User) error {
 func (m *mockStorage) DeleteUser(username string) error {
 	return m.inWriteLock(func() error {
 		delete(m.users, username)
+		delete(m.rosterItems, username)
+		delete(m.rosterVersions, username)
+		delete(m.rosterNotifications, username)
+		delete(m.vCards, username)
+		delete(m.offlineMessages, username)
+		delete(m.blockListItems, username)
+		delete(m.archiveMessages, username)
+		delete(m.pushRegistrations, username)
+		delete(m.privacyLists, username)
+		for k := range m.privateXML {
+			if strings.HasPrefix(k, username+":") {
+				delete(m.privateXML, k)
+			}
+		}
+		for k := range m.pubSubNodes {
+			if strings.HasPrefix(k, username+"@") {
+				delete(m.pubSubNodes, k)
+				delete(m.pubSubItems, k)
+			}
+		}
 		return nil
 	})
 }
@@ -74,6 +125,17 @@ func (m *mockStorage) UserExists(username string) (bool, error) {
 	return ret, err
 }
 
+func (m *mockStorage) FetchUsernames() ([]string, error) {
+	var usernames []string
+	err := m.inReadLock(func() error {
+		for username := range m.users {
+			usernames = append(usernames, username)
+		}
+		return nil
+	})
+	return usernames, err
+}
+
 func (m *mockStorage) FetchRosterItems(user string) ([]model.RosterItem, model.RosterVersion, error) {
 	var ris []model.RosterItem
 	var v model.RosterVersion
@@ -100,27 +162,36 @@ func (m *mockStorage) FetchRosterItem(user, contact string) (*model.RosterItem,
 	return ret, err
 }
 
+func (m *mockStorage) FetchRosterVersion(user string) (model.RosterVersion, error) {
+	var v model.RosterVersion
+	err := m.inReadLock(func() error {
+		v = m.rosterVersions[user]
+		return nil
+	})
+	return v, err
+}
+
 func (m *mockStorage) InsertOrUpdateRosterItem(ri *model.RosterItem) (model.RosterVersion, error) {
 	var v model.RosterVersion
 	err := m.inWriteLock(func() error {
 		ris := m.rosterItems[ri.Username]
-		if ris != nil {
-			for i, r := range ris {
-				if r.JID == ri.JID {
-					ris[i] = *ri
-					goto done
-				}
+		idx := -1
+		for i, r := range ris {
+			if r.JID == ri.JID {
+				idx = i
+				break
 			}
+		}
+		if idx == -1 {
 			ris = append(ris, *ri)
+			idx = len(ris) - 1
 		} else {
-			ris = []model.RosterItem{*ri}
+			ris[idx] = *ri
 		}
-
-	done:
-		ver := m.rosterVersions[ri.Username]
-		ver.Ver++
-		m.rosterVersions[ri.Username] = ver
-		ris[len(ris)-1].Ver = ver.Ver
+		v = m.rosterVersions[ri.Username]
+		v.Ver++
+		m.rosterVersions[ri.Username] = v
+		ris[idx].Ver = v.Ver
 		m.rosterItems[ri.Username] = ris
 		return nil
 	})
@@ -259,13 +330,33 @@ func (m *mockStorage) DeleteOfflineMessages(username string) error {
 	})
 }
 
+func (m *mockStorage) DeleteExpiredOfflineMessages(before time.Time) (int, error) {
+	var cnt int
+	err := m.inWriteLock(func() error {
+		for username, msgs := range m.offlineMessages {
+			var kept []xml.XElement
+			for _, msg := range msgs {
+				if stamp, ok := offlineMessageStamp(msg); ok && stamp.Before(before) {
+					cnt++
+					continue
+				}
+				kept = append(kept, msg)
+			}
+			m.offlineMessages[username] = kept
+		}
+		return nil
+	})
+	return cnt, err
+}
+
 func (m *mockStorage) InsertOrUpdateBlockListItems(items []model.BlockListItem) error {
 	return m.inWriteLock(func() error {
 		for _, item := range items {
 			bl := m.blockListItems[item.Username]
 			if bl != nil {
-				for _, blItem := range bl {
+				for i, blItem := range bl {
 					if blItem.JID == item.JID {
+						bl[i] = item
 						goto done
 					}
 				}
@@ -297,7 +388,297 @@ func (m *mockStorage) DeleteBlockListItems(items []model.BlockListItem) error {
 func (m *mockStorage) FetchBlockListItems(username string) ([]model.BlockListItem, error) {
 	var ret []model.BlockListItem
 	err := m.inReadLock(func() error {
-		ret = m.blockListItems[username]
+		ret = append(ret, m.blockListItems[username]...)
+		return nil
+	})
+	return ret, err
+}
+
+func (m *mockStorage) FetchBlockListItemsRange(username string, offset, limit int) ([]model.BlockListItem, int, error) {
+	var ret []model.BlockListItem
+	var count int
+	err := m.inReadLock(func() error {
+		bl := m.blockListItems[username]
+		ret = blockListItemsRange(bl, offset, limit)
+		count = len(bl)
+		return nil
+	})
+	return ret, count, err
+}
+
+func (m *mockStorage) InsertArchiveMessage(message *model.ArchiveMessage) error {
+	return m.inWriteLock(func() error {
+		for _, am := range m.archiveMessages[message.Username] {
+			if am.ID == message.ID {
+				return nil
+			}
+		}
+		am := *message
+		am.Message = xml.NewElementFromElement(message.Message)
+		m.archiveMessages[am.Username] = append(m.archiveMessages[am.Username], am)
+		return nil
+	})
+}
+
+func (m *mockStorage) FetchArchiveMessages(username string, filters ArchiveFilters) ([]model.ArchiveMessage, error) {
+	var ret []model.ArchiveMessage
+	err := m.inReadLock(func() error {
+		var err error
+		ret, err = filterArchiveMessages(m.archiveMessages[username], filters)
+		return err
+	})
+	return ret, err
+}
+
+func (m *mockStorage) TrimArchive(before time.Time, maxCount int) (int, error) {
+	var cnt int
+	err := m.inWriteLock(func() error {
+		for username, msgs := range m.archiveMessages {
+			kept := trimArchiveMessages(msgs, before, maxCount)
+			cnt += len(msgs) - len(kept)
+			m.archiveMessages[username] = kept
+		}
+		return nil
+	})
+	return cnt, err
+}
+
+func (m *mockStorage) InsertCapabilities(caps *model.Capabilities) error {
+	return m.inWriteLock(func() error {
+		m.capabilities[caps.Node+"#"+caps.Ver] = *caps
+		return nil
+	})
+}
+
+func (m *mockStorage) FetchCapabilities(node, ver string) (*model.Capabilities, error) {
+	var ret *model.Capabilities
+	err := m.inReadLock(func() error {
+		if c, ok := m.capabilities[node+"#"+ver]; ok {
+			ret = &c
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (m *mockStorage) InsertOrUpdatePubSubNode(node *model.PubSubNode) error {
+	return m.inWriteLock(func() error {
+		m.pubSubNodes[node.Host+":"+node.Name] = *node
+		return nil
+	})
+}
+
+func (m *mockStorage) FetchPubSubNode(host, name string) (*model.PubSubNode, error) {
+	var ret *model.PubSubNode
+	err := m.inReadLock(func() error {
+		if n, ok := m.pubSubNodes[host+":"+name]; ok {
+			ret = &n
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (m *mockStorage) FetchPubSubNodes(host string) ([]model.PubSubNode, error) {
+	var ret []model.PubSubNode
+	err := m.inReadLock(func() error {
+		for _, n := range m.pubSubNodes {
+			if n.Host == host {
+				ret = append(ret, n)
+			}
+		}
+		return nil
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, err
+}
+
+func (m *mockStorage) DeletePubSubNode(host, name string) error {
+	return m.inWriteLock(func() error {
+		delete(m.pubSubNodes, host+":"+name)
+		delete(m.pubSubItems, host+":"+name)
+		return nil
+	})
+}
+
+func (m *mockStorage) InsertOrUpdatePubSubItem(host, name string, item *model.PubSubItem) error {
+	return m.inWriteLock(func() error {
+		it := *item
+		it.Payload = xml.NewElementFromElement(item.Payload)
+
+		key := host + ":" + name
+		items := m.pubSubItems[key]
+		for i, itm := range items {
+			if itm.ID == it.ID {
+				items[i] = it
+				return nil
+			}
+		}
+		m.pubSubItems[key] = append(items, it)
+		return nil
+	})
+}
+
+func (m *mockStorage) FetchPubSubItems(host, name string) ([]model.PubSubItem, error) {
+	var ret []model.PubSubItem
+	err := m.inReadLock(func() error {
+		ret = m.pubSubItems[host+":"+name]
+		return nil
+	})
+	return ret, err
+}
+
+func (m *mockStorage) DeletePubSubItem(host, name, id string) error {
+	return m.inWriteLock(func() error {
+		key := host + ":" + name
+		items := m.pubSubItems[key]
+		for i, itm := range items {
+			if itm.ID == id {
+				m.pubSubItems[key] = append(items[:i], items[i+1:]...)
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (m *mockStorage) InsertPushRegistration(reg *model.PushRegistration) error {
+	return m.inWriteLock(func() error {
+		r := *reg
+		if reg.Options != nil {
+			r.Options = xml.NewElementFromElement(reg.Options)
+		}
+		regs := m.pushRegistrations[r.Username]
+		for i, rg := range regs {
+			if rg.JID == r.JID && rg.Node == r.Node {
+				regs[i] = r
+				return nil
+			}
+		}
+		m.pushRegistrations[r.Username] = append(regs, r)
+		return nil
+	})
+}
+
+func (m *mockStorage) DeletePushRegistrations(username, jid, node string) error {
+	return m.inWriteLock(func() error {
+		var regs []model.PushRegistration
+		for _, rg := range m.pushRegistrations[username] {
+			if rg.JID == jid && (len(node) == 0 || rg.Node == node) {
+				continue
+			}
+			regs = append(regs, rg)
+		}
+		m.pushRegistrations[username] = regs
+		return nil
+	})
+}
+
+func (m *mockStorage) FetchPushRegistrations(username string) ([]model.PushRegistration, error) {
+	var ret []model.PushRegistration
+	err := m.inReadLock(func() error {
+		ret = m.pushRegistrations[username]
+		return nil
+	})
+	return ret, err
+}
+
+func (m *mockStorage) InsertOrUpdatePrivacyList(list *model.PrivacyList) error {
+	return m.inWriteLock(func() error {
+		l := *list
+		l.Items = append([]model.PrivacyListItem(nil), list.Items...)
+		lists := m.privacyLists[l.Username]
+		for i, pl := range lists {
+			if pl.Name == l.Name {
+				l.IsDefault = pl.IsDefault
+				lists[i] = l
+				return nil
+			}
+		}
+		l.IsDefault = false
+		m.privacyLists[l.Username] = append(lists, l)
+		return nil
+	})
+}
+
+func (m *mockStorage) DeletePrivacyList(username, name string) error {
+	return m.inWriteLock(func() error {
+		lists := m.privacyLists[username]
+		for i, pl := range lists {
+			if pl.Name == name {
+				m.privacyLists[username] = append(lists[:i], lists[i+1:]...)
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (m *mockStorage) FetchPrivacyList(username, name string) (*model.PrivacyList, error) {
+	var ret *model.PrivacyList
+	err := m.inReadLock(func() error {
+		for _, pl := range m.privacyLists[username] {
+			if pl.Name == name {
+				l := pl
+				ret = &l
+				return nil
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func (m *mockStorage) FetchPrivacyLists(username string) ([]model.PrivacyList, error) {
+	var ret []model.PrivacyList
+	err := m.inReadLock(func() error {
+		ret = append(ret, m.privacyLists[username]...)
+		return nil
+	})
+	return ret, err
+}
+
+func (m *mockStorage) SetDefaultPrivacyList(username, name string) error {
+	return m.inWriteLock(func() error {
+		lists := m.privacyLists[username]
+		for i := range lists {
+			lists[i].IsDefault = lists[i].Name == name
+		}
+		return nil
+	})
+}
+
+func (m *mockStorage) InsertOrUpdateResource(res *model.Resource) error {
+	return m.inWriteLock(func() error {
+		ress := m.resources[res.Username]
+		for i, r := range ress {
+			if r.Resource == res.Resource {
+				ress[i] = *res
+				return nil
+			}
+		}
+		m.resources[res.Username] = append(ress, *res)
+		return nil
+	})
+}
+
+func (m *mockStorage) DeleteResource(username, resource, streamID string) error {
+	return m.inWriteLock(func() error {
+		ress := m.resources[username]
+		for i, r := range ress {
+			if r.Resource == resource && r.StreamID == streamID {
+				m.resources[username] = append(ress[:i], ress[i+1:]...)
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (m *mockStorage) FetchResources(username string) ([]model.Resource, error) {
+	var ret []model.Resource
+	err := m.inReadLock(func() error {
+		ret = append(ret, m.resources[username]...)
 		return nil
 	})
 	return ret, err
@@ -6,7 +6,9 @@
 package storage
 
 import (
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
@@ -36,6 +38,19 @@ func TestMockStorageUserExists(t *testing.T) {
 	require.False(t, ok)
 }
 
+func TestMockStorageFetchUsernames(t *testing.T) {
+	s := newMockStorage()
+	_ = s.InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+
+	s.activateMockedError()
+	_, err := s.FetchUsernames()
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+	usernames, err := s.FetchUsernames()
+	require.Nil(t, err)
+	require.Equal(t, []string{"ortuman"}, usernames)
+}
+
 func TestMockStorageFetchUser(t *testing.T) {
 	u := model.User{Username: "ortuman", Password: "1234"}
 	s := newMockStorage()
@@ -65,6 +80,37 @@ func TestMockStorageDeleteUser(t *testing.T) {
 	require.Nil(t, usr)
 }
 
+func TestMockStorageInsertNewUser(t *testing.T) {
+	u := model.User{Username: "ortuman", Password: "1234"}
+	s := newMockStorage()
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertUser(&u))
+	s.deactivateMockedError()
+	require.Nil(t, s.InsertUser(&u))
+	require.Equal(t, ErrUserExists, s.InsertUser(&u))
+}
+
+func TestMockStorageDeleteUserData(t *testing.T) {
+	s := newMockStorage()
+	_ = s.InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+	_, _ = s.InsertOrUpdateRosterItem(&model.RosterItem{Username: "ortuman", JID: "romeo@jackal.im"})
+	_ = s.InsertOrUpdateBlockListItems([]model.BlockListItem{{Username: "ortuman", JID: "juliet@jackal.im"}})
+	_ = s.InsertOrUpdatePrivateXML([]xml.XElement{xml.NewElementNamespace("exodus", "exodus:ns")}, "exodus:ns", "ortuman")
+	_ = s.InsertOrUpdateRosterNotification(&model.RosterNotification{Contact: "ortuman", JID: "romeo@jackal.im"})
+
+	require.Nil(t, s.DeleteUser("ortuman"))
+
+	rns, _ := s.FetchRosterNotifications("ortuman")
+	require.Equal(t, 0, len(rns))
+
+	ris, _, _ := s.FetchRosterItems("ortuman")
+	require.Equal(t, 0, len(ris))
+	bl, _ := s.FetchBlockListItems("ortuman")
+	require.Equal(t, 0, len(bl))
+	prv, _ := s.FetchPrivateXML("exodus:ns", "ortuman")
+	require.Equal(t, 0, len(prv))
+}
+
 func TestMockStorageInsertRosterItem(t *testing.T) {
 	g := []string{"general", "friends"}
 	ri := model.RosterItem{"user", "contact", "a name", "both", false, 1, g}
@@ -77,8 +123,31 @@ func TestMockStorageInsertRosterItem(t *testing.T) {
 	_, err = s.InsertOrUpdateRosterItem(&ri)
 	require.Nil(t, err)
 	ri.Subscription = "to"
-	_, err = s.InsertOrUpdateRosterItem(&ri)
+	v, err := s.InsertOrUpdateRosterItem(&ri)
+	require.Nil(t, err)
+	require.Equal(t, 2, v.Ver)
+
+	ri2, _ := s.FetchRosterItem("user", "contact")
+	require.Equal(t, 2, ri2.Ver)
+}
+
+func TestMockStorageFetchRosterVersion(t *testing.T) {
+	g := []string{"general", "friends"}
+	ri := model.RosterItem{"user", "contact", "a name", "both", false, 1, g}
+
+	s := newMockStorage()
+	s.InsertOrUpdateRosterItem(&ri)
+	s.DeleteRosterItem("user", "contact")
+
+	s.activateMockedError()
+	_, err := s.FetchRosterVersion("user")
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	v, err := s.FetchRosterVersion("user")
 	require.Nil(t, err)
+	require.Equal(t, 2, v.Ver)
+	require.Equal(t, 2, v.DeletionVer)
 }
 
 func TestMockStorageFetchRosterItem(t *testing.T) {
@@ -326,11 +395,32 @@ func TestMockStorageDeleteOfflineMessages(t *testing.T) {
 	require.Equal(t, 0, len(elems))
 }
 
+func TestMockStorageDeleteExpiredOfflineMessages(t *testing.T) {
+	now := time.Now()
+	s := newMockStorage()
+	for i := 0; i < 3; i++ {
+		m := xml.NewElementName("message")
+		m.AppendElement(xml.NewDelay("jackal.im", now.Add(-time.Duration(i)*time.Hour), "Offline Storage"))
+		s.InsertOfflineMessage(m, "ortuman")
+	}
+	s.InsertOfflineMessage(xml.NewElementName("message"), "ortuman")
+
+	s.activateMockedError()
+	_, err := s.DeleteExpiredOfflineMessages(now)
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	cnt, _ := s.DeleteExpiredOfflineMessages(now.Add(-time.Minute))
+	require.Equal(t, 2, cnt)
+	cnt, _ = s.CountOfflineMessages("ortuman")
+	require.Equal(t, 2, cnt)
+}
+
 func TestMockStorageInsertOrUpdateBlockListItems(t *testing.T) {
 	items := []model.BlockListItem{
-		{"ortuman", "user@jackal.im"},
-		{"ortuman", "romeo@jackal.im"},
-		{"ortuman", "juliet@jackal.im"},
+		{Username: "ortuman", JID: "user@jackal.im"},
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "juliet@jackal.im"},
 	}
 	s := newMockStorage()
 	s.activateMockedError()
@@ -348,16 +438,42 @@ func TestMockStorageInsertOrUpdateBlockListItems(t *testing.T) {
 	require.Equal(t, items, sItems)
 }
 
+func TestMockStorageFetchBlockListItemsRange(t *testing.T) {
+	items := []model.BlockListItem{
+		{Username: "ortuman", JID: "user@jackal.im"},
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "juliet@jackal.im"},
+	}
+	s := newMockStorage()
+	s.InsertOrUpdateBlockListItems(items)
+
+	sItems, count, _ := s.FetchBlockListItemsRange("ortuman", 0, 2)
+	require.Equal(t, items[:2], sItems)
+	require.Equal(t, 3, count)
+
+	sItems, _, _ = s.FetchBlockListItemsRange("ortuman", 1, -1)
+	require.Equal(t, items[1:], sItems)
+
+	sItems, count, _ = s.FetchBlockListItemsRange("ortuman", 3, 2)
+	require.Nil(t, sItems)
+	require.Equal(t, 3, count)
+
+	s.activateMockedError()
+	_, _, err := s.FetchBlockListItemsRange("ortuman", 0, 2)
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+}
+
 func TestMockStorageDeleteBlockListItems(t *testing.T) {
 	items := []model.BlockListItem{
-		{"ortuman", "user@jackal.im"},
-		{"ortuman", "romeo@jackal.im"},
-		{"ortuman", "juliet@jackal.im"},
+		{Username: "ortuman", JID: "user@jackal.im"},
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "juliet@jackal.im"},
 	}
 	s := newMockStorage()
 	s.InsertOrUpdateBlockListItems(items)
 
-	delItems := []model.BlockListItem{{"ortuman", "romeo@jackal.im"}}
+	delItems := []model.BlockListItem{{Username: "ortuman", JID: "romeo@jackal.im"}}
 	s.activateMockedError()
 	require.Equal(t, ErrMockedError, s.DeleteBlockListItems(delItems))
 	s.deactivateMockedError()
@@ -365,7 +481,234 @@ func TestMockStorageDeleteBlockListItems(t *testing.T) {
 	s.DeleteBlockListItems(delItems)
 	sItems, _ := s.FetchBlockListItems("ortuman")
 	require.Equal(t, []model.BlockListItem{
-		{"ortuman", "user@jackal.im"},
-		{"ortuman", "juliet@jackal.im"},
+		{Username: "ortuman", JID: "user@jackal.im"},
+		{Username: "ortuman", JID: "juliet@jackal.im"},
 	}, sItems)
 }
+
+func TestMockStorageArchiveMessages(t *testing.T) {
+	now := time.Now()
+	s := newMockStorage()
+	for i, jid := range []string{"noelia@jackal.im", "romeo@jackal.im", "noelia@jackal.im/garden", "noelia@jackal.im"} {
+		am := model.ArchiveMessage{
+			ID:       strconv.Itoa(i),
+			Username: "ortuman",
+			JID:      jid,
+			Message:  xml.NewElementName("message"),
+			Stamp:    now.Add(time.Duration(i) * time.Minute),
+		}
+		require.Nil(t, s.InsertArchiveMessage(&am))
+	}
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertArchiveMessage(&model.ArchiveMessage{Message: xml.NewElementName("message")}))
+	_, err := s.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	msgs, _ := s.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Equal(t, 4, len(msgs))
+
+	msgs, _ = s.FetchArchiveMessages("ortuman", ArchiveFilters{With: "noelia@jackal.im"})
+	require.Equal(t, 3, len(msgs))
+
+	msgs, _ = s.FetchArchiveMessages("ortuman", ArchiveFilters{Start: now.Add(time.Minute), End: now.Add(time.Minute * 2)})
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "1", msgs[0].ID)
+
+	msgs, _ = s.FetchArchiveMessages("ortuman", ArchiveFilters{After: "0", Max: 2})
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "1", msgs[0].ID)
+	require.Equal(t, "2", msgs[1].ID)
+
+	msgs, _ = s.FetchArchiveMessages("ortuman", ArchiveFilters{Before: "3", Max: 2})
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "1", msgs[0].ID)
+	require.Equal(t, "2", msgs[1].ID)
+
+	msgs, _ = s.FetchArchiveMessages("ortuman", ArchiveFilters{LastPage: true, Max: 2})
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "2", msgs[0].ID)
+	require.Equal(t, "3", msgs[1].ID)
+
+	msgs, _ = s.FetchArchiveMessages("ortuman", ArchiveFilters{With: "noelia@jackal.im/garden"})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "2", msgs[0].ID)
+
+	_, err = s.FetchArchiveMessages("ortuman", ArchiveFilters{After: "unknown"})
+	require.Equal(t, ErrArchiveMessageNotFound, err)
+
+	// already archived identifier
+	require.Nil(t, s.InsertArchiveMessage(&model.ArchiveMessage{ID: "3", Username: "ortuman", Message: xml.NewElementName("message")}))
+	msgs, _ = s.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Equal(t, 4, len(msgs))
+}
+
+func TestMockStorageTrimArchive(t *testing.T) {
+	now := time.Now()
+	s := newMockStorage()
+	for i := 0; i < 5; i++ {
+		am := model.ArchiveMessage{
+			ID:       strconv.Itoa(i),
+			Username: "ortuman",
+			JID:      "noelia@jackal.im",
+			Message:  xml.NewElementName("message"),
+			Stamp:    now.Add(time.Duration(i) * time.Minute),
+		}
+		require.Nil(t, s.InsertArchiveMessage(&am))
+	}
+	s.activateMockedError()
+	_, err := s.TrimArchive(now, 0)
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	cnt, _ := s.TrimArchive(now.Add(time.Minute), 0)
+	require.Equal(t, 1, cnt)
+
+	cnt, _ = s.TrimArchive(time.Time{}, 2)
+	require.Equal(t, 2, cnt)
+
+	msgs, _ := s.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "3", msgs[0].ID)
+	require.Equal(t, "4", msgs[1].ID)
+}
+
+func TestMockStorageCapabilities(t *testing.T) {
+	caps := model.Capabilities{Node: "http://code.google.com/p/exodus", Ver: "QgayPKawpkPSDYmwT/WM94uAlu0=", Features: []string{"urn:xmpp:ping"}}
+
+	s := newMockStorage()
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertCapabilities(&caps))
+	_, err := s.FetchCapabilities(caps.Node, caps.Ver)
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	require.Nil(t, s.InsertCapabilities(&caps))
+
+	fetched, err := s.FetchCapabilities(caps.Node, caps.Ver)
+	require.Nil(t, err)
+	require.Equal(t, caps, *fetched)
+
+	fetched, err = s.FetchCapabilities(caps.Node, "unknown")
+	require.Nil(t, err)
+	require.Nil(t, fetched)
+}
+
+func TestMockStorageHealthy(t *testing.T) {
+	s := newMockStorage()
+	require.True(t, s.Healthy())
+	s.activateMockedError()
+	require.False(t, s.Healthy())
+	s.deactivateMockedError()
+	require.True(t, s.Healthy())
+}
+
+func TestMockStoragePubSubNodes(t *testing.T) {
+	s := newMockStorage()
+	node := model.PubSubNode{Host: "ortuman@jackal.im", Name: "urn:xmpp:avatar:data", AccessModel: "presence"}
+	require.Nil(t, s.InsertOrUpdatePubSubNode(&node))
+
+	n, err := s.FetchPubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, err)
+	require.NotNil(t, n)
+	require.Equal(t, "presence", n.AccessModel)
+
+	n, _ = s.FetchPubSubNode("noelia@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, n)
+
+	item := model.PubSubItem{ID: "abc1234", Publisher: "ortuman@jackal.im", Payload: xml.NewElementName("data")}
+	require.Nil(t, s.InsertOrUpdatePubSubItem("ortuman@jackal.im", "urn:xmpp:avatar:data", &item))
+	require.Nil(t, s.InsertOrUpdatePubSubItem("ortuman@jackal.im", "urn:xmpp:avatar:data", &item))
+
+	items, _ := s.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Equal(t, 1, len(items))
+	require.Equal(t, "abc1234", items[0].ID)
+
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertOrUpdatePubSubNode(&node))
+	_, err = s.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	require.Nil(t, s.DeletePubSubItem("ortuman@jackal.im", "urn:xmpp:avatar:data", "abc1234"))
+	items, _ = s.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Equal(t, 0, len(items))
+
+	require.Nil(t, s.InsertOrUpdatePubSubItem("ortuman@jackal.im", "urn:xmpp:avatar:data", &item))
+	require.Nil(t, s.DeletePubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data"))
+	n, _ = s.FetchPubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, n)
+	items, _ = s.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Equal(t, 0, len(items))
+}
+
+func TestMockStorageFetchPubSubNodes(t *testing.T) {
+	s := newMockStorage()
+	for _, name := range []string{"urn:xmpp:avatar:metadata", "urn:xmpp:avatar:data"} {
+		require.Nil(t, s.InsertOrUpdatePubSubNode(&model.PubSubNode{Host: "ortuman@jackal.im", Name: name, AccessModel: "presence"}))
+	}
+	require.Nil(t, s.InsertOrUpdatePubSubNode(&model.PubSubNode{Host: "noelia@jackal.im", Name: "urn:xmpp:avatar:data", AccessModel: "open"}))
+
+	nodes, err := s.FetchPubSubNodes("ortuman@jackal.im")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(nodes))
+	require.Equal(t, "urn:xmpp:avatar:data", nodes[0].Name)
+
+	require.Nil(t, s.DeleteUser("ortuman"))
+	nodes, _ = s.FetchPubSubNodes("ortuman@jackal.im")
+	require.Equal(t, 0, len(nodes))
+	nodes, _ = s.FetchPubSubNodes("noelia@jackal.im")
+	require.Equal(t, 1, len(nodes))
+}
+
+func TestMockStoragePushRegistrations(t *testing.T) {
+	s := newMockStorage()
+	require.Nil(t, s.InsertPushRegistration(&model.PushRegistration{Username: "ortuman", JID: "push.jackal.im", Node: "n1"}))
+	require.Nil(t, s.InsertPushRegistration(&model.PushRegistration{Username: "ortuman", JID: "push.jackal.im", Node: "n2"}))
+	require.Nil(t, s.InsertPushRegistration(&model.PushRegistration{Username: "ortuman", JID: "push2.jackal.im", Node: "n1"}))
+	require.Nil(t, s.InsertPushRegistration(&model.PushRegistration{Username: "ortuman", JID: "push.jackal.im", Node: "n1"}))
+
+	regs, err := s.FetchPushRegistrations("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(regs))
+
+	require.Nil(t, s.DeletePushRegistrations("ortuman", "push2.jackal.im", "n1"))
+	regs, _ = s.FetchPushRegistrations("ortuman")
+	require.Equal(t, 2, len(regs))
+
+	require.Nil(t, s.DeletePushRegistrations("ortuman", "push.jackal.im", ""))
+	regs, _ = s.FetchPushRegistrations("ortuman")
+	require.Equal(t, 0, len(regs))
+
+	s.activateMockedError()
+	_, err = s.FetchPushRegistrations("ortuman")
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+}
+
+func TestMockStoragePrivacyLists(t *testing.T) {
+	s := newMockStorage()
+	items := []model.PrivacyListItem{{Type: "jid", Value: "juliet@jackal.im", Action: "deny", Order: 1}}
+	require.Nil(t, s.InsertOrUpdatePrivacyList(&model.PrivacyList{Username: "ortuman", Name: "public", Items: items}))
+	require.Nil(t, s.InsertOrUpdatePrivacyList(&model.PrivacyList{Username: "ortuman", Name: "private"}))
+
+	lists, err := s.FetchPrivacyLists("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(lists))
+
+	require.Nil(t, s.SetDefaultPrivacyList("ortuman", "public"))
+	require.Nil(t, s.InsertOrUpdatePrivacyList(&model.PrivacyList{Username: "ortuman", Name: "public", Items: items}))
+	l, err := s.FetchPrivacyList("ortuman", "public")
+	require.Nil(t, err)
+	require.True(t, l.IsDefault)
+	require.Equal(t, items, l.Items)
+
+	require.Nil(t, s.DeletePrivacyList("ortuman", "public"))
+	l, _ = s.FetchPrivacyList("ortuman", "public")
+	require.Nil(t, l)
+
+	s.activateMockedError()
+	_, err = s.FetchPrivacyLists("ortuman")
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+}
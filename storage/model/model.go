@@ -22,20 +22,39 @@ type GobDeserializer interface {
 	FromGob(dec *gob.Decoder)
 }
 
+// Stored password hashing schemes.
+// Plaintext passwords carry no scheme.
+const (
+	PlainPasswordScheme    = ""
+	BcryptPasswordScheme   = "bcrypt"
+	Argon2idPasswordScheme = "argon2id"
+)
+
 // User represents a user storage entity.
 type User struct {
 	Username        string
 	Password        string
+	PasswordScheme  string // scheme password is hashed with
+	ScramSHA256     string // salted SCRAM-SHA-256 credentials
 	LoggedOutStatus string
 	LoggedOutAt     time.Time
 }
 
+// HasPlainPassword returns whether or not user password is stored
+// in plaintext, as required by every challenge-response mechanism
+// other than SCRAM-SHA-256.
+func (u *User) HasPlainPassword() bool {
+	return len(u.Password) > 0 && u.PasswordScheme == PlainPasswordScheme
+}
+
 // FromGob deserializes a User entity from it's gob binary representation.
 func (u *User) FromGob(dec *gob.Decoder) {
 	dec.Decode(&u.Username)
 	dec.Decode(&u.Password)
 	dec.Decode(&u.LoggedOutStatus)
 	dec.Decode(&u.LoggedOutAt)
+	dec.Decode(&u.ScramSHA256)
+	dec.Decode(&u.PasswordScheme)
 }
 
 // ToGob converts a User entity to it's gob binary representation.
@@ -44,6 +63,8 @@ func (u *User) ToGob(enc *gob.Encoder) {
 	enc.Encode(&u.Password)
 	enc.Encode(&u.LoggedOutStatus)
 	enc.Encode(&u.LoggedOutAt)
+	enc.Encode(&u.ScramSHA256)
+	enc.Encode(&u.PasswordScheme)
 }
 
 // RosterItem represents a roster item storage entity.
@@ -134,10 +155,18 @@ func (rn *RosterNotification) ToGob(enc *gob.Encoder) {
 	}
 }
 
+// Block list item report reasons (XEP-0377).
+const (
+	ReportSpam  = "spam"
+	ReportAbuse = "abuse"
+)
+
 // BlockListItem represents block list item storage entity.
 type BlockListItem struct {
 	Username string
 	JID      string
+	Domain   bool   // blocks every JID within JID domain
+	Reason   string // reported reason, if the blocked JID was reported as well
 }
 
 // FromGob deserializes a BlockListItem entity
@@ -145,6 +174,13 @@ type BlockListItem struct {
 func (bli *BlockListItem) FromGob(dec *gob.Decoder) {
 	dec.Decode(&bli.Username)
 	dec.Decode(&bli.JID)
+	if err := dec.Decode(&bli.Domain); err != nil {
+		// item stored before domain blocks were introduced
+		j, _ := xml.NewJIDString(bli.JID, true)
+		bli.Domain = j != nil && j.IsServer() && !j.IsFull()
+		return
+	}
+	dec.Decode(&bli.Reason)
 }
 
 // ToGob converts a BlockListItem entity
@@ -152,4 +188,275 @@ func (bli *BlockListItem) FromGob(dec *gob.Decoder) {
 func (bli *BlockListItem) ToGob(enc *gob.Encoder) {
 	enc.Encode(&bli.Username)
 	enc.Encode(&bli.JID)
+	enc.Encode(&bli.Domain)
+	enc.Encode(&bli.Reason)
+}
+
+// Archived message directions, as seen from the archive owner.
+const (
+	ArchiveSent     = "sent"
+	ArchiveReceived = "received"
+)
+
+// ArchiveMessage represents an archived message storage entity.
+type ArchiveMessage struct {
+	ID        string
+	Username  string
+	JID       string
+	Message   xml.XElement
+	Stamp     time.Time
+	Direction string
+}
+
+// FromGob deserializes an ArchiveMessage entity
+// from it's gob binary representation.
+func (am *ArchiveMessage) FromGob(dec *gob.Decoder) {
+	dec.Decode(&am.ID)
+	dec.Decode(&am.Username)
+	dec.Decode(&am.JID)
+	var e xml.Element
+	e.FromGob(dec)
+	am.Message = &e
+	dec.Decode(&am.Stamp)
+	dec.Decode(&am.Direction) // missing in entries archived before v0.3.0
+}
+
+// ToGob converts an ArchiveMessage entity
+// to it's gob binary representation.
+func (am *ArchiveMessage) ToGob(enc *gob.Encoder) {
+	enc.Encode(&am.ID)
+	enc.Encode(&am.Username)
+	enc.Encode(&am.JID)
+	xml.NewElementFromElement(am.Message).ToGob(enc)
+	enc.Encode(&am.Stamp)
+	enc.Encode(&am.Direction)
+}
+
+// PubSubNode represents a pubsub node storage entity.
+type PubSubNode struct {
+	Host        string
+	Name        string
+	AccessModel string
+}
+
+// FromGob deserializes a PubSubNode entity
+// from it's gob binary representation.
+func (n *PubSubNode) FromGob(dec *gob.Decoder) {
+	dec.Decode(&n.Host)
+	dec.Decode(&n.Name)
+	dec.Decode(&n.AccessModel)
+}
+
+// ToGob converts a PubSubNode entity
+// to it's gob binary representation.
+func (n *PubSubNode) ToGob(enc *gob.Encoder) {
+	enc.Encode(&n.Host)
+	enc.Encode(&n.Name)
+	enc.Encode(&n.AccessModel)
+}
+
+// PubSubItem represents a pubsub node item storage entity.
+type PubSubItem struct {
+	ID        string
+	Publisher string
+	Payload   xml.XElement
+}
+
+// FromGob deserializes a PubSubItem entity
+// from it's gob binary representation.
+func (i *PubSubItem) FromGob(dec *gob.Decoder) {
+	dec.Decode(&i.ID)
+	dec.Decode(&i.Publisher)
+	var e xml.Element
+	e.FromGob(dec)
+	i.Payload = &e
+}
+
+// ToGob converts a PubSubItem entity
+// to it's gob binary representation.
+func (i *PubSubItem) ToGob(enc *gob.Encoder) {
+	enc.Encode(&i.ID)
+	enc.Encode(&i.Publisher)
+	xml.NewElementFromElement(i.Payload).ToGob(enc)
+}
+
+// PushRegistration represents a push notifications (XEP-0357) registration storage entity.
+type PushRegistration struct {
+	Username string
+	JID      string
+	Node     string
+	Options  xml.XElement
+}
+
+// FromGob deserializes a PushRegistration entity
+// from it's gob binary representation.
+func (pr *PushRegistration) FromGob(dec *gob.Decoder) {
+	dec.Decode(&pr.Username)
+	dec.Decode(&pr.JID)
+	dec.Decode(&pr.Node)
+	var hasOptions bool
+	dec.Decode(&hasOptions)
+	if hasOptions {
+		var e xml.Element
+		e.FromGob(dec)
+		pr.Options = &e
+	}
+}
+
+// ToGob converts a PushRegistration entity
+// to it's gob binary representation.
+func (pr *PushRegistration) ToGob(enc *gob.Encoder) {
+	enc.Encode(&pr.Username)
+	enc.Encode(&pr.JID)
+	enc.Encode(&pr.Node)
+	hasOptions := pr.Options != nil
+	enc.Encode(&hasOptions)
+	if hasOptions {
+		xml.NewElementFromElement(pr.Options).ToGob(enc)
+	}
+}
+
+// PrivacyListItem represents a privacy list (XEP-0016) rule.
+type PrivacyListItem struct {
+	Type        string // jid, group, subscription or empty (fall-through item)
+	Value       string
+	Action      string // allow or deny
+	Order       int
+	Message     bool
+	IQ          bool
+	PresenceIn  bool
+	PresenceOut bool
+}
+
+// FromGob deserializes a PrivacyListItem entity
+// from it's gob binary representation.
+func (pli *PrivacyListItem) FromGob(dec *gob.Decoder) {
+	dec.Decode(&pli.Type)
+	dec.Decode(&pli.Value)
+	dec.Decode(&pli.Action)
+	dec.Decode(&pli.Order)
+	dec.Decode(&pli.Message)
+	dec.Decode(&pli.IQ)
+	dec.Decode(&pli.PresenceIn)
+	dec.Decode(&pli.PresenceOut)
+}
+
+// ToGob converts a PrivacyListItem entity
+// to it's gob binary representation.
+func (pli *PrivacyListItem) ToGob(enc *gob.Encoder) {
+	enc.Encode(&pli.Type)
+	enc.Encode(&pli.Value)
+	enc.Encode(&pli.Action)
+	enc.Encode(&pli.Order)
+	enc.Encode(&pli.Message)
+	enc.Encode(&pli.IQ)
+	enc.Encode(&pli.PresenceIn)
+	enc.Encode(&pli.PresenceOut)
+}
+
+// PrivacyList represents a privacy list (XEP-0016) storage entity.
+type PrivacyList struct {
+	Username  string
+	Name      string
+	IsDefault bool
+	Items     []PrivacyListItem
+}
+
+// FromGob deserializes a PrivacyList entity
+// from it's gob binary representation.
+func (pl *PrivacyList) FromGob(dec *gob.Decoder) {
+	dec.Decode(&pl.Username)
+	dec.Decode(&pl.Name)
+	dec.Decode(&pl.IsDefault)
+	var ln int
+	dec.Decode(&ln)
+	for i := 0; i < ln; i++ {
+		var itm PrivacyListItem
+		itm.FromGob(dec)
+		pl.Items = append(pl.Items, itm)
+	}
+}
+
+// ToGob converts a PrivacyList entity
+// to it's gob binary representation.
+func (pl *PrivacyList) ToGob(enc *gob.Encoder) {
+	enc.Encode(&pl.Username)
+	enc.Encode(&pl.Name)
+	enc.Encode(&pl.IsDefault)
+	enc.Encode(len(pl.Items))
+	for i := range pl.Items {
+		pl.Items[i].ToGob(enc)
+	}
+}
+
+// Resource represents an online user resource storage entity.
+type Resource struct {
+	Username     string
+	Resource     string
+	StreamID     string
+	Presence     xml.XElement
+	LastActivity time.Time
+}
+
+// FromGob deserializes a Resource entity
+// from it's gob binary representation.
+func (r *Resource) FromGob(dec *gob.Decoder) {
+	dec.Decode(&r.Username)
+	dec.Decode(&r.Resource)
+	dec.Decode(&r.StreamID)
+	dec.Decode(&r.LastActivity)
+	var hasPresence bool
+	dec.Decode(&hasPresence)
+	if hasPresence {
+		var e xml.Element
+		e.FromGob(dec)
+		r.Presence = &e
+	}
+}
+
+// ToGob converts a Resource entity
+// to it's gob binary representation.
+func (r *Resource) ToGob(enc *gob.Encoder) {
+	enc.Encode(&r.Username)
+	enc.Encode(&r.Resource)
+	enc.Encode(&r.StreamID)
+	enc.Encode(&r.LastActivity)
+	hasPresence := r.Presence != nil
+	enc.Encode(&hasPresence)
+	if hasPresence {
+		xml.NewElementFromElement(r.Presence).ToGob(enc)
+	}
+}
+
+// Capabilities represents an entity capabilities (XEP-0115) storage entity.
+type Capabilities struct {
+	Node     string
+	Ver      string
+	Features []string
+}
+
+// HasFeature returns whether or not capabilities include a given feature.
+func (c *Capabilities) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// FromGob deserializes a Capabilities entity
+// from it's gob binary representation.
+func (c *Capabilities) FromGob(dec *gob.Decoder) {
+	dec.Decode(&c.Node)
+	dec.Decode(&c.Ver)
+	dec.Decode(&c.Features)
+}
+
+// ToGob converts a Capabilities entity
+// to it's gob binary representation.
+func (c *Capabilities) ToGob(enc *gob.Encoder) {
+	enc.Encode(&c.Node)
+	enc.Encode(&c.Ver)
+	enc.Encode(&c.Features)
 }
@@ -20,7 +20,9 @@ func TestModelUser(t *testing.T) {
 
 	now := time.Now()
 	usr1.Username = "ortuman"
-	usr1.Password = "1234"
+	usr1.Password = "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
+	usr1.PasswordScheme = BcryptPasswordScheme
+	usr1.ScramSHA256 = "4096:c2FsdA==:c3RvcmVk:c2VydmVy"
 	usr1.LoggedOutStatus = "Gone!"
 	usr1.LoggedOutAt = now
 
@@ -30,6 +32,9 @@ func TestModelUser(t *testing.T) {
 	usr2.FromGob(gob.NewDecoder(buf))
 	require.Equal(t, usr1.Username, usr2.Username)
 	require.Equal(t, usr1.Password, usr2.Password)
+	require.Equal(t, usr1.PasswordScheme, usr2.PasswordScheme)
+	require.False(t, usr2.HasPlainPassword())
+	require.Equal(t, usr1.ScramSHA256, usr2.ScramSHA256)
 	require.Equal(t, usr1.LoggedOutAt.Format(time.RFC3339), usr2.LoggedOutAt.Format(time.RFC3339))
 }
 
@@ -77,3 +82,153 @@ func TestModelRosterNotification(t *testing.T) {
 	require.Equal(t, 1, len(rn2.Elements))
 	require.Equal(t, rn1.Elements[0].String(), rn2.Elements[0].String())
 }
+
+func TestModelArchiveMessage(t *testing.T) {
+	var am1, am2 ArchiveMessage
+
+	am1 = ArchiveMessage{
+		ID:        "1234",
+		Username:  "ortuman",
+		JID:       "noelia@jackal.im",
+		Message:   xml.NewElementName("message"),
+		Stamp:     time.Now(),
+		Direction: ArchiveSent,
+	}
+	buf := new(bytes.Buffer)
+	am1.ToGob(gob.NewEncoder(buf))
+	am2.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, "1234", am2.ID)
+	require.Equal(t, "ortuman", am2.Username)
+	require.Equal(t, "noelia@jackal.im", am2.JID)
+	require.Equal(t, am1.Message.String(), am2.Message.String())
+	require.Equal(t, am1.Stamp.Format(time.RFC3339), am2.Stamp.Format(time.RFC3339))
+	require.Equal(t, ArchiveSent, am2.Direction)
+}
+
+func TestModelPubSubNode(t *testing.T) {
+	var n1, n2 PubSubNode
+
+	n1 = PubSubNode{Host: "ortuman@jackal.im", Name: "urn:xmpp:avatar:data", AccessModel: "presence"}
+	buf := new(bytes.Buffer)
+	n1.ToGob(gob.NewEncoder(buf))
+	n2.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, n1, n2)
+}
+
+func TestModelPubSubItem(t *testing.T) {
+	var i1, i2 PubSubItem
+
+	i1 = PubSubItem{
+		ID:        "abc1234",
+		Publisher: "ortuman@jackal.im",
+		Payload:   xml.NewElementNamespace("geoloc", "http://jabber.org/protocol/geoloc"),
+	}
+	buf := new(bytes.Buffer)
+	i1.ToGob(gob.NewEncoder(buf))
+	i2.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, "abc1234", i2.ID)
+	require.Equal(t, "ortuman@jackal.im", i2.Publisher)
+	require.Equal(t, i1.Payload.String(), i2.Payload.String())
+}
+
+func TestModelPushRegistration(t *testing.T) {
+	var r1, r2, r3 PushRegistration
+
+	r1 = PushRegistration{Username: "ortuman", JID: "push.jackal.im", Node: "yxs32uqsflafdk3iuqo"}
+	buf := new(bytes.Buffer)
+	r1.ToGob(gob.NewEncoder(buf))
+	r2.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, r1, r2)
+
+	r1.Options = xml.NewElementNamespace("x", "jabber:x:data")
+	buf = new(bytes.Buffer)
+	r1.ToGob(gob.NewEncoder(buf))
+	r3.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, "yxs32uqsflafdk3iuqo", r3.Node)
+	require.NotNil(t, r3.Options)
+	require.Equal(t, r1.Options.String(), r3.Options.String())
+}
+
+func TestModelPrivacyList(t *testing.T) {
+	var pl1, pl2 PrivacyList
+
+	pl1 = PrivacyList{
+		Username:  "ortuman",
+		Name:      "public",
+		IsDefault: true,
+		Items: []PrivacyListItem{
+			{Type: "jid", Value: "juliet@jackal.im", Action: "deny", Order: 1, Message: true, PresenceIn: true},
+			{Action: "allow", Order: 2},
+		},
+	}
+	buf := new(bytes.Buffer)
+	pl1.ToGob(gob.NewEncoder(buf))
+	pl2.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, pl1, pl2)
+}
+
+func TestModelResource(t *testing.T) {
+	var r1, r2, r3 Resource
+
+	now := time.Now()
+	r1 = Resource{Username: "ortuman", Resource: "balcony", StreamID: "abcd1234", LastActivity: now}
+	buf := new(bytes.Buffer)
+	r1.ToGob(gob.NewEncoder(buf))
+	r2.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, "ortuman", r2.Username)
+	require.Equal(t, "balcony", r2.Resource)
+	require.Equal(t, "abcd1234", r2.StreamID)
+	require.Equal(t, now.Format(time.RFC3339), r2.LastActivity.Format(time.RFC3339))
+	require.Nil(t, r2.Presence)
+
+	r1.Presence = xml.NewElementName("presence")
+	buf = new(bytes.Buffer)
+	r1.ToGob(gob.NewEncoder(buf))
+	r3.FromGob(gob.NewDecoder(buf))
+	require.NotNil(t, r3.Presence)
+	require.Equal(t, r1.Presence.String(), r3.Presence.String())
+}
+
+func TestModelBlockListItem(t *testing.T) {
+	bli1 := BlockListItem{Username: "ortuman", JID: "jabber.org", Domain: true, Reason: ReportSpam}
+	buf := new(bytes.Buffer)
+	bli1.ToGob(gob.NewEncoder(buf))
+	bli2 := BlockListItem{}
+	bli2.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, bli1, bli2)
+
+	// items stored without report reason
+	buf = new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	enc.Encode("ortuman")
+	enc.Encode("noelia@jackal.im")
+	enc.Encode(false)
+	bli3 := BlockListItem{}
+	bli3.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, BlockListItem{Username: "ortuman", JID: "noelia@jackal.im"}, bli3)
+
+	// items stored without domain flag
+	for _, jid := range []string{"jabber.org", "noelia@jackal.im"} {
+		buf = new(bytes.Buffer)
+		enc := gob.NewEncoder(buf)
+		enc.Encode("ortuman")
+		enc.Encode(jid)
+		bli := BlockListItem{}
+		bli.FromGob(gob.NewDecoder(buf))
+		require.Equal(t, jid, bli.JID)
+		require.Equal(t, jid == "jabber.org", bli.Domain)
+	}
+}
+
+func TestModelCapabilities(t *testing.T) {
+	var c1, c2 Capabilities
+
+	c1 = Capabilities{Node: "http://code.google.com/p/exodus", Ver: "QgayPKawpkPSDYmwT/WM94uAlu0=", Features: []string{"urn:xmpp:ping", "http://jabber.org/protocol/caps"}}
+	buf := new(bytes.Buffer)
+	c1.ToGob(gob.NewEncoder(buf))
+	c2.FromGob(gob.NewDecoder(buf))
+	require.Equal(t, c1, c2)
+
+	require.True(t, c2.HasFeature("urn:xmpp:ping"))
+	require.False(t, c2.HasFeature("urn:xmpp:carbons:2"))
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/ortuman/jackal/pool"
+	"github.com/ortuman/jackal/storage/model"
+)
+
+const (
+	redisIdleTimeout = time.Minute * 4
+	redisTestIdle    = time.Minute
+
+	// cached block lists are expired in case an invalidation was missed
+	redisBlockListTTL = time.Hour
+)
+
+// deletes a user resource only if still associated to the given stream.
+var redisDeleteResourceScript = redis.NewScript(2, `
+if redis.call("HGET", KEYS[2], ARGV[1]) == ARGV[2] then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	redis.call("HDEL", KEYS[2], ARGV[1])
+end
+return 0
+`)
+
+// redisStorage decorates a durable storage manager keeping fast-changing
+// ephemeral data (online resources and block lists cache) in Redis.
+type redisStorage struct {
+	Storage
+	pool    *redis.Pool
+	bufPool *pool.BufferPool
+}
+
+func newRedisStorage(cfg *RedisDb, s Storage) *redisStorage {
+	dialTimeout := time.Second * time.Duration(cfg.DialTimeout)
+	return newRedisStorageWithPool(&redis.Pool{
+		MaxIdle:     cfg.PoolSize,
+		MaxActive:   cfg.PoolSize,
+		IdleTimeout: redisIdleTimeout,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", cfg.Address,
+				redis.DialPassword(cfg.Password),
+				redis.DialDatabase(cfg.Database),
+				redis.DialConnectTimeout(dialTimeout),
+			)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < redisTestIdle {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}, s)
+}
+
+func newRedisStorageWithPool(p *redis.Pool, s Storage) *redisStorage {
+	return &redisStorage{
+		Storage: s,
+		pool:    p,
+		bufPool: pool.NewBufferPool(),
+	}
+}
+
+func (r *redisStorage) Shutdown() {
+	r.pool.Close()
+	r.Storage.Shutdown()
+}
+
+func (r *redisStorage) Healthy() bool {
+	if !r.Storage.Healthy() {
+		return false
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err == nil
+}
+
+func (r *redisStorage) DeleteUser(username string) error {
+	if err := r.Storage.DeleteUser(username); err != nil {
+		return err
+	}
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", r.blockListKey(username), r.resourcesKey(username), r.resourceStreamsKey(username))
+	return err
+}
+
+func (r *redisStorage) InsertOrUpdateBlockListItems(items []model.BlockListItem) error {
+	if err := r.Storage.InsertOrUpdateBlockListItems(items); err != nil {
+		return err
+	}
+	return r.invalidateBlockLists(items)
+}
+
+func (r *redisStorage) DeleteBlockListItems(items []model.BlockListItem) error {
+	if err := r.Storage.DeleteBlockListItems(items); err != nil {
+		return err
+	}
+	return r.invalidateBlockLists(items)
+}
+
+func (r *redisStorage) FetchBlockListItems(username string) ([]model.BlockListItem, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("GET", r.blockListKey(username)))
+	switch err {
+	case nil:
+		return r.decodeBlockListItems(b), nil
+	case redis.ErrNil:
+		break // not cached yet...
+	default:
+		return nil, err
+	}
+	items, err := r.Storage.FetchBlockListItems(username)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Do("SET", r.blockListKey(username), r.encodeBlockListItems(items), "EX", int(redisBlockListTTL/time.Second)); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// FetchBlockListItemsRange serves block list items ranges from the cached block list.
+func (r *redisStorage) FetchBlockListItemsRange(username string, offset, limit int) ([]model.BlockListItem, int, error) {
+	items, err := r.FetchBlockListItems(username)
+	if err != nil {
+		return nil, 0, err
+	}
+	return blockListItemsRange(items, offset, limit), len(items), nil
+}
+
+func (r *redisStorage) InsertOrUpdateResource(res *model.Resource) error {
+	buf := r.bufPool.Get()
+	defer r.bufPool.Put(buf)
+	res.ToGob(gob.NewEncoder(buf))
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HSET", r.resourcesKey(res.Username), res.Resource, buf.Bytes())
+	conn.Send("HSET", r.resourceStreamsKey(res.Username), res.Resource, res.StreamID)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (r *redisStorage) DeleteResource(username, resource, streamID string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := redisDeleteResourceScript.Do(conn, r.resourcesKey(username), r.resourceStreamsKey(username), resource, streamID)
+	return err
+}
+
+func (r *redisStorage) FetchResources(username string) ([]model.Resource, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	vals, err := redis.ByteSlices(conn.Do("HVALS", r.resourcesKey(username)))
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	ress := make([]model.Resource, len(vals))
+	for i, val := range vals {
+		ress[i].FromGob(gob.NewDecoder(bytes.NewReader(val)))
+	}
+	sort.Slice(ress, func(i, j int) bool { return ress[i].Resource < ress[j].Resource })
+	return ress, nil
+}
+
+func (r *redisStorage) invalidateBlockLists(items []model.BlockListItem) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// pipeline one invalidation per affected user
+	var count int
+	usernames := make(map[string]struct{})
+	for _, item := range items {
+		if _, ok := usernames[item.Username]; ok {
+			continue
+		}
+		usernames[item.Username] = struct{}{}
+		if err := conn.Send("DEL", r.blockListKey(item.Username)); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisStorage) encodeBlockListItems(items []model.BlockListItem) []byte {
+	buf := r.bufPool.Get()
+	defer r.bufPool.Put(buf)
+
+	enc := gob.NewEncoder(buf)
+	count := len(items)
+	enc.Encode(&count)
+	for i := range items {
+		items[i].ToGob(enc)
+	}
+	b := make([]byte, buf.Len())
+	copy(b, buf.Bytes())
+	return b
+}
+
+func (r *redisStorage) decodeBlockListItems(b []byte) []model.BlockListItem {
+	dec := gob.NewDecoder(bytes.NewReader(b))
+	var count int
+	dec.Decode(&count)
+	if count == 0 {
+		return nil
+	}
+	items := make([]model.BlockListItem, count)
+	for i := range items {
+		items[i].FromGob(dec)
+	}
+	return items
+}
+
+func (r *redisStorage) blockListKey(username string) string {
+	return "blockListItems:" + username
+}
+
+func (r *redisStorage) resourcesKey(username string) string {
+	return "resources:" + username
+}
+
+func (r *redisStorage) resourceStreamsKey(username string) string {
+	return "resourceStreams:" + username
+}
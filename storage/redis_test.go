@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage_Resources(t *testing.T) {
+	r, s := tUtilRedisStorage(t)
+	defer s.Close()
+	defer r.Shutdown()
+
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", true)
+	p := xml.NewPresence(j, j, xml.AvailableType)
+	require.Nil(t, r.InsertOrUpdateResource(&model.Resource{Username: "ortuman", Resource: "garden", StreamID: "s1"}))
+	require.Nil(t, r.InsertOrUpdateResource(&model.Resource{Username: "ortuman", Resource: "balcony", StreamID: "s2", Presence: p}))
+
+	ress, err := r.FetchResources("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ress))
+	require.Equal(t, "balcony", ress[0].Resource)
+	require.Equal(t, "s2", ress[0].StreamID)
+	require.Equal(t, p.String(), ress[0].Presence.String())
+	require.Equal(t, "garden", ress[1].Resource)
+	require.Nil(t, ress[1].Presence)
+
+	// resource taken over by a new stream
+	require.Nil(t, r.InsertOrUpdateResource(&model.Resource{Username: "ortuman", Resource: "garden", StreamID: "s3"}))
+	require.Nil(t, r.DeleteResource("ortuman", "garden", "s1"))
+
+	ress, _ = r.FetchResources("ortuman")
+	require.Equal(t, 2, len(ress))
+	require.Equal(t, "s3", ress[1].StreamID)
+
+	require.Nil(t, r.DeleteResource("ortuman", "garden", "s3"))
+	require.Nil(t, r.DeleteResource("ortuman", "balcony", "s2"))
+
+	ress, err = r.FetchResources("ortuman")
+	require.Nil(t, err)
+	require.Nil(t, ress)
+
+	// unreachable server
+	s.Close()
+	_, err = r.FetchResources("ortuman")
+	require.NotNil(t, err)
+	require.False(t, r.Healthy())
+}
+
+func TestRedisStorage_BlockListItems(t *testing.T) {
+	r, s := tUtilRedisStorage(t)
+	defer s.Close()
+	defer r.Shutdown()
+
+	items := []model.BlockListItem{
+		{Username: "ortuman", JID: "user@jackal.im"},
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+	}
+	require.Nil(t, r.InsertOrUpdateBlockListItems(items))
+
+	fetched, err := r.FetchBlockListItems("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, items, fetched)
+	require.True(t, s.Exists("blockListItems:ortuman"))
+
+	// served from cache
+	durable := r.Storage.(*mockStorage)
+	durable.blockListItems["ortuman"] = nil
+	fetched, _ = r.FetchBlockListItems("ortuman")
+	require.Equal(t, items, fetched)
+
+	// writes invalidate cached block list
+	require.Nil(t, r.DeleteBlockListItems(items[:1]))
+	require.False(t, s.Exists("blockListItems:ortuman"))
+
+	fetched, _ = r.FetchBlockListItems("ortuman")
+	require.Nil(t, fetched)
+
+	// empty block lists are cached as well
+	require.True(t, s.Exists("blockListItems:ortuman"))
+
+	require.Nil(t, r.DeleteUser("ortuman"))
+	require.False(t, s.Exists("blockListItems:ortuman"))
+}
+
+func tUtilRedisStorage(t *testing.T) (*redisStorage, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	require.Nil(t, err)
+
+	addr := s.Addr()
+	r := newRedisStorageWithPool(&redis.Pool{
+		MaxIdle: 2,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}, newMockStorage())
+	require.True(t, r.Healthy())
+	return r, s
+}
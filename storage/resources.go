@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// memoryResources keeps online user resources in process memory
+// on behalf of durable storage backends.
+type memoryResources struct {
+	mu        sync.RWMutex
+	resources map[string][]model.Resource
+}
+
+func newMemoryResources() *memoryResources {
+	return &memoryResources{resources: make(map[string][]model.Resource)}
+}
+
+func (m *memoryResources) InsertOrUpdateResource(res *model.Resource) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ress := m.resources[res.Username]
+	for i, r := range ress {
+		if r.Resource == res.Resource {
+			ress[i] = *res
+			return nil
+		}
+	}
+	m.resources[res.Username] = append(ress, *res)
+	return nil
+}
+
+func (m *memoryResources) DeleteResource(username, resource, streamID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ress := m.resources[username]
+	for i, r := range ress {
+		if r.Resource != resource || r.StreamID != streamID {
+			continue
+		}
+		if len(ress) == 1 {
+			delete(m.resources, username)
+		} else {
+			m.resources[username] = append(ress[:i], ress[i+1:]...)
+		}
+		break
+	}
+	return nil
+}
+
+func (m *memoryResources) FetchResources(username string) ([]model.Resource, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ress := m.resources[username]
+	if len(ress) == 0 {
+		return nil, nil
+	}
+	ret := make([]model.Resource, len(ress))
+	copy(ret, ress)
+	return ret, nil
+}
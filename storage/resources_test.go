@@ -0,0 +1,36 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryResources(t *testing.T) {
+	m := newMemoryResources()
+
+	require.Nil(t, m.InsertOrUpdateResource(&model.Resource{Username: "ortuman", Resource: "garden", StreamID: "s1"}))
+	require.Nil(t, m.InsertOrUpdateResource(&model.Resource{Username: "ortuman", Resource: "balcony", StreamID: "s2"}))
+	require.Nil(t, m.InsertOrUpdateResource(&model.Resource{Username: "ortuman", Resource: "garden", StreamID: "s3"}))
+
+	ress, err := m.FetchResources("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ress))
+	require.Equal(t, "s3", ress[0].StreamID)
+
+	// not owned by stream
+	require.Nil(t, m.DeleteResource("ortuman", "garden", "s1"))
+	ress, _ = m.FetchResources("ortuman")
+	require.Equal(t, 2, len(ress))
+
+	require.Nil(t, m.DeleteResource("ortuman", "garden", "s3"))
+	require.Nil(t, m.DeleteResource("ortuman", "balcony", "s2"))
+	ress, _ = m.FetchResources("ortuman")
+	require.Nil(t, ress)
+}
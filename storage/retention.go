@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+const delayNamespace = "urn:xmpp:delay"
+
+// retention periodically prunes expired offline messages
+// and archived messages exceeding configured limits.
+type retention struct {
+	cfg    *RetentionConfig
+	s      Storage
+	doneCh chan chan bool
+}
+
+func newRetention(cfg *RetentionConfig, s Storage) *retention {
+	r := &retention{
+		cfg:    cfg,
+		s:      s,
+		doneCh: make(chan chan bool),
+	}
+	go r.loop()
+	return r
+}
+
+func (r *retention) shutdown() {
+	ch := make(chan bool)
+	r.doneCh <- ch
+	<-ch
+}
+
+func (r *retention) loop() {
+	tc := time.NewTicker(time.Second * time.Duration(r.cfg.Interval))
+	defer tc.Stop()
+	for {
+		select {
+		case <-tc.C:
+			r.prune(time.Now())
+		case ch := <-r.doneCh:
+			close(ch)
+			return
+		}
+	}
+}
+
+func (r *retention) prune(now time.Time) {
+	if r.cfg.OfflineTTL > 0 {
+		before := now.Add(-time.Second * time.Duration(r.cfg.OfflineTTL))
+		cnt, err := r.s.DeleteExpiredOfflineMessages(before)
+		if err != nil {
+			log.Error(err)
+		} else {
+			log.Infof("retention: pruned %d offline messages", cnt)
+		}
+	}
+	if r.cfg.ArchiveMaxAge > 0 || r.cfg.ArchiveMaxCount > 0 {
+		var before time.Time
+		if r.cfg.ArchiveMaxAge > 0 {
+			before = now.Add(-time.Second * time.Duration(r.cfg.ArchiveMaxAge))
+		}
+		cnt, err := r.s.TrimArchive(before, r.cfg.ArchiveMaxCount)
+		if err != nil {
+			log.Error(err)
+		} else {
+			log.Infof("retention: pruned %d archived messages", cnt)
+		}
+	}
+}
+
+// offlineMessageStamp returns the time an offline message was stored at,
+// as stated by its Delayed Delivery information.
+func offlineMessageStamp(message xml.XElement) (time.Time, bool) {
+	delay := message.Elements().ChildNamespace("delay", delayNamespace)
+	if delay == nil {
+		return time.Time{}, false
+	}
+	stamp, err := time.Parse(time.RFC3339, delay.Attributes().Get("stamp"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return stamp, true
+}
+
+// trimArchiveMessages returns the archived messages kept after applying
+// retention limits to a user archive sorted in ascending chronological order.
+func trimArchiveMessages(messages []model.ArchiveMessage, before time.Time, maxCount int) []model.ArchiveMessage {
+	i := 0
+	if !before.IsZero() {
+		for i < len(messages) && messages[i].Stamp.Before(before) {
+			i++
+		}
+	}
+	if maxCount > 0 && len(messages)-i > maxCount {
+		i = len(messages) - maxCount
+	}
+	return messages[i:]
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention_Prune(t *testing.T) {
+	now := time.Now()
+	s := newMockStorage()
+	for i := 0; i < 4; i++ {
+		m := xml.NewElementName("message")
+		m.AppendElement(xml.NewDelay("jackal.im", now.Add(-time.Duration(i)*time.Hour), "Offline Storage"))
+		s.InsertOfflineMessage(m, "ortuman")
+
+		s.InsertArchiveMessage(&model.ArchiveMessage{
+			ID:       strconv.Itoa(i),
+			Username: "ortuman",
+			JID:      "noelia@jackal.im",
+			Message:  xml.NewElementName("message"),
+			Stamp:    now.Add(-time.Duration(3-i) * time.Hour),
+		})
+	}
+	r := &retention{cfg: &RetentionConfig{OfflineTTL: 5400, ArchiveMaxCount: 3}, s: s}
+	r.prune(now)
+
+	cnt, _ := s.CountOfflineMessages("ortuman")
+	require.Equal(t, 2, cnt)
+	msgs, _ := s.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Equal(t, 3, len(msgs))
+
+	r.cfg = &RetentionConfig{ArchiveMaxAge: 3600}
+	r.prune(now)
+	msgs, _ = s.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "2", msgs[0].ID)
+	require.Equal(t, "3", msgs[1].ID)
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// sharedRosterStorage decorates a storage manager merging the virtual
+// roster items implied by shared groups into users stored roster.
+// Shared group members are mutually subscribed, whatever their stored
+// roster items state.
+type sharedRosterStorage struct {
+	Storage
+	groups []SharedGroup
+
+	mu        sync.RWMutex
+	usernames []string // all users group members, nil if not fetched yet
+	usersGen  uint64   // incremented whenever users change
+}
+
+func newSharedRosterStorage(groups []SharedGroup, s Storage) *sharedRosterStorage {
+	return &sharedRosterStorage{Storage: s, groups: groups}
+}
+
+func (s *sharedRosterStorage) InsertUser(user *model.User) error {
+	defer s.invalidateUsernames()
+	return s.Storage.InsertUser(user)
+}
+
+func (s *sharedRosterStorage) InsertOrUpdateUser(user *model.User) error {
+	defer s.invalidateUsernames()
+	return s.Storage.InsertOrUpdateUser(user)
+}
+
+func (s *sharedRosterStorage) DeleteUser(username string) error {
+	defer s.invalidateUsernames()
+	return s.Storage.DeleteUser(username)
+}
+
+func (s *sharedRosterStorage) FetchRosterItems(username string) ([]model.RosterItem, model.RosterVersion, error) {
+	ris, ver, err := s.Storage.FetchRosterItems(username)
+	if err != nil {
+		return nil, ver, err
+	}
+	shared, err := s.sharedRosterItems(username)
+	if err != nil {
+		return nil, ver, err
+	}
+	return mergeSharedRosterItems(ris, shared), ver, nil
+}
+
+func (s *sharedRosterStorage) FetchRosterItem(username, jid string) (*model.RosterItem, error) {
+	ri, err := s.Storage.FetchRosterItem(username, jid)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := s.sharedRosterItems(username)
+	if err != nil {
+		return nil, err
+	}
+	for _, sri := range shared {
+		if sri.JID != jid {
+			continue
+		}
+		var ris []model.RosterItem
+		if ri != nil {
+			ris = append(ris, *ri)
+		}
+		return &mergeSharedRosterItems(ris, []model.RosterItem{sri})[0], nil
+	}
+	return ri, nil
+}
+
+// sharedRosterItems returns the virtual roster items
+// of every shared group a user is member of.
+func (s *sharedRosterStorage) sharedRosterItems(username string) ([]model.RosterItem, error) {
+	var ris []model.RosterItem
+	for _, g := range s.groups {
+		members := g.Members
+		if g.AllUsers {
+			usernames, err := s.fetchUsernames()
+			if err != nil {
+				return nil, err
+			}
+			members = usernames
+		}
+		if !containsString(members, username) {
+			continue
+		}
+		for _, member := range members {
+			if member == username {
+				continue
+			}
+			ris = mergeSharedRosterItems(ris, []model.RosterItem{{
+				Username:     username,
+				JID:          member + "@" + g.Domain,
+				Subscription: "both",
+				Groups:       []string{g.Name},
+			}})
+		}
+	}
+	return ris, nil
+}
+
+func (s *sharedRosterStorage) fetchUsernames() ([]string, error) {
+	s.mu.RLock()
+	usernames, gen := s.usernames, s.usersGen
+	s.mu.RUnlock()
+	if usernames != nil {
+		return usernames, nil
+	}
+	usernames, err := s.Storage.FetchUsernames()
+	if err != nil {
+		return nil, err
+	}
+	if usernames == nil {
+		usernames = []string{}
+	}
+	sort.Strings(usernames)
+	s.mu.Lock()
+	if gen == s.usersGen {
+		s.usernames = usernames
+	}
+	s.mu.Unlock()
+	return usernames, nil
+}
+
+func (s *sharedRosterStorage) invalidateUsernames() {
+	s.mu.Lock()
+	s.usernames = nil
+	s.usersGen++
+	s.mu.Unlock()
+}
+
+// mergeSharedRosterItems returns a copy of ris along with shared items, which are
+// added as new items or upgrade the subscription and groups of existing ones.
+func mergeSharedRosterItems(ris []model.RosterItem, shared []model.RosterItem) []model.RosterItem {
+	ret := make([]model.RosterItem, len(ris), len(ris)+len(shared))
+	copy(ret, ris)
+	for _, sri := range shared {
+		idx := -1
+		for i := range ret {
+			if ret[i].JID == sri.JID {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			sri.Groups = append([]string(nil), sri.Groups...)
+			ret = append(ret, sri)
+			continue
+		}
+		ri := &ret[idx]
+		ri.Subscription = "both"
+		ri.Ask = false
+		groups := append([]string(nil), ri.Groups...)
+		for _, group := range sri.Groups {
+			if !containsString(groups, group) {
+				groups = append(groups, group)
+			}
+		}
+		ri.Groups = groups
+	}
+	return ret
+}
+
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedRosterStorage(t *testing.T) {
+	s := newSharedRosterStorage([]SharedGroup{
+		{Name: "Everyone", Domain: "jackal.im", AllUsers: true},
+		{Name: "Staff", Domain: "jackal.im", Members: []string{"ortuman", "noelia"}},
+	}, newMockStorage())
+
+	s.InsertUser(&model.User{Username: "ortuman", Password: "1234"})
+	s.InsertUser(&model.User{Username: "noelia", Password: "1234"})
+
+	s.InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "noelia@jackal.im",
+		Name:         "Noelia",
+		Subscription: "none",
+		Ask:          true,
+		Groups:       []string{"Family"},
+	})
+	s.InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "ortuman",
+		JID:          "romeo@example.org",
+		Subscription: "to",
+	})
+
+	ris, _, err := s.FetchRosterItems("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ris))
+	require.Equal(t, "noelia@jackal.im", ris[0].JID)
+	require.Equal(t, "Noelia", ris[0].Name)
+	require.Equal(t, "both", ris[0].Subscription)
+	require.False(t, ris[0].Ask)
+	require.Equal(t, []string{"Family", "Everyone", "Staff"}, ris[0].Groups)
+	require.Equal(t, "to", ris[1].Subscription)
+
+	// stored items are left untouched
+	ri, _ := s.Storage.FetchRosterItem("ortuman", "noelia@jackal.im")
+	require.Equal(t, "none", ri.Subscription)
+	require.Equal(t, []string{"Family"}, ri.Groups)
+
+	// virtual items are not stored per user
+	ri, err = s.FetchRosterItem("noelia", "ortuman@jackal.im")
+	require.Nil(t, err)
+	require.NotNil(t, ri)
+	require.Equal(t, "both", ri.Subscription)
+	require.Equal(t, []string{"Everyone", "Staff"}, ri.Groups)
+
+	ri, _ = s.Storage.FetchRosterItem("noelia", "ortuman@jackal.im")
+	require.Nil(t, ri)
+
+	// users joining all users groups
+	ris, _, _ = s.FetchRosterItems("noelia")
+	require.Equal(t, 1, len(ris))
+
+	s.InsertUser(&model.User{Username: "juliet", Password: "1234"})
+
+	ris, _, _ = s.FetchRosterItems("noelia")
+	require.Equal(t, 2, len(ris))
+	require.Equal(t, "juliet@jackal.im", ris[0].JID)
+	require.Equal(t, []string{"Everyone"}, ris[0].Groups)
+
+	s.DeleteUser("juliet")
+	ris, _, _ = s.FetchRosterItems("noelia")
+	require.Equal(t, 1, len(ris))
+
+	// storage errors
+	s.Storage.(*mockStorage).activateMockedError()
+	_, _, err = s.FetchRosterItems("noelia")
+	require.Equal(t, ErrMockedError, err)
+	s.Storage.(*mockStorage).deactivateMockedError()
+}
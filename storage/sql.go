@@ -6,14 +6,15 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	sq "github.com/Masterminds/squirrel"
-	_ "github.com/go-sql-driver/mysql" // SQL driver
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/pool"
 	"github.com/ortuman/jackal/storage/model"
@@ -21,21 +22,46 @@ import (
 )
 
 var (
-	nowExpr = sq.Expr("NOW()")
+	nowExpr = sq.Expr("CURRENT_TIMESTAMP")
 )
 
 type sqlStorage struct {
-	db     *sql.DB
-	pool   *pool.BufferPool
-	doneCh chan chan bool
+	*memoryResources
+	db                  *sql.DB
+	dialect             *sqlDialect
+	pool                *pool.BufferPool
+	healthy             uint32
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	queryTimeout        time.Duration
+	doneCh              chan chan bool
 }
 
 func newSQLStorage(cfg *MySQLDb) *sqlStorage {
 	var err error
 	s := &sqlStorage{
-		pool:   pool.NewBufferPool(),
-		doneCh: make(chan chan bool),
+		memoryResources:     newMemoryResources(),
+		pool:                pool.NewBufferPool(),
+		dialect:             mysqlDialect,
+		healthCheckInterval: time.Second * time.Duration(cfg.HealthCheckInterval),
+		healthCheckTimeout:  time.Second * time.Duration(cfg.HealthCheckTimeout),
+		queryTimeout:        time.Second * time.Duration(cfg.QueryTimeout),
+		doneCh:              make(chan chan bool),
 	}
+	s.db, err = openMySQL(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.AutoMigrate {
+		s.migrate(cfg.MigrationsDir)
+	}
+	s.healthy = 1
+	go s.loop()
+
+	return s
+}
+
+func openMySQL(cfg *MySQLDb) (*sql.DB, error) {
 	host := cfg.Host
 	user := cfg.User
 	pass := cfg.Password
@@ -43,25 +69,46 @@ func newSQLStorage(cfg *MySQLDb) *sqlStorage {
 	poolSize := cfg.PoolSize
 
 	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true", user, pass, host, db)
-	s.db, err = sql.Open("mysql", dsn)
+	conn, err := sql.Open("mysql", dsn)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return nil, err
 	}
-	s.db.SetMaxOpenConns(poolSize) // set max opened connection count
+	conn.SetMaxOpenConns(poolSize) // set max opened connection count
+	conn.SetMaxIdleConns(cfg.MaxIdleConns)
+	conn.SetConnMaxIdleTime(time.Second * time.Duration(cfg.IdleTimeout))
 
-	if err := s.db.Ping(); err != nil {
-		log.Fatalf("%v", err)
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
 	}
-	go s.loop()
+	return conn, nil
+}
 
-	return s
+// migrate applies pending schema migrations found at dir,
+// aborting on failure.
+func (s *sqlStorage) migrate(dir string) {
+	migrations, err := LoadMigrations(dir)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	applied, err := (&migrator{db: s.db, dialect: s.dialect, migrations: migrations}).migrate(false)
+	for _, m := range applied {
+		log.Infof("storage: applied migration %v", m)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 }
 
 func newMockSQLStorage() (*sqlStorage, sqlmock.Sqlmock) {
 	var err error
 	var sqlMock sqlmock.Sqlmock
 	s := &sqlStorage{
-		pool: pool.NewBufferPool(),
+		memoryResources: newMemoryResources(),
+		pool:            pool.NewBufferPool(),
+		dialect:         mysqlDialect,
+		healthy:         1,
+		queryTimeout:    time.Second * defaultMySQLQueryTimeout,
 	}
 	s.db, sqlMock, err = sqlmock.New()
 	if err != nil {
@@ -76,409 +123,1107 @@ func (s *sqlStorage) Shutdown() {
 	<-ch
 }
 
-func (s *sqlStorage) InsertOrUpdateUser(u *model.User) error {
-	q := sq.Insert("users").
-		Columns("username", "password", "logged_out_status", "logged_out_at", "updated_at", "created_at").
-		Values(u.Username, u.Password, u.LoggedOutStatus, nowExpr, nowExpr, nowExpr).
-		Suffix("ON DUPLICATE KEY UPDATE password = ?, logged_out_status = ?, logged_out_at = ?, updated_at = NOW()", u.Password, u.LoggedOutStatus, u.LoggedOutAt)
+func (s *sqlStorage) Healthy() bool {
+	return atomic.LoadUint32(&s.healthy) == 1
+}
 
-	_, err := q.RunWith(s.db).Exec()
-	return err
+func (s *sqlStorage) InsertUser(u *model.User) error {
+	return s.withContext(func(ctx context.Context) error {
+		q := sq.Insert("users").
+			Columns("username", "password", "password_scheme", "scram_sha_256", "logged_out_status", "logged_out_at", "updated_at", "created_at").
+			Values(u.Username, u.Password, u.PasswordScheme, u.ScramSHA256, u.LoggedOutStatus, nowExpr, nowExpr, nowExpr)
+
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		if s.dialect.isDupEntry(err) {
+			return ErrUserExists
+		}
+		return err
+	})
 }
 
-func (s *sqlStorage) FetchUser(username string) (*model.User, error) {
-	q := sq.Select("username", "password", "logged_out_status", "logged_out_at").
-		From("users").
-		Where(sq.Eq{"username": username})
+func (s *sqlStorage) InsertOrUpdateUser(u *model.User) error {
+	return s.withContext(func(ctx context.Context) error {
+		q := sq.Insert("users").
+			Columns("username", "password", "password_scheme", "scram_sha_256", "logged_out_status", "logged_out_at", "updated_at", "created_at").
+			Values(u.Username, u.Password, u.PasswordScheme, u.ScramSHA256, u.LoggedOutStatus, nowExpr, nowExpr, nowExpr).
+			Suffix(s.upsert("password = ?, password_scheme = ?, scram_sha_256 = ?, logged_out_status = ?, logged_out_at = ?, updated_at = CURRENT_TIMESTAMP"), u.Password, u.PasswordScheme, u.ScramSHA256, u.LoggedOutStatus, u.LoggedOutAt)
 
-	var usr model.User
-	err := q.RunWith(s.db).QueryRow().Scan(&usr.Username, &usr.Password, &usr.LoggedOutStatus, &usr.LoggedOutAt)
-	switch err {
-	case nil:
-		return &usr, nil
-	case sql.ErrNoRows:
-		return nil, nil
-	default:
-		return nil, err
-	}
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
 }
 
-func (s *sqlStorage) DeleteUser(username string) error {
-	return s.inTransaction(func(tx *sql.Tx) error {
-		var err error
-		_, err = sq.Delete("offline_messages").Where(sq.Eq{"username": username}).RunWith(tx).Exec()
-		if err != nil {
+func (s *sqlStorage) FetchUser(username string) (usr *model.User, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("username", "password", "password_scheme", "scram_sha_256", "logged_out_status", "logged_out_at").
+			From("users").
+			Where(sq.Eq{"username": username})
+
+		var u model.User
+		err := q.RunWith(s.db).QueryRowContext(ctx).Scan(&u.Username, &u.Password, &u.PasswordScheme, &u.ScramSHA256, &u.LoggedOutStatus, &u.LoggedOutAt)
+		switch err {
+		case nil:
+			usr = &u
+			return nil
+		case sql.ErrNoRows:
+			return nil
+		default:
 			return err
 		}
-		_, err = sq.Delete("roster_items").Where(sq.Eq{"username": username}).RunWith(tx).Exec()
-		if err != nil {
-			return err
-		}
-		_, err = sq.Delete("roster_versions").Where(sq.Eq{"username": username}).RunWith(tx).Exec()
-		if err != nil {
-			return err
-		}
-		_, err = sq.Delete("private_storage").Where(sq.Eq{"username": username}).RunWith(tx).Exec()
-		if err != nil {
+	})
+	return
+}
+
+func (s *sqlStorage) DeleteUser(username string) error {
+	return s.withContext(func(ctx context.Context) error {
+		return s.inTransaction(ctx, func(tx *sql.Tx) error {
+			var err error
+			_, err = sq.Delete("offline_messages").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("roster_items").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("roster_versions").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("roster_notifications").Where(sq.Eq{"contact": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("private_storage").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("vcards").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("archive_messages").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("blocklist_items").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("push_registrations").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("privacy_list_items").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("privacy_lists").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			// PEP nodes hosted at any of user's bare JIDs
+			hostPattern := escapeLikePattern(username) + "@%"
+			_, err = sq.Delete("pubsub_items").Where("host "+s.dialect.like, hostPattern).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("pubsub_nodes").Where("host "+s.dialect.like, hostPattern).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("users").Where(sq.Eq{"username": username}).RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			return nil
+		})
+	})
+}
+
+func (s *sqlStorage) UserExists(username string) (exists bool, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("COUNT(*)").From("users").Where(sq.Eq{"username": username})
+
+		var count int
+		if err := q.RunWith(s.db).QueryRowContext(ctx).Scan(&count); err != nil {
 			return err
 		}
-		_, err = sq.Delete("vcards").Where(sq.Eq{"username": username}).RunWith(tx).Exec()
+		exists = count > 0
+		return nil
+	})
+	return
+}
+
+func (s *sqlStorage) FetchUsernames() (usernames []string, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		rows, err := sq.Select("username").From("users").RunWith(s.db).QueryContext(ctx)
 		if err != nil {
 			return err
 		}
-		_, err = sq.Delete("users").Where(sq.Eq{"username": username}).RunWith(tx).Exec()
-		if err != nil {
-			return err
+		defer rows.Close()
+
+		for rows.Next() {
+			var username string
+			if err := rows.Scan(&username); err != nil {
+				return err
+			}
+			usernames = append(usernames, username)
 		}
-		return nil
+		return rows.Err()
 	})
+	return
 }
 
-func (s *sqlStorage) UserExists(username string) (bool, error) {
-	q := sq.Select("COUNT(*)").From("users").Where(sq.Eq{"username": username})
+func (s *sqlStorage) InsertOrUpdateRosterItem(ri *model.RosterItem) (ver model.RosterVersion, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+			q := sq.Insert("roster_versions").
+				Columns("username", "created_at", "updated_at").
+				Values(ri.Username, nowExpr, nowExpr).
+				Suffix(s.upsert("ver = ver + 1, updated_at = CURRENT_TIMESTAMP"))
 
-	var count int
-	err := q.RunWith(s.db).QueryRow().Scan(&count)
-	switch err {
-	case nil:
-		return count > 0, nil
-	default:
-		return false, err
-	}
-}
+			if _, err := q.RunWith(tx).ExecContext(ctx); err != nil {
+				return err
+			}
+			groups := strings.Join(ri.Groups, ";")
 
-func (s *sqlStorage) InsertOrUpdateRosterItem(ri *model.RosterItem) (model.RosterVersion, error) {
-	err := s.inTransaction(func(tx *sql.Tx) error {
-		q := sq.Insert("roster_versions").
-			Columns("username", "created_at", "updated_at").
-			Values(ri.Username, nowExpr, nowExpr).
-			Suffix("ON DUPLICATE KEY UPDATE ver = ver + 1, updated_at = NOW()")
+			verExpr := sq.Expr("(SELECT ver FROM roster_versions WHERE username = ?)", ri.Username)
+			q = sq.Insert("roster_items").
+				Columns("username", "jid", "name", "subscription", "groups", "ask", "ver", "created_at", "updated_at").
+				Values(ri.Username, ri.JID, ri.Name, ri.Subscription, groups, ri.Ask, verExpr, nowExpr, nowExpr).
+				Suffix(s.upsert("name = ?, subscription = ?, groups = ?, ask = ?, ver = (SELECT ver FROM roster_versions WHERE username = ?), updated_at = CURRENT_TIMESTAMP"), ri.Name, ri.Subscription, groups, ri.Ask, ri.Username)
 
-		if _, err := q.RunWith(tx).Exec(); err != nil {
+			_, err := q.RunWith(tx).ExecContext(ctx)
+			return err
+		})
+		if err != nil {
 			return err
 		}
-		groups := strings.Join(ri.Groups, ";")
-
-		verExpr := sq.Expr("(SELECT ver FROM roster_versions WHERE username = ?)", ri.Username)
-		q = sq.Insert("roster_items").
-			Columns("username", "jid", "name", "subscription", "groups", "ask", "ver", "created_at", "updated_at").
-			Values(ri.Username, ri.JID, ri.Name, ri.Subscription, groups, ri.Ask, verExpr, nowExpr, nowExpr).
-			Suffix("ON DUPLICATE KEY UPDATE name = ?, subscription = ?, groups = ?, ask = ?, ver = ver + 1, updated_at = NOW()", ri.Name, ri.Subscription, groups, ri.Ask)
-
-		_, err := q.RunWith(tx).Exec()
+		ver, err = s.fetchRosterVer(ctx, ri.Username)
 		return err
 	})
-	if err != nil {
-		return model.RosterVersion{}, err
-	}
-	return s.fetchRosterVer(ri.Username)
+	return
 }
 
-func (s *sqlStorage) DeleteRosterItem(username, jid string) (model.RosterVersion, error) {
-	err := s.inTransaction(func(tx *sql.Tx) error {
-		q := sq.Insert("roster_versions").
-			Columns("username", "created_at", "updated_at").
-			Values(username, nowExpr, nowExpr).
-			Suffix("ON DUPLICATE KEY UPDATE ver = ver + 1, last_deletion_ver = ver, updated_at = NOW()")
+func (s *sqlStorage) DeleteRosterItem(username, jid string) (ver model.RosterVersion, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+			q := sq.Insert("roster_versions").
+				Columns("username", "created_at", "updated_at").
+				Values(username, nowExpr, nowExpr).
+				Suffix(s.upsert("last_deletion_ver = ver + 1, ver = ver + 1, updated_at = CURRENT_TIMESTAMP"))
 
-		if _, err := q.RunWith(tx).Exec(); err != nil {
+			if _, err := q.RunWith(tx).ExecContext(ctx); err != nil {
+				return err
+			}
+			_, err := sq.Delete("roster_items").
+				Where(sq.And{sq.Eq{"username": username}, sq.Eq{"jid": jid}}).
+				RunWith(tx).ExecContext(ctx)
+			return err
+		})
+		if err != nil {
 			return err
 		}
-		_, err := sq.Delete("roster_items").
-			Where(sq.And{sq.Eq{"username": username}, sq.Eq{"jid": jid}}).
-			RunWith(tx).Exec()
+		ver, err = s.fetchRosterVer(ctx, username)
 		return err
 	})
-	if err != nil {
-		return model.RosterVersion{}, err
-	}
-	return s.fetchRosterVer(username)
+	return
 }
 
-func (s *sqlStorage) FetchRosterItems(username string) ([]model.RosterItem, model.RosterVersion, error) {
-	q := sq.Select("username", "jid", "name", "subscription", "groups", "ask", "ver").
-		From("roster_items").
-		Where(sq.Eq{"username": username}).
-		OrderBy("created_at DESC")
+func (s *sqlStorage) FetchRosterItems(username string) (items []model.RosterItem, ver model.RosterVersion, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("username", "jid", "name", "subscription", "groups", "ask", "ver").
+			From("roster_items").
+			Where(sq.Eq{"username": username}).
+			OrderBy("created_at DESC")
 
-	rows, err := q.RunWith(s.db).Query()
-	if err != nil {
-		return nil, model.RosterVersion{}, err
-	}
-	defer rows.Close()
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	items, err := scanRosterItemEntities(rows)
-	if err != nil {
-		return nil, model.RosterVersion{}, err
-	}
-	ver, err := s.fetchRosterVer(username)
+		items, err = scanRosterItemEntities(rows)
+		if err != nil {
+			return err
+		}
+		ver, err = s.fetchRosterVer(ctx, username)
+		return err
+	})
 	if err != nil {
 		return nil, model.RosterVersion{}, err
 	}
-	return items, ver, nil
+	return
 }
 
-func (s *sqlStorage) FetchRosterItem(username, jid string) (*model.RosterItem, error) {
-	q := sq.Select("username", "jid", "name", "subscription", "groups", "ask", "ver").
-		From("roster_items").
-		Where(sq.And{sq.Eq{"username": username}, sq.Eq{"jid": jid}})
+func (s *sqlStorage) FetchRosterItem(username, jid string) (item *model.RosterItem, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("username", "jid", "name", "subscription", "groups", "ask", "ver").
+			From("roster_items").
+			Where(sq.And{sq.Eq{"username": username}, sq.Eq{"jid": jid}})
+
+		var ri model.RosterItem
+		err := scanRosterItemEntity(&ri, q.RunWith(s.db).QueryRowContext(ctx))
+		switch err {
+		case nil:
+			item = &ri
+			return nil
+		case sql.ErrNoRows:
+			return nil
+		default:
+			return err
+		}
+	})
+	return
+}
 
-	var ri model.RosterItem
-	err := scanRosterItemEntity(&ri, q.RunWith(s.db).QueryRow())
-	switch err {
-	case nil:
-		return &ri, nil
-	case sql.ErrNoRows:
-		return nil, nil
-	default:
-		return nil, err
-	}
+func (s *sqlStorage) FetchRosterVersion(username string) (ver model.RosterVersion, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		ver, err = s.fetchRosterVer(ctx, username)
+		return err
+	})
+	return
 }
 
 func (s *sqlStorage) InsertOrUpdateRosterNotification(rn *model.RosterNotification) error {
-	buf := s.pool.Get()
-	defer s.pool.Put(buf)
-	for _, elem := range rn.Elements {
-		buf.WriteString(elem.String())
-	}
-	elementsXML := buf.String()
+	return s.withContext(func(ctx context.Context) error {
+		buf := s.pool.Get()
+		defer s.pool.Put(buf)
+		for _, elem := range rn.Elements {
+			buf.WriteString(elem.String())
+		}
+		elementsXML := buf.String()
 
-	q := sq.Insert("roster_notifications").
-		Columns("contact", "jid", "elements", "updated_at", "created_at").
-		Values(rn.Contact, rn.JID, elementsXML, nowExpr, nowExpr).
-		Suffix("ON DUPLICATE KEY UPDATE elements = ?, updated_at = NOW()", elementsXML)
-	_, err := q.RunWith(s.db).Exec()
-	return err
+		q := sq.Insert("roster_notifications").
+			Columns("contact", "jid", "elements", "updated_at", "created_at").
+			Values(rn.Contact, rn.JID, elementsXML, nowExpr, nowExpr).
+			Suffix(s.upsert("elements = ?, updated_at = CURRENT_TIMESTAMP"), elementsXML)
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
 }
 
 func (s *sqlStorage) DeleteRosterNotification(contact, jid string) error {
-	q := sq.Delete("roster_notifications").Where(sq.And{sq.Eq{"contact": contact}, sq.Eq{"jid": jid}})
-	_, err := q.RunWith(s.db).Exec()
-	return err
+	return s.withContext(func(ctx context.Context) error {
+		q := sq.Delete("roster_notifications").Where(sq.And{sq.Eq{"contact": contact}, sq.Eq{"jid": jid}})
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
 }
 
-func (s *sqlStorage) FetchRosterNotifications(contact string) ([]model.RosterNotification, error) {
-	q := sq.Select("contact", "jid", "elements").
-		From("roster_notifications").
-		Where(sq.Eq{"contact": contact}).
-		OrderBy("created_at")
+func (s *sqlStorage) FetchRosterNotifications(contact string) (ret []model.RosterNotification, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("contact", "jid", "elements").
+			From("roster_notifications").
+			Where(sq.Eq{"contact": contact}).
+			OrderBy("created_at")
+
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		buf := s.pool.Get()
+		defer s.pool.Put(buf)
+
+		for rows.Next() {
+			var rn model.RosterNotification
+			var notificationXML string
+			rows.Scan(&rn.Contact, &rn.JID, &notificationXML)
+			buf.Reset()
+			buf.WriteString("<root>")
+			buf.WriteString(notificationXML)
+			buf.WriteString("</root>")
+
+			parser := xml.NewParser(buf)
+			root, err := parser.ParseElement()
+			if err != nil {
+				return err
+			}
+			rn.Elements = root.Elements().All()
 
-	rows, err := q.RunWith(s.db).Query()
+			ret = append(ret, rn)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return
+}
 
-	buf := s.pool.Get()
-	defer s.pool.Put(buf)
+func (s *sqlStorage) InsertOrUpdateVCard(vCard xml.XElement, username string) error {
+	return s.withContext(func(ctx context.Context) error {
+		rawXML := vCard.String()
+		q := sq.Insert("vcards").
+			Columns("username", "vcard", "updated_at", "created_at").
+			Values(username, rawXML, nowExpr, nowExpr).
+			Suffix(s.upsert("vcard = ?, updated_at = CURRENT_TIMESTAMP"), rawXML)
+
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
+}
 
-	var ret []model.RosterNotification
-	for rows.Next() {
-		var rn model.RosterNotification
-		var notificationXML string
-		rows.Scan(&rn.Contact, &rn.JID, &notificationXML)
-		buf.Reset()
-		buf.WriteString("<root>")
-		buf.WriteString(notificationXML)
-		buf.WriteString("</root>")
+func (s *sqlStorage) FetchVCard(username string) (elem xml.XElement, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("vcard").From("vcards").Where(sq.Eq{"username": username})
 
-		parser := xml.NewParser(buf)
-		root, err := parser.ParseElement()
-		if err != nil {
-			return nil, err
+		var vCard string
+		err := q.RunWith(s.db).QueryRowContext(ctx).Scan(&vCard)
+		switch err {
+		case nil:
+			parser := xml.NewParser(strings.NewReader(vCard))
+			elem, err = parser.ParseElement()
+			return err
+		case sql.ErrNoRows:
+			return nil
+		default:
+			return err
 		}
-		rn.Elements = root.Elements().All()
-
-		ret = append(ret, rn)
-	}
-	return ret, nil
+	})
+	return
 }
 
-func (s *sqlStorage) InsertOrUpdateVCard(vCard xml.XElement, username string) error {
-	rawXML := vCard.String()
-	q := sq.Insert("vcards").
-		Columns("username", "vcard", "updated_at", "created_at").
-		Values(username, rawXML, nowExpr, nowExpr).
-		Suffix("ON DUPLICATE KEY UPDATE vcard = ?, updated_at = NOW()", rawXML)
+func (s *sqlStorage) InsertOrUpdatePrivateXML(privateXML []xml.XElement, namespace string, username string) error {
+	return s.withContext(func(ctx context.Context) error {
+		buf := s.pool.Get()
+		defer s.pool.Put(buf)
+		for _, elem := range privateXML {
+			elem.ToXML(buf, true)
+		}
+		rawXML := buf.String()
+
+		q := sq.Insert("private_storage").
+			Columns("username", "namespace", "data", "updated_at", "created_at").
+			Values(username, namespace, rawXML, nowExpr, nowExpr).
+			Suffix(s.upsert("data = ?, updated_at = CURRENT_TIMESTAMP"), rawXML)
 
-	_, err := q.RunWith(s.db).Exec()
-	return err
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
 }
 
-func (s *sqlStorage) FetchVCard(username string) (xml.XElement, error) {
-	q := sq.Select("vcard").From("vcards").Where(sq.Eq{"username": username})
+func (s *sqlStorage) FetchPrivateXML(namespace string, username string) (elems []xml.XElement, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("data").
+			From("private_storage").
+			Where(sq.And{sq.Eq{"username": username}, sq.Eq{"namespace": namespace}})
+
+		var privateXML string
+		err := q.RunWith(s.db).QueryRowContext(ctx).Scan(&privateXML)
+		switch err {
+		case nil:
+			buf := s.pool.Get()
+			defer s.pool.Put(buf)
+			buf.WriteString("<root>")
+			buf.WriteString(privateXML)
+			buf.WriteString("</root>")
+
+			parser := xml.NewParser(buf)
+			rootEl, err := parser.ParseElement()
+			if err != nil {
+				return err
+			}
+			elems = rootEl.Elements().All()
+			return nil
 
-	var vCard string
-	err := q.RunWith(s.db).QueryRow().Scan(&vCard)
-	switch err {
-	case nil:
-		parser := xml.NewParser(strings.NewReader(vCard))
-		return parser.ParseElement()
-	case sql.ErrNoRows:
-		return nil, nil
-	default:
+		case sql.ErrNoRows:
+			return nil
+		default:
+			return err
+		}
+	})
+	if err != nil {
 		return nil, err
 	}
+	return
 }
 
-func (s *sqlStorage) InsertOrUpdatePrivateXML(privateXML []xml.XElement, namespace string, username string) error {
-	buf := s.pool.Get()
-	defer s.pool.Put(buf)
-	for _, elem := range privateXML {
-		elem.ToXML(buf, true)
-	}
-	rawXML := buf.String()
+func (s *sqlStorage) InsertOfflineMessage(message xml.XElement, username string) error {
+	return s.withContext(func(ctx context.Context) error {
+		q := sq.Insert("offline_messages").
+			Columns("username", "data", "created_at").
+			Values(username, message.String(), nowExpr)
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
+}
 
-	q := sq.Insert("private_storage").
-		Columns("username", "namespace", "data", "updated_at", "created_at").
-		Values(username, namespace, rawXML, nowExpr, nowExpr).
-		Suffix("ON DUPLICATE KEY UPDATE data = ?, updated_at = NOW()", rawXML)
+func (s *sqlStorage) CountOfflineMessages(username string) (count int, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("COUNT(*)").
+			From("offline_messages").
+			Where(sq.Eq{"username": username}).
+			OrderBy("created_at")
 
-	_, err := q.RunWith(s.db).Exec()
-	return err
+		return q.RunWith(s.db).ScanContext(ctx, &count)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return
 }
 
-func (s *sqlStorage) FetchPrivateXML(namespace string, username string) ([]xml.XElement, error) {
-	q := sq.Select("data").
-		From("private_storage").
-		Where(sq.And{sq.Eq{"username": username}, sq.Eq{"namespace": namespace}})
+func (s *sqlStorage) FetchOfflineMessages(username string) (elems []xml.XElement, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("data").
+			From("offline_messages").
+			Where(sq.Eq{"username": username}).
+			OrderBy("created_at")
+
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	var privateXML string
-	err := q.RunWith(s.db).QueryRow().Scan(&privateXML)
-	switch err {
-	case nil:
 		buf := s.pool.Get()
 		defer s.pool.Put(buf)
+
 		buf.WriteString("<root>")
-		buf.WriteString(privateXML)
+		for rows.Next() {
+			var msg string
+			rows.Scan(&msg)
+			buf.WriteString(msg)
+		}
 		buf.WriteString("</root>")
 
 		parser := xml.NewParser(buf)
 		rootEl, err := parser.ParseElement()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return rootEl.Elements().All(), nil
+		elems = rootEl.Elements().All()
+		return nil
+	})
+	return
+}
 
-	case sql.ErrNoRows:
-		return nil, nil
-	default:
-		return nil, err
-	}
+func (s *sqlStorage) DeleteOfflineMessages(username string) error {
+	return s.withContext(func(ctx context.Context) error {
+		q := sq.Delete("offline_messages").Where(sq.Eq{"username": username})
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
 }
 
-func (s *sqlStorage) InsertOfflineMessage(message xml.XElement, username string) error {
-	q := sq.Insert("offline_messages").
-		Columns("username", "data", "created_at").
-		Values(username, message.String(), nowExpr)
-	_, err := q.RunWith(s.db).Exec()
-	return err
+func (s *sqlStorage) InsertOrUpdateBlockListItems(items []model.BlockListItem) error {
+	return s.withContext(func(ctx context.Context) error {
+		return s.inTransaction(ctx, func(tx *sql.Tx) error {
+			for _, item := range items {
+				_, err := sq.Insert("blocklist_items").
+					Columns("username", "jid", "domain", "reason", "created_at").
+					Values(item.Username, item.JID, item.Domain, item.Reason, nowExpr).
+					Suffix(s.upsert("reason = ?"), item.Reason).
+					RunWith(tx).ExecContext(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
 }
 
-func (s *sqlStorage) CountOfflineMessages(username string) (int, error) {
-	q := sq.Select("COUNT(*)").
-		From("offline_messages").
-		Where(sq.Eq{"username": username}).
-		OrderBy("created_at")
+func (s *sqlStorage) DeleteBlockListItems(items []model.BlockListItem) error {
+	return s.withContext(func(ctx context.Context) error {
+		return s.inTransaction(ctx, func(tx *sql.Tx) error {
+			for _, item := range items {
+				_, err := sq.Delete("blocklist_items").
+					Where(sq.And{sq.Eq{"username": item.Username}, sq.Eq{"jid": item.JID}}).
+					RunWith(tx).ExecContext(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
 
-	var count int
-	err := q.RunWith(s.db).Scan(&count)
-	switch err {
-	case nil:
-		return count, nil
-	default:
-		return 0, err
+func (s *sqlStorage) DeleteExpiredOfflineMessages(before time.Time) (count int, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Delete("offline_messages").
+			Where(sq.Lt{"created_at": before})
+
+		res, err := q.RunWith(s.db).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		count = int(n)
+		return err
+	})
+	return
+}
+
+func (s *sqlStorage) FetchBlockListItems(username string) (items []model.BlockListItem, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("username", "jid", "domain", "reason").
+			From("blocklist_items").
+			Where(sq.Eq{"username": username}).
+			OrderBy("created_at")
+
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items, err = scanBlockListItemEntities(rows)
+		return err
+	})
+	return
+}
+
+func (s *sqlStorage) FetchBlockListItemsRange(username string, offset, limit int) (items []model.BlockListItem, count int, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		cq := sq.Select("COUNT(*)").
+			From("blocklist_items").
+			Where(sq.Eq{"username": username})
+
+		if err := cq.RunWith(s.db).ScanContext(ctx, &count); err != nil {
+			return err
+		}
+		if offset >= count || limit == 0 {
+			return nil
+		}
+		q := sq.Select("username", "jid", "domain", "reason").
+			From("blocklist_items").
+			Where(sq.Eq{"username": username}).
+			OrderBy("created_at").
+			Offset(uint64(offset))
+		if limit > 0 {
+			q = q.Limit(uint64(limit))
+		} else {
+			q = q.Limit(uint64(count - offset)) // MySQL requires a limit along with an offset
+		}
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		items, err = scanBlockListItemEntities(rows)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
 	}
+	return
+}
+
+func (s *sqlStorage) InsertArchiveMessage(message *model.ArchiveMessage) error {
+	return s.withContext(func(ctx context.Context) error {
+		q := sq.Insert("archive_messages").
+			Options(s.dialect.insertIgnore).
+			Columns("id", "username", "jid", "data", "direction", "created_at").
+			Values(message.ID, message.Username, message.JID, message.Message.String(), message.Direction, message.Stamp)
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
 }
 
-func (s *sqlStorage) FetchOfflineMessages(username string) ([]xml.XElement, error) {
-	q := sq.Select("data").
-		From("offline_messages").
-		Where(sq.Eq{"username": username}).
-		OrderBy("created_at")
+func (s *sqlStorage) FetchArchiveMessages(username string, filters ArchiveFilters) (ret []model.ArchiveMessage, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		for _, id := range []string{filters.After, filters.Before} {
+			if len(id) == 0 {
+				continue
+			}
+			exists, err := s.archiveMessageExists(ctx, username, id)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return ErrArchiveMessageNotFound
+			}
+		}
+		q := sq.Select("id", "username", "jid", "data", "direction", "created_at").
+			From("archive_messages").
+			Where(sq.Eq{"username": username})
+
+		if len(filters.With) > 0 {
+			if strings.Contains(filters.With, "/") {
+				q = q.Where(sq.Eq{"jid": filters.With})
+			} else {
+				// bare JID... match every resource
+				q = q.Where("(jid = ? OR jid "+s.dialect.like+")", filters.With, escapeLikePattern(filters.With)+"/%")
+			}
+		}
+		if !filters.Start.IsZero() {
+			q = q.Where(sq.GtOrEq{"created_at": filters.Start})
+		}
+		if !filters.End.IsZero() {
+			q = q.Where(sq.LtOrEq{"created_at": filters.End})
+		}
+		if len(filters.After) > 0 {
+			q = q.Where("serial > (SELECT serial FROM archive_messages WHERE username = ? AND id = ?)", username, filters.After)
+		}
+		if len(filters.Before) > 0 {
+			q = q.Where("serial < (SELECT serial FROM archive_messages WHERE username = ? AND id = ?)", username, filters.Before)
+		}
+		isBackwards := filters.IsBackwards()
+		if isBackwards {
+			q = q.OrderBy("serial DESC")
+		} else {
+			q = q.OrderBy("serial")
+		}
+		if filters.Max > 0 {
+			q = q.Limit(uint64(filters.Max))
+		}
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	rows, err := q.RunWith(s.db).Query()
+		ret, err = scanArchiveMessageEntities(rows)
+		if err != nil {
+			return err
+		}
+		if isBackwards {
+			for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+				ret[i], ret[j] = ret[j], ret[i]
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return
+}
 
-	buf := s.pool.Get()
-	defer s.pool.Put(buf)
+func (s *sqlStorage) TrimArchive(before time.Time, maxCount int) (count int, err error) {
+	if !before.IsZero() {
+		err = s.withContext(func(ctx context.Context) error {
+			q := sq.Delete("archive_messages").
+				Where(sq.Lt{"created_at": before})
 
-	buf.WriteString("<root>")
-	for rows.Next() {
-		var msg string
-		rows.Scan(&msg)
-		buf.WriteString(msg)
+			res, err := q.RunWith(s.db).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			count += int(n)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
 	}
-	buf.WriteString("</root>")
+	if maxCount == 0 {
+		return count, nil
+	}
+	var usernames []string
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("username").
+			From("archive_messages").
+			GroupBy("username").
+			Having("COUNT(*) > ?", maxCount)
+
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
 
-	parser := xml.NewParser(buf)
-	rootEl, err := parser.ParseElement()
+		for rows.Next() {
+			var username string
+			if err := rows.Scan(&username); err != nil {
+				return err
+			}
+			usernames = append(usernames, username)
+		}
+		return rows.Err()
+	})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return rootEl.Elements().All(), nil
+	for _, username := range usernames {
+		err = s.withContext(func(ctx context.Context) error {
+			// serial of the oldest message to be kept
+			var serial int64
+			q := sq.Select("serial").
+				From("archive_messages").
+				Where(sq.Eq{"username": username}).
+				OrderBy("serial DESC").
+				Limit(1).
+				Offset(uint64(maxCount - 1))
+
+			if err := q.RunWith(s.db).ScanContext(ctx, &serial); err != nil {
+				return err
+			}
+			dq := sq.Delete("archive_messages").
+				Where(sq.And{sq.Eq{"username": username}, sq.Lt{"serial": serial}})
+
+			res, err := dq.RunWith(s.db).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			count += int(n)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
 }
 
-func (s *sqlStorage) DeleteOfflineMessages(username string) error {
-	q := sq.Delete("offline_messages").Where(sq.Eq{"username": username})
-	_, err := q.RunWith(s.db).Exec()
-	return err
+func (s *sqlStorage) archiveMessageExists(ctx context.Context, username, id string) (bool, error) {
+	q := sq.Select("COUNT(*)").
+		From("archive_messages").
+		Where(sq.And{sq.Eq{"username": username}, sq.Eq{"id": id}})
+
+	var count int
+	if err := q.RunWith(s.db).QueryRowContext(ctx).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
 }
 
-func (s *sqlStorage) InsertOrUpdateBlockListItems(items []model.BlockListItem) error {
-	return s.inTransaction(func(tx *sql.Tx) error {
-		for _, item := range items {
-			_, err := sq.Insert("blocklist_items").
-				Options("IGNORE").
-				Columns("username", "jid", "created_at").
-				Values(item.Username, item.JID, nowExpr).
-				RunWith(tx).Exec()
+func (s *sqlStorage) InsertCapabilities(caps *model.Capabilities) error {
+	return s.withContext(func(ctx context.Context) error {
+		features := strings.Join(caps.Features, ";")
+		q := sq.Insert("capabilities").
+			Columns("node", "ver", "features", "created_at").
+			Values(caps.Node, caps.Ver, features, nowExpr).
+			Suffix(s.upsert("features = ?"), features)
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
+}
+
+func (s *sqlStorage) FetchCapabilities(node, ver string) (caps *model.Capabilities, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("features").
+			From("capabilities").
+			Where(sq.And{sq.Eq{"node": node}, sq.Eq{"ver": ver}})
+
+		var features string
+		err := q.RunWith(s.db).QueryRowContext(ctx).Scan(&features)
+		switch err {
+		case nil:
+			caps = &model.Capabilities{Node: node, Ver: ver}
+			if len(features) > 0 {
+				caps.Features = strings.Split(features, ";")
+			}
+			return nil
+		case sql.ErrNoRows:
+			return nil
+		default:
+			return err
+		}
+	})
+	return
+}
+
+func (s *sqlStorage) InsertOrUpdatePubSubNode(node *model.PubSubNode) error {
+	return s.withContext(func(ctx context.Context) error {
+		q := sq.Insert("pubsub_nodes").
+			Columns("host", "name", "access_model", "updated_at", "created_at").
+			Values(node.Host, node.Name, node.AccessModel, nowExpr, nowExpr).
+			Suffix(s.upsert("access_model = ?, updated_at = CURRENT_TIMESTAMP"), node.AccessModel)
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
+}
+
+func (s *sqlStorage) FetchPubSubNode(host, name string) (node *model.PubSubNode, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("host", "name", "access_model").
+			From("pubsub_nodes").
+			Where(sq.And{sq.Eq{"host": host}, sq.Eq{"name": name}})
+
+		var n model.PubSubNode
+		err := q.RunWith(s.db).QueryRowContext(ctx).Scan(&n.Host, &n.Name, &n.AccessModel)
+		switch err {
+		case nil:
+			node = &n
+			return nil
+		case sql.ErrNoRows:
+			return nil
+		default:
+			return err
+		}
+	})
+	return
+}
+
+func (s *sqlStorage) FetchPubSubNodes(host string) (nodes []model.PubSubNode, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("host", "name", "access_model").
+			From("pubsub_nodes").
+			Where(sq.Eq{"host": host}).
+			OrderBy("created_at")
+
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		nodes, err = scanPubSubNodeEntities(rows)
+		return err
+	})
+	return
+}
+
+func (s *sqlStorage) DeletePubSubNode(host, name string) error {
+	return s.withContext(func(ctx context.Context) error {
+		return s.inTransaction(ctx, func(tx *sql.Tx) error {
+			_, err := sq.Delete("pubsub_items").
+				Where(sq.And{sq.Eq{"host": host}, sq.Eq{"node": name}}).
+				RunWith(tx).ExecContext(ctx)
 			if err != nil {
 				return err
 			}
+			_, err = sq.Delete("pubsub_nodes").
+				Where(sq.And{sq.Eq{"host": host}, sq.Eq{"name": name}}).
+				RunWith(tx).ExecContext(ctx)
+			return err
+		})
+	})
+}
+
+func (s *sqlStorage) InsertOrUpdatePubSubItem(host, name string, item *model.PubSubItem) error {
+	return s.withContext(func(ctx context.Context) error {
+		payload := item.Payload.String()
+		q := sq.Insert("pubsub_items").
+			Columns("host", "node", "item_id", "publisher", "payload", "updated_at", "created_at").
+			Values(host, name, item.ID, item.Publisher, payload, nowExpr, nowExpr).
+			Suffix(s.upsert("publisher = ?, payload = ?, updated_at = CURRENT_TIMESTAMP"), item.Publisher, payload)
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
+}
+
+func (s *sqlStorage) FetchPubSubItems(host, name string) (items []model.PubSubItem, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("item_id", "publisher", "payload").
+			From("pubsub_items").
+			Where(sq.And{sq.Eq{"host": host}, sq.Eq{"node": name}}).
+			OrderBy("created_at")
+
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
 		}
-		return nil
+		defer rows.Close()
+
+		items, err = scanPubSubItemEntities(rows)
+		return err
 	})
+	return
 }
 
-func (s *sqlStorage) DeleteBlockListItems(items []model.BlockListItem) error {
-	return s.inTransaction(func(tx *sql.Tx) error {
-		for _, item := range items {
-			_, err := sq.Delete("blocklist_items").
-				Where(sq.And{sq.Eq{"username": item.Username}, sq.Eq{"jid": item.JID}}).
-				RunWith(tx).Exec()
+func (s *sqlStorage) DeletePubSubItem(host, name, id string) error {
+	return s.withContext(func(ctx context.Context) error {
+		q := sq.Delete("pubsub_items").
+			Where(sq.And{sq.Eq{"host": host}, sq.Eq{"node": name}, sq.Eq{"item_id": id}})
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
+}
+
+func (s *sqlStorage) InsertPushRegistration(reg *model.PushRegistration) error {
+	return s.withContext(func(ctx context.Context) error {
+		var options string
+		if reg.Options != nil {
+			options = reg.Options.String()
+		}
+		q := sq.Insert("push_registrations").
+			Columns("username", "jid", "node", "options", "created_at").
+			Values(reg.Username, reg.JID, reg.Node, options, nowExpr).
+			Suffix(s.upsert("options = ?"), options)
+		_, err := q.RunWith(s.db).ExecContext(ctx)
+		return err
+	})
+}
+
+func (s *sqlStorage) DeletePushRegistrations(username, jid, node string) error {
+	return s.withContext(func(ctx context.Context) error {
+		where := sq.And{sq.Eq{"username": username}, sq.Eq{"jid": jid}}
+		if len(node) > 0 {
+			where = append(where, sq.Eq{"node": node})
+		}
+		_, err := sq.Delete("push_registrations").Where(where).RunWith(s.db).ExecContext(ctx)
+		return err
+	})
+}
+
+func (s *sqlStorage) FetchPushRegistrations(username string) (regs []model.PushRegistration, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("username", "jid", "node", "options").
+			From("push_registrations").
+			Where(sq.Eq{"username": username}).
+			OrderBy("created_at")
+
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		regs, err = scanPushRegistrationEntities(rows)
+		return err
+	})
+	return
+}
+
+func (s *sqlStorage) InsertOrUpdatePrivacyList(list *model.PrivacyList) error {
+	return s.withContext(func(ctx context.Context) error {
+		return s.inTransaction(ctx, func(tx *sql.Tx) error {
+			_, err := sq.Insert("privacy_lists").
+				Columns("username", "name", "is_default", "updated_at", "created_at").
+				Values(list.Username, list.Name, false, nowExpr, nowExpr).
+				Suffix(s.upsert("updated_at = CURRENT_TIMESTAMP")).
+				RunWith(tx).ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sq.Delete("privacy_list_items").
+				Where(sq.And{sq.Eq{"username": list.Username}, sq.Eq{"list": list.Name}}).
+				RunWith(tx).ExecContext(ctx)
 			if err != nil {
 				return err
 			}
+			for _, itm := range list.Items {
+				_, err := sq.Insert("privacy_list_items").
+					Columns("username", "list", "ord", "type", "value", "action", "message", "iq", "presence_in", "presence_out").
+					Values(list.Username, list.Name, itm.Order, itm.Type, itm.Value, itm.Action, itm.Message, itm.IQ, itm.PresenceIn, itm.PresenceOut).
+					RunWith(tx).ExecContext(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func (s *sqlStorage) DeletePrivacyList(username, name string) error {
+	return s.withContext(func(ctx context.Context) error {
+		return s.inTransaction(ctx, func(tx *sql.Tx) error {
+			where := sq.And{sq.Eq{"username": username}, sq.Eq{"list": name}}
+			if _, err := sq.Delete("privacy_list_items").Where(where).RunWith(tx).ExecContext(ctx); err != nil {
+				return err
+			}
+			where = sq.And{sq.Eq{"username": username}, sq.Eq{"name": name}}
+			_, err := sq.Delete("privacy_lists").Where(where).RunWith(tx).ExecContext(ctx)
+			return err
+		})
+	})
+}
+
+func (s *sqlStorage) FetchPrivacyList(username, name string) (list *model.PrivacyList, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		var l model.PrivacyList
+		err := sq.Select("username", "name", "is_default").
+			From("privacy_lists").
+			Where(sq.And{sq.Eq{"username": username}, sq.Eq{"name": name}}).
+			RunWith(s.db).QueryRowContext(ctx).Scan(&l.Username, &l.Name, &l.IsDefault)
+		switch err {
+		case nil:
+			break
+		case sql.ErrNoRows:
+			return nil
+		default:
+			return err
+		}
+		lists, err := s.fetchPrivacyListItems(ctx, []model.PrivacyList{l}, sq.And{sq.Eq{"username": username}, sq.Eq{"list": name}})
+		if err != nil {
+			return err
 		}
+		list = &lists[0]
 		return nil
 	})
+	return
+}
+
+func (s *sqlStorage) FetchPrivacyLists(username string) (lists []model.PrivacyList, err error) {
+	err = s.withContext(func(ctx context.Context) error {
+		q := sq.Select("username", "name", "is_default").
+			From("privacy_lists").
+			Where(sq.Eq{"username": username}).
+			OrderBy("created_at")
+
+		rows, err := q.RunWith(s.db).QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		lists, err = scanPrivacyListEntities(rows)
+		rows.Close()
+		if err != nil || len(lists) == 0 {
+			return err
+		}
+		lists, err = s.fetchPrivacyListItems(ctx, lists, sq.Eq{"username": username})
+		return err
+	})
+	return
+}
+
+func (s *sqlStorage) SetDefaultPrivacyList(username, name string) error {
+	return s.withContext(func(ctx context.Context) error {
+		_, err := sq.Update("privacy_lists").
+			Set("is_default", sq.Expr("name = ?", name)).
+			Where(sq.Eq{"username": username}).
+			RunWith(s.db).ExecContext(ctx)
+		return err
+	})
 }
 
-func (s *sqlStorage) FetchBlockListItems(username string) ([]model.BlockListItem, error) {
-	q := sq.Select("username", "jid").
-		From("blocklist_items").
-		Where(sq.Eq{"username": username}).
-		OrderBy("created_at")
+func (s *sqlStorage) fetchPrivacyListItems(ctx context.Context, lists []model.PrivacyList, where sq.Sqlizer) ([]model.PrivacyList, error) {
+	q := sq.Select("list", "ord", "type", "value", "action", "message", "iq", "presence_in", "presence_out").
+		From("privacy_list_items").
+		Where(where).
+		OrderBy("list", "ord")
 
-	rows, err := q.RunWith(s.db).Query()
+	rows, err := q.RunWith(s.db).QueryContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	return scanBlockListItemEntities(rows)
+
+	for rows.Next() {
+		var listName string
+		var itm model.PrivacyListItem
+		if err := rows.Scan(&listName, &itm.Order, &itm.Type, &itm.Value, &itm.Action, &itm.Message, &itm.IQ, &itm.PresenceIn, &itm.PresenceOut); err != nil {
+			return nil, err
+		}
+		for i := range lists {
+			if lists[i].Name == listName {
+				lists[i].Items = append(lists[i].Items, itm)
+				break
+			}
+		}
+	}
+	return lists, rows.Err()
 }
 
-func (s *sqlStorage) fetchRosterVer(username string) (model.RosterVersion, error) {
+// upsert returns an insert statement suffix applying set
+// assignments whenever the inserted row already exists.
+func (s *sqlStorage) upsert(set string) string {
+	return s.dialect.upsert + " " + set
+}
+
+func escapeLikePattern(str string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return r.Replace(str)
+}
+
+func (s *sqlStorage) fetchRosterVer(ctx context.Context, username string) (model.RosterVersion, error) {
 	q := sq.Select("IFNULL(MAX(ver), 0)", "IFNULL(MAX(last_deletion_ver), 0)").
 		From("roster_versions").
 		Where(sq.Eq{"username": username})
 
 	var ver model.RosterVersion
-	row := q.RunWith(s.db).QueryRow()
+	row := q.RunWith(s.db).QueryRowContext(ctx)
 	err := row.Scan(&ver.Ver, &ver.DeletionVer)
 	switch err {
 	case nil:
@@ -489,15 +1234,12 @@ func (s *sqlStorage) fetchRosterVer(username string) (model.RosterVersion, error
 }
 
 func (s *sqlStorage) loop() {
-	tc := time.NewTicker(time.Second * 15)
+	tc := time.NewTicker(s.healthCheckInterval)
 	defer tc.Stop()
 	for {
 		select {
 		case <-tc.C:
-			err := s.db.Ping()
-			if err != nil {
-				log.Error(err)
-			}
+			s.checkHealth()
 		case ch := <-s.doneCh:
 			s.db.Close()
 			close(ch)
@@ -506,8 +1248,34 @@ func (s *sqlStorage) loop() {
 	}
 }
 
-func (s *sqlStorage) inTransaction(f func(tx *sql.Tx) error) error {
-	tx, txErr := s.db.Begin()
+func (s *sqlStorage) checkHealth() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.healthCheckTimeout)
+	defer cancel()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		if atomic.CompareAndSwapUint32(&s.healthy, 1, 0) {
+			log.Errorf("storage backend unavailable: %v", err)
+		}
+		return
+	}
+	if atomic.CompareAndSwapUint32(&s.healthy, 0, 1) {
+		log.Infof("storage backend available")
+	}
+}
+
+// withContext runs f bounded by the configured query timeout,
+// failing fast whenever the storage backend is unavailable.
+func (s *sqlStorage) withContext(f func(ctx context.Context) error) error {
+	if !s.Healthy() {
+		return ErrUnavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+	defer cancel()
+	return f(ctx)
+}
+
+func (s *sqlStorage) inTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, txErr := s.db.BeginTx(ctx, nil)
 	if txErr != nil {
 		return txErr
 	}
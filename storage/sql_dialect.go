@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import "github.com/go-sql-driver/mysql"
+
+// MySQL error numbers
+const (
+	mysqlErrDupEntry    = 1062
+	mysqlErrNoSuchTable = 1146
+)
+
+// sqlDialect describes the syntax and error reporting
+// differences between supported SQL databases.
+type sqlDialect struct {
+	// upsert prefixes the assignments applied when an inserted row already exists.
+	upsert string
+
+	// insertIgnore is the insert option skipping already existing rows.
+	insertIgnore string
+
+	// like is a LIKE predicate whose pattern escapes wildcards with a backslash.
+	like string
+
+	isDupEntry    func(err error) bool
+	isNoSuchTable func(err error) bool
+}
+
+var mysqlDialect = &sqlDialect{
+	upsert:       "ON DUPLICATE KEY UPDATE",
+	insertIgnore: "IGNORE",
+	like:         "LIKE ?",
+	isDupEntry: func(err error) bool {
+		myErr, ok := err.(*mysql.MySQLError)
+		return ok && myErr.Number == mysqlErrDupEntry
+	},
+	isNoSuchTable: func(err error) bool {
+		myErr, ok := err.(*mysql.MySQLError)
+		return ok && myErr.Number == mysqlErrNoSuchTable
+	},
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
 )
 
 type rowScanner interface {
@@ -45,8 +46,88 @@ func scanBlockListItemEntities(scanner rowsScanner) ([]model.BlockListItem, erro
 	var ret []model.BlockListItem
 	for scanner.Next() {
 		var it model.BlockListItem
-		scanner.Scan(&it.Username, &it.JID)
+		scanner.Scan(&it.Username, &it.JID, &it.Domain, &it.Reason)
 		ret = append(ret, it)
 	}
 	return ret, nil
 }
+
+func scanArchiveMessageEntities(scanner rowsScanner) ([]model.ArchiveMessage, error) {
+	var ret []model.ArchiveMessage
+	for scanner.Next() {
+		var am model.ArchiveMessage
+		var data string
+		if err := scanner.Scan(&am.ID, &am.Username, &am.JID, &data, &am.Direction, &am.Stamp); err != nil {
+			return nil, err
+		}
+		msg, err := xml.NewParser(strings.NewReader(data)).ParseElement()
+		if err != nil {
+			return nil, err
+		}
+		am.Message = msg
+		ret = append(ret, am)
+	}
+	return ret, nil
+}
+
+func scanPubSubNodeEntities(scanner rowsScanner) ([]model.PubSubNode, error) {
+	var ret []model.PubSubNode
+	for scanner.Next() {
+		var n model.PubSubNode
+		if err := scanner.Scan(&n.Host, &n.Name, &n.AccessModel); err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+func scanPubSubItemEntities(scanner rowsScanner) ([]model.PubSubItem, error) {
+	var ret []model.PubSubItem
+	for scanner.Next() {
+		var it model.PubSubItem
+		var payload string
+		if err := scanner.Scan(&it.ID, &it.Publisher, &payload); err != nil {
+			return nil, err
+		}
+		elem, err := xml.NewParser(strings.NewReader(payload)).ParseElement()
+		if err != nil {
+			return nil, err
+		}
+		it.Payload = elem
+		ret = append(ret, it)
+	}
+	return ret, nil
+}
+
+func scanPushRegistrationEntities(scanner rowsScanner) ([]model.PushRegistration, error) {
+	var ret []model.PushRegistration
+	for scanner.Next() {
+		var r model.PushRegistration
+		var options string
+		if err := scanner.Scan(&r.Username, &r.JID, &r.Node, &options); err != nil {
+			return nil, err
+		}
+		if len(options) > 0 {
+			elem, err := xml.NewParser(strings.NewReader(options)).ParseElement()
+			if err != nil {
+				return nil, err
+			}
+			r.Options = elem
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+func scanPrivacyListEntities(scanner rowsScanner) ([]model.PrivacyList, error) {
+	var ret []model.PrivacyList
+	for scanner.Next() {
+		var l model.PrivacyList
+		if err := scanner.Scan(&l.Username, &l.Name, &l.IsDefault); err != nil {
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
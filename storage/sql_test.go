@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/ortuman/jackal/pool"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
@@ -29,7 +30,7 @@ func TestMySQLStorageInsertUser(t *testing.T) {
 
 	s, mock := newMockSQLStorage()
 	mock.ExpectExec("INSERT INTO users (.+) ON DUPLICATE KEY UPDATE (.+)").
-		WithArgs("ortuman", "1234", "Bye!", "1234", "Bye!", now).
+		WithArgs("ortuman", "1234", "", "", "Bye!", "1234", "", "", "Bye!", now).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	err := s.InsertOrUpdateUser(&user)
@@ -38,13 +39,38 @@ func TestMySQLStorageInsertUser(t *testing.T) {
 
 	s, mock = newMockSQLStorage()
 	mock.ExpectExec("INSERT INTO users (.+) ON DUPLICATE KEY UPDATE (.+)").
-		WithArgs("ortuman", "1234", "Bye!", "1234", "Bye!", now).
+		WithArgs("ortuman", "1234", "", "", "Bye!", "1234", "", "", "Bye!", now).
 		WillReturnError(errMySQLStorage)
 	err = s.InsertOrUpdateUser(&user)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
 
+func TestMySQLStorageInsertNewUser(t *testing.T) {
+	user := model.User{Username: "ortuman", Password: "1234"}
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO users (.+)").
+		WithArgs("ortuman", "1234", "", "", "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	require.Nil(t, s.InsertUser(&user))
+	require.Nil(t, mock.ExpectationsWereMet())
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO users (.+)").
+		WithArgs("ortuman", "1234", "", "", "").
+		WillReturnError(&mysql.MySQLError{Number: mysqlErrDupEntry})
+	require.Equal(t, ErrUserExists, s.InsertUser(&user))
+	require.Nil(t, mock.ExpectationsWereMet())
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO users (.+)").
+		WithArgs("ortuman", "1234", "", "", "").
+		WillReturnError(errMySQLStorage)
+	require.Equal(t, errMySQLStorage, s.InsertUser(&user))
+	require.Nil(t, mock.ExpectationsWereMet())
+}
+
 func TestMySQLStorageDeleteUser(t *testing.T) {
 	s, mock := newMockSQLStorage()
 	mock.ExpectBegin()
@@ -54,10 +80,26 @@ func TestMySQLStorageDeleteUser(t *testing.T) {
 		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM roster_versions (.+)").
 		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM roster_notifications (.+)").
+		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM private_storage (.+)").
 		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM vcards (.+)").
 		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM archive_messages (.+)").
+		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM blocklist_items (.+)").
+		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM push_registrations (.+)").
+		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM privacy_list_items (.+)").
+		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM privacy_lists (.+)").
+		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM pubsub_items (.+)").
+		WithArgs("ortuman@%").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM pubsub_nodes (.+)").
+		WithArgs("ortuman@%").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM users (.+)").
 		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
@@ -78,7 +120,7 @@ func TestMySQLStorageDeleteUser(t *testing.T) {
 }
 
 func TestMySQLStorageFetchUser(t *testing.T) {
-	var userColumns = []string{"username", "password", "logged_out_status", "logged_out_at"}
+	var userColumns = []string{"username", "password", "password_scheme", "scram_sha_256", "logged_out_status", "logged_out_at"}
 
 	s, mock := newMockSQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
@@ -92,7 +134,7 @@ func TestMySQLStorageFetchUser(t *testing.T) {
 	s, mock = newMockSQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
 		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("ortuman", "1234", "Bye!", time.Now()))
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("ortuman", "1234", "", "", "Bye!", time.Now()))
 	_, err = s.FetchUser("ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
@@ -127,6 +169,24 @@ func TestMySQLStorageUserExists(t *testing.T) {
 	require.Equal(t, errMySQLStorage, err)
 }
 
+func TestMySQLStorageFetchUsernames(t *testing.T) {
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT username FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("ortuman").AddRow("noelia"))
+
+	usernames, err := s.FetchUsernames()
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []string{"ortuman", "noelia"}, usernames)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT username FROM users").
+		WillReturnError(errMySQLStorage)
+	_, err = s.FetchUsernames()
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
 func TestMySQLStorageInsertRosterItem(t *testing.T) {
 	g := []string{"general", "friends"}
 	ri := model.RosterItem{"user", "contact", "a name", "both", false, 1, g}
@@ -143,6 +203,7 @@ func TestMySQLStorageInsertRosterItem(t *testing.T) {
 		ri.Subscription,
 		"general;friends",
 		ri.Ask,
+		ri.Username,
 	}
 
 	s, mock := newMockSQLStorage()
@@ -242,6 +303,28 @@ func TestMySQLStorageFetchRosterItems(t *testing.T) {
 	require.Equal(t, errMySQLStorage, err)
 }
 
+func TestMySQLStorageFetchRosterVersion(t *testing.T) {
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM roster_versions (.+)").
+		WithArgs("ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"ver", "deletionVer"}).AddRow(3, 2))
+
+	ver, err := s.FetchRosterVersion("ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 3, ver.Ver)
+	require.Equal(t, 2, ver.DeletionVer)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM roster_versions (.+)").
+		WithArgs("ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchRosterVersion("ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
 func TestMySQLStorageInsertRosterNotification(t *testing.T) {
 	rn := model.RosterNotification{
 		"ortuman",
@@ -592,33 +675,54 @@ func TestMySQLStorageDeleteOfflineMessages(t *testing.T) {
 	require.Equal(t, errMySQLStorage, err)
 }
 
+func TestMySQLStorageDeleteExpiredOfflineMessages(t *testing.T) {
+	before := time.Now()
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages WHERE created_at (.+)").
+		WithArgs(before).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	cnt, err := s.DeleteExpiredOfflineMessages(before)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 3, cnt)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages (.+)").
+		WithArgs(before).WillReturnError(errMySQLStorage)
+
+	_, err = s.DeleteExpiredOfflineMessages(before)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
 func TestMySQLStorageInsertBlockListItems(t *testing.T) {
 	s, mock := newMockSQLStorage()
 	mock.ExpectBegin()
-	mock.ExpectExec("INSERT IGNORE INTO blocklist_items (.+)").
+	mock.ExpectExec("INSERT INTO blocklist_items (.+) ON DUPLICATE KEY UPDATE (.+)").
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
-	err := s.InsertOrUpdateBlockListItems([]model.BlockListItem{{"ortuman", "noelia@jackal.im"}})
+	err := s.InsertOrUpdateBlockListItems([]model.BlockListItem{{Username: "ortuman", JID: "noelia@jackal.im"}})
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
 	s, mock = newMockSQLStorage()
 	mock.ExpectBegin()
-	mock.ExpectExec("INSERT IGNORE INTO blocklist_items (.+)").WillReturnError(errMySQLStorage)
+	mock.ExpectExec("INSERT INTO blocklist_items (.+) ON DUPLICATE KEY UPDATE (.+)").WillReturnError(errMySQLStorage)
 	mock.ExpectRollback()
 
-	err = s.InsertOrUpdateBlockListItems([]model.BlockListItem{{"ortuman", "noelia@jackal.im"}})
+	err = s.InsertOrUpdateBlockListItems([]model.BlockListItem{{Username: "ortuman", JID: "noelia@jackal.im"}})
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
 
 func TestMySQLFetchBlockListItems(t *testing.T) {
-	var blockListColumns = []string{"username", "jid"}
+	var blockListColumns = []string{"username", "jid", "domain", "reason"}
 	s, mock := newMockSQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM blocklist_items (.+)").
 		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(blockListColumns).AddRow("ortuman", "noelia@jackal.im"))
+		WillReturnRows(sqlmock.NewRows(blockListColumns).AddRow("ortuman", "noelia@jackal.im", false, ""))
 
 	_, err := s.FetchBlockListItems("ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
@@ -634,6 +738,44 @@ func TestMySQLFetchBlockListItems(t *testing.T) {
 	require.Equal(t, errMySQLStorage, err)
 }
 
+func TestMySQLFetchBlockListItemsRange(t *testing.T) {
+	var blockListColumns = []string{"username", "jid", "domain", "reason"}
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM blocklist_items (.+)").
+		WithArgs("ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("SELECT (.+) FROM blocklist_items (.+) LIMIT 2 OFFSET 1").
+		WithArgs("ortuman").
+		WillReturnRows(sqlmock.NewRows(blockListColumns).AddRow("ortuman", "noelia@jackal.im", false, "").AddRow("ortuman", "jabber.org", true, ""))
+
+	items, count, err := s.FetchBlockListItemsRange("ortuman", 1, -1)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(items))
+	require.Equal(t, 3, count)
+
+	// out of range offset
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM blocklist_items (.+)").
+		WithArgs("ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	items, count, err = s.FetchBlockListItemsRange("ortuman", 3, 10)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 0, len(items))
+	require.Equal(t, 3, count)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM blocklist_items (.+)").
+		WithArgs("ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, _, err = s.FetchBlockListItemsRange("ortuman", 0, 10)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
 func TestMySQLStorageDeleteBlockListItems(t *testing.T) {
 	s, mock := newMockSQLStorage()
 	mock.ExpectBegin()
@@ -649,7 +791,7 @@ func TestMySQLStorageDeleteBlockListItems(t *testing.T) {
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
-	delItems := []model.BlockListItem{{"ortuman", "noelia@jackal.im"}}
+	delItems := []model.BlockListItem{{Username: "ortuman", JID: "noelia@jackal.im"}}
 	err := s.DeleteBlockListItems(delItems)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
@@ -664,3 +806,479 @@ func TestMySQLStorageDeleteBlockListItems(t *testing.T) {
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
+
+func TestMySQLStorageInsertArchiveMessage(t *testing.T) {
+	am := model.ArchiveMessage{
+		ID:        uuid.New(),
+		Username:  "ortuman",
+		JID:       "noelia@jackal.im",
+		Message:   xml.NewElementName("message"),
+		Stamp:     time.Now(),
+		Direction: model.ArchiveSent,
+	}
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("INSERT IGNORE INTO archive_messages (.+)").
+		WithArgs(am.ID, "ortuman", "noelia@jackal.im", am.Message.String(), model.ArchiveSent, am.Stamp).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := s.InsertArchiveMessage(&am)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectExec("INSERT IGNORE INTO archive_messages (.+)").
+		WithArgs(am.ID, "ortuman", "noelia@jackal.im", am.Message.String(), model.ArchiveSent, am.Stamp).
+		WillReturnError(errMySQLStorage)
+
+	err = s.InsertArchiveMessage(&am)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchArchiveMessages(t *testing.T) {
+	var archiveColumns = []string{"id", "username", "jid", "data", "direction", "created_at"}
+
+	now := time.Now()
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM archive_messages (.+)").
+		WithArgs("ortuman", "abcd").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT (.+) FROM archive_messages (.+) ORDER BY serial DESC LIMIT 2").
+		WithArgs("ortuman", "noelia@jackal.im", "noelia@jackal.im/%", "ortuman", "abcd").
+		WillReturnRows(sqlmock.NewRows(archiveColumns).
+			AddRow("2", "ortuman", "noelia@jackal.im", "<message id='m2'/>", "received", now).
+			AddRow("1", "ortuman", "noelia@jackal.im", "<message id='m1'/>", "sent", now))
+
+	msgs, err := s.FetchArchiveMessages("ortuman", ArchiveFilters{With: "noelia@jackal.im", Before: "abcd", Max: 2})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "1", msgs[0].ID)
+	require.Equal(t, "m1", msgs[0].Message.ID())
+	require.Equal(t, model.ArchiveSent, msgs[0].Direction)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archive_messages (.+)").
+		WithArgs("ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchArchiveMessages("ortuman", ArchiveFilters{})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+
+	// unknown paging reference
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM archive_messages (.+)").
+		WithArgs("ortuman", "abcd").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	_, err = s.FetchArchiveMessages("ortuman", ArchiveFilters{After: "abcd"})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, ErrArchiveMessageNotFound, err)
+
+	// last page and full JID filtering
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archive_messages (.+) ORDER BY serial DESC LIMIT 1").
+		WithArgs("ortuman", "noelia@jackal.im/garden").
+		WillReturnRows(sqlmock.NewRows(archiveColumns).
+			AddRow("3", "ortuman", "noelia@jackal.im/garden", "<message id='m3'/>", "", now))
+
+	msgs, err = s.FetchArchiveMessages("ortuman", ArchiveFilters{With: "noelia@jackal.im/garden", LastPage: true, Max: 1})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "3", msgs[0].ID)
+}
+
+func TestMySQLStorageTrimArchive(t *testing.T) {
+	before := time.Now()
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("DELETE FROM archive_messages WHERE created_at (.+)").
+		WithArgs(before).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("SELECT username FROM archive_messages GROUP BY username HAVING (.+)").
+		WithArgs(10).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("ortuman"))
+	mock.ExpectQuery("SELECT serial FROM archive_messages WHERE (.+) ORDER BY serial DESC LIMIT 1 OFFSET 9").
+		WithArgs("ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"serial"}).AddRow(25))
+	mock.ExpectExec("DELETE FROM archive_messages WHERE (.+) serial (.+)").
+		WithArgs("ortuman", 25).WillReturnResult(sqlmock.NewResult(0, 4))
+
+	cnt, err := s.TrimArchive(before, 10)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 6, cnt)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT username FROM archive_messages (.+)").
+		WithArgs(10).WillReturnError(errMySQLStorage)
+
+	_, err = s.TrimArchive(time.Time{}, 10)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageHealthCheck(t *testing.T) {
+	s, mock := newMockSQLStorage()
+	s.healthCheckTimeout = time.Second
+
+	s.checkHealth()
+	require.True(t, s.Healthy())
+
+	// backend not reachable... fail fast
+	s.db.Close()
+	s.checkHealth()
+	require.False(t, s.Healthy())
+
+	_, _, err := s.FetchRosterItems("ortuman")
+	require.Equal(t, ErrUnavailable, err)
+	err = s.InsertOfflineMessage(xml.NewElementName("message"), "ortuman")
+	require.Equal(t, ErrUnavailable, err)
+	require.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLStorageQueryTimeout(t *testing.T) {
+	s, mock := newMockSQLStorage()
+	s.queryTimeout = time.Millisecond * 50
+
+	mock.ExpectQuery("SELECT (.+) FROM vcards (.+)").
+		WithArgs("ortuman").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"vcard"}).AddRow("<vCard xmlns='vcard-temp'/>"))
+
+	vCard, err := s.FetchVCard("ortuman")
+	require.NotNil(t, err)
+	require.Nil(t, vCard)
+}
+
+func TestMySQLStorageInsertCapabilities(t *testing.T) {
+	caps := model.Capabilities{Node: "http://code.google.com/p/exodus", Ver: "QgayPKawpkPSDYmwT/WM94uAlu0=", Features: []string{"urn:xmpp:ping", "urn:xmpp:time"}}
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO capabilities (.+) ON DUPLICATE KEY UPDATE features = ?").
+		WithArgs(caps.Node, caps.Ver, "urn:xmpp:ping;urn:xmpp:time", "urn:xmpp:ping;urn:xmpp:time").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := s.InsertCapabilities(&caps)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO capabilities (.+)").
+		WillReturnError(errMySQLStorage)
+
+	err = s.InsertCapabilities(&caps)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchCapabilities(t *testing.T) {
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT features FROM capabilities (.+)").
+		WithArgs("http://code.google.com/p/exodus", "QgayPKawpkPSDYmwT/WM94uAlu0=").
+		WillReturnRows(sqlmock.NewRows([]string{"features"}).AddRow("urn:xmpp:ping;urn:xmpp:time"))
+
+	caps, err := s.FetchCapabilities("http://code.google.com/p/exodus", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []string{"urn:xmpp:ping", "urn:xmpp:time"}, caps.Features)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT features FROM capabilities (.+)").
+		WithArgs("http://code.google.com/p/exodus", "QgayPKawpkPSDYmwT/WM94uAlu0=").
+		WillReturnRows(sqlmock.NewRows([]string{"features"}))
+
+	caps, err = s.FetchCapabilities("http://code.google.com/p/exodus", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Nil(t, caps)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT features FROM capabilities (.+)").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchCapabilities("http://code.google.com/p/exodus", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageInsertPubSubNode(t *testing.T) {
+	node := model.PubSubNode{Host: "ortuman@jackal.im", Name: "urn:xmpp:avatar:data", AccessModel: "presence"}
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO pubsub_nodes (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data", "presence", "presence").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := s.InsertOrUpdatePubSubNode(&node)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO pubsub_nodes (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data", "presence", "presence").
+		WillReturnError(errMySQLStorage)
+
+	err = s.InsertOrUpdatePubSubNode(&node)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchPubSubNode(t *testing.T) {
+	var nodeColumns = []string{"host", "name", "access_model"}
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM pubsub_nodes (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data").
+		WillReturnRows(sqlmock.NewRows(nodeColumns).AddRow("ortuman@jackal.im", "urn:xmpp:avatar:data", "open"))
+
+	node, err := s.FetchPubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.NotNil(t, node)
+	require.Equal(t, "open", node.AccessModel)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM pubsub_nodes (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data").
+		WillReturnRows(sqlmock.NewRows(nodeColumns))
+
+	node, err = s.FetchPubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Nil(t, node)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM pubsub_nodes (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchPubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchPubSubNodes(t *testing.T) {
+	var nodeColumns = []string{"host", "name", "access_model"}
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM pubsub_nodes (.+)").
+		WithArgs("ortuman@jackal.im").
+		WillReturnRows(sqlmock.NewRows(nodeColumns).
+			AddRow("ortuman@jackal.im", "urn:xmpp:avatar:data", "open").
+			AddRow("ortuman@jackal.im", "urn:xmpp:avatar:metadata", "presence"))
+
+	nodes, err := s.FetchPubSubNodes("ortuman@jackal.im")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(nodes))
+	require.Equal(t, "presence", nodes[1].AccessModel)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM pubsub_nodes (.+)").
+		WithArgs("ortuman@jackal.im").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchPubSubNodes("ortuman@jackal.im")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageDeletePubSubNode(t *testing.T) {
+	s, mock := newMockSQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM pubsub_items (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM pubsub_nodes (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := s.DeletePubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM pubsub_items (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data").WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+
+	err = s.DeletePubSubNode("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageInsertPubSubItem(t *testing.T) {
+	item := model.PubSubItem{ID: "abc1234", Publisher: "ortuman@jackal.im", Payload: xml.NewElementName("data")}
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO pubsub_items (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data", "abc1234", "ortuman@jackal.im", "<data/>", "ortuman@jackal.im", "<data/>").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := s.InsertOrUpdatePubSubItem("ortuman@jackal.im", "urn:xmpp:avatar:data", &item)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+}
+
+func TestMySQLStorageFetchPubSubItems(t *testing.T) {
+	var itemColumns = []string{"item_id", "publisher", "payload"}
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM pubsub_items (.+) ORDER BY created_at").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data").
+		WillReturnRows(sqlmock.NewRows(itemColumns).AddRow("abc1234", "ortuman@jackal.im", "<data/>"))
+
+	items, err := s.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(items))
+	require.Equal(t, "abc1234", items[0].ID)
+	require.Equal(t, "data", items[0].Payload.Name())
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM pubsub_items (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchPubSubItems("ortuman@jackal.im", "urn:xmpp:avatar:data")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageDeletePubSubItem(t *testing.T) {
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("DELETE FROM pubsub_items (.+)").
+		WithArgs("ortuman@jackal.im", "urn:xmpp:avatar:data", "abc1234").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := s.DeletePubSubItem("ortuman@jackal.im", "urn:xmpp:avatar:data", "abc1234")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+}
+
+func TestMySQLStoragePushRegistrations(t *testing.T) {
+	reg := model.PushRegistration{Username: "ortuman", JID: "push.jackal.im", Node: "n1", Options: xml.NewElementNamespace("x", "jabber:x:data")}
+
+	s, mock := newMockSQLStorage()
+	mock.ExpectExec("INSERT INTO push_registrations (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("ortuman", "push.jackal.im", "n1", `<x xmlns="jabber:x:data"/>`, `<x xmlns="jabber:x:data"/>`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.Nil(t, s.InsertPushRegistration(&reg))
+	require.Nil(t, mock.ExpectationsWereMet())
+
+	var pushColumns = []string{"username", "jid", "node", "options"}
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM push_registrations (.+)").
+		WithArgs("ortuman").
+		WillReturnRows(sqlmock.NewRows(pushColumns).
+			AddRow("ortuman", "push.jackal.im", "n1", `<x xmlns="jabber:x:data"/>`).
+			AddRow("ortuman", "push.jackal.im", "n2", ""))
+	regs, err := s.FetchPushRegistrations("ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(regs))
+	require.Equal(t, "x", regs[0].Options.Name())
+	require.Nil(t, regs[1].Options)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectExec("DELETE FROM push_registrations (.+)").
+		WithArgs("ortuman", "push.jackal.im").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM push_registrations (.+)").
+		WithArgs("ortuman", "push.jackal.im", "n1").
+		WillReturnError(errMySQLStorage)
+	require.Nil(t, s.DeletePushRegistrations("ortuman", "push.jackal.im", ""))
+	require.Equal(t, errMySQLStorage, s.DeletePushRegistrations("ortuman", "push.jackal.im", "n1"))
+	require.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLStoragePrivacyLists(t *testing.T) {
+	list := model.PrivacyList{
+		Username: "ortuman",
+		Name:     "public",
+		Items: []model.PrivacyListItem{
+			{Type: "jid", Value: "juliet@jackal.im", Action: "deny", Order: 1, Message: true},
+		},
+	}
+	s, mock := newMockSQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO privacy_lists (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("ortuman", "public", false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM privacy_list_items (.+)").
+		WithArgs("ortuman", "public").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO privacy_list_items (.+)").
+		WithArgs("ortuman", "public", 1, "jid", "juliet@jackal.im", "deny", true, false, false, false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.Nil(t, s.InsertOrUpdatePrivacyList(&list))
+	require.Nil(t, mock.ExpectationsWereMet())
+
+	var listColumns = []string{"username", "name", "is_default"}
+	var itemColumns = []string{"list", "ord", "type", "value", "action", "message", "iq", "presence_in", "presence_out"}
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM privacy_lists (.+)").
+		WithArgs("ortuman").
+		WillReturnRows(sqlmock.NewRows(listColumns).
+			AddRow("ortuman", "public", true).
+			AddRow("ortuman", "private", false))
+	mock.ExpectQuery("SELECT (.+) FROM privacy_list_items (.+)").
+		WithArgs("ortuman").
+		WillReturnRows(sqlmock.NewRows(itemColumns).
+			AddRow("private", 1, "", "", "deny", false, false, false, false).
+			AddRow("public", 1, "jid", "juliet@jackal.im", "deny", true, false, false, false).
+			AddRow("public", 2, "", "", "allow", false, false, false, false))
+	lists, err := s.FetchPrivacyLists("ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(lists))
+	require.True(t, lists[0].IsDefault)
+	require.Equal(t, 2, len(lists[0].Items))
+	require.Equal(t, "juliet@jackal.im", lists[0].Items[0].Value)
+	require.Equal(t, 1, len(lists[1].Items))
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM privacy_lists (.+)").
+		WithArgs("ortuman", "public").
+		WillReturnRows(sqlmock.NewRows(listColumns))
+	l, err := s.FetchPrivacyList("ortuman", "public")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Nil(t, l)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM privacy_lists (.+)").
+		WithArgs("ortuman", "public").
+		WillReturnRows(sqlmock.NewRows(listColumns).AddRow("ortuman", "public", false))
+	mock.ExpectQuery("SELECT (.+) FROM privacy_list_items (.+)").
+		WithArgs("ortuman", "public").
+		WillReturnRows(sqlmock.NewRows(itemColumns).
+			AddRow("public", 1, "jid", "juliet@jackal.im", "deny", true, false, false, false))
+	l, err = s.FetchPrivacyList("ortuman", "public")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.NotNil(t, l)
+	require.Equal(t, list.Items, l.Items)
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectExec("UPDATE privacy_lists (.+)").
+		WithArgs("public", "ortuman").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	require.Nil(t, s.SetDefaultPrivacyList("ortuman", "public"))
+	require.Nil(t, mock.ExpectationsWereMet())
+
+	s, mock = newMockSQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM privacy_list_items (.+)").
+		WithArgs("ortuman", "public").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM privacy_lists (.+)").
+		WithArgs("ortuman", "public").
+		WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+	require.Equal(t, errMySQLStorage, s.DeletePrivacyList("ortuman", "public"))
+	require.Nil(t, mock.ExpectationsWereMet())
+}
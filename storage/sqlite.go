@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/pool"
+)
+
+// time in milliseconds a statement waits for a locked database
+// (e.g. while the migrate command runs) before failing
+const sqliteBusyTimeout = 5000
+
+// upserts omit their conflict target, which requires SQLite 3.35 or later
+var sqliteDialect = &sqlDialect{
+	upsert:       "ON CONFLICT DO UPDATE SET",
+	insertIgnore: "OR IGNORE",
+	like:         `LIKE ? ESCAPE '\'`,
+	isDupEntry: func(err error) bool {
+		sqliteErr, ok := err.(sqlite3.Error)
+		if !ok {
+			return false
+		}
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	},
+	isNoSuchTable: func(err error) bool {
+		sqliteErr, ok := err.(sqlite3.Error)
+		return ok && strings.HasPrefix(sqliteErr.Error(), "no such table")
+	},
+}
+
+// newSQLiteStorage returns a SQL storage backed by a single SQLite database file.
+// Pending schema migrations are always applied, so that an empty
+// database file is ready to use right away.
+func newSQLiteStorage(cfg *SQLiteDb) *sqlStorage {
+	var err error
+	s := &sqlStorage{
+		memoryResources:     newMemoryResources(),
+		pool:                pool.NewBufferPool(),
+		dialect:             sqliteDialect,
+		healthCheckInterval: time.Second * defaultMySQLHealthCheckInterval,
+		healthCheckTimeout:  time.Second * defaultMySQLHealthCheckTimeout,
+		queryTimeout:        time.Second * defaultMySQLQueryTimeout,
+		doneCh:              make(chan chan bool),
+	}
+	s.db, err = openSQLite(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	s.migrate(cfg.MigrationsDir)
+
+	s.healthy = 1
+	go s.loop()
+
+	return s
+}
+
+func openSQLite(cfg *SQLiteDb) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=%d&_journal_mode=WAL", cfg.Path, sqliteBusyTimeout)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer at a time... serialize
+	// every statement and transaction through one connection
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteStorage_Users(t *testing.T) {
+	s, teardown := tUtilSQLiteInit(t)
+	defer teardown()
+
+	require.Nil(t, s.InsertUser(&model.User{Username: "ortuman", Password: "1234"}))
+	require.Equal(t, ErrUserExists, s.InsertUser(&model.User{Username: "ortuman", Password: "5678"}))
+
+	require.Nil(t, s.InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "5678", LoggedOutStatus: "Bye!", LoggedOutAt: time.Now()}))
+	usr, err := s.FetchUser("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, "5678", usr.Password)
+	require.Equal(t, "Bye!", usr.LoggedOutStatus)
+
+	require.Nil(t, s.DeleteUser("ortuman"))
+	exists, err := s.UserExists("ortuman")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestSQLiteStorage_Roster(t *testing.T) {
+	s, teardown := tUtilSQLiteInit(t)
+	defer teardown()
+
+	ri := &model.RosterItem{Username: "ortuman", JID: "juliet@jackal.im", Subscription: "none", Groups: []string{"friends"}}
+	ver, err := s.InsertOrUpdateRosterItem(ri)
+	require.Nil(t, err)
+	require.Equal(t, 0, ver.Ver)
+
+	ri.Subscription = "both"
+	ver, err = s.InsertOrUpdateRosterItem(ri)
+	require.Nil(t, err)
+	require.Equal(t, 1, ver.Ver)
+
+	_, err = s.InsertOrUpdateRosterItem(&model.RosterItem{Username: "ortuman", JID: "romeo@jackal.im", Subscription: "to"})
+	require.Nil(t, err)
+
+	items, ver, err := s.FetchRosterItems("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(items))
+	require.Equal(t, 2, ver.Ver)
+
+	item, err := s.FetchRosterItem("ortuman", "juliet@jackal.im")
+	require.Nil(t, err)
+	require.Equal(t, "both", item.Subscription)
+	require.Equal(t, []string{"friends"}, item.Groups)
+
+	ver, err = s.DeleteRosterItem("ortuman", "romeo@jackal.im")
+	require.Nil(t, err)
+	require.Equal(t, 3, ver.Ver)
+	require.Equal(t, 3, ver.DeletionVer)
+
+	items, _, err = s.FetchRosterItems("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(items))
+}
+
+func TestSQLiteStorage_BlockList(t *testing.T) {
+	s, teardown := tUtilSQLiteInit(t)
+	defer teardown()
+
+	items := []model.BlockListItem{
+		{Username: "ortuman", JID: "juliet@jackal.im"},
+		{Username: "ortuman", JID: "example.org", Domain: true},
+	}
+	require.Nil(t, s.InsertOrUpdateBlockListItems(items))
+
+	// report an already blocked JID
+	require.Nil(t, s.InsertOrUpdateBlockListItems([]model.BlockListItem{{Username: "ortuman", JID: "juliet@jackal.im", Reason: "spam"}}))
+
+	fetched, err := s.FetchBlockListItems("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(fetched))
+	for _, itm := range fetched {
+		switch itm.JID {
+		case "juliet@jackal.im":
+			require.Equal(t, "spam", itm.Reason)
+		case "example.org":
+			require.True(t, itm.Domain)
+		}
+	}
+	require.Nil(t, s.DeleteBlockListItems([]model.BlockListItem{{Username: "ortuman", JID: "example.org"}}))
+
+	fetched, err = s.FetchBlockListItems("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(fetched))
+}
+
+func TestSQLiteStorage_Archive(t *testing.T) {
+	s, teardown := tUtilSQLiteInit(t)
+	defer teardown()
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	am := &model.ArchiveMessage{ID: uuid.New(), Username: "ortuman", JID: "juliet@jackal.im/balcony", Message: msg, Stamp: time.Now(), Direction: "sent"}
+	require.Nil(t, s.InsertArchiveMessage(am))
+	require.Nil(t, s.InsertArchiveMessage(am)) // already archived
+
+	msgs, err := s.FetchArchiveMessages("ortuman", ArchiveFilters{With: "juliet@jackal.im"})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, am.ID, msgs[0].ID)
+
+	msgs, err = s.FetchArchiveMessages("ortuman", ArchiveFilters{With: "juliet_jackal.im"})
+	require.Nil(t, err)
+	require.Equal(t, 0, len(msgs))
+}
+
+func TestSQLiteStorage_Migrations(t *testing.T) {
+	s, teardown := tUtilSQLiteInit(t)
+	defer teardown()
+
+	migrations, err := LoadMigrations("../sql/migrations/sqlite")
+	require.Nil(t, err)
+
+	states, err := (&migrator{db: s.db, dialect: sqliteDialect, migrations: migrations}).status()
+	require.Nil(t, err)
+	for _, st := range states {
+		require.True(t, st.Applied)
+	}
+}
+
+func tUtilSQLiteInit(t *testing.T) (*sqlStorage, func()) {
+	dir, err := ioutil.TempDir("", "jackal_sqlite")
+	require.Nil(t, err)
+
+	s := newSQLiteStorage(&SQLiteDb{
+		Path:          filepath.Join(dir, "jackal.db"),
+		MigrationsDir: "../sql/migrations/sqlite",
+	})
+	return s, func() {
+		s.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
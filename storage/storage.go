@@ -9,6 +9,7 @@ import (
 	"errors"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/storage/model"
@@ -18,19 +19,34 @@ import (
 // ErrMockedError represents a storage mocked error value.
 var ErrMockedError = errors.New("storage mocked error")
 
+// ErrUserExists is returned when inserting an already existing user.
+var ErrUserExists = errors.New("storage user already exists")
+
+// ErrUnavailable is returned when the storage backend is not reachable.
+var ErrUnavailable = errors.New("storage backend unavailable")
+
 // Storage represents an entity storage interface.
 type Storage interface {
 	Shutdown()
 
+	// Healthy reports whether the storage backend is currently reachable.
+	Healthy() bool
+
+	InsertUser(user *model.User) error
 	InsertOrUpdateUser(user *model.User) error
+	// DeleteUser removes a user account along with its roster,
+	// block list and any remaining data stored on its behalf.
 	DeleteUser(username string) error
 	FetchUser(username string) (*model.User, error)
 	UserExists(username string) (bool, error)
+	// FetchUsernames returns the username of every stored user.
+	FetchUsernames() ([]string, error)
 
 	InsertOrUpdateRosterItem(ri *model.RosterItem) (model.RosterVersion, error)
 	DeleteRosterItem(username, jid string) (model.RosterVersion, error)
 	FetchRosterItems(username string) ([]model.RosterItem, model.RosterVersion, error)
 	FetchRosterItem(username, jid string) (*model.RosterItem, error)
+	FetchRosterVersion(username string) (model.RosterVersion, error)
 
 	InsertOrUpdateRosterNotification(rn *model.RosterNotification) error
 	DeleteRosterNotification(contact, jid string) error
@@ -46,15 +62,68 @@ type Storage interface {
 	CountOfflineMessages(username string) (int, error)
 	FetchOfflineMessages(username string) ([]xml.XElement, error)
 	DeleteOfflineMessages(username string) error
+	// DeleteExpiredOfflineMessages removes every offline message stored
+	// before a given time, returning the number of removed messages.
+	DeleteExpiredOfflineMessages(before time.Time) (int, error)
 
 	InsertOrUpdateBlockListItems(items []model.BlockListItem) error
 	DeleteBlockListItems(items []model.BlockListItem) error
 
 	FetchBlockListItems(username string) ([]model.BlockListItem, error)
+	// FetchBlockListItemsRange returns up to limit block list items starting
+	// at offset (no limit if negative), along with the total items count.
+	FetchBlockListItemsRange(username string, offset, limit int) ([]model.BlockListItem, int, error)
+
+	// InsertArchiveMessage archives a message, unless an entry with the same
+	// identifier has already been archived by its user.
+	InsertArchiveMessage(message *model.ArchiveMessage) error
+	FetchArchiveMessages(username string, filters ArchiveFilters) ([]model.ArchiveMessage, error)
+	// TrimArchive removes messages archived before a given time (unless zero),
+	// along with the oldest ones exceeding maxCount per user (unless zero),
+	// returning the number of removed messages.
+	TrimArchive(before time.Time, maxCount int) (int, error)
+
+	InsertCapabilities(caps *model.Capabilities) error
+	FetchCapabilities(node, ver string) (*model.Capabilities, error)
+
+	InsertOrUpdatePubSubNode(node *model.PubSubNode) error
+	FetchPubSubNode(host, name string) (*model.PubSubNode, error)
+	FetchPubSubNodes(host string) ([]model.PubSubNode, error)
+	DeletePubSubNode(host, name string) error
+
+	InsertOrUpdatePubSubItem(host, name string, item *model.PubSubItem) error
+	FetchPubSubItems(host, name string) ([]model.PubSubItem, error)
+	DeletePubSubItem(host, name, id string) error
+
+	InsertPushRegistration(reg *model.PushRegistration) error
+	// DeletePushRegistrations removes every registration of a push service
+	// when an empty node is given.
+	DeletePushRegistrations(username, jid, node string) error
+
+	FetchPushRegistrations(username string) ([]model.PushRegistration, error)
+
+	// InsertOrUpdatePrivacyList stores a privacy list and its items,
+	// keeping its current default state.
+	InsertOrUpdatePrivacyList(list *model.PrivacyList) error
+	DeletePrivacyList(username, name string) error
+	FetchPrivacyList(username, name string) (*model.PrivacyList, error)
+	FetchPrivacyLists(username string) ([]model.PrivacyList, error)
+	// SetDefaultPrivacyList sets user's default privacy list, declining
+	// the use of any default list when an empty name is given.
+	SetDefaultPrivacyList(username, name string) error
+
+	// online resources are ephemeral data, kept in memory
+	// unless a storage cache has been configured.
+	InsertOrUpdateResource(res *model.Resource) error
+	// DeleteResource removes a user resource only if it's
+	// still associated to the given stream identifier.
+	DeleteResource(username, resource, streamID string) error
+	FetchResources(username string) ([]model.Resource, error)
 }
 
 var (
 	inst        Storage
+	instRetent  *retention
 	instMu      sync.RWMutex
 	initialized uint32
 )
@@ -65,16 +134,31 @@ func Initialize(cfg *Config) {
 		instMu.Lock()
 		defer instMu.Unlock()
 
+		var s Storage
 		switch cfg.Type {
 		case BadgerDB:
-			inst = newBadgerDB(cfg.BadgerDB)
+			s = newBadgerDB(cfg.BadgerDB)
 		case MySQL:
-			inst = newSQLStorage(cfg.MySQL)
+			s = newSQLStorage(cfg.MySQL)
+		case SQLite:
+			s = newSQLiteStorage(cfg.SQLite)
 		case Mock:
-			inst = newMockStorage()
+			s = newMockStorage()
 		default:
 			// should not be reached
-			break
+			return
+		}
+		switch cfg.Cache {
+		case RedisCache:
+			s = newRedisStorage(cfg.Redis, s)
+		}
+		if len(cfg.SharedGroups) > 0 {
+			s = newSharedRosterStorage(cfg.SharedGroups, s)
+		}
+		inst = newMeteredStorage(s)
+
+		if cfg.Retention != nil {
+			instRetent = newRetention(cfg.Retention, inst)
 		}
 	}
 }
@@ -91,12 +175,15 @@ func Instance() Storage {
 }
 
 // Shutdown shuts down storage sub system.
-// This method should be used only for testing purposes.
 func Shutdown() {
 	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
 		instMu.Lock()
 		defer instMu.Unlock()
 
+		if instRetent != nil {
+			instRetent.shutdown()
+			instRetent = nil
+		}
 		inst.Shutdown()
 		inst = nil
 	}
@@ -108,9 +195,8 @@ func ActivateMockedError() {
 	instMu.Lock()
 	defer instMu.Unlock()
 
-	switch inst := inst.(type) {
-	case *mockStorage:
-		inst.activateMockedError()
+	if mock, ok := unwrapStorage(inst).(*mockStorage); ok {
+		mock.activateMockedError()
 	}
 }
 
@@ -120,8 +206,32 @@ func DeactivateMockedError() {
 	instMu.Lock()
 	defer instMu.Unlock()
 
-	switch inst := inst.(type) {
-	case *mockStorage:
-		inst.deactivateMockedError()
+	if mock, ok := unwrapStorage(inst).(*mockStorage); ok {
+		mock.deactivateMockedError()
+	}
+}
+
+// blockListItemsRange returns the [offset, offset+limit) block list items range.
+func blockListItemsRange(items []model.BlockListItem, offset, limit int) []model.BlockListItem {
+	if offset >= len(items) {
+		return nil
+	}
+	items = items[offset:]
+	if limit >= 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+func unwrapStorage(s Storage) Storage {
+	for {
+		switch d := s.(type) {
+		case *meteredStorage:
+			s = d.Storage
+		case *sharedRosterStorage:
+			s = d.Storage
+		default:
+			return s
+		}
 	}
 }
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import (
+	"errors"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+// Announcement represents a message sent by the server on its own behalf,
+// such as a login welcome message or a broadcasted announcement.
+type Announcement struct {
+	Subject string `yaml:"subject"`
+	Body    string `yaml:"body"`
+}
+
+// Validate checks the announcement content.
+func (a *Announcement) Validate() error {
+	if len(a.Body) == 0 {
+		return errors.New("c2s: announcement requires a body")
+	}
+	return nil
+}
+
+// Message returns the announcement message addressed to a given JID,
+// sent from the JID domain.
+func (a *Announcement) Message(to *xml.JID) *xml.Message {
+	msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+	if len(a.Subject) > 0 {
+		subject := xml.NewElementName("subject")
+		subject.SetText(a.Subject)
+		msg.AppendElement(subject)
+	}
+	body := xml.NewElementName("body")
+	body.SetText(a.Body)
+	msg.AppendElement(body)
+
+	from, _ := xml.NewJID("", to.Domain(), "", true)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	return msg
+}
+
+// Announce sends an announcement to every authenticated stream,
+// returning the number of sessions it has been sent to.
+func (m *Manager) Announce(a *Announcement) int {
+	stms := m.AuthenticatedStreams()
+	for _, stm := range stms {
+		stm.SendElement(a.Message(stm.JID()))
+	}
+	return len(stms)
+}
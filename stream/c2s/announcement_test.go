@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncement_Message(t *testing.T) {
+	require.NotNil(t, (&Announcement{Subject: "Welcome"}).Validate())
+
+	a := &Announcement{Subject: "Welcome", Body: "Welcome to jackal!"}
+	require.Nil(t, a.Validate())
+
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	msg := a.Message(j)
+	require.True(t, msg.IsNormal())
+	require.Equal(t, "jackal.im", msg.FromJID().String())
+	require.Equal(t, "ortuman@jackal.im/balcony", msg.ToJID().String())
+	require.Equal(t, "Welcome", msg.Elements().Child("subject").Text())
+	require.Equal(t, "Welcome to jackal!", msg.Elements().Child("body").Text())
+
+	msg = (&Announcement{Body: "Welcome to jackal!"}).Message(j)
+	require.Nil(t, msg.Elements().Child("subject"))
+}
+
+func TestC2SManager_Announce(t *testing.T) {
+	Initialize(&Config{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("romeo@jackal.im/garden", false)
+	j3, _ := xml.NewJIDString("juliet@jackal.im/garden", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	stm2 := NewMockStream(uuid.New(), j2)
+	stm3 := NewMockStream(uuid.New(), j3)
+	Instance().RegisterStream(stm1)
+	Instance().AuthenticateStream(stm1)
+	Instance().RegisterStream(stm2)
+	Instance().AuthenticateStream(stm2)
+	Instance().RegisterStream(stm3) // not yet authenticated
+
+	require.Equal(t, 2, Instance().Announce(&Announcement{Body: "Maintenance at 10:00 UTC"}))
+
+	for _, stm := range []*MockStream{stm1, stm2} {
+		elem := stm.FetchElement()
+		require.Equal(t, "message", elem.Name())
+		require.Equal(t, stm.JID().String(), elem.To())
+		require.Equal(t, "Maintenance at 10:00 UTC", elem.Elements().Child("body").Text())
+	}
+}
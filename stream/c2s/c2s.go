@@ -8,12 +8,18 @@ package c2s
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/ortuman/jackal/cluster"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/metrics"
+	"github.com/ortuman/jackal/router"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream"
+	"github.com/ortuman/jackal/stream/s2s"
 	"github.com/ortuman/jackal/xml"
 )
 
@@ -33,8 +39,25 @@ var (
 	// ErrBlockedJID will be returned by Route method if
 	// destination JID matches any of the user's blocked JID.
 	ErrBlockedJID = errors.New("c2s: destination jid is blocked")
+
+	// ErrIQTimeout will be passed to an IQ result handler if no
+	// response to a server originated IQ is received in time.
+	ErrIQTimeout = errors.New("c2s: iq response timeout")
+)
+
+// IQResultHandler is invoked with the result or error response
+// to a server originated IQ, or with ErrIQTimeout if none arrived in time.
+type IQResultHandler func(iq *xml.IQ, err error)
+
+// roster subscription values allowing a contact to receive user's presence
+const (
+	subscriptionFrom = "from"
+	subscriptionBoth = "both"
 )
 
+// interval at which pending stream unregistrations are checked while draining
+const drainPollInterval = time.Millisecond * 50
+
 // Stream represents a client-to-server XMPP stream.
 type Stream interface {
 	ID() string
@@ -54,16 +77,27 @@ type Stream interface {
 	Presence() *xml.Presence
 
 	SendElement(element xml.XElement)
+	SendIQ(iq *xml.IQ, handler IQResultHandler, timeout time.Duration)
 	Disconnect(err error)
 }
 
+// Logger returns a log entry carrying stream session fields,
+// in order to correlate every log related to a stream.
+func Logger(stm Stream) *log.Entry {
+	return log.WithFields(log.Fields{"id": stm.ID(), "jid": stm.JID().String()})
+}
+
 // Manager manages the sessions associated with an account.
 type Manager struct {
 	cfg        *Config
 	lock       sync.RWMutex
 	stms       map[string]Stream
 	authedStms map[string][]Stream
-	blockLists map[string][]*xml.JID
+	authedCnt  int
+
+	blockListsMu  sync.RWMutex
+	blockLists    map[string][]blockedJID
+	blockListsVer uint64
 }
 
 // singleton interface
@@ -83,7 +117,7 @@ func Initialize(cfg *Config) {
 			cfg:        cfg,
 			stms:       make(map[string]Stream),
 			authedStms: make(map[string][]Stream),
-			blockLists: make(map[string][]*xml.JID),
+			blockLists: make(map[string][]blockedJID),
 		}
 	}
 }
@@ -124,6 +158,15 @@ func (m *Manager) IsLocalDomain(domain string) bool {
 	return false
 }
 
+// CanonicalDomain returns the local domain an alias domain stands for,
+// or the very same domain if it's not an alias.
+func (m *Manager) CanonicalDomain(domain string) string {
+	if canonical, ok := m.cfg.Aliases[domain]; ok {
+		return canonical
+	}
+	return domain
+}
+
 // RegisterStream registers the specified client stream.
 // An error will be returned in case the stream has been previously registered.
 func (m *Manager) RegisterStream(stm Stream) error {
@@ -138,6 +181,7 @@ func (m *Manager) RegisterStream(stm Stream) error {
 	}
 	m.stms[stm.ID()] = stm
 	m.lock.Unlock()
+	metrics.C2SStreams.Inc()
 	log.Infof("registered stream... (id: %s)", stm.ID())
 	return nil
 }
@@ -152,14 +196,22 @@ func (m *Manager) UnregisterStream(stm Stream) error {
 		m.lock.Unlock()
 		return fmt.Errorf("stream not found: %s", stm.ID())
 	}
+	var wasAuthed, resourceInUse bool
 	if authedStms := m.authedStms[stm.Username()]; authedStms != nil {
-		res := stm.Resource()
 		for i := 0; i < len(authedStms); i++ {
-			if res == authedStms[i].Resource() {
+			if stm.ID() == authedStms[i].ID() {
 				authedStms = append(authedStms[:i], authedStms[i+1:]...)
+				m.authedCnt--
+				wasAuthed = true
 				break
 			}
 		}
+		// a replacing session may have already bound the same resource
+		for _, authedStm := range authedStms {
+			if authedStm.Resource() == stm.Resource() {
+				resourceInUse = true
+			}
+		}
 		if len(authedStms) > 0 {
 			m.authedStms[stm.Username()] = authedStms
 		} else {
@@ -168,10 +220,36 @@ func (m *Manager) UnregisterStream(stm Stream) error {
 	}
 	delete(m.stms, stm.ID())
 	m.lock.Unlock()
+	if wasAuthed && !resourceInUse && cluster.Enabled() {
+		if err := cluster.Instance().UnregisterSession(stm.Username(), stm.Resource()); err != nil {
+			log.Error(err)
+		}
+	}
+	metrics.C2SStreams.Dec()
 	log.Infof("unregistered stream... (id: %s)", stm.ID())
 	return nil
 }
 
+// DisconnectAll disconnects every registered stream with the given error,
+// waiting until all of them have been unregistered or timeout expires.
+// Those streams still registered after timeout are returned.
+func (m *Manager) DisconnectAll(err error, timeout time.Duration) []Stream {
+	for _, stm := range m.registeredStreams() {
+		stm.Disconnect(err)
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		m.lock.RLock()
+		count := len(m.stms)
+		m.lock.RUnlock()
+		if count == 0 {
+			return nil
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return m.registeredStreams()
+}
+
 // AuthenticateStream sets a previously registered stream as authenticated.
 // An error will be returned in case no assigned resource is found.
 func (m *Manager) AuthenticateStream(stm Stream) error {
@@ -184,11 +262,57 @@ func (m *Manager) AuthenticateStream(stm Stream) error {
 	} else {
 		m.authedStms[stm.Username()] = []Stream{stm}
 	}
+	m.authedCnt++
 	m.lock.Unlock()
+	if cluster.Enabled() {
+		if err := cluster.Instance().RegisterSession(stm.Username(), stm.Resource()); err != nil {
+			log.Error(err)
+		}
+	}
 	log.Infof("authenticated stream... (%s/%s)", stm.Username(), stm.Resource())
 	return nil
 }
 
+// OnlineUsersCount returns the number of users having
+// at least one authenticated stream.
+func (m *Manager) OnlineUsersCount() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.authedStms)
+}
+
+// AuthenticatedStreamsCount returns the number of
+// authenticated streams held by this node.
+func (m *Manager) AuthenticatedStreamsCount() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.authedCnt
+}
+
+// MaxSessionsPerUser returns the maximum number of concurrent
+// sessions a user can hold (0 means unlimited).
+func (m *Manager) MaxSessionsPerUser() int {
+	return m.cfg.MaxSessionsPerUser
+}
+
+// MaxSessions returns the maximum number of concurrent
+// sessions on this node (0 means unlimited).
+func (m *Manager) MaxSessions() int {
+	return m.cfg.MaxSessions
+}
+
+// AuthenticatedStreams returns every authenticated stream sorted by JID.
+func (m *Manager) AuthenticatedStreams() []Stream {
+	m.lock.RLock()
+	var ret []Stream
+	for _, stms := range m.authedStms {
+		ret = append(ret, stms...)
+	}
+	m.lock.RUnlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].JID().String() < ret[j].JID().String() })
+	return ret
+}
+
 // IsBlockedJID returns whether or not the passed jid matches any
 // of a user's blocking list JID.
 func (m *Manager) IsBlockedJID(jid *xml.JID, username string) bool {
@@ -204,22 +328,54 @@ func (m *Manager) IsBlockedJID(jid *xml.JID, username string) bool {
 // ReloadBlockList reloads in-memory block list for a given user and starts
 // applying it for future stanza routing.
 func (m *Manager) ReloadBlockList(username string) {
-	m.lock.Lock()
+	m.UpdateBlockList(username, func() error { return nil })
+}
+
+// UpdateBlockList applies a block list storage update and reloads
+// in-memory user's block list atomically, so that no stanza can be
+// routed against a stale block list once the update has been applied.
+func (m *Manager) UpdateBlockList(username string, update func() error) error {
+	m.blockListsMu.Lock()
+	defer m.blockListsMu.Unlock()
+
+	err := update()
 	delete(m.blockLists, username)
-	m.lock.Unlock()
+	m.blockListsVer++
+
+	metrics.BlockListReloads.Inc()
 	log.Infof("block list reloaded... (username: %s)", username)
+	return err
 }
 
 // Route routes a stanza applying server rules for handling XML stanzas.
 // (https://xmpp.org/rfcs/rfc3921.html#rules)
 func (m *Manager) Route(elem xml.Stanza) error {
+	_, err := m.route(elem, false)
+	return err
+}
+
+// RouteStanza routes a stanza the same way Route does, returning the stanza
+// as processed by routing hooks, or nil if any of them dropped it.
+func (m *Manager) RouteStanza(elem xml.Stanza) (xml.Stanza, error) {
 	return m.route(elem, false)
 }
 
 // MustRoute routes a stanza applying server rules for handling XML stanzas
 // and ignoring blocking lists.
 func (m *Manager) MustRoute(elem xml.Stanza) error {
-	return m.route(elem, true)
+	_, err := m.route(elem, true)
+	return err
+}
+
+// DeliverLocal delivers a stanza forwarded by another cluster node
+// to the matching local streams, without forwarding it back again.
+// Blocking lists were already applied by the forwarding node.
+func (m *Manager) DeliverLocal(elem xml.Stanza) error {
+	if err := m.deliverLocal(elem, m.StreamsMatchingJID(elem.ToJID().ToBareJID())); err != nil {
+		return err
+	}
+	metrics.StanzasRouted.WithLabelValues(elem.Name()).Inc()
+	return nil
 }
 
 // StreamsMatchingJID returns all available streams that match a given JID.
@@ -255,9 +411,47 @@ func (m *Manager) StreamsMatchingJID(jid *xml.JID) []Stream {
 	return ret
 }
 
-func (m *Manager) route(elem xml.Stanza, ignoreBlocking bool) error {
+func (m *Manager) route(elem xml.Stanza, ignoreBlocking bool) (xml.Stanza, error) {
+	m.rewriteAliasDomain(elem)
+
+	dir := router.Inbound
+	if !m.IsLocalDomain(elem.ToJID().Domain()) {
+		dir = router.Outbound
+	}
+	if elem = router.ProcessStanza(elem, dir); elem == nil {
+		return nil, router.ErrDropped
+	}
+	err := m.deliver(elem, ignoreBlocking)
+	if err == nil {
+		metrics.StanzasRouted.WithLabelValues(elem.Name()).Inc()
+	}
+	return elem, err
+}
+
+// rewriteAliasDomain readdresses a stanza sent to an alias domain to its canonical local domain.
+func (m *Manager) rewriteAliasDomain(elem xml.Stanza) {
+	toJID := elem.ToJID()
+	canonical := m.CanonicalDomain(toJID.Domain())
+	if canonical == toJID.Domain() {
+		return
+	}
+	j, _ := xml.NewJID(toJID.Node(), canonical, toJID.Resource(), true)
+	switch stanza := elem.(type) {
+	case *xml.Message:
+		stanza.SetToJID(j)
+	case *xml.Presence:
+		stanza.SetToJID(j)
+	case *xml.IQ:
+		stanza.SetToJID(j)
+	}
+}
+
+func (m *Manager) deliver(elem xml.Stanza, ignoreBlocking bool) error {
 	toJID := elem.ToJID()
 	if !m.IsLocalDomain(toJID.Domain()) {
+		if s2s.Enabled() {
+			return s2s.Instance().Route(elem)
+		}
 		return nil
 	}
 	if !ignoreBlocking && !toJID.IsServer() {
@@ -265,8 +459,18 @@ func (m *Manager) route(elem xml.Stanza, ignoreBlocking bool) error {
 			return ErrBlockedJID
 		}
 	}
+	if presence, ok := elem.(*xml.Presence); ok && presence.IsProbe() {
+		// probes are answered on behalf of the user, never delivered to its streams
+		if toJID.IsServer() {
+			return nil
+		}
+		return m.answerProbe(presence)
+	}
 	rcps := m.StreamsMatchingJID(toJID.ToBareJID())
 	if len(rcps) == 0 {
+		if m.routeCluster(elem) {
+			return nil
+		}
 		exists, err := storage.Instance().UserExists(toJID.Node())
 		if err != nil {
 			return err
@@ -276,6 +480,25 @@ func (m *Manager) route(elem xml.Stanza, ignoreBlocking bool) error {
 		}
 		return ErrNotExistingAccount
 	}
+	if err := m.deliverLocal(elem, rcps); err != nil {
+		// another node may hold the resource, or one eligible for the message
+		if (err == ErrResourceNotFound || err == ErrNotAuthenticated) && m.routeCluster(elem) {
+			return nil
+		}
+		return err
+	}
+	if _, ok := elem.(*xml.Message); !ok && !toJID.IsFullWithUser() {
+		// remaining resources may be connected to other nodes
+		m.routeCluster(elem)
+	}
+	return nil
+}
+
+func (m *Manager) deliverLocal(elem xml.Stanza, rcps []Stream) error {
+	if len(rcps) == 0 {
+		return ErrNotAuthenticated
+	}
+	toJID := elem.ToJID()
 	if toJID.IsFullWithUser() {
 		for _, stm := range rcps {
 			if stm.Resource() == toJID.Resource() {
@@ -287,20 +510,13 @@ func (m *Manager) route(elem xml.Stanza, ignoreBlocking bool) error {
 	}
 	switch elem.(type) {
 	case *xml.Message:
-		// send toJID highest priority stream
-		stm := rcps[0]
-		var highestPriority int8
-		if p := stm.Presence(); p != nil {
-			highestPriority = p.Priority()
+		stms := messageRecipients(rcps, m.cfg.MessageDelivery)
+		if len(stms) == 0 {
+			return ErrNotAuthenticated
 		}
-		for i := 1; i < len(rcps); i++ {
-			rcp := rcps[i]
-			if p := rcp.Presence(); p != nil && p.Priority() > highestPriority {
-				stm = rcp
-				highestPriority = p.Priority()
-			}
+		for _, stm := range stms {
+			stm.SendElement(elem)
 		}
-		stm.SendElement(elem)
 
 	default:
 		// broadcast toJID all streams
@@ -311,10 +527,113 @@ func (m *Manager) route(elem xml.Stanza, ignoreBlocking bool) error {
 	return nil
 }
 
-func (m *Manager) getBlockList(username string) []*xml.JID {
+// MessageRecipients returns the local streams a message addressed
+// to a bare JID is delivered to, according to the configured delivery mode.
+func (m *Manager) MessageRecipients(jid *xml.JID) []Stream {
+	return messageRecipients(m.StreamsMatchingJID(jid.ToBareJID()), m.cfg.MessageDelivery)
+}
+
+// IsMessageRecipient returns whether or not a stream is eligible to receive messages
+// addressed to its bare JID, that is, whether it's available with a non-negative priority.
+// Users with no eligible stream are considered unavailable for message delivery,
+// and so are their offline messages held back.
+// (https://xmpp.org/rfcs/rfc6121.html#rules-local-message)
+func IsMessageRecipient(stm Stream) bool {
+	p := stm.Presence()
+	return p != nil && p.IsAvailable() && p.Priority() >= 0
+}
+
+// messageRecipients returns the available streams with a non-negative
+// presence priority a message addressed to a bare JID should be delivered to.
+// In best resource mode only the ones sharing the highest priority are returned.
+// (https://xmpp.org/rfcs/rfc6121.html#rules-local-message)
+func messageRecipients(rcps []Stream, mode MessageDeliveryMode) []Stream {
+	var ret []Stream
+	var highestPriority int8
+	for _, stm := range rcps {
+		if !IsMessageRecipient(stm) {
+			continue
+		}
+		p := stm.Presence()
+		switch {
+		case mode == AllResourcesDelivery:
+			ret = append(ret, stm)
+		case len(ret) == 0 || p.Priority() > highestPriority:
+			ret = []Stream{stm}
+			highestPriority = p.Priority()
+		case p.Priority() == highestPriority:
+			ret = append(ret, stm)
+		}
+	}
+	return ret
+}
+
+// answerProbe replies a presence probe addressed to a local user
+// with the current presence of each of its available resources,
+// as long as the prober is subscribed to user's presence.
+// (https://xmpp.org/rfcs/rfc6121.html#presence-probe-inbound)
+func (m *Manager) answerProbe(probe *xml.Presence) error {
+	usrJID := probe.ToJID().ToBareJID()
+	proberJID := probe.FromJID()
+
+	ri, err := storage.Instance().FetchRosterItem(usrJID.Node(), proberJID.ToBareJID().String())
+	if err != nil {
+		return err
+	}
+	if ri == nil || (ri.Subscription != subscriptionFrom && ri.Subscription != subscriptionBoth) {
+		m.MustRoute(xml.NewPresence(usrJID, proberJID.ToBareJID(), xml.UnsubscribedType))
+		return nil
+	}
+	var answered bool
+	for _, stm := range m.StreamsMatchingJID(usrJID) {
+		presence := stm.Presence()
+		if presence == nil || !presence.IsAvailable() {
+			continue
+		}
+		p := xml.NewPresence(stm.JID(), proberJID, xml.AvailableType)
+		p.AppendElements(presence.Elements().All())
+		m.MustRoute(p)
+		answered = true
+	}
+	if !answered {
+		m.MustRoute(xml.NewPresence(usrJID, proberJID, xml.UnavailableType))
+	}
+	return nil
+}
+
+// routeCluster forwards a stanza to other cluster nodes, reporting
+// whether or not any of them holds a matching session.
+// An unreachable cluster registry is handled as if no session matched.
+func (m *Manager) routeCluster(elem xml.Stanza) bool {
+	if !cluster.Enabled() {
+		return false
+	}
+	switch err := cluster.Instance().Route(elem); err {
+	case nil:
+		return true
+	case cluster.ErrSessionNotFound:
+		break
+	default:
+		log.Error(err)
+	}
+	return false
+}
+
+func (m *Manager) registeredStreams() []Stream {
 	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var ret []Stream
+	for _, stm := range m.stms {
+		ret = append(ret, stm)
+	}
+	return ret
+}
+
+func (m *Manager) getBlockList(username string) []blockedJID {
+	m.blockListsMu.RLock()
 	bl := m.blockLists[username]
-	m.lock.RUnlock()
+	ver := m.blockListsVer
+	m.blockListsMu.RUnlock()
 	if bl != nil {
 		return bl
 	}
@@ -323,24 +642,37 @@ func (m *Manager) getBlockList(username string) []*xml.JID {
 		log.Error(err)
 		return nil
 	}
-	bl = []*xml.JID{}
+	bl = []blockedJID{}
 	for _, blItm := range blItms {
 		j, _ := xml.NewJIDString(blItm.JID, true)
-		bl = append(bl, j)
+		bl = append(bl, blockedJID{jid: j, domain: blItm.Domain})
 	}
-	m.lock.Lock()
-	m.blockLists[username] = bl
-	m.lock.Unlock()
+	m.blockListsMu.Lock()
+	if m.blockListsVer == ver {
+		// do not cache it if a block list was updated in the meantime
+		m.blockLists[username] = bl
+	}
+	m.blockListsMu.Unlock()
 	return bl
 }
 
-func (m *Manager) jidMatchesBlockedJID(jid, blockedJID *xml.JID) bool {
-	if blockedJID.IsFullWithUser() {
-		return jid.Matches(blockedJID, xml.JIDMatchesNode|xml.JIDMatchesDomain|xml.JIDMatchesResource)
-	} else if blockedJID.IsFullWithServer() {
-		return jid.Matches(blockedJID, xml.JIDMatchesDomain|xml.JIDMatchesResource)
-	} else if blockedJID.IsBare() {
-		return jid.Matches(blockedJID, xml.JIDMatchesNode|xml.JIDMatchesDomain)
+// blockedJID represents an in-memory cached block list item.
+type blockedJID struct {
+	jid    *xml.JID
+	domain bool // blocks every JID within its domain
+}
+
+func (m *Manager) jidMatchesBlockedJID(jid *xml.JID, blocked blockedJID) bool {
+	blkJID := blocked.jid
+	if blocked.domain {
+		return jid.Domain() == blkJID.Domain()
+	}
+	if blkJID.IsFullWithUser() {
+		return jid.Matches(blkJID, xml.JIDMatchesNode|xml.JIDMatchesDomain|xml.JIDMatchesResource)
+	} else if blkJID.IsFullWithServer() {
+		return jid.Matches(blkJID, xml.JIDMatchesDomain|xml.JIDMatchesResource)
+	} else if blkJID.IsBare() {
+		return jid.Matches(blkJID, xml.JIDMatchesNode|xml.JIDMatchesDomain)
 	}
-	return jid.Matches(blockedJID, xml.JIDMatchesDomain)
+	return jid.Matches(blkJID, xml.JIDMatchesDomain)
 }
@@ -7,9 +7,14 @@ package c2s
 
 import (
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis"
+	"github.com/ortuman/jackal/cluster"
+	"github.com/ortuman/jackal/router"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
@@ -66,6 +71,9 @@ func TestC2SManager(t *testing.T) {
 	err = Instance().AuthenticateStream(strm5)
 	require.Nil(t, err)
 
+	require.Equal(t, 4, Instance().OnlineUsersCount())
+	require.Equal(t, 5, Instance().AuthenticatedStreamsCount())
+
 	strms := Instance().StreamsMatchingJID(j1.ToBareJID())
 	require.Equal(t, 2, len(strms))
 	require.Equal(t, "ortuman@jackal.im/balcony", strms[0].JID().String())
@@ -92,6 +100,126 @@ func TestC2SManager(t *testing.T) {
 
 	strms = Instance().StreamsMatchingJID(j1.ToBareJID())
 	require.Equal(t, 0, len(strms))
+	require.Equal(t, 3, Instance().OnlineUsersCount())
+	require.Equal(t, 3, Instance().AuthenticatedStreamsCount())
+}
+
+func TestC2SManager_AliasDomain(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	Initialize(&Config{
+		Domains: []string{"jackal.im"},
+		Aliases: map[string]string{"jackal.net": "jackal.im"},
+	})
+	defer Shutdown()
+
+	require.Equal(t, "jackal.im", Instance().CanonicalDomain("jackal.net"))
+	require.Equal(t, "jackal.im", Instance().CanonicalDomain("jackal.im"))
+	require.Equal(t, "example.org", Instance().CanonicalDomain("example.org"))
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("romeo@example.org/garden", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	Instance().RegisterStream(stm1)
+	Instance().AuthenticateStream(stm1)
+
+	// stanzas addressed to an alias reach the canonical user sessions
+	to, _ := xml.NewJIDString("ortuman@jackal.net/balcony", false)
+	msgID := uuid.New()
+	msg := xml.NewMessageType(msgID, xml.ChatType)
+	msg.SetFromJID(j2)
+	msg.SetToJID(to)
+	require.Nil(t, Instance().Route(msg))
+
+	elem := stm1.FetchElement()
+	require.Equal(t, msgID, elem.ID())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.To())
+}
+
+func TestC2SManager_RoutingHooks(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	Initialize(&Config{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("romeo@example.org/garden", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	Instance().RegisterStream(stm1)
+	Instance().AuthenticateStream(stm1)
+
+	var dirs []router.Direction
+	router.RegisterHook("spam", 0, router.HookFunc(func(stanza xml.Stanza, dir router.Direction) xml.Stanza {
+		dirs = append(dirs, dir)
+		if msg, ok := stanza.(*xml.Message); ok && msg.IsMessageWithBody() && msg.Elements().Child("body").Text() == "spam" {
+			return nil
+		}
+		return stanza
+	}))
+	defer router.UnregisterHook("spam")
+
+	newMessage := func(body string) *xml.Message {
+		msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+		msg.SetFromJID(j2)
+		msg.SetToJID(j1)
+		b := xml.NewElementName("body")
+		b.SetText(body)
+		msg.AppendElement(b)
+		return msg
+	}
+	// dropped stanzas are never delivered
+	require.Equal(t, router.ErrDropped, Instance().Route(newMessage("spam")))
+	require.Equal(t, &xml.Element{}, stm1.FetchElement())
+
+	msg := newMessage("Hi!")
+	require.Nil(t, Instance().Route(msg))
+	require.Equal(t, msg.ID(), stm1.FetchElement().ID())
+
+	// stanzas addressed to remote domains are outbound
+	reply := xml.NewMessageType(uuid.New(), xml.ChatType)
+	reply.SetFromJID(j1)
+	reply.SetToJID(j2)
+	require.Nil(t, Instance().Route(reply))
+
+	require.Equal(t, []router.Direction{router.Inbound, router.Inbound, router.Outbound}, dirs)
+}
+
+func TestC2SManager_RouteStanza(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	Initialize(&Config{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("romeo@example.org/garden", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	Instance().RegisterStream(stm1)
+	Instance().AuthenticateStream(stm1)
+
+	router.RegisterHook("tag", 0, router.HookFunc(func(stanza xml.Stanza, dir router.Direction) xml.Stanza {
+		msg, ok := stanza.(*xml.Message)
+		if !ok {
+			return stanza
+		}
+		tagged, _ := xml.NewMessageFromElement(msg, msg.FromJID(), msg.ToJID())
+		tagged.AppendElement(xml.NewElementNamespace("tag", "urn:test"))
+		return tagged
+	}))
+	defer router.UnregisterHook("tag")
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j2)
+	msg.SetToJID(j1)
+	routed, err := Instance().RouteStanza(msg)
+	require.Nil(t, err)
+	require.NotNil(t, routed.Elements().ChildNamespace("tag", "urn:test"))
+	require.Nil(t, msg.Elements().ChildNamespace("tag", "urn:test"))
+
+	elem := stm1.FetchElement()
+	require.NotNil(t, elem.Elements().ChildNamespace("tag", "urn:test"))
 }
 
 func TestC2SManager_Routing(t *testing.T) {
@@ -178,6 +306,74 @@ func TestC2SManager_Routing(t *testing.T) {
 	require.Nil(t, Instance().Route(msg))
 	elem = stm3.FetchElement()
 	require.Equal(t, msgID, elem.ID())
+
+	// ...or to every resource sharing the highest priority
+	stm4.SetPresence(tUtilPriorityPresence(j4, "2"))
+	require.Nil(t, Instance().Route(msg))
+	elem = stm3.FetchElement()
+	require.Equal(t, msgID, elem.ID())
+	elem = stm4.FetchElement()
+	require.Equal(t, msgID, elem.ID())
+
+	// negative priority resources never receive bare JID messages
+	stm3.SetPresence(tUtilPriorityPresence(j3, "-1"))
+	require.Nil(t, Instance().Route(msg))
+	elem = stm4.FetchElement()
+	require.Equal(t, msgID, elem.ID())
+
+	stm4.SetPresence(tUtilPriorityPresence(j4, "-5"))
+	require.Equal(t, ErrNotAuthenticated, Instance().Route(msg))
+
+	// ...neither do unavailable ones
+	stm4.SetPresence(xml.NewPresence(j4, j4, xml.UnavailableType))
+	require.Equal(t, ErrNotAuthenticated, Instance().Route(msg))
+
+	stm4.SetPresence(tUtilPriorityPresence(j4, "0"))
+	require.Nil(t, Instance().Route(msg))
+	elem = stm4.FetchElement()
+	require.Equal(t, msgID, elem.ID())
+}
+
+func TestC2SManager_MessageDelivery(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	Initialize(&Config{Domains: []string{"jackal.im"}, MessageDelivery: AllResourcesDelivery})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("hamlet@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("hamlet@jackal.im/garden", false)
+	j3, _ := xml.NewJIDString("hamlet@jackal.im/yard", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	stm2 := NewMockStream(uuid.New(), j2)
+	stm3 := NewMockStream(uuid.New(), j3)
+	for _, stm := range []*MockStream{stm1, stm2, stm3} {
+		Instance().RegisterStream(stm)
+		Instance().AuthenticateStream(stm)
+	}
+	stm1.SetPresence(tUtilPriorityPresence(j1, "5"))
+	stm2.SetPresence(tUtilPriorityPresence(j2, "0"))
+	stm3.SetPresence(tUtilPriorityPresence(j3, "-1"))
+
+	// every non-negative priority resource receives the message
+	msgID := uuid.New()
+	msg := xml.NewMessageType(msgID, xml.ChatType)
+	msg.SetToJID(j1.ToBareJID())
+	require.Nil(t, Instance().Route(msg))
+	require.Equal(t, msgID, stm1.FetchElement().ID())
+	require.Equal(t, msgID, stm2.FetchElement().ID())
+	require.Equal(t, []Stream{stm1, stm2}, Instance().MessageRecipients(j1.ToBareJID()))
+
+	// ...while only the highest priority ones do in best mode
+	Instance().cfg.MessageDelivery = BestResourceDelivery
+	require.Nil(t, Instance().Route(msg))
+	require.Equal(t, msgID, stm1.FetchElement().ID())
+	require.Equal(t, []Stream{stm1}, Instance().MessageRecipients(j1.ToBareJID()))
+
+	// full JID messages are unaffected by delivery mode
+	msg.SetToJID(j3)
+	require.Nil(t, Instance().Route(msg))
+	require.Equal(t, msgID, stm3.FetchElement().ID())
 }
 
 func TestC2SManager_StreamsMatching(t *testing.T) {
@@ -212,6 +408,168 @@ func TestC2SManager_StreamsMatching(t *testing.T) {
 	require.Equal(t, 3, len(Instance().StreamsMatchingJID(j)))
 }
 
+func TestC2SManager_PresenceProbe(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	Initialize(&Config{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("hamlet@jackal.im/garden", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	stm2 := NewMockStream(uuid.New(), j2)
+	stm2.SetPresence(xml.NewPresence(j2, j2, xml.AvailableType))
+
+	Instance().RegisterStream(stm1)
+	Instance().RegisterStream(stm2)
+	Instance().AuthenticateStream(stm1)
+	Instance().AuthenticateStream(stm2)
+
+	probe := xml.NewPresence(j1.ToBareJID(), j2.ToBareJID(), xml.ProbeType)
+
+	// prober not subscribed to user's presence
+	require.Nil(t, Instance().Route(probe))
+	elem := stm1.FetchElement()
+	require.Equal(t, xml.UnsubscribedType, elem.Type())
+	require.Equal(t, "hamlet@jackal.im", elem.From())
+
+	storage.Instance().InsertOrUpdateRosterItem(&model.RosterItem{
+		Username:     "hamlet",
+		JID:          "ortuman@jackal.im",
+		Subscription: "from",
+	})
+	require.Nil(t, Instance().Route(probe))
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "hamlet@jackal.im/garden", elem.From())
+
+	// probes are never delivered to user's streams
+	require.Equal(t, &xml.Element{}, stm2.FetchElement())
+
+	// no available resources
+	Instance().UnregisterStream(stm2)
+	require.Nil(t, Instance().Route(probe))
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, "hamlet@jackal.im", elem.From())
+}
+
+func TestC2SManager_UnregisterReplacedStream(t *testing.T) {
+	Initialize(&Config{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	stm1 := NewMockStream(uuid.New(), j)
+	stm2 := NewMockStream(uuid.New(), j)
+
+	Instance().RegisterStream(stm1)
+	Instance().AuthenticateStream(stm1)
+
+	// replacing session binds the same resource before the old one is unregistered
+	Instance().RegisterStream(stm2)
+	Instance().AuthenticateStream(stm2)
+	Instance().UnregisterStream(stm1)
+
+	stms := Instance().StreamsMatchingJID(j)
+	require.Equal(t, 1, len(stms))
+	require.Equal(t, stm2.ID(), stms[0].ID())
+}
+
+func TestC2SManager_DisconnectAll(t *testing.T) {
+	Initialize(&Config{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/garden", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	stm2 := NewMockStream(uuid.New(), j2)
+	Instance().RegisterStream(stm1)
+	Instance().RegisterStream(stm2)
+
+	// first stream unregisters once disconnected...
+	go func() {
+		stm1.WaitDisconnection()
+		Instance().UnregisterStream(stm1)
+	}()
+	stms := Instance().DisconnectAll(streamerror.ErrSystemShutdown, time.Millisecond*200)
+	require.Equal(t, 1, len(stms))
+	require.Equal(t, stm2.ID(), stms[0].ID())
+	require.True(t, stm1.IsDisconnected())
+	require.Equal(t, streamerror.ErrSystemShutdown, stm2.WaitDisconnection())
+
+	Instance().UnregisterStream(stm2)
+	require.Nil(t, Instance().DisconnectAll(streamerror.ErrSystemShutdown, time.Second))
+}
+
+func TestC2SManager_ClusterRouting(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	Initialize(&Config{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	s, err := miniredis.Run()
+	require.Nil(t, err)
+	defer s.Close()
+
+	// hamlet is connected to another alive node
+	s.Set("cluster:node:node2", "1")
+	s.SetAdd("cluster:members", "node2")
+	s.HSet("cluster:sessions:hamlet", "garden", "node2")
+
+	cluster.Initialize(&cluster.Config{
+		Name:              "node1",
+		Redis:             cluster.RedisConfig{Address: s.Addr(), PoolSize: 2},
+		HeartbeatInterval: 1,
+		NodeTimeout:       2,
+	}, nil)
+	defer cluster.Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("hamlet@jackal.im/garden", false)
+	j3, _ := xml.NewJIDString("hamlet@jackal.im/balcony", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	Instance().RegisterStream(stm1)
+	Instance().AuthenticateStream(stm1)
+	require.Equal(t, "node1", s.HGet("cluster:sessions:ortuman", "balcony"))
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(j2)
+	require.Nil(t, Instance().Route(iq))
+
+	inbox, _ := s.List("cluster:inbox:node2")
+	require.Equal(t, 1, len(inbox))
+
+	iq.SetToJID(j3)
+	storage.Instance().InsertOrUpdateUser(&model.User{Username: "hamlet", Password: ""})
+	require.Equal(t, ErrNotAuthenticated, Instance().Route(iq))
+
+	// unavailable local resources don't hold back bare JID messages
+	stm2 := NewMockStream(uuid.New(), j3)
+	Instance().RegisterStream(stm2)
+	Instance().AuthenticateStream(stm2)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j3.ToBareJID())
+	require.Nil(t, Instance().Route(msg))
+
+	inbox, _ = s.List("cluster:inbox:node2")
+	require.Equal(t, 2, len(inbox))
+	Instance().UnregisterStream(stm2)
+
+	// forwarded stanzas are delivered locally
+	iq.SetFromJID(j2)
+	iq.SetToJID(j1)
+	require.Nil(t, Instance().DeliverLocal(iq))
+	require.Equal(t, iq.ID(), stm1.FetchElement().ID())
+
+	Instance().UnregisterStream(stm1)
+	require.False(t, s.Exists("cluster:sessions:ortuman"))
+}
+
 func TestC2SManager_BlockedJID(t *testing.T) {
 	storage.Initialize(&storage.Config{Type: storage.Mock})
 	defer storage.Shutdown()
@@ -290,3 +648,60 @@ func TestC2SManager_BlockedJID(t *testing.T) {
 	iq.SetToJID(j1)
 	require.Equal(t, ErrBlockedJID, Instance().Route(iq))
 }
+
+func TestC2SManager_BlockedDomain(t *testing.T) {
+	storage.Initialize(&storage.Config{Type: storage.Mock})
+	defer storage.Shutdown()
+
+	Initialize(&Config{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("romeo@example.org/garden", false)
+	j3, _ := xml.NewJIDString("example.org/res", false)
+	j4, _ := xml.NewJIDString("example.org", false)
+	j5, _ := xml.NewJIDString("juliet@jabber.org/garden", false)
+	stm1 := NewMockStream(uuid.New(), j1)
+	Instance().RegisterStream(stm1)
+	Instance().AuthenticateStream(stm1)
+
+	bl := []model.BlockListItem{{
+		Username: "ortuman",
+		JID:      "example.org",
+		Domain:   true,
+	}}
+	storage.Instance().InsertOrUpdateBlockListItems(bl)
+	Instance().ReloadBlockList("ortuman")
+
+	require.True(t, Instance().IsBlockedJID(j2, "ortuman"))
+	require.True(t, Instance().IsBlockedJID(j2.ToBareJID(), "ortuman"))
+	require.True(t, Instance().IsBlockedJID(j3, "ortuman"))
+	require.True(t, Instance().IsBlockedJID(j4, "ortuman"))
+	require.False(t, Instance().IsBlockedJID(j5, "ortuman"))
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j2)
+	msg.SetToJID(j1)
+	require.Equal(t, ErrBlockedJID, Instance().Route(msg))
+
+	msg.SetFromJID(j5)
+	require.Nil(t, Instance().Route(msg))
+	require.Equal(t, msg.ID(), stm1.FetchElement().ID())
+
+	storage.Instance().DeleteBlockListItems(bl)
+	Instance().ReloadBlockList("ortuman")
+
+	require.False(t, Instance().IsBlockedJID(j2, "ortuman"))
+}
+
+func tUtilPriorityPresence(j *xml.JID, priority string) *xml.Presence {
+	p := xml.NewElementName("presence")
+	p.SetFrom(j.String())
+	p.SetTo(j.String())
+	p.SetType(xml.AvailableType)
+	pr := xml.NewElementName("priority")
+	pr.SetText(priority)
+	p.AppendElement(pr)
+	presence, _ := xml.NewPresenceFromElement(p, j, j)
+	return presence
+}
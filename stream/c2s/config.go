@@ -5,15 +5,50 @@
 
 package c2s
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MessageDeliveryMode represents the way messages addressed
+// to a bare JID are delivered across user's resources.
+type MessageDeliveryMode string
+
+const (
+	// BestResourceDelivery delivers bare JID messages to the available
+	// resources sharing the highest non-negative priority.
+	BestResourceDelivery MessageDeliveryMode = "best"
+
+	// AllResourcesDelivery delivers bare JID messages to every
+	// available resource with a non-negative priority.
+	AllResourcesDelivery MessageDeliveryMode = "all"
+)
 
 // Config represents a client-to-server manager configuration.
 type Config struct {
-	Domains []string
+	Domains         []string
+	MessageDelivery MessageDeliveryMode
+
+	// MaxSessionsPerUser limits the number of concurrent sessions
+	// a user can hold on this node (0 means unlimited).
+	MaxSessionsPerUser int
+
+	// MaxSessions limits the total number of concurrent
+	// sessions on this node (0 means unlimited).
+	MaxSessions int
+
+	// Aliases maps alias domains to the local domain they stand for.
+	Aliases map[string]string
 }
 
 type configProxyType struct {
 	Domains []string `yaml:"domains"`
+	Message struct {
+		Delivery string `yaml:"delivery"`
+	} `yaml:"message"`
+	MaxSessionsPerUser int `yaml:"max_sessions_per_user"`
+	MaxSessions        int `yaml:"max_sessions"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
@@ -26,5 +61,19 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return errors.New("c2s.Config: no domain specified")
 	}
 	c.Domains = p.Domains
+
+	switch mode := MessageDeliveryMode(strings.ToLower(p.Message.Delivery)); mode {
+	case "", BestResourceDelivery:
+		c.MessageDelivery = BestResourceDelivery
+	case AllResourcesDelivery:
+		c.MessageDelivery = mode
+	default:
+		return fmt.Errorf("c2s.Config: unrecognized message delivery mode: %s", p.Message.Delivery)
+	}
+	if p.MaxSessionsPerUser < 0 || p.MaxSessions < 0 {
+		return errors.New("c2s.Config: session limits can't be negative")
+	}
+	c.MaxSessionsPerUser = p.MaxSessionsPerUser
+	c.MaxSessions = p.MaxSessions
 	return nil
 }
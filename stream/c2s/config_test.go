@@ -17,6 +17,26 @@ func TestC2SLoad(t *testing.T) {
 	err := yaml.Unmarshal([]byte("domains: [jackal.im]"), &cfg)
 	require.Nil(t, err)
 	require.Equal(t, "jackal.im", cfg.Domains[0])
+	require.Equal(t, BestResourceDelivery, cfg.MessageDelivery)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("{domains: [jackal.im], message: {delivery: all}}"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, AllResourcesDelivery, cfg.MessageDelivery)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("{domains: [jackal.im], message: {delivery: random}}"), &cfg)
+	require.NotNil(t, err)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("{domains: [jackal.im], max_sessions_per_user: 5, max_sessions: 1000}"), &cfg)
+	require.Nil(t, err)
+	require.Equal(t, 5, cfg.MaxSessionsPerUser)
+	require.Equal(t, 1000, cfg.MaxSessions)
+
+	cfg = Config{}
+	err = yaml.Unmarshal([]byte("{domains: [jackal.im], max_sessions: -1}"), &cfg)
+	require.NotNil(t, err)
 }
 
 func TestC2SEmptyDomains(t *testing.T) {
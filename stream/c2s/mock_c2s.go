@@ -6,6 +6,7 @@
 package c2s
 
 import (
+	"sync"
 	"time"
 
 	"github.com/ortuman/jackal/stream"
@@ -18,6 +19,9 @@ type MockStream struct {
 	ctx    *stream.Context
 	elemCh chan xml.XElement
 	discCh chan error
+
+	iqMu       sync.Mutex
+	iqHandlers map[string]IQResultHandler
 }
 
 // NewMockStream returns a new mocked stream instance.
@@ -32,6 +36,7 @@ func NewMockStream(id string, jid *xml.JID) *MockStream {
 	stm.ctx.SetString(jid.Resource(), "resource")
 	stm.elemCh = make(chan xml.XElement, 16)
 	stm.discCh = make(chan error, 1)
+	stm.iqHandlers = make(map[string]IQResultHandler)
 	return stm
 }
 
@@ -141,13 +146,56 @@ func (m *MockStream) SendElement(element xml.XElement) {
 	m.elemCh <- element
 }
 
+// SendIQ sends the given IQ element, invoking handler once its
+// response is delivered through ResolveIQ or with ErrIQTimeout
+// after timeout elapses.
+func (m *MockStream) SendIQ(iq *xml.IQ, handler IQResultHandler, timeout time.Duration) {
+	id := iq.ID()
+	m.iqMu.Lock()
+	m.iqHandlers[id] = handler
+	m.iqMu.Unlock()
+	if timeout > 0 {
+		time.AfterFunc(timeout, func() {
+			if h := m.takeIQHandler(id); h != nil {
+				h(nil, ErrIQTimeout)
+			}
+		})
+	}
+	m.SendElement(iq)
+}
+
+// ResolveIQ delivers a response to a pending IQ sent through SendIQ,
+// returning false if there's no handler waiting for it.
+func (m *MockStream) ResolveIQ(iq *xml.IQ) bool {
+	h := m.takeIQHandler(iq.ID())
+	if h == nil {
+		return false
+	}
+	h(iq, nil)
+	return true
+}
+
+func (m *MockStream) takeIQHandler(id string) IQResultHandler {
+	m.iqMu.Lock()
+	defer m.iqMu.Unlock()
+	h := m.iqHandlers[id]
+	delete(m.iqHandlers, id)
+	return h
+}
+
 // FetchElement waits until a new XML element is sent to
 // the mocked stream and returns it.
 func (m *MockStream) FetchElement() xml.XElement {
+	return m.FetchElementTimeout(time.Second * 3)
+}
+
+// FetchElementTimeout waits up to timeout until a new XML element
+// is sent to the mocked stream and returns it, or an empty element otherwise.
+func (m *MockStream) FetchElementTimeout(timeout time.Duration) xml.XElement {
 	select {
 	case e := <-m.elemCh:
 		return e
-	case <-time.After(time.Second * 3):
+	case <-time.After(timeout):
 		return &xml.Element{}
 	}
 }
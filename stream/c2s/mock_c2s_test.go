@@ -7,6 +7,7 @@ package c2s
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
@@ -54,3 +55,23 @@ func TestMockC2Stream(t *testing.T) {
 	require.NotNil(t, fetch)
 	require.Equal(t, "elem1234", fetch.Name())
 }
+
+func TestMockC2Stream_SendIQ(t *testing.T) {
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	strm := NewMockStream(uuid.New(), j)
+
+	respCh := make(chan error, 1)
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	strm.SendIQ(iq, func(resp *xml.IQ, err error) { respCh <- err }, time.Minute)
+	require.Equal(t, iq.ID(), strm.FetchElement().ID())
+
+	require.True(t, strm.ResolveIQ(iq.ResultIQ()))
+	require.Nil(t, <-respCh)
+	require.False(t, strm.ResolveIQ(iq.ResultIQ()))
+
+	iq = xml.NewIQType(uuid.New(), xml.GetType)
+	strm.SendIQ(iq, func(resp *xml.IQ, err error) { respCh <- err }, time.Millisecond*50)
+	strm.FetchElement()
+	require.Equal(t, ErrIQTimeout, <-respCh)
+	require.False(t, strm.ResolveIQ(iq.ResultIQ()))
+}
@@ -12,12 +12,19 @@ import (
 // Error represents a "stream:error" element.
 type Error struct {
 	reason string
+	text   string
 }
 
 var (
 	// ErrInvalidXML represents 'invalid-xml' stream error.
 	ErrInvalidXML = newStreamError("invalid-xml")
 
+	// ErrNotWellFormed represents 'not-well-formed' stream error.
+	ErrNotWellFormed = newStreamError("not-well-formed")
+
+	// ErrRestrictedXML represents 'restricted-xml' stream error.
+	ErrRestrictedXML = newStreamError("restricted-xml")
+
 	// ErrInvalidNamespace represents 'invalid-namespace' stream error.
 	ErrInvalidNamespace = newStreamError("invalid-namespace")
 
@@ -27,6 +34,9 @@ var (
 	// ErrInvalidFrom represents 'invalid-from' stream error.
 	ErrInvalidFrom = newStreamError("invalid-from")
 
+	// ErrImproperAddressing represents 'improper-addressing' stream error.
+	ErrImproperAddressing = newStreamError("improper-addressing")
+
 	// ErrPolicyViolation represents 'connection-timeout' stream error.
 	ErrPolicyViolation = newStreamError("policy-violation")
 
@@ -42,21 +52,39 @@ var (
 	// ErrNotAuthorized represents 'not-authorized' stream error.
 	ErrNotAuthorized = newStreamError("not-authorized")
 
+	// ErrConflict represents 'conflict' stream error.
+	ErrConflict = newStreamError("conflict")
+
 	// ErrResourceConstraint represents 'resource-constraint' stream error.
 	ErrResourceConstraint = newStreamError("resource-constraint")
 
 	// ErrInternalServerError represents 'internal-server-error' stream error.
 	ErrInternalServerError = newStreamError("internal-server-error")
+
+	// ErrUndefinedCondition represents 'undefined-condition' stream error.
+	ErrUndefinedCondition = newStreamError("undefined-condition")
+
+	// ErrSystemShutdown represents 'system-shutdown' stream error.
+	ErrSystemShutdown = newStreamError("system-shutdown")
 )
 
 func newStreamError(reason string) *Error {
 	return &Error{reason: reason}
 }
 
+// NewSeeOtherHostError returns a 'see-other-host' stream error
+// redirecting the peer to the given host.
+func NewSeeOtherHostError(host string) *Error {
+	return &Error{reason: "see-other-host", text: host}
+}
+
 // Element returns stream error XML node.
 func (se *Error) Element() xml.XElement {
 	ret := xml.NewElementName("stream:error")
 	reason := xml.NewElementNamespace(se.reason, "urn:ietf:params:xml:ns:xmpp-streams")
+	if len(se.text) > 0 {
+		reason.SetText(se.text)
+	}
 	ret.AppendElement(reason)
 	return ret
 }
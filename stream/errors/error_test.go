@@ -15,6 +15,12 @@ func TestStreamError(t *testing.T) {
 	require.Equal(t, "invalid-xml", ErrInvalidXML.Error())
 	require.Equal(t, "invalid-xml", ErrInvalidXML.Element().Elements().All()[0].Name())
 
+	require.Equal(t, "not-well-formed", ErrNotWellFormed.Error())
+	require.Equal(t, "not-well-formed", ErrNotWellFormed.Element().Elements().All()[0].Name())
+
+	require.Equal(t, "restricted-xml", ErrRestrictedXML.Error())
+	require.Equal(t, "restricted-xml", ErrRestrictedXML.Element().Elements().All()[0].Name())
+
 	require.Equal(t, "invalid-namespace", ErrInvalidNamespace.Error())
 	require.Equal(t, "invalid-namespace", ErrInvalidNamespace.Element().Elements().All()[0].Name())
 
@@ -24,6 +30,9 @@ func TestStreamError(t *testing.T) {
 	require.Equal(t, "invalid-from", ErrInvalidFrom.Error())
 	require.Equal(t, "invalid-from", ErrInvalidFrom.Element().Elements().All()[0].Name())
 
+	require.Equal(t, "improper-addressing", ErrImproperAddressing.Error())
+	require.Equal(t, "improper-addressing", ErrImproperAddressing.Element().Elements().All()[0].Name())
+
 	require.Equal(t, "connection-timeout", ErrConnectionTimeout.Error())
 	require.Equal(t, "connection-timeout", ErrConnectionTimeout.Element().Elements().All()[0].Name())
 
@@ -36,9 +45,23 @@ func TestStreamError(t *testing.T) {
 	require.Equal(t, "not-authorized", ErrNotAuthorized.Error())
 	require.Equal(t, "not-authorized", ErrNotAuthorized.Element().Elements().All()[0].Name())
 
+	require.Equal(t, "conflict", ErrConflict.Error())
+	require.Equal(t, "conflict", ErrConflict.Element().Elements().All()[0].Name())
+
 	require.Equal(t, "resource-constraint", ErrResourceConstraint.Error())
 	require.Equal(t, "resource-constraint", ErrResourceConstraint.Element().Elements().All()[0].Name())
 
 	require.Equal(t, "internal-server-error", ErrInternalServerError.Error())
 	require.Equal(t, "internal-server-error", ErrInternalServerError.Element().Elements().All()[0].Name())
+
+	require.Equal(t, "undefined-condition", ErrUndefinedCondition.Error())
+	require.Equal(t, "undefined-condition", ErrUndefinedCondition.Element().Elements().All()[0].Name())
+
+	require.Equal(t, "system-shutdown", ErrSystemShutdown.Error())
+	require.Equal(t, "system-shutdown", ErrSystemShutdown.Element().Elements().All()[0].Name())
+
+	seeOtherHost := NewSeeOtherHostError("xmpp2.jackal.im:5222")
+	require.Equal(t, "see-other-host", seeOtherHost.Error())
+	require.Equal(t, "see-other-host", seeOtherHost.Element().Elements().All()[0].Name())
+	require.Equal(t, "xmpp2.jackal.im:5222", seeOtherHost.Element().Elements().All()[0].Text())
 }
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+import "time"
+
+const (
+	defaultMaxDials   = 4
+	defaultMaxBackoff = time.Minute * 5
+)
+
+// initialDialBackoff is the time a remote domain is considered
+// unreachable after its first connection failure, doubled on every
+// consecutive failure until reaching the configured maximum.
+const initialDialBackoff = time.Second
+
+// Config represents a server-to-server manager configuration.
+type Config struct {
+	DialbackSecret string
+	MaxDials       int
+	MaxBackoff     time.Duration
+
+	// Filter restricts the remote domains every local domain federates with.
+	Filter DomainFilter
+
+	// HostFilters overrides Filter for specific local domains.
+	HostFilters map[string]DomainFilter
+}
+
+func (c *Config) maxDials() int {
+	if c.MaxDials > 0 {
+		return c.MaxDials
+	}
+	return defaultMaxDials
+}
+
+func (c *Config) filter(localDomain string) *DomainFilter {
+	if f, ok := c.HostFilters[localDomain]; ok {
+		return &f
+	}
+	return &c.Filter
+}
+
+func (c *Config) maxBackoff() time.Duration {
+	if c.MaxBackoff > 0 {
+		return c.MaxBackoff
+	}
+	return defaultMaxBackoff
+}
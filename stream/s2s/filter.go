@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DomainFilter restricts the remote domains a local domain federates with.
+// Patterns are either a domain name or a wildcard matching every
+// subdomain of a given one (e.g. '*.example.com').
+type DomainFilter struct {
+	// Allow contains the only remote domains allowed to federate with, if not empty.
+	Allow []string `yaml:"allow"`
+
+	// Deny contains the remote domains never allowed to federate with.
+	// Denied domains take precedence over allowed ones.
+	Deny []string `yaml:"deny"`
+}
+
+// IsEmpty returns whether or not the filter allows every remote domain.
+func (f *DomainFilter) IsEmpty() bool {
+	return len(f.Allow) == 0 && len(f.Deny) == 0
+}
+
+// Validate checks the filter domain patterns.
+func (f *DomainFilter) Validate() error {
+	for _, patterns := range [][]string{f.Allow, f.Deny} {
+		for _, pattern := range patterns {
+			if !isValidDomainPattern(pattern) {
+				return fmt.Errorf("s2s: invalid domain pattern: %s", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Allows returns whether or not the filter allows federating with a remote domain.
+func (f *DomainFilter) Allows(domain string) bool {
+	domain = strings.ToLower(domain)
+	if matchesDomainPatterns(domain, f.Deny) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchesDomainPatterns(domain, f.Allow)
+}
+
+func matchesDomainPatterns(domain string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(domain, pattern[1:]) {
+				return true
+			}
+		} else if domain == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidDomainPattern(pattern string) bool {
+	domain := strings.TrimPrefix(pattern, "*.")
+	return len(domain) > 0 && !strings.ContainsAny(domain, "*@/ ")
+}
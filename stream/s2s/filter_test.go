@@ -0,0 +1,47 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainFilter_Validate(t *testing.T) {
+	require.Nil(t, (&DomainFilter{Allow: []string{"example.org", "*.example.com"}}).Validate())
+	require.NotNil(t, (&DomainFilter{Allow: []string{""}}).Validate())
+	require.NotNil(t, (&DomainFilter{Deny: []string{"*"}}).Validate())
+	require.NotNil(t, (&DomainFilter{Deny: []string{"a.*.example.com"}}).Validate())
+	require.NotNil(t, (&DomainFilter{Deny: []string{"romeo@example.com"}}).Validate())
+}
+
+func TestDomainFilter_AllowOnly(t *testing.T) {
+	f := &DomainFilter{Allow: []string{"example.org", "*.example.com"}}
+	require.True(t, f.Allows("example.org"))
+	require.True(t, f.Allows("EXAMPLE.ORG"))
+	require.True(t, f.Allows("chat.example.com"))
+	require.True(t, f.Allows("muc.chat.example.com"))
+	require.False(t, f.Allows("example.com"))
+	require.False(t, f.Allows("badexample.com"))
+	require.False(t, f.Allows("example.net"))
+}
+
+func TestDomainFilter_Deny(t *testing.T) {
+	f := &DomainFilter{Deny: []string{"*.spam.org", "example.net"}}
+	require.False(t, f.IsEmpty())
+	require.True(t, f.Allows("example.org"))
+	require.False(t, f.Allows("example.net"))
+	require.False(t, f.Allows("a.spam.org"))
+	require.True(t, f.Allows("spam.org"))
+
+	// denied domains take precedence
+	f = &DomainFilter{Allow: []string{"*.example.com"}, Deny: []string{"evil.example.com"}}
+	require.True(t, f.Allows("chat.example.com"))
+	require.False(t, f.Allows("evil.example.com"))
+
+	require.True(t, (&DomainFilter{}).Allows("example.org"))
+}
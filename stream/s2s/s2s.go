@@ -0,0 +1,337 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/metrics"
+	"github.com/ortuman/jackal/util"
+	"github.com/ortuman/jackal/xml"
+)
+
+// ErrRemoteServerNotFound will be returned by Route method
+// if remote server connection recently failed and it's not
+// going to be dialed again until its backoff period expires.
+var ErrRemoteServerNotFound = errors.New("s2s: remote server not found")
+
+// ErrRemoteDomainNotAllowed will be returned by Route method
+// if the local domain is not allowed to federate with remote one.
+var ErrRemoteDomainNotAllowed = errors.New("s2s: remote domain not allowed")
+
+// Stream represents a server-to-server XMPP stream.
+type Stream interface {
+	ID() string
+	Disconnect(err error)
+}
+
+// OutStream represents an outgoing server-to-server XMPP stream.
+type OutStream interface {
+	Stream
+	SendElement(element xml.XElement)
+}
+
+// NewOutStreamFunc creates a not yet connected outgoing stream
+// between a local and a remote domain.
+type NewOutStreamFunc func(localDomain, remoteDomain string) OutStream
+
+// Manager manages the local server established s2s streams.
+type Manager struct {
+	cfg          *Config
+	newOutStream NewOutStreamFunc
+	lock         sync.RWMutex
+	inStms       map[string]Stream
+	outStms      map[string]OutStream
+	dialMu       sync.Mutex
+	dialSems     map[string]*dialSemaphore
+	backoffs     map[string]*dialBackoff
+	iqsMu        sync.Mutex
+	iqs          map[string]*trackedIQ
+}
+
+type trackedIQ struct {
+	remoteDomain string
+	handler      func(iq *xml.IQ)
+}
+
+type dialSemaphore struct {
+	ch   chan struct{}
+	refs int
+}
+
+type dialBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// singleton interface
+var (
+	inst        *Manager
+	instMu      sync.RWMutex
+	initialized uint32
+)
+
+// Initialize initializes the s2s manager.
+// An empty dialback secret is replaced by a random one.
+func Initialize(cfg *Config, newOutStream NewOutStreamFunc) {
+	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		c := *cfg
+		if len(c.DialbackSecret) == 0 {
+			c.DialbackSecret = hex.EncodeToString(util.RandomBytes(32))
+		}
+		inst = &Manager{
+			cfg:          &c,
+			newOutStream: newOutStream,
+			inStms:       make(map[string]Stream),
+			outStms:      make(map[string]OutStream),
+			dialSems:     make(map[string]*dialSemaphore),
+			backoffs:     make(map[string]*dialBackoff),
+			iqs:          make(map[string]*trackedIQ),
+		}
+	}
+}
+
+// Enabled returns whether or not server-to-server
+// communication has been initialized.
+func Enabled() bool {
+	return atomic.LoadUint32(&initialized) == 1
+}
+
+// Instance returns the s2s manager instance.
+func Instance() *Manager {
+	instMu.RLock()
+	defer instMu.RUnlock()
+
+	if inst == nil {
+		log.Fatalf("s2s manager not initialized")
+	}
+	return inst
+}
+
+// Shutdown disconnects every s2s stream and shuts down s2s manager system.
+func Shutdown() {
+	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		inst.lock.RLock()
+		for _, stm := range inst.inStms {
+			stm.Disconnect(nil)
+		}
+		for _, stm := range inst.outStms {
+			stm.Disconnect(nil)
+		}
+		inst.lock.RUnlock()
+		inst = nil
+	}
+}
+
+// DialbackKey generates a dialback key for a given stream.
+// (https://xmpp.org/extensions/xep-0185.html)
+func (m *Manager) DialbackKey(receivingDomain, originatingDomain, streamID string) string {
+	secretHash := sha256.Sum256([]byte(m.cfg.DialbackSecret))
+	h := hmac.New(sha256.New, []byte(hex.EncodeToString(secretHash[:])))
+	h.Write([]byte(receivingDomain + " " + originatingDomain + " " + streamID))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// IsAllowedDomain returns whether or not a local domain is allowed
+// to federate with a remote one.
+func (m *Manager) IsAllowedDomain(localDomain, remoteDomain string) bool {
+	return m.cfg.filter(localDomain).Allows(remoteDomain)
+}
+
+// RegisterInStream registers an incoming s2s stream.
+func (m *Manager) RegisterInStream(stm Stream) {
+	m.lock.Lock()
+	m.inStms[stm.ID()] = stm
+	m.lock.Unlock()
+	metrics.S2SStreams.Inc()
+	log.Infof("registered s2s in stream... (id: %s)", stm.ID())
+}
+
+// UnregisterInStream unregisters a previously registered incoming s2s stream.
+func (m *Manager) UnregisterInStream(stm Stream) {
+	m.lock.Lock()
+	if _, ok := m.inStms[stm.ID()]; !ok {
+		m.lock.Unlock()
+		return
+	}
+	delete(m.inStms, stm.ID())
+	m.lock.Unlock()
+	metrics.S2SStreams.Dec()
+	log.Infof("unregistered s2s in stream... (id: %s)", stm.ID())
+}
+
+// UnregisterOutStream unregisters an outgoing s2s stream,
+// forcing a new connection to be established on next routing.
+func (m *Manager) UnregisterOutStream(localDomain, remoteDomain string, stm OutStream) {
+	key := outStreamKey(localDomain, remoteDomain)
+	m.lock.Lock()
+	if m.outStms[key] != stm {
+		m.lock.Unlock()
+		return
+	}
+	delete(m.outStms, key)
+	m.lock.Unlock()
+	metrics.S2SStreams.Dec()
+	log.Infof("unregistered s2s out stream... (%s -> %s)", localDomain, remoteDomain)
+}
+
+// Route routes a stanza to a remote server, reusing an already
+// established outgoing stream or establishing a new one otherwise.
+func (m *Manager) Route(stanza xml.Stanza) error {
+	localDomain := stanza.FromJID().Domain()
+	remoteDomain := stanza.ToJID().Domain()
+	if !m.IsAllowedDomain(localDomain, remoteDomain) {
+		log.Warnf("s2s: %s not allowed to federate with %s... discarding stanza", localDomain, remoteDomain)
+		return ErrRemoteDomainNotAllowed
+	}
+	stm := m.outStream(localDomain, remoteDomain)
+	if stm == nil {
+		return ErrRemoteServerNotFound
+	}
+	stm.SendElement(stanza)
+	return nil
+}
+
+// TrackIQ registers the handler of a response to an IQ sent to a remote
+// domain. As responses are received over incoming streams, they must be
+// handed over through ResolveIQ.
+func (m *Manager) TrackIQ(id, remoteDomain string, handler func(iq *xml.IQ)) {
+	m.iqsMu.Lock()
+	m.iqs[id] = &trackedIQ{remoteDomain: remoteDomain, handler: handler}
+	m.iqsMu.Unlock()
+}
+
+// UntrackIQ discards a previously tracked IQ response handler.
+func (m *Manager) UntrackIQ(id string) {
+	m.iqsMu.Lock()
+	delete(m.iqs, id)
+	m.iqsMu.Unlock()
+}
+
+// ResolveIQ routes a result or error IQ received from a remote domain
+// to its tracked handler, returning false if it's not a response
+// to a tracked IQ.
+func (m *Manager) ResolveIQ(iq *xml.IQ) bool {
+	if !iq.IsResult() && iq.Type() != xml.ErrorType {
+		return false
+	}
+	m.iqsMu.Lock()
+	t := m.iqs[iq.ID()]
+	if t == nil || t.remoteDomain != iq.FromJID().Domain() {
+		m.iqsMu.Unlock()
+		return false
+	}
+	delete(m.iqs, iq.ID())
+	m.iqsMu.Unlock()
+
+	t.handler(iq)
+	return true
+}
+
+// AcquireDial blocks until a new connection against a remote domain
+// can be dialed, limiting the number of concurrent dials per domain.
+// Returned function must be called once dial has finished.
+func (m *Manager) AcquireDial(remoteDomain string) (release func()) {
+	m.dialMu.Lock()
+	sem := m.dialSems[remoteDomain]
+	if sem == nil {
+		sem = &dialSemaphore{ch: make(chan struct{}, m.cfg.maxDials())}
+		m.dialSems[remoteDomain] = sem
+	}
+	sem.refs++
+	m.dialMu.Unlock()
+
+	sem.ch <- struct{}{}
+	return func() {
+		<-sem.ch
+		m.dialMu.Lock()
+		sem.refs--
+		if sem.refs == 0 {
+			delete(m.dialSems, remoteDomain)
+		}
+		m.dialMu.Unlock()
+	}
+}
+
+// ReportConnectionFailure notifies that an outgoing stream against
+// a remote domain could not be established, preventing it from
+// being dialed again until its backoff period expires.
+func (m *Manager) ReportConnectionFailure(remoteDomain string) {
+	m.dialMu.Lock()
+	defer m.dialMu.Unlock()
+
+	b := m.backoffs[remoteDomain]
+	if b == nil {
+		b = &dialBackoff{}
+		m.backoffs[remoteDomain] = b
+	}
+	b.failures++
+
+	maxBackoff := m.cfg.maxBackoff()
+	backoff := maxBackoff
+	if b.failures < 32 {
+		if d := initialDialBackoff << uint(b.failures-1); d < maxBackoff {
+			backoff = d
+		}
+	}
+	b.until = time.Now().Add(backoff)
+	log.Infof("s2s connection to %s failed... backing off for %v", remoteDomain, backoff)
+}
+
+// ReportConnectionSuccess notifies that an outgoing stream against
+// a remote domain has been established, resetting its backoff.
+func (m *Manager) ReportConnectionSuccess(remoteDomain string) {
+	m.dialMu.Lock()
+	delete(m.backoffs, remoteDomain)
+	m.dialMu.Unlock()
+}
+
+func (m *Manager) isBackingOff(remoteDomain string) bool {
+	m.dialMu.Lock()
+	defer m.dialMu.Unlock()
+	b := m.backoffs[remoteDomain]
+	return b != nil && time.Now().Before(b.until)
+}
+
+func (m *Manager) outStream(localDomain, remoteDomain string) OutStream {
+	key := outStreamKey(localDomain, remoteDomain)
+	m.lock.RLock()
+	stm := m.outStms[key]
+	m.lock.RUnlock()
+	if stm != nil {
+		return stm
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if stm := m.outStms[key]; stm != nil {
+		return stm // registered in the meantime...
+	}
+	if m.isBackingOff(remoteDomain) {
+		return nil
+	}
+	stm = m.newOutStream(localDomain, remoteDomain)
+	m.outStms[key] = stm
+	metrics.S2SStreams.Inc()
+	log.Infof("registered s2s out stream... (%s -> %s)", localDomain, remoteDomain)
+	return stm
+}
+
+func outStreamKey(localDomain, remoteDomain string) string {
+	return localDomain + ":" + remoteDomain
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package s2s
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeOutStream struct {
+	mu           sync.Mutex
+	id           string
+	elems        []xml.XElement
+	disconnected bool
+}
+
+func (f *fakeOutStream) ID() string { return f.id }
+
+func (f *fakeOutStream) SendElement(elem xml.XElement) {
+	f.mu.Lock()
+	f.elems = append(f.elems, elem)
+	f.mu.Unlock()
+}
+
+func (f *fakeOutStream) Disconnect(err error) {
+	f.mu.Lock()
+	f.disconnected = true
+	f.mu.Unlock()
+}
+
+func TestS2SManager_DialbackKey(t *testing.T) {
+	Initialize(&Config{DialbackSecret: "s3cr3tf0rd14lb4ck"}, nil)
+	defer Shutdown()
+
+	require.True(t, Enabled())
+
+	// HEX(HMAC-SHA256(HEX(SHA256(secret)), receiving + ' ' + originating + ' ' + id))
+	key := Instance().DialbackKey("example.org", "example.com", "D60000229F")
+	require.Equal(t, "28689a642f96dd0cdac4b72a0cd805bbbd6a9b46f44064a6c52e43239d19954d", key)
+
+	require.NotEqual(t, key, Instance().DialbackKey("example.org", "example.com", "D60000229E"))
+	require.NotEqual(t, key, Instance().DialbackKey("example.com", "example.org", "D60000229F"))
+}
+
+func TestS2SManager_Route(t *testing.T) {
+	var stms []*fakeOutStream
+	Initialize(&Config{}, func(localDomain, remoteDomain string) OutStream {
+		stm := &fakeOutStream{id: localDomain + "->" + remoteDomain}
+		stms = append(stms, stm)
+		return stm
+	})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("juliet@example.org/garden", false)
+	j3, _ := xml.NewJIDString("romeo@example.net/garden", false)
+
+	require.Nil(t, Instance().Route(tUtilMessage(j1, j2)))
+	require.Nil(t, Instance().Route(tUtilMessage(j1, j2)))
+	require.Equal(t, 1, len(stms))
+	require.Equal(t, 2, len(stms[0].elems))
+
+	require.Nil(t, Instance().Route(tUtilMessage(j1, j3)))
+	require.Equal(t, 2, len(stms))
+	require.Equal(t, "jackal.im->example.net", stms[1].ID())
+
+	// unregistered streams are established again
+	Instance().UnregisterOutStream("jackal.im", "example.org", stms[0])
+	require.Nil(t, Instance().Route(tUtilMessage(j1, j2)))
+	require.Equal(t, 3, len(stms))
+
+	in := &fakeOutStream{id: "in-1"}
+	Instance().RegisterInStream(in)
+
+	Shutdown()
+	require.False(t, Enabled())
+	require.True(t, in.disconnected)
+	require.True(t, stms[1].disconnected)
+	require.True(t, stms[2].disconnected)
+}
+
+func TestS2SManager_DomainFilter(t *testing.T) {
+	var stms []*fakeOutStream
+	cfg := &Config{
+		Filter:      DomainFilter{Deny: []string{"example.net"}},
+		HostFilters: map[string]DomainFilter{"jabber.org": {Allow: []string{"example.net"}}},
+	}
+	Initialize(cfg, func(localDomain, remoteDomain string) OutStream {
+		stm := &fakeOutStream{id: localDomain + "->" + remoteDomain}
+		stms = append(stms, stm)
+		return stm
+	})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("noelia@jabber.org/yard", false)
+	j3, _ := xml.NewJIDString("juliet@example.org/garden", false)
+	j4, _ := xml.NewJIDString("romeo@example.net/garden", false)
+
+	require.True(t, Instance().IsAllowedDomain("jackal.im", "example.org"))
+	require.False(t, Instance().IsAllowedDomain("jackal.im", "example.net"))
+	require.True(t, Instance().IsAllowedDomain("jabber.org", "example.net"))
+	require.False(t, Instance().IsAllowedDomain("jabber.org", "example.org"))
+
+	require.Nil(t, Instance().Route(tUtilMessage(j1, j3)))
+	require.Equal(t, ErrRemoteDomainNotAllowed, Instance().Route(tUtilMessage(j1, j4)))
+	require.Nil(t, Instance().Route(tUtilMessage(j2, j4)))
+	require.Equal(t, ErrRemoteDomainNotAllowed, Instance().Route(tUtilMessage(j2, j3)))
+
+	// denied domains are never dialed
+	require.Equal(t, 2, len(stms))
+	require.Equal(t, "jackal.im->example.org", stms[0].ID())
+	require.Equal(t, "jabber.org->example.net", stms[1].ID())
+}
+
+func TestS2SManager_Backoff(t *testing.T) {
+	var stms []*fakeOutStream
+	Initialize(&Config{MaxBackoff: time.Millisecond * 100}, func(localDomain, remoteDomain string) OutStream {
+		stm := &fakeOutStream{id: localDomain + "->" + remoteDomain}
+		stms = append(stms, stm)
+		return stm
+	})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("juliet@example.org/garden", false)
+
+	require.Nil(t, Instance().Route(tUtilMessage(j1, j2)))
+
+	// connection failed...
+	Instance().ReportConnectionFailure("example.org")
+	Instance().UnregisterOutStream("jackal.im", "example.org", stms[0])
+
+	require.Equal(t, ErrRemoteServerNotFound, Instance().Route(tUtilMessage(j1, j2)))
+	require.Equal(t, 1, len(stms))
+
+	time.Sleep(time.Millisecond * 150) // wait until backoff expires
+
+	require.Nil(t, Instance().Route(tUtilMessage(j1, j2)))
+	require.Equal(t, 2, len(stms))
+
+	Instance().ReportConnectionSuccess("example.org")
+	require.Nil(t, Instance().Route(tUtilMessage(j1, j2)))
+	require.Equal(t, 2, len(stms))
+}
+
+func TestS2SManager_AcquireDial(t *testing.T) {
+	Initialize(&Config{MaxDials: 2}, nil)
+	defer Shutdown()
+
+	r1 := Instance().AcquireDial("example.org")
+	r2 := Instance().AcquireDial("example.org")
+
+	// other domains are not affected by the limit
+	Instance().AcquireDial("example.net")()
+
+	acquiredCh := make(chan struct{})
+	go func() {
+		Instance().AcquireDial("example.org")()
+		close(acquiredCh)
+	}()
+	select {
+	case <-acquiredCh:
+		require.Fail(t, "max dials limit exceeded")
+	case <-time.After(time.Millisecond * 50):
+		break
+	}
+	r1()
+	select {
+	case <-acquiredCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "dial not acquired")
+	}
+	r2()
+
+	Instance().dialMu.Lock()
+	require.Equal(t, 0, len(Instance().dialSems))
+	Instance().dialMu.Unlock()
+}
+
+func TestS2SManager_TrackIQ(t *testing.T) {
+	Initialize(&Config{}, nil)
+	defer Shutdown()
+
+	var resolved []*xml.IQ
+	Instance().TrackIQ("ping_1", "example.org", func(iq *xml.IQ) { resolved = append(resolved, iq) })
+	Instance().TrackIQ("ping_2", "example.org", func(iq *xml.IQ) { resolved = append(resolved, iq) })
+
+	local, _ := xml.NewJIDString("jackal.im", true)
+	remote, _ := xml.NewJIDString("example.org", true)
+	other, _ := xml.NewJIDString("example.com", true)
+
+	newIQ := func(id, iqType string, from *xml.JID) *xml.IQ {
+		elem := xml.NewIQType(id, iqType)
+		if iqType == xml.GetType {
+			elem.AppendElement(xml.NewElementNamespace("ping", "urn:xmpp:ping"))
+		}
+		iq, _ := xml.NewIQFromElement(elem, from, local)
+		return iq
+	}
+	require.False(t, Instance().ResolveIQ(newIQ("ping_1", xml.GetType, remote)))
+	require.False(t, Instance().ResolveIQ(newIQ("ping_1", xml.ResultType, other))) // not sent to this domain
+	require.True(t, Instance().ResolveIQ(newIQ("ping_1", xml.ResultType, remote)))
+	require.False(t, Instance().ResolveIQ(newIQ("ping_1", xml.ResultType, remote))) // already resolved
+	require.Equal(t, 1, len(resolved))
+
+	Instance().UntrackIQ("ping_2")
+	require.False(t, Instance().ResolveIQ(newIQ("ping_2", xml.ErrorType, remote)))
+	require.Equal(t, 1, len(resolved))
+}
+
+func tUtilMessage(from, to *xml.JID) *xml.Message {
+	msg, _ := xml.NewMessageFromElement(xml.NewElementName("message"), from, to)
+	return msg
+}
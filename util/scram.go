@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ScramIterationsCount is the PBKDF2 iteration count used to derive SCRAM credentials.
+const ScramIterationsCount = 4096
+
+// ScramCredentials represents SCRAM salted credentials as stored
+// along with the user entity, so that plain password is not needed
+// to authenticate. (https://tools.ietf.org/html/rfc5802#section-3)
+type ScramCredentials struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramSHA256Credentials derives SCRAM-SHA-256 credentials
+// from a plain password using a random salt.
+func NewScramSHA256Credentials(password string) *ScramCredentials {
+	c := &ScramCredentials{Iterations: ScramIterationsCount, Salt: RandomBytes(32)}
+	saltedPassword := pbkdf2.Key([]byte(password), c.Salt, c.Iterations, sha256.Size, sha256.New)
+	clientKey := HMACSum(sha256.New, []byte("Client Key"), saltedPassword)
+	c.StoredKey = HashSum(sha256.New, clientKey)
+	c.ServerKey = HMACSum(sha256.New, []byte("Server Key"), saltedPassword)
+	return c
+}
+
+// ParseScramCredentials parses credentials encoded
+// as 'iterations:salt:storedKey:serverKey'.
+func ParseScramCredentials(str string) (*ScramCredentials, error) {
+	sp := strings.Split(str, ":")
+	if len(sp) != 4 {
+		return nil, fmt.Errorf("malformed SCRAM credentials")
+	}
+	var err error
+	c := &ScramCredentials{}
+	if c.Iterations, err = strconv.Atoi(sp[0]); err != nil || c.Iterations <= 0 {
+		return nil, fmt.Errorf("malformed SCRAM credentials iteration count")
+	}
+	if c.Salt, err = base64.StdEncoding.DecodeString(sp[1]); err != nil {
+		return nil, err
+	}
+	if c.StoredKey, err = base64.StdEncoding.DecodeString(sp[2]); err != nil {
+		return nil, err
+	}
+	if c.ServerKey, err = base64.StdEncoding.DecodeString(sp[3]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// String returns the encoded representation of SCRAM credentials.
+func (c *ScramCredentials) String() string {
+	return fmt.Sprintf("%d:%s:%s:%s", c.Iterations,
+		base64.StdEncoding.EncodeToString(c.Salt),
+		base64.StdEncoding.EncodeToString(c.StoredKey),
+		base64.StdEncoding.EncodeToString(c.ServerKey))
+}
+
+// HMACSum returns the HMAC of 'b' keyed by 'key' using hash function 'h'.
+func HMACSum(h func() hash.Hash, b []byte, key []byte) []byte {
+	m := hmac.New(h, key)
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+// HashSum returns the digest of 'b' using hash function 'h'.
+func HashSum(h func() hash.Hash, b []byte) []byte {
+	hs := h()
+	hs.Write(b)
+	return hs.Sum(nil)
+}
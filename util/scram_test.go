@@ -0,0 +1,27 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScramCredentials(t *testing.T) {
+	creds := NewScramSHA256Credentials("1234")
+	require.Equal(t, ScramIterationsCount, creds.Iterations)
+	require.Equal(t, 32, len(creds.Salt))
+
+	parsed, err := ParseScramCredentials(creds.String())
+	require.Nil(t, err)
+	require.Equal(t, creds, parsed)
+
+	_, err = ParseScramCredentials("4096:c2FsdA==")
+	require.NotNil(t, err)
+	_, err = ParseScramCredentials("zero:c2FsdA==:c3RvcmVk:c2VydmVy")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DataFormNamespace represents the XEP-0004 Data Forms namespace.
+const DataFormNamespace = "jabber:x:data"
+
+const (
+	// FormDataFormType represents a 'form' data form type.
+	FormDataFormType = "form"
+
+	// SubmitDataFormType represents a 'submit' data form type.
+	SubmitDataFormType = "submit"
+
+	// CancelDataFormType represents a 'cancel' data form type.
+	CancelDataFormType = "cancel"
+
+	// ResultDataFormType represents a 'result' data form type.
+	ResultDataFormType = "result"
+)
+
+const (
+	// BooleanFieldType represents a 'boolean' data form field type.
+	BooleanFieldType = "boolean"
+
+	// FixedFieldType represents a 'fixed' data form field type.
+	FixedFieldType = "fixed"
+
+	// HiddenFieldType represents a 'hidden' data form field type.
+	HiddenFieldType = "hidden"
+
+	// JIDMultiFieldType represents a 'jid-multi' data form field type.
+	JIDMultiFieldType = "jid-multi"
+
+	// JIDSingleFieldType represents a 'jid-single' data form field type.
+	JIDSingleFieldType = "jid-single"
+
+	// ListMultiFieldType represents a 'list-multi' data form field type.
+	ListMultiFieldType = "list-multi"
+
+	// ListSingleFieldType represents a 'list-single' data form field type.
+	ListSingleFieldType = "list-single"
+
+	// TextMultiFieldType represents a 'text-multi' data form field type.
+	TextMultiFieldType = "text-multi"
+
+	// TextPrivateFieldType represents a 'text-private' data form field type.
+	TextPrivateFieldType = "text-private"
+
+	// TextSingleFieldType represents a 'text-single' data form field type.
+	TextSingleFieldType = "text-single"
+)
+
+// FormTypeFieldVar represents the name of the hidden field identifying a form type.
+const FormTypeFieldVar = "FORM_TYPE"
+
+// DataFormFieldOption represents a list field option.
+type DataFormFieldOption struct {
+	Label string
+	Value string
+}
+
+// DataFormField represents a data form field.
+type DataFormField struct {
+	Var      string
+	Type     string
+	Label    string
+	Required bool
+	Values   []string
+	Options  []DataFormFieldOption
+}
+
+// Value returns field first value, or empty string if no value was provided.
+func (f *DataFormField) Value() string {
+	if len(f.Values) == 0 {
+		return ""
+	}
+	return f.Values[0]
+}
+
+// BoolValue returns field value as a boolean.
+// A missing value stands for false.
+func (f *DataFormField) BoolValue() (bool, error) {
+	switch f.Value() {
+	case "1", "true":
+		return true, nil
+	case "", "0", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean value for field %s: %s", f.Var, f.Value())
+}
+
+// JIDValues returns field values as JIDs.
+func (f *DataFormField) JIDValues() ([]*JID, error) {
+	ret := make([]*JID, 0, len(f.Values))
+	for _, v := range f.Values {
+		j, err := NewJIDString(v, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JID value for field %s: %s", f.Var, v)
+		}
+		ret = append(ret, j)
+	}
+	return ret, nil
+}
+
+// DataForm represents a XEP-0004 data form.
+type DataForm struct {
+	Type         string
+	Title        string
+	Instructions string
+	Fields       []DataFormField
+}
+
+// NewDataForm returns an empty data form of a given type.
+func NewDataForm(formType string) *DataForm {
+	return &DataForm{Type: formType}
+}
+
+// ParseDataForm returns the data form represented by an 'x' element.
+func ParseDataForm(elem XElement) (*DataForm, error) {
+	if elem.Name() != "x" || elem.Namespace() != DataFormNamespace {
+		return nil, fmt.Errorf("wrong data form element: %s", elem.Name())
+	}
+	form := &DataForm{Type: elem.Attributes().Get("type")}
+	switch form.Type {
+	case FormDataFormType, SubmitDataFormType, CancelDataFormType, ResultDataFormType:
+		break
+	default:
+		return nil, fmt.Errorf(`invalid data form "type" attribute: %s`, form.Type)
+	}
+	if title := elem.Elements().Child("title"); title != nil {
+		form.Title = title.Text()
+	}
+	if instructions := elem.Elements().Child("instructions"); instructions != nil {
+		form.Instructions = instructions.Text()
+	}
+	for _, fieldElem := range elem.Elements().Children("field") {
+		field := DataFormField{
+			Var:      fieldElem.Attributes().Get("var"),
+			Type:     fieldElem.Attributes().Get("type"),
+			Label:    fieldElem.Attributes().Get("label"),
+			Required: fieldElem.Elements().Child("required") != nil,
+		}
+		if !isValidFieldType(field.Type) {
+			return nil, fmt.Errorf(`invalid data form field "type" attribute: %s`, field.Type)
+		}
+		if len(field.Var) == 0 && field.Type != FixedFieldType {
+			return nil, errors.New(`data form field "var" attribute is required`)
+		}
+		for _, value := range fieldElem.Elements().Children("value") {
+			field.Values = append(field.Values, value.Text())
+		}
+		if len(field.Values) > 1 && len(field.Type) > 0 && !isMultiValueFieldType(field.Type) {
+			return nil, fmt.Errorf("data form field %s does not allow multiple values", field.Var)
+		}
+		for _, optElem := range fieldElem.Elements().Children("option") {
+			var opt DataFormFieldOption
+			opt.Label = optElem.Attributes().Get("label")
+			if value := optElem.Elements().Child("value"); value != nil {
+				opt.Value = value.Text()
+			}
+			field.Options = append(field.Options, opt)
+		}
+		form.Fields = append(form.Fields, field)
+	}
+	return form, nil
+}
+
+// AddField appends a new field to the data form.
+func (f *DataForm) AddField(field DataFormField) *DataForm {
+	f.Fields = append(f.Fields, field)
+	return f
+}
+
+// Field returns the data form field identified by a given name.
+// A nil value will be returned if no such field exists.
+func (f *DataForm) Field(name string) *DataFormField {
+	for i := range f.Fields {
+		if f.Fields[i].Var == name {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
+// FormType returns the value of the hidden FORM_TYPE field, if any.
+func (f *DataForm) FormType() string {
+	if field := f.Field(FormTypeFieldVar); field != nil {
+		return field.Value()
+	}
+	return ""
+}
+
+// Validate checks a submitted data form against the form it answers,
+// verifying that every required field has been filled in and that
+// provided values are consistent with field types.
+func (f *DataForm) Validate(form *DataForm) error {
+	if f.Type != SubmitDataFormType {
+		return fmt.Errorf("data form of type %s can't be validated", f.Type)
+	}
+	for i := range form.Fields {
+		formField := &form.Fields[i]
+		if formField.Type == FixedFieldType {
+			continue
+		}
+		field := f.Field(formField.Var)
+		if field == nil || len(field.Values) == 0 {
+			if formField.Required {
+				return fmt.Errorf("required data form field %s is missing", formField.Var)
+			}
+			continue
+		}
+		if err := validateFieldValues(field, formField); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Element returns data form element representation.
+func (f *DataForm) Element() XElement {
+	x := NewElementNamespace("x", DataFormNamespace)
+	x.SetAttribute("type", f.Type)
+	if len(f.Title) > 0 {
+		title := NewElementName("title")
+		title.SetText(f.Title)
+		x.AppendElement(title)
+	}
+	if len(f.Instructions) > 0 {
+		instructions := NewElementName("instructions")
+		instructions.SetText(f.Instructions)
+		x.AppendElement(instructions)
+	}
+	for _, field := range f.Fields {
+		fieldElem := NewElementName("field")
+		if len(field.Var) > 0 {
+			fieldElem.SetAttribute("var", field.Var)
+		}
+		if len(field.Type) > 0 {
+			fieldElem.SetAttribute("type", field.Type)
+		}
+		if len(field.Label) > 0 {
+			fieldElem.SetAttribute("label", field.Label)
+		}
+		if field.Required {
+			fieldElem.AppendElement(NewElementName("required"))
+		}
+		for _, v := range field.Values {
+			value := NewElementName("value")
+			value.SetText(v)
+			fieldElem.AppendElement(value)
+		}
+		for _, opt := range field.Options {
+			optElem := NewElementName("option")
+			if len(opt.Label) > 0 {
+				optElem.SetAttribute("label", opt.Label)
+			}
+			value := NewElementName("value")
+			value.SetText(opt.Value)
+			optElem.AppendElement(value)
+			fieldElem.AppendElement(optElem)
+		}
+		x.AppendElement(fieldElem)
+	}
+	return x
+}
+
+func validateFieldValues(field, formField *DataFormField) error {
+	// submitted fields usually omit their type
+	typ := field.Type
+	if len(typ) == 0 {
+		typ = formField.Type
+	}
+	if len(field.Values) > 1 && !isMultiValueFieldType(typ) {
+		return fmt.Errorf("data form field %s does not allow multiple values", field.Var)
+	}
+	switch typ {
+	case BooleanFieldType:
+		_, err := field.BoolValue()
+		return err
+
+	case JIDSingleFieldType, JIDMultiFieldType:
+		_, err := field.JIDValues()
+		return err
+
+	case ListSingleFieldType, ListMultiFieldType:
+		if len(formField.Options) == 0 {
+			return nil
+		}
+		for _, v := range field.Values {
+			if !hasFieldOption(formField, v) {
+				return fmt.Errorf("invalid option for field %s: %s", field.Var, v)
+			}
+		}
+	}
+	return nil
+}
+
+func hasFieldOption(field *DataFormField, value string) bool {
+	for _, opt := range field.Options {
+		if opt.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidFieldType(typ string) bool {
+	switch typ {
+	case "", BooleanFieldType, FixedFieldType, HiddenFieldType, JIDMultiFieldType, JIDSingleFieldType,
+		ListMultiFieldType, ListSingleFieldType, TextMultiFieldType, TextPrivateFieldType, TextSingleFieldType:
+		return true
+	}
+	return false
+}
+
+func isMultiValueFieldType(typ string) bool {
+	switch typ {
+	case JIDMultiFieldType, ListMultiFieldType, TextMultiFieldType, FixedFieldType:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml_test
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataForm_Element(t *testing.T) {
+	form := xml.NewDataForm(xml.FormDataFormType)
+	form.Title = "Room configuration"
+	form.AddField(xml.DataFormField{
+		Var:    xml.FormTypeFieldVar,
+		Type:   xml.HiddenFieldType,
+		Values: []string{"http://jabber.org/protocol/muc#roomconfig"},
+	}).AddField(xml.DataFormField{
+		Var:      "muc#roomconfig_roomname",
+		Type:     xml.TextSingleFieldType,
+		Label:    "Room name",
+		Required: true,
+	}).AddField(xml.DataFormField{
+		Var:     "muc#roomconfig_whois",
+		Type:    xml.ListSingleFieldType,
+		Values:  []string{"moderators"},
+		Options: []xml.DataFormFieldOption{{Label: "Moderators", Value: "moderators"}, {Label: "Anyone", Value: "anyone"}},
+	})
+
+	elem := form.Element()
+	require.Equal(t, "x", elem.Name())
+	require.Equal(t, xml.DataFormNamespace, elem.Namespace())
+	require.Equal(t, xml.FormDataFormType, elem.Attributes().Get("type"))
+	require.Equal(t, "Room configuration", elem.Elements().Child("title").Text())
+
+	fields := elem.Elements().Children("field")
+	require.Equal(t, 3, len(fields))
+	require.NotNil(t, fields[1].Elements().Child("required"))
+	require.Equal(t, 2, len(fields[2].Elements().Children("option")))
+
+	// round trip
+	parsed, err := xml.ParseDataForm(elem)
+	require.Nil(t, err)
+	require.Equal(t, form, parsed)
+	require.Equal(t, "http://jabber.org/protocol/muc#roomconfig", parsed.FormType())
+}
+
+func TestDataForm_Parse(t *testing.T) {
+	_, err := xml.ParseDataForm(xml.NewElementNamespace("x", "jabber:x:oob"))
+	require.NotNil(t, err)
+
+	// invalid form type
+	x := xml.NewElementNamespace("x", xml.DataFormNamespace)
+	x.SetAttribute("type", "draft")
+	_, err = xml.ParseDataForm(x)
+	require.NotNil(t, err)
+
+	// invalid field type
+	x.SetAttribute("type", xml.SubmitDataFormType)
+	x.AppendElement(tUtilDataFormField("a", "text-large"))
+	_, err = xml.ParseDataForm(x)
+	require.NotNil(t, err)
+
+	// missing field var
+	x.ClearElements()
+	x.AppendElement(tUtilDataFormField("", xml.TextSingleFieldType))
+	_, err = xml.ParseDataForm(x)
+	require.NotNil(t, err)
+
+	// multiple values on a single value field
+	x.ClearElements()
+	x.AppendElement(tUtilDataFormField("a", xml.TextSingleFieldType, "1", "2"))
+	_, err = xml.ParseDataForm(x)
+	require.NotNil(t, err)
+
+	// value extraction
+	x.ClearElements()
+	x.AppendElement(tUtilDataFormField("public", xml.BooleanFieldType, "1"))
+	x.AppendElement(tUtilDataFormField("admins", xml.JIDMultiFieldType, "ortuman@jackal.im", "romeo@jackal.im"))
+	x.AppendElement(tUtilDataFormField("name", "", "Balcony"))
+	form, err := xml.ParseDataForm(x)
+	require.Nil(t, err)
+	require.Equal(t, xml.SubmitDataFormType, form.Type)
+	require.Equal(t, "", form.FormType())
+	require.Nil(t, form.Field("description"))
+
+	public, err := form.Field("public").BoolValue()
+	require.Nil(t, err)
+	require.True(t, public)
+
+	admins, err := form.Field("admins").JIDValues()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(admins))
+	require.Equal(t, "romeo@jackal.im", admins[1].String())
+
+	require.Equal(t, "Balcony", form.Field("name").Value())
+}
+
+func TestDataForm_Validate(t *testing.T) {
+	form := xml.NewDataForm(xml.FormDataFormType)
+	form.AddField(xml.DataFormField{Var: "instructions", Type: xml.FixedFieldType, Values: []string{"Fill in"}})
+	form.AddField(xml.DataFormField{Var: "name", Type: xml.TextSingleFieldType, Required: true})
+	form.AddField(xml.DataFormField{Var: "public", Type: xml.BooleanFieldType})
+	form.AddField(xml.DataFormField{Var: "owner", Type: xml.JIDSingleFieldType})
+	form.AddField(xml.DataFormField{
+		Var:     "whois",
+		Type:    xml.ListSingleFieldType,
+		Options: []xml.DataFormFieldOption{{Value: "moderators"}, {Value: "anyone"}},
+	})
+
+	// only submitted forms can be validated
+	require.NotNil(t, form.Validate(form))
+
+	submit := func(fields ...xml.DataFormField) *xml.DataForm {
+		f := xml.NewDataForm(xml.SubmitDataFormType)
+		for _, field := range fields {
+			f.AddField(field)
+		}
+		return f
+	}
+	// required field
+	require.NotNil(t, submit().Validate(form))
+	require.NotNil(t, submit(xml.DataFormField{Var: "name"}).Validate(form))
+	require.Nil(t, submit(xml.DataFormField{Var: "name", Values: []string{"Balcony"}}).Validate(form))
+
+	name := xml.DataFormField{Var: "name", Values: []string{"Balcony"}}
+
+	// field types are taken from the original form
+	require.NotNil(t, submit(name, xml.DataFormField{Var: "public", Values: []string{"yes"}}).Validate(form))
+	require.Nil(t, submit(name, xml.DataFormField{Var: "public", Values: []string{"true"}}).Validate(form))
+
+	require.NotNil(t, submit(name, xml.DataFormField{Var: "owner", Values: []string{"ortuman@"}}).Validate(form))
+	require.NotNil(t, submit(name, xml.DataFormField{Var: "owner", Values: []string{"ortuman@jackal.im", "romeo@jackal.im"}}).Validate(form))
+	require.Nil(t, submit(name, xml.DataFormField{Var: "owner", Values: []string{"ortuman@jackal.im"}}).Validate(form))
+
+	require.NotNil(t, submit(name, xml.DataFormField{Var: "whois", Values: []string{"nobody"}}).Validate(form))
+	require.Nil(t, submit(name, xml.DataFormField{Var: "whois", Values: []string{"anyone"}}).Validate(form))
+}
+
+func tUtilDataFormField(name, typ string, values ...string) xml.XElement {
+	field := xml.NewElementName("field")
+	if len(name) > 0 {
+		field.SetAttribute("var", name)
+	}
+	if len(typ) > 0 {
+		field.SetAttribute("type", typ)
+	}
+	for _, v := range values {
+		value := xml.NewElementName("value")
+		value.SetText(v)
+		field.AppendElement(value)
+	}
+	return field
+}
@@ -11,19 +11,30 @@ import (
 
 const (
 	delayNamespace = "urn:xmpp:delay"
+	delayLayout    = "2006-01-02T15:04:05Z"
 )
 
-// Delay attaches element's Delayed Delivery information.
-func (e *Element) Delay(from string, text string) {
+// NewDelay creates a Delayed Delivery (XEP-0203) element
+// stamped at a given time.
+func NewDelay(from string, stamp time.Time, text string) *Element {
 	d := NewElementNamespace("delay", delayNamespace)
 	if len(from) > 0 {
 		d.SetAttribute("from", from)
 	}
-	t := time.Now()
-	d.SetAttribute("stamp", t.Format("2006-01-02T15:04:05Z"))
+	d.SetAttribute("stamp", stamp.UTC().Format(delayLayout))
 
 	if len(text) > 0 {
 		d.SetText(text)
 	}
-	e.AppendElement(d)
+	return d
+}
+
+// Delay attaches element's Delayed Delivery information.
+// An element already carrying a delay is left untouched
+// in order to preserve the original sending time.
+func (e *Element) Delay(from string, text string) {
+	if e.elements.ChildNamespace("delay", delayNamespace) != nil {
+		return
+	}
+	e.AppendElement(NewDelay(from, time.Now(), text))
 }
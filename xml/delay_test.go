@@ -7,6 +7,7 @@ package xml_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/xml"
 	"github.com/stretchr/testify/require"
@@ -17,6 +18,20 @@ func TestDelay(t *testing.T) {
 	e.Delay("example.org", "any text")
 	delay := e.Elements().Child("delay")
 	require.NotNil(t, delay)
+	require.Equal(t, "urn:xmpp:delay", delay.Namespace())
 	require.Equal(t, "example.org", delay.Attributes().Get("from"))
 	require.Equal(t, "any text", delay.Text())
+
+	// already delayed elements are not stamped twice
+	e.Delay("jackal.im", "")
+	require.Equal(t, 1, len(e.Elements().Children("delay")))
+	require.Equal(t, "example.org", e.Elements().Child("delay").Attributes().Get("from"))
+}
+
+func TestNewDelay(t *testing.T) {
+	loc := time.FixedZone("CEST", 2*60*60)
+	d := xml.NewDelay("", time.Date(2018, 6, 1, 12, 30, 0, 0, loc), "")
+	require.Equal(t, "2018-06-01T10:30:00Z", d.Attributes().Get("stamp"))
+	require.Equal(t, "", d.Attributes().Get("from"))
+	require.Equal(t, "", d.Text())
 }
@@ -63,6 +63,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -80,6 +82,8 @@ const (
 	JIDMatchesResource = JIDMatchingOptions(4)
 )
 
+var prepCache = newJIDCache(jidCacheSize)
+
 // JID represents an XMPP address (JID).
 // A JID is made up of a node (generally a username), a domain, and a resource.
 // The node and resource are optional; domain is required.
@@ -91,6 +95,7 @@ type JID struct {
 
 // NewJID constructs a JID given a user, domain, and resource.
 // This construction allows the caller to specify if stringprep should be applied or not.
+// Stringprep results are cached, as normalization is fairly expensive.
 func NewJID(node, domain, resource string, skipStringPrep bool) (*JID, error) {
 	if skipStringPrep {
 		return &JID{
@@ -99,6 +104,16 @@ func NewJID(node, domain, resource string, skipStringPrep bool) (*JID, error) {
 			resource: resource,
 		}, nil
 	}
+	// NUL characters are never allowed, so they can safely separate cache key parts
+	key := node + "\x00" + domain + "\x00" + resource
+	if j := prepCache.get(key); j != nil {
+		return j, nil
+	}
+	for _, part := range []string{node, domain, resource} {
+		if err := validateJIDPart(part); err != nil {
+			return nil, err
+		}
+	}
 	prepNode, err := nodeprep(node)
 	if err != nil {
 		return nil, err
@@ -111,11 +126,13 @@ func NewJID(node, domain, resource string, skipStringPrep bool) (*JID, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &JID{
+	j := &JID{
 		node:     prepNode,
 		domain:   prepDomain,
 		resource: prepResource,
-	}, nil
+	}
+	prepCache.put(key, j)
+	return j, nil
 }
 
 // NewJIDString constructs a JID from it's string representation.
@@ -126,35 +143,20 @@ func NewJIDString(str string, skipStringPrep bool) (*JID, error) {
 	}
 	var node, domain, resource string
 
-	atIndex := strings.Index(str, "@")
-	slashIndex := strings.Index(str, "/")
-
-	// node
-	if atIndex > 0 {
-		node = str[0:atIndex]
-	}
-
-	// domain
-	if atIndex+1 == len(str) {
-		return nil, errors.New("JID with empty domain not valid")
+	// resource is delimited by the first slash, so that
+	// it's allowed to contain any '@' or '/' character
+	if slashIndex := strings.Index(str, "/"); slashIndex >= 0 {
+		resource = str[slashIndex+1:]
+		str = str[:slashIndex]
 	}
-	if atIndex < 0 {
-		if slashIndex > 0 {
-			domain = str[0:slashIndex]
-		} else {
-			domain = str
-		}
+	if atIndex := strings.Index(str, "@"); atIndex >= 0 {
+		node = str[:atIndex]
+		domain = str[atIndex+1:]
 	} else {
-		if slashIndex > 0 {
-			domain = str[atIndex+1 : slashIndex]
-		} else {
-			domain = str[atIndex+1:]
-		}
+		domain = str
 	}
-
-	// resource
-	if slashIndex > 0 && slashIndex+1 < len(str) {
-		resource = str[slashIndex+1:]
+	if len(domain) == 0 {
+		return nil, errors.New("JID with empty domain not valid")
 	}
 	return NewJID(node, domain, resource, skipStringPrep)
 }
@@ -237,6 +239,21 @@ func (j *JID) String() string {
 	return buf.String()
 }
 
+// validateJIDPart rejects input that can't be safely handed to stringprep,
+// such as malformed UTF-8 or control characters, NUL included, which would
+// otherwise silently truncate the C string.
+func validateJIDPart(in string) error {
+	if !utf8.ValidString(in) {
+		return fmt.Errorf("input is not valid UTF-8: %v", []byte(in))
+	}
+	for _, r := range in {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("input contains a disallowed control character: %U", r)
+		}
+	}
+	return nil
+}
+
 func nodeprep(in string) (string, error) {
 	cin := C.CString(in)
 	defer C.free(unsafe.Pointer(cin))
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maximum number of stringprep normalized JIDs kept in memory
+const jidCacheSize = 8192
+
+type jidCacheEntry struct {
+	key string
+	jid JID
+}
+
+// jidCache is a bounded LRU cache of stringprep normalized JIDs,
+// keyed by their raw parts.
+type jidCache struct {
+	mu      sync.Mutex
+	size    int
+	ll      *list.List
+	entries map[string]*list.Element
+}
+
+func newJIDCache(size int) *jidCache {
+	return &jidCache{
+		size:    size,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *jidCache) get(key string) *JID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.ll.MoveToFront(e)
+	j := e.Value.(*jidCacheEntry).jid
+	return &j
+}
+
+func (c *jidCache) put(key string, j *JID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*jidCacheEntry).jid = *j
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&jidCacheEntry{key: key, jid: *j})
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*jidCacheEntry).key)
+	}
+}
+
+func (c *jidCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJIDCache_Eviction(t *testing.T) {
+	c := newJIDCache(2)
+	c.put("a", &JID{node: "a", domain: "jackal.im"})
+	c.put("b", &JID{node: "b", domain: "jackal.im"})
+
+	// touching 'a' makes 'b' the least recently used entry
+	require.Equal(t, "a@jackal.im", c.get("a").String())
+	c.put("c", &JID{node: "c", domain: "jackal.im"})
+
+	require.Equal(t, 2, c.len())
+	require.Nil(t, c.get("b"))
+	require.NotNil(t, c.get("a"))
+	require.NotNil(t, c.get("c"))
+
+	// cached JIDs are handed out as copies
+	j := c.get("a")
+	j.node = "romeo"
+	require.Equal(t, "a", c.get("a").Node())
+}
+
+func TestJIDCache_Concurrency(t *testing.T) {
+	c := newJIDCache(16)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < 1000; k++ {
+				key := fmt.Sprintf("user%d", (i*k)%32)
+				if c.get(key) == nil {
+					c.put(key, &JID{node: key, domain: "jackal.im"})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.True(t, c.len() <= 16)
+}
+
+func TestJIDCache_NewJID(t *testing.T) {
+	j1, err := NewJID("Ortuman", "Jackal.im", "Balcony", false)
+	require.Nil(t, err)
+	require.Equal(t, "ortuman@jackal.im/Balcony", j1.String())
+
+	key := "Ortuman\x00Jackal.im\x00Balcony"
+	require.NotNil(t, prepCache.get(key))
+
+	j2, err := NewJID("Ortuman", "Jackal.im", "Balcony", false)
+	require.Nil(t, err)
+	require.Equal(t, j1, j2)
+	require.False(t, j1 == j2)
+
+	// invalid JIDs are never cached
+	_, err = NewJID("ortuman", "jackal.im", "balcony\x00admin", false)
+	require.NotNil(t, err)
+	require.Nil(t, prepCache.get("ortuman\x00jackal.im\x00balcony\x00admin"))
+}
+
+func BenchmarkNewJIDString_StringPrep(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		nodeprep("ortuman")
+		domainprep("jackal.im")
+		resourceprep("balcony")
+	}
+}
+
+func BenchmarkNewJIDString_Cached(b *testing.B) {
+	NewJIDString("ortuman@jackal.im/balcony", false)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewJIDString("ortuman@jackal.im/balcony", false)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// characters disallowed in a JID node part, along with their escape sequence.
+// (https://xmpp.org/extensions/xep-0106.html#escaping)
+var jidNodeEscapes = map[byte]string{
+	' ':  `\20`,
+	'"':  `\22`,
+	'&':  `\26`,
+	'\'': `\27`,
+	'/':  `\2f`,
+	':':  `\3a`,
+	'<':  `\3c`,
+	'>':  `\3e`,
+	'@':  `\40`,
+	'\\': `\5c`,
+}
+
+var jidNodeUnescapes = map[string]byte{}
+
+func init() {
+	for c, esc := range jidNodeEscapes {
+		jidNodeUnescapes[esc] = c
+	}
+}
+
+// EscapeNode escapes a JID node part according to XEP-0106, so that
+// it can hold those characters otherwise disallowed by nodeprep.
+// A backslash is only escaped if it's followed by an escape sequence,
+// and a node can't either begin or end with a space.
+// (https://xmpp.org/extensions/xep-0106.html)
+func EscapeNode(node string) (string, error) {
+	if strings.HasPrefix(node, " ") || strings.HasSuffix(node, " ") {
+		return "", errors.New("JID node can't begin or end with a space")
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(node); i++ {
+		c := node[i]
+		esc, ok := jidNodeEscapes[c]
+		if !ok || (c == '\\' && !isJIDNodeEscape(node[i:])) {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteString(esc)
+	}
+	return buf.String(), nil
+}
+
+// UnescapeNode turns every XEP-0106 escape sequence contained
+// in a JID node part back into its original character.
+// (https://xmpp.org/extensions/xep-0106.html)
+func UnescapeNode(node string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(node); i++ {
+		if isJIDNodeEscape(node[i:]) {
+			buf.WriteByte(jidNodeUnescapes[node[i:i+3]])
+			i += 2
+			continue
+		}
+		buf.WriteByte(node[i])
+	}
+	return buf.String()
+}
+
+// isJIDNodeEscape returns whether or not s starts with an escape sequence.
+func isJIDNodeEscape(s string) bool {
+	if len(s) < 3 || s[0] != '\\' {
+		return false
+	}
+	_, ok := jidNodeUnescapes[s[:3]]
+	return ok
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml_test
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJIDEscape_Characters(t *testing.T) {
+	escapes := map[string]string{
+		"a b":  `a\20b`,
+		`a"b`:  `a\22b`,
+		"a&b":  `a\26b`,
+		"a'b":  `a\27b`,
+		"a/b":  `a\2fb`,
+		"a:b":  `a\3ab`,
+		"a<b":  `a\3cb`,
+		"a>b":  `a\3eb`,
+		"a@b":  `a\40b`,
+		`a\5c`: `a\5c5c`,
+	}
+	for node, escaped := range escapes {
+		esc, err := xml.EscapeNode(node)
+		require.Nil(t, err)
+		require.Equal(t, escaped, esc)
+		require.Equal(t, node, xml.UnescapeNode(esc))
+	}
+	_, err := xml.EscapeNode(" space")
+	require.NotNil(t, err)
+	_, err = xml.EscapeNode("space ")
+	require.NotNil(t, err)
+}
+
+func TestJIDEscape_Examples(t *testing.T) {
+	// https://xmpp.org/extensions/xep-0106.html#examples
+	escapes := map[string]string{
+		"space cadet":         `space\20cadet`,
+		`call me "ishmael"`:   `call\20me\20\22ishmael\22`,
+		"at&t guy":            `at\26t\20guy`,
+		"d'artagnan":          `d\27artagnan`,
+		"/.fanboy":            `\2f.fanboy`,
+		"::foo::":             `\3a\3afoo\3a\3a`,
+		"<foo>":               `\3cfoo\3e`,
+		"user@host":           `user\40host`,
+		`c:\net`:              `c\3a\net`,
+		`c:\\net`:             `c\3a\\net`,
+		`c:\cool stuff`:       `c\3a\cool\20stuff`,
+		`c:\5commas`:          `c\3a\5c5commas`,
+		`tom\20jones`:         `tom\5c20jones`,
+		`\5c`:                 `\5c5c`,
+		`trailing backslash\`: `trailing\20backslash\`,
+	}
+	for node, escaped := range escapes {
+		esc, err := xml.EscapeNode(node)
+		require.Nil(t, err)
+		require.Equal(t, escaped, esc)
+		require.Equal(t, node, xml.UnescapeNode(esc))
+	}
+}
+
+func TestJIDEscape_DoubleEscaping(t *testing.T) {
+	esc, _ := xml.EscapeNode("user@host")
+	require.Equal(t, `user\40host`, esc)
+
+	// escaping an already escaped node escapes its backslashes only
+	esc2, _ := xml.EscapeNode(esc)
+	require.Equal(t, `user\5c40host`, esc2)
+	require.Equal(t, esc, xml.UnescapeNode(esc2))
+	require.Equal(t, "user@host", xml.UnescapeNode(xml.UnescapeNode(esc2)))
+
+	// unrecognized sequences are kept as they are
+	require.Equal(t, `\2g\41\`, xml.UnescapeNode(`\2g\41\`))
+	require.Equal(t, `\2F`, xml.UnescapeNode(`\2F`))
+}
+
+func TestJIDEscape_JIDString(t *testing.T) {
+	node, _ := xml.EscapeNode(`call me "ishmael" @ d'artagnan's <home>`)
+
+	j, err := xml.NewJIDString(node+"@jackal.im/res@home/garden", false)
+	require.Nil(t, err)
+	require.Equal(t, node, j.Node())
+	require.Equal(t, "jackal.im", j.Domain())
+	require.Equal(t, "res@home/garden", j.Resource())
+	require.Equal(t, node+"@jackal.im/res@home/garden", j.String())
+	require.Equal(t, `call me "ishmael" @ d'artagnan's <home>`, xml.UnescapeNode(j.Node()))
+
+	j2, err := xml.NewJIDString(j.String(), false)
+	require.Nil(t, err)
+	require.True(t, j.Matches(j2, xml.JIDMatchesNode|xml.JIDMatchesDomain|xml.JIDMatchesResource))
+
+	// server JID resource may hold an '@' character
+	j, err = xml.NewJIDString("jackal.im/res@home", false)
+	require.Nil(t, err)
+	require.Equal(t, "", j.Node())
+	require.Equal(t, "jackal.im", j.Domain())
+	require.Equal(t, "res@home", j.Resource())
+
+	// unescaped disallowed characters are still rejected
+	_, err = xml.NewJIDString(`call me "ishmael"@jackal.im`, false)
+	require.NotNil(t, err)
+}
@@ -111,4 +111,15 @@ func TestBadPrep(t *testing.T) {
 	j3, err := xml.NewJID("ortuman", "example.org", basResource, false)
 	require.Nil(t, j3)
 	require.NotNil(t, err)
+
+	// NUL and control characters
+	j4, err := xml.NewJIDString("ortuman@example.org/res\x00admin", false)
+	require.Nil(t, j4)
+	require.NotNil(t, err)
+	j5, err := xml.NewJID("ortu\nman", "example.org", "res", false)
+	require.Nil(t, j5)
+	require.NotNil(t, err)
+	j6, err := xml.NewJID("ortuman", "example.org\x7f", "res", false)
+	require.Nil(t, j6)
+	require.NotNil(t, err)
 }
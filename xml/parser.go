@@ -6,26 +6,47 @@
 package xml
 
 import (
+	"bufio"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 const rootElementIndex = -1
 
 const streamName = "stream"
 
-// ErrStreamClosedByPeer is returned by Parse when peer closes the stream.
-var ErrStreamClosedByPeer = errors.New("stream closed by peer")
+// maximum element nesting depth accepted by the parser
+const maxElementDepth = 128
+
+var (
+	// ErrStreamClosedByPeer is returned by Parse when peer closes the stream.
+	ErrStreamClosedByPeer = errors.New("stream closed by peer")
+
+	// ErrTooLargeStanza is returned by Parse when an element
+	// exceeds the parser maximum stanza size.
+	ErrTooLargeStanza = errors.New("too large stanza")
+
+	// ErrTooDeepElement is returned by Parse when an element
+	// exceeds the maximum nesting depth.
+	ErrTooDeepElement = errors.New("too deeply nested element")
+
+	// ErrRestrictedXML is returned by Parse when input contains
+	// a document type declaration or a non predefined entity reference.
+	ErrRestrictedXML = errors.New("restricted xml")
+)
 
 // Parser parses arbitrary XML input and builds an array with the structure of all tag and data elements.
 type Parser struct {
-	dec          *xml.Decoder
-	nextElement  *Element
-	parsingIndex int
-	parsingStack []*Element
-	inElement    bool
+	dec           *xml.Decoder
+	lr            *limitedReader
+	maxStanzaSize int64
+	nextElement   *Element
+	parsingIndex  int
+	parsingStack  []*Element
+	inElement     bool
 }
 
 // NewParser creates an empty Parser instance.
@@ -33,19 +54,45 @@ func NewParser(reader io.Reader) *Parser {
 	return &Parser{dec: xml.NewDecoder(reader), parsingIndex: rootElementIndex}
 }
 
+// NewLimitedParser creates an empty Parser instance that fails
+// with ErrTooLargeStanza as soon as an element exceeds maxStanzaSize bytes,
+// without reading it entirely.
+func NewLimitedParser(reader io.Reader, maxStanzaSize int) *Parser {
+	lr := &limitedReader{r: reader}
+	return &Parser{
+		dec:           xml.NewDecoder(bufio.NewReaderSize(lr, readAheadSize)),
+		lr:            lr,
+		maxStanzaSize: int64(maxStanzaSize),
+		parsingIndex:  rootElementIndex,
+	}
+}
+
 // ParseElement parses next available XML element from reader.
 func (p *Parser) ParseElement() (XElement, error) {
 	d := p.dec
+	if p.lr != nil {
+		// bytes read ahead while parsing previous element
+		// are not accounted, so allow one extra buffer
+		p.lr.n = p.maxStanzaSize + readAheadSize
+	}
+	startOffset := d.InputOffset()
 	t, err := d.RawToken()
 	if err != nil {
-		return nil, err
+		return nil, parseError(err)
 	}
 	for {
 		switch t1 := t.(type) {
 		case xml.ProcInst:
 			return nil, nil
 
+		case xml.Directive:
+			// DTDs and entity declarations are never allowed (RFC 6120 11.1)
+			return nil, ErrRestrictedXML
+
 		case xml.StartElement:
+			if p.parsingIndex+1 >= maxElementDepth {
+				return nil, ErrTooDeepElement
+			}
 			p.startElement(t1)
 			if t1.Name.Local == streamName && t1.Name.Space == streamName {
 				p.closeElement()
@@ -67,9 +114,15 @@ func (p *Parser) ParseElement() (XElement, error) {
 				goto done
 			}
 		}
+		if p.maxStanzaSize > 0 && d.InputOffset()-startOffset > p.maxStanzaSize {
+			return nil, ErrTooLargeStanza
+		}
 		t, err = d.RawToken()
 		if err != nil {
-			return nil, err
+			if err == io.EOF && p.parsingIndex != rootElementIndex {
+				return nil, io.ErrUnexpectedEOF // truncated element
+			}
+			return nil, parseError(err)
 		}
 	}
 done:
@@ -124,9 +177,40 @@ func (p *Parser) closeElement() {
 	p.inElement = false
 }
 
+// parseError maps decoder errors caused by entity references other
+// than the predefined ones, which are never expanded, to ErrRestrictedXML.
+func parseError(err error) error {
+	if synErr, ok := err.(*xml.SyntaxError); ok && strings.HasPrefix(synErr.Msg, "invalid character entity") {
+		return ErrRestrictedXML
+	}
+	return err
+}
+
 func xmlName(space, local string) string {
 	if len(space) > 0 {
 		return fmt.Sprintf("%s:%s", space, local)
 	}
 	return local
 }
+
+// size of the buffer reading ahead from a limited parser reader
+const readAheadSize = 4096
+
+// limitedReader reads from r failing with ErrTooLargeStanza
+// once n bytes have been read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, ErrTooLargeStanza
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
@@ -41,10 +41,47 @@ func TestParser_FailedDocParse(t *testing.T) {
 	docSrc2 := `<element a="attr1">\n`
 	p = xml.NewParser(strings.NewReader(docSrc2))
 	element, err := p.ParseElement()
-	require.Equal(t, io.EOF, err)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
 	require.Nil(t, element)
 }
 
+func TestParser_MaxStanzaSize(t *testing.T) {
+	elem := xml.NewElementName("a")
+	elem.SetText(strings.Repeat("b", 1024))
+	docSrc := elem.String()
+
+	p := xml.NewLimitedParser(strings.NewReader(docSrc+docSrc), 2048)
+	for i := 0; i < 2; i++ {
+		a, err := p.ParseElement()
+		require.Nil(t, err)
+		require.Equal(t, 1024, len(a.Text()))
+	}
+
+	// oversized multi token element
+	children := strings.Repeat("<b>"+strings.Repeat("c", 512)+"</b>", 64)
+	p = xml.NewLimitedParser(strings.NewReader("<a>"+children+"</a>"), 2048)
+	_, err := p.ParseElement()
+	require.Equal(t, xml.ErrTooLargeStanza, err)
+
+	// oversized single token element
+	p = xml.NewLimitedParser(strings.NewReader("<a>"+strings.Repeat("b", 1<<20)+"</a>"), 2048)
+	_, err = p.ParseElement()
+	require.Equal(t, xml.ErrTooLargeStanza, err)
+}
+
+func TestParser_MaxDepth(t *testing.T) {
+	docSrc := strings.Repeat("<a>", 64) + strings.Repeat("</a>", 64)
+	p := xml.NewParser(strings.NewReader(docSrc))
+	a, err := p.ParseElement()
+	require.Nil(t, err)
+	require.NotNil(t, a)
+
+	docSrc = strings.Repeat("<a>", 10000) + strings.Repeat("</a>", 10000)
+	p = xml.NewParser(strings.NewReader(docSrc))
+	_, err = p.ParseElement()
+	require.Equal(t, xml.ErrTooDeepElement, err)
+}
+
 func TestParser_Close(t *testing.T) {
 	src := `</stream:stream>\n`
 	p := xml.NewParser(strings.NewReader(src))
@@ -84,6 +121,32 @@ func TestParser_DocChildElements(t *testing.T) {
 	require.Equal(t, "c", childs[2].Name())
 }
 
+func TestParser_RestrictedXML(t *testing.T) {
+	docSrc := `<?xml version="1.0"?>
+<!DOCTYPE lolz [
+ <!ENTITY lol "lol">
+ <!ENTITY lol2 "&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;">
+]>
+<lolz>&lol2;</lolz>`
+	p := xml.NewParser(strings.NewReader(docSrc))
+	_, err := p.ParseElement() // xml header
+	require.Nil(t, err)
+	_, err = p.ParseElement() // whitespace between header and DOCTYPE
+	require.Nil(t, err)
+	_, err = p.ParseElement()
+	require.Equal(t, xml.ErrRestrictedXML, err)
+
+	p = xml.NewParser(strings.NewReader(`<lolz>&lol2;</lolz>`))
+	_, err = p.ParseElement()
+	require.Equal(t, xml.ErrRestrictedXML, err)
+
+	// predefined entities
+	p = xml.NewParser(strings.NewReader(`<a>&amp;&lt;&gt;&quot;&apos;</a>`))
+	a, err := p.ParseElement()
+	require.Nil(t, err)
+	require.Equal(t, `&<>"'`, a.Text())
+}
+
 func TestStream(t *testing.T) {
 	openStreamXML := `<stream:stream xmlns:stream="http://etherx.jabber.org/streams" version="1.0" xmlns="jabber:client" to="localhost" xml:lang="en" xmlns:xml="http://www.w3.org/XML/1998/namespace"> `
 	p := xml.NewParser(strings.NewReader(openStreamXML))
@@ -29,6 +29,9 @@ const (
 
 	// UnsubscribedType represents a 'unsubscribed' Presence type.
 	UnsubscribedType = "unsubscribed"
+
+	// ProbeType represents a 'probe' Presence type.
+	ProbeType = "probe"
 )
 
 // ShowState represents Presence show state.
@@ -131,6 +134,11 @@ func (p *Presence) IsUnsubscribed() bool {
 	return p.Type() == UnsubscribedType
 }
 
+// IsProbe returns true if this is a 'probe' type Presence.
+func (p *Presence) IsProbe() bool {
+	return p.Type() == ProbeType
+}
+
 // Status returns presence stanza default status.
 func (p *Presence) Status() string {
 	if st := p.Elements().Child("status"); st != nil {
@@ -173,7 +181,7 @@ func (p *Presence) SetFromJID(from *JID) {
 
 func isPresenceType(presenceType string) bool {
 	switch presenceType {
-	case "", ErrorType, AvailableType, UnavailableType, SubscribeType, UnsubscribeType, SubscribedType, UnsubscribedType:
+	case "", ErrorType, AvailableType, UnavailableType, SubscribeType, UnsubscribeType, SubscribedType, UnsubscribedType, ProbeType:
 		return true
 	default:
 		return false
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+const stanzaIDNamespace = "urn:xmpp:sid:0"
+
+// NewStanzaID creates a Unique and Stable Stanza ID (XEP-0359) element
+// holding the identifier assigned to a stanza by a given entity.
+func NewStanzaID(id, by string) *Element {
+	sid := NewElementNamespace("stanza-id", stanzaIDNamespace)
+	sid.SetAttribute("id", id)
+	sid.SetAttribute("by", by)
+	return sid
+}
+
+// StanzaID returns the identifier assigned to an element by a given entity,
+// or an empty string if it has not been assigned one.
+func (e *Element) StanzaID(by string) string {
+	for _, sid := range e.elements.ChildrenNamespace("stanza-id", stanzaIDNamespace) {
+		if sid.Attributes().Get("by") == by {
+			return sid.Attributes().Get("id")
+		}
+	}
+	return ""
+}
+
+// SetStanzaID assigns element an identifier on behalf of a given entity,
+// replacing any other one claiming to be assigned by it.
+func (e *Element) SetStanzaID(id, by string) {
+	e.RemoveStanzaID(by)
+	e.AppendElement(NewStanzaID(id, by))
+}
+
+// RemoveStanzaID removes every identifier claiming
+// to be assigned to element by a given entity.
+func (e *Element) RemoveStanzaID(by string) {
+	filtered := e.elements[:0]
+	for _, elem := range e.elements {
+		if elem.Name() != "stanza-id" || elem.Namespace() != stanzaIDNamespace || elem.Attributes().Get("by") != by {
+			filtered = append(filtered, elem)
+		}
+	}
+	e.elements = filtered
+}
+
+// OriginID returns the identifier assigned to an element by its originating entity,
+// or an empty string if it has not been assigned one.
+func (e *Element) OriginID() string {
+	if oid := e.elements.ChildNamespace("origin-id", stanzaIDNamespace); oid != nil {
+		return oid.Attributes().Get("id")
+	}
+	return ""
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml_test
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStanzaID(t *testing.T) {
+	e := xml.NewElementName("message")
+	require.Equal(t, "", e.StanzaID("ortuman@jackal.im"))
+
+	oid := xml.NewElementNamespace("origin-id", "urn:xmpp:sid:0")
+	oid.SetAttribute("id", "de305d54")
+	e.AppendElement(oid)
+	e.AppendElement(xml.NewStanzaID("5f3dbc5e", "jackal.im"))
+	e.AppendElement(xml.NewStanzaID("f00ba7", "ortuman@jackal.im"))
+
+	require.Equal(t, "de305d54", e.OriginID())
+	require.Equal(t, "5f3dbc5e", e.StanzaID("jackal.im"))
+	require.Equal(t, "f00ba7", e.StanzaID("ortuman@jackal.im"))
+
+	// assigned identifier replaces any spoofed one
+	e.SetStanzaID("28482098", "ortuman@jackal.im")
+	require.Equal(t, "28482098", e.StanzaID("ortuman@jackal.im"))
+	require.Equal(t, 2, len(e.Elements().ChildrenNamespace("stanza-id", "urn:xmpp:sid:0")))
+
+	e.RemoveStanzaID("jackal.im")
+	require.Equal(t, "", e.StanzaID("jackal.im"))
+	require.Equal(t, "28482098", e.StanzaID("ortuman@jackal.im"))
+	require.Equal(t, "de305d54", e.OriginID())
+}